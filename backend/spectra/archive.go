@@ -0,0 +1,161 @@
+// Simulated archive storage for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// Storage tiers reported by GetTier
+const (
+	tierStandard = "STANDARD"
+	tierArchive  = "ARCHIVE"
+)
+
+// archived returns whether the object at spectraPath is in the archive
+// tier, as chosen by archive_rate from the world's seed and the path.
+func (f *Fs) archived(spectraPath string) bool {
+	if f.opt.ArchiveRate <= 0 {
+		return false
+	}
+	return pathFraction(f.worldSeed(), "archive", spectraPath) < f.opt.ArchiveRate
+}
+
+// initRestores creates the table recording restores of archived
+// objects.
+//
+// It lives alongside the nodes in the database, which the SDK leaves
+// alone, so restores requested by one rclone run are seen by the next.
+func (f *Fs) initRestores(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_restores (
+	world      TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	ready_at   INTEGER NOT NULL, -- Unix milliseconds
+	expires_at INTEGER NOT NULL, -- Unix milliseconds
+	PRIMARY KEY (world, path)
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create restores table: %w", err)
+	}
+	return nil
+}
+
+// restoreState reads when the restore of the object at spectraPath is
+// ready and when it expires, returning zero times if there isn't one.
+func (f *Fs) restoreState(ctx context.Context, spectraPath string) (readyAt, expiresAt time.Time, err error) {
+	var ready, expires int64
+	err = f.db.QueryRowContext(ctx, `
+SELECT ready_at, expires_at FROM spectra_restores WHERE world = ? AND path = ?`,
+		f.opt.World, spectraPath).Scan(&ready, &expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return readyAt, expiresAt, nil
+	}
+	if err != nil {
+		return readyAt, expiresAt, fmt.Errorf("failed to read restore of %q: %w", spectraPath, err)
+	}
+	return time.UnixMilli(ready), time.UnixMilli(expires), nil
+}
+
+// restore requests a restore of the archived object at spectraPath
+// which stays available for lifetime once ready, returning when it will
+// be ready.
+//
+// A restore which is in progress or ready keeps its ready time and has
+// its lifetime extended, as with Glacier: a ready restore stays
+// available for lifetime from now.
+func (f *Fs) restore(ctx context.Context, spectraPath string, lifetime time.Duration) (time.Time, error) {
+	now := f.clock.Now()
+	readyAt, expiresAt, err := f.restoreState(ctx, spectraPath)
+	if err != nil {
+		return readyAt, err
+	}
+	if !now.Before(expiresAt) {
+		readyAt = now.Add(time.Duration(f.opt.RestoreDelay))
+	}
+	expiresAt = readyAt.Add(lifetime)
+	if now.After(readyAt) {
+		expiresAt = now.Add(lifetime)
+	}
+	_, err = f.db.ExecContext(ctx, `
+INSERT OR REPLACE INTO spectra_restores (world, path, ready_at, expires_at) VALUES (?, ?, ?, ?)`,
+		f.opt.World, spectraPath, readyAt.UnixMilli(), expiresAt.UnixMilli())
+	if err != nil {
+		return readyAt, fmt.Errorf("failed to restore %q: %w", spectraPath, err)
+	}
+	return readyAt, nil
+}
+
+// checkRestored returns an error unless the archived object at
+// spectraPath has a restore which is ready.
+//
+// The errors aren't retried as the restore takes far longer than the
+// retries would.
+func (f *Fs) checkRestored(ctx context.Context, spectraPath string) error {
+	readyAt, expiresAt, err := f.restoreState(ctx, spectraPath)
+	if err != nil {
+		return err
+	}
+	now := f.clock.Now()
+	switch {
+	case !now.Before(expiresAt):
+		return fserrors.NoRetryError(errors.New(`object is archived: restore it with "rclone backend restore" first`))
+	case now.Before(readyAt):
+		return fserrors.NoRetryError(fmt.Errorf("restore in progress: ready in %v", readyAt.Sub(now).Round(time.Second)))
+	}
+	return nil
+}
+
+// GetTier returns the storage tier of the object
+func (o *Object) GetTier() string {
+	if o.fs.archived(o.spectraPath()) {
+		return tierArchive
+	}
+	return tierStandard
+}
+
+// restoreStatus is the result of restoring one object
+type restoreStatus struct {
+	Remote  string `json:"remote"`
+	Status  string `json:"status"`
+	ReadyAt string `json:"readyAt,omitempty"`
+}
+
+// restoreObjects requests restores of the archived objects in the
+// remote, which stay available for lifetime once ready.
+func (f *Fs) restoreObjects(ctx context.Context, lifetime time.Duration) ([]restoreStatus, error) {
+	if f.opt.ArchiveRate <= 0 {
+		return nil, errors.New("no objects are archived: set archive_rate")
+	}
+	var out []restoreStatus
+	err := operations.ListFn(ctx, f, func(obj fs.Object) {
+		st := restoreStatus{Remote: obj.Remote(), Status: "not archived"}
+		spectraPath := f.toSpectraPath(obj.Remote())
+		if f.archived(spectraPath) {
+			readyAt, err := f.restore(ctx, spectraPath, lifetime)
+			if err != nil {
+				st.Status = err.Error()
+			} else {
+				st.Status = "OK"
+				st.ReadyAt = readyAt.UTC().Format(time.RFC3339)
+			}
+		}
+		out = append(out, st)
+	})
+	if err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.GetTierer = (*Object)(nil)
+)
@@ -0,0 +1,171 @@
+// Stored modification times and metadata for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// initAttributes creates the table holding the metadata of nodes.
+//
+// Modification times are kept on the nodes themselves. The metadata of
+// nodes which no longer exist, as the world was recreated, is dropped.
+func (f *Fs) initAttributes(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_attributes (
+	node_id TEXT NOT NULL,
+	key     TEXT NOT NULL,
+	value   TEXT NOT NULL,
+	PRIMARY KEY (node_id, key)
+);
+DELETE FROM spectra_attributes WHERE node_id NOT IN (SELECT id FROM nodes)`)
+	if err != nil {
+		return fmt.Errorf("failed to create attributes table: %w", err)
+	}
+	return nil
+}
+
+// keepsAttributes returns whether modification times and metadata can
+// be set, either in the database or by the engine
+func (f *Fs) keepsAttributes() bool {
+	return f.db != nil || keepsAttributes(f.engine)
+}
+
+// nodeID returns id, or the ID of the node at spectraPath if id isn't
+// known
+func (f *Fs) nodeID(ctx context.Context, spectraPath, id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	node, err := f.getNode(ctx, spectraPath)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", fs.ErrorObjectNotFound
+	}
+	return node.ID, nil
+}
+
+// setModTime sets the modification time of the node with id
+func (f *Fs) setModTime(ctx context.Context, id string, modTime time.Time) error {
+	if f.db != nil {
+		result, err := f.db.ExecContext(ctx, `UPDATE nodes SET last_updated = ? WHERE id = ?`, modTime, id)
+		if err != nil {
+			return fmt.Errorf("failed to set modification time: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to set modification time: %w", err)
+		} else if n == 0 {
+			// Removed since it was looked up
+			return fs.ErrorObjectNotFound
+		}
+		return nil
+	}
+	if !keepsAttributes(f.engine) {
+		return fs.ErrorCantSetModTime
+	}
+	_, err := retryBusy(f.opt.OpTimeout, func() (*sdk.Node, error) {
+		return f.engine.(attributeKeeper).SetModTime(id, modTime)
+	})
+	if isNotFound(err) {
+		return fs.ErrorObjectNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set modification time: %w", err)
+	}
+	return nil
+}
+
+// attributes returns the metadata stored for the node with id, or nil
+// if there is none or it can't be stored
+func (f *Fs) attributes(ctx context.Context, id string) (attrs map[string]string, err error) {
+	if id == "" {
+		return nil, nil
+	}
+	if f.db != nil {
+		var rows *sql.Rows
+		rows, err = f.db.QueryContext(ctx, `SELECT key, value FROM spectra_attributes WHERE node_id = ?`, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata: %w", err)
+		}
+		defer fs.CheckClose(rows, &err)
+		for rows.Next() {
+			var key, value string
+			if err = rows.Scan(&key, &value); err != nil {
+				return nil, fmt.Errorf("failed to read metadata: %w", err)
+			}
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			attrs[key] = value
+		}
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read metadata: %w", err)
+		}
+		return attrs, nil
+	}
+	if !keepsAttributes(f.engine) {
+		return nil, nil
+	}
+	attrs, err = retryBusy(f.opt.OpTimeout, func() (map[string]string, error) {
+		return f.engine.(attributeKeeper).Attributes(id)
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return attrs, nil
+}
+
+// storeAttributes replaces the metadata stored for the node with id
+// with attrs
+func (f *Fs) storeAttributes(ctx context.Context, id string, attrs map[string]string) (err error) {
+	if f.db != nil {
+		var tx *sql.Tx
+		tx, err = f.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to store metadata: %w", err)
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+			}
+		}()
+		if _, err = tx.ExecContext(ctx, `DELETE FROM spectra_attributes WHERE node_id = ?`, id); err != nil {
+			return fmt.Errorf("failed to store metadata: %w", err)
+		}
+		for key, value := range attrs {
+			_, err = tx.ExecContext(ctx, `
+INSERT INTO spectra_attributes (node_id, key, value) VALUES (?, ?, ?)`,
+				id, key, value)
+			if err != nil {
+				return fmt.Errorf("failed to store metadata: %w", err)
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("failed to store metadata: %w", err)
+		}
+		return nil
+	}
+	if !keepsAttributes(f.engine) {
+		return fs.ErrorNotImplemented
+	}
+	_, err = retryBusy(f.opt.OpTimeout, func() (struct{}, error) {
+		return struct{}{}, f.engine.(attributeKeeper).SetAttributes(id, attrs)
+	})
+	if isNotFound(err) {
+		return fs.ErrorObjectNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store metadata: %w", err)
+	}
+	return nil
+}
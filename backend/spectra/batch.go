@@ -0,0 +1,188 @@
+// Batched node lookups for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// parentPath returns the Spectra path of the parent of spectraPath
+func parentPath(spectraPath string) string {
+	parent := path.Dir(spectraPath)
+	if parent == "." {
+		parent = "/"
+	}
+	return parent
+}
+
+// listChildren lists the children of the directory at spectraPath in
+// the current world, generating them if necessary unless lazy
+// generation is off.
+//
+// It returns nil and no error if the directory doesn't exist.
+//
+// Concurrent listings of the same directory are coalesced into one
+// SDK call. The children listed are kept in the node cache.
+func (f *Fs) listChildren(ctx context.Context, spectraPath string) (*sdk.ListResult, error) {
+	gen := f.nodeCache.generation()
+	result, err := f.readChildren(ctx, spectraPath)
+	if result != nil {
+		children := make([]*sdk.Node, 0, len(result.Folders)+len(result.Files))
+		for i := range result.Folders {
+			children = append(children, &result.Folders[i].Node)
+		}
+		for i := range result.Files {
+			children = append(children, &result.Files[i].Node)
+		}
+		f.nodeCache.put(gen, spectraPath, children)
+	}
+	return result, err
+}
+
+// readChildren lists the children of the directory at spectraPath for
+// listChildren
+func (f *Fs) readChildren(ctx context.Context, spectraPath string) (*sdk.ListResult, error) {
+	if err := f.simulateChurn(ctx); err != nil {
+		return nil, err
+	}
+	if !f.opt.Lazy {
+		return f.listStored(ctx, spectraPath)
+	}
+	result, err := f.listCoalescer.do(spectraPath, func() (*sdk.ListResult, error) {
+		return f.sdkListChildren(ctx, spectraPath, f.opt.World)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := resultError(result); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list %q: %w", spectraPath, err)
+	}
+	return result, nil
+}
+
+// getNodes looks up the nodes at spectraPaths in the current world
+// and returns the ones which exist keyed by path.
+//
+// The paths are grouped by parent directory and each parent is listed
+// once, which also triggers lazy generation, so looking up many
+// entries of the same directory costs a single SDK call rather than a
+// ListChildren and a GetNode for each one. With an on disk database
+// the nodes already generated are read from it first and only the
+// parents of the rest are listed. Nodes whose parents were listed
+// recently are taken from the node cache without either. A parent which
+// hasn't been generated yet is looked up in turn, generating the path
+// down to it.
+func (f *Fs) getNodes(ctx context.Context, spectraPaths ...string) (map[string]*sdk.Node, error) {
+	// Cached nodes see the churn too
+	if err := f.simulateChurn(ctx); err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]*sdk.Node, len(spectraPaths))
+	uncached := make([]string, 0, len(spectraPaths))
+	for _, spectraPath := range spectraPaths {
+		node, ok := f.nodeCache.lookup(spectraPath)
+		if !ok {
+			uncached = append(uncached, spectraPath)
+		} else if node != nil {
+			nodes[spectraPath] = node
+		}
+	}
+	spectraPaths = uncached
+	if f.db != nil && len(spectraPaths) > 0 {
+		// Stat-ing a long list of files, as with --files-from,
+		// shouldn't list the parent of each one
+		stored, err := f.lookupNodes(ctx, spectraPaths)
+		if err != nil {
+			return nil, err
+		}
+		nodes = stored
+		missing := make([]string, 0, len(spectraPaths)-len(stored))
+		for _, spectraPath := range spectraPaths {
+			if nodes[spectraPath] == nil {
+				missing = append(missing, spectraPath)
+			}
+		}
+		spectraPaths = missing
+	}
+	byParent := make(map[string][]string)
+	var parents []string
+	for _, spectraPath := range spectraPaths {
+		if spectraPath == "/" {
+			// The root has no parent to list
+			node, err := f.nodeCoalescer.do(spectraPath, func() (*sdk.Node, error) {
+				return retryBusy(f.opt.OpTimeout, func() (*sdk.Node, error) {
+					return f.engine.GetNode(ctx, &sdk.GetNodeRequest{
+						Path:      spectraPath,
+						TableName: f.opt.World,
+					})
+				})
+			})
+			if err != nil {
+				return nil, err
+			}
+			nodes[spectraPath] = node
+			continue
+		}
+		parent := parentPath(spectraPath)
+		if _, ok := byParent[parent]; !ok {
+			parents = append(parents, parent)
+		}
+		byParent[parent] = append(byParent[parent], spectraPath)
+	}
+	for _, parent := range parents {
+		result, err := f.listChildren(ctx, parent)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil && parent != "/" && f.opt.Lazy {
+			// The parent may not be generated yet, so look it up,
+			// which generates it, and list it again if it exists
+			node, err := f.getNode(ctx, parent)
+			if err != nil {
+				return nil, err
+			}
+			if node != nil && node.Type == sdk.NodeTypeFolder {
+				if result, err = f.listChildren(ctx, parent); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if result == nil {
+			continue
+		}
+		wanted := make(map[string]struct{}, len(byParent[parent]))
+		for _, spectraPath := range byParent[parent] {
+			wanted[spectraPath] = struct{}{}
+		}
+		for i := range result.Folders {
+			if _, ok := wanted[result.Folders[i].Path]; ok {
+				nodes[result.Folders[i].Path] = &result.Folders[i].Node
+			}
+		}
+		for i := range result.Files {
+			if _, ok := wanted[result.Files[i].Path]; ok {
+				nodes[result.Files[i].Path] = &result.Files[i].Node
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// getNode looks up the node at spectraPath in the current world,
+// returning nil and no error if it doesn't exist.
+//
+// The lookup goes via a listing of the parent so lookups of siblings
+// made at the same time coalesce into a single SDK call.
+func (f *Fs) getNode(ctx context.Context, spectraPath string) (*sdk.Node, error) {
+	nodes, err := f.getNodes(ctx, spectraPath)
+	if err != nil {
+		return nil, err
+	}
+	return nodes[spectraPath], nil
+}
@@ -0,0 +1,201 @@
+// Benchmark command for the Spectra backend
+package spectra
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// Phases of the bench command
+const (
+	benchList = "list" // listing directories
+	benchStat = "stat" // finding files
+	benchRead = "read" // reading files
+)
+
+// benchPhase is the result of one phase of the bench command
+type benchPhase struct {
+	Phase          string  `json:"phase"`
+	Ops            int64   `json:"ops"`
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	OpsPerSecond   float64 `json:"opsPerSecond"`
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	P50Seconds     float64 `json:"p50Seconds"`
+	P99Seconds     float64 `json:"p99Seconds"`
+	MaxSeconds     float64 `json:"maxSeconds"`
+}
+
+// benchResult is the result of the bench command
+type benchResult struct {
+	Remote  string       `json:"remote"`
+	World   string       `json:"world"`
+	Engine  string       `json:"engine"`
+	Started time.Time    `json:"started"`
+	Phases  []benchPhase `json:"phases"`
+}
+
+// benchTimer times the operations of one phase of the bench command
+type benchTimer struct {
+	phase     string
+	start     time.Time
+	latencies []time.Duration
+	bytes     int64
+}
+
+// newBenchTimer starts timing phase
+func newBenchTimer(phase string) *benchTimer {
+	return &benchTimer{phase: phase, start: time.Now()}
+}
+
+// time runs the operation fn, which returns the bytes it transferred,
+// and records how long it took
+func (t *benchTimer) time(fn func() (int64, error)) error {
+	start := time.Now()
+	n, err := fn()
+	t.latencies = append(t.latencies, time.Since(start))
+	t.bytes += n
+	return err
+}
+
+// result returns the result of the phase
+func (t *benchTimer) result() benchPhase {
+	elapsed := time.Since(t.start).Seconds()
+	p := benchPhase{
+		Phase:   t.phase,
+		Ops:     int64(len(t.latencies)),
+		Bytes:   t.bytes,
+		Seconds: elapsed,
+	}
+	if elapsed > 0 {
+		p.OpsPerSecond = float64(p.Ops) / elapsed
+		p.BytesPerSecond = float64(p.Bytes) / elapsed
+	}
+	if len(t.latencies) > 0 {
+		slices.Sort(t.latencies)
+		quantile := func(q float64) float64 {
+			return t.latencies[int(q*float64(len(t.latencies)-1))].Seconds()
+		}
+		p.P50Seconds = quantile(0.5)
+		p.P99Seconds = quantile(0.99)
+		p.MaxSeconds = quantile(1)
+	}
+	return p
+}
+
+// bench lists the remote down to maxDepth, one directory at a time,
+// then finds and reads up to files of the files listed, timing each
+// operation.
+//
+// The files are the first ones listed, so the same files are used on
+// every run against the same world.
+func (f *Fs) bench(ctx context.Context, maxDepth, files int) (*benchResult, error) {
+	out := &benchResult{
+		Remote:  f.name,
+		World:   f.opt.World,
+		Engine:  cmp.Or(f.opt.Engine, engineSDK),
+		Started: time.Now(),
+	}
+
+	// List breadth first so the files used are near the root
+	list := newBenchTimer(benchList)
+	var objects []fs.Object
+	dirs, depth := []string{""}, 0
+	for len(dirs) > 0 && (maxDepth < 0 || depth < maxDepth) {
+		var next []string
+		for _, dir := range dirs {
+			err := list.time(func() (int64, error) {
+				entries, err := f.List(ctx, dir)
+				if err != nil {
+					return 0, err
+				}
+				for _, entry := range entries {
+					switch x := entry.(type) {
+					case fs.Directory:
+						next = append(next, x.Remote())
+					case fs.Object:
+						if len(objects) < files {
+							objects = append(objects, x)
+						}
+					}
+				}
+				return 0, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("bench: failed to list %q: %w", dir, err)
+			}
+		}
+		dirs = next
+		depth++
+	}
+	out.Phases = append(out.Phases, list.result())
+
+	stat := newBenchTimer(benchStat)
+	for _, o := range objects {
+		err := stat.time(func() (int64, error) {
+			_, err := f.NewObject(ctx, o.Remote())
+			return 0, err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("bench: failed to find %q: %w", o.Remote(), err)
+		}
+	}
+	out.Phases = append(out.Phases, stat.result())
+
+	read := newBenchTimer(benchRead)
+	for _, o := range objects {
+		err := read.time(func() (n int64, err error) {
+			in, err := o.Open(ctx)
+			if err != nil {
+				return 0, err
+			}
+			defer fs.CheckClose(in, &err)
+			return io.Copy(io.Discard, in)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("bench: failed to read %q: %w", o.Remote(), err)
+		}
+	}
+	out.Phases = append(out.Phases, read.result())
+	return out, nil
+}
+
+// csvTable returns the result as one CSV table with a row per phase
+func (r *benchResult) csvTable() [][]string {
+	f64 := func(x float64) string { return strconv.FormatFloat(x, 'f', -1, 64) }
+	rows := [][]string{{"phase", "ops", "bytes", "seconds", "ops_per_second", "bytes_per_second", "p50_seconds", "p99_seconds", "max_seconds"}}
+	for _, p := range r.Phases {
+		rows = append(rows, []string{p.Phase, strconv.FormatInt(p.Ops, 10), strconv.FormatInt(p.Bytes, 10),
+			f64(p.Seconds), f64(p.OpsPerSecond), f64(p.BytesPerSecond), f64(p.P50Seconds), f64(p.P99Seconds), f64(p.MaxSeconds)})
+	}
+	return rows
+}
+
+// timeSeries returns the result as a point for each phase, tagged
+// with the remote, world, engine and phase
+func (r *benchResult) timeSeries() *timeSeries {
+	ts := &timeSeries{measurement: "spectra_bench", time: r.Started}
+	for _, p := range r.Phases {
+		ts.points = append(ts.points, seriesPoint{
+			tags: []seriesTag{{"remote", r.Remote}, {"world", r.World}, {"engine", r.Engine}, {"phase", p.Phase}},
+			fields: []seriesField{
+				{"ops", "Operations made in the phase.", float64(p.Ops)},
+				{"bytes", "Bytes read in the phase.", float64(p.Bytes)},
+				{"seconds", "How long the phase took.", p.Seconds},
+				{"ops_per_second", "Operations made per second.", p.OpsPerSecond},
+				{"bytes_per_second", "Bytes read per second.", p.BytesPerSecond},
+				{"p50_seconds", "Median latency of the operations.", p.P50Seconds},
+				{"p99_seconds", "99th percentile latency of the operations.", p.P99Seconds},
+				{"max_seconds", "Longest latency of the operations.", p.MaxSeconds},
+			},
+		})
+	}
+	return ts
+}
@@ -0,0 +1,175 @@
+// Content addressed storage of uploaded data for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// initBlobs creates the tables holding the data of uploaded files.
+//
+// Blobs are stored once per distinct content, keyed by SHA256, so
+// files with the same content share storage. Files are mapped to their
+// blob by node ID. The SDK makes new nodes whenever it starts so the
+// mappings left from earlier runs are dropped, but the blobs are kept
+// until the compact command removes them.
+func (f *Fs) initBlobs(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_blobs (
+	sha256      TEXT PRIMARY KEY,
+	size        INTEGER NOT NULL, -- size before compression
+	compression TEXT NOT NULL DEFAULT 'off',
+	encrypted   INTEGER NOT NULL DEFAULT 0,
+	data        BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS spectra_file_blobs (
+	node_id TEXT PRIMARY KEY,
+	sha256  TEXT NOT NULL
+);
+DELETE FROM spectra_file_blobs WHERE node_id NOT IN (SELECT id FROM nodes)`)
+	if err != nil {
+		return fmt.Errorf("failed to create blob tables: %w", err)
+	}
+	return nil
+}
+
+// storeBlob stores data as the content of the file with nodeID,
+// sharing the blob with any other file with the same content, and
+// corrects the size and checksum of the node which the SDK sets from
+// generated content. It returns the checksum committed.
+//
+// It does nothing without an on disk database, so uploaded files are
+// served with generated content, and returns "". New blobs are
+// compressed with db_compression then encrypted with db_key.
+func (f *Fs) storeBlob(ctx context.Context, nodeID string, data []byte) (string, error) {
+	return f.replaceBlob(ctx, nodeID, data, time.Time{})
+}
+
+// replaceBlob stores data as the content of the file with nodeID as
+// storeBlob does, replacing any content it had in place so it keeps
+// its node, and sets its modification time to modTime unless it is
+// zero.
+//
+// The content, size, checksum and modification time change in one
+// transaction, so the file is left as it was if it fails.
+func (f *Fs) replaceBlob(ctx context.Context, nodeID string, data []byte, modTime time.Time) (key string, err error) {
+	if f.db == nil {
+		return "", nil
+	}
+	sum := sha256.Sum256(data)
+	key = hex.EncodeToString(sum[:])
+	var exists bool
+	err = f.db.QueryRowContext(ctx, `SELECT count(*) > 0 FROM spectra_blobs WHERE sha256 = ?`, key).Scan(&exists)
+	if err != nil {
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	}
+	var (
+		stored []byte
+		method string
+	)
+	if !exists {
+		stored, method, err = compressBlob(f.opt.DBCompression, data)
+		if err != nil {
+			return "", err
+		}
+		if f.encrypted() {
+			if stored, err = f.seal(stored); err != nil {
+				return "", err
+			}
+		}
+	}
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if !exists {
+		_, err = tx.ExecContext(ctx, `
+INSERT OR IGNORE INTO spectra_blobs (sha256, size, compression, encrypted, data) VALUES (?, ?, ?, ?, ?)`,
+			key, len(data), method, f.encrypted(), stored)
+		if err != nil {
+			return "", fmt.Errorf("failed to store blob: %w", err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT OR REPLACE INTO spectra_file_blobs (node_id, sha256) VALUES (?, ?)`,
+		nodeID, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	}
+	// Hashes stored by hash-all are of the old content
+	_, err = tx.ExecContext(ctx, `DELETE FROM spectra_hashes WHERE node_id = ?`, nodeID)
+	if err != nil {
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	}
+	var result sql.Result
+	if modTime.IsZero() {
+		result, err = tx.ExecContext(ctx, `
+UPDATE nodes SET size = ?, checksum = ? WHERE id = ?`,
+			len(data), key, nodeID)
+	} else {
+		result, err = tx.ExecContext(ctx, `
+UPDATE nodes SET size = ?, checksum = ?, last_updated = ? WHERE id = ?`,
+			len(data), key, modTime, nodeID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	} else if n == 0 {
+		// Removed since it was looked up
+		return "", fs.ErrorObjectNotFound
+	}
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to store blob: %w", err)
+	}
+	return key, nil
+}
+
+// loadBlob returns the stored content of the file with nodeID, or nil
+// if it has none as its content is generated.
+func (f *Fs) loadBlob(ctx context.Context, nodeID string) ([]byte, error) {
+	if f.db == nil {
+		return nil, nil
+	}
+	var (
+		method    string
+		encrypted bool
+		data      []byte
+	)
+	err := f.db.QueryRowContext(ctx, `
+SELECT b.compression, b.encrypted, b.data FROM spectra_file_blobs fb JOIN spectra_blobs b ON b.sha256 = fb.sha256
+WHERE fb.node_id = ?`, nodeID).Scan(&method, &encrypted, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load blob: %w", err)
+	}
+	if encrypted {
+		if data, err = f.unseal(data); err != nil {
+			return nil, err
+		}
+	}
+	data, err = decompressBlob(method, data)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		// Distinguish empty files from generated ones
+		data = []byte{}
+	}
+	return data, nil
+}
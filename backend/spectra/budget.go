@@ -0,0 +1,49 @@
+// Operation budgets for the Spectra backend
+package spectra
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// budgetError is returned once a remote has used up its max_api_calls
+// or max_read_bytes
+type budgetError struct {
+	limit  string // the option whose budget is used up
+	budget int64  // the budget set
+	bytes  bool   // whether budget is a size in bytes
+}
+
+// Error returns the error message
+func (e *budgetError) Error() string {
+	if e.bytes {
+		return fmt.Sprintf("spectra: operation budget exceeded: reading more than %s of file data is over %s", fs.SizeSuffix(e.budget), e.limit)
+	}
+	return fmt.Sprintf("spectra: operation budget exceeded: making more than %d API calls is over %s", e.budget, e.limit)
+}
+
+// Fatal returns true so rclone stops rather than carrying on against
+// the budget
+func (e *budgetError) Fatal() bool {
+	return true
+}
+
+// spendCall counts an API call against max_api_calls, returning a
+// budgetError if it would go over it
+func (f *Fs) spendCall() error {
+	if f.opt.MaxAPICalls <= 0 {
+		return nil
+	}
+	if f.apiCalls.Add(1) > f.opt.MaxAPICalls {
+		return &budgetError{limit: "max_api_calls", budget: f.opt.MaxAPICalls}
+	}
+	return nil
+}
+
+// newEgressReader returns in counting the bytes read through it as
+// egress and failing reads past max_read_bytes
+func (f *Fs) newEgressReader(in io.Reader) io.Reader {
+	return &egressReader{in: in, egress: &f.costs.egress, budget: int64(f.opt.MaxReadBytes)}
+}
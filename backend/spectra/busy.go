@@ -0,0 +1,161 @@
+// Retrying busy database operations for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/mattn/go-sqlite3"
+	"github.com/rclone/rclone/fs"
+)
+
+// Retries of SDK calls failing as the database is busy
+const (
+	busyTimeout  = 10 * time.Second // stop retrying after this long, as the backend's own connection does
+	busyMinSleep = time.Millisecond
+	busyMaxSleep = 100 * time.Millisecond
+)
+
+// isBusy returns whether err is SQLite failing as another connection
+// holds a lock on the database
+func isBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	// The SDK doesn't always wrap the errors it returns
+	return isBusyMessage(err.Error())
+}
+
+// isBusyMessage returns whether msg reports the database being busy
+func isBusyMessage(msg string) bool {
+	return strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// opTimeoutError is returned when an SDK call takes longer than
+// op_timeout
+//
+// It is retriable, as a request timing out at a provider would be.
+type opTimeoutError struct {
+	timeout time.Duration // the op_timeout which passed
+}
+
+// Error returns the error message
+func (e *opTimeoutError) Error() string {
+	return fmt.Sprintf("spectra: SDK call timed out after op_timeout of %v", e.timeout)
+}
+
+// Retry returns true as the operation may be retried
+func (e *opTimeoutError) Retry() bool {
+	return true
+}
+
+// Temporary returns true so low level retries retry the operation
+func (e *opTimeoutError) Temporary() bool {
+	return true
+}
+
+// Timeout returns true as the call timed out
+func (e *opTimeoutError) Timeout() bool {
+	return true
+}
+
+// callWithin calls fn, returning an opTimeoutError if it doesn't return
+// within timeout. SDK calls can't be cancelled, so fn carries on in the
+// background and its result is dropped. A timeout of 0 waits for fn
+// however long it takes.
+func callWithin[T any](timeout time.Duration, fn func() (T, error)) (T, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		val T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		done <- result{val, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.val, r.err
+	case <-timer.C:
+		var zero T
+		return zero, &opTimeoutError{timeout: timeout}
+	}
+}
+
+// retryBusy calls fn, which makes an SDK call, until it doesn't fail
+// with the database busy or busyTimeout passes. Each call fails with
+// an opTimeoutError if it takes longer than opTimeout, unless that is
+// 0.
+//
+// The SDK's connection only waits 5 seconds for a lock held by the
+// backend's own connection, or another rclone using the same database,
+// and doesn't wait at all when upgrading one of its transactions to
+// write would deadlock. Each call is one short transaction so
+// retrying it is safe. The sleeps back off with jitter so many
+// transfers waiting on the lock don't retry in step.
+func retryBusy[T any](opTimeout fs.Duration, fn func() (T, error)) (T, error) {
+	deadline := time.Now().Add(busyTimeout)
+	sleep := busyMinSleep
+	for {
+		result, err := callWithin(time.Duration(opTimeout), fn)
+		if !isBusy(err) || time.Now().After(deadline) {
+			return result, err
+		}
+		time.Sleep(sleep/2 + rand.N(sleep))
+		sleep = min(2*sleep, busyMaxSleep)
+	}
+}
+
+// sdkListChildren lists the children of parentPath in world, which
+// generates them if they haven't been, retrying while the database is
+// busy
+func (f *Fs) sdkListChildren(ctx context.Context, parentPath, world string) (*sdk.ListResult, error) {
+	return retryBusy(f.opt.OpTimeout, func() (*sdk.ListResult, error) {
+		result, err := f.engine.ListChildren(ctx, &sdk.ListChildrenRequest{
+			ParentPath: parentPath,
+			TableName:  world,
+		})
+		if err == nil && result != nil && !result.Success && isBusyMessage(result.Message) {
+			// The SDK reports some failures in the result
+			return result, errors.New(result.Message)
+		}
+		return result, err
+	})
+}
+
+// sdkDeleteNode deletes the node at spectraPath in the current world,
+// retrying while the database is busy
+func (f *Fs) sdkDeleteNode(ctx context.Context, spectraPath string) error {
+	_, err := retryBusy(f.opt.OpTimeout, func() (struct{}, error) {
+		return struct{}{}, f.engine.DeleteNode(ctx, &sdk.DeleteNodeRequest{
+			Path:      spectraPath,
+			TableName: f.opt.World,
+		})
+	})
+	return err
+}
+
+// sdkGetFileData returns the data block of the file with id, retrying
+// while the database is busy
+func (f *Fs) sdkGetFileData(ctx context.Context, id string) ([]byte, error) {
+	return retryBusy(f.opt.OpTimeout, func() ([]byte, error) {
+		block, _, err := f.engine.GetFileData(ctx, id)
+		return block, err
+	})
+}
@@ -0,0 +1,184 @@
+// Change notification for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// changeRetention is how long changes are kept in the change log for
+// the remotes polling it
+const changeRetention = time.Hour
+
+// initChanges creates the change log and the triggers recording every
+// change to the nodes in it, so changes made by any process using the
+// database, including the Spectra API, are seen.
+//
+// They are only made once a remote is polled for changes, as recording
+// changes slows down generating nodes.
+func (f *Fs) initChanges(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_changes (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	path       TEXT NOT NULL,
+	type       TEXT NOT NULL,
+	changed_at INTEGER NOT NULL
+);
+CREATE TRIGGER IF NOT EXISTS spectra_changes_insert AFTER INSERT ON nodes BEGIN
+	INSERT INTO spectra_changes (path, type, changed_at) VALUES (NEW.path, NEW.type, unixepoch());
+END;
+CREATE TRIGGER IF NOT EXISTS spectra_changes_update AFTER UPDATE ON nodes BEGIN
+	INSERT INTO spectra_changes (path, type, changed_at) VALUES (OLD.path, OLD.type, unixepoch());
+	INSERT INTO spectra_changes (path, type, changed_at) SELECT NEW.path, NEW.type, unixepoch() WHERE NEW.path <> OLD.path;
+END;
+CREATE TRIGGER IF NOT EXISTS spectra_changes_delete AFTER DELETE ON nodes BEGIN
+	INSERT INTO spectra_changes (path, type, changed_at) VALUES (OLD.path, OLD.type, unixepoch());
+END`)
+	if err != nil {
+		return fmt.Errorf("failed to create change log: %w", err)
+	}
+	return nil
+}
+
+// ChangeNotify calls notifyFunc with the path of each file or directory
+// changed in the database, by this or any other process, polling the
+// change log at the interval sent on pollIntervalChan until it is
+// closed.
+func (f *Fs) ChangeNotify(ctx context.Context, notifyFunc func(string, fs.EntryType), pollIntervalChan <-chan time.Duration) {
+	// Start recording before returning so changes made as soon as
+	// this returns are notified
+	seq, err := f.startChanges(ctx)
+	started := err == nil
+	if err != nil {
+		fs.Errorf(f, "Change notify: %v", err)
+	}
+	go func() {
+		var (
+			ticker  *time.Ticker
+			tickerC <-chan time.Time
+		)
+		for {
+			select {
+			case pollInterval, ok := <-pollIntervalChan:
+				if !ok {
+					if ticker != nil {
+						ticker.Stop()
+					}
+					return
+				}
+				if ticker != nil {
+					ticker.Stop()
+					ticker, tickerC = nil, nil
+				}
+				if pollInterval != 0 {
+					ticker = time.NewTicker(pollInterval)
+					tickerC = ticker.C
+				}
+				if !started {
+					var err error
+					if seq, err = f.startChanges(ctx); err != nil {
+						fs.Errorf(f, "Change notify: %v", err)
+						continue
+					}
+					started = true
+				}
+			case <-tickerC:
+				if !started {
+					continue
+				}
+				var err error
+				if seq, err = f.pollChanges(ctx, seq, notifyFunc); err != nil {
+					fs.Infof(f, "Change notify listener failure: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// startChanges starts recording changes and returns the sequence
+// number of the latest, so only later changes are notified
+func (f *Fs) startChanges(ctx context.Context) (seq int64, err error) {
+	if err = f.initChanges(ctx); err != nil {
+		return 0, err
+	}
+	err = f.db.QueryRowContext(ctx, `SELECT coalesce(max(seq), 0) FROM spectra_changes`).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read change log: %w", err)
+	}
+	return seq, nil
+}
+
+// change is a change to a node read from the change log
+type change struct {
+	path string // Spectra path of the node
+	kind string // type of the node
+}
+
+// readChanges returns the changes in the log after seq and the
+// sequence number of the last one
+func (f *Fs) readChanges(ctx context.Context, seq int64) (changes []change, last int64, err error) {
+	last = seq
+	rows, err := f.readDB.QueryContext(ctx, `
+SELECT seq, path, type FROM spectra_changes WHERE seq > ? ORDER BY seq`, seq)
+	if err != nil {
+		return nil, seq, fmt.Errorf("failed to read change log: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	for rows.Next() {
+		var c change
+		if err = rows.Scan(&last, &c.path, &c.kind); err != nil {
+			return nil, seq, fmt.Errorf("failed to read change log: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, seq, fmt.Errorf("failed to read change log: %w", err)
+	}
+	return changes, last, nil
+}
+
+// pollChanges notifies the changes after seq which are under the root
+// of the remote and returns the sequence number of the last one. Changes
+// older than changeRetention are dropped from the log.
+func (f *Fs) pollChanges(ctx context.Context, seq int64, notifyFunc func(string, fs.EntryType)) (last int64, err error) {
+	changes, last, err := f.readChanges(ctx, seq)
+	if err != nil {
+		return seq, err
+	}
+
+	// Notify each path once per poll
+	root := f.toSpectraPath("")
+	seen := make(map[change]bool, len(changes))
+	for _, c := range changes {
+		if seen[c] || c.path == root || (root != "/" && !strings.HasPrefix(c.path, root+"/")) {
+			continue
+		}
+		seen[c] = true
+		entryType := fs.EntryObject
+		if c.kind == sdk.NodeTypeFolder {
+			entryType = fs.EntryDirectory
+		}
+		notifyFunc(f.fromSpectraPath(c.path), entryType)
+	}
+	if len(changes) > 0 {
+		// Cached listings may be out of date
+		f.nodeCache.clear()
+	}
+
+	_, err = f.db.ExecContext(ctx, `DELETE FROM spectra_changes WHERE changed_at < ?`,
+		time.Now().Add(-changeRetention).Unix())
+	if err != nil {
+		return last, fmt.Errorf("failed to prune change log: %w", err)
+	}
+	return last, nil
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.ChangeNotifier = (*Fs)(nil)
+)
@@ -0,0 +1,181 @@
+// Simulated dataset churn for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// churn tracks the simulated changes made to the world since the
+// backend started
+type churn struct {
+	start        time.Time // when the simulation started at the current rates
+	grown        int64     // number of files added so far
+	shrunk       int64     // number of files removed so far
+	grownBefore  int64     // number of files added before start
+	shrunkBefore int64     // number of files removed before start
+}
+
+// dueEvents returns the number of events which should have happened
+// by now at rate per second of simulated time, given before had
+// happened by the start
+func (c *churn) dueEvents(now time.Time, before int64, rate float64) int64 {
+	return before + int64(now.Sub(c.start).Seconds()*rate)
+}
+
+// simulateChurn brings the world up to date with the files which
+// should have appeared or vanished by now
+func (f *Fs) simulateChurn(ctx context.Context) error {
+	if t := f.tuning(); t.growthRate <= 0 && t.shrinkRate <= 0 {
+		return nil
+	}
+	f.churnMu.Lock()
+	defer f.churnMu.Unlock()
+	return f.catchUpChurn(ctx)
+}
+
+// catchUpChurn brings the world up to date at the current rates for
+// simulateChurn.
+//
+// Call with churnMu held.
+func (f *Fs) catchUpChurn(ctx context.Context) error {
+	t, now := f.tuning(), f.clock.Now()
+	grown, shrunk := f.churn.grown, f.churn.shrunk
+	defer func() {
+		if f.churn.grown != grown || f.churn.shrunk != shrunk {
+			f.nodeCache.clear()
+		}
+	}()
+	if t.growthRate > 0 {
+		if err := f.grow(ctx, f.churn.dueEvents(now, f.churn.grownBefore, t.growthRate)); err != nil {
+			return err
+		}
+	}
+	if t.shrinkRate > 0 {
+		return f.shrink(ctx, f.churn.dueEvents(now, f.churn.shrunkBefore, t.shrinkRate))
+	}
+	return nil
+}
+
+// grow adds files until due have been added, as growth_rate does over
+// time.
+//
+// The n-th file is called grown_<n>.txt and is placed in a directory
+// which has already been generated, chosen from sim_seed and n, so the
+// same run against the same dataset grows it the same way.
+//
+// Call with churnMu held.
+func (f *Fs) grow(ctx context.Context, due int64) error {
+	for ; f.churn.grown < due; f.churn.grown++ {
+		n := f.churn.grown + 1
+		dir, err := f.pickGenerated(sdk.NodeTypeFolder, "grow", n, true)
+		if err != nil {
+			return err
+		}
+		if dir == "" {
+			// Nothing generated yet so nowhere to grow
+			return nil
+		}
+		name := "grown_" + strconv.FormatInt(n, 10) + ".txt"
+		node, err := retryBusy(f.opt.OpTimeout, func() (*sdk.Node, error) {
+			return f.engine.UploadFile(ctx, &sdk.UploadFileRequest{
+				ParentPath: dir,
+				TableName:  f.opt.World,
+				Name:       name,
+				Data:       []byte{0}, // content is generated
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("failed to grow %q: %w", name, err)
+		}
+		// The SDK stamps the file with the wall time
+		if err := f.setModTime(ctx, node.ID, f.clock.Now()); err != nil {
+			return fmt.Errorf("failed to grow %q: %w", name, err)
+		}
+		f.recordGrown(path.Join(dir, name))
+		fs.Debugf(f, "Grew %q in %q", name, dir)
+	}
+	return nil
+}
+
+// shrink removes files until due have been removed, as shrink_rate
+// does over time.
+//
+// The n-th file removed is picked from sim_seed and n out of the files
+// generated so far, so the same run against the same dataset shrinks
+// it the same way.
+//
+// Call with churnMu held.
+func (f *Fs) shrink(ctx context.Context, due int64) error {
+	for ; f.churn.shrunk < due; f.churn.shrunk++ {
+		n := f.churn.shrunk + 1
+		file, err := f.pickGenerated(sdk.NodeTypeFile, "shrink", n, false)
+		if err != nil {
+			return err
+		}
+		if file == "" {
+			// Nothing left to remove
+			return nil
+		}
+		if err := f.recordRemoved(ctx, file); err != nil {
+			return fmt.Errorf("failed to shrink %q: %w", file, err)
+		}
+		err = f.sdkDeleteNode(ctx, file)
+		if err != nil {
+			return fmt.Errorf("failed to shrink %q: %w", file, err)
+		}
+		fs.Debugf(f, "Shrank %q", file)
+	}
+	return nil
+}
+
+// pickGenerated deterministically picks a node of nodeType which
+// exists in the current world from those generated so far, using the
+// sim_seed, salt and n, and returns its Spectra path.
+//
+// If generated is set only folders whose children have been generated
+// are considered. Files are only considered if they have siblings, as
+// a directory left empty would be generated afresh when next listed,
+// and aren't pinned by pin_uploads.
+//
+// It returns "" if there are none.
+func (f *Fs) pickGenerated(nodeType, salt string, n int64, generated bool) (string, error) {
+	where := `type = ? AND json_extract(existence_map, ?) = 1`
+	if generated {
+		where += ` AND EXISTS (SELECT 1 FROM nodes c WHERE c.parent_id = nodes.id)`
+	}
+	if nodeType == sdk.NodeTypeFile {
+		where += ` AND (SELECT count(*) FROM nodes s WHERE s.parent_id = nodes.parent_id) > 1`
+		if f.opt.PinUploads {
+			where += ` AND id NOT IN (SELECT node_id FROM spectra_pins)`
+		}
+	}
+	var count int64
+	err := f.db.QueryRow(`SELECT count(*) FROM nodes WHERE `+where,
+		nodeType, worldKey(f.opt.World)).Scan(&count)
+	if err != nil {
+		return "", fmt.Errorf("failed to count %ss: %w", nodeType, err)
+	}
+	if count == 0 {
+		return "", nil
+	}
+	x := pathFraction(f.simSeed(), salt, strconv.FormatInt(n, 10))
+	var spectraPath string
+	err = f.db.QueryRow(`SELECT path FROM nodes WHERE `+where+` ORDER BY path LIMIT 1 OFFSET ?`,
+		nodeType, worldKey(f.opt.World), int64(x*float64(count))).Scan(&spectraPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to pick %s: %w", nodeType, err)
+	}
+	return spectraPath, nil
+}
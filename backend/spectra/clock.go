@@ -0,0 +1,55 @@
+// Simulated time for the Spectra backend
+package spectra
+
+import (
+	"fmt"
+	"time"
+)
+
+// clock tells the simulated time.
+//
+// Features simulating the passing of time, such as churn, restores from
+// the archive tier and the simulated writer, read it rather than the
+// wall clock, so time_scale can compress days of them into minutes.
+// Tests can plug in a clock of their own.
+type clock interface {
+	// Now returns the simulated time now
+	Now() time.Time
+	// After returns a channel which receives once d of simulated time
+	// has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// scaledClock is a clock running scale times as fast as the wall clock
+// from start, when it read the same as the wall clock
+type scaledClock struct {
+	start time.Time
+	scale float64
+}
+
+// newClock returns a clock running scale times as fast as the wall
+// clock from now. A scale of 0 is taken as 1.
+func newClock(scale float64) (clock, error) {
+	if scale < 0 {
+		return nil, fmt.Errorf("time_scale must not be negative, got %g", scale)
+	}
+	if scale == 0 {
+		scale = 1
+	}
+	return &scaledClock{start: time.Now(), scale: scale}, nil
+}
+
+// Now returns the simulated time now
+func (c *scaledClock) Now() time.Time {
+	now := time.Now()
+	if c.scale == 1 {
+		return now
+	}
+	return c.start.Add(time.Duration(float64(now.Sub(c.start)) * c.scale))
+}
+
+// After returns a channel which receives once d of simulated time has
+// passed
+func (c *scaledClock) After(d time.Duration) <-chan time.Time {
+	return time.After(time.Duration(float64(d) / c.scale))
+}
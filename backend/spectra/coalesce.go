@@ -0,0 +1,62 @@
+// Request coalescing for the Spectra backend
+package spectra
+
+import (
+	"sync"
+	"time"
+)
+
+// coalescer merges identical requests issued within a short window
+// into a single call whose result is shared by all the callers.
+//
+// Callers only join a call which hasn't started yet, so every caller
+// sees a result read after it made its request.
+type coalescer[V any] struct {
+	window  time.Duration
+	mu      sync.Mutex
+	pending map[string]*coalescedCall[V]
+}
+
+// coalescedCall is a call which callers are waiting on
+type coalescedCall[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+// newCoalescer makes a coalescer which waits window before issuing
+// each call. A window of 0 disables coalescing.
+func newCoalescer[V any](window time.Duration) *coalescer[V] {
+	return &coalescer[V]{
+		window:  window,
+		pending: make(map[string]*coalescedCall[V]),
+	}
+}
+
+// do calls fn, or waits for the result of a pending call with the
+// same key if there is one
+func (c *coalescer[V]) do(key string, fn func() (V, error)) (V, error) {
+	if c.window <= 0 {
+		return fn()
+	}
+	c.mu.Lock()
+	if call, ok := c.pending[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.val, call.err
+	}
+	call := &coalescedCall[V]{done: make(chan struct{})}
+	c.pending[key] = call
+	c.mu.Unlock()
+
+	// Let the burst gather then close the call to new joiners
+	// before running it
+	time.Sleep(c.window)
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.mu.Unlock()
+
+	call.val, call.err = fn()
+	close(call.done)
+	return call.val, call.err
+}
@@ -0,0 +1,1321 @@
+// Backend commands for the Spectra backend
+package spectra
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configstruct"
+	"github.com/rclone/rclone/fs/walk"
+)
+
+var commandHelp = []fs.CommandHelp{{
+	Name:  "ls-stats",
+	Short: "Show distribution statistics of the generated dataset.",
+	Long: `Walks the remote, generating it as needed, and reports file count
+and size broken down by extension and depth, along with a histogram
+of directory fan-out.
+
+Depths are counted from the root of the remote, which is depth 0, so
+the files and folders directly inside it are depth 1 whatever their
+depth level in Spectra.
+
+Use this to check the generated dataset matches the profile configured
+in the Spectra configuration file.
+
+Usage example:
+
+` + "```console" + `
+rclone backend ls-stats myspectra:
+rclone backend ls-stats myspectra:folder_1 -o max-depth=2
+rclone backend ls-stats myspectra:folder_1 -o rollup
+` + "```" + `
+
+With rollup the totals are read from the directory rollups kept in
+the database instead of walking the remote, which needs an on disk
+database. The breakdowns and maximum depth are left out.`,
+	Opts: map[string]string{
+		"max-depth": "Maximum depth to walk (default unlimited).",
+		"rollup":    "Only report the totals, read from the database rollups.",
+		"format":    "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "seed-info",
+	Short: "Show the resolved generation parameters.",
+	Long: `Shows the generation parameters after merging the Spectra
+configuration file, the backend options and their defaults, along with
+the worlds and the seed and sim_seed derived for each.
+
+Record this alongside test results to capture exactly what produced
+the dataset.
+
+Usage example:
+
+` + "```console" + `
+rclone backend seed-info myspectra:
+` + "```",
+}, {
+	Name:  "world-manifest",
+	Short: "Show the manifest recording what generated the world.",
+	Long: `Shows the manifest stored in the database when the world was first
+used: the Spectra configuration, the seed of the world, the settings
+the content of files depends on, the versions of the Spectra SDK and
+rclone and when it was generated.
+
+The fields of the manifest which differ from what this remote would
+generate are listed under differs, so a world shared between teams
+can be checked to be reproducible from the configuration at hand. It
+needs an on disk database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend world-manifest myspectra:
+` + "```",
+}, {
+	Name:  "snapshot",
+	Short: "Store a snapshot of the world to restore later.",
+	Long: `Generates the whole world and stores a copy of it in the database
+under the name given by target, replacing any snapshot already called
+that, along with the content of uploaded files and their metadata.
+Use the restore command with -o snapshot to roll the world back to
+it, for example after running a destructive sync test against it.
+
+Snapshots are kept in the database when the SDK recreates the nodes,
+so they can be restored by a later run. Without target the snapshots
+in the database are listed. It needs an on disk database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend snapshot myspectra: -o target=before-sync
+rclone backend snapshot myspectra:
+` + "```",
+	Opts: map[string]string{
+		"target": "Name to store the snapshot under.",
+	},
+}, {
+	Name:  "restore",
+	Short: "Restore archived objects or roll the world back to a snapshot.",
+	Long: `Requests a restore of every archived object in the remote. Archived
+objects can be opened once restore_delay has passed, until the
+restored copy expires.
+
+Requesting a restore of an object which is being restored or has been
+restored extends the time it stays available.
+
+With -o snapshot the whole world is instead rolled back to the
+snapshot of that name stored by the snapshot command, whatever the
+root of the remote. Nodes shared with other worlds stay in them.
+
+Usage example:
+
+` + "```console" + `
+rclone backend restore myspectra:folder_1 -o duration=24h
+rclone backend restore myspectra:folder_1/file_1.txt
+rclone backend restore myspectra: -o snapshot=before-sync
+` + "```",
+	Opts: map[string]string{
+		"duration": "How long the restored copy stays available (default 24h).",
+		"snapshot": "Name of the world snapshot to roll back to.",
+	},
+}, {
+	Name:  "hidden",
+	Short: "List the files hidden by hide_count.",
+	Long: `Lists the paths, relative to the root of the world, of the files
+hidden from this world by hide_count. This is the set of files
+"rclone check" should report as missing when comparing another world
+against this one.
+
+Usage example:
+
+` + "```console" + `
+rclone backend hidden myspectra:
+` + "```",
+}, {
+	Name:  "extra",
+	Short: "List the extra files shown by extra_count.",
+	Long: `Lists the paths, relative to the root of the world, of the extra
+files shown in this world by extra_count which haven't been deleted.
+This is the set of files syncing the same world without extra_count to
+this one with --delete-before, --delete-during or --delete-after
+should delete.
+
+Usage example:
+
+` + "```console" + `
+rclone backend extra myspectra:
+` + "```",
+}, {
+	Name:  "moved",
+	Short: "List the files moved by move_rate.",
+	Long: `Lists the files shown moved in this world by move_rate, with the
+paths, relative to the root of the world, they were moved from and to.
+This is the set of moves --track-renames should find when syncing
+between this world and the same world without move_rate.
+
+Usage example:
+
+` + "```console" + `
+rclone backend moved myspectra:
+` + "```",
+}, {
+	Name:  "warm",
+	Short: "Generate the directories leading to a list of paths.",
+	Long: `Generates the directories leading to each path given, listing each
+directory once however many of the paths are in it, so a later run
+which only touches those paths, such as "rclone copy --files-from",
+isn't slowed down by generating them as it goes.
+
+The paths are given as arguments, or read one per line from the file
+given with the files-from option, relative to the root of the remote.
+The result counts the paths found and lists any missing.
+
+Usage example:
+
+` + "```console" + `
+rclone backend warm myspectra: folder_1/file_1.txt folder_2/file_3.txt
+rclone backend warm myspectra: -o files-from=paths.txt
+` + "```",
+	Opts: map[string]string{
+		"files-from": "File to read the paths from, one per line.",
+	},
+}, {
+	Name:  "compact",
+	Short: "Compact the Spectra database.",
+	Long: `Removes nodes left behind under deleted directories, chunks of
+ended upload sessions, hashes of removed files and expired restores,
+then vacuums the database to return the space they used.
+
+Run this on long lived databases after heavy churn to stop them
+growing without bound. It needs an on disk database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend compact myspectra:
+` + "```",
+}, {
+	Name:  "hash-all",
+	Short: "Compute and store every hash of every file.",
+	Long: `Walks the remote computing every hash type it supports for every
+file and stores the hashes in the database, so later checks only read
+metadata whichever hash type the destination needs. Hashes read from
+the nodes anyway, such as the SHA-256 of tiled content, aren't stored.
+
+The stored hashes are used until the file is changed or a setting its
+content depends on, such as drift_epoch or content, is. It needs an on
+disk database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend hash-all myspectra:,hashes=md5,sha1
+` + "```",
+}, {
+	Name:  "fsck",
+	Short: "Check the Spectra database for inconsistent nodes.",
+	Long: `Checks every node in the database, in all worlds, for
+
+- nodes whose parent is missing
+- nodes whose path, parent path or depth doesn't match their parent
+- files whose size or checksum doesn't match the content served
+- folders with a size or checksum
+
+and lists the problems found. With the repair option nodes with a
+missing parent are deleted along with everything below them and the
+other problems are corrected. It needs an on disk database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend fsck myspectra:
+rclone backend fsck myspectra: -o repair
+` + "```",
+	Opts: map[string]string{
+		"repair": "Repair the problems found.",
+	},
+}, {
+	Name:  "corrupt",
+	Short: "Corrupt nodes in the Spectra database.",
+	Long: `Deterministically corrupts nodes already in the database to test
+fsck and how rclone copes with an inconsistent backend. Nodes can be
+given a missing parent, a wrong size or a bad checksum. Only files are
+given wrong sizes and bad checksums.
+
+The nodes corrupted are picked from the seed, the world and the
+variant, so the same database is corrupted the same way each time.
+The corrupted nodes are listed.
+
+Usage example:
+
+` + "```console" + `
+rclone backend corrupt myspectra: -o count=10
+rclone backend corrupt myspectra: -o count=5 -o kinds=size,checksum -o variant=2
+` + "```",
+	Opts: map[string]string{
+		"count":   "Number of nodes to corrupt (default 1).",
+		"kinds":   "Comma separated kinds of corruption: parent, size, checksum (default all).",
+		"variant": "Picks a different set of nodes (default 0).",
+	},
+}, {
+	Name:  "export",
+	Short: "Export the dataset to a snapshot file.",
+	Long: `Generates the whole dataset, up to eager_max_nodes nodes, and writes
+it with all its worlds to a single SQLite file which can be copied to
+another machine.
+
+Load it there with the snapshot option, which loads it each time the
+remote is created, or the import command, which loads it until the
+remote is next created.
+
+Usage example:
+
+` + "```console" + `
+rclone backend export myspectra: /path/to/dataset.db
+rclone lsf myspectra,snapshot=/path/to/dataset.db:
+` + "```",
+}, {
+	Name:  "import",
+	Short: "Import the dataset from a snapshot file.",
+	Long: `Replaces the dataset with the one in a snapshot file written by the
+export command.
+
+Spectra recreates its database whenever the remote is created, so this
+only lasts as long as the remote, for example for the life of a
+mount or rclone rcd. Use the snapshot option to load a snapshot every
+time.
+
+Usage example:
+
+` + "```console" + `
+rclone rc backend/command command=import fs=myspectra: -a /path/to/dataset.db
+` + "```",
+}, {
+	Name:  "delta",
+	Short: "Count the files changed between two snapshots.",
+	Long: `Compares the files below the root of the remote in this world in two
+snapshot files written by the export command, or in one snapshot and
+the database as it is now if only one is given, and reports the
+number and size of the files added, modified and deleted between
+them.
+
+Files are matched by path and count as modified if their size,
+checksum or modification time differs. Give the drift_epoch of each
+state with from-epoch and to-epoch to count the files content drift
+changes between them too. The size of the added and modified files is
+what an incremental sync would copy, and with bandwidth set the time
+that takes is estimated.
+
+It needs an on disk database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend delta myspectra: monday.db tuesday.db
+rclone backend delta myspectra: monday.db -o bandwidth=100M
+` + "```",
+	Opts: map[string]string{
+		"from-epoch": "drift_epoch of the earlier state (default drift_epoch).",
+		"to-epoch":   "drift_epoch of the later state (default drift_epoch).",
+		"bandwidth":  "Bytes per second to estimate the transfer time at, eg 100M.",
+		"format":     "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "cost",
+	Short: "Show the simulated spend so far.",
+	Long: `Shows the requests made through the remote per operation class and
+the file data read, along with what they would have cost at the prices
+set by the cost_list, cost_stat, cost_read, cost_write and
+cost_egress options.
+
+The counts are kept for the life of the remote, so this is most
+useful against a long running rclone, such as rclone rcd or a mount.
+One line summaries are logged when rclone finishes with the remote.
+
+Usage example:
+
+` + "```console" + `
+rclone rc backend/command command=cost fs=myspectra:
+rclone rc backend/command command=cost fs=myspectra: -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"format": "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "tune",
+	Short: "Change the simulation while the remote runs.",
+	Long: `Changes the latencies, fault rate, bandwidth and churn rates of a
+running remote without restarting it, so a long running mount or sync
+can be perturbed as it goes, and shows the values in effect.
+
+Each option is named as the backend option it changes and takes the
+same values. All of them are checked before any is changed. Streams
+already open keep the bandwidth they started with. Churn carries on
+from the files already added or removed at the new rates. Run without
+options to show the values in effect.
+
+Usage example:
+
+` + "```console" + `
+rclone rc backend/command command=tune fs=myspectra: -o latency_read=uniform:50ms,200ms -o fault_error_rate=0.05
+rclone rc backend/command command=tune fs=myspectra: -o growth_rate=0
+` + "```",
+	Opts: map[string]string{
+		"latency_list":     "Latency to add to each directory listing.",
+		"latency_stat":     "Latency to add to each single object lookup.",
+		"latency_read":     "Latency to add to opening each object for reading.",
+		"latency_write":    "Latency to add to each upload, delete and directory change.",
+		"fault_error_rate": "Fraction of operations to fail (0.0-1.0).",
+		"stream_bandwidth": "Bandwidth each stream opened from now on is limited to.",
+		"growth_rate":      "Number of new files to add to the world per second.",
+		"shrink_rate":      "Number of files to remove from the world per second.",
+	},
+}, {
+	Name:  "progress",
+	Short: "Show how much of the world has been generated.",
+	Long: `Shows the directories, files and bytes generated so far below the
+root of the remote, the number of directories whose children haven't
+been generated yet and whether generation is complete, without
+generating anything.
+
+rclone about reports the totals of the whole tree, generating the rest
+of it first, so use this to see how far a lazy or eager generation has
+got. Directories which generated no children count as ungenerated, as
+they can't be told apart from directories not listed yet. This needs
+an on disk database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend progress myspectra:
+rclone rc backend/command command=progress fs=myspectra: -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"format": "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "limits",
+	Short: "Show the soft limits and whether they have been crossed.",
+	Long: `Checks the soft limits set by the warn_objects, warn_bytes and
+warn_db_size options and shows each one with its current value,
+whether it has been crossed and when.
+
+Crossing a limit is logged as a warning too, with the limit, value and
+threshold as fields of JSON logs. Poll this over the remote control
+API to watch a long running generation job.
+
+Usage example:
+
+` + "```console" + `
+rclone rc backend/command command=limits fs=myspectra:
+rclone backend limits myspectra: -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"format": "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "regenerate",
+	Short: "Generate a subtree of the world.",
+	Long: `Generates everything below a directory which hasn't been generated
+yet, as lazy generation would when it is listed, and shows how much of
+it has been generated, as the progress command does.
+
+The directory is given as an argument relative to the root of the
+remote, which is used if none is given. Directories the
+generation_filter excludes are left ungenerated. This needs an on disk
+database.
+
+Usage example:
+
+` + "```console" + `
+rclone backend regenerate myspectra:
+rclone backend regenerate myspectra: folder_1 -o max-depth=2
+` + "```",
+	Opts: map[string]string{
+		"max-depth": "Maximum depth below the directory to generate (default unlimited).",
+		"format":    "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "reseed",
+	Short: "Rebuild the world with a new seed.",
+	Long: `Deletes every node, along with any content uploaded, and generates
+the world afresh from a new seed in place of the seed in the Spectra
+configuration file. The files hidden by hide_count, the extra files
+shown by extra_count and the files moved by move_rate are picked again
+and eager generation is redone.
+
+Every world in the database is rebuilt, as they share their nodes.
+Other remotes using the same database carry on generating from their
+own seed, so run this while nothing else is using the database.
+
+Spectra recreates its database whenever the remote is created, so this
+only lasts as long as the remote, for example for the life of a
+mount or rclone rcd.
+
+Usage example:
+
+` + "```console" + `
+rclone rc backend/command command=reseed fs=myspectra: -o seed=99
+` + "```",
+	Opts: map[string]string{
+		"seed": "The new seed (required).",
+	},
+}, {
+	Name:  "stats",
+	Short: "Show the number of nodes stored by world and depth.",
+	Long: `Counts the nodes stored at and below the root of the remote in
+each world, broken down by depth level, without generating any more
+of them. Nodes in several worlds are counted in each. This needs an on
+disk database.
+
+Depths are Spectra's depth levels, which start at 0 at the root of the
+world whatever the root of the remote. Use ls-stats to walk the
+remote, generating it as it goes.
+
+Usage example:
+
+` + "```console" + `
+rclone backend stats myspectra:
+rclone backend stats myspectra:folder_1 -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"format": "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "contention",
+	Short: "Show how long calls have waited for each other.",
+	Long: `Shows, for each kind of call to the engine generating the world, how
+many calls have been made, how many had to wait for another call to
+the same directory or for a reseed, and how long they waited in total
+and at most. The pools of connections to the database are shown too,
+with how often and how long queries waited for a free connection, as
+are the concurrency pools set by max_metadata_concurrency,
+max_read_concurrency and max_write_concurrency, with how often and how
+long operations waited for a slot.
+
+The counts are kept for the life of the remote, or of the engine with
+world=all, so this is most useful against a long running rclone, such
+as rclone rcd or a mount, while it is under load.
+
+Usage example:
+
+` + "```console" + `
+rclone rc backend/command command=contention fs=myspectra:
+rclone rc backend/command command=contention fs=myspectra: -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"format": "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "heatmap",
+	Short: "Show which paths have been listed, read and written.",
+	Long: `Shows the paths listed, looked up, read and written through the
+remote, with how many times each was and when it was first and last
+accessed, counting every access in order from 1. This needs the
+heatmap option, which records the accesses for the life of the remote,
+so it is most useful against a long running rclone, such as rclone
+rcd or a mount.
+
+Sorted by first access the paths show the order a workload traversed
+the remote in. With the depth option the accesses of each path are
+added to its ancestor that many levels below the root, to show the
+locality of the workload, which parts of the tree it visited when.
+
+Usage example:
+
+` + "```console" + `
+rclone rc backend/command command=heatmap fs=myspectra: -o depth=1
+rclone rc backend/command command=heatmap fs=myspectra: -o sort=total -o top=20 -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"depth":  "Depth below the root to add the accesses up at (default each path).",
+		"sort":   "Order of the paths: first (default), last or total.",
+		"top":    "Number of paths to show (default all).",
+		"format": "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "profile",
+	Short: "Show how many calls of each operation were made and how long they took.",
+	Long: `Shows, for List, NewObject, Open, Put, Mkdir, Rmdir, Remove and
+Purge, how many calls have been made through the remote, how many
+failed, how long they took in total, on average and at most, and a
+histogram of how long they took, in buckets of up to 100µs, 1ms, 10ms,
+100ms, 1s, 10s and longer.
+
+The times are those the caller sees, including any simulated latency,
+throttling and waits for a concurrency slot. Open is timed until the
+object is open, not until it has been read. Calls are counted from
+when the remote was created, or the counts last reset with the reset
+option, which resets them once they have been shown. Run it over the
+remote control API to profile a long running rclone, such as rclone
+rcd or a mount, without tracing it from outside.
+
+Usage example:
+
+` + "```console" + `
+rclone backend profile myspectra:
+rclone rc backend/command command=profile fs=myspectra: -o reset
+rclone rc backend/command command=profile fs=myspectra: -o format=prom
+` + "```",
+	Opts: map[string]string{
+		"reset":  "Reset the counts after showing them.",
+		"format": "Output format: json (default), csv, influx or prom.",
+	},
+}, {
+	Name:  "bench",
+	Short: "Time listing, finding and reading files.",
+	Long: `Lists the remote one directory at a time, then finds and reads the
+first files listed one at a time, timing each operation. Each phase is
+reported with the operations made, the bytes read, how long it took,
+the rates and the median, 99th percentile and longest latencies.
+
+The results can be output as InfluxDB line protocol, with a point per
+phase tagged with the remote, world, engine and phase, or in the
+Prometheus text format for the node exporter's textfile collector, so
+nightly runs can feed dashboards directly.
+
+Usage example:
+
+` + "```console" + `
+rclone backend bench myspectra: -o max-depth=3 -o files=50
+rclone backend bench myspectra: -o format=influx >> bench.lp
+rclone backend bench myspectra: -o format=prom > /var/lib/node_exporter/spectra_bench.prom
+` + "```",
+	Opts: map[string]string{
+		"max-depth": "Maximum depth to list (default unlimited).",
+		"files":     "Number of files to find and read (default 100).",
+		"format":    "Output format: json (default), csv, influx or prom.",
+	},
+}, {
+	Name:  "health",
+	Short: "Check the remote is ready for use.",
+	Long: `Checks the world can be read from the Spectra SDK and the database,
+that the database can be written unless the remote is read only, and
+how long listing the root takes, generating it if it hasn't been yet.
+Each check is reported with whether it passed and how long it took.
+
+The checks bypass the simulated latency, faults and limits. If any
+fails the command fails with an error naming them, so it can be used
+as a readiness probe, directly or through the rc.
+
+Usage example:
+
+` + "```console" + `
+rclone backend health myspectra: -o max-latency=2s
+rclone rc backend/command command=health fs=myspectra:
+` + "```",
+	Opts: map[string]string{
+		"max-latency": "Fail if listing the root takes longer than this (default no limit).",
+	},
+}, {
+	Name:  "selftest",
+	Short: "Check each capability of the remote works.",
+	Long: `Lists the root of the remote, then makes a scratch directory and
+uploads a file to it, finds it, reads it back, checks its hashes
+against the content read and moves it, before purging the scratch
+directory again. Each capability is reported as passed, failed or
+skipped, when the remote doesn't support it as configured or a check
+it needs failed.
+
+The checks go through the remote as rclone would, so the simulated
+latency, faults and limits apply to them; turn those off to check the
+configuration and environment alone. A read only remote is checked by
+finding, reading and hashing the first file in its root instead.
+
+Usage example:
+
+` + "```console" + `
+rclone backend selftest myspectra:
+rclone backend selftest myspectra: -o dir=tmp/selftest -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"dir":    "Scratch directory to use, which mustn't exist (default spectra-selftest-<time>).",
+		"format": "Output format: json (default) or csv.",
+	},
+}, {
+	Name:  "replay",
+	Short: "Apply the operations recorded in a journal to the remote.",
+	Long: `Reads a journal written with the journal option and applies the
+operations in it to the remote in order, stopping at the first which
+fails. Replaying onto a fresh world rebuilds what the journalled remote
+wrote, so it can be compared with the world a crashed or partial sync
+left behind, with rclone check for instance. Set until to replay the
+operations up to and including that one only, to rebuild the world as
+it was at a point of the sync.
+
+The paths in the journal are from the root of the world, so replay it
+onto the root of a remote. The number of operations applied is
+reported by operation, along with the number of the last one.
+
+Usage example:
+
+` + "```console" + `
+rclone backend replay fresh: /tmp/spectra.journal
+rclone backend replay fresh: /tmp/spectra.journal -o until=120 -o format=csv
+` + "```",
+	Opts: map[string]string{
+		"until":  "Number of the last operation to apply (default all).",
+		"format": "Output format: json (default) or csv.",
+	},
+}}
+
+// Command the backend to run a named command
+//
+// The command run is name
+// args may be used to read arguments from
+// opts may be used to read optional arguments from
+//
+// The result should be capable of being JSON encoded
+// If it is a string or a []string it will be shown to the user
+// otherwise it will be JSON encoded and shown to the user like that
+func (f *Fs) Command(ctx context.Context, name string, arg []string, opt map[string]string) (out any, err error) {
+	// Commands such as reseed and corrupt change the world behind the
+	// node cache
+	defer f.nodeCache.change()()
+	switch name {
+	case "ls-stats":
+		if _, ok := opt["rollup"]; ok {
+			stats, err := f.rollupStats(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return formatResult(stats, opt)
+		}
+		maxDepth, err := intOpt(opt, "max-depth", -1)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := f.lsStats(ctx, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		return formatResult(stats, opt)
+	case "seed-info":
+		return f.seedInfo()
+	case "world-manifest":
+		if f.db == nil {
+			return nil, errors.New("world-manifest needs an on disk database")
+		}
+		return f.worldManifestReport(ctx)
+	case "hidden":
+		hidden := make([]string, 0, len(f.hidden))
+		for spectraPath := range f.hidden {
+			hidden = append(hidden, strings.TrimPrefix(spectraPath, "/"))
+		}
+		sort.Strings(hidden)
+		return hidden, nil
+	case "extra":
+		return f.listExtra(), nil
+	case "moved":
+		return f.listMoves(), nil
+	case "warm":
+		paths := arg
+		if name := opt["files-from"]; name != "" {
+			list, err := readPathList(name)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, list...)
+		}
+		if len(paths) == 0 {
+			return nil, errors.New("warm needs paths as arguments or files-from")
+		}
+		return f.warmPaths(ctx, paths)
+	case "compact":
+		if f.db == nil {
+			return nil, errors.New("compact needs an on disk database")
+		}
+		return f.compact(ctx)
+	case "hash-all":
+		if f.db == nil {
+			return nil, errors.New("hash-all needs an on disk database")
+		}
+		return f.hashAll(ctx)
+	case "fsck":
+		if f.db == nil {
+			return nil, errors.New("fsck needs an on disk database")
+		}
+		_, repair := opt["repair"]
+		if repair {
+			if err := f.checkWrite("repair", ""); err != nil {
+				return nil, err
+			}
+		}
+		return f.fsck(ctx, repair)
+	case "corrupt":
+		if f.db == nil {
+			return nil, errors.New("corrupt needs an on disk database")
+		}
+		if err := f.checkWrite("corrupt", ""); err != nil {
+			return nil, err
+		}
+		count, err := intOpt(opt, "count", 1)
+		if err != nil {
+			return nil, err
+		}
+		kinds := corruptionKinds
+		if value := opt["kinds"]; value != "" {
+			kinds = strings.Split(value, ",")
+		}
+		return f.corrupt(ctx, count, kinds, opt["variant"])
+	case "export", "import":
+		if f.db == nil {
+			return nil, fmt.Errorf("%s needs an on disk database", name)
+		}
+		if len(arg) != 1 {
+			return nil, fmt.Errorf("%s needs the path of the snapshot file", name)
+		}
+		if name == "export" {
+			return nil, f.exportSnapshot(ctx, arg[0])
+		}
+		if err := f.checkWrite("import", arg[0]); err != nil {
+			return nil, err
+		}
+		return nil, f.importSnapshot(ctx, arg[0])
+	case "snapshot":
+		if f.db == nil {
+			return nil, errors.New("snapshot needs an on disk database")
+		}
+		if opt["target"] == "" {
+			return f.worldSnapshots(ctx, "")
+		}
+		return f.snapshotWorld(ctx, opt["target"])
+	case "restore":
+		if name, ok := opt["snapshot"]; ok {
+			if f.db == nil {
+				return nil, errors.New("restore needs an on disk database to roll back to a snapshot")
+			}
+			if name == "" {
+				return nil, errors.New("restore needs the name of the snapshot")
+			}
+			if err := f.checkWrite("restore", ""); err != nil {
+				return nil, err
+			}
+			return f.restoreWorld(ctx, name)
+		}
+		lifetime := 24 * time.Hour
+		if value := opt["duration"]; value != "" {
+			lifetime, err = fs.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad value for \"duration\": %w", err)
+			}
+		}
+		return f.restoreObjects(ctx, lifetime)
+	case "delta":
+		if f.db == nil {
+			return nil, errors.New("delta needs an on disk database")
+		}
+		if len(arg) < 1 || len(arg) > 2 {
+			return nil, errors.New("delta needs one or two snapshot files")
+		}
+		dopt := deltaOptions{from: arg[0]}
+		if len(arg) == 2 {
+			dopt.to = arg[1]
+		}
+		if dopt.fromEpoch, err = intOpt(opt, "from-epoch", f.opt.DriftEpoch); err != nil {
+			return nil, err
+		}
+		if dopt.toEpoch, err = intOpt(opt, "to-epoch", f.opt.DriftEpoch); err != nil {
+			return nil, err
+		}
+		if value := opt["bandwidth"]; value != "" {
+			if err := dopt.bandwidth.Set(value); err != nil {
+				return nil, fmt.Errorf("bad value for \"bandwidth\": %w", err)
+			}
+		}
+		report, err := f.delta(ctx, dopt)
+		if err != nil {
+			return nil, err
+		}
+		return formatResult(report, opt)
+	case "cost":
+		return formatResult(f.costReport(), opt)
+	case "tune":
+		return f.tune(ctx, opt)
+	case "progress":
+		if f.db == nil {
+			return nil, errors.New("progress needs an on disk database")
+		}
+		p, err := f.progress(ctx, f.toSpectraPath(""))
+		if err != nil {
+			return nil, err
+		}
+		return formatResult(p, opt)
+	case "limits":
+		return formatResult(f.softLimitReport(ctx), opt)
+	case "regenerate":
+		if f.db == nil {
+			return nil, errors.New("regenerate needs an on disk database")
+		}
+		dir := ""
+		if len(arg) > 0 {
+			dir = arg[0]
+		}
+		maxDepth, err := intOpt(opt, "max-depth", -1)
+		if err != nil {
+			return nil, err
+		}
+		p, err := f.regenerate(ctx, dir, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		return formatResult(p, opt)
+	case "reseed":
+		if err := f.checkWrite("reseed", ""); err != nil {
+			return nil, err
+		}
+		value, ok := opt["seed"]
+		if !ok {
+			return nil, errors.New("reseed needs the seed option")
+		}
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value for \"seed\": %w", err)
+		}
+		return nil, f.reseed(ctx, seed)
+	case "stats":
+		if f.db == nil {
+			return nil, errors.New("stats needs an on disk database")
+		}
+		stats, err := f.nodeStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return formatResult(stats, opt)
+	case "contention":
+		return formatResult(f.contentionReport(), opt)
+	case "profile":
+		_, reset := opt["reset"]
+		return formatResult(f.profileReport(reset), opt)
+	case "heatmap":
+		if f.heat == nil {
+			return nil, errors.New("heatmap needs the heatmap option")
+		}
+		depth, err := intOpt(opt, "depth", -1)
+		if err != nil {
+			return nil, err
+		}
+		top, err := intOpt(opt, "top", 0)
+		if err != nil {
+			return nil, err
+		}
+		r, err := f.heatReport(depth, opt["sort"], top)
+		if err != nil {
+			return nil, err
+		}
+		return formatResult(r, opt)
+	case "bench":
+		maxDepth, err := intOpt(opt, "max-depth", -1)
+		if err != nil {
+			return nil, err
+		}
+		files, err := intOpt(opt, "files", 100)
+		if err != nil {
+			return nil, err
+		}
+		result, err := f.bench(ctx, maxDepth, files)
+		if err != nil {
+			return nil, err
+		}
+		return formatResult(result, opt)
+	case "health":
+		var maxLatency time.Duration
+		if value := opt["max-latency"]; value != "" {
+			maxLatency, err = fs.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad value for \"max-latency\": %w", err)
+			}
+		}
+		report := f.health(ctx, maxLatency)
+		if err := report.err(); err != nil {
+			return nil, err
+		}
+		return report, nil
+	case "selftest":
+		scratch := opt["dir"]
+		if scratch == "" {
+			scratch = fmt.Sprintf("spectra-selftest-%d", time.Now().UnixNano())
+		}
+		return formatResult(f.selftest(ctx, scratch), opt)
+	case "replay":
+		if len(arg) != 1 {
+			return nil, errors.New("replay needs the path of the journal")
+		}
+		until, err := intOpt(opt, "until", 0)
+		if err != nil {
+			return nil, err
+		}
+		report, err := f.replay(ctx, arg[0], int64(until))
+		if err != nil {
+			return report, err
+		}
+		return formatResult(report, opt)
+	default:
+		return nil, fs.ErrorCommandNotFound
+	}
+}
+
+// intOpt parses the integer command option name, returning def if
+// it isn't set
+func intOpt(opt map[string]string, name string, def int) (int, error) {
+	value, ok := opt[name]
+	if !ok || value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("bad value for %q: %w", name, err)
+	}
+	return i, nil
+}
+
+// csvTabler is implemented by command results which can be rendered
+// as a CSV table
+type csvTabler interface {
+	// csvTable returns the header row followed by the data rows
+	csvTable() [][]string
+}
+
+// timeSerieser is implemented by command results which can be
+// rendered as points of time series
+type timeSerieser interface {
+	// timeSeries returns the result as points of time series
+	timeSeries() *timeSeries
+}
+
+// timeSeries is a command result as points of time series, measured
+// at one time, for the influx and prom formats
+type timeSeries struct {
+	measurement string    // name of the measurement, prefixing the Prometheus metrics
+	time        time.Time // when the points were measured
+	points      []seriesPoint
+}
+
+// seriesPoint is the values of a set of fields for a set of tags
+type seriesPoint struct {
+	tags   []seriesTag
+	fields []seriesField
+}
+
+// seriesTag is a tag of a point, a label in Prometheus
+type seriesTag struct {
+	key   string
+	value string
+}
+
+// seriesField is a value of a point, a metric in Prometheus
+type seriesField struct {
+	key   string
+	help  string // description of the Prometheus metric
+	value float64
+}
+
+// influxEscaper escapes the measurement names, tag keys, tag values
+// and field keys of InfluxDB line protocol
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influx renders the points as InfluxDB line protocol, one line per
+// point with a nanosecond timestamp
+func (ts *timeSeries) influx() string {
+	var b strings.Builder
+	for _, point := range ts.points {
+		b.WriteString(influxEscaper.Replace(ts.measurement))
+		for _, tag := range point.tags {
+			if tag.value == "" {
+				// Empty tag values aren't allowed
+				continue
+			}
+			fmt.Fprintf(&b, ",%s=%s", influxEscaper.Replace(tag.key), influxEscaper.Replace(tag.value))
+		}
+		for i, field := range point.fields {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			fmt.Fprintf(&b, "%s%s=%s", sep, influxEscaper.Replace(field.key), strconv.FormatFloat(field.value, 'g', -1, 64))
+		}
+		fmt.Fprintf(&b, " %d\n", ts.time.UnixNano())
+	}
+	return b.String()
+}
+
+// promEscaper escapes the label values of the Prometheus text format
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prom renders the points in the Prometheus text exposition format, as
+// read by the node exporter's textfile collector, with a gauge for
+// each field named after the measurement and the field.
+//
+// The collector doesn't allow timestamps, so the time of the points is
+// given by a gauge of its own.
+func (ts *timeSeries) prom() string {
+	var (
+		b     strings.Builder
+		order []seriesField
+		lines = map[string][]string{}
+	)
+	for _, point := range ts.points {
+		labels := make([]string, 0, len(point.tags))
+		for _, tag := range point.tags {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, tag.key, promEscaper.Replace(tag.value)))
+		}
+		for _, field := range point.fields {
+			if _, ok := lines[field.key]; !ok {
+				order = append(order, field)
+			}
+			lines[field.key] = append(lines[field.key], fmt.Sprintf("%s_%s{%s} %s",
+				ts.measurement, field.key, strings.Join(labels, ","), strconv.FormatFloat(field.value, 'g', -1, 64)))
+		}
+	}
+	for _, field := range order {
+		name := ts.measurement + "_" + field.key
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, field.help, name)
+		for _, line := range lines[field.key] {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+	}
+	name := ts.measurement + "_timestamp_seconds"
+	fmt.Fprintf(&b, "# HELP %s When the measurements were made, in seconds since the Unix epoch.\n# TYPE %s gauge\n", name, name)
+	fmt.Fprintf(&b, "%s %s\n", name, strconv.FormatFloat(float64(ts.time.UnixNano())/1e9, 'f', -1, 64))
+	return b.String()
+}
+
+// formatResult renders the command result out in the format chosen
+// by the "format" option.
+//
+// JSON is the default and returns out unchanged for the backend
+// command to encode. CSV, InfluxDB line protocol and the Prometheus
+// text format are returned as strings so they are printed verbatim.
+func formatResult(out any, opt map[string]string) (any, error) {
+	switch format := strings.ToLower(opt["format"]); format {
+	case "", "json":
+		return out, nil
+	case "csv":
+		table, ok := out.(csvTabler)
+		if !ok {
+			return nil, errors.New("this command doesn't support csv output")
+		}
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if err := w.WriteAll(table.csvTable()); err != nil {
+			return nil, fmt.Errorf("failed to write csv: %w", err)
+		}
+		return buf.String(), nil
+	case "influx", "prom":
+		series, ok := out.(timeSerieser)
+		if !ok {
+			return nil, fmt.Errorf("this command doesn't support %s output", format)
+		}
+		if format == "influx" {
+			return series.timeSeries().influx(), nil
+		}
+		return series.timeSeries().prom(), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q: use json, csv, influx or prom", format)
+	}
+}
+
+// sizeCount is a count of files and their total size
+type sizeCount struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// add accounts a file of size bytes
+func (c *sizeCount) add(size int64) {
+	c.Files++
+	c.Bytes += size
+}
+
+// depthStats are the statistics for one level of the tree
+type depthStats struct {
+	Depth int   `json:"depth"`
+	Dirs  int64 `json:"dirs"`
+	sizeCount
+}
+
+// extensionStats are the statistics for one file extension
+type extensionStats struct {
+	Extension string `json:"extension"`
+	sizeCount
+}
+
+// fanoutStats counts directories by the number of entries they hold
+type fanoutStats struct {
+	Entries int   `json:"entries"`
+	Dirs    int64 `json:"dirs"`
+}
+
+// lsStats is the result of the ls-stats command
+type lsStats struct {
+	Dirs        int64            `json:"dirs"`
+	Files       int64            `json:"files"`
+	Bytes       int64            `json:"bytes"`
+	MaxDepth    int              `json:"maxDepth"`
+	ByExtension []extensionStats `json:"byExtension"`
+	ByDepth     []depthStats     `json:"byDepth"`
+	Fanout      []fanoutStats    `json:"fanout"`
+}
+
+// csvTable returns the statistics as one CSV table with a row per
+// breakdown entry
+func (s *lsStats) csvTable() [][]string {
+	i64 := func(i int64) string { return strconv.FormatInt(i, 10) }
+	rows := [][]string{
+		{"section", "key", "dirs", "files", "bytes"},
+		{"total", "", i64(s.Dirs), i64(s.Files), i64(s.Bytes)},
+	}
+	for _, e := range s.ByExtension {
+		rows = append(rows, []string{"extension", e.Extension, "", i64(e.Files), i64(e.Bytes)})
+	}
+	for _, d := range s.ByDepth {
+		rows = append(rows, []string{"depth", strconv.Itoa(d.Depth), i64(d.Dirs), i64(d.Files), i64(d.Bytes)})
+	}
+	for _, fo := range s.Fanout {
+		rows = append(rows, []string{"fanout", strconv.Itoa(fo.Entries), i64(fo.Dirs), "", ""})
+	}
+	return rows
+}
+
+// lsStats walks the remote collecting the statistics for ls-stats
+func (f *Fs) lsStats(ctx context.Context, maxDepth int) (*lsStats, error) {
+	// Pass the depth on to ListR if the walk uses it
+	ctx, ci := fs.AddConfig(ctx)
+	ci.MaxDepth = maxDepth
+	var (
+		mu          sync.Mutex
+		byExtension = map[string]*sizeCount{}
+		byDepth     = map[int]*depthStats{}
+		fanout      = map[int]int64{}
+		out         = &lsStats{}
+	)
+	level := func(depth int) *depthStats {
+		ds := byDepth[depth]
+		if ds == nil {
+			ds = &depthStats{Depth: depth}
+			byDepth[depth] = ds
+		}
+		return ds
+	}
+	err := walk.Walk(ctx, f, "", true, maxDepth, func(dir string, entries fs.DirEntries, err error) error {
+		if err != nil {
+			return err
+		}
+		depth := 0
+		if dir != "" {
+			depth = strings.Count(dir, "/") + 1
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		out.Dirs++
+		out.MaxDepth = max(out.MaxDepth, depth)
+		level(depth).Dirs++
+		fanout[len(entries)]++
+		for _, entry := range entries {
+			o, ok := entry.(fs.Object)
+			if !ok {
+				continue
+			}
+			size := o.Size()
+			out.Files++
+			out.Bytes += size
+			level(depth + 1).add(size)
+			ext := strings.ToLower(path.Ext(o.Remote()))
+			if byExtension[ext] == nil {
+				byExtension[ext] = &sizeCount{}
+			}
+			byExtension[ext].add(size)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		return nil, fmt.Errorf("%q not found: %w", f.root, err)
+	} else if err != nil {
+		return nil, err
+	}
+	for ext, c := range byExtension {
+		out.ByExtension = append(out.ByExtension, extensionStats{Extension: ext, sizeCount: *c})
+	}
+	sort.Slice(out.ByExtension, func(i, j int) bool {
+		return out.ByExtension[i].Extension < out.ByExtension[j].Extension
+	})
+	for _, ds := range byDepth {
+		out.ByDepth = append(out.ByDepth, *ds)
+	}
+	sort.Slice(out.ByDepth, func(i, j int) bool {
+		return out.ByDepth[i].Depth < out.ByDepth[j].Depth
+	})
+	for entries, dirs := range fanout {
+		out.Fanout = append(out.Fanout, fanoutStats{Entries: entries, Dirs: dirs})
+	}
+	sort.Slice(out.Fanout, func(i, j int) bool {
+		return out.Fanout[i].Entries < out.Fanout[j].Entries
+	})
+	return out, nil
+}
+
+// worldInfo describes one world for seed-info
+type worldInfo struct {
+	Name        string  `json:"name"`
+	Probability float64 `json:"probability"`
+	Seed        int64   `json:"seed"`
+	SimSeed     int64   `json:"simSeed"`
+	Selected    bool    `json:"selected"`
+}
+
+// seedInfo is the result of the seed-info command
+type seedInfo struct {
+	ConfigPath string            `json:"configPath"`
+	Generation any               `json:"generation"`
+	Worlds     []worldInfo       `json:"worlds"`
+	Options    map[string]string `json:"options"`
+}
+
+// seedInfo collects the resolved generation parameters
+func (f *Fs) seedInfo() (*seedInfo, error) {
+	cfg := f.engine.GetConfig()
+	out := &seedInfo{
+		ConfigPath: f.opt.ConfigPath,
+		Generation: cfg.Seed,
+		Options:    map[string]string{},
+	}
+	out.Worlds = append(out.Worlds, worldInfo{Name: "primary", Probability: 1})
+	for _, name := range getSecondaryTableNames(cfg) {
+		out.Worlds = append(out.Worlds, worldInfo{Name: name, Probability: cfg.SecondaryTables[name]})
+	}
+	sort.Slice(out.Worlds[1:], func(i, j int) bool {
+		return out.Worlds[i+1].Name < out.Worlds[j+1].Name
+	})
+	for i := range out.Worlds {
+		w := &out.Worlds[i]
+		w.Seed = deriveWorldSeed(cfg.Seed.Seed, w.Name)
+		w.SimSeed = w.Seed
+		if f.opt.SimSeed != 0 {
+			w.SimSeed = deriveWorldSeed(f.opt.SimSeed, w.Name)
+		}
+		w.Selected = w.Name == f.opt.World
+	}
+	items, err := configstruct.Items(&f.opt)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		out.Options[item.Name], err = configstruct.InterfaceToString(item.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to show option %q: %w", item.Name, err)
+		}
+	}
+	return out, nil
+}
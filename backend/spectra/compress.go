@@ -0,0 +1,93 @@
+// Compression of stored blobs for the Spectra backend
+package spectra
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression methods for db_compression
+const (
+	compressionOff  = "off"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// zstdCodec returns the shared zstd encoder and decoder, which are safe
+// for concurrent use with EncodeAll and DecodeAll
+var zstdCodec = sync.OnceValues(func() (*zstd.Encoder, *zstd.Decoder) {
+	enc, _ := zstd.NewWriter(nil)
+	dec, _ := zstd.NewReader(nil)
+	return enc, dec
+})
+
+// checkCompression returns an error if method isn't a known
+// compression method
+func checkCompression(method string) error {
+	switch method {
+	case compressionOff, compressionGzip, compressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown db_compression %q: use %s, %s or %s", method, compressionOff, compressionGzip, compressionZstd)
+}
+
+// compressBlob compresses data with method, returning the data to store
+// and the method it was stored with.
+//
+// Data which doesn't get smaller is stored as it is, so incompressible
+// data costs nothing extra to read.
+func compressBlob(method string, data []byte) ([]byte, string, error) {
+	var out []byte
+	switch method {
+	case compressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, "", fmt.Errorf("failed to compress blob: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, "", fmt.Errorf("failed to compress blob: %w", err)
+		}
+		out = buf.Bytes()
+	case compressionZstd:
+		enc, _ := zstdCodec()
+		out = enc.EncodeAll(data, nil)
+	default:
+		return data, compressionOff, nil
+	}
+	if len(out) >= len(data) {
+		return data, compressionOff, nil
+	}
+	return out, method, nil
+}
+
+// decompressBlob reverses compressBlob for data stored with method
+func decompressBlob(method string, data []byte) ([]byte, error) {
+	switch method {
+	case compressionOff:
+		return data, nil
+	case compressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress blob: %w", err)
+		}
+		out, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress blob: %w", err)
+		}
+		return out, nil
+	case compressionZstd:
+		_, dec := zstdCodec()
+		out, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress blob: %w", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("blob stored with unknown compression %q", method)
+}
@@ -0,0 +1,157 @@
+// File content generation for the Spectra backend
+package spectra
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+// isGiant returns whether the file at spectraPath has been promoted
+// to a giant object.
+//
+// The choice is a pure function of the generation seed and the path
+// so the same files are giant on every run and in every world.
+func (f *Fs) isGiant(spectraPath string) bool {
+	if f.opt.GiantObjectRate <= 0 || f.opt.GiantObjectSize <= 0 {
+		return false
+	}
+	if f.opt.GiantObjectRate >= 1 {
+		return true
+	}
+	return pathFraction(f.engine.GetConfig().Seed.Seed, "giant", spectraPath) < f.opt.GiantObjectRate
+}
+
+// fileSize returns the size reported for the file at spectraPath
+// given the size stored in the Spectra database.
+func (f *Fs) fileSize(spectraPath string, size int64) int64 {
+	if f.isGiant(spectraPath) {
+		return int64(f.opt.GiantObjectSize)
+	}
+	return size
+}
+
+// giantSHA256 returns the SHA256 of a giant object of size bytes
+// made from block.
+//
+// Every giant object of a given size has the same content so the
+// result is computed once per size and cached.
+func (f *Fs) giantSHA256(block []byte, size int64) (string, error) {
+	f.giantHashMu.Lock()
+	defer f.giantHashMu.Unlock()
+	if sum, ok := f.giantHash[size]; ok {
+		return sum, nil
+	}
+	sum, err := tiledSHA256(block, size)
+	if err != nil {
+		return "", err
+	}
+	f.giantHash[size] = sum
+	return sum, nil
+}
+
+// worldSeed returns the seed for choices which should differ between
+// worlds, such as which files drift.
+func (f *Fs) worldSeed() int64 {
+	return deriveWorldSeed(f.engine.GetConfig().Seed.Seed, f.opt.World)
+}
+
+// simSeed returns the seed of the world's simulated misbehaviour,
+// derived from sim_seed if it is set and the world's seed otherwise
+func (f *Fs) simSeed() int64 {
+	if f.opt.SimSeed == 0 {
+		return f.worldSeed()
+	}
+	return deriveWorldSeed(f.opt.SimSeed, f.opt.World)
+}
+
+// deriveWorldSeed derives the seed for world from the generation
+// seed. The primary world uses the generation seed itself.
+func deriveWorldSeed(seed int64, world string) int64 {
+	if world == "primary" {
+		return seed
+	}
+	return int64(seedHash(seed, "world", world))
+}
+
+// pathFraction deterministically maps seed, salt and pth onto [0, 1)
+func pathFraction(seed int64, salt, pth string) float64 {
+	return float64(seedHash(seed, salt, pth)>>11) / float64(uint64(1)<<53)
+}
+
+// seedHash deterministically hashes seed, salt and pth to 64 bits
+func seedHash(seed int64, salt, pth string) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(seed))
+	_, _ = h.Write(buf[:])
+	_, _ = h.Write([]byte(salt))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(pth))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer which spreads the entropy of x
+// over all the output bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// tiledReader reads the bytes [off, end) of a stream made by
+// repeating block end to end.
+//
+// This lets files larger than the block Spectra generates be read
+// without ever holding more than the block in memory.
+type tiledReader struct {
+	block []byte
+	off   int64
+	end   int64
+}
+
+// newTiledReader returns a reader for bytes [off, end) of block tiled
+func newTiledReader(block []byte, off, end int64) *tiledReader {
+	return &tiledReader{block: block, off: off, end: end}
+}
+
+// Read implements io.Reader
+func (r *tiledReader) Read(p []byte) (n int, err error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	if remaining := r.end - r.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	blockSize := int64(len(r.block))
+	first := min(int64(len(p)), blockSize)
+	for int64(n) < first {
+		n += copy(p[n:first], r.block[(r.off+int64(n))%blockSize:])
+	}
+	// p repeats every block from here on, so the rest is copied from
+	// what has been read, doubling it each time. A large read takes a
+	// few copies instead of one for each block.
+	for n < len(p) {
+		n += copy(p[n:], p[:n])
+	}
+	r.off += int64(n)
+	return n, nil
+}
+
+// tiledSHA256 returns the hex SHA256 of block repeated to size bytes
+func tiledSHA256(block []byte, size int64) (string, error) {
+	if len(block) == 0 {
+		return "", fmt.Errorf("can't hash %d bytes of an empty block", size)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, newTiledReader(block, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
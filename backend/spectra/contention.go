@@ -0,0 +1,357 @@
+// Thread-safe engine access for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// lockStripes is the number of locks the directories of the world are
+// spread over
+const lockStripes = 64
+
+// Engine calls whose contention is measured
+const (
+	engineListChildren = iota
+	engineGetNode
+	engineGetFileData
+	engineCreateFolder
+	engineUploadFile
+	engineReplaceFile
+	engineSetModTime
+	engineAttributes
+	engineDeleteNode
+	engineReset
+	engineRenamePrefix
+	numEngineCalls
+)
+
+// engineCallNames are the names of the engine calls in reports
+var engineCallNames = [numEngineCalls]string{"list_children", "get_node", "get_file_data", "create_folder", "upload_file", "replace_file", "set_mod_time", "attributes", "delete_node", "reset", "rename_prefix"}
+
+// lockStats counts the calls of one kind and how long they waited for
+// their locks
+type lockStats struct {
+	calls     atomic.Int64 // calls made
+	contended atomic.Int64 // calls which had to wait for a lock
+	wait      atomic.Int64 // nanoseconds spent waiting
+	maxWait   atomic.Int64 // longest wait in nanoseconds
+}
+
+// waited records a call which waited d for its locks
+func (s *lockStats) waited(d time.Duration) {
+	s.contended.Add(1)
+	s.wait.Add(int64(d))
+	for {
+		old := s.maxWait.Load()
+		if int64(d) <= old || s.maxWait.CompareAndSwap(old, int64(d)) {
+			return
+		}
+	}
+}
+
+// lockedEngine makes an engine safe for the many goroutines of a
+// highly parallel rclone, and types the errors it returns with
+// typedError.
+//
+// The SDK makes one call at a time on its database, but checking
+// whether a folder has children and generating them if not are
+// separate steps, so two listings of a folder at once can both
+// generate its children, and Reset swaps the generator under calls in
+// progress. Calls which list or change a folder hold the lock of its
+// stripe, so different folders go ahead in parallel, and every call
+// shares a lock Reset holds alone.
+//
+// How often and for how long calls wait for the locks is counted for
+// the contention command.
+type lockedEngine struct {
+	engine
+	mu      sync.RWMutex              // held shared by calls and alone by Reset
+	stripes [lockStripes]sync.Mutex   // locks of the folders being listed or changed
+	stats   [numEngineCalls]lockStats // contention per call
+}
+
+// newLockedEngine wraps e so it can be called concurrently
+func newLockedEngine(e engine) *lockedEngine {
+	return &lockedEngine{engine: e}
+}
+
+// stripe returns the lock of the folder with id or at spectraPath
+func (e *lockedEngine) stripe(id, spectraPath string) *sync.Mutex {
+	h := fnv.New32a()
+	if spectraPath != "" {
+		_, _ = h.Write([]byte(spectraPath))
+	} else {
+		_, _ = h.Write([]byte(id))
+	}
+	return &e.stripes[h.Sum32()%lockStripes]
+}
+
+// enter takes the locks of a call, the lock of the folder it lists or
+// changes as well if folder isn't nil, and returns the function
+// releasing them
+func (e *lockedEngine) enter(call int, folder *sync.Mutex) (exit func()) {
+	s := &e.stats[call]
+	s.calls.Add(1)
+	start := time.Now()
+	contended := false
+	if !e.mu.TryRLock() {
+		contended = true
+		e.mu.RLock()
+	}
+	if folder != nil && !folder.TryLock() {
+		contended = true
+		folder.Lock()
+	}
+	if contended {
+		s.waited(time.Since(start))
+	}
+	return func() {
+		if folder != nil {
+			folder.Unlock()
+		}
+		e.mu.RUnlock()
+	}
+}
+
+// ListChildren lists the children of a folder in a world, generating
+// them if the folder has none
+func (e *lockedEngine) ListChildren(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	defer e.enter(engineListChildren, e.stripe(req.ParentID, req.ParentPath))()
+	result, err := e.engine.ListChildren(ctx, req)
+	return result, typedError(err)
+}
+
+// GetNode returns the node with an ID or at a path in a world
+func (e *lockedEngine) GetNode(ctx context.Context, req *sdk.GetNodeRequest) (*sdk.Node, error) {
+	defer e.enter(engineGetNode, nil)()
+	node, err := e.engine.GetNode(ctx, req)
+	return node, typedError(err)
+}
+
+// GetFileData returns the data block and checksum of a file
+func (e *lockedEngine) GetFileData(ctx context.Context, id string) ([]byte, string, error) {
+	defer e.enter(engineGetFileData, nil)()
+	data, checksum, err := e.engine.GetFileData(ctx, id)
+	return data, checksum, typedError(err)
+}
+
+// CreateFolder creates a folder in a parent folder
+func (e *lockedEngine) CreateFolder(ctx context.Context, req *sdk.CreateFolderRequest) (*sdk.Node, error) {
+	defer e.enter(engineCreateFolder, e.stripe(req.ParentID, req.ParentPath))()
+	node, err := e.engine.CreateFolder(ctx, req)
+	return node, typedError(err)
+}
+
+// UploadFile creates a file in a parent folder
+func (e *lockedEngine) UploadFile(ctx context.Context, req *sdk.UploadFileRequest) (*sdk.Node, error) {
+	defer e.enter(engineUploadFile, e.stripe(req.ParentID, req.ParentPath))()
+	node, err := e.engine.UploadFile(ctx, req)
+	return node, typedError(err)
+}
+
+// ReplaceFile replaces the content of the file with id, if the engine
+// can do so in place
+func (e *lockedEngine) ReplaceFile(id string, data []byte) (*sdk.Node, error) {
+	replacer, ok := e.engine.(contentReplacer)
+	if !ok {
+		return nil, errCantReplace
+	}
+	defer e.enter(engineReplaceFile, nil)()
+	node, err := replacer.ReplaceFile(id, data)
+	return node, typedError(err)
+}
+
+// SetModTime sets the modification time of the node with id, if the
+// engine keeps modification times
+func (e *lockedEngine) SetModTime(id string, modTime time.Time) (*sdk.Node, error) {
+	keeper, ok := e.engine.(attributeKeeper)
+	if !ok {
+		return nil, errCantKeepAttributes
+	}
+	defer e.enter(engineSetModTime, nil)()
+	node, err := keeper.SetModTime(id, modTime)
+	return node, typedError(err)
+}
+
+// Attributes returns the metadata of the node with id, if the engine
+// keeps metadata
+func (e *lockedEngine) Attributes(id string) (map[string]string, error) {
+	keeper, ok := e.engine.(attributeKeeper)
+	if !ok {
+		return nil, errCantKeepAttributes
+	}
+	defer e.enter(engineAttributes, nil)()
+	attrs, err := keeper.Attributes(id)
+	return attrs, typedError(err)
+}
+
+// SetAttributes replaces the metadata of the node with id, if the
+// engine keeps metadata
+func (e *lockedEngine) SetAttributes(id string, attrs map[string]string) error {
+	keeper, ok := e.engine.(attributeKeeper)
+	if !ok {
+		return errCantKeepAttributes
+	}
+	defer e.enter(engineAttributes, nil)()
+	return typedError(keeper.SetAttributes(id, attrs))
+}
+
+// DeleteNode deletes the node with an ID or at a path in a world
+func (e *lockedEngine) DeleteNode(ctx context.Context, req *sdk.DeleteNodeRequest) error {
+	var folder *sync.Mutex
+	if req.Path != "" {
+		folder = e.stripe("", parentPath(path.Clean(req.Path)))
+	}
+	defer e.enter(engineDeleteNode, folder)()
+	return typedError(e.engine.DeleteNode(ctx, req))
+}
+
+// Reset deletes every node and recreates the root, once the calls in
+// progress have finished
+func (e *lockedEngine) Reset(ctx context.Context) error {
+	s := &e.stats[engineReset]
+	s.calls.Add(1)
+	start := time.Now()
+	if !e.mu.TryLock() {
+		e.mu.Lock()
+		s.waited(time.Since(start))
+	}
+	defer e.mu.Unlock()
+	return e.engine.Reset(ctx)
+}
+
+// RenamePrefix renames the folder at srcPath in a world to dstPath
+// along with everything below it, if the engine can.
+//
+// Many folders change at once, so it waits for the calls in progress
+// to finish and holds off the rest until it is done, as Reset does,
+// so no call sees the tree half renamed.
+func (e *lockedEngine) RenamePrefix(world, srcPath, dstPath string) (int64, error) {
+	renamer, ok := e.engine.(prefixRenamer)
+	if !ok {
+		return 0, errCantRename
+	}
+	s := &e.stats[engineRenamePrefix]
+	s.calls.Add(1)
+	start := time.Now()
+	if !e.mu.TryLock() {
+		e.mu.Lock()
+		s.waited(time.Since(start))
+	}
+	defer e.mu.Unlock()
+	n, err := renamer.RenamePrefix(world, srcPath, dstPath)
+	return n, typedError(err)
+}
+
+// Close closes the engine once the calls in progress have finished,
+// including those abandoned by op_timeout, so the database isn't
+// closed under them
+func (e *lockedEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.engine.Close()
+}
+
+// Uploaded returns whether the file with id was uploaded, if the
+// engine keeps the content of uploaded files itself
+func (e *lockedEngine) Uploaded(id string) bool {
+	keeper, ok := e.engine.(contentKeeper)
+	return ok && keeper.Uploaded(id)
+}
+
+// callContention is the contention of one kind of engine call
+type callContention struct {
+	Call        string  `json:"call"`
+	Calls       int64   `json:"calls"`
+	Contended   int64   `json:"contended"`
+	WaitSeconds float64 `json:"waitSeconds"`
+	MaxWait     float64 `json:"maxWaitSeconds"`
+}
+
+// poolContention is the contention of a pool of database connections
+// or of operation slots
+type poolContention struct {
+	Pool        string  `json:"pool"`
+	Open        int     `json:"open"`
+	InUse       int     `json:"inUse"`
+	Waits       int64   `json:"waits"`
+	WaitSeconds float64 `json:"waitSeconds"`
+}
+
+// contentionReport is the result of the contention command
+type contentionReport struct {
+	Engine []callContention `json:"engine"`
+	Pools  []poolContention `json:"pools"`
+	Ops    []poolContention `json:"ops"`
+}
+
+// contentionReport returns how often and for how long calls to the
+// engine, queries of the database and operations in the concurrency
+// pools have waited for each other
+func (f *Fs) contentionReport() *contentionReport {
+	r := &contentionReport{Engine: []callContention{}, Pools: []poolContention{}, Ops: []poolContention{}}
+	if e, ok := f.engine.(*lockedEngine); ok {
+		for call := range e.stats {
+			s := &e.stats[call]
+			r.Engine = append(r.Engine, callContention{
+				Call:        engineCallNames[call],
+				Calls:       s.calls.Load(),
+				Contended:   s.contended.Load(),
+				WaitSeconds: time.Duration(s.wait.Load()).Seconds(),
+				MaxWait:     time.Duration(s.maxWait.Load()).Seconds(),
+			})
+		}
+	}
+	pool := func(name string, db *sql.DB) {
+		stats := db.Stats()
+		r.Pools = append(r.Pools, poolContention{
+			Pool:        name,
+			Open:        stats.OpenConnections,
+			InUse:       stats.InUse,
+			Waits:       stats.WaitCount,
+			WaitSeconds: stats.WaitDuration.Seconds(),
+		})
+	}
+	if f.db != nil {
+		pool("write", f.db)
+		if f.readDB != f.db {
+			pool("read", f.readDB)
+		}
+	}
+	r.Ops = append(r.Ops, f.pools.contention()...)
+	return r
+}
+
+// csvTable returns the report as one CSV table with a row per engine
+// call, one per connection pool and one per concurrency pool
+func (r *contentionReport) csvTable() [][]string {
+	f64 := func(x float64) string { return strconv.FormatFloat(x, 'f', -1, 64) }
+	i64 := func(i int64) string { return strconv.FormatInt(i, 10) }
+	rows := [][]string{{"item", "calls", "contended", "wait_seconds", "max_wait_seconds"}}
+	for _, c := range r.Engine {
+		rows = append(rows, []string{c.Call, i64(c.Calls), i64(c.Contended), f64(c.WaitSeconds), f64(c.MaxWait)})
+	}
+	for _, p := range r.Pools {
+		rows = append(rows, []string{p.Pool + "_db", "", i64(p.Waits), f64(p.WaitSeconds), ""})
+	}
+	for _, p := range r.Ops {
+		rows = append(rows, []string{p.Pool + "_ops", "", i64(p.Waits), f64(p.WaitSeconds), ""})
+	}
+	return rows
+}
+
+// Check the interfaces are satisfied
+var (
+	_ engine          = (*lockedEngine)(nil)
+	_ contentKeeper   = (*lockedEngine)(nil)
+	_ contentReplacer = (*lockedEngine)(nil)
+)
@@ -0,0 +1,113 @@
+// World control from Go for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+)
+
+// GenerationProgress is how much of a tree has been generated, as
+// returned by Materialize
+type GenerationProgress = generationProgress
+
+// WorldSnapshot describes a snapshot of a world, as returned by
+// SnapshotWorld and RestoreWorld
+type WorldSnapshot = worldSnapshot
+
+// The methods below let test harnesses in Go do what the backend
+// commands do without going through rclone backend. They are wrapped
+// by the worldctl package, which sets up the remote too.
+
+// Materialize generates everything below the directory dir of the
+// remote which hasn't been generated yet, down to maxDepth levels below
+// it unless maxDepth is negative, as the regenerate command does.
+func (f *Fs) Materialize(ctx context.Context, dir string, maxDepth int) (*GenerationProgress, error) {
+	if f.db == nil {
+		return nil, errors.New("materialize needs an on disk database")
+	}
+	defer f.nodeCache.change()()
+	return f.regenerate(ctx, dir, maxDepth)
+}
+
+// Churn adds grow files to the world and removes shrink files from it
+// straight away, as growth_rate and shrink_rate do over time, and
+// returns how many were added and removed.
+//
+// The files are picked as growth_rate and shrink_rate pick them, and
+// carry on their numbering, so the same calls against the same dataset
+// change it the same way. Fewer are removed if there are too few files
+// left to remove.
+func (f *Fs) Churn(ctx context.Context, grow, shrink int64) (grown, shrunk int64, err error) {
+	if f.db == nil {
+		return 0, 0, errors.New("churn needs an on disk database")
+	}
+	if err := f.checkWrite("churn", ""); err != nil {
+		return 0, 0, err
+	}
+	f.churnMu.Lock()
+	defer f.churnMu.Unlock()
+	startGrown, startShrunk := f.churn.grown, f.churn.shrunk
+	defer func() {
+		grown, shrunk = f.churn.grown-startGrown, f.churn.shrunk-startShrunk
+		if grown != 0 || shrunk != 0 {
+			f.nodeCache.clear()
+		}
+	}()
+	if grow > 0 {
+		if err := f.grow(ctx, startGrown+grow); err != nil {
+			return 0, 0, err
+		}
+	}
+	if shrink > 0 {
+		if err := f.shrink(ctx, startShrunk+shrink); err != nil {
+			return 0, 0, err
+		}
+	}
+	return 0, 0, nil
+}
+
+// Reseed rebuilds the world from seed, as the reseed command does
+func (f *Fs) Reseed(ctx context.Context, seed int64) error {
+	if err := f.checkWrite("reseed", ""); err != nil {
+		return err
+	}
+	defer f.nodeCache.change()()
+	return f.reseed(ctx, seed)
+}
+
+// SnapshotWorld stores a copy of the world in the database under name,
+// as the snapshot command does
+func (f *Fs) SnapshotWorld(ctx context.Context, name string) (*WorldSnapshot, error) {
+	if f.db == nil {
+		return nil, errors.New("snapshot needs an on disk database")
+	}
+	if name == "" {
+		return nil, errors.New("snapshot needs a name")
+	}
+	defer f.nodeCache.change()()
+	snapshot, err := f.snapshotWorld(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// RestoreWorld rolls the world back to the snapshot called name, as the
+// restore command does with -o snapshot
+func (f *Fs) RestoreWorld(ctx context.Context, name string) (*WorldSnapshot, error) {
+	if f.db == nil {
+		return nil, errors.New("restore needs an on disk database to roll back to a snapshot")
+	}
+	if name == "" {
+		return nil, errors.New("restore needs the name of the snapshot")
+	}
+	if err := f.checkWrite("restore", ""); err != nil {
+		return nil, err
+	}
+	defer f.nodeCache.change()()
+	snapshot, err := f.restoreWorld(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
@@ -0,0 +1,44 @@
+// Corrupted reads for the Spectra backend
+package spectra
+
+import (
+	"io"
+)
+
+// corruption returns the offset of the byte corrupted in reads of the
+// file at spectraPath, size bytes long, and the bits flipped in it, as
+// chosen by corrupt_rate, or an offset of -1 if it isn't corrupted.
+//
+// Which files are corrupted, and where, depends only on sim_seed and
+// the path, so the same files are corrupted on every run.
+func (f *Fs) corruption(spectraPath string, size int64) (off int64, mask byte) {
+	if f.opt.CorruptRate <= 0 || size <= 0 {
+		return -1, 0
+	}
+	seed := f.simSeed()
+	if pathFraction(seed, "corrupt", spectraPath) >= f.opt.CorruptRate {
+		return -1, 0
+	}
+	h := seedHash(seed, "corrupt/byte", spectraPath)
+	// The mask is never 0 so the byte always changes
+	return int64((h >> 8) % uint64(size)), byte(h%255) + 1
+}
+
+// corruptReader flips the bits in mask of the byte at off of the data
+// read from in, which starts at pos
+type corruptReader struct {
+	in   io.Reader
+	pos  int64
+	off  int64
+	mask byte
+}
+
+// Read reads from in, corrupting the byte at off if it is read
+func (r *corruptReader) Read(p []byte) (n int, err error) {
+	n, err = r.in.Read(p)
+	if i := r.off - r.pos; i >= 0 && i < int64(n) {
+		p[i] ^= r.mask
+	}
+	r.pos += int64(n)
+	return n, err
+}
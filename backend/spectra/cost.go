@@ -0,0 +1,130 @@
+// Simulated request costs for the Spectra backend
+package spectra
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// costs counts the requests made and data read by a remote so their
+// simulated cost can be reported
+type costs struct {
+	requests [numOpClasses]atomic.Int64 // requests made per operation class
+	egress   atomic.Int64               // bytes of file data read
+}
+
+// costReport is the simulated spend of a remote as reported by the cost
+// command
+type costReport struct {
+	Requests    map[string]int64   `json:"requests"`
+	EgressBytes int64              `json:"egressBytes"`
+	Spend       map[string]float64 `json:"spend"`
+	Total       float64            `json:"total"`
+}
+
+// prices returns the cost of 1,000 requests of each operation class
+func (opt *Options) prices() [numOpClasses]float64 {
+	return [numOpClasses]float64{
+		opList:  opt.CostList,
+		opStat:  opt.CostStat,
+		opRead:  opt.CostRead,
+		opWrite: opt.CostWrite,
+	}
+}
+
+// costed returns whether any costs are set
+func (opt *Options) costed() bool {
+	for _, price := range opt.prices() {
+		if price > 0 {
+			return true
+		}
+	}
+	return opt.CostEgress > 0
+}
+
+// costReport returns the requests made and data read so far and what
+// they would have cost
+func (f *Fs) costReport() *costReport {
+	r := &costReport{
+		Requests:    make(map[string]int64, numOpClasses),
+		EgressBytes: f.costs.egress.Load(),
+		Spend:       make(map[string]float64, numOpClasses+1),
+	}
+	for class, price := range f.opt.prices() {
+		n := f.costs.requests[class].Load()
+		name := opClass(class).String()
+		r.Requests[name] = n
+		r.Spend[name] = roundSpend(float64(n) * price / 1000)
+		r.Total += r.Spend[name]
+	}
+	r.Spend["egress"] = roundSpend(float64(r.EgressBytes) * f.opt.CostEgress / (1 << 30))
+	r.Total = roundSpend(r.Total + r.Spend["egress"])
+	return r
+}
+
+// roundSpend rounds x to a billionth to hide floating point noise
+func roundSpend(x float64) float64 {
+	return math.Round(x*1e9) / 1e9
+}
+
+// csvTable returns the report as one CSV table with a row per
+// operation class and one for egress
+func (r *costReport) csvTable() [][]string {
+	f64 := func(x float64) string { return strconv.FormatFloat(x, 'f', -1, 64) }
+	rows := [][]string{{"item", "count", "spend"}}
+	for _, name := range opClassNames {
+		rows = append(rows, []string{name, strconv.FormatInt(r.Requests[name], 10), f64(r.Spend[name])})
+	}
+	rows = append(rows,
+		[]string{"egress", strconv.FormatInt(r.EgressBytes, 10), f64(r.Spend["egress"])},
+		[]string{"total", "", f64(r.Total)},
+	)
+	return rows
+}
+
+// String summarises the report on one line for the log
+func (r *costReport) String() string {
+	var requests []string
+	for _, name := range opClassNames {
+		requests = append(requests, fmt.Sprintf("%d %s", r.Requests[name], name))
+	}
+	return fmt.Sprintf("simulated spend %.4f for %s requests and %v egress",
+		r.Total, strings.Join(requests, ", "), fs.SizeSuffix(r.EgressBytes))
+}
+
+// logCosts logs the simulated spend if any costs are set
+func (f *Fs) logCosts() {
+	if f.opt.costed() {
+		fs.Logf(f, "Cost: %v", f.costReport())
+	}
+}
+
+// egressReader counts the bytes read through it as egress, failing
+// reads once egress reaches budget if that is set
+type egressReader struct {
+	in     io.Reader
+	egress *atomic.Int64
+	budget int64
+}
+
+// Read reads from the underlying reader counting the bytes read
+func (r *egressReader) Read(p []byte) (n int, err error) {
+	if r.budget > 0 && len(p) > 0 {
+		left := r.budget - r.egress.Load()
+		if left <= 0 {
+			return 0, &budgetError{limit: "max_read_bytes", budget: r.budget, bytes: true}
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err = r.in.Read(p)
+	r.egress.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,442 @@
+// Direct database access for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+
+	_ "github.com/mattn/go-sqlite3" // sqlite3 driver used by the Spectra SDK
+)
+
+// deleteBatchSize is the number of trees deleted per statement
+const deleteBatchSize = 500
+
+// lookupBatchSize is the number of paths looked up per statement
+const lookupBatchSize = 500
+
+// openDB opens a handle on the Spectra database at dbPath for the
+// operations the SDK doesn't provide.
+//
+// It returns nil and no error if the database is in memory, as it
+// can't be shared with the SDK.
+func openDB(dbPath string) (*sql.DB, error) {
+	if dbPath == "" || dbPath == ":memory:" {
+		return nil, nil
+	}
+	// Wait for the SDK's own writes rather than failing with
+	// "database is locked"
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?_busy_timeout=10000&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Spectra database: %w", err)
+	}
+	// A single connection keeps our writes serialised
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// openReadDB opens a pool of conns read only connections to the
+// Spectra database at dbPath for looking up nodes.
+//
+// It returns nil and no error if the database is in memory or conns
+// isn't positive.
+func openReadDB(dbPath string, conns int) (*sql.DB, error) {
+	if dbPath == "" || dbPath == ":memory:" || conns <= 0 {
+		return nil, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro&_busy_timeout=10000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Spectra database: %w", err)
+	}
+	db.SetMaxOpenConns(conns)
+	db.SetMaxIdleConns(conns)
+	return db, nil
+}
+
+// worldKey returns the JSON path of world in a node's existence map
+func worldKey(world string) string {
+	return `$."` + world + `"`
+}
+
+// dbNode is a node as read from the database
+type dbNode struct {
+	id       string
+	nodeType string
+}
+
+// lookupNode reads the node at spectraPath in the current world from
+// the database without generating anything, returning nil if it
+// doesn't exist.
+func (f *Fs) lookupNode(ctx context.Context, spectraPath string) (*dbNode, error) {
+	var node dbNode
+	err := f.readDB.QueryRowContext(ctx, `
+SELECT id, type FROM nodes
+WHERE path = ? AND json_extract(existence_map, ?) = 1`,
+		spectraPath, worldKey(f.opt.World)).Scan(&node.id, &node.nodeType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %q: %w", spectraPath, err)
+	}
+	return &node, nil
+}
+
+// lookupNodes reads the nodes at spectraPaths in the current world
+// from the database without generating anything, returning the ones
+// which exist keyed by path.
+//
+// The paths are looked up in batches with a query each, however many
+// directories they are spread over.
+func (f *Fs) lookupNodes(ctx context.Context, spectraPaths []string) (map[string]*sdk.Node, error) {
+	nodes := make(map[string]*sdk.Node, len(spectraPaths))
+	for start := 0; start < len(spectraPaths); start += lookupBatchSize {
+		batch := spectraPaths[start:min(start+lookupBatchSize, len(spectraPaths))]
+		args := make([]any, 0, len(batch)+1)
+		args = append(args, worldKey(f.opt.World))
+		for _, spectraPath := range batch {
+			args = append(args, spectraPath)
+		}
+		found, err := f.queryNodes(ctx, `
+WHERE json_extract(existence_map, ?) = 1 AND path IN (?`+strings.Repeat(", ?", len(batch)-1)+`)`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up nodes: %w", err)
+		}
+		for i := range found {
+			nodes[found[i].Path] = &found[i]
+		}
+	}
+	return nodes, nil
+}
+
+// listStored lists the children of the directory at spectraPath in
+// the current world which are already in the database, without
+// generating any.
+//
+// Like listChildren it returns nil and no error if the directory
+// doesn't exist.
+func (f *Fs) listStored(ctx context.Context, spectraPath string) (*sdk.ListResult, error) {
+	var (
+		parentID    string
+		inWorld     bool
+		worldLookup = worldKey(f.opt.World)
+	)
+	err := f.readDB.QueryRowContext(ctx, `
+SELECT id, coalesce(json_extract(existence_map, ?), 0) FROM nodes WHERE path = ?`,
+		worldLookup, spectraPath).Scan(&parentID, &inWorld)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %q: %w", spectraPath, err)
+	}
+	result := &sdk.ListResult{
+		Success: true,
+		Folders: make([]sdk.Folder, 0),
+		Files:   make([]sdk.File, 0),
+	}
+	if !inWorld {
+		return result, nil
+	}
+	nodes, err := f.queryNodes(ctx, `
+WHERE parent_id = ? AND json_extract(existence_map, ?) = 1
+ORDER BY type, name`, parentID, worldLookup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %w", spectraPath, err)
+	}
+	for _, node := range nodes {
+		switch node.Type {
+		case sdk.NodeTypeFolder:
+			result.Folders = append(result.Folders, sdk.Folder{Node: node})
+		case sdk.NodeTypeFile:
+			result.Files = append(result.Files, sdk.File{Node: node})
+		}
+	}
+	return result, nil
+}
+
+// listTree returns every node below the directory at spectraPath in
+// the current world which is already in the database, in one query,
+// without generating any.
+//
+// Nodes deeper than maxDepth are left out unless it is negative.
+func (f *Fs) listTree(ctx context.Context, spectraPath string, maxDepth int) ([]sdk.Node, error) {
+	return f.listTreeIn(ctx, f.readDB, spectraPath, maxDepth)
+}
+
+// listTreeIn is listTree reading from the nodes table in db
+func (f *Fs) listTreeIn(ctx context.Context, db *sql.DB, spectraPath string, maxDepth int) ([]sdk.Node, error) {
+	prefix := spectraPath + "/"
+	if spectraPath == "/" {
+		prefix = "/"
+	}
+	// Descendants sort between "path/" and "path0" as '0' follows '/'
+	nodes, err := queryNodesIn(ctx, db, `
+WHERE path >= ? AND path < ? AND path <> '/' AND json_extract(existence_map, ?) = 1
+AND (? < 0 OR depth_level <= ?)
+ORDER BY path`, prefix, prefix[:len(prefix)-1]+"0", worldKey(f.opt.World), maxDepth, maxDepth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q recursively: %w", spectraPath, err)
+	}
+	return nodes, nil
+}
+
+// ungenerated returns the folders below the directory at spectraPath,
+// and the directory itself, in the current world whose children
+// haven't been generated yet.
+//
+// Folders at the maximum depth never have children so aren't returned,
+// nor are those at maxDepth or deeper unless maxDepth is negative.
+func (f *Fs) ungenerated(ctx context.Context, spectraPath string, maxDepth int) (paths []string, err error) {
+	prefix := spectraPath + "/"
+	if spectraPath == "/" {
+		prefix = "/"
+	}
+	below := f.engine.GetConfig().Seed.MaxDepth
+	if maxDepth >= 0 && maxDepth < below {
+		below = maxDepth
+	}
+	rows, err := f.db.QueryContext(ctx, `
+SELECT path FROM nodes
+WHERE type = ? AND (path = ? OR (path >= ? AND path < ?))
+AND depth_level < ? AND json_extract(existence_map, ?) = 1
+AND NOT EXISTS (SELECT 1 FROM nodes c WHERE c.parent_id = nodes.id)`,
+		sdk.NodeTypeFolder, spectraPath, prefix, prefix[:len(prefix)-1]+"0",
+		below, worldKey(f.opt.World))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find ungenerated folders: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	for rows.Next() {
+		var p string
+		if err = rows.Scan(&p); err != nil {
+			return nil, fmt.Errorf("failed to read folder: %w", err)
+		}
+		paths = append(paths, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find ungenerated folders: %w", err)
+	}
+	return paths, nil
+}
+
+// queryNodes reads the nodes selected by the SQL clauses in where,
+// which follow the FROM clause
+func (f *Fs) queryNodes(ctx context.Context, where string, args ...any) (nodes []sdk.Node, err error) {
+	return queryNodesIn(ctx, f.readDB, where, args...)
+}
+
+// queryNodesIn is queryNodes reading from the nodes table in db
+func queryNodesIn(ctx context.Context, db *sql.DB, where string, args ...any) (nodes []sdk.Node, err error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT id, parent_id, name, path, parent_path, type, depth_level, size, last_updated, checksum, existence_map
+FROM nodes`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.CheckClose(rows, &err)
+	for rows.Next() {
+		var (
+			node         sdk.Node
+			checksum     sql.NullString
+			existenceMap string
+		)
+		err = rows.Scan(&node.ID, &node.ParentID, &node.Name, &node.Path, &node.ParentPath,
+			&node.Type, &node.DepthLevel, &node.Size, &node.LastUpdated, &checksum, &existenceMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read node: %w", err)
+		}
+		if checksum.Valid {
+			node.Checksum = &checksum.String
+		}
+		if err = json.Unmarshal([]byte(existenceMap), &node.ExistenceMap); err != nil {
+			return nil, fmt.Errorf("failed to decode existence map of %q: %w", node.Path, err)
+		}
+		nodes = append(nodes, node)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// deleteTrees deletes the nodes at spectraPaths and everything below
+// them from the world of the remote in a single transaction, returning
+// the number of nodes deleted.
+//
+// Deleting "/" deletes everything except the root itself. Nodes which
+// exist in other worlds too are only marked as not existing in this
+// one, so sibling worlds keep them, and the rest are removed from the
+// database along with any below the paths which exist in no world.
+func (f *Fs) deleteTrees(ctx context.Context, spectraPaths ...string) (deleted int64, err error) {
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start delete: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	key := worldKey(f.opt.World)
+	for start := 0; start < len(spectraPaths); start += deleteBatchSize {
+		batch := spectraPaths[start:min(start+deleteBatchSize, len(spectraPaths))]
+		where := "path <> '/' AND ("
+		args := make([]any, 0, 3*len(batch))
+		for i, spectraPath := range batch {
+			if i > 0 {
+				where += " OR "
+			}
+			// Descendants sort between "path/" and "path0" as
+			// '0' follows '/'
+			prefix := spectraPath + "/"
+			if spectraPath == "/" {
+				prefix = "/"
+			}
+			where += "path = ? OR (path >= ? AND path < ?)"
+			args = append(args, spectraPath, prefix, prefix[:len(prefix)-1]+"0")
+		}
+		where += ")"
+		result, err := tx.ExecContext(ctx, `
+UPDATE nodes SET existence_map = json_set(existence_map, ?, json('false'))
+WHERE json_extract(existence_map, ?) = 1 AND `+where, append([]any{key, key}, args...)...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to count deleted nodes: %w", err)
+		}
+		deleted += n
+		_, err = tx.ExecContext(ctx, `
+DELETE FROM nodes WHERE NOT EXISTS (SELECT 1 FROM json_each(existence_map) WHERE value = 1) AND `+where, args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit delete: %w", err)
+	}
+	return deleted, nil
+}
+
+// compactStats is the result of the compact command
+type compactStats struct {
+	OrphanedNodes   int64 `json:"orphanedNodes"`
+	OrphanedChunks  int64 `json:"orphanedChunks"`
+	OrphanedBlobs   int64 `json:"orphanedBlobs"`
+	OrphanedHashes  int64 `json:"orphanedHashes"`
+	ExpiredRestores int64 `json:"expiredRestores"`
+	BytesBefore     int64 `json:"bytesBefore"`
+	BytesAfter      int64 `json:"bytesAfter"`
+}
+
+// dbSize returns the size of the database in bytes
+func (f *Fs) dbSize(ctx context.Context) (size int64, err error) {
+	err = f.db.QueryRowContext(ctx, `
+SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`).Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database size: %w", err)
+	}
+	return size, nil
+}
+
+// tableExists returns whether the database has a table called name
+func (f *Fs) tableExists(ctx context.Context, name string) (bool, error) {
+	var n int
+	err := f.db.QueryRowContext(ctx, `
+SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up table %q: %w", name, err)
+	}
+	return n > 0, nil
+}
+
+// execCount runs query returning the number of rows affected
+func (f *Fs) execCount(ctx context.Context, query string, args ...any) (int64, error) {
+	result, err := f.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// compact removes what churn leaves behind in the database and then
+// vacuums it to return the space to the filesystem.
+//
+// This is nodes whose parent has been deleted, as the SDK's DeleteNode
+// doesn't delete children, chunks of upload sessions which have ended,
+// blobs no file or world snapshot uses any more and restores which have
+// expired.
+func (f *Fs) compact(ctx context.Context) (stats compactStats, err error) {
+	if stats.BytesBefore, err = f.dbSize(ctx); err != nil {
+		return stats, err
+	}
+	// Each pass removes one level of orphans
+	for {
+		n, err := f.execCount(ctx, `
+DELETE FROM nodes WHERE path <> '/' AND parent_id NOT IN (SELECT id FROM nodes)`)
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete orphaned nodes: %w", err)
+		}
+		if n == 0 {
+			break
+		}
+		stats.OrphanedNodes += n
+	}
+	if ok, err := f.tableExists(ctx, "spectra_upload_chunks"); err != nil {
+		return stats, err
+	} else if ok {
+		stats.OrphanedChunks, err = f.execCount(ctx, `
+DELETE FROM spectra_upload_chunks WHERE session_id NOT IN (SELECT id FROM spectra_upload_sessions)`)
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete orphaned chunks: %w", err)
+		}
+	}
+	if ok, err := f.tableExists(ctx, "spectra_blobs"); err != nil {
+		return stats, err
+	} else if ok {
+		_, err = f.db.ExecContext(ctx, `
+DELETE FROM spectra_file_blobs WHERE node_id NOT IN (SELECT id FROM nodes)`)
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete orphaned blob mappings: %w", err)
+		}
+		stats.OrphanedBlobs, err = f.execCount(ctx, `
+DELETE FROM spectra_blobs WHERE sha256 NOT IN (SELECT sha256 FROM spectra_file_blobs)
+AND sha256 NOT IN (SELECT sha256 FROM spectra_world_snapshot_nodes WHERE sha256 IS NOT NULL)`)
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete orphaned blobs: %w", err)
+		}
+	}
+	if ok, err := f.tableExists(ctx, "spectra_hashes"); err != nil {
+		return stats, err
+	} else if ok {
+		stats.OrphanedHashes, err = f.execCount(ctx, `
+DELETE FROM spectra_hashes WHERE node_id NOT IN (SELECT id FROM nodes)`)
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete orphaned hashes: %w", err)
+		}
+	}
+	if ok, err := f.tableExists(ctx, "spectra_restores"); err != nil {
+		return stats, err
+	} else if ok {
+		stats.ExpiredRestores, err = f.execCount(ctx, `
+DELETE FROM spectra_restores WHERE expires_at <= ?`, f.clock.Now().UnixMilli())
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete expired restores: %w", err)
+		}
+	}
+	if _, err = f.db.ExecContext(ctx, "VACUUM"); err != nil {
+		return stats, fmt.Errorf("failed to vacuum database: %w", err)
+	}
+	if stats.BytesAfter, err = f.dbSize(ctx); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,184 @@
+// Change reports between snapshots for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// deltaCount is a count of files changed in one way and their size
+type deltaCount struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// add counts a file of size bytes
+func (c *deltaCount) add(size int64) {
+	c.Files++
+	c.Bytes += size
+}
+
+// deltaReport is the result of the delta command: the files below the
+// root of the remote added, modified and deleted between two states of
+// its world
+type deltaReport struct {
+	From     string     `json:"from"`
+	To       string     `json:"to"`
+	Added    deltaCount `json:"added"`
+	Modified deltaCount `json:"modified"`
+	Deleted  deltaCount `json:"deleted"`
+	// Unchanged files aren't transferred by an incremental sync
+	Unchanged deltaCount `json:"unchanged"`
+	// TransferBytes is the size of the added and modified files,
+	// which an incremental sync copies
+	TransferBytes int64 `json:"transferBytes"`
+	// TransferSeconds is how long copying them takes at the
+	// bandwidth given, if one was
+	TransferSeconds float64 `json:"transferSeconds,omitempty"`
+}
+
+// csvTable returns the report as a CSV table with a row per kind of
+// change
+func (r *deltaReport) csvTable() [][]string {
+	rows := [][]string{{"change", "files", "bytes"}}
+	for _, c := range []struct {
+		name  string
+		count deltaCount
+	}{{"added", r.Added}, {"modified", r.Modified}, {"deleted", r.Deleted}, {"unchanged", r.Unchanged}} {
+		rows = append(rows, []string{c.name, strconv.FormatInt(c.count.Files, 10), strconv.FormatInt(c.count.Bytes, 10)})
+	}
+	return rows
+}
+
+// deltaOptions are the options of the delta command
+type deltaOptions struct {
+	from, to           string        // snapshots compared, "" for the database itself
+	fromEpoch, toEpoch int           // drift_epoch of each state
+	bandwidth          fs.SizeSuffix // bytes per second to estimate transfers at, 0 for none
+}
+
+// delta compares the files below the root of the remote in this world
+// in the snapshots written by the export command at opt.from and
+// opt.to, either being the database as it is now if blank.
+//
+// Files are matched by path and are modified if their size, checksum
+// or modification time differs, or if content drift changes them
+// between the epochs of the two states. The files are streamed from
+// the database, so worlds of any size can be compared.
+func (f *Fs) delta(ctx context.Context, opt deltaOptions) (report *deltaReport, err error) {
+	// ATTACH applies to one connection so hold on to it
+	conn, err := f.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("delta: %w", err)
+	}
+	defer fs.CheckClose(conn, &err)
+	attach := func(schema, src string) (string, func(), error) {
+		if src == "" {
+			return "main", func() {}, nil
+		}
+		if _, err := os.Stat(src); err != nil {
+			return "", nil, fmt.Errorf("failed to open snapshot: %w", err)
+		}
+		if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS `+schema, "file:"+src+"?mode=ro"); err != nil {
+			return "", nil, fmt.Errorf("failed to open snapshot %q: %w", src, err)
+		}
+		return schema, func() { _, _ = conn.ExecContext(context.Background(), `DETACH DATABASE `+schema) }, nil
+	}
+	from, detach, err := attach("delta_from", opt.from)
+	if err != nil {
+		return nil, err
+	}
+	defer detach()
+	to, detach, err := attach("delta_to", opt.to)
+	if err != nil {
+		return nil, err
+	}
+	defer detach()
+
+	report = &deltaReport{From: opt.from, To: opt.to}
+	if report.From == "" {
+		report.From = "database"
+	}
+	if report.To == "" {
+		report.To = "database"
+	}
+	prefix := f.toSpectraPath("") + "/"
+	if prefix == "//" {
+		prefix = "/"
+	}
+	files := func(schema string) string {
+		return `(SELECT path, size, checksum, last_updated FROM ` + schema + `.nodes
+WHERE type = 'file' AND path >= ? AND path < ? AND json_extract(existence_map, ?) = 1)`
+	}
+	args := []any{prefix, prefix[:len(prefix)-1] + "0", worldKey(f.opt.World)}
+	query := func(sql string, fn func(path string, size int64, state int)) (err error) {
+		rows, err := conn.QueryContext(ctx, sql, append(args, args...)...)
+		if err != nil {
+			return fmt.Errorf("delta: failed to compare: %w", err)
+		}
+		defer fs.CheckClose(rows, &err)
+		for rows.Next() {
+			var (
+				p     string
+				size  int64
+				state int
+			)
+			if err = rows.Scan(&p, &size, &state); err != nil {
+				return fmt.Errorf("delta: failed to compare: %w", err)
+			}
+			fn(p, f.fileSize(p, size), state)
+		}
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("delta: failed to compare: %w", err)
+		}
+		return nil
+	}
+
+	// The files in the later state, each added, modified or unchanged
+	const (
+		unchanged = iota
+		modified
+		added
+	)
+	drift := f.opt.DriftRate > 0 && opt.fromEpoch != opt.toEpoch
+	err = query(`
+SELECT b.path, b.size, CASE
+	WHEN a.path IS NULL THEN `+strconv.Itoa(added)+`
+	WHEN a.size <> b.size OR a.checksum IS NOT b.checksum OR a.last_updated <> b.last_updated THEN `+strconv.Itoa(modified)+`
+	ELSE `+strconv.Itoa(unchanged)+` END
+FROM `+files(to)+` b LEFT JOIN `+files(from)+` a ON a.path = b.path`,
+		func(p string, size int64, state int) {
+			switch {
+			case state == added:
+				report.Added.add(size)
+			case state == modified, drift && f.drifted(p):
+				report.Modified.add(size)
+			default:
+				report.Unchanged.add(size)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// The files in the earlier state which are gone
+	err = query(`
+SELECT a.path, a.size, 0
+FROM `+files(from)+` a LEFT JOIN `+files(to)+` b ON b.path = a.path WHERE b.path IS NULL`,
+		func(p string, size int64, state int) {
+			report.Deleted.add(size)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	report.TransferBytes = report.Added.Bytes + report.Modified.Bytes
+	if opt.bandwidth > 0 {
+		report.TransferSeconds = float64(report.TransferBytes) / float64(opt.bandwidth)
+	}
+	return report, nil
+}
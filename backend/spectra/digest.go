@@ -0,0 +1,194 @@
+// Pluggable content digests for the Spectra backend
+package spectra
+
+import (
+	"fmt"
+	gohash "hash"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/rclone/rclone/backend/dropbox/dbhash"
+	"github.com/rclone/rclone/backend/onedrive/quickxorhash"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// Digest computes a deterministic digest of file content which spectra
+// reports as an extra hash type.
+//
+// Register implementations with RegisterDigest before creating the
+// remote, for example from an init function, to validate non-standard
+// checksums with rclone hashsum or rclone check against spectra.
+type Digest interface {
+	// Type returns the hash type the digest is reported as. Use
+	// hash.RegisterHash to make a new one.
+	Type() hash.Type
+
+	// Sum returns the digest of the content read from in
+	Sum(in io.Reader) (string, error)
+}
+
+// registry of the extra digests
+var (
+	digestsMu sync.Mutex
+	digests   = map[hash.Type]Digest{}
+)
+
+// RegisterDigest registers d so spectra remotes created afterwards
+// report its hash type, replacing any digest of the same type.
+func RegisterDigest(d Digest) {
+	digestsMu.Lock()
+	defer digestsMu.Unlock()
+	digests[d.Type()] = d
+}
+
+// hashDigest is a Digest computing one of rclone's hash types
+type hashDigest hash.Type
+
+// NewHashDigest returns a Digest computing the rclone hash type ty
+func NewHashDigest(ty hash.Type) Digest {
+	return hashDigest(ty)
+}
+
+// Type returns the hash type the digest is reported as
+func (d hashDigest) Type() hash.Type {
+	return hash.Type(d)
+}
+
+// Sum returns the digest of the content read from in
+func (d hashDigest) Sum(in io.Reader) (string, error) {
+	hasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(hash.Type(d)))
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(hasher, in); err != nil {
+		return "", err
+	}
+	return hasher.Sums()[hash.Type(d)], nil
+}
+
+// providerHash describes a provider specific hash type which spectra
+// can compute, so it can stand in for that provider
+type providerHash struct {
+	alias   string
+	width   int
+	newFunc func() gohash.Hash
+}
+
+// providerHashes are the provider specific hash types by name
+var providerHashes = map[string]providerHash{
+	"quickxor": {alias: "QuickXorHash", width: 40, newFunc: quickxorhash.New},
+	"dropbox":  {alias: "DropboxHash", width: 64, newFunc: dbhash.New},
+}
+
+// providerHashMu serialises registering provider hash types
+var providerHashMu sync.Mutex
+
+// resolveHashType returns the hash type called name.
+//
+// Provider hash types are normally registered by their backend, so if
+// that isn't linked in they are registered here.
+func resolveHashType(name string) (ty hash.Type, err error) {
+	if err = ty.Set(name); err == nil {
+		return ty, nil
+	}
+	ph, ok := providerHashes[strings.ToLower(name)]
+	if !ok {
+		return ty, err
+	}
+	providerHashMu.Lock()
+	defer providerHashMu.Unlock()
+	if ty.Set(name) == nil {
+		return ty, nil
+	}
+	return hash.RegisterHash(strings.ToLower(name), ph.alias, ph.width, ph.newFunc), nil
+}
+
+// loadDigests returns the registered digests along with the digests
+// for the rclone hash types named in extra, which is a comma separated
+// list.
+func loadDigests(extra string) (map[hash.Type]Digest, error) {
+	digestsMu.Lock()
+	out := make(map[hash.Type]Digest, len(digests))
+	for ty, d := range digests {
+		out[ty] = d
+	}
+	digestsMu.Unlock()
+	for name := range strings.SplitSeq(extra, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		ty, err := resolveHashType(name)
+		if err != nil {
+			return nil, fmt.Errorf("extra_hashes: %w", err)
+		}
+		if _, ok := out[ty]; !ok {
+			out[ty] = NewHashDigest(ty)
+		}
+	}
+	// SHA256 comes from the Spectra database
+	delete(out, hash.SHA256)
+	return out, nil
+}
+
+// loadHashes adds the digests for the rclone hash types named in
+// hashes, which is a comma separated list, to digests and returns
+// whether SHA-256 from the Spectra database is among them.
+//
+// An empty list is taken as the default, SHA-256 alone. "none" names
+// no hash type, so hashes = none supports only the extra hash types.
+func loadHashes(hashes string, digests map[hash.Type]Digest) (sha256 bool, err error) {
+	if strings.TrimSpace(hashes) == "" {
+		return true, nil
+	}
+	for name := range strings.SplitSeq(hashes, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		ty, err := resolveHashType(name)
+		if err != nil {
+			return false, fmt.Errorf("hashes: %w", err)
+		}
+		switch ty {
+		case hash.None:
+		case hash.SHA256:
+			sha256 = true
+		default:
+			if _, ok := digests[ty]; !ok {
+				digests[ty] = NewHashDigest(ty)
+			}
+		}
+	}
+	return sha256, nil
+}
+
+// digestKey identifies a cached digest
+type digestKey struct {
+	ty   hash.Type
+	size int64
+}
+
+// contentDigest returns the digest d of size bytes of content made
+// from block.
+//
+// Every file of a given size has the same content so the result is
+// computed once per size and cached.
+func (f *Fs) contentDigest(d Digest, block []byte, size int64) (string, error) {
+	key := digestKey{ty: d.Type(), size: size}
+	f.digestCacheMu.Lock()
+	defer f.digestCacheMu.Unlock()
+	if sum, ok := f.digestCache[key]; ok {
+		return sum, nil
+	}
+	if len(block) == 0 && size > 0 {
+		return "", fmt.Errorf("can't compute %v of empty block", d.Type())
+	}
+	sum, err := d.Sum(newTiledReader(block, 0, size))
+	if err != nil {
+		return "", fmt.Errorf("failed to compute %v: %w", d.Type(), err)
+	}
+	f.digestCache[key] = sum
+	return sum, nil
+}
@@ -0,0 +1,57 @@
+// Directory modification times for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// Modification times directories can report
+const (
+	dirModTimeNode   = "node"   // the modification time of the node
+	dirModTimeEpoch  = "epoch"  // the Unix epoch
+	dirModTimeParent = "parent" // the modification time of the parent
+	dirModTimeZero   = "zero"   // none, so rclone uses --default-time
+)
+
+// checkDirModTime returns an error if mode isn't a dir_modtime
+func checkDirModTime(mode string) error {
+	switch mode {
+	case "", dirModTimeNode, dirModTimeEpoch, dirModTimeParent, dirModTimeZero:
+		return nil
+	}
+	return fmt.Errorf("unknown dir_modtime %q: must be %q, %q, %q or %q", mode,
+		dirModTimeNode, dirModTimeEpoch, dirModTimeParent, dirModTimeZero)
+}
+
+// dirModTimeSettable returns whether the modification times set on
+// directories are reported, which they only are with dir_modtime node
+func (f *Fs) dirModTimeSettable() bool {
+	return f.opt.DirModTime == "" || f.opt.DirModTime == dirModTimeNode
+}
+
+// dirModTime returns the modification time the directory with node
+// reports, as chosen by dir_modtime
+func (f *Fs) dirModTime(ctx context.Context, node *sdk.Node) time.Time {
+	switch f.opt.DirModTime {
+	case dirModTimeEpoch:
+		return time.Unix(0, 0).UTC()
+	case dirModTimeZero:
+		return time.Time{}
+	case dirModTimeParent:
+		if node.Path == "/" {
+			return node.LastUpdated
+		}
+		parent, err := f.getNode(ctx, parentPath(node.Path))
+		if err != nil || parent == nil {
+			fs.Debugf(f, "Using own modification time of %q as its parent wasn't found: %v", node.Path, err)
+			return node.LastUpdated
+		}
+		return parent.LastUpdated
+	}
+	return node.LastUpdated
+}
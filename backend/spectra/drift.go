@@ -0,0 +1,34 @@
+// Simulated content drift for the Spectra backend
+package spectra
+
+import (
+	"strconv"
+)
+
+// drifted returns whether the content of the file at spectraPath has
+// drifted in this world, as chosen by drift_rate from the world's seed
+// and the path.
+func (f *Fs) drifted(spectraPath string) bool {
+	if f.opt.DriftRate <= 0 {
+		return false
+	}
+	return pathFraction(f.worldSeed(), "drift", spectraPath) < f.opt.DriftRate
+}
+
+// driftBlock returns a copy of the generated block for the drifted file
+// at spectraPath with one byte changed.
+//
+// The byte changed and its new value are chosen from the world's seed,
+// drift_epoch and the path, so the content is the same on every run
+// until drift_epoch is changed. The size and modification time of the
+// file are left alone so only comparing checksums notices the change.
+func (f *Fs) driftBlock(spectraPath string, block []byte) []byte {
+	if len(block) == 0 {
+		return block
+	}
+	h := seedHash(f.worldSeed(), "drift", strconv.Itoa(f.opt.DriftEpoch)+"/"+spectraPath)
+	out := append([]byte(nil), block...)
+	// The low byte is never 0 so the byte always changes
+	out[(h>>8)%uint64(len(out))] ^= byte(h%255) + 1
+	return out
+}
@@ -0,0 +1,161 @@
+// Encryption at rest for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs/config/obscure"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Sizes used by the encryption
+const (
+	keySize   = 32
+	nonceSize = 24
+	saltSize  = 16
+)
+
+// keyCheck is sealed with the key when the database is first encrypted
+// so a wrong db_key is noticed when the remote is created
+var keyCheck = []byte("spectra")
+
+// initEncryption creates the table holding the salt for db_key and
+// derives the key used to encrypt data stored in the database.
+//
+// The first remote created with db_key on a database picks a random
+// salt and records a check value, which later remotes use to make sure
+// they were given the same key. The table holds a single row and is
+// read and written in one immediate transaction, so remotes opening a
+// new database at the same time agree on the salt.
+func (f *Fs) initEncryption(ctx context.Context) (err error) {
+	password, err := obscure.Reveal(f.opt.DBKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt db_key: %w", err)
+	}
+	_, err = f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_encryption (
+	id        INTEGER PRIMARY KEY CHECK (id = 1),
+	salt      BLOB NOT NULL,
+	key_check BLOB NOT NULL
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create encryption table: %w", err)
+	}
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read salt: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var salt, check []byte
+	err = tx.QueryRowContext(ctx, `SELECT salt, key_check FROM spectra_encryption WHERE id = 1`).Scan(&salt, &check)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		salt = make([]byte, saltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return fmt.Errorf("failed to make salt: %w", err)
+		}
+		if err = f.deriveKey(password, salt); err != nil {
+			return err
+		}
+		check, err = f.seal(keyCheck)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO spectra_encryption (id, salt, key_check) VALUES (1, ?, ?)`, salt, check)
+		if err != nil {
+			return fmt.Errorf("failed to store salt: %w", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("failed to store salt: %w", err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to read salt: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to read salt: %w", err)
+	}
+	if err = f.deriveKey(password, salt); err != nil {
+		return err
+	}
+	if _, err = f.unseal(check); err != nil {
+		return errors.New("db_key doesn't match the key the database was encrypted with")
+	}
+	return nil
+}
+
+// deriveKey sets the key used for encryption from password and salt
+func (f *Fs) deriveKey(password string, salt []byte) (err error) {
+	f.dbKey, err = deriveKeyFrom(password, salt)
+	return err
+}
+
+// deriveKeyFrom returns the key derived from password and salt
+func deriveKeyFrom(password string, salt []byte) (*[keySize]byte, error) {
+	key, err := scrypt.Key([]byte(password), salt, 16384, 8, 1, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	k := new([keySize]byte)
+	copy(k[:], key)
+	return k, nil
+}
+
+// encrypted returns whether data stored in the database is encrypted
+func (f *Fs) encrypted() bool {
+	return f.dbKey != nil
+}
+
+// seal encrypts data with a random nonce, which is put before it
+func (f *Fs) seal(data []byte) ([]byte, error) {
+	return sealWith(f.dbKey, data)
+}
+
+// unseal decrypts data encrypted by seal
+func (f *Fs) unseal(data []byte) ([]byte, error) {
+	if !f.encrypted() {
+		return nil, errors.New("data is encrypted: set db_key")
+	}
+	return unsealWith(f.dbKey, data)
+}
+
+// sealWith encrypts data with key and a random nonce, which is put
+// before it
+func sealWith(key *[keySize]byte, data []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, fmt.Errorf("failed to make nonce: %w", err)
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, key), nil
+}
+
+// unsealWith decrypts data encrypted by sealWith with key
+func unsealWith(key *[keySize]byte, data []byte) ([]byte, error) {
+	if len(data) < nonceSize+secretbox.Overhead {
+		return nil, errors.New("encrypted data is too short")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], data)
+	out, ok := secretbox.Open(nil, data[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("failed to decrypt data: wrong db_key or corrupted")
+	}
+	if out == nil {
+		out = []byte{}
+	}
+	return out, nil
+}
+
+// unsealedSize returns the size of data of size bytes once decrypted
+func unsealedSize(size int64) int64 {
+	return size - nonceSize - secretbox.Overhead
+}
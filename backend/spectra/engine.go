@@ -0,0 +1,213 @@
+// Generation engines for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// Engines the world can be generated and stored by
+const (
+	engineSDK    = "sdk"    // the Spectra SDK, storing the world in SQLite
+	engineMemory = "memory" // memEngine, holding the world in memory
+	engineRemote = "remote" // remoteEngine, calling a Spectra API server
+)
+
+// engine generates the world on demand and stores the nodes written to
+// it. This is the part of the Spectra SDK the backend uses, so other
+// engines can stand in for the SDK.
+//
+// Errors reporting missing and existing nodes wrap iofs.ErrNotExist
+// and iofs.ErrExist. The SDK's errors don't, so typedError gives them
+// their kind from their messages, and other engines use the SDK's
+// messages too so they read the same.
+type engine interface {
+	// ListChildren lists the children of a folder in a world,
+	// generating them if the folder has none
+	ListChildren(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error)
+	// GetNode returns the node with an ID or at a path in a world
+	GetNode(ctx context.Context, req *sdk.GetNodeRequest) (*sdk.Node, error)
+	// GetFileData returns the data block and checksum of a file
+	GetFileData(ctx context.Context, id string) ([]byte, string, error)
+	// CreateFolder creates a folder in a parent folder
+	CreateFolder(ctx context.Context, req *sdk.CreateFolderRequest) (*sdk.Node, error)
+	// UploadFile creates a file in a parent folder
+	UploadFile(ctx context.Context, req *sdk.UploadFileRequest) (*sdk.Node, error)
+	// DeleteNode deletes the node with an ID or at a path in a world
+	DeleteNode(ctx context.Context, req *sdk.DeleteNodeRequest) error
+	// Reset deletes every node and recreates the root, generating
+	// from the seed in the generation parameters from then on
+	Reset(ctx context.Context) error
+	// GetConfig returns the generation parameters
+	GetConfig() *sdk.Config
+	// Close releases the engine and the database holding the
+	// world. No calls may be made after it.
+	Close() error
+}
+
+// contentKeeper is implemented by engines which keep the content of
+// uploaded files themselves, so the backend doesn't store it
+type contentKeeper interface {
+	// Uploaded returns whether the file with id was uploaded
+	Uploaded(id string) bool
+}
+
+// errCantReplace is returned by ReplaceFile when the engine can't
+// replace files in place
+var errCantReplace = errors.New("engine can't replace files in place")
+
+// contentReplacer is implemented by engines which can replace the
+// content of a file in place, keeping its node
+type contentReplacer interface {
+	// ReplaceFile replaces the content of the file with id with
+	// data and returns its node
+	ReplaceFile(id string, data []byte) (*sdk.Node, error)
+}
+
+// errCantKeepAttributes is returned by the attribute calls when the
+// engine can't keep the modification times and metadata of nodes
+var errCantKeepAttributes = errors.New("engine can't keep modification times or metadata")
+
+// attributeKeeper is implemented by engines which keep the
+// modification times and metadata of nodes themselves, so the backend
+// doesn't store them
+type attributeKeeper interface {
+	// SetModTime sets the modification time of the node with id
+	// and returns its node
+	SetModTime(id string, modTime time.Time) (*sdk.Node, error)
+	// Attributes returns the metadata of the node with id
+	Attributes(id string) (map[string]string, error)
+	// SetAttributes replaces the metadata of the node with id
+	SetAttributes(id string, attrs map[string]string) error
+}
+
+// errCantRename is returned by RenamePrefix when the engine can't
+// rename folders
+var errCantRename = errors.New("engine can't rename folders")
+
+// errRenameShared is returned by RenamePrefix when nodes below the
+// folder exist in other worlds, which would see them renamed too
+var errRenameShared = errors.New("nodes below the folder exist in other worlds")
+
+// prefixRenamer is implemented by engines which can rename a folder
+// along with everything below it in one call
+type prefixRenamer interface {
+	// RenamePrefix renames the folder at srcPath in a world to
+	// dstPath, moving it into the folder above dstPath, along with
+	// every node below it, and returns the number of nodes renamed
+	RenamePrefix(world, srcPath, dstPath string) (int64, error)
+}
+
+// renamesPrefixes returns whether e can rename folders itself
+func renamesPrefixes(e engine) bool {
+	if locked, ok := e.(*lockedEngine); ok {
+		e = locked.engine
+	}
+	_, ok := e.(prefixRenamer)
+	return ok
+}
+
+// keepsAttributes returns whether e keeps the modification times and
+// metadata of nodes itself
+func keepsAttributes(e engine) bool {
+	if locked, ok := e.(*lockedEngine); ok {
+		e = locked.engine
+	}
+	_, ok := e.(attributeKeeper)
+	return ok
+}
+
+// sdkEngine is the engine of the SDK. Its calls are made on a local
+// database and can't be cancelled, so it ignores their contexts.
+type sdkEngine struct {
+	*sdk.SpectraFS
+}
+
+// ListChildren lists the children of a folder in a world, generating
+// them if the folder has none
+func (e sdkEngine) ListChildren(_ context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	return e.SpectraFS.ListChildren(req)
+}
+
+// GetNode returns the node with an ID or at a path in a world
+func (e sdkEngine) GetNode(_ context.Context, req *sdk.GetNodeRequest) (*sdk.Node, error) {
+	return e.SpectraFS.GetNode(req)
+}
+
+// GetFileData returns the data block and checksum of a file
+func (e sdkEngine) GetFileData(_ context.Context, id string) ([]byte, string, error) {
+	return e.SpectraFS.GetFileData(id)
+}
+
+// CreateFolder creates a folder in a parent folder
+func (e sdkEngine) CreateFolder(_ context.Context, req *sdk.CreateFolderRequest) (*sdk.Node, error) {
+	return e.SpectraFS.CreateFolder(req)
+}
+
+// UploadFile creates a file in a parent folder
+func (e sdkEngine) UploadFile(_ context.Context, req *sdk.UploadFileRequest) (*sdk.Node, error) {
+	return e.SpectraFS.UploadFile(req)
+}
+
+// DeleteNode deletes the node with an ID or at a path in a world
+func (e sdkEngine) DeleteNode(_ context.Context, req *sdk.DeleteNodeRequest) error {
+	return e.SpectraFS.DeleteNode(req)
+}
+
+// Reset deletes every node and recreates the root
+func (e sdkEngine) Reset(_ context.Context) error {
+	return e.SpectraFS.Reset()
+}
+
+// newEngine returns the engine selected by opt, safe to call
+// concurrently
+func newEngine(ctx context.Context, opt *Options) (engine, error) {
+	if err := checkFanout(opt); err != nil {
+		return nil, err
+	}
+	if err := checkNamespace(opt); err != nil {
+		return nil, err
+	}
+	switch opt.Engine {
+	case engineSDK, "":
+		spectraSDK, err := sdk.New(opt.ConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Spectra SDK: %w", err)
+		}
+		return newLockedEngine(sdkEngine{spectraSDK}), nil
+	case engineMemory:
+		e, err := newMemEngine(opt.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		e.fanout = opt.FanoutPattern
+		return newLockedEngine(e), nil
+	case engineRemote:
+		e, err := newRemoteEngine(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		if opt.Namespace != "" {
+			return newLockedEngine(newNamespaceEngine(e, opt.Namespace)), nil
+		}
+		return newLockedEngine(e), nil
+	default:
+		return nil, fmt.Errorf("unknown engine %q: must be %q, %q or %q", opt.Engine, engineSDK, engineMemory, engineRemote)
+	}
+}
+
+// Check the interfaces are satisfied
+var (
+	_ engine          = sdkEngine{}
+	_ engine          = (*memEngine)(nil)
+	_ engine          = (*remoteEngine)(nil)
+	_ engine          = (*namespaceEngine)(nil)
+	_ contentKeeper   = (*memEngine)(nil)
+	_ contentReplacer = (*memEngine)(nil)
+	_ attributeKeeper = (*memEngine)(nil)
+	_ prefixRenamer   = (*memEngine)(nil)
+)
@@ -0,0 +1,101 @@
+// Translation of engine errors for the Spectra backend
+package spectra
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// The messages the Spectra SDK reports missing and existing nodes with.
+//
+// The SDK doesn't return typed errors for these, so its errors are
+// recognised by their messages here and nowhere else. Errors are typed
+// as they come out of the engine, and everything else tests for
+// iofs.ErrNotExist and iofs.ErrExist.
+var (
+	sdkNotFoundMessages = []string{"not found", "does not exist"}
+	sdkExistsMessages   = []string{"already exists"}
+)
+
+// engineError is an error from an engine marked with the kind of
+// failure it reports, iofs.ErrNotExist or iofs.ErrExist, keeping its
+// message and the error it wraps, if any
+type engineError struct {
+	msg  string // message of the error
+	kind error  // iofs.ErrNotExist or iofs.ErrExist
+	err  error  // error wrapped, may be nil
+}
+
+// newEngineError returns an error of kind with the message made from
+// format and args, which may wrap an error with %w
+func newEngineError(kind error, format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	return &engineError{msg: err.Error(), kind: kind, err: errors.Unwrap(err)}
+}
+
+// Error returns the error message
+func (e *engineError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the kind of failure and the error wrapped
+func (e *engineError) Unwrap() []error {
+	if e.err == nil {
+		return []error{e.kind}
+	}
+	return []error{e.kind, e.err}
+}
+
+// containsAny returns whether msg contains any of substrs, ignoring
+// case
+func containsAny(msg string, substrs []string) bool {
+	msg = strings.ToLower(msg)
+	for _, substr := range substrs {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// typedError returns err from an engine marked with the kind of
+// failure it reports, so it can be told apart with errors.Is however
+// it is worded.
+//
+// Errors which are already typed, or report anything other than a
+// missing or existing node, are returned as they are.
+func typedError(err error) error {
+	switch {
+	case err == nil, errors.Is(err, iofs.ErrNotExist), errors.Is(err, iofs.ErrExist):
+		return err
+	case errors.Is(err, sql.ErrNoRows), containsAny(err.Error(), sdkNotFoundMessages):
+		return &engineError{msg: err.Error(), kind: iofs.ErrNotExist, err: err}
+	case containsAny(err.Error(), sdkExistsMessages):
+		return &engineError{msg: err.Error(), kind: iofs.ErrExist, err: err}
+	}
+	return err
+}
+
+// resultError returns the failure a ListChildren result reports as a
+// typed error, or nil if it succeeded
+func resultError(result *sdk.ListResult) error {
+	if result.Success {
+		return nil
+	}
+	return typedError(errors.New(result.Message))
+}
+
+// isNotFound returns whether err reports a missing node
+func isNotFound(err error) bool {
+	return errors.Is(typedError(err), iofs.ErrNotExist)
+}
+
+// isExist returns whether err reports a node already existing
+func isExist(err error) bool {
+	return errors.Is(typedError(err), iofs.ErrExist)
+}
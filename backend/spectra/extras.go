@@ -0,0 +1,204 @@
+// Extra files for the Spectra backend
+package spectra
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// pickExtra picks the extra_count files this world shows on top of its
+// own, and where each one is shown.
+//
+// Each extra file is a copy of one of the world's files, with its
+// content, shown under a new name in a directory picked from the
+// world's seed. The files copied are those whose paths hash lowest
+// with the seed, so the whole world is generated first to pick the
+// same files on every run.
+func (f *Fs) pickExtra(ctx context.Context) (err error) {
+	if err := f.generateBelow(ctx, "/", -1, nil); err != nil {
+		return err
+	}
+	rows, err := f.db.QueryContext(ctx, `
+SELECT path, type FROM nodes WHERE json_extract(existence_map, ?) = 1 ORDER BY path`,
+		worldKey(f.opt.World))
+	if err != nil {
+		return fmt.Errorf("failed to list files to copy: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	type candidate struct {
+		path string
+		hash uint64
+	}
+	var (
+		candidates []candidate
+		folders    []string
+	)
+	seed := f.worldSeed()
+	for rows.Next() {
+		var spectraPath, nodeType string
+		if err = rows.Scan(&spectraPath, &nodeType); err != nil {
+			return fmt.Errorf("failed to read file to copy: %w", err)
+		}
+		switch nodeType {
+		case sdk.NodeTypeFile:
+			if !f.hidden[spectraPath] {
+				candidates = append(candidates, candidate{spectraPath, seedHash(seed, "extra", spectraPath)})
+			}
+		case sdk.NodeTypeFolder:
+			folders = append(folders, spectraPath)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to list files to copy: %w", err)
+	}
+	if !slices.Contains(folders, "/") {
+		folders = append(folders, "/")
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.path, b.path))
+	})
+	if len(candidates) < f.opt.ExtraCount {
+		fs.Logf(f, "Only %d files to copy: showing %d extra files", len(candidates), len(candidates))
+	}
+	f.extraMu.Lock()
+	defer f.extraMu.Unlock()
+	f.extra = make(map[string]string, f.opt.ExtraCount)
+	f.extraIn = make(map[string][]string)
+	for _, c := range candidates[:min(f.opt.ExtraCount, len(candidates))] {
+		h := seedHash(seed, "extra_to", c.path)
+		dir := folders[h%uint64(len(folders))]
+		to := path.Join(dir, extraName(path.Base(c.path), h))
+		f.extra[to] = c.path
+		f.extraIn[dir] = append(f.extraIn[dir], to)
+	}
+	return nil
+}
+
+// extraName returns the name an extra copy of a file called name is
+// given, made unique with h so it can't clash with the files already
+// there
+func extraName(name string, h uint64) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s-extra-%08x%s", strings.TrimSuffix(name, ext), uint32(h>>32), ext)
+}
+
+// extraNode returns the path of the node of the extra file shown at
+// spectraPath and whether there is one
+func (f *Fs) extraNode(spectraPath string) (string, bool) {
+	if f.opt.ExtraCount <= 0 {
+		return "", false
+	}
+	f.extraMu.Lock()
+	defer f.extraMu.Unlock()
+	nodePath, ok := f.extra[spectraPath]
+	return nodePath, ok
+}
+
+// forgetExtra stops showing the extra file at spectraPath, for when it
+// has been removed or replaced, and returns whether there was one.
+//
+// The file it is a copy of is left alone.
+func (f *Fs) forgetExtra(spectraPath string) bool {
+	if f.opt.ExtraCount <= 0 {
+		return false
+	}
+	f.extraMu.Lock()
+	defer f.extraMu.Unlock()
+	if _, ok := f.extra[spectraPath]; !ok {
+		return false
+	}
+	delete(f.extra, spectraPath)
+	dir := parentPath(spectraPath)
+	f.extraIn[dir] = slices.DeleteFunc(f.extraIn[dir], func(to string) bool { return to == spectraPath })
+	return true
+}
+
+// forgetExtraWithin stops showing the extra files in the directory at
+// spectraDir, or below it, for when it has been purged
+func (f *Fs) forgetExtraWithin(spectraDir string) {
+	if f.opt.ExtraCount <= 0 {
+		return
+	}
+	f.extraMu.Lock()
+	defer f.extraMu.Unlock()
+	for to := range f.extra {
+		if within(to, spectraDir) {
+			delete(f.extra, to)
+			dir := parentPath(to)
+			f.extraIn[dir] = slices.DeleteFunc(f.extraIn[dir], func(into string) bool { return into == to })
+		}
+	}
+}
+
+// addExtra adds the extra files shown in the directory at spectraDir
+// to its entries.
+//
+// dir is the remote path of the directory.
+func (f *Fs) addExtra(ctx context.Context, dir, spectraDir string, entries fs.DirEntries) (fs.DirEntries, error) {
+	extra, err := f.extraEntries(ctx, dir, spectraDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, extra...), nil
+}
+
+// extraEntries returns the extra files shown in the directory dir at
+// spectraDir
+func (f *Fs) extraEntries(ctx context.Context, dir, spectraDir string) (entries fs.DirEntries, err error) {
+	if f.opt.ExtraCount <= 0 {
+		return nil, nil
+	}
+	f.extraMu.Lock()
+	in := slices.Clone(f.extraIn[spectraDir])
+	f.extraMu.Unlock()
+	for _, to := range in {
+		nodePath, ok := f.extraNode(to)
+		if !ok {
+			continue
+		}
+		node, err := f.getNode(ctx, nodePath)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			// The file it copies has been removed
+			continue
+		}
+		entries = append(entries, f.newObject(path.Join(dir, f.opt.Enc.ToStandardName(path.Base(to))), node))
+	}
+	return entries, nil
+}
+
+// extraDirs returns the directories at or below spectraDir which have
+// extra files shown in them
+func (f *Fs) extraDirs(spectraDir string) (dirs []string) {
+	f.extraMu.Lock()
+	defer f.extraMu.Unlock()
+	for dir, in := range f.extraIn {
+		if len(in) > 0 && within(dir, spectraDir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// listExtra returns the paths, relative to the root of the world, of
+// the extra files shown by extra_count in order
+func (f *Fs) listExtra() []string {
+	f.extraMu.Lock()
+	defer f.extraMu.Unlock()
+	extra := make([]string, 0, len(f.extra))
+	for to := range f.extra {
+		extra = append(extra, strings.TrimPrefix(to, "/"))
+	}
+	slices.Sort(extra)
+	return extra
+}
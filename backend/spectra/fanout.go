@@ -0,0 +1,107 @@
+// Directory fan-out patterns for the Spectra backend
+package spectra
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// Fan-out patterns set by fanout_pattern
+const (
+	fanoutUniform  = "uniform"  // counts picked evenly from the configured ranges
+	fanoutBalanced = "balanced" // the middle of the ranges everywhere
+	fanoutSkewed   = "skewed"   // most children in one directory in ten
+	fanoutHotspot  = "hotspot"  // balanced apart from one huge directory
+)
+
+const (
+	// skewHeavy is the fraction of directories which are heavy in
+	// the skewed pattern
+	skewHeavy = 0.1
+	// skewFactor is how many times the balanced counts heavy
+	// directories get, and light ones get the balanced counts divided
+	// by, so heavy directories hold about 90% of the children
+	skewFactor = 9
+	// hotspotFactor is how many times the balanced number of files
+	// the hotspot directory gets
+	hotspotFactor = 100
+)
+
+// checkFanout checks fanout_pattern is known and the engine can
+// generate it. Only the memory engine picks the counts itself.
+func checkFanout(opt *Options) error {
+	switch opt.FanoutPattern {
+	case "", fanoutUniform:
+		return nil
+	case fanoutBalanced, fanoutSkewed, fanoutHotspot:
+	default:
+		return fmt.Errorf("unknown fanout_pattern %q: must be %q, %q, %q or %q", opt.FanoutPattern, fanoutUniform, fanoutBalanced, fanoutSkewed, fanoutHotspot)
+	}
+	if opt.Engine != engineMemory {
+		return fmt.Errorf("fanout_pattern %q needs the %q engine", opt.FanoutPattern, engineMemory)
+	}
+	return nil
+}
+
+// folderCount returns the number of folders to generate in parent,
+// drawing from rng for the uniform pattern
+func (e *memEngine) folderCount(parent *sdk.Node, rng *rand.Rand) int {
+	s := e.cfg.Seed
+	return e.fanoutCount(parent, rng, s.MinFolders, s.MaxFolders, false)
+}
+
+// fileCount returns the number of files to generate in parent, drawing
+// from rng for the uniform pattern
+func (e *memEngine) fileCount(parent *sdk.Node, rng *rand.Rand) int {
+	s := e.cfg.Seed
+	return e.fanoutCount(parent, rng, s.MinFiles, s.MaxFiles, true)
+}
+
+// fanoutCount returns the number of children between lo and hi to
+// generate in parent as the fan-out pattern has it
+func (e *memEngine) fanoutCount(parent *sdk.Node, rng *rand.Rand, lo, hi int, files bool) int {
+	balanced := (lo + hi + 1) / 2
+	switch e.fanout {
+	case fanoutBalanced:
+		return balanced
+	case fanoutSkewed:
+		if e.heavy(parent.Path) {
+			return balanced * skewFactor
+		}
+		return balanced / skewFactor
+	case fanoutHotspot:
+		if files && parent.Path == e.hotspot() {
+			return max(balanced, 1) * hotspotFactor
+		}
+		return balanced
+	}
+	return lo + rng.IntN(hi-lo+1)
+}
+
+// heavy returns whether the directory at dirPath gets the most
+// children in the skewed pattern. The root always does so the tree
+// grows, and the others are picked from the seed and their paths.
+func (e *memEngine) heavy(dirPath string) bool {
+	return dirPath == "/" || pathFraction(e.cfg.Seed.Seed, "fanout/heavy", dirPath) < skewHeavy
+}
+
+// hotspot returns the path of the hotspot directory in the hotspot
+// pattern. Its depth, and the folder taken at each level on the way
+// down to it, are picked from the seed.
+func (e *memEngine) hotspot() string {
+	s := e.cfg.Seed
+	folders := uint64((s.MinFolders + s.MaxFolders + 1) / 2)
+	depth := int(seedHash(s.Seed, "fanout/hotspot", "") % uint64(s.MaxDepth))
+	var b strings.Builder
+	for level := 0; level < depth && folders > 0; level++ {
+		i := seedHash(s.Seed, "fanout/hotspot", b.String()+"/")%folders + 1
+		fmt.Fprintf(&b, "/folder_%d", i)
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
@@ -0,0 +1,399 @@
+// Simulated faults for the Spectra backend
+package spectra
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// Operations fault_error_rate and fault_triggers can fail
+const (
+	faultList   = "list"
+	faultStat   = "stat"
+	faultRead   = "read"
+	faultWrite  = "write"
+	faultDelete = "delete"
+)
+
+// Errors fault_error_rate and fault_triggers fail operations with
+const (
+	faultTimeout  = "timeout"   // the request timing out, retried
+	fault5xx      = "5xx"       // a server error, retried
+	faultNotFound = "not_found" // the object or directory missing, not retried
+)
+
+// Ways bad_range_rate serves ranged reads wrongly
+const (
+	badRangeIgnore = "ignore" // the whole file, ignoring the range
+	badRangeShort  = "short"  // the first half of the range only
+	badRangeLong   = "long"   // past the end of the range to the end of the file
+)
+
+// checkFaults checks the operations and errors set for
+// fault_error_rate, and the ways set for bad_range_rate, are known
+func checkFaults(opt *Options) error {
+	if opt.FaultErrorRate < 0 || opt.FaultErrorRate > 1 {
+		return fmt.Errorf("fault_error_rate must be between 0 and 1, got %g", opt.FaultErrorRate)
+	}
+	for _, op := range opt.FaultOps {
+		if !slices.Contains([]string{faultList, faultStat, faultRead, faultWrite, faultDelete}, op) {
+			return fmt.Errorf("unknown fault_ops operation %q: must be %q, %q, %q, %q or %q", op, faultList, faultStat, faultRead, faultWrite, faultDelete)
+		}
+	}
+	for _, kind := range opt.FaultErrorTypes {
+		if !slices.Contains([]string{faultTimeout, fault5xx, faultNotFound}, kind) {
+			return fmt.Errorf("unknown fault_error_types error %q: must be %q, %q or %q", kind, faultTimeout, fault5xx, faultNotFound)
+		}
+	}
+	if opt.FaultErrorRate > 0 && len(opt.FaultErrorTypes) == 0 {
+		return errors.New("fault_error_rate needs at least one fault_error_types error")
+	}
+	if opt.BadRangeRate < 0 || opt.BadRangeRate > 1 {
+		return fmt.Errorf("bad_range_rate must be between 0 and 1, got %g", opt.BadRangeRate)
+	}
+	for _, kind := range opt.BadRangeTypes {
+		if !slices.Contains([]string{badRangeIgnore, badRangeShort, badRangeLong}, kind) {
+			return fmt.Errorf("unknown bad_range_types way %q: must be %q, %q or %q", kind, badRangeIgnore, badRangeShort, badRangeLong)
+		}
+	}
+	if opt.BadRangeRate > 0 && len(opt.BadRangeTypes) == 0 {
+		return errors.New("bad_range_rate needs at least one bad_range_types way")
+	}
+	return nil
+}
+
+// faultTrigger is a fault set by fault_triggers, failing one attempt
+// at an operation, or every attempt on the paths matching a glob
+type faultTrigger struct {
+	spec  string         // the trigger as set
+	op    string         // operation failed
+	glob  *regexp.Regexp // paths it applies to, nil for all
+	nth   int            // attempt to fail counting from 1, 0 for all
+	kind  string         // error to fail it with
+	count int            // attempts matched so far, protected by faultMu
+}
+
+// parseFaultTriggers parses the triggers set by fault_triggers.
+//
+// Each is an operation, optionally followed by @ and a glob the path
+// must match, by # and the number of the attempt to fail, counting the
+// attempts at the operation on the paths matching, and by = and the
+// error to fail it with, which is the first of fault_error_types if
+// not given. For example write#1000 fails the thousandth write, and
+// read@**.iso=not_found every read of an ISO image.
+func parseFaultTriggers(opt *Options) (triggers []*faultTrigger, err error) {
+	for _, spec := range opt.FaultTriggers {
+		t := &faultTrigger{spec: spec}
+		rest := spec
+		if i := strings.LastIndex(rest, "="); i >= 0 {
+			rest, t.kind = rest[:i], rest[i+1:]
+		} else if len(opt.FaultErrorTypes) > 0 {
+			t.kind = opt.FaultErrorTypes[0]
+		}
+		if !slices.Contains([]string{faultTimeout, fault5xx, faultNotFound}, t.kind) {
+			return nil, fmt.Errorf("fault_triggers %q: unknown error %q: must be %q, %q or %q", spec, t.kind, faultTimeout, fault5xx, faultNotFound)
+		}
+		if i := strings.LastIndex(rest, "#"); i >= 0 {
+			var nth string
+			rest, nth = rest[:i], rest[i+1:]
+			if t.nth, err = strconv.Atoi(nth); err != nil || t.nth < 1 {
+				return nil, fmt.Errorf("fault_triggers %q: attempt must be a number from 1, got %q", spec, nth)
+			}
+		}
+		if i := strings.Index(rest, "@"); i >= 0 {
+			var glob string
+			rest, glob = rest[:i], rest[i+1:]
+			if t.glob, err = filter.GlobPathToRegexp(glob, false); err != nil {
+				return nil, fmt.Errorf("fault_triggers %q: %w", spec, err)
+			}
+		}
+		t.op = rest
+		if !slices.Contains([]string{faultList, faultStat, faultRead, faultWrite, faultDelete}, t.op) {
+			return nil, fmt.Errorf("fault_triggers %q: unknown operation %q: must be %q, %q, %q, %q or %q", spec, t.op, faultList, faultStat, faultRead, faultWrite, faultDelete)
+		}
+		triggers = append(triggers, t)
+	}
+	return triggers, nil
+}
+
+// triggered returns the error of the first fault_triggers trigger
+// failing this attempt at the operation op on remote, if any.
+//
+// Every trigger matching the attempt counts it, whether or not an
+// earlier one fails it, so the numbers of the attempts don't depend on
+// the other triggers.
+func (f *Fs) triggered(op, remote string) (kind string, ok bool) {
+	if len(f.triggers) == 0 {
+		return "", false
+	}
+	f.faultMu.Lock()
+	defer f.faultMu.Unlock()
+	for _, t := range f.triggers {
+		if t.op != op || (t.glob != nil && !t.glob.MatchString(remote)) {
+			continue
+		}
+		t.count++
+		if !ok && (t.nth == 0 || t.count == t.nth) {
+			fs.Debugf(f, "Fault trigger %q fires on attempt %d", t.spec, t.count)
+			kind, ok = t.kind, true
+		}
+	}
+	return kind, ok
+}
+
+// faultError is an error injected by fault_error_rate or fault_triggers
+//
+// Timeouts and server errors are retriable, as they would be from a
+// provider.
+type faultError struct {
+	kind   string // faultTimeout or fault5xx
+	op     string // operation which failed
+	remote string // what it failed on
+}
+
+// Error returns the error message
+func (e *faultError) Error() string {
+	if e.kind == faultTimeout {
+		return fmt.Sprintf("spectra: injected fault: %s of %q timed out", e.op, e.remote)
+	}
+	return fmt.Sprintf("spectra: injected fault: %s of %q failed: 503 Service Unavailable", e.op, e.remote)
+}
+
+// Retry returns true as the operation may be retried
+func (e *faultError) Retry() bool {
+	return true
+}
+
+// Temporary returns true so low level retries retry the operation
+func (e *faultError) Temporary() bool {
+	return true
+}
+
+// Timeout returns whether the fault is a timeout
+func (e *faultError) Timeout() bool {
+	return e.kind == faultTimeout
+}
+
+// fault returns the error fault_triggers or fault_error_rate fails
+// this attempt at the operation op on remote with, or nil if it goes
+// ahead.
+//
+// Triggers are checked first. Otherwise whether an attempt fails, and
+// with which error, depends only on sim_seed, the operation, the path
+// and how many times the operation has been tried on the path before.
+func (f *Fs) fault(op, remote string) error {
+	if kind, ok := f.triggered(op, remote); ok {
+		return f.injectFault(kind, op, remote)
+	}
+	rate := f.tuning().faultErrorRate
+	if rate <= 0 || !slices.Contains(f.opt.FaultOps, op) {
+		return nil
+	}
+	spectraPath := f.toSpectraPath(remote)
+	key := op + "\x00" + spectraPath
+	f.faultMu.Lock()
+	try := f.tries[key]
+	f.tries[key] = try + 1
+	f.faultMu.Unlock()
+	salt := "fault/" + op + "/" + strconv.Itoa(try)
+	seed := f.simSeed()
+	if pathFraction(seed, salt, spectraPath) >= rate {
+		return nil
+	}
+	kind := f.opt.FaultErrorTypes[seedHash(seed, salt+"/type", spectraPath)%uint64(len(f.opt.FaultErrorTypes))]
+	return f.injectFault(kind, op, remote)
+}
+
+// injectFault returns the error of kind failing the operation op on
+// remote
+func (f *Fs) injectFault(kind, op, remote string) error {
+	fs.Debugf(f, "Injecting %s fault into %s of %q", kind, op, remote)
+	if kind != faultNotFound {
+		return &faultError{kind: kind, op: op, remote: remote}
+	}
+	if op == faultList {
+		return fs.ErrorDirNotFound
+	}
+	return fs.ErrorObjectNotFound
+}
+
+// badRange returns the part of the file at spectraPath, size bytes
+// long, served for this attempt at reading from offset up to end, as
+// chosen by bad_range_rate.
+//
+// Only reads of part of the file can go wrong. Whether an attempt
+// does, and how, depends only on sim_seed, the path and how
+// many times it has been read with a range before.
+func (f *Fs) badRange(spectraPath string, size, offset, end int64) (int64, int64) {
+	if f.opt.BadRangeRate <= 0 || (offset == 0 && end == size) {
+		return offset, end
+	}
+	key := "range\x00" + spectraPath
+	f.faultMu.Lock()
+	try := f.tries[key]
+	f.tries[key] = try + 1
+	f.faultMu.Unlock()
+	salt := "range/" + strconv.Itoa(try)
+	seed := f.simSeed()
+	if pathFraction(seed, salt, spectraPath) >= f.opt.BadRangeRate {
+		return offset, end
+	}
+	kind := f.opt.BadRangeTypes[seedHash(seed, salt+"/type", spectraPath)%uint64(len(f.opt.BadRangeTypes))]
+	fs.Debugf(f, "Serving %s range for bytes %d-%d of %q", kind, offset, end, spectraPath)
+	switch kind {
+	case badRangeIgnore:
+		return 0, size
+	case badRangeShort:
+		return offset, offset + (end-offset)/2
+	default:
+		return offset, size
+	}
+}
+
+// dropFlaky drops the entries chosen by flaky_list_rate from the
+// listing of the directory at spectraPath.
+//
+// Entries are only dropped the first time a directory is listed so
+// they reappear when the listing is retried. Which entries are dropped
+// depends only on sim_seed and their paths.
+func (f *Fs) dropFlaky(spectraPath string, entries fs.DirEntries) fs.DirEntries {
+	if !f.dropsFlaky(spectraPath) {
+		return entries
+	}
+	return slices.DeleteFunc(entries, f.flaky)
+}
+
+// dropsFlaky returns whether this listing of the directory at
+// spectraPath drops its flaky entries, which only the first does
+func (f *Fs) dropsFlaky(spectraPath string) bool {
+	if f.opt.FlakyListRate <= 0 {
+		return false
+	}
+	f.listedMu.Lock()
+	defer f.listedMu.Unlock()
+	retry := f.listed[spectraPath]
+	f.listed[spectraPath] = true
+	return !retry
+}
+
+// flaky returns whether entry is chosen by flaky_list_rate to be
+// dropped from the first listing of its directory
+func (f *Fs) flaky(entry fs.DirEntry) bool {
+	if pathFraction(f.simSeed(), "flaky", f.toSpectraPath(entry.Remote())) < f.opt.FlakyListRate {
+		fs.Debugf(f, "Dropping %q from listing", entry.Remote())
+		return true
+	}
+	return false
+}
+
+// duplicateListed repeats the entries chosen by duplicate_list_rate in
+// entries, each straight after itself, as a paginated listing API
+// repeats the entry at the end of one page at the start of the next
+// when the listing shifts between requests.
+//
+// Which entries are repeated depends only on sim_seed and their paths.
+func (f *Fs) duplicateListed(entries fs.DirEntries) fs.DirEntries {
+	if f.opt.DuplicateListRate <= 0 {
+		return entries
+	}
+	out := make(fs.DirEntries, 0, len(entries))
+	for _, entry := range entries {
+		out = append(out, entry)
+		if f.duplicated(entry) {
+			out = append(out, entry)
+		}
+	}
+	return out
+}
+
+// duplicated returns whether entry is chosen by duplicate_list_rate to
+// be listed twice
+func (f *Fs) duplicated(entry fs.DirEntry) bool {
+	if f.opt.DuplicateListRate <= 0 {
+		return false
+	}
+	if pathFraction(f.simSeed(), "duplicate", f.toSpectraPath(entry.Remote())) < f.opt.DuplicateListRate {
+		fs.Debugf(f, "Listing %q twice", entry.Remote())
+		return true
+	}
+	return false
+}
+
+// hashAbsent returns whether the object at spectraPath should report
+// no hashes, as chosen by no_hash_rate from the world's seed and the
+// path.
+func (f *Fs) hashAbsent(spectraPath string) bool {
+	if f.opt.NoHashRate <= 0 {
+		return false
+	}
+	return pathFraction(f.worldSeed(), "nohash", spectraPath) < f.opt.NoHashRate
+}
+
+// pickHidden picks the hide_count files hidden from this world.
+//
+// These are the files whose paths hash lowest with the world's seed,
+// so the whole world is generated first to pick the same files on
+// every run.
+func (f *Fs) pickHidden(ctx context.Context) (err error) {
+	if err := f.generateBelow(ctx, "/", -1, nil); err != nil {
+		return err
+	}
+	rows, err := f.db.QueryContext(ctx, `
+SELECT path FROM nodes WHERE type = ? AND json_extract(existence_map, ?) = 1`,
+		sdk.NodeTypeFile, worldKey(f.opt.World))
+	if err != nil {
+		return fmt.Errorf("failed to list files to hide: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	type candidate struct {
+		path string
+		hash uint64
+	}
+	var candidates []candidate
+	seed := f.worldSeed()
+	for rows.Next() {
+		var spectraPath string
+		if err = rows.Scan(&spectraPath); err != nil {
+			return fmt.Errorf("failed to read file to hide: %w", err)
+		}
+		candidates = append(candidates, candidate{spectraPath, seedHash(seed, "hide", spectraPath)})
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to list files to hide: %w", err)
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.path, b.path))
+	})
+	if len(candidates) < f.opt.HideCount {
+		fs.Logf(f, "Only %d files to hide: hiding all of them", len(candidates))
+	}
+	f.hidden = make(map[string]bool, f.opt.HideCount)
+	for _, c := range candidates[:min(f.opt.HideCount, len(candidates))] {
+		f.hidden[c.path] = true
+	}
+	return nil
+}
+
+// dropHidden drops the files picked by hide_count from entries
+func (f *Fs) dropHidden(entries fs.DirEntries) fs.DirEntries {
+	if len(f.hidden) == 0 {
+		return entries
+	}
+	return slices.DeleteFunc(entries, f.isHidden)
+}
+
+// isHidden returns whether entry is a file picked by hide_count
+func (f *Fs) isHidden(entry fs.DirEntry) bool {
+	_, isObject := entry.(fs.Object)
+	return isObject && f.hidden[f.toSpectraPath(entry.Remote())]
+}
@@ -0,0 +1,44 @@
+// Filter aware generation for the Spectra backend
+package spectra
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/fs/filter"
+)
+
+// includeDir reports whether the directory at spectraPath should be
+// generated
+type includeDir func(spectraPath string) (bool, error)
+
+// generationFilter returns the check of which directories to generate
+// from the filters in ctx if filter_generation is set, or nil if every
+// directory should be generated.
+//
+// Directories outside the root of the remote and the root itself are
+// always generated, as the filters only apply inside it.
+func (f *Fs) generationFilter(ctx context.Context) includeDir {
+	fi := filter.GetConfig(ctx)
+	if !f.opt.FilterGeneration || fi.InActive() {
+		return nil
+	}
+	include := fi.IncludeDirectory(ctx, f)
+	return func(spectraPath string) (bool, error) {
+		root := f.toSpectraPath("")
+		if spectraPath == root || !within(spectraPath, root) {
+			return true, nil
+		}
+		return include(f.fromSpectraPath(spectraPath))
+	}
+}
+
+// listFilter returns the generation filter for a listing, which is
+// only used if the caller has said it is filtering the listing.
+//
+// Callers which list excluded files too get every directory generated.
+func (f *Fs) listFilter(ctx context.Context) includeDir {
+	if !filter.GetUseFilter(ctx) {
+		return nil
+	}
+	return f.generationFilter(ctx)
+}
@@ -0,0 +1,313 @@
+// Consistency checking for the Spectra backend
+package spectra
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// fsckMaxPasses limits the passes made repairing the tree, each of
+// which fixes at least one more level of it
+const fsckMaxPasses = 64
+
+// Problems found by fsck
+const (
+	problemMissingParent = "missing parent"
+	problemLocation      = "path, parent path or depth doesn't match parent"
+	problemFileContent   = "size or checksum doesn't match content"
+	problemFolderContent = "folder has a size or checksum"
+)
+
+// fsckIssue is a problem found with a node
+type fsckIssue struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// fsckResult is the result of the fsck command
+type fsckResult struct {
+	Nodes  int64       `json:"nodes"`
+	Issues []fsckIssue `json:"issues"`
+}
+
+// fsck checks every node in the database, in all worlds, for nodes
+// whose parent is missing, whose location doesn't match their parent's
+// or whose size and checksum don't match the content served for them.
+//
+// If repair is set nodes with a missing parent are deleted along with
+// everything below them, and the other nodes are corrected.
+func (f *Fs) fsck(ctx context.Context, repair bool) (result fsckResult, err error) {
+	if err = f.db.QueryRowContext(ctx, `SELECT count(*) FROM nodes`).Scan(&result.Nodes); err != nil {
+		return result, fmt.Errorf("failed to count nodes: %w", err)
+	}
+
+	// Nodes whose parent is missing. Deleting them orphans their
+	// children so keep going until none are left.
+	for range fsckMaxPasses {
+		orphans, err := f.fsckQuery(ctx, problemMissingParent, `
+SELECT n.id, n.path FROM nodes n
+WHERE n.path <> '/' AND NOT EXISTS (SELECT 1 FROM nodes p WHERE p.id = n.parent_id)`)
+		if err != nil {
+			return result, err
+		}
+		for i := range orphans {
+			orphans[i].Repaired = repair
+		}
+		result.Issues = append(result.Issues, orphans...)
+		if !repair || len(orphans) == 0 {
+			break
+		}
+		_, err = f.db.ExecContext(ctx, `
+DELETE FROM nodes WHERE path <> '/' AND NOT EXISTS (SELECT 1 FROM nodes p WHERE p.id = nodes.parent_id)`)
+		if err != nil {
+			return result, fmt.Errorf("failed to delete orphaned nodes: %w", err)
+		}
+	}
+
+	// Nodes not where their parent says they should be. Repairing a
+	// node moves its children so keep going until none are left.
+	seen := make(map[string]bool)
+	for range fsckMaxPasses {
+		misplaced, err := f.fsckQuery(ctx, problemLocation, `
+SELECT n.id, n.path FROM nodes n JOIN nodes p ON p.id = n.parent_id
+WHERE n.path <> '/' AND (
+	n.parent_path <> p.path OR
+	n.depth_level <> p.depth_level + 1 OR
+	n.path <> CASE WHEN p.path = '/' THEN '/' || n.name ELSE p.path || '/' || n.name END
+)`)
+		if err != nil {
+			return result, err
+		}
+		for _, issue := range misplaced {
+			if !seen[issue.ID] {
+				seen[issue.ID] = true
+				issue.Repaired = repair
+				result.Issues = append(result.Issues, issue)
+			}
+		}
+		if !repair || len(misplaced) == 0 {
+			break
+		}
+		_, err = f.db.ExecContext(ctx, `
+UPDATE nodes SET
+	parent_path = p.path,
+	depth_level = p.depth_level + 1,
+	path = CASE WHEN p.path = '/' THEN '/' || nodes.name ELSE p.path || '/' || nodes.name END
+FROM nodes p
+WHERE p.id = nodes.parent_id AND nodes.path <> '/'`)
+		if err != nil {
+			return result, fmt.Errorf("failed to repair locations: %w", err)
+		}
+	}
+
+	// Files whose metadata doesn't match the content served
+	size, checksum, err := f.fileContent(ctx)
+	if err != nil {
+		return result, err
+	}
+	if size >= 0 {
+		// Uploaded files are checked against their blobs below
+		badFiles, err := f.fsckQuery(ctx, problemFileContent, `
+SELECT id, path FROM nodes
+WHERE type = ? AND (size <> ? OR checksum IS NULL OR checksum <> ?)
+AND id NOT IN (SELECT node_id FROM spectra_file_blobs)`,
+			sdk.NodeTypeFile, size, checksum)
+		if err != nil {
+			return result, err
+		}
+		if repair && len(badFiles) > 0 {
+			_, err = f.db.ExecContext(ctx, `
+UPDATE nodes SET size = ?, checksum = ?
+WHERE type = ? AND (size <> ? OR checksum IS NULL OR checksum <> ?)
+AND id NOT IN (SELECT node_id FROM spectra_file_blobs)`,
+				size, checksum, sdk.NodeTypeFile, size, checksum)
+			if err != nil {
+				return result, fmt.Errorf("failed to repair files: %w", err)
+			}
+			for i := range badFiles {
+				badFiles[i].Repaired = true
+			}
+		}
+		result.Issues = append(result.Issues, badFiles...)
+	}
+
+	// Uploaded files whose metadata doesn't match their blob
+	badUploads, err := f.fsckQuery(ctx, problemFileContent, `
+SELECT n.id, n.path FROM nodes n
+JOIN spectra_file_blobs fb ON fb.node_id = n.id JOIN spectra_blobs b ON b.sha256 = fb.sha256
+WHERE n.size <> b.size OR n.checksum IS NULL OR n.checksum <> b.sha256`)
+	if err != nil {
+		return result, err
+	}
+	if repair && len(badUploads) > 0 {
+		_, err = f.db.ExecContext(ctx, `
+UPDATE nodes SET size = b.size, checksum = b.sha256
+FROM spectra_file_blobs fb JOIN spectra_blobs b ON b.sha256 = fb.sha256
+WHERE fb.node_id = nodes.id AND (nodes.size <> b.size OR nodes.checksum IS NULL OR nodes.checksum <> b.sha256)`)
+		if err != nil {
+			return result, fmt.Errorf("failed to repair uploaded files: %w", err)
+		}
+		for i := range badUploads {
+			badUploads[i].Repaired = true
+		}
+	}
+	result.Issues = append(result.Issues, badUploads...)
+
+	// Folders with content
+	badFolders, err := f.fsckQuery(ctx, problemFolderContent, `
+SELECT id, path FROM nodes WHERE type = ? AND (size <> 0 OR checksum IS NOT NULL)`,
+		sdk.NodeTypeFolder)
+	if err != nil {
+		return result, err
+	}
+	if repair && len(badFolders) > 0 {
+		_, err = f.db.ExecContext(ctx, `
+UPDATE nodes SET size = 0, checksum = NULL WHERE type = ? AND (size <> 0 OR checksum IS NOT NULL)`,
+			sdk.NodeTypeFolder)
+		if err != nil {
+			return result, fmt.Errorf("failed to repair folders: %w", err)
+		}
+		for i := range badFolders {
+			badFolders[i].Repaired = true
+		}
+	}
+	result.Issues = append(result.Issues, badFolders...)
+
+	if len(result.Issues) > 0 {
+		fs.Logf(f, "fsck found %d issues in %d nodes", len(result.Issues), result.Nodes)
+	}
+	return result, nil
+}
+
+// fsckQuery runs query, which selects the id and path of nodes, and
+// returns them as issues with problem
+func (f *Fs) fsckQuery(ctx context.Context, problem, query string, args ...any) (issues []fsckIssue, err error) {
+	rows, err := f.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for %s: %w", problem, err)
+	}
+	defer fs.CheckClose(rows, &err)
+	for rows.Next() {
+		issue := fsckIssue{Problem: problem}
+		if err = rows.Scan(&issue.ID, &issue.Path); err != nil {
+			return nil, fmt.Errorf("failed to read node: %w", err)
+		}
+		issues = append(issues, issue)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check for %s: %w", problem, err)
+	}
+	return issues, nil
+}
+
+// fileContent returns the size and SHA256 of the content every file
+// is served with, or a size of -1 if there are no files.
+func (f *Fs) fileContent(ctx context.Context) (size int64, checksum string, err error) {
+	var id string
+	err = f.db.QueryRowContext(ctx, `SELECT id FROM nodes WHERE type = ? LIMIT 1`, sdk.NodeTypeFile).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1, "", nil
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to find a file: %w", err)
+	}
+	block, err := f.sdkGetFileData(ctx, id)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read file data: %w", err)
+	}
+	sum := sha256.Sum256(block)
+	return int64(len(block)), hex.EncodeToString(sum[:]), nil
+}
+
+// Kinds of corruption made by the corrupt command
+var corruptionKinds = []string{"parent", "size", "checksum"}
+
+// corruption is a node corrupted by the corrupt command
+type corruption struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// corrupt deterministically corrupts count nodes in the database with
+// the given kinds of corruption, for testing fsck and how rclone copes
+// with an inconsistent backend.
+//
+// The nodes are those whose paths hash lowest with the world's seed
+// and variant, and each is given one of kinds in turn. Only files are
+// given bad sizes and checksums.
+func (f *Fs) corrupt(ctx context.Context, count int, kinds []string, variant string) (out []corruption, err error) {
+	for _, kind := range kinds {
+		if !slices.Contains(corruptionKinds, kind) {
+			return nil, fmt.Errorf("unknown kind of corruption %q: use %s", kind, strings.Join(corruptionKinds, ", "))
+		}
+	}
+	type candidate struct {
+		id, path, nodeType string
+		hash               uint64
+	}
+	var candidates []candidate
+	rows, err := f.db.QueryContext(ctx, `SELECT id, path, type FROM nodes WHERE path <> '/'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes to corrupt: %w", err)
+	}
+	seed := f.worldSeed()
+	for rows.Next() {
+		var c candidate
+		if err = rows.Scan(&c.id, &c.path, &c.nodeType); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to read node to corrupt: %w", err)
+		}
+		c.hash = seedHash(seed, "corrupt", variant+"/"+c.path)
+		candidates = append(candidates, c)
+	}
+	if err = rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, fmt.Errorf("failed to list nodes to corrupt: %w", err)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, fmt.Errorf("failed to list nodes to corrupt: %w", err)
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.path, b.path))
+	})
+	for _, c := range candidates {
+		if len(out) >= count {
+			break
+		}
+		kind := kinds[len(out)%len(kinds)]
+		if kind != "parent" && c.nodeType != sdk.NodeTypeFile {
+			continue
+		}
+		var query string
+		switch kind {
+		case "parent":
+			query = `UPDATE nodes SET parent_id = 'corrupt-' || id WHERE id = ?`
+		case "size":
+			query = `UPDATE nodes SET size = size + 1 WHERE id = ?`
+		case "checksum":
+			query = `UPDATE nodes SET checksum = 'corrupt' WHERE id = ?`
+		}
+		if _, err = f.db.ExecContext(ctx, query, c.id); err != nil {
+			return out, fmt.Errorf("failed to corrupt %q: %w", c.path, err)
+		}
+		fs.Debugf(f, "Corrupted %s of %q", kind, c.path)
+		out = append(out, corruption{ID: c.id, Path: c.path, Kind: kind})
+	}
+	if len(out) < count {
+		fs.Logf(f, "Only found %d nodes to corrupt", len(out))
+	}
+	return out, nil
+}
@@ -0,0 +1,127 @@
+// Read only HTTP gateway for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	libhttp "github.com/rclone/rclone/lib/http"
+	"github.com/rclone/rclone/lib/http/serve"
+)
+
+// gateways are the running gateways by the address they serve on, so
+// remotes created again with the same gateway_addr share one
+var (
+	gatewaysMu sync.Mutex
+	gateways   = map[string]*http.Server{}
+)
+
+// startGateway starts serving the world read only over HTTP on addr if
+// nothing is served there by this process already.
+//
+// Directories are served as HTML indexes and files with support for
+// range requests, so tools other than rclone can read the same world.
+func (f *Fs) startGateway(addr string) error {
+	gatewaysMu.Lock()
+	defer gatewaysMu.Unlock()
+	if _, ok := gateways[addr]; ok {
+		fs.Debugf(f, "Gateway already running on %s", addr)
+		return nil
+	}
+	tmpl, err := libhttp.GetTemplate("")
+	if err != nil {
+		return fmt.Errorf("failed to load gateway template: %w", err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start gateway: %w", err)
+	}
+	srv := &http.Server{
+		Handler: &gateway{f: f, tmpl: tmpl},
+	}
+	gateways[addr] = srv
+	f.gateway = srv
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fs.Errorf(f, "Gateway on %s failed: %v", addr, err)
+		}
+	}()
+	fs.Logf(f, "Serving read only gateway on http://%s/", listener.Addr())
+	return nil
+}
+
+// stopGateway stops the gateway started by this remote, if any
+func (f *Fs) stopGateway(ctx context.Context) error {
+	if f.gateway == nil {
+		return nil
+	}
+	gatewaysMu.Lock()
+	for addr, srv := range gateways {
+		if srv == f.gateway {
+			delete(gateways, addr)
+		}
+	}
+	gatewaysMu.Unlock()
+	srv := f.gateway
+	f.gateway = nil
+	return srv.Shutdown(ctx)
+}
+
+// gateway serves a remote read only over HTTP
+type gateway struct {
+	f    *Fs
+	tmpl *template.Template
+}
+
+// ServeHTTP serves the file or directory index at the request path
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	remote := strings.Trim(r.URL.Path, "/")
+	dirURL := remote == "" || strings.HasSuffix(r.URL.Path, "/")
+	if !dirURL {
+		o, err := g.f.NewObject(ctx, remote)
+		if err == nil {
+			serve.SetCacheHeaders(ctx, w, o)
+			serve.Object(w, r, o)
+			return
+		}
+		if !errors.Is(err, fs.ErrorObjectNotFound) && !errors.Is(err, fs.ErrorIsDir) {
+			serve.Error(ctx, remote, w, "Failed to open file", err)
+			return
+		}
+	}
+	entries, err := g.f.List(ctx, remote)
+	if errors.Is(err, fs.ErrorDirNotFound) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		serve.Error(ctx, remote, w, "Failed to list directory", err)
+		return
+	}
+	if !dirURL {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	dir := serve.NewDirectory(remote, g.tmpl)
+	for _, entry := range entries {
+		_, isDir := entry.(fs.Directory)
+		dir.AddHTMLEntry(entry.Remote(), isDir, entry.Size(), entry.ModTime(ctx))
+	}
+	// The gateway doesn't make zip files of directories
+	for i := range dir.Entries {
+		dir.Entries[i].ZipURL = ""
+	}
+	dir.Serve(w, r)
+}
@@ -0,0 +1,192 @@
+// Generation control for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// eagerProgressInterval is how often eager generation logs progress
+const eagerProgressInterval = 5 * time.Second
+
+// generateAll generates the whole world up front, stopping once
+// eager_max_nodes nodes have been generated.
+//
+// The tree is generated breadth first through the primary world, which
+// contains every node, so secondary worlds are fully generated too.
+func (f *Fs) generateAll(ctx context.Context) error {
+	var (
+		start     = time.Now()
+		lastLog   = start
+		dirs      int64
+		files     int64
+		queue     = []string{"/"}
+		maxNodes  = int64(f.opt.EagerMaxNodes)
+		truncated bool
+		include   = f.generationFilter(ctx)
+	)
+	fs.Infof(f, "Generating world eagerly")
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if maxNodes > 0 && dirs+files >= maxNodes {
+			truncated = true
+			break
+		}
+		dir := queue[0]
+		queue = queue[1:]
+		result, err := f.sdkListChildren(ctx, dir, "primary")
+		if err != nil {
+			return fmt.Errorf("eager generation of %q failed: %w", dir, err)
+		}
+		if !result.Success {
+			return fmt.Errorf("eager generation of %q failed: %s", dir, result.Message)
+		}
+		for i := range result.Folders {
+			if include != nil {
+				ok, err := include(result.Folders[i].Path)
+				if err != nil {
+					return fmt.Errorf("eager generation of %q failed: %w", dir, err)
+				}
+				if !ok {
+					continue
+				}
+			}
+			queue = append(queue, result.Folders[i].Path)
+		}
+		dirs += int64(len(result.Folders))
+		files += int64(len(result.Files))
+		f.checkSoftLimits(ctx, false)
+		if time.Since(lastLog) >= eagerProgressInterval {
+			lastLog = time.Now()
+			fs.Infof(f, "Generating world eagerly: %d directories, %d files, %d directories queued", dirs, files, len(queue))
+		}
+	}
+	if truncated {
+		fs.Logf(f, "Eager generation stopped at eager_max_nodes=%d with %d directories not generated", maxNodes, len(queue))
+	}
+	fs.Infof(f, "Generated world eagerly: %d directories, %d files in %v", dirs, files, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// generateBelow generates the children of the directory at spectraPath
+// and of every directory below it which haven't been generated yet.
+//
+// Folders at maxDepth or deeper are left ungenerated unless maxDepth
+// is negative, as are those include rejects if it is set.
+func (f *Fs) generateBelow(ctx context.Context, spectraPath string, maxDepth int, include includeDir) error {
+	tried := make(map[string]bool)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dirs, err := f.ungenerated(ctx, spectraPath, maxDepth)
+		if err != nil {
+			return err
+		}
+		progress := false
+		for _, dir := range dirs {
+			// Directories which generate no children stay ungenerated
+			if tried[dir] {
+				continue
+			}
+			tried[dir] = true
+			progress = true
+			if include != nil {
+				ok, err := include(dir)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+			}
+			if _, err := f.listChildren(ctx, dir); err != nil {
+				return err
+			}
+		}
+		if !progress {
+			return nil
+		}
+	}
+}
+
+// pathDepth returns the depth level of the node at spectraPath, the
+// root being at depth 0
+func pathDepth(spectraPath string) int {
+	if spectraPath == "/" {
+		return 0
+	}
+	return strings.Count(spectraPath, "/")
+}
+
+// depthLimit returns the deepest depth level a recursive listing of
+// the directory at spectraPath needs to return, or -1 for no limit.
+//
+// The limit is taken from --max-depth, which callers listing a limited
+// number of levels set in the config in the context, so a shallow
+// listing of a deep world doesn't generate and read the levels below
+// that would be thrown away.
+func depthLimit(ctx context.Context, spectraPath string) int {
+	maxDepth := fs.GetConfig(ctx).MaxDepth
+	if maxDepth < 0 {
+		return -1
+	}
+	return pathDepth(spectraPath) + maxDepth
+}
+
+// resolveStartAt returns the directory selected by start_at, relative
+// to the root of the world.
+//
+// start_at is either the path of a directory or random:DEPTH[:VARIANT]
+// which walks down DEPTH levels from the root, picking a folder at each
+// level from the seed and VARIANT, so the same subtree is picked on
+// every run with the same dataset.
+func (f *Fs) resolveStartAt(ctx context.Context) (string, error) {
+	spec, ok := strings.CutPrefix(f.opt.StartAt, "random:")
+	if !ok {
+		dir := parsePath(f.opt.StartAt)
+		node, err := f.getNode(ctx, "/"+dir)
+		if err != nil {
+			return "", err
+		}
+		if node == nil || node.Type != sdk.NodeTypeFolder {
+			return "", fmt.Errorf("start_at: directory %q not found", dir)
+		}
+		return dir, nil
+	}
+	depthStr, variant, _ := strings.Cut(spec, ":")
+	depth, err := strconv.Atoi(depthStr)
+	if err != nil || depth < 0 {
+		return "", fmt.Errorf("start_at: bad depth in %q", f.opt.StartAt)
+	}
+	if variant == "" {
+		variant = "0"
+	}
+	if _, err := strconv.Atoi(variant); err != nil {
+		return "", fmt.Errorf("start_at: bad variant in %q", f.opt.StartAt)
+	}
+	seed := f.engine.GetConfig().Seed.Seed
+	dir := "/"
+	for level := range depth {
+		result, err := f.listChildren(ctx, dir)
+		if err != nil {
+			return "", err
+		}
+		if result == nil || len(result.Folders) == 0 {
+			return "", errors.New("start_at: ran out of directories at " + dir)
+		}
+		i := seedHash(seed, "start_at", variant+"/"+strconv.Itoa(level)) % uint64(len(result.Folders))
+		dir = path.Join(dir, result.Folders[i].Name)
+	}
+	return parsePath(dir), nil
+}
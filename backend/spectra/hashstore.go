@@ -0,0 +1,204 @@
+// Precomputed hashes for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// hashBatch is how many hashes the hash-all command stores per
+// transaction
+const hashBatch = 1000
+
+// initHashes creates the table holding the hashes stored by the
+// hash-all command. The hashes of nodes which no longer exist are
+// dropped.
+//
+// Each hash is stored with the profile of the settings it was computed
+// with, so changing a setting the content depends on, such as
+// drift_epoch, makes it be computed again rather than served stale.
+func (f *Fs) initHashes(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_hashes (
+	node_id TEXT NOT NULL,
+	hash    TEXT NOT NULL,
+	profile TEXT NOT NULL,
+	value   TEXT NOT NULL,
+	PRIMARY KEY (node_id, hash, profile)
+);
+DELETE FROM spectra_hashes WHERE node_id NOT IN (SELECT id FROM nodes)`)
+	if err != nil {
+		return fmt.Errorf("failed to create hashes table: %w", err)
+	}
+	return nil
+}
+
+// hashProfile returns the settings the content generated for files
+// depends on
+func (f *Fs) hashProfile() string {
+	return fmt.Sprintf("seed=%d,content=%s,drift_rate=%g,drift_epoch=%d,giant_object_rate=%g,giant_object_size=%d",
+		f.worldSeed(), f.opt.Content, f.opt.DriftRate, f.opt.DriftEpoch, f.opt.GiantObjectRate, f.opt.GiantObjectSize)
+}
+
+// computedSHA256 returns whether the SHA-256 of the file at spectraPath
+// is computed from its content rather than read from its node
+func (f *Fs) computedSHA256(spectraPath string) bool {
+	return f.uniqueContent() || f.drifted(spectraPath) || f.isGiant(spectraPath)
+}
+
+// sourceProfile is the profile of the hashes of uploaded files taken
+// from the source, which don't depend on any settings as the content
+// is stored verbatim
+const sourceProfile = "source"
+
+// storedHash returns the hash of type ty of the node with id stored by
+// the hash-all command or taken from the source it was uploaded from,
+// if there is one
+func (f *Fs) storedHash(ctx context.Context, id string, ty hash.Type) (string, bool) {
+	if f.db == nil || id == "" {
+		return "", false
+	}
+	var sum string
+	err := f.readDB.QueryRowContext(ctx, `
+SELECT value FROM spectra_hashes WHERE node_id = ? AND hash = ? AND profile IN (?, ?) LIMIT 1`,
+		id, ty.String(), f.hashProfile(), sourceProfile).Scan(&sum)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			fs.Debugf(f, "Failed to read stored %v of node %q: %v", ty, id, err)
+		}
+		return "", false
+	}
+	return sum, true
+}
+
+// storeSourceHashes stores the hashes src has of the types computed
+// from the content of the uploaded file with id, so they are returned
+// as src gives them rather than computed by reading the file, as
+// hash-all stores them. The SHA-256 of the node is the Spectra
+// database's own so isn't taken from src.
+//
+// The hashes are dropped with the others when the content changes.
+func (f *Fs) storeSourceHashes(ctx context.Context, id string, src fs.ObjectInfo) error {
+	if f.db == nil || id == "" {
+		return nil
+	}
+	for ty := range f.digests {
+		sum, err := src.Hash(ctx, ty)
+		if err != nil || sum == "" {
+			continue
+		}
+		_, err = f.db.ExecContext(ctx, `
+INSERT OR REPLACE INTO spectra_hashes (node_id, hash, profile, value) VALUES (?, ?, ?, ?)`,
+			id, ty.String(), sourceProfile, sum)
+		if err != nil {
+			return fmt.Errorf("failed to store %v of source: %w", ty, err)
+		}
+	}
+	return nil
+}
+
+// hashAllResult is the result of the hash-all command
+type hashAllResult struct {
+	Types  []string `json:"types"`
+	Files  int64    `json:"files"`
+	Hashes int64    `json:"hashes"`
+}
+
+// hashAll computes every hash type the remote supports for every file
+// in it and stores those which aren't read from the node, so later
+// checks with any of them only read metadata.
+//
+// Files whose hash is absent, as chosen by no_hash_rate, are skipped.
+func (f *Fs) hashAll(ctx context.Context) (result hashAllResult, err error) {
+	var types []hash.Type
+	for ty := range f.digests {
+		types = append(types, ty)
+	}
+	if f.sha256 {
+		types = append(types, hash.SHA256)
+	}
+	slices.Sort(types)
+	result.Types = []string{}
+	for _, ty := range types {
+		result.Types = append(result.Types, ty.String())
+	}
+
+	// The hashes are computed before each batch is stored, as computing
+	// them may need the database connection the transaction would hold
+	type row struct {
+		id  string
+		ty  hash.Type
+		sum string
+	}
+	var rows []row
+	flush := func() (err error) {
+		if len(rows) == 0 {
+			return nil
+		}
+		tx, err := f.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to store hashes: %w", err)
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+			}
+		}()
+		profile := f.hashProfile()
+		for _, r := range rows {
+			_, err = tx.ExecContext(ctx, `
+INSERT OR REPLACE INTO spectra_hashes (node_id, hash, profile, value) VALUES (?, ?, ?, ?)`,
+				r.id, r.ty.String(), profile, r.sum)
+			if err != nil {
+				return fmt.Errorf("failed to store hashes: %w", err)
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("failed to store hashes: %w", err)
+		}
+		result.Hashes += int64(len(rows))
+		rows = rows[:0]
+		return nil
+	}
+
+	var walkErr error
+	err = operations.ListFn(ctx, f, func(obj fs.Object) {
+		o, ok := obj.(*Object)
+		if walkErr != nil || !ok || f.hashAbsent(o.spectraPath()) {
+			return
+		}
+		id := o.ID()
+		if id == "" {
+			return
+		}
+		result.Files++
+		for _, ty := range types {
+			if ty == hash.SHA256 && !f.computedSHA256(o.spectraPath()) {
+				continue
+			}
+			sum, err := o.Hash(ctx, ty)
+			if err != nil {
+				walkErr = fmt.Errorf("hash-all: failed to hash %q: %w", o.remote, err)
+				return
+			}
+			rows = append(rows, row{id: id, ty: ty, sum: sum})
+		}
+		if len(rows) >= hashBatch {
+			walkErr = flush()
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+	if walkErr != nil {
+		return result, walkErr
+	}
+	return result, flush()
+}
@@ -0,0 +1,107 @@
+// Health checks for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// healthCheck is the result of one check made by the health command
+type healthCheck struct {
+	Name    string  `json:"name"`
+	OK      bool    `json:"ok"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// healthReport is the result of the health command
+type healthReport struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []healthCheck `json:"checks"`
+}
+
+// health checks the remote can be used: that the world can be read
+// from the engine and the database, that the database can be written
+// unless the remote is read only, and that listing the root, which
+// generates it if it hasn't been yet, takes no longer than maxLatency
+// if that is positive.
+//
+// The checks go straight to the engine and database, bypassing the
+// simulated latency, faults and limits, so they report on what
+// backs the remote rather than on what it simulates.
+func (f *Fs) health(ctx context.Context, maxLatency time.Duration) *healthReport {
+	report := &healthReport{Healthy: true, Checks: []healthCheck{}}
+	check := func(name string, fn func() error) {
+		start := time.Now()
+		err := fn()
+		c := healthCheck{Name: name, OK: err == nil, Seconds: time.Since(start).Seconds()}
+		if err != nil {
+			c.Error = err.Error()
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	check("engine", func() error {
+		node, err := f.engine.GetNode(ctx, &sdk.GetNodeRequest{Path: "/", TableName: f.opt.World})
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			return errors.New("root not found")
+		}
+		return nil
+	})
+	if f.db != nil {
+		check("database", func() error {
+			var n int
+			return f.readDB.QueryRowContext(ctx, `SELECT count(*) FROM (SELECT 1 FROM nodes LIMIT 1)`).Scan(&n)
+		})
+		if !f.opt.ReadOnly {
+			check("write", func() error {
+				// Take the write lock and write, then roll back
+				tx, err := f.db.BeginTx(ctx, nil)
+				if err != nil {
+					return err
+				}
+				defer func() { _ = tx.Rollback() }()
+				_, err = tx.ExecContext(ctx, `UPDATE spectra_schema SET version = version`)
+				return err
+			})
+		}
+	}
+	check("generation", func() error {
+		start := time.Now()
+		result, err := f.sdkListChildren(ctx, f.toSpectraPath(""), f.opt.World)
+		if err == nil {
+			err = resultError(result)
+		}
+		if err != nil {
+			return err
+		}
+		if elapsed := time.Since(start); maxLatency > 0 && elapsed > maxLatency {
+			return fmt.Errorf("took %v, longer than %v", elapsed.Round(time.Millisecond), maxLatency)
+		}
+		return nil
+	})
+	return report
+}
+
+// err returns an error naming the failed checks if there are any
+func (r *healthReport) err() error {
+	if r.Healthy {
+		return nil
+	}
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name+": "+c.Error)
+		}
+	}
+	return fmt.Errorf("unhealthy: %s", strings.Join(failed, "; "))
+}
@@ -0,0 +1,146 @@
+// Access heatmap for the Spectra backend
+package spectra
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Orders the heatmap command can sort paths in
+const (
+	heatSortFirst = "first" // by first access, the traversal order
+	heatSortLast  = "last"  // by latest access
+	heatSortTotal = "total" // by accesses, hottest first
+)
+
+// pathHeat is the accesses recorded for one path
+type pathHeat struct {
+	ops   [numOpClasses]int64 // accesses per operation class
+	first int64               // sequence number of the first access
+	last  int64               // sequence number of the latest access
+}
+
+// heatmap records the paths accessed through a remote
+type heatmap struct {
+	mu    sync.Mutex
+	seq   int64                // accesses recorded so far
+	paths map[string]*pathHeat // accesses by remote path
+}
+
+// newHeatmap returns an empty heatmap
+func newHeatmap() *heatmap {
+	return &heatmap{paths: make(map[string]*pathHeat)}
+}
+
+// touch records an operation of class on remote in the heatmap, if it
+// is being recorded
+func (f *Fs) touch(class opClass, remote string) {
+	h := f.heat
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	p := h.paths[remote]
+	if p == nil {
+		p = &pathHeat{first: h.seq}
+		h.paths[remote] = p
+	}
+	p.ops[class]++
+	p.last = h.seq
+}
+
+// heatEntry is the accesses of a path as reported by the heatmap
+// command
+type heatEntry struct {
+	Path   string `json:"path"`
+	Lists  int64  `json:"lists"`
+	Stats  int64  `json:"stats"`
+	Reads  int64  `json:"reads"`
+	Writes int64  `json:"writes"`
+	Total  int64  `json:"total"`
+	First  int64  `json:"first"`
+	Last   int64  `json:"last"`
+}
+
+// heatReport is the result of the heatmap command
+type heatReport struct {
+	Accesses int64       `json:"accesses"`
+	Paths    []heatEntry `json:"paths"`
+}
+
+// heatReport returns the accesses recorded so far.
+//
+// If depth is 0 or more the accesses of each path are added to its
+// ancestor depth levels below the root of the remote, to show the
+// locality of a workload at that level. The paths are sorted by order
+// and only the first top are returned if top is more than 0.
+func (f *Fs) heatReport(depth int, order string, top int) (*heatReport, error) {
+	f.heat.mu.Lock()
+	r := &heatReport{Accesses: f.heat.seq}
+	grouped := make(map[string]*pathHeat, len(f.heat.paths))
+	for remote, p := range f.heat.paths {
+		if depth >= 0 {
+			if parts := strings.Split(remote, "/"); len(parts) > depth {
+				remote = strings.Join(parts[:depth], "/")
+			}
+		}
+		g := grouped[remote]
+		if g == nil {
+			g = &pathHeat{first: p.first}
+			grouped[remote] = g
+		}
+		for class, n := range p.ops {
+			g.ops[class] += n
+		}
+		g.first = min(g.first, p.first)
+		g.last = max(g.last, p.last)
+	}
+	f.heat.mu.Unlock()
+
+	r.Paths = make([]heatEntry, 0, len(grouped))
+	for remote, g := range grouped {
+		e := heatEntry{
+			Path:   remote,
+			Lists:  g.ops[opList],
+			Stats:  g.ops[opStat],
+			Reads:  g.ops[opRead],
+			Writes: g.ops[opWrite],
+			First:  g.first,
+			Last:   g.last,
+		}
+		e.Total = e.Lists + e.Stats + e.Reads + e.Writes
+		r.Paths = append(r.Paths, e)
+	}
+	switch order {
+	case "", heatSortFirst:
+		slices.SortFunc(r.Paths, func(a, b heatEntry) int { return cmp.Compare(a.First, b.First) })
+	case heatSortLast:
+		slices.SortFunc(r.Paths, func(a, b heatEntry) int { return cmp.Compare(b.Last, a.Last) })
+	case heatSortTotal:
+		slices.SortFunc(r.Paths, func(a, b heatEntry) int {
+			return cmp.Or(cmp.Compare(b.Total, a.Total), cmp.Compare(a.First, b.First))
+		})
+	default:
+		return nil, fmt.Errorf("unknown sort %q: use %s, %s or %s", order, heatSortFirst, heatSortLast, heatSortTotal)
+	}
+	if top > 0 && len(r.Paths) > top {
+		r.Paths = r.Paths[:top]
+	}
+	return r, nil
+}
+
+// csvTable returns the report as one CSV table with a row per path
+func (r *heatReport) csvTable() [][]string {
+	i64 := func(i int64) string { return strconv.FormatInt(i, 10) }
+	rows := [][]string{{"path", "lists", "stats", "reads", "writes", "total", "first", "last"}}
+	for _, e := range r.Paths {
+		rows = append(rows, []string{e.Path, i64(e.Lists), i64(e.Stats), i64(e.Reads), i64(e.Writes), i64(e.Total), i64(e.First), i64(e.Last)})
+	}
+	return rows
+}
@@ -0,0 +1,91 @@
+// Simulated object hotness for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// Hotness of objects reported in their metadata
+const (
+	hotnessHot  = "hot"
+	hotnessCold = "cold"
+)
+
+// throttleBurst is the most a throttled reader reads at once, so the
+// bandwidth is kept to smoothly
+const throttleBurst = 64 * 1024
+
+// cold returns whether the object at spectraPath is cold, as chosen by
+// cold_object_rate from the world's seed and the path.
+func (f *Fs) cold(spectraPath string) bool {
+	if f.opt.ColdObjectRate <= 0 {
+		return false
+	}
+	return pathFraction(f.worldSeed(), "cold", spectraPath) < f.opt.ColdObjectRate
+}
+
+// hotness returns the hotness of the object at spectraPath
+func (f *Fs) hotness(spectraPath string) string {
+	if f.cold(spectraPath) {
+		return hotnessCold
+	}
+	return hotnessHot
+}
+
+// readBandwidth returns the bandwidth each stream reading the object
+// at spectraPath is limited to, the lower of stream_bandwidth and
+// cold_bandwidth for cold objects, or 0 if it isn't limited
+func (f *Fs) readBandwidth(spectraPath string) int64 {
+	bandwidth := int64(f.tuning().streamBandwidth)
+	if f.cold(spectraPath) && (bandwidth <= 0 || int64(f.opt.ColdBandwidth) < bandwidth) {
+		bandwidth = int64(f.opt.ColdBandwidth)
+	}
+	return bandwidth
+}
+
+// uploadStream returns in limited to stream_bandwidth if it is set
+func (f *Fs) uploadStream(ctx context.Context, in io.Reader) io.Reader {
+	bandwidth := f.tuning().streamBandwidth
+	if bandwidth <= 0 {
+		return in
+	}
+	return newThrottledReader(ctx, in, int64(bandwidth))
+}
+
+// throttledReader reads from a stream at a limited bandwidth, as from a
+// cold object or over a slow network
+type throttledReader struct {
+	ctx     context.Context
+	in      io.Reader
+	limiter *rate.Limiter
+}
+
+// newThrottledReader returns a reader for in limited to bandwidth
+// bytes per second. Each reader has its own limit, so reading an
+// object in several streams reads it faster, as it would from a
+// provider.
+func newThrottledReader(ctx context.Context, in io.Reader, bandwidth int64) *throttledReader {
+	burst := int(min(bandwidth, throttleBurst))
+	return &throttledReader{
+		ctx:     ctx,
+		in:      in,
+		limiter: rate.NewLimiter(rate.Limit(bandwidth), max(burst, 1)),
+	}
+}
+
+// Read implements io.Reader, waiting for the bytes read to be allowed
+func (r *throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err = r.in.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,153 @@
+// Snapshot isolated listings for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"path"
+	"slices"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// isolation records the changes churn has made to the world since the
+// remote was created, so listings can show the world as it was then
+type isolation struct {
+	grown   map[string]bool       // paths of files added by growth_rate
+	removed map[string][]sdk.Node // files removed by shrink_rate by their parent paths
+}
+
+// isolated returns whether listings show the world as it was when the
+// remote was created
+func (f *Fs) isolated() bool {
+	t := f.tuning()
+	return f.opt.SnapshotIsolation && (t.growthRate > 0 || t.shrinkRate > 0)
+}
+
+// recordGrown records that churn added the file at spectraPath.
+//
+// Call with churnMu held.
+func (f *Fs) recordGrown(spectraPath string) {
+	if !f.isolated() {
+		return
+	}
+	if f.isolation.grown == nil {
+		f.isolation.grown = make(map[string]bool)
+	}
+	f.isolation.grown[spectraPath] = true
+}
+
+// recordRemoved records the node of the file at spectraPath which churn
+// is about to remove.
+//
+// Call with churnMu held.
+func (f *Fs) recordRemoved(ctx context.Context, spectraPath string) error {
+	if !f.isolated() {
+		return nil
+	}
+	nodes, err := f.lookupNodes(ctx, []string{spectraPath})
+	if err != nil {
+		return err
+	}
+	node := nodes[spectraPath]
+	if node == nil || f.isolation.grown[spectraPath] {
+		// Files which weren't there at the start stay hidden
+		return nil
+	}
+	if f.isolation.removed == nil {
+		f.isolation.removed = make(map[string][]sdk.Node)
+	}
+	parent := parentPath(spectraPath)
+	f.isolation.removed[parent] = append(f.isolation.removed[parent], *node)
+	return nil
+}
+
+// asOfStart returns the entries of the directory dir at spectraDir as
+// they were when the remote was created, dropping the files churn has
+// added since and putting back those it has removed.
+func (f *Fs) asOfStart(dir, spectraDir string, entries fs.DirEntries) fs.DirEntries {
+	if !f.isolated() {
+		return entries
+	}
+	entries = slices.DeleteFunc(entries, f.grownSinceStart)
+	removed := f.removedSinceStart(spectraDir)
+	if len(removed) == 0 {
+		return entries
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[path.Base(entry.Remote())] = true
+	}
+	for i := range removed {
+		// Unless a file has been uploaded in its place since
+		if node := removed[i]; !present[node.Name] {
+			entries = append(entries, f.newObject(path.Join(dir, f.opt.Enc.ToStandardName(node.Name)), &node))
+		}
+	}
+	return entries
+}
+
+// grownSinceStart returns whether entry is a file churn has added since
+// the remote was created, which isolated listings drop
+func (f *Fs) grownSinceStart(entry fs.DirEntry) bool {
+	if !f.isolated() {
+		return false
+	}
+	if _, isObject := entry.(fs.Object); !isObject {
+		return false
+	}
+	f.churnMu.Lock()
+	defer f.churnMu.Unlock()
+	return f.isolation.grown[f.toSpectraPath(entry.Remote())]
+}
+
+// removedSinceStart returns the nodes of the files churn has removed
+// from the directory at spectraDir since the remote was created, which
+// isolated listings put back
+func (f *Fs) removedSinceStart(spectraDir string) []sdk.Node {
+	if !f.isolated() {
+		return nil
+	}
+	f.churnMu.Lock()
+	defer f.churnMu.Unlock()
+	return slices.Clone(f.isolation.removed[spectraDir])
+}
+
+// removedDirs returns the directories at or below spectraDir which
+// churn has removed files from
+func (f *Fs) removedDirs(spectraDir string) (dirs []string) {
+	if !f.isolated() {
+		return nil
+	}
+	f.churnMu.Lock()
+	defer f.churnMu.Unlock()
+	for dir := range f.isolation.removed {
+		if within(dir, spectraDir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// startNode returns the node at spectraPath as it was when the remote
+// was created, given the node there now, which may be nil.
+func (f *Fs) startNode(spectraPath string, node *sdk.Node) *sdk.Node {
+	if !f.isolated() {
+		return node
+	}
+	f.churnMu.Lock()
+	defer f.churnMu.Unlock()
+	if f.isolation.grown[spectraPath] {
+		return nil
+	}
+	if node != nil {
+		return node
+	}
+	for i, removed := range f.isolation.removed[parentPath(spectraPath)] {
+		if removed.Path == spectraPath {
+			return &f.isolation.removed[parentPath(spectraPath)][i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,502 @@
+// Operations journal for the Spectra backend
+package spectra
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/object"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Operations recorded in the journal
+const (
+	journalPut         = "put"         // a file uploaded, updated or copied
+	journalMkdir       = "mkdir"       // a directory made
+	journalRmdir       = "rmdir"       // a directory removed
+	journalRemove      = "remove"      // a file removed
+	journalPurge       = "purge"       // a directory removed with everything in it
+	journalMove        = "move"        // a file moved
+	journalDirMove     = "dirmove"     // a directory moved
+	journalSetModTime  = "setmodtime"  // the modification time of a file or directory set
+	journalSetMetadata = "setmetadata" // the metadata of a file or directory set
+)
+
+// journalChunkSize is how much of the content of a file is sealed at
+// a time when the content kept with the journal is encrypted
+const journalChunkSize = 1 << 20
+
+// journalEntry is one operation recorded in the journal, one JSON
+// object per line. Paths are from the root of the world.
+type journalEntry struct {
+	Seq       int64       `json:"seq"`
+	Time      time.Time   `json:"time"`
+	Op        string      `json:"op"`
+	Path      string      `json:"path"`
+	Dst       string      `json:"dst,omitempty"` // destination of a move
+	Dir       bool        `json:"dir,omitempty"` // whether a time or metadata set is of a directory
+	ModTime   *time.Time  `json:"modTime,omitempty"`
+	Metadata  fs.Metadata `json:"metadata,omitempty"`
+	Content   string      `json:"content,omitempty"`   // file in the content directory holding the content of a file put
+	Size      int64       `json:"size,omitempty"`      // size of the content of a file put
+	Encrypted bool        `json:"encrypted,omitempty"` // whether the content is encrypted with db_key
+}
+
+// journalContentDir returns the directory the content of the files put
+// is kept in beside the journal at name
+func journalContentDir(name string) string {
+	return name + ".content"
+}
+
+// journalKey returns the key the content kept with the journal at name
+// is encrypted with, derived from password and the salt kept with the
+// content. The salt is made if there is none and create is set.
+func journalKey(name, password string, create bool) (*[keySize]byte, error) {
+	saltFile := filepath.Join(journalContentDir(name), "salt")
+	salt, err := os.ReadFile(saltFile)
+	if errors.Is(err, os.ErrNotExist) && create {
+		salt = make([]byte, saltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("failed to make journal salt: %w", err)
+		}
+		err = os.WriteFile(saltFile, salt, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal salt: %w", err)
+	}
+	return deriveKeyFrom(password, salt)
+}
+
+// openJournal opens the journal set by the journal option to append to,
+// carrying on the sequence numbers of the entries already in it.
+//
+// A partial last entry, left by a crash while it was written, is cut
+// off.
+func (f *Fs) openJournal() error {
+	seq, end, err := readJournal(f.opt.Journal, func(entry *journalEntry) error { return nil })
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(f.opt.Journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() > end {
+		fs.Logf(f, "Dropping partial entry after entry %d at the end of the journal", seq)
+		err = file.Truncate(end)
+	}
+	if err == nil {
+		err = os.MkdirAll(journalContentDir(f.opt.Journal), 0700)
+	}
+	if err == nil && f.encrypted() {
+		var password string
+		if password, err = obscure.Reveal(f.opt.DBKey); err == nil {
+			f.journalKey, err = journalKey(f.opt.Journal, password, true)
+		}
+	}
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	f.journal, f.journalSeq, f.journalEnd = file, seq, end
+	return nil
+}
+
+// closeJournal closes the journal if there is one
+func (f *Fs) closeJournal() error {
+	f.journalMu.Lock()
+	defer f.journalMu.Unlock()
+	if f.journal == nil {
+		return nil
+	}
+	err := f.journal.Close()
+	f.journal = nil
+	return err
+}
+
+// record appends entry to the journal, if there is one.
+//
+// Each entry is written with a single write once the operation has
+// succeeded, so a journal cut short by a crash holds whole entries of
+// the operations which completed, and at most part of one more, which
+// is dropped when the journal is next opened.
+func (f *Fs) record(entry journalEntry) error {
+	f.journalMu.Lock()
+	defer f.journalMu.Unlock()
+	if f.journal == nil {
+		return nil
+	}
+	entry.Seq, entry.Time = f.journalSeq+1, time.Now()
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = f.journal.Write(append(line, '\n'))
+	}
+	if err != nil {
+		// Don't leave part of the entry for the next to follow
+		_ = f.journal.Truncate(f.journalEnd)
+		return fmt.Errorf("failed to journal %s of %q: %w", entry.Op, entry.Path, err)
+	}
+	f.journalSeq++
+	f.journalEnd += int64(len(line)) + 1
+	return nil
+}
+
+// journalled records entry once the operation it describes has
+// succeeded, which is when *err is nil, and fails the operation if it
+// can't be. It is deferred by the operations with their named error
+// result.
+func (f *Fs) journalled(err *error, entry journalEntry) {
+	if *err == nil && f.journal != nil {
+		*err = f.record(entry)
+	}
+}
+
+// journalPut records the upload of o along with its modification time
+// and metadata, so replaying it makes the same file.
+//
+// The content is streamed into a file of its own in the content
+// directory beside the journal, encrypted if db_key is set, and the
+// entry refers to it.
+func (f *Fs) journalPut(ctx context.Context, o *Object) error {
+	if f.journal == nil {
+		return nil
+	}
+	block, stored, err := o.dataBlock(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to journal put: %w", err)
+	}
+	content, err := f.writeJournalContent(o.contentReader(block, stored, 0, o.size))
+	if err != nil {
+		return fmt.Errorf("failed to journal put: %w", err)
+	}
+	modTime := o.ModTime(ctx)
+	entry := journalEntry{
+		Op:        journalPut,
+		Path:      f.toSpectraPath(o.remote),
+		ModTime:   &modTime,
+		Content:   content,
+		Size:      o.size,
+		Encrypted: f.journalKey != nil,
+	}
+	if f.keepsAttributes() {
+		entry.Metadata, err = f.attributes(ctx, o.ID())
+	}
+	if err == nil {
+		err = f.record(entry)
+	}
+	if err != nil {
+		_ = os.Remove(filepath.Join(journalContentDir(f.opt.Journal), content))
+		return fmt.Errorf("failed to journal put: %w", err)
+	}
+	return nil
+}
+
+// writeJournalContent writes the content read from in to a new file in
+// the content directory of the journal and returns its name.
+//
+// Encrypted content is sealed a chunk at a time, each chunk written
+// after its size as 4 bytes big endian.
+func (f *Fs) writeJournalContent(in io.Reader) (name string, err error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to make content name: %w", err)
+	}
+	name = hex.EncodeToString(id[:])
+	contentFile := filepath.Join(journalContentDir(f.opt.Journal), name)
+	file, err := os.OpenFile(contentFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(contentFile)
+		}
+	}()
+	if f.journalKey == nil {
+		_, err = io.Copy(file, in)
+		return name, err
+	}
+	chunk := make([]byte, journalChunkSize)
+	for {
+		n, readErr := io.ReadFull(in, chunk)
+		if n > 0 {
+			sealed, err := sealWith(f.journalKey, chunk[:n])
+			if err != nil {
+				return "", err
+			}
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+			if _, err := file.Write(append(size[:], sealed...)); err != nil {
+				return "", err
+			}
+		}
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return name, nil
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+}
+
+// unsealReader reads the content sealed a chunk at a time by
+// writeJournalContent
+type unsealReader struct {
+	in    io.Reader
+	key   *[keySize]byte
+	chunk []byte // what is left of the chunk being read
+}
+
+// Read reads the content, unsealing the chunks as it goes
+func (r *unsealReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		var size [4]byte
+		if _, err := io.ReadFull(r.in, size[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = errors.New("journal content is cut short")
+			}
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > journalChunkSize+nonceSize+secretbox.Overhead {
+			return 0, errors.New("journal content is corrupted")
+		}
+		sealed := make([]byte, n)
+		if _, err := io.ReadFull(r.in, sealed); err != nil {
+			return 0, errors.New("journal content is cut short")
+		}
+		var err error
+		if r.chunk, err = unsealWith(r.key, sealed); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// readJournal calls fn with each entry of the journal at name in turn
+// and returns the sequence number of the last one and the offset of
+// the end of it.
+//
+// A last line without its newline is the partial entry of a crash, so
+// it is left out rather than failing.
+func readJournal(name string, fn func(entry *journalEntry) error) (seq, end int64, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer fs.CheckClose(file, &err)
+	in := bufio.NewReader(file)
+	for {
+		line, readErr := in.ReadBytes('\n')
+		if errors.Is(readErr, io.EOF) {
+			return seq, end, nil
+		}
+		if readErr != nil {
+			return seq, end, fmt.Errorf("failed to read journal entry after %d: %w", seq, readErr)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry journalEntry
+			if err = json.Unmarshal(line, &entry); err != nil {
+				return seq, end, fmt.Errorf("failed to read journal entry after %d: %w", seq, err)
+			}
+			if err = fn(&entry); err != nil {
+				return seq, end, err
+			}
+			seq = entry.Seq
+		}
+		end += int64(len(line))
+	}
+}
+
+// replayReport is the result of the replay command
+type replayReport struct {
+	Applied int64            `json:"applied"`
+	LastSeq int64            `json:"lastSeq"`
+	Ops     map[string]int64 `json:"ops"`
+}
+
+// replay applies the operations in the journal at name to the remote in
+// order, up to and including the one numbered until if that is
+// positive, stopping at the first which fails.
+//
+// The paths in the journal are from the root of the world, so the
+// remote should be at the root of the world too.
+func (f *Fs) replay(ctx context.Context, name string, until int64) (*replayReport, error) {
+	report := &replayReport{Ops: map[string]int64{}}
+	content := &journalContent{f: f, name: name}
+	errStop := errors.New("stop")
+	_, _, err := readJournal(name, func(entry *journalEntry) error {
+		if until > 0 && entry.Seq > until {
+			return errStop
+		}
+		if err := f.replayEntry(ctx, content, entry); err != nil {
+			return fmt.Errorf("failed to replay %s of %q, entry %d: %w", entry.Op, entry.Path, entry.Seq, err)
+		}
+		report.Applied++
+		report.LastSeq = entry.Seq
+		report.Ops[entry.Op]++
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return report, err
+	}
+	return report, nil
+}
+
+// csvTable returns the report as one CSV table with a row per
+// operation applied
+func (r *replayReport) csvTable() [][]string {
+	rows := [][]string{{"op", "applied"}}
+	ops := make([]string, 0, len(r.Ops))
+	for op := range r.Ops {
+		ops = append(ops, op)
+	}
+	slices.Sort(ops)
+	for _, op := range ops {
+		rows = append(rows, []string{op, strconv.FormatInt(r.Ops[op], 10)})
+	}
+	return rows
+}
+
+// journalContent reads the content of the files put from the content
+// directory of the journal at name
+type journalContent struct {
+	f    *Fs
+	name string
+	key  *[keySize]byte // derived from db_key when first needed
+}
+
+// open returns a reader for the content of the file entry puts
+func (c *journalContent) open(entry *journalEntry) (io.ReadCloser, error) {
+	if entry.Encrypted && c.key == nil {
+		if c.f.opt.DBKey == "" {
+			return nil, errors.New("journal content is encrypted: set db_key")
+		}
+		password, err := obscure.Reveal(c.f.opt.DBKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt db_key: %w", err)
+		}
+		if c.key, err = journalKey(c.name, password, false); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Content == "" || entry.Content != filepath.Base(entry.Content) {
+		return nil, fmt.Errorf("bad content %q", entry.Content)
+	}
+	file, err := os.Open(filepath.Join(journalContentDir(c.name), entry.Content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open content: %w", err)
+	}
+	if !entry.Encrypted {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&unsealReader{in: bufio.NewReader(file), key: c.key}, file}, nil
+}
+
+// replayEntry applies one operation from the journal to the remote,
+// reading the content of the files put from content
+func (f *Fs) replayEntry(ctx context.Context, content *journalContent, entry *journalEntry) (err error) {
+	remote := f.fromSpectraPath(entry.Path)
+	if !within(entry.Path, f.toSpectraPath("")) || (entry.Dst != "" && !within(entry.Dst, f.toSpectraPath(""))) {
+		return errors.New("path is outside the remote")
+	}
+	switch entry.Op {
+	case journalPut:
+		modTime := f.clock.Now()
+		if entry.ModTime != nil {
+			modTime = *entry.ModTime
+		}
+		in, err := content.open(entry)
+		if err != nil {
+			return err
+		}
+		defer fs.CheckClose(in, &err)
+		src := object.NewStaticObjectInfo(remote, modTime, entry.Size, true, nil, nil)
+		o, err := f.NewObject(ctx, remote)
+		switch {
+		case err == nil:
+			err = o.Update(ctx, in, src)
+		case errors.Is(err, fs.ErrorObjectNotFound):
+			o, err = f.Put(ctx, in, src)
+		}
+		if err != nil || len(entry.Metadata) == 0 {
+			return err
+		}
+		return o.(*Object).SetMetadata(ctx, entry.Metadata)
+	case journalMkdir:
+		return f.Mkdir(ctx, remote)
+	case journalRmdir:
+		return f.Rmdir(ctx, remote)
+	case journalPurge:
+		return f.Purge(ctx, remote)
+	case journalRemove:
+		o, err := f.NewObject(ctx, remote)
+		if err != nil {
+			return err
+		}
+		return o.Remove(ctx)
+	case journalMove:
+		o, err := f.NewObject(ctx, remote)
+		if err != nil {
+			return err
+		}
+		_, err = f.Move(ctx, o, f.fromSpectraPath(entry.Dst))
+		return err
+	case journalDirMove:
+		return f.DirMove(ctx, f, remote, f.fromSpectraPath(entry.Dst))
+	case journalSetModTime:
+		if entry.ModTime == nil {
+			return errors.New("no modification time")
+		}
+		if entry.Dir {
+			return f.DirSetModTime(ctx, remote, *entry.ModTime)
+		}
+		o, err := f.NewObject(ctx, remote)
+		if err != nil {
+			return err
+		}
+		return o.SetModTime(ctx, *entry.ModTime)
+	case journalSetMetadata:
+		if entry.Dir {
+			node, err := f.getNode(ctx, entry.Path)
+			if err != nil {
+				return err
+			}
+			if node == nil {
+				return fs.ErrorDirNotFound
+			}
+			return f.newDirectory(ctx, remote, node).SetMetadata(ctx, entry.Metadata)
+		}
+		o, err := f.NewObject(ctx, remote)
+		if err != nil {
+			return err
+		}
+		return o.(*Object).SetMetadata(ctx, entry.Metadata)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+}
@@ -0,0 +1,242 @@
+// Simulated latency for the Spectra backend
+package spectra
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// opClass is a class of operation which latency can be set for
+type opClass int
+
+// Classes of operation
+const (
+	opList  opClass = iota // directory listings
+	opStat                 // single object lookups and hashes
+	opRead                 // opening objects for reading
+	opWrite                // uploads, deletes and directory changes
+	numOpClasses
+)
+
+// opClassNames are the names of the operation classes
+var opClassNames = [numOpClasses]string{"list", "stat", "read", "write"}
+
+// String returns the name of the operation class
+func (c opClass) String() string {
+	return opClassNames[c]
+}
+
+// latencyDist is a distribution of latencies
+type latencyDist struct {
+	kind    string          // "", "fixed", "uniform", "normal", "exp" or "trace"
+	a, b    time.Duration   // parameters of the distribution
+	samples []time.Duration // latencies observed, for "trace"
+}
+
+// parseLatencyDist parses a latency distribution which is one of
+//
+//	DURATION or fixed:DURATION
+//	uniform:MIN,MAX
+//	normal:MEAN,STDDEV
+//	exp:MEAN
+//
+// An empty string means no latency.
+func parseLatencyDist(s string) (d latencyDist, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return d, nil
+	}
+	kind, params, found := strings.Cut(s, ":")
+	if !found {
+		kind, params = "fixed", s
+	}
+	var durations []time.Duration
+	for param := range strings.SplitSeq(params, ",") {
+		duration, err := fs.ParseDuration(strings.TrimSpace(param))
+		if err != nil {
+			return d, fmt.Errorf("bad latency %q: %w", s, err)
+		}
+		durations = append(durations, duration)
+	}
+	want := 1
+	switch kind {
+	case "fixed", "exp":
+	case "uniform", "normal":
+		want = 2
+	default:
+		return d, fmt.Errorf("bad latency %q: unknown distribution %q", s, kind)
+	}
+	if len(durations) != want {
+		return d, fmt.Errorf("bad latency %q: %s needs %d parameters", s, kind, want)
+	}
+	d.kind, d.a = kind, durations[0]
+	if want == 2 {
+		d.b = durations[1]
+	}
+	if kind == "uniform" && d.b < d.a {
+		return d, fmt.Errorf("bad latency %q: max is less than min", s)
+	}
+	return d, nil
+}
+
+// String returns the distribution as it is set in the options
+func (d latencyDist) String() string {
+	switch d.kind {
+	case "fixed":
+		return d.a.String()
+	case "uniform", "normal":
+		return fmt.Sprintf("%s:%v,%v", d.kind, d.a, d.b)
+	case "exp":
+		return fmt.Sprintf("exp:%v", d.a)
+	case "trace":
+		return fmt.Sprintf("trace of %d latencies", len(d.samples))
+	}
+	return ""
+}
+
+// sample draws a latency from the distribution using rng
+func (d latencyDist) sample(rng *rand.Rand) time.Duration {
+	var x float64
+	switch d.kind {
+	case "fixed":
+		return d.a
+	case "uniform":
+		x = float64(d.a) + rng.Float64()*float64(d.b-d.a)
+	case "normal":
+		x = float64(d.a) + rng.NormFloat64()*float64(d.b)
+	case "exp":
+		x = rng.ExpFloat64() * float64(d.a)
+	case "trace":
+		return d.samples[rng.IntN(len(d.samples))]
+	default:
+		return 0
+	}
+	return time.Duration(math.Max(x, 0))
+}
+
+// parseLatencies parses the per operation class latency options
+func parseLatencies(opt *Options) (latencies [numOpClasses]latencyDist, err error) {
+	for class, value := range [numOpClasses]string{
+		opList:  opt.LatencyList,
+		opStat:  opt.LatencyStat,
+		opRead:  opt.LatencyRead,
+		opWrite: opt.LatencyWrite,
+	} {
+		latencies[class], err = parseLatencyDist(value)
+		if err != nil {
+			return latencies, fmt.Errorf("latency_%v: %w", opClass(class), err)
+		}
+	}
+	if opt.LatencyTrace == "" {
+		return latencies, nil
+	}
+	samples, err := loadLatencyTrace(opt.LatencyTrace)
+	if err != nil {
+		return latencies, fmt.Errorf("latency_trace: %w", err)
+	}
+	for class := range samples {
+		if len(samples[class]) > 0 {
+			latencies[class] = latencyDist{kind: "trace", samples: samples[class]}
+		}
+	}
+	return latencies, nil
+}
+
+// loadLatencyTrace reads the latencies observed of each class of
+// operation from the trace file at name.
+//
+// Each line is the class of an operation, list, stat, read or write,
+// and how long it took, as a duration or in seconds, separated by a
+// comma. Blank lines, lines starting with # and a header line starting
+// with op are skipped.
+func loadLatencyTrace(name string) (samples [numOpClasses][]time.Duration, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return samples, err
+	}
+	defer fs.CheckClose(file, &err)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || (n == 1 && strings.HasPrefix(line, "op,")) {
+			continue
+		}
+		op, value, found := strings.Cut(line, ",")
+		class := slices.Index(opClassNames[:], strings.TrimSpace(op))
+		if !found || class < 0 {
+			return samples, fmt.Errorf("line %d: want an operation of %s and a latency, got %q", n, strings.Join(opClassNames[:], ", "), line)
+		}
+		d, err := fs.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			return samples, fmt.Errorf("line %d: bad latency %q", n, value)
+		}
+		samples[class] = append(samples[class], d)
+	}
+	if err := scanner.Err(); err != nil {
+		return samples, err
+	}
+	if slices.IndexFunc(samples[:], func(s []time.Duration) bool { return len(s) > 0 }) < 0 {
+		return samples, fmt.Errorf("no latencies in %q", name)
+	}
+	return samples, nil
+}
+
+// delay sleeps for a latency drawn from the distribution for class,
+// returning early with an error if ctx is cancelled
+func (f *Fs) delay(ctx context.Context, class opClass) error {
+	f.latencyMu.Lock()
+	d := f.latency[class].sample(f.latencyRand)
+	f.latencyMu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// coldStart delays the first access to the directory at spectraPath
+// by a latency drawn from cold_start_latency, as a cache miss or tape
+// recall would. Concurrent first accesses all wait for the same delay.
+func (f *Fs) coldStart(ctx context.Context, spectraPath string) error {
+	if f.coldLatency.kind == "" {
+		return nil
+	}
+	f.warmMu.Lock()
+	warming, ok := f.warm[spectraPath]
+	if !ok {
+		warming = make(chan struct{})
+		f.warm[spectraPath] = warming
+	}
+	f.warmMu.Unlock()
+	if !ok {
+		f.latencyMu.Lock()
+		d := f.coldLatency.sample(f.latencyRand)
+		f.latencyMu.Unlock()
+		fs.Debugf(f, "Cold start of %q: waiting %v", spectraPath, d)
+		// Always finish warming so waiters aren't left hanging
+		time.Sleep(d)
+		close(warming)
+		return nil
+	}
+	select {
+	case <-warming:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,144 @@
+// Simulated provider limits for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/time/rate"
+)
+
+// throttleError is returned when an operation exceeds a QPS cap
+//
+// It is retriable and says when to retry, as a provider's rate limit
+// response would.
+type throttleError struct {
+	kind       string    // "read" or "write"
+	qps        float64   // the cap which was exceeded
+	retryAfter time.Time // when a retry will be allowed
+}
+
+// Error returns the error message
+func (e *throttleError) Error() string {
+	return fmt.Sprintf("spectra: %s QPS cap of %g exceeded, retry after %v", e.kind, e.qps, time.Until(e.retryAfter).Round(time.Millisecond))
+}
+
+// Retry returns true as the operation may be retried
+func (e *throttleError) Retry() bool {
+	return true
+}
+
+// Temporary returns true so low level retries retry the operation
+func (e *throttleError) Temporary() bool {
+	return true
+}
+
+// RetryAfter returns when the operation may be retried
+func (e *throttleError) RetryAfter() time.Time {
+	return e.retryAfter
+}
+
+// qpsLimiters are the read and write limiters for a world
+type qpsLimiters struct {
+	read  *rate.Limiter
+	write *rate.Limiter
+}
+
+// worldLimiters holds the limiters for each world so every remote on
+// the same world shares its caps, as clients of a provider would
+var (
+	worldLimitersMu sync.Mutex
+	worldLimiters   = map[string]*qpsLimiters{}
+)
+
+// newQPSLimiter makes a limiter for qps or returns nil if qps <= 0
+func newQPSLimiter(qps float64) *rate.Limiter {
+	if qps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(qps), int(math.Max(1, math.Ceil(qps))))
+}
+
+// getQPSLimiters returns the shared limiters for world in the database
+// at dbPath, creating them with the caps in opt if needed
+func getQPSLimiters(dbPath string, opt *Options) *qpsLimiters {
+	if opt.MaxReadQPS <= 0 && opt.MaxWriteQPS <= 0 {
+		return &qpsLimiters{}
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%g\x00%g", dbPath, opt.World, opt.MaxReadQPS, opt.MaxWriteQPS)
+	worldLimitersMu.Lock()
+	defer worldLimitersMu.Unlock()
+	limiters := worldLimiters[key]
+	if limiters == nil {
+		limiters = &qpsLimiters{
+			read:  newQPSLimiter(opt.MaxReadQPS),
+			write: newQPSLimiter(opt.MaxWriteQPS),
+		}
+		worldLimiters[key] = limiters
+	}
+	return limiters
+}
+
+// throttle returns a throttleError if an operation of class would
+// exceed the world's QPS caps
+func (f *Fs) throttle(class opClass) error {
+	limiter, kind, qps := f.qps.read, "read", f.opt.MaxReadQPS
+	if class == opWrite {
+		limiter, kind, qps = f.qps.write, "write", f.opt.MaxWriteQPS
+	}
+	if limiter == nil {
+		return nil
+	}
+	r := limiter.Reserve()
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	// Don't consume the token as the operation isn't going ahead
+	r.Cancel()
+	return &throttleError{kind: kind, qps: qps, retryAfter: time.Now().Add(delay)}
+}
+
+// beginOp is called at the start of each operation of class to apply
+// the simulated QPS caps, concurrency pools and latency. It returns
+// ctx marked as holding the operation's slot and the function to call
+// when the operation is done.
+func (f *Fs) beginOp(ctx context.Context, class opClass) (context.Context, func(), error) {
+	if err := f.throttle(class); err != nil {
+		return ctx, nil, err
+	}
+	if err := f.spendCall(); err != nil {
+		return ctx, nil, err
+	}
+	ctx, done, err := f.pools.acquire(ctx, class)
+	if err != nil {
+		return ctx, nil, err
+	}
+	f.costs.requests[class].Add(1)
+	f.checkSoftLimits(ctx, false)
+	if err := f.delay(ctx, class); err != nil {
+		done()
+		return ctx, nil, err
+	}
+	return ctx, done, nil
+}
+
+// checkName returns an error if a name in the path remote is longer
+// than max_name_length bytes as stored, as a provider with a limit on
+// the length of names would refuse to write it
+func (f *Fs) checkName(op, remote string) error {
+	if f.opt.MaxNameLength <= 0 {
+		return nil
+	}
+	for _, name := range strings.Split(f.opt.Enc.FromStandardPath(remote), "/") {
+		if len(name) > f.opt.MaxNameLength {
+			return fmt.Errorf("can't %s %q as a name is longer than %d bytes: %w", op, remote, f.opt.MaxNameLength, fs.ErrorFileNameTooLong)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Public links for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// PublicLink returns a pseudo URL for the object or directory at
+// remote which expires after expire, or link_expiry if that isn't set.
+//
+// The URL is made from link_base_url and a token derived from the
+// world's seed, the path and the expiry time, so the same link is
+// returned for the same request on every run. Nothing serves it.
+func (f *Fs) PublicLink(ctx context.Context, remote string, expire fs.Duration, unlink bool) (string, error) {
+	if unlink {
+		return "", errors.New("spectra links can't be removed")
+	}
+	ctx, done, err := f.beginOp(ctx, opStat)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	spectraPath := f.toSpectraPath(remote)
+	node, err := f.getNode(ctx, spectraPath)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", fs.ErrorObjectNotFound
+	}
+	if !expire.IsSet() {
+		expire = f.opt.LinkExpiry
+	}
+	var expires int64
+	if expire.IsSet() && expire > 0 {
+		// Whole seconds so links made in the same second match
+		expires = f.clock.Now().Add(time.Duration(expire)).Unix()
+	}
+	token := seedHash(f.worldSeed(), "link", spectraPath+"\x00"+strconv.FormatInt(expires, 10))
+	link := strings.TrimSuffix(f.opt.LinkBaseURL, "/") + "/" + fmt.Sprintf("%016x", token) + "/"
+	if spectraPath != "/" {
+		link += url.PathEscape(path.Base(spectraPath))
+	}
+	if expires != 0 {
+		link += "?expires=" + strconv.FormatInt(expires, 10)
+	}
+	return link, nil
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.PublicLinker = (*Fs)(nil)
+)
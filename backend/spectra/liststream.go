@@ -0,0 +1,168 @@
+// Streamed listings for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/list"
+)
+
+// dirLister passes the entries of one directory through the simulated
+// listing faults and churn as they are made, sending them on in
+// tranches, so a directory with hundreds of thousands of entries is
+// never held as entries all at once.
+//
+// It gives the same entries as asOfStart, dropFlaky, dropHidden,
+// addExtra, duplicateListed and applyMoves do in turn on a whole
+// listing.
+type dirLister struct {
+	f          *Fs
+	dir        string          // remote path of the directory
+	spectraDir string          // Spectra path of the directory
+	flaky      bool            // whether flaky entries are dropped
+	removed    []sdk.Node      // files churn removed since the remote was created
+	listed     map[string]bool // names listed, if files are to be put back
+	out        *list.Helper
+}
+
+// newDirLister makes a dirLister for the directory dir at spectraDir
+// sending the entries to callback
+func (f *Fs) newDirLister(dir, spectraDir string, callback fs.ListRCallback) *dirLister {
+	l := &dirLister{
+		f:          f,
+		dir:        dir,
+		spectraDir: spectraDir,
+		flaky:      f.dropsFlaky(spectraDir),
+		removed:    f.removedSinceStart(spectraDir),
+		out:        list.NewHelper(callback),
+	}
+	if len(l.removed) > 0 {
+		l.listed = make(map[string]bool)
+	}
+	return l
+}
+
+// add adds an entry of the listing
+func (l *dirLister) add(entry fs.DirEntry) error {
+	if l.f.grownSinceStart(entry) {
+		return nil
+	}
+	if l.listed != nil {
+		l.listed[path.Base(entry.Remote())] = true
+	}
+	return l.send(entry, true)
+}
+
+// send sends entry on unless it is dropped, dropping it as flaky or
+// hidden only if faults is set
+func (l *dirLister) send(entry fs.DirEntry, faults bool) error {
+	if faults && ((l.flaky && l.f.flaky(entry)) || l.f.isHidden(entry)) {
+		return nil
+	}
+	if l.f.movedAwayEntry(entry) {
+		return nil
+	}
+	if err := l.out.Add(entry); err != nil {
+		return err
+	}
+	if l.f.duplicated(entry) {
+		return l.out.Add(entry)
+	}
+	return nil
+}
+
+// finish adds the files the listing shows which aren't in the
+// directory and sends the last tranche
+func (l *dirLister) finish(ctx context.Context) error {
+	for i := range l.removed {
+		// Unless a file has been uploaded in its place since
+		if node := l.removed[i]; !l.listed[node.Name] {
+			if err := l.send(l.f.newObject(path.Join(l.dir, l.f.opt.Enc.ToStandardName(node.Name)), &node), true); err != nil {
+				return err
+			}
+		}
+	}
+	extra, err := l.f.extraEntries(ctx, l.dir, l.spectraDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range extra {
+		if err := l.send(entry, false); err != nil {
+			return err
+		}
+	}
+	into, err := l.f.movedIntoEntries(ctx, l.dir, l.spectraDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range into {
+		if err := l.out.Add(entry); err != nil {
+			return err
+		}
+	}
+	return l.out.Flush()
+}
+
+// listPaged lists the directory dir at spectraPath for ListP reading
+// its children from the database list_page_size at a time, in order of
+// their paths, so only a page of them is held at once.
+//
+// Children which haven't been generated yet are generated first.
+func (f *Fs) listPaged(ctx context.Context, dir, spectraPath string, callback fs.ListRCallback) error {
+	if f.opt.Lazy {
+		dirs, err := f.ungenerated(ctx, spectraPath, pathDepth(spectraPath)+1)
+		if err != nil {
+			return err
+		}
+		if len(dirs) > 0 {
+			// Not listChildren, so the children aren't cached
+			if _, err := f.readChildren(ctx, spectraPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Children sort between "path/" and "path0" as '0' follows '/'
+	prefix := spectraPath + "/"
+	if spectraPath == "/" {
+		prefix = "/"
+	}
+	end := prefix[:len(prefix)-1] + "0"
+	l := f.newDirLister(dir, spectraPath, callback)
+	for after := prefix; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		nodes, err := f.queryNodes(ctx, `
+WHERE path > ? AND path < ? AND parent_path = ? AND json_extract(existence_map, ?) = 1
+ORDER BY path LIMIT ?`, after, end, spectraPath, worldKey(f.opt.World), f.opt.ListPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to list %q: %w", spectraPath, err)
+		}
+		for i := range nodes {
+			node := &nodes[i]
+			remote := path.Join(dir, f.opt.Enc.ToStandardName(node.Name))
+			var entry fs.DirEntry
+			switch node.Type {
+			case sdk.NodeTypeFolder:
+				entry = f.newDirectory(ctx, remote, node)
+				f.prefetch(node.Path)
+			case sdk.NodeTypeFile:
+				entry = f.newObject(remote, node)
+			default:
+				continue
+			}
+			if err := l.add(entry); err != nil {
+				return err
+			}
+		}
+		if len(nodes) < f.opt.ListPageSize {
+			return l.finish(ctx)
+		}
+		after = nodes[len(nodes)-1].Path
+	}
+}
@@ -0,0 +1,109 @@
+// Dry run planning from a manifest for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// openManifest opens the snapshot named by the manifest option, which
+// --dry-run listings are answered from
+func (f *Fs) openManifest(ctx context.Context) error {
+	if _, err := os.Stat(f.opt.Manifest); err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	// The manifest is never written so SQLite needn't lock it
+	db, err := sql.Open("sqlite3", "file:"+f.opt.Manifest+"?mode=ro&immutable=1")
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	var count int64
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM nodes`).Scan(&count); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	fs.Debugf(f, "Planning --dry-run from manifest %q with %d nodes", f.opt.Manifest, count)
+	f.manifest = db
+	return nil
+}
+
+// planning returns whether metadata is answered from the manifest
+// rather than the generator, which is only done during --dry-run.
+func (f *Fs) planning(ctx context.Context) bool {
+	return f.manifest != nil && fs.GetConfig(ctx).DryRun
+}
+
+// manifestNode returns the node at spectraPath in the manifest in this
+// remote's world, or nil if there isn't one
+func (f *Fs) manifestNode(ctx context.Context, spectraPath string) (*sdk.Node, error) {
+	nodes, err := queryNodesIn(ctx, f.manifest, `
+WHERE path = ? AND json_extract(existence_map, ?) = 1`, spectraPath, worldKey(f.opt.World))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q from manifest: %w", spectraPath, err)
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	return &nodes[0], nil
+}
+
+// manifestDir returns fs.ErrorDirNotFound unless there is a directory at
+// spectraPath in the manifest
+func (f *Fs) manifestDir(ctx context.Context, spectraPath string) error {
+	if spectraPath == "/" {
+		return nil
+	}
+	node, err := f.manifestNode(ctx, spectraPath)
+	if err != nil {
+		return err
+	}
+	if node == nil || node.Type != sdk.NodeTypeFolder {
+		return fs.ErrorDirNotFound
+	}
+	return nil
+}
+
+// manifestObject finds the Object at remote in the manifest
+func (f *Fs) manifestObject(ctx context.Context, remote, spectraPath string) (fs.Object, error) {
+	node, err := f.manifestNode(ctx, spectraPath)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil || f.hidden[spectraPath] {
+		return nil, fs.ErrorObjectNotFound
+	}
+	if node.Type == sdk.NodeTypeFolder {
+		return nil, fs.ErrorIsDir
+	}
+	return f.newObject(remote, node), nil
+}
+
+// manifestList lists the directory dir at spectraPath from the manifest
+func (f *Fs) manifestList(ctx context.Context, dir, spectraPath string) (fs.DirEntries, error) {
+	if err := f.manifestDir(ctx, spectraPath); err != nil {
+		return nil, err
+	}
+	nodes, err := queryNodesIn(ctx, f.manifest, `
+WHERE parent_path = ? AND path <> '/' AND json_extract(existence_map, ?) = 1
+ORDER BY type, name`, spectraPath, worldKey(f.opt.World))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q from manifest: %w", spectraPath, err)
+	}
+	entries := make(fs.DirEntries, 0, len(nodes))
+	for i := range nodes {
+		node := &nodes[i]
+		switch node.Type {
+		case sdk.NodeTypeFolder:
+			entries = append(entries, f.newDirectory(ctx, path.Join(dir, f.opt.Enc.ToStandardName(node.Name)), node))
+		case sdk.NodeTypeFile:
+			entries = append(entries, f.newObject(path.Join(dir, f.opt.Enc.ToStandardName(node.Name)), node))
+		}
+	}
+	return f.duplicateListed(f.dropHidden(f.dropFlaky(spectraPath, entries))), nil
+}
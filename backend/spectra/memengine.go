@@ -0,0 +1,523 @@
+// Pure in memory engine for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"maps"
+	mathrand "math/rand"
+	"math/rand/v2"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/google/uuid"
+)
+
+// memBlockSize is the size of the data block of generated files, as
+// with the SDK
+const memBlockSize = 1024
+
+// memEngine generates and holds the world in memory without SQLite, for
+// lightweight use and tests.
+//
+// It generates the same shape of tree from the same configuration as
+// the SDK, with the same file data, but picks the children of each
+// folder from the seed and the folder's path, so the world is the same
+// whatever order it is listed in. Uploaded content is kept.
+type memEngine struct {
+	cfg      *sdk.Config
+	block    []byte // data of generated files
+	checksum string // SHA256 of block
+	fanout   string // fanout_pattern picking the number of children
+
+	mu       sync.Mutex
+	rng      *rand.Rand                   // rolls existence of created nodes in secondary worlds
+	nodes    map[string]*sdk.Node         // nodes by ID
+	byPath   map[string]string            // IDs of nodes by path
+	children map[string][]string          // IDs of children by parent ID
+	data     map[string][]byte            // content of uploaded files by ID
+	attrs    map[string]map[string]string // metadata by ID
+}
+
+// loadMemConfig reads and checks the Spectra configuration file at
+// configPath as the SDK does
+func loadMemConfig(configPath string) (*sdk.Config, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var cfg sdk.Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config JSON: %w", err)
+	}
+	switch s := cfg.Seed; {
+	case s.MaxDepth < 1:
+		return nil, errors.New("config validation failed: max_depth must be at least 1")
+	case s.MinFolders < 0 || s.MaxFolders < s.MinFolders:
+		return nil, fmt.Errorf("config validation failed: invalid folder count range: min=%d, max=%d", s.MinFolders, s.MaxFolders)
+	case s.MinFiles < 0 || s.MaxFiles < s.MinFiles:
+		return nil, fmt.Errorf("config validation failed: invalid file count range: min=%d, max=%d", s.MinFiles, s.MaxFiles)
+	}
+	for world, probability := range cfg.SecondaryTables {
+		if probability < 0 || probability > 1 {
+			return nil, fmt.Errorf("config validation failed: probability of world %q must be between 0 and 1", world)
+		}
+	}
+	// The world isn't stored anywhere
+	cfg.Seed.DBPath = ""
+	return &cfg, nil
+}
+
+// newMemEngine makes an in memory engine from the Spectra configuration
+// file at configPath
+func newMemEngine(configPath string) (*memEngine, error) {
+	cfg, err := loadMemConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize memory engine: %w", err)
+	}
+	// Generated file data is the SDK's: a block read from math/rand
+	// seeded with the file binary seed
+	block := make([]byte, memBlockSize)
+	_, _ = mathrand.New(mathrand.NewSource(cfg.Seed.FileBinarySeed)).Read(block)
+	sum := sha256.Sum256(block)
+	e := &memEngine{
+		cfg:      cfg,
+		block:    block,
+		checksum: hex.EncodeToString(sum[:]),
+	}
+	e.reset()
+	return e, nil
+}
+
+// reset empties the world, leaving only the root.
+//
+// Call with mu held.
+func (e *memEngine) reset() {
+	e.rng = rand.New(rand.NewPCG(uint64(e.cfg.Seed.Seed), seedHash(e.cfg.Seed.Seed, "memory", "/")))
+	e.nodes = make(map[string]*sdk.Node)
+	e.byPath = make(map[string]string)
+	e.children = make(map[string][]string)
+	e.data = make(map[string][]byte)
+	e.attrs = make(map[string]map[string]string)
+	existence := map[string]bool{"primary": true}
+	for world := range e.cfg.SecondaryTables {
+		existence[world] = true
+	}
+	e.insert(&sdk.Node{
+		ID:           "root",
+		Name:         "/",
+		Path:         "/",
+		Type:         sdk.NodeTypeFolder,
+		LastUpdated:  time.Now(),
+		ExistenceMap: existence,
+	})
+}
+
+// insert adds node to the world.
+//
+// Call with mu held.
+func (e *memEngine) insert(node *sdk.Node) {
+	e.nodes[node.ID] = node
+	e.byPath[node.Path] = node.ID
+	if node.ParentID != "" {
+		e.children[node.ParentID] = append(e.children[node.ParentID], node.ID)
+	}
+}
+
+// resolve returns the node with id, or at spectraPath in world if id
+// is empty, or an error saying it wasn't found.
+//
+// Call with mu held.
+func (e *memEngine) resolve(id, spectraPath, world string) (*sdk.Node, error) {
+	if id == "" {
+		if spectraPath == "" {
+			return nil, errors.New("either id or path must be specified")
+		}
+		id = e.byPath[spectraPath]
+	}
+	node := e.nodes[id]
+	if node == nil || (spectraPath != "" && world != "" && !node.ExistenceMap[world]) {
+		return nil, newEngineError(iofs.ErrNotExist, "node not found")
+	}
+	return node, nil
+}
+
+// existence rolls the worlds a new child of parent exists in: all the
+// secondary worlds parent is in, each with its probability.
+func (e *memEngine) existence(parent *sdk.Node, rng *rand.Rand) map[string]bool {
+	existence := map[string]bool{"primary": true}
+	worlds := make([]string, 0, len(e.cfg.SecondaryTables))
+	for world := range e.cfg.SecondaryTables {
+		worlds = append(worlds, world)
+	}
+	// Roll in a fixed order so the same seed gives the same worlds
+	slices.Sort(worlds)
+	for _, world := range worlds {
+		existence[world] = parent.ExistenceMap[world] && rng.Float64() <= e.cfg.SecondaryTables[world]
+	}
+	return existence
+}
+
+// generate generates the children of parent, picked from the seed and
+// the parent's path.
+//
+// Call with mu held.
+func (e *memEngine) generate(parent *sdk.Node) {
+	s := e.cfg.Seed
+	if parent.DepthLevel >= s.MaxDepth {
+		return
+	}
+	rng := rand.New(rand.NewPCG(uint64(s.Seed), seedHash(s.Seed, "memory", parent.Path)))
+	now := time.Now()
+	child := func(name, nodeType string, size int64, checksum *string) {
+		childPath := path.Join(parent.Path, name)
+		e.insert(&sdk.Node{
+			ID:           uuid.NewSHA1(uuid.NameSpaceURL, fmt.Appendf(nil, "spectra:%d:%s", s.Seed, childPath)).String(),
+			ParentID:     parent.ID,
+			Name:         name,
+			Path:         childPath,
+			ParentPath:   parent.Path,
+			Type:         nodeType,
+			DepthLevel:   parent.DepthLevel + 1,
+			Size:         size,
+			LastUpdated:  now,
+			Checksum:     checksum,
+			ExistenceMap: e.existence(parent, rng),
+		})
+	}
+	folders := e.folderCount(parent, rng)
+	for i := 1; i <= folders; i++ {
+		child(fmt.Sprintf("folder_%d", i), sdk.NodeTypeFolder, 0, nil)
+	}
+	files := e.fileCount(parent, rng)
+	for i := 1; i <= files; i++ {
+		checksum := e.checksum
+		child(fmt.Sprintf("file_%d.txt", i), sdk.NodeTypeFile, memBlockSize, &checksum)
+	}
+}
+
+// ListChildren lists the children of a folder in a world, generating
+// them if the folder has none
+func (e *memEngine) ListChildren(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	world := req.TableName
+	if world == "" {
+		world = "primary"
+	}
+	parent, err := e.resolve(req.ParentID, req.ParentPath, world)
+	if err != nil {
+		return &sdk.ListResult{Success: false, Message: fmt.Sprintf("Parent node not found: %v", err)}, nil
+	}
+	result := &sdk.ListResult{
+		Success: true,
+		Folders: make([]sdk.Folder, 0),
+		Files:   make([]sdk.File, 0),
+	}
+	if !parent.ExistenceMap[world] {
+		result.Message = fmt.Sprintf("Node does not exist in world %s", world)
+		return result, nil
+	}
+	if len(e.children[parent.ID]) == 0 {
+		e.generate(parent)
+	}
+	for _, id := range e.children[parent.ID] {
+		node := *e.nodes[id]
+		if !node.ExistenceMap[world] {
+			continue
+		}
+		switch node.Type {
+		case sdk.NodeTypeFolder:
+			result.Folders = append(result.Folders, sdk.Folder{Node: node})
+		case sdk.NodeTypeFile:
+			result.Files = append(result.Files, sdk.File{Node: node})
+		}
+	}
+	slices.SortFunc(result.Folders, func(a, b sdk.Folder) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(result.Files, func(a, b sdk.File) int { return strings.Compare(a.Name, b.Name) })
+	return result, nil
+}
+
+// GetNode returns the node with an ID or at a path in a world
+func (e *memEngine) GetNode(ctx context.Context, req *sdk.GetNodeRequest) (*sdk.Node, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	world := req.TableName
+	if world == "" {
+		world = "primary"
+	}
+	node, err := e.resolve(req.ID, req.Path, world)
+	if err != nil {
+		return nil, err
+	}
+	n := *node
+	return &n, nil
+}
+
+// GetFileData returns the data block and checksum of a file, which is
+// the uploaded content of uploaded files
+func (e *memEngine) GetFileData(ctx context.Context, id string) ([]byte, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	node := e.nodes[id]
+	if node == nil {
+		return nil, "", newEngineError(iofs.ErrNotExist, "failed to get file node: node not found: %s", id)
+	}
+	if node.Type != sdk.NodeTypeFile {
+		return nil, "", fmt.Errorf("node %s is not a file", id)
+	}
+	if data, ok := e.data[id]; ok {
+		return data, *node.Checksum, nil
+	}
+	return e.block, e.checksum, nil
+}
+
+// Uploaded returns whether the file with id was uploaded
+func (e *memEngine) Uploaded(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.data[id]
+	return ok
+}
+
+// create adds a node called name of nodeType to the parent folder in
+// world.
+//
+// Call with mu held.
+func (e *memEngine) create(parentID, parentPath, world, name, nodeType string, data []byte) (*sdk.Node, error) {
+	if name == "" {
+		return nil, errors.New("name is required")
+	}
+	if world == "" {
+		world = "primary"
+	}
+	parent, err := e.resolve(parentID, parentPath, world)
+	if err != nil {
+		return nil, newEngineError(iofs.ErrNotExist, "failed to get parent node: %w", err)
+	}
+	if parent.Type != sdk.NodeTypeFolder {
+		return nil, fmt.Errorf("parent %s is not a folder", parent.ID)
+	}
+	childPath := path.Join(parent.Path, name)
+	if _, ok := e.byPath[childPath]; ok {
+		return nil, newEngineError(iofs.ErrExist, "node %s already exists", childPath)
+	}
+	node := &sdk.Node{
+		ID:           uuid.New().String(),
+		ParentID:     parent.ID,
+		Name:         name,
+		Path:         childPath,
+		ParentPath:   parent.Path,
+		Type:         nodeType,
+		DepthLevel:   parent.DepthLevel + 1,
+		LastUpdated:  time.Now(),
+		ExistenceMap: e.existence(parent, e.rng),
+	}
+	if nodeType == sdk.NodeTypeFile {
+		sum := sha256.Sum256(data)
+		checksum := hex.EncodeToString(sum[:])
+		node.Size, node.Checksum = int64(len(data)), &checksum
+		e.data[node.ID] = slices.Clone(data)
+	}
+	e.insert(node)
+	n := *node
+	return &n, nil
+}
+
+// CreateFolder creates a folder in a parent folder
+func (e *memEngine) CreateFolder(ctx context.Context, req *sdk.CreateFolderRequest) (*sdk.Node, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.create(req.ParentID, req.ParentPath, req.TableName, req.Name, sdk.NodeTypeFolder, nil)
+}
+
+// UploadFile creates a file in a parent folder holding the data
+func (e *memEngine) UploadFile(ctx context.Context, req *sdk.UploadFileRequest) (*sdk.Node, error) {
+	if len(req.Data) == 0 {
+		return nil, errors.New("data is required")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.create(req.ParentID, req.ParentPath, req.TableName, req.Name, sdk.NodeTypeFile, req.Data)
+}
+
+// ReplaceFile replaces the content of the file with id with data and
+// returns its node
+func (e *memEngine) ReplaceFile(id string, data []byte) (*sdk.Node, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	node := e.nodes[id]
+	if node == nil {
+		return nil, newEngineError(iofs.ErrNotExist, "failed to get file node: node not found: %s", id)
+	}
+	if node.Type != sdk.NodeTypeFile {
+		return nil, fmt.Errorf("node %s is not a file", id)
+	}
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	node.Size, node.Checksum, node.LastUpdated = int64(len(data)), &checksum, time.Now()
+	e.data[id] = slices.Clone(data)
+	n := *node
+	return &n, nil
+}
+
+// SetModTime sets the modification time of the node with id
+func (e *memEngine) SetModTime(id string, modTime time.Time) (*sdk.Node, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	node := e.nodes[id]
+	if node == nil {
+		return nil, newEngineError(iofs.ErrNotExist, "failed to get node: node not found: %s", id)
+	}
+	node.LastUpdated = modTime
+	n := *node
+	return &n, nil
+}
+
+// Attributes returns the metadata of the node with id
+func (e *memEngine) Attributes(id string) (map[string]string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.nodes[id] == nil {
+		return nil, newEngineError(iofs.ErrNotExist, "failed to get node: node not found: %s", id)
+	}
+	return maps.Clone(e.attrs[id]), nil
+}
+
+// SetAttributes replaces the metadata of the node with id
+func (e *memEngine) SetAttributes(id string, attrs map[string]string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.nodes[id] == nil {
+		return newEngineError(iofs.ErrNotExist, "failed to get node: node not found: %s", id)
+	}
+	if len(attrs) == 0 {
+		delete(e.attrs, id)
+		return nil
+	}
+	e.attrs[id] = maps.Clone(attrs)
+	return nil
+}
+
+// DeleteNode deletes the node with an ID or at a path in a world from
+// all worlds, along with everything below it
+func (e *memEngine) DeleteNode(ctx context.Context, req *sdk.DeleteNodeRequest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	world := req.TableName
+	if world == "" {
+		world = "primary"
+	}
+	node, err := e.resolve(req.ID, req.Path, world)
+	if err != nil {
+		return fmt.Errorf("failed to resolve node: %w", err)
+	}
+	if node.ID == "root" {
+		return errors.New("cannot delete root node")
+	}
+	siblings := e.children[node.ParentID]
+	e.children[node.ParentID] = slices.DeleteFunc(siblings, func(id string) bool { return id == node.ID })
+	queue := []string{node.ID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = append(queue[1:], e.children[id]...)
+		delete(e.byPath, e.nodes[id].Path)
+		delete(e.nodes, id)
+		delete(e.children, id)
+		delete(e.data, id)
+		delete(e.attrs, id)
+	}
+	return nil
+}
+
+// RenamePrefix renames the folder at srcPath in a world to dstPath,
+// moving it into the folder above dstPath, along with every node
+// below it, and returns the number of nodes renamed.
+//
+// Only the nodes generated so far are renamed, so renaming a folder
+// whose subtree hasn't been listed is immediate however large it will
+// be. The folders below it not yet listed are generated from their new
+// paths when they are.
+func (e *memEngine) RenamePrefix(world, srcPath, dstPath string) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	node, err := e.resolve("", srcPath, world)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve node: %w", err)
+	}
+	if node.ID == "root" {
+		return 0, errors.New("cannot rename root node")
+	}
+	if node.Type != sdk.NodeTypeFolder {
+		return 0, fmt.Errorf("node %s is not a folder", node.ID)
+	}
+	if within(dstPath, srcPath) {
+		return 0, fmt.Errorf("cannot rename %s into itself", srcPath)
+	}
+	if _, ok := e.byPath[dstPath]; ok {
+		return 0, newEngineError(iofs.ErrExist, "node %s already exists", dstPath)
+	}
+	parent, err := e.resolve("", parentPath(dstPath), world)
+	if err != nil {
+		return 0, newEngineError(iofs.ErrNotExist, "failed to get parent node: %w", err)
+	}
+	if parent.Type != sdk.NodeTypeFolder {
+		return 0, fmt.Errorf("parent %s is not a folder", parent.ID)
+	}
+
+	// Check the whole subtree before changing any of it
+	subtree := []string{node.ID}
+	for i := 0; i < len(subtree); i++ {
+		for w, exists := range e.nodes[subtree[i]].ExistenceMap {
+			if exists && w != world {
+				return 0, errRenameShared
+			}
+		}
+		subtree = append(subtree, e.children[subtree[i]]...)
+	}
+
+	siblings := e.children[node.ParentID]
+	e.children[node.ParentID] = slices.DeleteFunc(siblings, func(id string) bool { return id == node.ID })
+	e.children[parent.ID] = append(e.children[parent.ID], node.ID)
+	node.ParentID, node.Name = parent.ID, path.Base(dstPath)
+	depth := parent.DepthLevel + 1 - node.DepthLevel
+	for _, id := range subtree {
+		n := e.nodes[id]
+		delete(e.byPath, n.Path)
+		n.Path = dstPath + strings.TrimPrefix(n.Path, srcPath)
+		n.ParentPath = parentPath(n.Path)
+		n.DepthLevel += depth
+		e.byPath[n.Path] = id
+	}
+	return int64(len(subtree)), nil
+}
+
+// Reset deletes every node and recreates the root, generating from
+// the seed in the generation parameters from then on
+func (e *memEngine) Reset(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reset()
+	return nil
+}
+
+// GetConfig returns the generation parameters
+func (e *memEngine) GetConfig() *sdk.Config {
+	return e.cfg
+}
+
+// Close releases the engine. The world is only held in memory so
+// there is nothing to close.
+func (e *memEngine) Close() error {
+	return nil
+}
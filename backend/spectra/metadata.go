@@ -0,0 +1,424 @@
+// Object metadata for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// metadataTimeFormat is the format of the times in metadata
+const metadataTimeFormat = time.RFC3339Nano
+
+// systemMetadataInfo describes the metadata spectra reports
+var systemMetadataInfo = map[string]fs.MetadataHelp{
+	"mtime": {
+		Help:    "Time of last modification",
+		Type:    "RFC 3339",
+		Example: "2006-01-02T15:04:05.999999999Z07:00",
+	},
+	"btime": {
+		Help:    "Time of file birth (creation), the modification time if never set",
+		Type:    "RFC 3339",
+		Example: "2006-01-02T15:04:05.999999999Z07:00",
+	},
+	"cache-control": {
+		Help:     "Cache-Control header",
+		Type:     "string",
+		Example:  "public, max-age=3600",
+		ReadOnly: true,
+	},
+	"expires": {
+		Help:     "Expires header",
+		Type:     "RFC 7231 date",
+		Example:  "Wed, 21 Oct 2015 07:28:00 GMT",
+		ReadOnly: true,
+	},
+	"content-type": {
+		Help:     "Content-Type header",
+		Type:     "string",
+		Example:  "text/plain",
+		ReadOnly: true,
+	},
+	"hotness": {
+		Help:     "Whether the object is hot or cold, cold objects being read at cold_bandwidth",
+		Type:     "string",
+		Example:  hotnessCold,
+		ReadOnly: true,
+	},
+	"rollup-dirs": {
+		Help:     "Number of directories below a directory",
+		Type:     "int",
+		Example:  "12",
+		ReadOnly: true,
+	},
+	"rollup-files": {
+		Help:     "Number of files below a directory",
+		Type:     "int",
+		Example:  "345",
+		ReadOnly: true,
+	},
+	"rollup-bytes": {
+		Help:     "Total size of the files below a directory",
+		Type:     "int",
+		Example:  "1048576",
+		ReadOnly: true,
+	},
+}
+
+// cachePolicy is a caching policy an object can be given
+type cachePolicy struct {
+	cacheControl string        // value of the Cache-Control header
+	maxAge       time.Duration // how long after the modification time it expires
+}
+
+// cachePolicies are the caching policies objects are given, ranging
+// from uncacheable to immutable
+var cachePolicies = []cachePolicy{
+	{cacheControl: "no-store"},
+	{cacheControl: "no-cache"},
+	{cacheControl: "private, max-age=0"},
+	{cacheControl: "public, max-age=60", maxAge: time.Minute},
+	{cacheControl: "public, max-age=3600", maxAge: time.Hour},
+	{cacheControl: "public, max-age=86400", maxAge: 24 * time.Hour},
+	{cacheControl: "public, max-age=31536000, immutable", maxAge: 365 * 24 * time.Hour},
+}
+
+// nodeMetadata returns the metadata of the node with id, last modified
+// at modTime: its modification and creation times and the metadata
+// stored for it
+func (f *Fs) nodeMetadata(ctx context.Context, id string, modTime time.Time) (fs.Metadata, error) {
+	attrs, err := f.attributes(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(fs.Metadata, len(attrs)+2)
+	for k, v := range attrs {
+		metadata[k] = v
+	}
+	metadata["mtime"] = modTime.Format(metadataTimeFormat)
+	if _, ok := metadata["btime"]; !ok {
+		metadata["btime"] = metadata["mtime"]
+	}
+	return metadata, nil
+}
+
+// splitMetadata splits metadata being written into the modification
+// time it sets, which is zero if it doesn't, and the metadata to store
+// for the node, dropping the read only system metadata
+func splitMetadata(metadata fs.Metadata) (modTime time.Time, attrs map[string]string, err error) {
+	attrs = make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		switch k {
+		case "mtime":
+			modTime, err = time.Parse(metadataTimeFormat, v)
+			if err != nil {
+				return modTime, nil, fmt.Errorf("failed to parse metadata %s: %w", k, err)
+			}
+		case "btime":
+			if _, err = time.Parse(metadataTimeFormat, v); err != nil {
+				return modTime, nil, fmt.Errorf("failed to parse metadata %s: %w", k, err)
+			}
+			attrs[k] = v
+		default:
+			if help, ok := systemMetadataInfo[k]; ok && help.ReadOnly {
+				continue
+			}
+			attrs[k] = v
+		}
+	}
+	return modTime, attrs, nil
+}
+
+// writeMetadata sets the modification time and metadata of the node
+// with id from metadata, or its modification time to modTime if
+// metadata doesn't set one, and returns the modification time set,
+// which is zero if neither does.
+//
+// The metadata stored for the node is replaced if replace is set and
+// added to otherwise.
+func (f *Fs) writeMetadata(ctx context.Context, id string, modTime time.Time, metadata fs.Metadata, replace bool) (time.Time, error) {
+	setModTime, attrs, err := splitMetadata(metadata)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if setModTime.IsZero() {
+		setModTime = modTime
+	}
+	if metadata != nil {
+		if !replace {
+			stored, err := f.attributes(ctx, id)
+			if err != nil {
+				return time.Time{}, err
+			}
+			for k, v := range stored {
+				if _, ok := attrs[k]; !ok {
+					attrs[k] = v
+				}
+			}
+		}
+		if err := f.storeAttributes(ctx, id, attrs); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if !setModTime.IsZero() {
+		if err := f.setModTime(ctx, id, setModTime); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return setModTime, nil
+}
+
+// writeMetadata sets the modification time and metadata of the object
+// as Fs.writeMetadata does
+func (o *Object) writeMetadata(ctx context.Context, modTime time.Time, metadata fs.Metadata, replace bool) error {
+	id, err := o.fs.nodeID(ctx, o.spectraPath(), o.ID())
+	if err != nil {
+		return err
+	}
+	modTime, err = o.fs.writeMetadata(ctx, id, modTime, metadata, replace)
+	if err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		o.modTime = modTime
+	}
+	return nil
+}
+
+// putMetadata sets the modification time of the object just uploaded
+// from src to that of src, and its metadata to that of src or set by
+// options if --metadata is in use.
+//
+// The hashes src has are stored with the object too. Nothing else is
+// set if modification times can't be stored, leaving the time of the
+// upload.
+func (o *Object) putMetadata(ctx context.Context, src fs.ObjectInfo, options []fs.OpenOption) error {
+	if err := o.fs.storeSourceHashes(ctx, o.ID(), src); err != nil {
+		return err
+	}
+	if !o.fs.keepsAttributes() {
+		return nil
+	}
+	metadata, err := fs.GetMetadataOptions(ctx, o.fs, src, options)
+	if err != nil {
+		return err
+	}
+	return o.writeMetadata(ctx, src.ModTime(ctx), metadata, true)
+}
+
+// SetModTime sets the modification time of the object
+func (o *Object) SetModTime(ctx context.Context, t time.Time) (err error) {
+	defer o.fs.journalled(&err, journalEntry{Op: journalSetModTime, Path: o.fs.toSpectraPath(o.remote), ModTime: &t})
+	if err := o.fs.checkWrite("set modification time of", o.remote); err != nil {
+		return err
+	}
+	if err := o.fs.checkShared(ctx, "set modification time of", o.fs.toSpectraPath(o.remote)); err != nil {
+		return err
+	}
+	if !o.fs.keepsAttributes() {
+		return fs.ErrorCantSetModTime
+	}
+	if _, ok := o.fs.extraNode(o.fs.toSpectraPath(o.remote)); ok {
+		// Setting it would set that of the file it copies
+		return fs.ErrorCantSetModTimeWithoutDelete
+	}
+	ctx, done, err := o.fs.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer o.fs.nodeCache.change()()
+	return o.writeMetadata(ctx, t, nil, false)
+}
+
+// SetMetadata sets the modification time of the object from metadata
+// and adds the rest of it to the metadata stored for the object
+func (o *Object) SetMetadata(ctx context.Context, metadata fs.Metadata) (err error) {
+	defer o.fs.journalled(&err, journalEntry{Op: journalSetMetadata, Path: o.fs.toSpectraPath(o.remote), Metadata: metadata})
+	if err := o.fs.checkWrite("set metadata of", o.remote); err != nil {
+		return err
+	}
+	if err := o.fs.checkShared(ctx, "set metadata of", o.fs.toSpectraPath(o.remote)); err != nil {
+		return err
+	}
+	if !o.fs.keepsAttributes() {
+		return fs.ErrorNotImplemented
+	}
+	if _, ok := o.fs.extraNode(o.fs.toSpectraPath(o.remote)); ok {
+		return errors.New("can't set the metadata of an extra file as it would set that of the file it copies")
+	}
+	ctx, done, err := o.fs.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer o.fs.nodeCache.change()()
+	return o.writeMetadata(ctx, time.Time{}, metadata, false)
+}
+
+// Metadata returns the modification and creation times of the object
+// and the metadata stored for it, along with its expiry metadata if
+// expiry_headers is set and its hotness if cold_object_rate is.
+//
+// The caching policy is chosen from the world's seed and the path, and
+// the object expires that long after its modification time, so the
+// same object has the same headers on every run.
+func (o *Object) Metadata(ctx context.Context) (fs.Metadata, error) {
+	metadata, err := o.fs.nodeMetadata(ctx, o.ID(), o.modTime)
+	if err != nil {
+		return nil, err
+	}
+	if o.fs.opt.ExpiryHeaders {
+		x := pathFraction(o.fs.worldSeed(), "expiry", o.spectraPath())
+		policy := cachePolicies[int(x*float64(len(cachePolicies)))]
+		metadata["cache-control"] = policy.cacheControl
+		metadata["expires"] = o.modTime.Add(policy.maxAge).UTC().Format(http.TimeFormat)
+		metadata["content-type"] = o.MimeType(ctx)
+	}
+	if o.fs.opt.ColdObjectRate > 0 {
+		metadata["hotness"] = o.fs.hotness(o.spectraPath())
+	}
+	return metadata, nil
+}
+
+// directory returns the node ID of the directory at dir
+func (f *Fs) directory(ctx context.Context, dir string) (string, error) {
+	node, err := f.getNode(ctx, f.toSpectraPath(dir))
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.Type != sdk.NodeTypeFolder {
+		return "", fs.ErrorDirNotFound
+	}
+	return node.ID, nil
+}
+
+// DirSetModTime sets the modification time of the directory at dir
+func (f *Fs) DirSetModTime(ctx context.Context, dir string, modTime time.Time) (err error) {
+	defer f.journalled(&err, journalEntry{Op: journalSetModTime, Path: f.toSpectraPath(dir), Dir: true, ModTime: &modTime})
+	if err := f.checkWrite("set modification time of", dir); err != nil {
+		return err
+	}
+	if err := f.checkShared(ctx, "set modification time of", f.toSpectraPath(dir)); err != nil {
+		return err
+	}
+	if !f.dirModTimeSettable() {
+		return fs.ErrorCantSetModTime
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	id, err := f.directory(ctx, dir)
+	if err != nil {
+		return err
+	}
+	_, err = f.writeMetadata(ctx, id, modTime, nil, false)
+	return err
+}
+
+// MkdirMetadata makes the directory passed in as dir.
+//
+// It shouldn't return an error if it already exists.
+//
+// If the metadata is not nil it is set.
+//
+// It returns the directory that was created.
+func (f *Fs) MkdirMetadata(ctx context.Context, dir string, metadata fs.Metadata) (fs.Directory, error) {
+	if err := f.Mkdir(ctx, dir); err != nil && err != fs.ErrorDirExists {
+		return nil, err
+	}
+	node, err := f.getNode(ctx, f.toSpectraPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fs.ErrorDirNotFound
+	}
+	d := f.newDirectory(ctx, dir, node)
+	if metadata != nil {
+		if err := d.SetMetadata(ctx, metadata); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// setModTime sets the modification time the directory reports
+func (d *Directory) setModTime(modTime time.Time) {
+	if !modTime.IsZero() {
+		d.Dir = fs.NewDir(d.Remote(), modTime).SetID(d.ID())
+	}
+}
+
+// SetModTime sets the modification time of the directory
+func (d *Directory) SetModTime(ctx context.Context, t time.Time) (err error) {
+	defer d.fs.journalled(&err, journalEntry{Op: journalSetModTime, Path: d.fs.toSpectraPath(d.Remote()), Dir: true, ModTime: &t})
+	if err := d.fs.checkWrite("set modification time of", d.Remote()); err != nil {
+		return err
+	}
+	if err := d.fs.checkShared(ctx, "set modification time of", d.fs.toSpectraPath(d.Remote())); err != nil {
+		return err
+	}
+	if !d.fs.keepsAttributes() || !d.fs.dirModTimeSettable() {
+		return fs.ErrorCantSetModTime
+	}
+	ctx, done, err := d.fs.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer d.fs.nodeCache.change()()
+	modTime, err := d.fs.writeMetadata(ctx, d.ID(), t, nil, false)
+	if err != nil {
+		return err
+	}
+	d.setModTime(modTime)
+	return nil
+}
+
+// SetMetadata sets the modification time of the directory from
+// metadata and adds the rest of it to the metadata stored for the
+// directory
+func (d *Directory) SetMetadata(ctx context.Context, metadata fs.Metadata) (err error) {
+	defer d.fs.journalled(&err, journalEntry{Op: journalSetMetadata, Path: d.fs.toSpectraPath(d.Remote()), Dir: true, Metadata: metadata})
+	if err := d.fs.checkWrite("set metadata of", d.Remote()); err != nil {
+		return err
+	}
+	if err := d.fs.checkShared(ctx, "set metadata of", d.fs.toSpectraPath(d.Remote())); err != nil {
+		return err
+	}
+	if !d.fs.keepsAttributes() {
+		return fs.ErrorNotImplemented
+	}
+	ctx, done, err := d.fs.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer d.fs.nodeCache.change()()
+	modTime, err := d.fs.writeMetadata(ctx, d.ID(), time.Time{}, metadata, false)
+	if err != nil {
+		return err
+	}
+	d.setModTime(modTime)
+	return nil
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Metadataer      = (*Object)(nil)
+	_ fs.SetMetadataer   = (*Object)(nil)
+	_ fs.DirSetModTimer  = (*Fs)(nil)
+	_ fs.MkdirMetadataer = (*Fs)(nil)
+	_ fs.SetModTimer     = (*Directory)(nil)
+	_ fs.SetMetadataer   = (*Directory)(nil)
+)
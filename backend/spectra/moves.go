@@ -0,0 +1,246 @@
+// Simulated file moves for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// fileMove is a file shown in a different directory by move_rate
+type fileMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// pickMoved picks the files this world shows moved, as chosen by
+// move_rate from the world's seed and their paths, and where each one
+// is moved to.
+//
+// The whole world is generated first to pick the same files and
+// destinations on every run. The files are only moved in this remote's
+// view of the world, so the same world without move_rate has them in
+// their original places with the same content.
+func (f *Fs) pickMoved(ctx context.Context) (err error) {
+	if err := f.generateBelow(ctx, "/", -1, nil); err != nil {
+		return err
+	}
+	rows, err := f.db.QueryContext(ctx, `
+SELECT path, type FROM nodes WHERE json_extract(existence_map, ?) = 1 ORDER BY path`,
+		worldKey(f.opt.World))
+	if err != nil {
+		return fmt.Errorf("failed to list files to move: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	var files, folders []string
+	for rows.Next() {
+		var spectraPath, nodeType string
+		if err = rows.Scan(&spectraPath, &nodeType); err != nil {
+			return fmt.Errorf("failed to read file to move: %w", err)
+		}
+		switch nodeType {
+		case sdk.NodeTypeFile:
+			files = append(files, spectraPath)
+		case sdk.NodeTypeFolder:
+			folders = append(folders, spectraPath)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to list files to move: %w", err)
+	}
+	if !slices.Contains(folders, "/") {
+		folders = append(folders, "/")
+	}
+	seed := f.worldSeed()
+	f.moved = make(map[string]string)
+	f.movedFrom = make(map[string]string)
+	f.movedInto = make(map[string][]string)
+	for _, from := range files {
+		if f.hidden[from] || pathFraction(seed, "move", from) >= f.opt.MoveRate {
+			continue
+		}
+		h := seedHash(seed, "move_to", from)
+		dir := folders[h%uint64(len(folders))]
+		if dir == parentPath(from) && len(folders) > 1 {
+			// Always move to another directory when there is one
+			dir = folders[(h+1)%uint64(len(folders))]
+		}
+		to := path.Join(dir, movedName(path.Base(from), h))
+		f.moved[from] = to
+		f.movedFrom[to] = from
+		f.movedInto[dir] = append(f.movedInto[dir], to)
+	}
+	fs.Debugf(f, "Moved %d of %d files", len(f.moved), len(files))
+	return nil
+}
+
+// movedName returns the name a file called name is given when moved,
+// made unique with h so it can't clash with the files already there
+func movedName(name string, h uint64) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s-moved-%08x%s", strings.TrimSuffix(name, ext), uint32(h>>32), ext)
+}
+
+// nodePath returns the path of the node shown at spectraPath, which is
+// spectraPath itself unless it is where a file was moved to or an
+// extra file.
+func (f *Fs) nodePath(spectraPath string) string {
+	if nodePath, ok := f.extraNode(spectraPath); ok {
+		return nodePath
+	}
+	if f.opt.MoveRate <= 0 {
+		return spectraPath
+	}
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	if from, ok := f.movedFrom[spectraPath]; ok {
+		return from
+	}
+	return spectraPath
+}
+
+// movedAway returns whether the file at spectraPath is shown elsewhere
+func (f *Fs) movedAway(spectraPath string) bool {
+	if f.opt.MoveRate <= 0 {
+		return false
+	}
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	_, ok := f.moved[spectraPath]
+	return ok
+}
+
+// forgetMove stops showing the file at spectraPath as moved, for when
+// it has been removed or replaced.
+func (f *Fs) forgetMove(spectraPath string) {
+	if f.opt.MoveRate <= 0 {
+		return
+	}
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	from, ok := f.movedFrom[spectraPath]
+	if !ok {
+		return
+	}
+	delete(f.moved, from)
+	delete(f.movedFrom, spectraPath)
+	dir := parentPath(spectraPath)
+	f.movedInto[dir] = slices.DeleteFunc(f.movedInto[dir], func(to string) bool { return to == spectraPath })
+}
+
+// movedWithin returns the paths of the nodes of the files shown moved
+// into the directory at spectraDir, or below it, from outside it
+func (f *Fs) movedWithin(spectraDir string) (from []string) {
+	if f.opt.MoveRate <= 0 {
+		return nil
+	}
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	for to, nodePath := range f.movedFrom {
+		if within(to, spectraDir) && !within(nodePath, spectraDir) {
+			from = append(from, nodePath)
+		}
+	}
+	slices.Sort(from)
+	return from
+}
+
+// forgetMovesWithin stops showing the files moved into or out of the
+// directory at spectraDir, or below it, as moved, for when it has been
+// purged.
+func (f *Fs) forgetMovesWithin(spectraDir string) {
+	if f.opt.MoveRate <= 0 {
+		return
+	}
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	for from, to := range f.moved {
+		if within(from, spectraDir) || within(to, spectraDir) {
+			delete(f.moved, from)
+			delete(f.movedFrom, to)
+			dir := parentPath(to)
+			f.movedInto[dir] = slices.DeleteFunc(f.movedInto[dir], func(into string) bool { return into == to })
+		}
+	}
+}
+
+// applyMoves drops the files moved away from the directory at
+// spectraDir from its entries and adds those moved into it.
+//
+// dir is the remote path of the directory.
+func (f *Fs) applyMoves(ctx context.Context, dir, spectraDir string, entries fs.DirEntries) (fs.DirEntries, error) {
+	if f.opt.MoveRate <= 0 {
+		return entries, nil
+	}
+	entries = slices.DeleteFunc(entries, f.movedAwayEntry)
+	into, err := f.movedIntoEntries(ctx, dir, spectraDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, into...), nil
+}
+
+// movedAwayEntry returns whether entry is a file moved away from its
+// directory
+func (f *Fs) movedAwayEntry(entry fs.DirEntry) bool {
+	_, isObject := entry.(fs.Object)
+	return isObject && f.movedAway(f.toSpectraPath(entry.Remote()))
+}
+
+// movedIntoEntries returns the files moved into the directory dir at
+// spectraDir
+func (f *Fs) movedIntoEntries(ctx context.Context, dir, spectraDir string) (entries fs.DirEntries, err error) {
+	if f.opt.MoveRate <= 0 {
+		return nil, nil
+	}
+	f.movedMu.Lock()
+	into := slices.Clone(f.movedInto[spectraDir])
+	f.movedMu.Unlock()
+	for _, to := range into {
+		node, err := f.getNode(ctx, f.nodePath(to))
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			// Removed since it was moved
+			continue
+		}
+		entries = append(entries, f.newObject(path.Join(dir, f.opt.Enc.ToStandardName(path.Base(to))), node))
+	}
+	return entries, nil
+}
+
+// movedDirs returns the directories at or below spectraDir which have
+// files moved into them
+func (f *Fs) movedDirs(spectraDir string) (dirs []string) {
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	for dir, into := range f.movedInto {
+		if len(into) > 0 && within(dir, spectraDir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	slices.Sort(dirs)
+	return dirs
+}
+
+// listMoves returns the moves made by move_rate sorted by where the
+// files were moved from
+func (f *Fs) listMoves() []fileMove {
+	f.movedMu.Lock()
+	defer f.movedMu.Unlock()
+	moves := make([]fileMove, 0, len(f.moved))
+	for from, to := range f.moved {
+		moves = append(moves, fileMove{
+			From: strings.TrimPrefix(from, "/"),
+			To:   strings.TrimPrefix(to, "/"),
+		})
+	}
+	slices.SortFunc(moves, func(a, b fileMove) int { return strings.Compare(a.From, b.From) })
+	return moves
+}
@@ -0,0 +1,466 @@
+// Namespaces of the remote engine for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// Layout of the namespaces on the API server
+const (
+	namespacesDir  = ".spectra-namespaces" // folder at the root of the server holding the namespaces
+	dirMarker      = ".spectra-dir"        // file in a folder of a namespace letting the base show through it
+	opaqueMarker   = ".spectra-opaque"     // file in a folder of a namespace hiding the base below it
+	whiteoutPrefix = ".wh."                // prefix of the files marking nodes of the base deleted in a namespace
+	overlayWorld   = "primary"             // world the namespaces are kept in, as new nodes always exist in it
+)
+
+// errNamespaceReset is returned by Reset in a namespace, as the world
+// is shared with the other namespaces
+var errNamespaceReset = errors.New("can't reset the world the namespaces share")
+
+// checkNamespace checks namespace is a usable name and the engine can
+// keep it
+func checkNamespace(opt *Options) error {
+	if opt.Namespace == "" {
+		return nil
+	}
+	if opt.Engine != engineRemote {
+		return fmt.Errorf("namespace needs the %q engine", engineRemote)
+	}
+	if opt.Namespace == "." || opt.Namespace == ".." || strings.ContainsAny(opt.Namespace, "/\\") {
+		return fmt.Errorf("bad namespace %q: must be a single path element", opt.Namespace)
+	}
+	return nil
+}
+
+// namespaceEngine is a remote engine keeping the changes of one client
+// in its own namespace, an overlay over the world the API server
+// generates, so several clients can share the server without seeing
+// each other's changes.
+//
+// The overlay of a world is a tree of folders on the server at
+// /.spectra-namespaces/<namespace>/<world>, kept in the primary world.
+// Files uploaded and folders made in the namespace are made there.
+// Nodes of the base world deleted in the namespace are marked by a
+// whiteout file called .wh.<name> beside where they would be, and a
+// folder made where one was deleted is marked opaque so the base below
+// it is hidden. Every folder of the overlay holds a marker file, so the
+// server never generates children for it.
+//
+// Each call walks the overlay down to the folder it is about, so it
+// costs a listing per level of the path as well as the call itself.
+//
+// The changes of a namespace are made one at a time, so only one
+// process may change a namespace at once.
+type namespaceEngine struct {
+	*remoteEngine
+	namespace string
+	mu        sync.Mutex // held while the overlay is changed
+}
+
+// newNamespaceEngine returns an engine keeping the changes made with e
+// in namespace
+func newNamespaceEngine(e *remoteEngine, namespace string) *namespaceEngine {
+	return &namespaceEngine{remoteEngine: e, namespace: namespace}
+}
+
+// reservedName returns whether name is used by the namespaces, so
+// can't be given to a file or folder
+func reservedName(name string) bool {
+	return name == dirMarker || name == opaqueMarker || strings.HasPrefix(name, whiteoutPrefix)
+}
+
+// worldOf returns the world a request names
+func worldOf(tableName string) string {
+	if tableName == "" {
+		return "primary"
+	}
+	return tableName
+}
+
+// root returns the path on the server of the overlay of world
+func (e *namespaceEngine) root(world string) string {
+	return path.Join("/", namespacesDir, e.namespace, world)
+}
+
+// overlayPath returns the path on the server of spectraPath in the
+// overlay of world
+func (e *namespaceEngine) overlayPath(world, spectraPath string) string {
+	return path.Join(e.root(world), spectraPath)
+}
+
+// shown returns node of the overlay of world as it is shown in the
+// namespace, or nil if it isn't in the overlay
+func (e *namespaceEngine) shown(world string, node *sdk.Node) *sdk.Node {
+	root := e.root(world)
+	visible := func(serverPath string) (string, bool) {
+		if serverPath == root {
+			return "/", true
+		}
+		rest, ok := strings.CutPrefix(serverPath, root+"/")
+		return "/" + rest, ok
+	}
+	nodePath, ok := visible(node.Path)
+	if !ok {
+		return nil
+	}
+	n := *node
+	n.Path = nodePath
+	n.ParentPath, _ = visible(node.ParentPath)
+	n.DepthLevel -= pathDepth(root)
+	n.ExistenceMap = map[string]bool{world: true}
+	return &n
+}
+
+// listOverlay lists the folder of the overlay at serverPath, or
+// returns nil if there is none
+func (e *namespaceEngine) listOverlay(ctx context.Context, serverPath string) (*sdk.ListResult, error) {
+	result, err := e.list(ctx, &sdk.ListChildrenRequest{ParentPath: serverPath, TableName: overlayWorld})
+	if err != nil {
+		return nil, err
+	}
+	if err := resultError(result); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// layer is what a namespace holds at a folder of a world
+type layer struct {
+	visible bool            // the folder isn't deleted in the namespace
+	base    bool            // the base world shows through at the folder
+	overlay *sdk.ListResult // the folder of the overlay, nil if none
+}
+
+// layers walks the overlay of world down to the folder at spectraPath
+// and returns what the namespace holds there
+func (e *namespaceEngine) layers(ctx context.Context, world, spectraPath string) (l layer, err error) {
+	l.base = true
+	l.overlay, err = e.listOverlay(ctx, e.root(world))
+	if err != nil {
+		return l, err
+	}
+	dir := e.root(world)
+	for _, name := range strings.Split(strings.Trim(spectraPath, "/"), "/") {
+		if name == "" || l.overlay == nil {
+			break
+		}
+		folder := nodeIn(l.overlay, name)
+		switch {
+		case folder != nil && folder.Type == sdk.NodeTypeFolder:
+			dir = path.Join(dir, name)
+			if l.overlay, err = e.listOverlay(ctx, dir); err != nil {
+				return l, err
+			}
+			if l.overlay != nil && nodeIn(l.overlay, opaqueMarker) != nil {
+				l.base = false
+			}
+		case folder != nil, nodeIn(l.overlay, whiteoutPrefix+name) != nil:
+			// Replaced by a file or deleted in the namespace
+			return layer{}, nil
+		default:
+			// Only the base has anything below here
+			l.overlay = nil
+		}
+	}
+	l.visible = l.base || l.overlay != nil
+	return l, nil
+}
+
+// ListChildren lists the children of a folder in a world as the
+// namespace shows them: the children in the base world, generating
+// them if the folder has none, less those deleted in the namespace,
+// with those made in the namespace in place of any of the same name
+func (e *namespaceEngine) ListChildren(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	if req.ParentPath == "" {
+		return nil, errors.New("namespaces need folders to be listed by path")
+	}
+	world := worldOf(req.TableName)
+	l, err := e.layers(ctx, world, req.ParentPath)
+	if err != nil {
+		return nil, err
+	}
+	if !l.visible {
+		return &sdk.ListResult{Success: false, Message: fmt.Sprintf("Parent node not found: %s", req.ParentPath)}, nil
+	}
+	result := &sdk.ListResult{Success: true, Folders: make([]sdk.Folder, 0), Files: make([]sdk.File, 0)}
+	if l.base {
+		base, err := e.remoteEngine.ListChildren(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if !base.Success && l.overlay == nil {
+			return base, nil
+		}
+		if base.Success {
+			result = base
+		}
+	}
+	if l.overlay == nil {
+		return result, nil
+	}
+
+	// Replace the base with the overlay
+	hidden := make(map[string]bool)
+	for _, node := range overlayNodes(l.overlay) {
+		if name, ok := strings.CutPrefix(node.Name, whiteoutPrefix); ok {
+			hidden[name] = true
+		} else {
+			hidden[node.Name] = true
+		}
+	}
+	result.Folders = slices.DeleteFunc(result.Folders, func(folder sdk.Folder) bool { return hidden[folder.Name] })
+	result.Files = slices.DeleteFunc(result.Files, func(file sdk.File) bool { return hidden[file.Name] })
+	for _, node := range overlayNodes(l.overlay) {
+		if reservedName(node.Name) {
+			continue
+		}
+		node = e.shown(world, node)
+		if node.Type == sdk.NodeTypeFolder {
+			result.Folders = append(result.Folders, sdk.Folder{Node: *node})
+		} else {
+			result.Files = append(result.Files, sdk.File{Node: *node})
+		}
+	}
+	slices.SortFunc(result.Folders, func(a, b sdk.Folder) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(result.Files, func(a, b sdk.File) int { return strings.Compare(a.Name, b.Name) })
+	return result, nil
+}
+
+// overlayNodes returns the nodes listed in a folder of the overlay
+func overlayNodes(result *sdk.ListResult) []*sdk.Node {
+	nodes := make([]*sdk.Node, 0, len(result.Folders)+len(result.Files))
+	for i := range result.Folders {
+		nodes = append(nodes, &result.Folders[i].Node)
+	}
+	for i := range result.Files {
+		nodes = append(nodes, &result.Files[i].Node)
+	}
+	return nodes
+}
+
+// GetNode returns the node with an ID or at a path in a world as the
+// namespace shows it
+func (e *namespaceEngine) GetNode(ctx context.Context, req *sdk.GetNodeRequest) (*sdk.Node, error) {
+	world := worldOf(req.TableName)
+	if req.ID != "" || req.Path == "/" {
+		node, err := e.remoteEngine.GetNode(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if shown := e.shown(world, node); shown != nil {
+			return shown, nil
+		}
+		return node, nil
+	}
+	if req.Path == "" {
+		return nil, errors.New("either id or path must be specified")
+	}
+	result, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: parentPath(req.Path), TableName: world})
+	if err != nil {
+		return nil, err
+	}
+	if err := resultError(result); err != nil {
+		return nil, err
+	}
+	if node := nodeIn(result, path.Base(req.Path)); node != nil {
+		return node, nil
+	}
+	return nil, newEngineError(iofs.ErrNotExist, "node not found")
+}
+
+// mkdirOverlay makes the folder name in the folder of the overlay at
+// serverDir, holding marker
+func (e *namespaceEngine) mkdirOverlay(ctx context.Context, serverDir, name, marker string) (*sdk.Node, error) {
+	node, err := e.remoteEngine.CreateFolder(ctx, &sdk.CreateFolderRequest{ParentPath: serverDir, TableName: overlayWorld, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	if err := e.mark(ctx, node.Path, marker); err != nil {
+		// Don't leave a folder the server would generate children for
+		_ = e.remoteEngine.DeleteNode(ctx, &sdk.DeleteNodeRequest{ID: node.ID})
+		return nil, err
+	}
+	return node, nil
+}
+
+// mark makes the marker file name in the folder of the overlay at
+// serverDir
+func (e *namespaceEngine) mark(ctx context.Context, serverDir, name string) error {
+	_, err := e.remoteEngine.UploadFile(ctx, &sdk.UploadFileRequest{ParentPath: serverDir, TableName: overlayWorld, Name: name, Data: []byte{0}})
+	return err
+}
+
+// ensureOverlay makes the folders of the overlay of world down to the
+// folder at spectraPath, which the namespace shows, if they haven't
+// been made, and returns the listing of the last
+func (e *namespaceEngine) ensureOverlay(ctx context.Context, world, spectraPath string) (*sdk.ListResult, error) {
+	// The root of the server must have its children generated
+	// before the namespaces are made in it
+	if _, err := e.remoteEngine.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: "/", TableName: overlayWorld}); err != nil {
+		return nil, err
+	}
+	dir := "/"
+	names := []string{namespacesDir, e.namespace, world}
+	if spectraPath != "/" {
+		names = append(names, strings.Split(strings.Trim(spectraPath, "/"), "/")...)
+	}
+	for _, name := range names {
+		result, err := e.list(ctx, &sdk.ListChildrenRequest{ParentPath: dir, TableName: overlayWorld})
+		if err != nil {
+			return nil, err
+		}
+		if err := resultError(result); err != nil {
+			return nil, err
+		}
+		node := nodeIn(result, name)
+		switch {
+		case node == nil:
+			if _, err := e.mkdirOverlay(ctx, dir, name, dirMarker); err != nil {
+				return nil, err
+			}
+		case node.Type != sdk.NodeTypeFolder:
+			return nil, fmt.Errorf("%s is not a folder", path.Join(dir, name))
+		}
+		dir = path.Join(dir, name)
+	}
+	listing, err := e.listOverlay(ctx, dir)
+	if err == nil && listing == nil {
+		err = newEngineError(iofs.ErrNotExist, "failed to make %s", dir)
+	}
+	return listing, err
+}
+
+// create makes the node called name in the folder at parent of world
+// in the overlay, with makeNode, replacing any node of the base deleted
+// there
+func (e *namespaceEngine) create(ctx context.Context, parent, world, name string, makeNode func(serverDir string, deleted bool) (*sdk.Node, error)) (*sdk.Node, error) {
+	if parent == "" {
+		return nil, errors.New("namespaces need nodes to be made by path")
+	}
+	if reservedName(name) {
+		return nil, fmt.Errorf("name %q is reserved for namespaces", name)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	existing, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: parent, TableName: world})
+	if err != nil {
+		return nil, err
+	}
+	if err := resultError(existing); err != nil {
+		return nil, newEngineError(iofs.ErrNotExist, "failed to get parent node: %w", err)
+	}
+	if nodeIn(existing, name) != nil {
+		return nil, newEngineError(iofs.ErrExist, "node %s already exists", path.Join(parent, name))
+	}
+	listing, err := e.ensureOverlay(ctx, world, parent)
+	if err != nil {
+		return nil, err
+	}
+	whiteout := nodeIn(listing, whiteoutPrefix+name)
+	node, err := makeNode(e.overlayPath(world, parent), whiteout != nil)
+	if err != nil {
+		return nil, err
+	}
+	if whiteout != nil {
+		if err := e.remoteEngine.DeleteNode(ctx, &sdk.DeleteNodeRequest{ID: whiteout.ID}); err != nil {
+			return nil, err
+		}
+	}
+	return e.shown(world, node), nil
+}
+
+// CreateFolder creates a folder in a parent folder in the namespace.
+//
+// A folder made where one of the base was deleted is opaque, so what
+// was below the deleted one stays deleted.
+func (e *namespaceEngine) CreateFolder(ctx context.Context, req *sdk.CreateFolderRequest) (*sdk.Node, error) {
+	return e.create(ctx, req.ParentPath, worldOf(req.TableName), req.Name, func(serverDir string, deleted bool) (*sdk.Node, error) {
+		marker := dirMarker
+		if deleted {
+			marker = opaqueMarker
+		}
+		return e.mkdirOverlay(ctx, serverDir, req.Name, marker)
+	})
+}
+
+// UploadFile creates a file in a parent folder in the namespace
+func (e *namespaceEngine) UploadFile(ctx context.Context, req *sdk.UploadFileRequest) (*sdk.Node, error) {
+	return e.create(ctx, req.ParentPath, worldOf(req.TableName), req.Name, func(serverDir string, _ bool) (*sdk.Node, error) {
+		upload := *req
+		upload.ParentPath, upload.ParentID, upload.TableName = serverDir, "", overlayWorld
+		return e.remoteEngine.UploadFile(ctx, &upload)
+	})
+}
+
+// DeleteNode deletes the node with an ID or at a path in a world from
+// the namespace, along with everything below it. Nodes of the base
+// world are marked as deleted rather than deleted.
+func (e *namespaceEngine) DeleteNode(ctx context.Context, req *sdk.DeleteNodeRequest) error {
+	world := worldOf(req.TableName)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spectraPath := req.Path
+	if spectraPath == "" {
+		node, err := e.GetNode(ctx, &sdk.GetNodeRequest{ID: req.ID, TableName: world})
+		if err != nil {
+			return err
+		}
+		spectraPath = node.Path
+	}
+	spectraPath = path.Clean(spectraPath)
+	if spectraPath == "/" {
+		return errors.New("cannot delete root node")
+	}
+	parent, name := parentPath(spectraPath), path.Base(spectraPath)
+	l, err := e.layers(ctx, world, parent)
+	if err != nil {
+		return err
+	}
+	var inOverlay, inBase, whiteout *sdk.Node
+	if l.overlay != nil {
+		inOverlay = nodeIn(l.overlay, name)
+		whiteout = nodeIn(l.overlay, whiteoutPrefix+name)
+	}
+	if l.base && whiteout == nil {
+		base, err := e.remoteEngine.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: parent, TableName: world})
+		if err != nil {
+			return err
+		}
+		if base.Success {
+			inBase = nodeIn(base, name)
+		}
+	}
+	if !l.visible || (inOverlay == nil && inBase == nil) {
+		return newEngineError(iofs.ErrNotExist, "node not found: %s", spectraPath)
+	}
+	if inOverlay != nil {
+		if err := e.remoteEngine.DeleteNode(ctx, &sdk.DeleteNodeRequest{ID: inOverlay.ID}); err != nil {
+			return err
+		}
+	}
+	if inBase == nil {
+		return nil
+	}
+	if _, err := e.ensureOverlay(ctx, world, parent); err != nil {
+		return err
+	}
+	return e.mark(ctx, e.overlayPath(world, parent), whiteoutPrefix+name)
+}
+
+// Reset refuses to reset the world, as other namespaces share it
+func (e *namespaceEngine) Reset(ctx context.Context) error {
+	return errNamespaceReset
+}
@@ -0,0 +1,141 @@
+// Node metadata cache for the Spectra backend
+package spectra
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+)
+
+// nodeCache keeps the children of the directories listed recently, so
+// looking up the nodes of files already listed, as NewObject, Hash
+// and Open do for every file of a sync, costs no SDK or database
+// calls.
+//
+// A directory is cached whole, so a lookup of a path not in its
+// listing is known to find nothing too. The listings expire after the
+// TTL and the oldest are dropped to keep the nodes cached to the size.
+//
+// Every change made through the remote clears the cache as it starts
+// and again as it ends, and a listing read while the cache was
+// cleared isn't cached, so the remote always sees its own changes.
+// Changes made by other remotes are seen once the listings expire.
+type nodeCache struct {
+	size  int           // most nodes to cache, 0 to cache nothing
+	ttl   time.Duration // how long listings are cached for
+	mu    sync.Mutex
+	gen   uint64                   // incremented each time the cache is cleared
+	dirs  map[string]*list.Element // cached listings by directory
+	order *list.List               // *cachedDir, oldest first
+	nodes int                      // nodes cached in all the listings
+}
+
+// cachedDir is the listing of one directory in the node cache
+type cachedDir struct {
+	dir      string               // Spectra path of the directory
+	children map[string]*sdk.Node // children by Spectra path
+	expires  time.Time            // when the listing expires
+}
+
+// newNodeCache makes a cache holding up to size nodes for ttl. A size
+// or ttl of 0 disables it.
+func newNodeCache(size int, ttl time.Duration) *nodeCache {
+	if ttl <= 0 {
+		size = 0
+	}
+	return &nodeCache{
+		size:  max(size, 0),
+		ttl:   ttl,
+		dirs:  make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// generation returns the generation of the cache to pass to put, read
+// before listing a directory
+func (c *nodeCache) generation() uint64 {
+	if c.size == 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// put caches children as the listing of dir, unless the cache has been
+// cleared since gen was read or the listing is too big
+func (c *nodeCache) put(gen uint64, dir string, children []*sdk.Node) {
+	if c.size == 0 || len(children) > c.size {
+		return
+	}
+	entry := &cachedDir{
+		dir:      dir,
+		children: make(map[string]*sdk.Node, len(children)),
+		expires:  time.Now().Add(c.ttl),
+	}
+	for _, node := range children {
+		entry.children[node.Path] = node
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.dirs[dir]; ok {
+		c.remove(e)
+	}
+	for c.nodes+len(children) > c.size {
+		c.remove(c.order.Front())
+	}
+	c.dirs[dir] = c.order.PushBack(entry)
+	c.nodes += len(children)
+}
+
+// remove drops the cached listing e. Call with mu held.
+func (c *nodeCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cachedDir)
+	delete(c.dirs, entry.dir)
+	c.nodes -= len(entry.children)
+}
+
+// lookup returns the node at spectraPath and whether the listing of
+// its parent is cached, so a nil node means there is nothing there
+func (c *nodeCache) lookup(spectraPath string) (node *sdk.Node, ok bool) {
+	if c.size == 0 || spectraPath == "/" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.dirs[parentPath(spectraPath)]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cachedDir)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	return entry.children[spectraPath], true
+}
+
+// clear drops every cached listing
+func (c *nodeCache) clear() {
+	if c.size == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	clear(c.dirs)
+	c.order.Init()
+	c.nodes = 0
+}
+
+// change clears the cache at the start of a change to the world and
+// returns the function clearing it again at the end
+func (c *nodeCache) change() (done func()) {
+	c.clear()
+	return c.clear
+}
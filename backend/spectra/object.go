@@ -4,9 +4,14 @@ package spectra
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Project-Sylos/Spectra/sdk"
@@ -18,9 +23,16 @@ import (
 type Object struct {
 	fs       *Fs       // parent filesystem
 	remote   string    // remote path
+	id       string    // Spectra node ID if known
 	size     int64     // file size
 	modTime  time.Time // modification time
 	checksum string    // cached checksum
+
+	blockMu   sync.Mutex // protects block, stored, rewritten and id
+	block     []byte     // data block, read on first Open
+	stored    bool       // block is uploaded content rather than generated
+	rewritten bool       // block was read after the simulated writer rewrote the file
+	hashMu    sync.Mutex // protects checksum
 }
 
 // Fs returns the parent Fs
@@ -41,6 +53,12 @@ func (o *Object) String() string {
 	return o.remote
 }
 
+// spectraPath returns the path of the object's node, which differs
+// from where the object is shown if it was moved by move_rate
+func (o *Object) spectraPath() string {
+	return o.fs.nodePath(o.fs.toSpectraPath(o.remote))
+}
+
 // ModTime returns the modification time
 func (o *Object) ModTime(ctx context.Context) time.Time {
 	return o.modTime
@@ -53,24 +71,88 @@ func (o *Object) Size() int64 {
 
 // Hash returns the hash of the object
 func (o *Object) Hash(ctx context.Context, ty hash.Type) (string, error) {
-	if ty != hash.SHA256 {
+	if o.fs.hashAbsent(o.spectraPath()) {
+		return "", nil
+	}
+	if d, ok := o.fs.digests[ty]; ok {
+		if sum, ok := o.fs.storedHash(ctx, o.ID(), ty); ok {
+			return sum, nil
+		}
+		block, stored, err := o.dataBlock(ctx)
+		if err != nil {
+			return "", err
+		}
+		if stored {
+			return d.Sum(bytes.NewReader(block))
+		}
+		if o.fs.uniqueContent() || o.fs.drifted(o.spectraPath()) {
+			// Unique and drifted content isn't shared so isn't cached
+			return o.sharedSum(ty, func() (string, error) {
+				return d.Sum(o.contentReader(block, false, 0, o.size))
+			})
+		}
+		return o.fs.contentDigest(d, block, o.size)
+	}
+	if ty != hash.SHA256 || !o.fs.sha256 {
 		return "", hash.ErrUnsupported
 	}
 
 	// If we have cached checksum, return it
+	o.hashMu.Lock()
+	defer o.hashMu.Unlock()
 	if o.checksum != "" {
 		return o.checksum, nil
 	}
 
+	spectraPath := o.spectraPath()
+	unique := o.fs.uniqueContent()
+	if drifted := o.fs.drifted(spectraPath); unique || drifted || o.fs.isGiant(spectraPath) {
+		if sum, ok := o.fs.storedHash(ctx, o.ID(), ty); ok {
+			o.checksum = sum
+			return o.checksum, nil
+		}
+		block, stored, err := o.dataBlock(ctx)
+		if err != nil {
+			return "", err
+		}
+		if stored {
+			sum := sha256.Sum256(block)
+			o.checksum = hex.EncodeToString(sum[:])
+			return o.checksum, nil
+		}
+		if unique {
+			o.checksum, err = o.sharedSum(ty, func() (string, error) {
+				return streamSHA256(o.contentReader(block, false, 0, o.size))
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to hash object: %w", err)
+			}
+			return o.checksum, nil
+		}
+		if drifted {
+			o.checksum, err = o.sharedSum(ty, func() (string, error) {
+				return tiledSHA256(block, o.size)
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to hash drifted object: %w", err)
+			}
+			return o.checksum, nil
+		}
+		o.checksum, err = o.fs.giantSHA256(block, o.size)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash giant object: %w", err)
+		}
+		return o.checksum, nil
+	}
+
 	// Get the node to fetch the checksum
-	spectraPath := o.fs.toSpectraPath(o.remote)
-	node, err := o.fs.spectraSDK.GetNode(&sdk.GetNodeRequest{
-		Path:      spectraPath,
-		TableName: o.fs.opt.World,
-	})
+	node, err := o.fs.getNode(ctx, spectraPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to get node for hash: %w", err)
 	}
+	if node == nil {
+		return "", fs.ErrorObjectNotFound
+	}
 
 	if node.Checksum != nil {
 		o.checksum = *node.Checksum
@@ -78,125 +160,398 @@ func (o *Object) Hash(ctx context.Context, ty hash.Type) (string, error) {
 	return o.checksum, nil
 }
 
+// ID returns the Spectra node ID of the object if known
+func (o *Object) ID() string {
+	o.blockMu.Lock()
+	defer o.blockMu.Unlock()
+	return o.id
+}
+
+// Inode returns a stable inode number derived from where the object
+// is shown
+func (o *Object) Inode() uint64 {
+	return o.fs.pathInode(o.fs.toSpectraPath(o.remote))
+}
+
 // Storable returns whether the object is storable
 func (o *Object) Storable() bool {
 	return true
 }
 
-// SetModTime sets the modification time
-func (o *Object) SetModTime(ctx context.Context, t time.Time) error {
-	// Spectra doesn't support setting modification time
-	return fs.ErrorCantSetModTime
+// MimeType returns the content type of the object, detected from the
+// extension of its name as the Spectra SDK keeps none
+func (o *Object) MimeType(ctx context.Context) string {
+	return fs.MimeTypeFromName(o.remote)
 }
 
-// Open opens the file for read
-func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
-	spectraPath := o.fs.toSpectraPath(o.remote)
-
-	// Get the node first to ensure it exists and trigger lazy generation
-	node, err := o.fs.spectraSDK.GetNode(&sdk.GetNodeRequest{
-		Path:      spectraPath,
-		TableName: o.fs.opt.World,
-	})
+// dataBlock returns the data block of the object and whether it is
+// the stored content of an uploaded file rather than generated.
+//
+// The block is fetched on first use and kept, so reopening the object
+// at a different offset, as chunked readers and non-cached VFS mounts
+// do on every seek, costs no SDK calls. Objects for the same file
+// opened at once share a single fetch.
+func (o *Object) dataBlock(ctx context.Context) ([]byte, bool, error) {
+	o.blockMu.Lock()
+	defer o.blockMu.Unlock()
+	rewritten := o.fs.isRewritten(o.spectraPath())
+	if o.block != nil && rewritten == o.rewritten {
+		return o.block, o.stored, nil
+	}
+	id := o.id
+	if rewritten != o.rewritten {
+		// The node may have been replaced so look it up again
+		id = ""
+	}
+	shared, err := o.fs.fetchBlock(ctx, o.spectraPath(), id)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "not found") {
-			return nil, fs.ErrorObjectNotFound
-		}
-		return nil, fmt.Errorf("failed to get node: %w", err)
+		return nil, false, err
 	}
+	o.id, o.block, o.stored, o.rewritten = shared.id, shared.block, shared.stored, rewritten
+	return o.block, o.stored, nil
+}
 
-	// Get file data using SDK
-	data, _, err := o.fs.spectraSDK.GetFileData(node.ID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file data: %w", err)
+// contentReader returns a reader for bytes [off, end) of the content
+// of the object given its data block and whether that is uploaded
+// content.
+//
+// Generated content is the block repeated, or with content=unique the
+// file's own keystream, so any range is read without the bytes before.
+func (o *Object) contentReader(block []byte, stored bool, off, end int64) io.Reader {
+	if stored || !o.fs.uniqueContent() {
+		return newTiledReader(block, off, end)
 	}
+	return newStreamReader(o.fs.contentCipher, o.fs.contentNonce(o.spectraPath()), off, end)
+}
 
-	// Apply range options if specified
-	var start, end int64 = 0, int64(len(data))
-	for _, opt := range options {
-		switch v := opt.(type) {
+// readRange returns the offset and the limit, or -1 for none, of the
+// part of the file of size which options ask to read.
+//
+// A Range header passed as an HTTP option, as with --header-download,
+// is read like a range option. Other options don't change what is
+// read: advisory ones, such as the hashes the caller will compute, are
+// ignored and unknown mandatory ones are logged rather than failing
+// the read, so options added to rclone later don't break it.
+func (o *Object) readRange(options []fs.OpenOption, size int64) (offset, limit int64) {
+	limit = -1
+	for _, option := range options {
+		switch x := option.(type) {
 		case *fs.RangeOption:
-			start, end = v.Decode(int64(len(data)))
+			offset, limit = x.Decode(size)
 		case *fs.SeekOption:
-			start = v.Offset
+			offset = x.Offset
+		case *fs.HTTPOption:
+			if !strings.EqualFold(x.Key, "Range") {
+				continue
+			}
+			r, err := fs.ParseRangeOption(x.Value)
+			if err != nil {
+				fs.Debugf(o, "Ignoring bad Range header %q: %v", x.Value, err)
+				continue
+			}
+			offset, limit = r.Decode(size)
+		default:
+			if option.Mandatory() {
+				fs.Logf(o, "Unsupported mandatory option: %v", option)
+			}
 		}
 	}
+	return offset, limit
+}
 
-	if start > 0 || end < int64(len(data)) {
-		if start < 0 {
-			start = 0
+// Open opens the file for read
+func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (_ io.ReadCloser, err error) {
+	defer o.fs.profiled(profOpen, time.Now(), &err)
+	ctx, done, err := o.fs.beginOp(ctx, opRead)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if done != nil {
+			done()
+		}
+	}()
+	o.fs.touch(opRead, o.remote)
+	if err := o.fs.fault(faultRead, o.remote); err != nil {
+		return nil, err
+	}
+	if err := o.fs.coldStart(ctx, parentPath(o.fs.toSpectraPath(o.remote))); err != nil {
+		return nil, err
+	}
+	if o.fs.archived(o.spectraPath()) {
+		if err := o.fs.checkRestored(ctx, o.spectraPath()); err != nil {
+			return nil, err
+		}
+	}
+	if o.fs.tuning().shrinkRate > 0 {
+		// The object may have vanished since it was listed
+		if err := o.fs.simulateChurn(ctx); err != nil {
+			return nil, err
 		}
-		if end > int64(len(data)) {
-			end = int64(len(data))
+		node, err := o.fs.lookupNode(ctx, o.spectraPath())
+		if err != nil {
+			return nil, err
 		}
-		data = data[start:end]
+		if node == nil {
+			return nil, fs.ErrorObjectNotFound
+		}
+	}
+	block, stored, err := o.dataBlock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(block))
+	if !stored {
+		size = o.fs.fileSize(o.spectraPath(), size)
 	}
 
-	return io.NopCloser(bytes.NewReader(data)), nil
+	offset, limit := o.readRange(options, size)
+	offset = min(max(offset, 0), size)
+	end := size
+	if limit >= 0 && limit < size-offset {
+		end = offset + limit
+	}
+	toEnd := limit < 0 // whether the read runs to the end of the file
+	if badOffset, badEnd := o.fs.badRange(o.spectraPath(), size, offset, end); badOffset != offset || badEnd != end {
+		offset, end, toEnd = badOffset, badEnd, false
+	}
+
+	in := o.contentReader(block, stored, offset, end)
+	if off, mask := o.fs.corruption(o.spectraPath(), size); off >= 0 {
+		in = &corruptReader{in: in, pos: offset, off: off, mask: mask}
+	}
+	in = o.fs.newEgressReader(in)
+	if o.fs.rewritable(o.spectraPath()) && !o.fs.pinned(ctx, o.ID()) {
+		o.fs.opened(o)
+		if toEnd {
+			end = -1 // read to the end of the file, however long
+		}
+		in = newRewriteReader(ctx, o, in, offset, end)
+	}
+	if bandwidth := o.fs.readBandwidth(o.spectraPath()); bandwidth > 0 {
+		in = newThrottledReader(ctx, in, bandwidth)
+	}
+	// The reader releases the slot when closed
+	rc := &slotReader{Reader: in, release: done}
+	done = nil
+	return rc, nil
 }
 
-// Update updates the object with new content
+// Update updates the object with new content.
+//
+// The content is replaced in place, so the file keeps its node ID, and
+// with it its inode, and is left as it was if the update fails.
+// Engines which can't do that have the file deleted and uploaded
+// again.
 func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	if err := o.fs.checkWrite("update", o.remote); err != nil {
+		return err
+	}
+	if err := o.fs.checkShared(ctx, "update", o.fs.toSpectraPath(o.remote)); err != nil {
+		return err
+	}
+	ctx, done, err := o.fs.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer o.fs.nodeCache.change()()
+	o.fs.touch(opWrite, o.remote)
+	if err := o.fs.fault(faultWrite, o.remote); err != nil {
+		return err
+	}
 	// Read the new data
-	data, err := io.ReadAll(in)
+	data, err := io.ReadAll(o.fs.uploadStream(ctx, in))
 	if err != nil {
 		return fmt.Errorf("failed to read data: %w", err)
 	}
 
 	spectraPath := o.fs.toSpectraPath(o.remote)
+	if _, ok := o.fs.extraNode(spectraPath); ok {
+		// An extra copy becomes a file of its own, leaving the
+		// file it copies alone
+		obj, err := o.fs.upload(ctx, o.remote, data, nil)
+		if err != nil {
+			return err
+		}
+		o.setUpdated(obj.id, obj.size, obj.modTime)
+		if err := o.putMetadata(ctx, src, options); err != nil {
+			return err
+		}
+		return o.fs.journalPut(ctx, o)
+	}
 
-	// Delete the old file
-	deleteReq := &sdk.DeleteNodeRequest{
-		Path:      spectraPath,
-		TableName: o.fs.opt.World,
+	if err := o.fs.checkQuota(ctx, o.remote, 0, int64(len(data))-o.size); err != nil {
+		return err
 	}
-	err = o.fs.spectraSDK.DeleteNode(deleteReq)
+	id, size, modTime, err := o.fs.replaceContent(ctx, o.spectraPath(), o.ID(), data)
 	if err != nil {
-		return fmt.Errorf("failed to delete old file: %w", err)
+		return err
+	}
+	if err := o.fs.pin(ctx, id); err != nil {
+		return err
 	}
+	o.setUpdated(id, size, modTime)
+	if err := o.putMetadata(ctx, src, options); err != nil {
+		return err
+	}
+	return o.fs.journalPut(ctx, o)
+}
+
+// setUpdated sets the node, size and modification time of the object
+// after an update, forgetting the content and checksum it had
+func (o *Object) setUpdated(id string, size int64, modTime time.Time) {
+	o.size = size
+	o.modTime = modTime
+	o.hashMu.Lock()
+	o.checksum = ""
+	o.hashMu.Unlock()
+	o.blockMu.Lock()
+	o.id = id
+	o.block, o.stored = nil, false
+	o.blockMu.Unlock()
+}
 
-	// Upload the new file
-	uploadReq := &sdk.UploadFileRequest{
-		ParentPath: o.fs.toSpectraPath(""),
-		TableName:  o.fs.opt.World,
-		Name:       o.remote,
-		Data:       data,
+// replaceContent replaces the content of the file at spectraPath,
+// whose node is id if known, with data, in place where it can, and
+// returns the ID of its node, its size and modification time after
+func (f *Fs) replaceContent(ctx context.Context, spectraPath, id string, data []byte) (string, int64, time.Time, error) {
+	if id == "" {
+		node, err := f.getNode(ctx, spectraPath)
+		if err != nil {
+			return "", 0, time.Time{}, err
+		}
+		if node == nil {
+			return "", 0, time.Time{}, fs.ErrorObjectNotFound
+		}
+		id = node.ID
 	}
 
-	node, err := o.fs.spectraSDK.UploadFile(uploadReq)
+	// Replace the content in place, keeping the node
+	if f.db != nil {
+		modTime := f.clock.Now()
+		if _, err := f.replaceBlob(ctx, id, data, modTime); err != nil {
+			return "", 0, time.Time{}, fmt.Errorf("failed to update file: %w", err)
+		}
+		return id, int64(len(data)), modTime, nil
+	}
+	if replacer, ok := f.engine.(contentReplacer); ok {
+		node, err := retryBusy(f.opt.OpTimeout, func() (*sdk.Node, error) {
+			return replacer.ReplaceFile(id, data)
+		})
+		if err == nil {
+			return node.ID, node.Size, node.LastUpdated, nil
+		}
+		if !errors.Is(err, errCantReplace) {
+			return "", 0, time.Time{}, fmt.Errorf("failed to update file: %w", err)
+		}
+	}
+	node, err := f.reupload(ctx, spectraPath, id, data)
 	if err != nil {
-		return fmt.Errorf("failed to upload updated file: %w", err)
+		return "", 0, time.Time{}, err
 	}
+	return node.ID, f.fileSize(spectraPath, node.Size), node.LastUpdated, nil
+}
 
-	// Update object metadata
-	o.size = node.Size
-	o.modTime = node.LastUpdated
-	o.checksum = "" // clear cached checksum
+// sdkData returns what to upload to the engine for a file holding
+// data. The SDK refuses empty files, so they are uploaded with a byte
+// of generated content when the blob stored in the database holds
+// what they really contain.
+func (f *Fs) sdkData(data []byte) []byte {
+	if len(data) == 0 && f.db != nil {
+		return []byte{0}
+	}
+	return data
+}
 
-	return nil
+// reupload replaces the file at spectraPath, whose node is id, with a
+// new file holding data, for engines which can't replace files in
+// place.
+//
+// The old file is deleted first as the new one can't be made beside
+// it, and is put back with its old data block if the upload fails.
+func (f *Fs) reupload(ctx context.Context, spectraPath, id string, data []byte) (*sdk.Node, error) {
+	old, err := f.sdkGetFileData(ctx, id)
+	if isNotFound(err) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read old file: %w", err)
+	}
+	if err := f.sdkDeleteNode(ctx, spectraPath); err != nil {
+		return nil, fmt.Errorf("failed to delete old file: %w", err)
+	}
+	upload := func(data []byte) (*sdk.Node, error) {
+		return retryBusy(f.opt.OpTimeout, func() (*sdk.Node, error) {
+			return f.engine.UploadFile(ctx, &sdk.UploadFileRequest{
+				ParentPath: parentPath(spectraPath),
+				TableName:  f.opt.World,
+				Name:       path.Base(spectraPath),
+				Data:       f.sdkData(data),
+			})
+		})
+	}
+	node, err := upload(data)
+	if err != nil {
+		if _, restoreErr := upload(old); restoreErr != nil {
+			fs.Errorf(f, "Failed to restore %q after failed update: %v", spectraPath, restoreErr)
+		}
+		return nil, fmt.Errorf("failed to upload updated file: %w", err)
+	}
+	return node, nil
 }
 
 // Remove removes the object
-func (o *Object) Remove(ctx context.Context) error {
-	spectraPath := o.fs.toSpectraPath(o.remote)
-
-	req := &sdk.DeleteNodeRequest{
-		Path:      spectraPath,
-		TableName: o.fs.opt.World,
+func (o *Object) Remove(ctx context.Context) (err error) {
+	defer o.fs.profiled(profRemove, time.Now(), &err)
+	defer o.fs.journalled(&err, journalEntry{Op: journalRemove, Path: o.fs.toSpectraPath(o.remote)})
+	if err := o.fs.checkWrite("remove", o.remote); err != nil {
+		return err
+	}
+	ctx, done, err := o.fs.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
 	}
+	defer done()
+	defer o.fs.nodeCache.change()()
+	o.fs.touch(opWrite, o.remote)
+	if err := o.fs.fault(faultDelete, o.remote); err != nil {
+		return err
+	}
+	if err := o.fs.checkDelete(ctx, o.fs.toSpectraPath(o.remote), false); err != nil {
+		return err
+	}
+	if o.fs.forgetExtra(o.fs.toSpectraPath(o.remote)) {
+		// Only the copy is removed
+		return nil
+	}
+	spectraPath := o.spectraPath()
 
-	err := o.fs.spectraSDK.DeleteNode(req)
+	// With a database the file is only removed from this world
+	if o.fs.db != nil {
+		var deleted int64
+		deleted, err = o.fs.deleteTrees(ctx, spectraPath)
+		if err == nil && deleted == 0 {
+			return fs.ErrorObjectNotFound
+		}
+	} else {
+		err = o.fs.sdkDeleteNode(ctx, spectraPath)
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "not found") {
+		if isNotFound(err) {
 			return fs.ErrorObjectNotFound
 		}
 		return fmt.Errorf("failed to remove object: %w", err)
 	}
+	o.fs.forgetMove(o.fs.toSpectraPath(o.remote))
 
 	return nil
 }
 
 // Check the interfaces are satisfied
 var (
-	_ fs.Object = (*Object)(nil)
+	_ fs.Object    = (*Object)(nil)
+	_ fs.IDer      = (*Object)(nil)
+	_ fs.Inoder    = (*Object)(nil)
+	_ fs.MimeTyper = (*Object)(nil)
 )
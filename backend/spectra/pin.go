@@ -0,0 +1,60 @@
+// Pinned uploads for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// initPins creates the table of the files pinned by pin_uploads.
+//
+// Pins are kept by node ID, so they follow a file when it is moved, and
+// the pins of nodes which have gone, including those of earlier runs,
+// are dropped.
+func (f *Fs) initPins(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_pins (
+	node_id TEXT PRIMARY KEY
+);
+DELETE FROM spectra_pins WHERE node_id NOT IN (SELECT id FROM nodes)`)
+	if err != nil {
+		return fmt.Errorf("failed to create pin table: %w", err)
+	}
+	return nil
+}
+
+// pin marks the file with id, just uploaded, so the simulated churn and
+// writers leave it alone, if pin_uploads is set
+func (f *Fs) pin(ctx context.Context, id string) error {
+	if !f.opt.PinUploads {
+		return nil
+	}
+	_, err := f.db.ExecContext(ctx, `INSERT OR IGNORE INTO spectra_pins (node_id) VALUES (?)`, id)
+	if err != nil {
+		return fmt.Errorf("failed to pin uploaded file: %w", err)
+	}
+	return nil
+}
+
+// pinned returns whether the file with id is pinned.
+//
+// Files whose pin can't be read are treated as pinned, so a fixture is
+// never changed by mistake.
+func (f *Fs) pinned(ctx context.Context, id string) bool {
+	if !f.opt.PinUploads {
+		return false
+	}
+	var one int
+	err := f.readDB.QueryRowContext(ctx, `SELECT 1 FROM spectra_pins WHERE node_id = ?`, id).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		fs.Debugf(f, "Failed to read pin of %q: %v", id, err)
+	}
+	return true
+}
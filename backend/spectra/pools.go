@@ -0,0 +1,100 @@
+// Concurrency pools for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// opPool limits how many operations using it are in progress at once
+type opPool struct {
+	name      string
+	slots     chan struct{} // holds a value for each slot in use
+	waits     atomic.Int64  // operations which waited for a slot
+	waitNanos atomic.Int64  // total time spent waiting
+}
+
+// opPools are the pools of each operation class. Listings and lookups
+// share the metadata pool. A nil pool doesn't limit its class.
+type opPools [numOpClasses]*opPool
+
+// poolSlotKey is the context key marking an operation holding a slot
+type poolSlotKey struct{}
+
+// newOpPools makes the pools limited to the sizes in opt
+func newOpPools(opt *Options) (p opPools) {
+	newPool := func(name string, size int) *opPool {
+		if size <= 0 {
+			return nil
+		}
+		return &opPool{name: name, slots: make(chan struct{}, size)}
+	}
+	metadata := newPool("metadata", opt.MaxMetadataConcurrency)
+	p[opList], p[opStat] = metadata, metadata
+	p[opRead] = newPool("read", opt.MaxReadConcurrency)
+	p[opWrite] = newPool("write", opt.MaxWriteConcurrency)
+	return p
+}
+
+// acquire waits for a slot in the pool of class and returns ctx marked
+// as holding it and the function releasing it.
+//
+// Operations made within one holding a slot, as the parent directories
+// an upload makes, use its slot rather than waiting for another, so
+// they can't deadlock however small the pools are.
+func (p *opPools) acquire(ctx context.Context, class opClass) (context.Context, func(), error) {
+	pool := p[class]
+	if pool == nil || ctx.Value(poolSlotKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+	select {
+	case pool.slots <- struct{}{}:
+	default:
+		pool.waits.Add(1)
+		start := time.Now()
+		select {
+		case pool.slots <- struct{}{}:
+			pool.waitNanos.Add(int64(time.Since(start)))
+		case <-ctx.Done():
+			pool.waitNanos.Add(int64(time.Since(start)))
+			return ctx, nil, ctx.Err()
+		}
+	}
+	release := sync.OnceFunc(func() { <-pool.slots })
+	return context.WithValue(ctx, poolSlotKey{}, pool), release, nil
+}
+
+// contention returns the contention of each pool in use
+func (p *opPools) contention() (pools []poolContention) {
+	seen := make(map[*opPool]bool)
+	for _, pool := range p {
+		if pool == nil || seen[pool] {
+			continue
+		}
+		seen[pool] = true
+		pools = append(pools, poolContention{
+			Pool:        pool.name,
+			Open:        cap(pool.slots),
+			InUse:       len(pool.slots),
+			Waits:       pool.waits.Load(),
+			WaitSeconds: time.Duration(pool.waitNanos.Load()).Seconds(),
+		})
+	}
+	return pools
+}
+
+// slotReader releases the slot of the read which opened it when it is
+// closed, so the slot is held for the whole transfer
+type slotReader struct {
+	io.Reader
+	release func()
+}
+
+// Close releases the slot
+func (r *slotReader) Close() error {
+	r.release()
+	return nil
+}
@@ -0,0 +1,94 @@
+// Background generation for the Spectra backend
+package spectra
+
+import (
+	"context"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// prefetchQueuePerWorker is how many directories each worker started by
+// generation_concurrency can have queued. Directories listed while the
+// queue is full aren't prefetched.
+const prefetchQueuePerWorker = 256
+
+// startPrefetch starts the generation_concurrency workers generating
+// the subdirectories of the directories listed in the background
+func (f *Fs) startPrefetch() {
+	f.prefetchQueue = make(chan string, f.opt.GenerationConcurrency*prefetchQueuePerWorker)
+	f.prefetchQueued = make(map[string]bool)
+	f.prefetchCtx, f.prefetchCancel = context.WithCancel(context.Background())
+	for range f.opt.GenerationConcurrency {
+		f.prefetchWG.Add(1)
+		go func() {
+			defer f.prefetchWG.Done()
+			for {
+				select {
+				case spectraPath := <-f.prefetchQueue:
+					f.prefetchDir(f.prefetchCtx, spectraPath)
+				case <-f.prefetchCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// stopPrefetch stops the workers, dropping the directories they haven't
+// started and waiting for those in progress
+func (f *Fs) stopPrefetch() {
+	if f.prefetchCancel == nil {
+		return
+	}
+	f.prefetchCancel()
+	f.prefetchWG.Wait()
+}
+
+// prefetch queues the directories at spectraPaths, just listed, to be
+// generated in the background so a traversal finds them generated when
+// it gets to them.
+//
+// Directories at the maximum depth have no children so aren't queued,
+// nor are those already queued.
+func (f *Fs) prefetch(spectraPaths ...string) {
+	if f.prefetchQueue == nil {
+		return
+	}
+	maxDepth := f.engine.GetConfig().Seed.MaxDepth
+	f.prefetchMu.Lock()
+	defer f.prefetchMu.Unlock()
+	for _, spectraPath := range spectraPaths {
+		if pathDepth(spectraPath) >= maxDepth || f.prefetchQueued[spectraPath] {
+			continue
+		}
+		select {
+		case f.prefetchQueue <- spectraPath:
+			f.prefetchQueued[spectraPath] = true
+		default:
+			return
+		}
+	}
+}
+
+// prefetchDir generates the children of the directory at spectraPath
+// unless they have been generated already.
+//
+// The listing is shared with any made of the directory at the same
+// time, so a traversal reaching it first waits for it rather than
+// generating it again.
+func (f *Fs) prefetchDir(ctx context.Context, spectraPath string) {
+	defer func() {
+		f.prefetchMu.Lock()
+		delete(f.prefetchQueued, spectraPath)
+		f.prefetchMu.Unlock()
+	}()
+	if f.db != nil {
+		dirs, err := f.ungenerated(ctx, spectraPath, pathDepth(spectraPath)+1)
+		if err != nil || len(dirs) == 0 {
+			return
+		}
+	}
+	if _, err := f.listChildren(ctx, spectraPath); err != nil {
+		fs.Debugf(f, "Failed to prefetch %q: %v", spectraPath, err)
+	}
+}
@@ -0,0 +1,201 @@
+// Operation profiling for the Spectra backend
+package spectra
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Operations profiled for the profile command
+const (
+	profList = iota
+	profNewObject
+	profOpen
+	profPut
+	profMkdir
+	profRmdir
+	profRemove
+	profPurge
+	numProfileOps
+)
+
+// profileOpNames are the names of the profiled operations in reports
+var profileOpNames = [numProfileOps]string{"list", "new_object", "open", "put", "mkdir", "rmdir", "remove", "purge"}
+
+// profileBounds are the upper bounds of the buckets of the latency
+// histograms. A last bucket holds the latencies above them all.
+var profileBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// numProfileBuckets is the number of buckets of the latency histograms
+const numProfileBuckets = len(profileBounds) + 1
+
+// opProfile counts the calls of one operation and how long they took
+type opProfile struct {
+	calls   atomic.Int64                    // calls made
+	errors  atomic.Int64                    // calls which returned an error
+	total   atomic.Int64                    // nanoseconds taken in total
+	max     atomic.Int64                    // longest call in nanoseconds
+	buckets [numProfileBuckets]atomic.Int64 // calls per latency bucket
+}
+
+// profiles counts the calls of each profiled operation
+type profiles [numProfileOps]opProfile
+
+// profiled records a call of op started at start which returned *err.
+// It is deferred by the operations with their named error result.
+func (f *Fs) profiled(op int, start time.Time, err *error) {
+	d := time.Since(start)
+	p := &f.profiles[op]
+	p.calls.Add(1)
+	if *err != nil {
+		p.errors.Add(1)
+	}
+	p.total.Add(int64(d))
+	for {
+		old := p.max.Load()
+		if int64(d) <= old || p.max.CompareAndSwap(old, int64(d)) {
+			break
+		}
+	}
+	bucket := len(profileBounds)
+	for i, bound := range profileBounds {
+		if d <= bound {
+			bucket = i
+			break
+		}
+	}
+	p.buckets[bucket].Add(1)
+}
+
+// reset zeroes the counts
+func (p *profiles) reset() {
+	for op := range p {
+		p[op].calls.Store(0)
+		p[op].errors.Store(0)
+		p[op].total.Store(0)
+		p[op].max.Store(0)
+		for i := range p[op].buckets {
+			p[op].buckets[i].Store(0)
+		}
+	}
+}
+
+// profileBucket is the number of calls which took at most LE seconds,
+// and more than the bound of the bucket before
+type profileBucket struct {
+	LE    string `json:"le"` // upper bound in seconds, or +Inf
+	Calls int64  `json:"calls"`
+}
+
+// opReport is the profile of one operation as reported by the profile
+// command
+type opReport struct {
+	Op          string          `json:"op"`
+	Calls       int64           `json:"calls"`
+	Errors      int64           `json:"errors"`
+	Seconds     float64         `json:"seconds"`
+	MeanSeconds float64         `json:"meanSeconds"`
+	MaxSeconds  float64         `json:"maxSeconds"`
+	Buckets     []profileBucket `json:"buckets"`
+}
+
+// profileReport is the result of the profile command
+type profileReport struct {
+	Since time.Time  `json:"since"`
+	Ops   []opReport `json:"ops"`
+}
+
+// bucketBound returns the upper bound of bucket i as reported
+func bucketBound(i int) string {
+	if i >= len(profileBounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(profileBounds[i].Seconds(), 'f', -1, 64)
+}
+
+// profileReport returns the calls of each profiled operation counted
+// since the remote was created or the counts were last reset, and
+// resets them if reset is set
+func (f *Fs) profileReport(reset bool) *profileReport {
+	f.profileMu.Lock()
+	defer f.profileMu.Unlock()
+	r := &profileReport{Since: f.profileSince, Ops: make([]opReport, 0, numProfileOps)}
+	for op := range f.profiles {
+		p := &f.profiles[op]
+		o := opReport{
+			Op:         profileOpNames[op],
+			Calls:      p.calls.Load(),
+			Errors:     p.errors.Load(),
+			Seconds:    time.Duration(p.total.Load()).Seconds(),
+			MaxSeconds: time.Duration(p.max.Load()).Seconds(),
+			Buckets:    make([]profileBucket, len(p.buckets)),
+		}
+		if o.Calls > 0 {
+			o.MeanSeconds = o.Seconds / float64(o.Calls)
+		}
+		for i := range p.buckets {
+			o.Buckets[i] = profileBucket{LE: bucketBound(i), Calls: p.buckets[i].Load()}
+		}
+		r.Ops = append(r.Ops, o)
+	}
+	if reset {
+		f.profiles.reset()
+		f.profileSince = time.Now()
+	}
+	return r
+}
+
+// csvTable returns the report as one CSV table with a row per
+// operation and a column per latency bucket
+func (r *profileReport) csvTable() [][]string {
+	f64 := func(x float64) string { return strconv.FormatFloat(x, 'f', -1, 64) }
+	i64 := func(i int64) string { return strconv.FormatInt(i, 10) }
+	header := []string{"op", "calls", "errors", "seconds", "mean_seconds", "max_seconds"}
+	for i := range numProfileBuckets {
+		header = append(header, "le_"+bucketBound(i))
+	}
+	rows := [][]string{header}
+	for _, o := range r.Ops {
+		row := []string{o.Op, i64(o.Calls), i64(o.Errors), f64(o.Seconds), f64(o.MeanSeconds), f64(o.MaxSeconds)}
+		for _, b := range o.Buckets {
+			row = append(row, i64(b.Calls))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// timeSeries returns the report as a point for each operation, tagged
+// with the operation, and one for each of its latency buckets, tagged
+// with the operation and the bound of the bucket
+func (r *profileReport) timeSeries() *timeSeries {
+	ts := &timeSeries{measurement: "spectra_profile", time: time.Now()}
+	for _, o := range r.Ops {
+		ts.points = append(ts.points, seriesPoint{
+			tags: []seriesTag{{"op", o.Op}},
+			fields: []seriesField{
+				{"calls", "Calls made of the operation.", float64(o.Calls)},
+				{"errors", "Calls of the operation which failed.", float64(o.Errors)},
+				{"seconds", "Time taken by the calls in total.", o.Seconds},
+				{"max_seconds", "Longest call of the operation.", o.MaxSeconds},
+			},
+		})
+		for _, b := range o.Buckets {
+			ts.points = append(ts.points, seriesPoint{
+				tags: []seriesTag{{"op", o.Op}, {"le", b.LE}},
+				fields: []seriesField{
+					{"bucket_calls", "Calls of the operation in the latency bucket.", float64(b.Calls)},
+				},
+			})
+		}
+	}
+	return ts
+}
@@ -0,0 +1,123 @@
+// Delete protection and read only remotes for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// parseProtect returns the paths in the protect option cleaned and
+// made absolute from the root of the world
+func parseProtect(paths fs.CommaSepList) []string {
+	var out []string
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		out = append(out, path.Clean("/"+p))
+	}
+	return out
+}
+
+// within returns whether spectraPath is dir or below it
+func within(spectraPath, dir string) bool {
+	return dir == "/" || spectraPath == dir || strings.HasPrefix(spectraPath, dir+"/")
+}
+
+// checkDelete returns a permission denied error if deleting the node at
+// spectraPath is forbidden by the protect option, or because the node is
+// shared with a read only world.
+//
+// If tree is set the node is being deleted along with everything below
+// it, so a protected path anywhere in the tree forbids it too.
+func (f *Fs) checkDelete(ctx context.Context, spectraPath string, tree bool) error {
+	for _, protected := range f.protect {
+		if within(spectraPath, protected) || (tree && within(protected, spectraPath)) {
+			fs.Debugf(f, "Refusing to delete %q protected by %q", spectraPath, protected)
+			return fmt.Errorf("%q is protected from deletion: %w", spectraPath, fs.ErrorPermissionDenied)
+		}
+	}
+	return f.checkShared(ctx, "delete", spectraPath)
+}
+
+// readOnlyWorlds returns the worlds named by the read_only_worlds
+// option other than the world of the remote
+func (f *Fs) readOnlyWorlds() []string {
+	var worlds []string
+	for _, world := range f.opt.ReadOnlyWorlds {
+		if world = strings.TrimSpace(world); world != "" && world != f.opt.World {
+			worlds = append(worlds, world)
+		}
+	}
+	return worlds
+}
+
+// checkShared returns a permission denied error if the node at
+// spectraPath exists in a world named by read_only_worlds as well as in
+// this one, so op would change that world too.
+//
+// A node only exists in the worlds its parent does, so if a directory
+// isn't shared with a read only world nothing below it is either.
+func (f *Fs) checkShared(ctx context.Context, op, spectraPath string) error {
+	worlds := f.readOnlyWorlds()
+	if len(worlds) == 0 {
+		return nil
+	}
+	node, err := f.getNode(ctx, f.nodePath(spectraPath))
+	if err != nil || node == nil {
+		return err
+	}
+	for _, world := range worlds {
+		if node.ExistenceMap[world] {
+			fs.Debugf(f, "Refusing to %s %q shared with read only world %q", op, spectraPath, world)
+			return fmt.Errorf("can't %s %q as it is shared with read only world %q: %w", op, spectraPath, world, fs.ErrorPermissionDenied)
+		}
+	}
+	return nil
+}
+
+// checkWrite returns a permission denied error if the remote is read
+// only, as set by the read_only option, so op can't change remote.
+//
+// op is the operation refused, such as "upload", and remote the path
+// it would change, if any.
+func (f *Fs) checkWrite(op, remote string) error {
+	if !f.opt.ReadOnly {
+		return nil
+	}
+	fs.Debugf(f, "Refusing to %s %q as the remote is read only", op, remote)
+	if remote == "" {
+		return fmt.Errorf("can't %s as the remote is read only: %w", op, fs.ErrorPermissionDenied)
+	}
+	return fmt.Errorf("can't %s %q as the remote is read only: %w", op, remote, fs.ErrorPermissionDenied)
+}
+
+// isolate takes the node with id, just made in this world, out of the
+// worlds named by read_only_worlds and puts it in this one.
+//
+// The SDK puts the nodes it makes in the primary world whichever world
+// they are made in, and in the others by their probabilities, so
+// without this a file uploaded to a writable world would appear in a
+// read only one.
+func (f *Fs) isolate(ctx context.Context, id string) error {
+	worlds := f.readOnlyWorlds()
+	if len(worlds) == 0 {
+		return nil
+	}
+	query := `UPDATE nodes SET existence_map = json_set(existence_map, ?, json('true')`
+	args := []any{worldKey(f.opt.World)}
+	for _, world := range worlds {
+		query += `, ?, json('false')`
+		args = append(args, worldKey(world))
+	}
+	_, err := f.db.ExecContext(ctx, query+`) WHERE id = ?`, append(args, id)...)
+	if err != nil {
+		return fmt.Errorf("failed to take %q out of read only worlds: %w", id, err)
+	}
+	return nil
+}
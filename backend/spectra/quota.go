@@ -0,0 +1,80 @@
+// Storage quotas for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// quotaError is returned by writes which would take the world over
+// its quota_bytes or quota_objects
+type quotaError struct {
+	remote string // remote path of the file written
+	limit  string // "bytes" or "objects"
+	quota  int64  // the quota which would be exceeded
+	used   int64  // usage before the write
+	bytes  bool   // whether quota and used are sizes in bytes
+}
+
+// Error returns the error message
+func (e *quotaError) Error() string {
+	format := func(x int64) string {
+		if e.bytes {
+			return fs.SizeSuffix(x).String()
+		}
+		return fmt.Sprint(x)
+	}
+	return fmt.Sprintf("spectra: 507 insufficient storage: writing %q would exceed the %s quota of %s (%s used)",
+		e.remote, e.limit, format(e.quota), format(e.used))
+}
+
+// NoRetry returns true as retrying won't help until space is freed
+func (e *quotaError) NoRetry() bool {
+	return true
+}
+
+// hasQuota returns whether a quota is set
+func (f *Fs) hasQuota() bool {
+	return f.opt.QuotaObjects > 0 || f.opt.QuotaBytes > 0
+}
+
+// checkQuota returns a quotaError if writing remote, adding objects
+// files and bytes bytes to the world, would take it over its quota.
+//
+// Usage is that of the whole world, the files generated or uploaded in
+// it so far, as the soft limits count it. Writes which shrink the world
+// always succeed.
+func (f *Fs) checkQuota(ctx context.Context, remote string, objects, bytes int64) error {
+	if !f.hasQuota() || (objects <= 0 && bytes <= 0) {
+		return nil
+	}
+	r, err := f.storedRollup(ctx, "/")
+	if err != nil {
+		return err
+	}
+	if quota := f.opt.QuotaObjects; quota > 0 && objects > 0 && r.Files+objects > quota {
+		return &quotaError{remote: remote, limit: "objects", quota: quota, used: r.Files}
+	}
+	if quota := int64(f.opt.QuotaBytes); quota > 0 && bytes > 0 && r.Bytes+bytes > quota {
+		return &quotaError{remote: remote, limit: "bytes", quota: quota, used: r.Bytes, bytes: true}
+	}
+	return nil
+}
+
+// quotaUsage adds the total and free space of the world to usage if
+// quota_bytes is set
+func (f *Fs) quotaUsage(ctx context.Context, usage *fs.Usage) error {
+	quota := int64(f.opt.QuotaBytes)
+	if quota <= 0 {
+		return nil
+	}
+	r, err := f.storedRollup(ctx, "/")
+	if err != nil {
+		return err
+	}
+	usage.Total = fs.NewUsageValue(quota)
+	usage.Free = fs.NewUsageValue(max(quota-r.Bytes, 0))
+	return nil
+}
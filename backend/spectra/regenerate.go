@@ -0,0 +1,111 @@
+// Regeneration and reseeding for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// regenerate generates everything below the directory dir of the
+// remote which hasn't been generated yet, down to maxDepth levels below
+// it unless maxDepth is negative, and returns how much of it has been
+// generated.
+//
+// Directories generation_filter excludes are left ungenerated, as they
+// are by eager generation.
+func (f *Fs) regenerate(ctx context.Context, dir string, maxDepth int) (*generationProgress, error) {
+	spectraPath := f.toSpectraPath(dir)
+	node, err := f.getNode(ctx, spectraPath)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("%q: %w", dir, fs.ErrorDirNotFound)
+	}
+	if maxDepth >= 0 {
+		maxDepth += pathDepth(spectraPath)
+	}
+	start := time.Now()
+	if err := f.generateBelow(ctx, spectraPath, maxDepth, f.generationFilter(ctx)); err != nil {
+		return nil, fmt.Errorf("failed to generate %q: %w", dir, err)
+	}
+	p, err := f.progress(ctx, spectraPath)
+	if err != nil {
+		return nil, err
+	}
+	fs.Infof(f, "Generated %q: %d directories, %d files in %v", dir, p.Dirs, p.Files, time.Since(start).Round(time.Millisecond))
+	f.checkSoftLimits(ctx, false)
+	return p, nil
+}
+
+// reseed rebuilds the world from seed in place of the seed from the
+// Spectra configuration file.
+//
+// Every node is deleted, along with the content uploaded to them, and
+// the root is recreated, so the world is generated afresh from the new
+// seed as it is listed. The files hide_count, extra_count and
+// move_rate pick are picked again and eager generation is redone.
+// This applies to every world in the database, as they share their
+// nodes.
+func (f *Fs) reseed(ctx context.Context, seed int64) error {
+	cfg := f.engine.GetConfig()
+	old := cfg.Seed.Seed
+	cfg.Seed.Seed = seed
+	if err := f.engine.Reset(ctx); err != nil {
+		cfg.Seed.Seed = old
+		return fmt.Errorf("failed to reseed: %w", err)
+	}
+	fs.Infof(f, "Reseeded world from %d to %d", old, seed)
+	if f.db != nil {
+		if _, err := f.db.ExecContext(ctx, `DELETE FROM spectra_file_blobs`); err != nil {
+			return fmt.Errorf("failed to reseed: %w", err)
+		}
+	}
+
+	// Forget what was known about the old tree
+	f.rollupMu.Lock()
+	clear(f.rolledUp)
+	f.rollupMu.Unlock()
+	f.listedMu.Lock()
+	clear(f.listed)
+	f.listedMu.Unlock()
+	f.warmMu.Lock()
+	clear(f.warm)
+	f.warmMu.Unlock()
+	f.churnMu.Lock()
+	f.churn = churn{start: f.clock.Now()}
+	f.isolation = isolation{}
+	f.churnMu.Unlock()
+	f.movedMu.Lock()
+	f.moved, f.movedFrom, f.movedInto = nil, nil, nil
+	f.movedMu.Unlock()
+	f.extraMu.Lock()
+	f.extra, f.extraIn = nil, nil
+	f.extraMu.Unlock()
+	f.hidden = nil
+
+	if f.opt.Eager && !f.planning(ctx) {
+		if err := f.generateAll(ctx); err != nil {
+			return err
+		}
+	}
+	if f.opt.HideCount > 0 {
+		if err := f.pickHidden(ctx); err != nil {
+			return err
+		}
+	}
+	if f.opt.ExtraCount > 0 {
+		if err := f.pickExtra(ctx); err != nil {
+			return err
+		}
+	}
+	if f.opt.MoveRate > 0 {
+		if err := f.pickMoved(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+// Remote engine for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/fshttp"
+	"github.com/rclone/rclone/lib/pacer"
+	"github.com/rclone/rclone/lib/rest"
+)
+
+// Pacing of the calls to the API server
+const (
+	remoteMinSleep      = 10 * time.Millisecond
+	remoteMaxSleep      = 2 * time.Second
+	remoteDecayConstant = 2 // bigger for slower decay, exponential
+)
+
+// remoteRetryErrorCodes are the HTTP status codes of the calls to the
+// API server which are retried.
+//
+// The server reports every failure of the SDK as 500 Internal Server
+// Error, a missing or existing node as much as a fault, so it isn't
+// retried. A busy database is retried by retryBusy instead.
+var remoteRetryErrorCodes = []int{
+	408, // Request Timeout
+	429, // Rate exceeded
+	502, // Bad Gateway
+	503, // Service Unavailable
+	504, // Gateway Time-out
+}
+
+// remoteEngine is an engine making its calls to a running Spectra API
+// server over HTTP, so several rclone processes can share one world
+// without opening its database themselves.
+//
+// The world is generated and stored by the server, and the generation
+// parameters are read from it.
+type remoteEngine struct {
+	srv    *rest.Client
+	client *http.Client
+	pacer  *fs.Pacer
+	cfg    *sdk.Config
+}
+
+// apiResponse is the envelope of the API server's responses
+type apiResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// apiFileData is the data of a file returned by the API server
+type apiFileData struct {
+	Data     []byte `json:"data"`
+	Checksum string `json:"checksum"`
+}
+
+// apiURL returns the URL of the API server: apiURL if set, otherwise
+// the host and port in the api section of the configuration file
+func apiURL(opt *Options) (string, error) {
+	if opt.APIURL != "" {
+		return opt.APIURL, nil
+	}
+	cfg, err := loadMemConfig(opt.ConfigPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to find Spectra API server: %w", err)
+	}
+	if cfg.API.Host == "" || cfg.API.Port == 0 {
+		return "", errors.New("failed to find Spectra API server: set api_url or the api host and port in the Spectra configuration")
+	}
+	return "http://" + cfg.API.Host + ":" + strconv.Itoa(cfg.API.Port), nil
+}
+
+// newRemoteEngine connects to the API server for opt and reads the
+// generation parameters from it
+func newRemoteEngine(ctx context.Context, opt *Options) (*remoteEngine, error) {
+	root, err := apiURL(opt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := url.Parse(root); err != nil {
+		return nil, fmt.Errorf("bad api_url %q: %w", root, err)
+	}
+	client := fshttp.NewClient(ctx)
+	e := &remoteEngine{
+		srv:    rest.NewClient(client).SetRoot(root + "/api/v1").SetErrorHandler(apiErrorHandler),
+		client: client,
+		pacer:  fs.NewPacer(ctx, pacer.NewDefault(pacer.MinSleep(remoteMinSleep), pacer.MaxSleep(remoteMaxSleep), pacer.DecayConstant(remoteDecayConstant))),
+	}
+	var cfg sdk.Config
+	if err := e.call(ctx, "GET", "/config", nil, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to initialize remote engine: %w", err)
+	}
+	e.cfg = &cfg
+	return e, nil
+}
+
+// apiErrorHandler returns the error reported by a failed call, with
+// the message the server gave so typedError can tell its kind
+func apiErrorHandler(resp *http.Response) error {
+	var r apiResponse
+	if err := rest.DecodeJSON(resp, &r); err != nil || r.Message == "" {
+		return fmt.Errorf("spectra API server: HTTP error %d (%s)", resp.StatusCode, resp.Status)
+	}
+	return errors.New(r.Message)
+}
+
+// shouldRetry returns a boolean as to whether this resp and err
+// deserve to be retried.  It returns the err as a convenience
+func shouldRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if fserrors.ContextError(ctx, &err) {
+		return false, err
+	}
+	return fserrors.ShouldRetry(err) || fserrors.ShouldRetryHTTP(resp, remoteRetryErrorCodes), err
+}
+
+// callJSON makes a call to the API server with the pacer, retrying
+// transient failures
+func (e *remoteEngine) callJSON(ctx context.Context, opts *rest.Opts, request, response any) error {
+	return e.pacer.Call(func() (bool, error) {
+		resp, err := e.srv.CallJSON(ctx, opts, request, response)
+		return shouldRetry(ctx, resp, err)
+	})
+}
+
+// call makes a call to the API server sending request as JSON, if it
+// isn't nil, and decoding the data of the response into response, if
+// it isn't nil
+func (e *remoteEngine) call(ctx context.Context, method, pth string, request, response any) error {
+	var r apiResponse
+	opts := rest.Opts{Method: method, Path: pth}
+	if err := e.callJSON(ctx, &opts, request, &r); err != nil {
+		return err
+	}
+	if !r.Success {
+		return errors.New(r.Message)
+	}
+	if response == nil || len(r.Data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(r.Data, response); err != nil {
+		return fmt.Errorf("failed to decode response from Spectra API server: %w", err)
+	}
+	return nil
+}
+
+// list lists the children of a folder on the server, generating them
+// if the folder has none
+func (e *remoteEngine) list(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	// The listing isn't wrapped in the response envelope
+	var result sdk.ListResult
+	opts := rest.Opts{Method: "POST", Path: "/items/list"}
+	if err := e.callJSON(ctx, &opts, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ListChildren lists the children of a folder in a world, generating
+// them if the folder has none. The folder holding the namespaces is
+// left out of the root.
+func (e *remoteEngine) ListChildren(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	result, err := e.list(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if req.ParentPath == "/" {
+		result.Folders = slices.DeleteFunc(result.Folders, func(folder sdk.Folder) bool { return folder.Name == namespacesDir })
+	}
+	return result, nil
+}
+
+// nodeIn returns the node called name in a listing, or nil if there is
+// none
+func nodeIn(result *sdk.ListResult, name string) *sdk.Node {
+	for i := range result.Folders {
+		if result.Folders[i].Name == name {
+			return &result.Folders[i].Node
+		}
+	}
+	for i := range result.Files {
+		if result.Files[i].Name == name {
+			return &result.Files[i].Node
+		}
+	}
+	return nil
+}
+
+// GetNode returns the node with an ID or at a path in a world.
+//
+// The server only looks nodes up by ID, so nodes are looked up by path
+// in the listing of their parent, which takes as long as the parent
+// has children.
+func (e *remoteEngine) GetNode(ctx context.Context, req *sdk.GetNodeRequest) (*sdk.Node, error) {
+	id := req.ID
+	if id == "" && req.Path == "/" {
+		id = "root"
+	}
+	if id != "" {
+		var node sdk.Node
+		if err := e.call(ctx, "GET", "/node/"+url.PathEscape(id), nil, &node); err != nil {
+			return nil, err
+		}
+		return &node, nil
+	}
+	if req.Path == "" {
+		return nil, errors.New("either id or path must be specified")
+	}
+	result, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: path.Dir(req.Path), TableName: req.TableName})
+	if err != nil {
+		return nil, err
+	}
+	if err := resultError(result); err != nil {
+		return nil, err
+	}
+	if node := nodeIn(result, path.Base(req.Path)); node != nil {
+		return node, nil
+	}
+	return nil, newEngineError(iofs.ErrNotExist, "node not found")
+}
+
+// GetFileData returns the data block and checksum of a file
+func (e *remoteEngine) GetFileData(ctx context.Context, id string) ([]byte, string, error) {
+	var data apiFileData
+	if err := e.call(ctx, "GET", "/items/"+url.PathEscape(id)+"/data", nil, &data); err != nil {
+		return nil, "", err
+	}
+	return data.Data, data.Checksum, nil
+}
+
+// CreateFolder creates a folder in a parent folder
+func (e *remoteEngine) CreateFolder(ctx context.Context, req *sdk.CreateFolderRequest) (*sdk.Node, error) {
+	var node sdk.Node
+	if err := e.call(ctx, "POST", "/items/folder", req, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// UploadFile creates a file in a parent folder
+func (e *remoteEngine) UploadFile(ctx context.Context, req *sdk.UploadFileRequest) (*sdk.Node, error) {
+	var node sdk.Node
+	if err := e.call(ctx, "POST", "/items/file", req, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// DeleteNode deletes the node with an ID or at a path in a world
+func (e *remoteEngine) DeleteNode(ctx context.Context, req *sdk.DeleteNodeRequest) error {
+	id := req.ID
+	if id == "" {
+		node, err := e.GetNode(ctx, &sdk.GetNodeRequest{Path: req.Path, TableName: req.TableName})
+		if err != nil {
+			return err
+		}
+		id = node.ID
+	}
+	return e.call(ctx, "DELETE", "/node/"+url.PathEscape(id), nil, nil)
+}
+
+// Reset deletes every node and recreates the root on the server
+func (e *remoteEngine) Reset(ctx context.Context) error {
+	return e.call(ctx, "POST", "/reset", nil, nil)
+}
+
+// GetConfig returns the generation parameters of the server
+func (e *remoteEngine) GetConfig() *sdk.Config {
+	return e.cfg
+}
+
+// Close closes the idle connections to the server
+func (e *remoteEngine) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
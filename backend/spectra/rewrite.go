@@ -0,0 +1,169 @@
+// Simulated concurrent writers for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// rewriteSuffix is appended to a file by the simulated writer, so its
+// size and checksum change
+const rewriteSuffix = "\nrewritten by a simulated concurrent writer\n"
+
+// startRewriter starts the simulated writer rewriting the files picked
+// by rewrite_rate as they are opened
+func (f *Fs) startRewriter() {
+	f.rewriting = make(map[string]bool)
+	f.rewritten = make(map[string]bool)
+	f.rewriteCtx, f.rewriteCancel = context.WithCancel(context.Background())
+}
+
+// stopRewriter stops the simulated writer, dropping the rewrites it
+// hasn't started and waiting for those in progress
+func (f *Fs) stopRewriter() {
+	if f.rewriteCancel == nil {
+		return
+	}
+	f.rewriteCancel()
+	f.rewriteWG.Wait()
+}
+
+// rewritable returns whether the file at spectraPath is rewritten by
+// the simulated writer, as chosen by rewrite_rate from sim_seed and the
+// path.
+//
+// Giant objects aren't rewritten as their content can't be stored.
+func (f *Fs) rewritable(spectraPath string) bool {
+	if f.opt.RewriteRate <= 0 {
+		return false
+	}
+	return pathFraction(f.simSeed(), "rewrite", spectraPath) < f.opt.RewriteRate && !f.isGiant(spectraPath)
+}
+
+// isRewritten returns whether the simulated writer has rewritten the
+// file at spectraPath
+func (f *Fs) isRewritten(spectraPath string) bool {
+	if f.opt.RewriteRate <= 0 {
+		return false
+	}
+	f.rewriteMu.Lock()
+	defer f.rewriteMu.Unlock()
+	return f.rewritten[spectraPath]
+}
+
+// opened schedules the rewrite of the file o, which has just been
+// opened, rewrite_delay from now if it is rewritable and hasn't been
+// already
+func (f *Fs) opened(o *Object) {
+	spectraPath := o.spectraPath()
+	if !f.rewritable(spectraPath) {
+		return
+	}
+	if _, ok := f.extraNode(f.toSpectraPath(o.remote)); ok {
+		// Rewriting it would rewrite the file it copies
+		return
+	}
+	f.rewriteMu.Lock()
+	defer f.rewriteMu.Unlock()
+	if f.rewriting[spectraPath] {
+		return
+	}
+	f.rewriting[spectraPath] = true
+	target := &Object{fs: f, remote: o.remote, id: o.ID(), size: o.size}
+	f.rewriteWG.Add(1)
+	go func() {
+		defer f.rewriteWG.Done()
+		select {
+		case <-f.clock.After(time.Duration(f.opt.RewriteDelay)):
+		case <-f.rewriteCtx.Done():
+			return
+		}
+		if err := f.rewrite(f.rewriteCtx, target); err != nil {
+			fs.Errorf(target, "Simulated writer failed to rewrite: %v", err)
+			return
+		}
+		fs.Debugf(target, "Simulated writer rewrote")
+	}()
+}
+
+// rewrite appends rewriteSuffix to the file o in place
+func (f *Fs) rewrite(ctx context.Context, o *Object) error {
+	block, stored, err := o.dataBlock(ctx)
+	if err != nil {
+		return err
+	}
+	size := int64(len(block))
+	if !stored {
+		size = f.fileSize(o.spectraPath(), size)
+	}
+	data, err := io.ReadAll(o.contentReader(block, stored, 0, size))
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	data = append(data, rewriteSuffix...)
+	spectraPath := o.spectraPath()
+	defer f.nodeCache.change()()
+	if _, _, _, err := f.replaceContent(ctx, spectraPath, o.ID(), data); err != nil {
+		return err
+	}
+	f.rewriteMu.Lock()
+	f.rewritten[spectraPath] = true
+	f.rewriteMu.Unlock()
+	return nil
+}
+
+// rewriteReader reads an object which the simulated writer may rewrite
+// while it is read, carrying on with the new content from the same
+// offset once it has
+type rewriteReader struct {
+	ctx     context.Context
+	o       *Object
+	in      io.Reader
+	off     int64 // offset of the next byte read
+	end     int64 // offset to read up to, or -1 for the end of the file
+	changed bool  // whether the reader has switched to the new content
+}
+
+// newRewriteReader returns a reader for o reading in from off up to
+// end, or to the end of the file if end is -1
+func newRewriteReader(ctx context.Context, o *Object, in io.Reader, off, end int64) *rewriteReader {
+	return &rewriteReader{ctx: ctx, o: o, in: in, off: off, end: end}
+}
+
+// Read implements io.Reader
+func (r *rewriteReader) Read(p []byte) (n int, err error) {
+	if !r.changed && r.o.fs.isRewritten(r.o.spectraPath()) {
+		r.changed = true
+		in, err := r.o.reopen(r.ctx, r.off, r.end)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read rewritten file: %w", err)
+		}
+		fs.Debugf(r.o, "Rewritten while being read at offset %d", r.off)
+		r.in = in
+	}
+	n, err = r.in.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+// reopen returns a reader for the current content of o from off up to
+// end, or to the end of the file if end is -1
+func (o *Object) reopen(ctx context.Context, off, end int64) (io.Reader, error) {
+	block, stored, err := o.dataBlock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(block))
+	if !stored {
+		size = o.fs.fileSize(o.spectraPath(), size)
+	}
+	if end < 0 || end > size {
+		end = size
+	}
+	off = min(off, end)
+	return o.fs.newEgressReader(o.contentReader(block, stored, off, end)), nil
+}
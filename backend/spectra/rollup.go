@@ -0,0 +1,279 @@
+// Directory size rollups for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// rollup is the number of directories and files below a directory and
+// the total size of the files, in one world
+type rollup struct {
+	Dirs  int64 `json:"dirs"`
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// sqlParent returns an SQL expression for the parent directory of the
+// Spectra path in the column or expression p.
+//
+// The inner rtrim strips every character of the last path element as
+// the set of characters to strip is every character of p but "/".
+func sqlParent(p string) string {
+	parent := fmt.Sprintf(`rtrim(rtrim(%s, replace(%s, '/', '')), '/')`, p, p)
+	return fmt.Sprintf(`CASE WHEN %s = '' THEN '/' ELSE %s END`, parent, parent)
+}
+
+// rollupDelta returns the SQL adding the node in row (NEW or OLD) to
+// the rollups of every directory above it in the worlds it exists in,
+// or taking it away if sign is "-".
+func rollupDelta(row, sign string) string {
+	fileType := `'` + sdk.NodeTypeFile + `'`
+	folderType := `'` + sdk.NodeTypeFolder + `'`
+	// The AND true stops SQLite reading ON CONFLICT as part of the join
+	return strings.NewReplacer("$row", row, "$sign", sign, "$file", fileType, "$folder", folderType).Replace(`
+INSERT INTO spectra_rollups (world, path, dirs, files, bytes)
+WITH RECURSIVE above(p) AS (
+	SELECT $row.parent_path
+	UNION ALL SELECT ` + sqlParent("p") + ` FROM above WHERE p <> '/'
+)
+SELECT w.key, above.p,
+	$sign($row.type = $folder),
+	$sign($row.type = $file),
+	$sign(CASE WHEN $row.type = $file THEN $row.size ELSE 0 END)
+FROM above, json_each($row.existence_map) w WHERE w.value = 1 AND true
+ON CONFLICT (world, path) DO UPDATE SET
+	dirs = dirs + excluded.dirs,
+	files = files + excluded.files,
+	bytes = bytes + excluded.bytes;`)
+}
+
+// initRollups creates the table of directory rollups along with the
+// triggers keeping it up to date as nodes are written, then rebuilds
+// it from the nodes already in the database if the triggers weren't
+// there.
+//
+// The triggers go when the SDK recreates the nodes table, so this must
+// run every time the backend is created, after the SDK has started.
+// While they are there the rollups are up to date, so the remotes
+// sharing the SDK's database after the first don't rebuild them.
+func (f *Fs) initRollups(ctx context.Context) (err error) {
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create rollups: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var triggers int
+	err = tx.QueryRowContext(ctx, `
+SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = 'nodes'
+AND name IN ('spectra_rollups_insert', 'spectra_rollups_delete', 'spectra_rollups_update')`).Scan(&triggers)
+	if err != nil {
+		return fmt.Errorf("failed to create rollups: %w", err)
+	}
+	if triggers == 3 {
+		return tx.Commit()
+	}
+	_, err = tx.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_rollups (
+	world TEXT NOT NULL,
+	path  TEXT NOT NULL,
+	dirs  INTEGER NOT NULL DEFAULT 0,
+	files INTEGER NOT NULL DEFAULT 0,
+	bytes INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (world, path)
+);
+CREATE TRIGGER IF NOT EXISTS spectra_rollups_insert AFTER INSERT ON nodes
+WHEN NEW.path <> '/' BEGIN`+rollupDelta("NEW", "")+`
+END;
+CREATE TRIGGER IF NOT EXISTS spectra_rollups_delete AFTER DELETE ON nodes
+WHEN OLD.path <> '/' BEGIN`+rollupDelta("OLD", "-")+`
+END;
+CREATE TRIGGER IF NOT EXISTS spectra_rollups_update AFTER UPDATE OF type, size, parent_path, existence_map ON nodes
+WHEN NEW.path <> '/' AND (OLD.type IS NOT NEW.type OR OLD.size IS NOT NEW.size
+	OR OLD.parent_path IS NOT NEW.parent_path OR OLD.existence_map IS NOT NEW.existence_map) BEGIN`+
+		rollupDelta("OLD", "-")+rollupDelta("NEW", "")+`
+END;
+DELETE FROM spectra_rollups;
+INSERT INTO spectra_rollups (world, path, dirs, files, bytes)
+WITH RECURSIVE above(world, p, type, size) AS (
+	SELECT w.key, n.parent_path, n.type, n.size
+	FROM nodes n, json_each(n.existence_map) w WHERE w.value = 1 AND n.path <> '/'
+	UNION ALL SELECT world, `+sqlParent("p")+`, type, size FROM above WHERE p <> '/'
+)
+SELECT world, p,
+	sum(type = ?),
+	sum(type = ?),
+	sum(CASE WHEN type = ? THEN size ELSE 0 END)
+FROM above GROUP BY world, p`, sdk.NodeTypeFolder, sdk.NodeTypeFile, sdk.NodeTypeFile)
+	if err != nil {
+		return fmt.Errorf("failed to create rollups: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create rollups: %w", err)
+	}
+	return nil
+}
+
+// rollup returns the rollup of the directory at spectraPath in this
+// remote's world.
+//
+// The rollups only count nodes which have been generated, so with lazy
+// generation the rest of the directory's tree is generated the first
+// time it is asked for. After that the rollups are kept up to date by
+// the database as nodes are written, so this is a single lookup.
+func (f *Fs) rollup(ctx context.Context, spectraPath string) (r rollup, err error) {
+	if f.db == nil {
+		return r, errors.New("directory rollups need an on disk database")
+	}
+	f.rollupMu.Lock()
+	generated := f.rolledUp[spectraPath]
+	f.rollupMu.Unlock()
+	if !generated {
+		if err := f.generateBelow(ctx, spectraPath, -1, nil); err != nil {
+			return r, err
+		}
+		f.rollupMu.Lock()
+		f.rolledUp[spectraPath] = true
+		f.rollupMu.Unlock()
+	}
+	return f.storedRollup(ctx, spectraPath)
+}
+
+// storedRollup returns the rollup of the directory at spectraPath in
+// this remote's world of the nodes generated so far, without
+// generating any more.
+func (f *Fs) storedRollup(ctx context.Context, spectraPath string) (r rollup, err error) {
+	err = f.db.QueryRowContext(ctx, `SELECT dirs, files, bytes FROM spectra_rollups WHERE world = ? AND path = ?`,
+		f.opt.World, spectraPath).Scan(&r.Dirs, &r.Files, &r.Bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Nothing has been written below the directory
+		return rollup{}, nil
+	} else if err != nil {
+		return r, fmt.Errorf("failed to read rollup: %w", err)
+	}
+	return r, nil
+}
+
+// rootRollup returns the rollup of the root of the remote, generating
+// the rest of its tree first if generate is set
+func (f *Fs) rootRollup(ctx context.Context, generate bool) (rollup, error) {
+	spectraPath := f.toSpectraPath("")
+	node, err := f.getNode(ctx, spectraPath)
+	if err != nil {
+		return rollup{}, err
+	}
+	if node == nil || node.Type != sdk.NodeTypeFolder {
+		return rollup{}, fmt.Errorf("%q not found: %w", f.root, fs.ErrorDirNotFound)
+	}
+	if !generate {
+		return f.storedRollup(ctx, spectraPath)
+	}
+	return f.rollup(ctx, spectraPath)
+}
+
+// About gets quota information from the rollup of the root, with the
+// space left below quota_bytes in the world as free.
+//
+// Only the nodes generated so far are counted, as generating the whole
+// tree for a df would take as long as listing it.
+func (f *Fs) About(ctx context.Context) (*fs.Usage, error) {
+	r, err := f.rootRollup(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	usage := &fs.Usage{
+		Used:    fs.NewUsageValue(r.Bytes),
+		Objects: fs.NewUsageValue(r.Files),
+	}
+	if err := f.quotaUsage(ctx, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// rollupStats returns the totals for ls-stats from the rollup of the
+// root, counting the root as a directory as walking it does
+func (f *Fs) rollupStats(ctx context.Context) (*lsStats, error) {
+	r, err := f.rootRollup(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	return &lsStats{Dirs: r.Dirs + 1, Files: r.Files, Bytes: r.Bytes}, nil
+}
+
+// generationProgress is how much of the tree below the root of the
+// remote has been generated, as reported by the progress command
+type generationProgress struct {
+	Dirs        int64 `json:"dirs"`        // directories generated so far
+	Files       int64 `json:"files"`       // files generated or uploaded so far
+	Bytes       int64 `json:"bytes"`       // total size of those files
+	Ungenerated int   `json:"ungenerated"` // directories whose children haven't been generated
+	Complete    bool  `json:"complete"`    // whether nothing is left to generate
+}
+
+// progress returns how much of the tree below the directory at
+// spectraPath has been generated, without generating any more of it
+func (f *Fs) progress(ctx context.Context, spectraPath string) (*generationProgress, error) {
+	r, err := f.storedRollup(ctx, spectraPath)
+	if err != nil {
+		return nil, err
+	}
+	ungenerated, err := f.ungenerated(ctx, spectraPath, -1)
+	if err != nil {
+		return nil, err
+	}
+	return &generationProgress{
+		Dirs:        r.Dirs,
+		Files:       r.Files,
+		Bytes:       r.Bytes,
+		Ungenerated: len(ungenerated),
+		Complete:    len(ungenerated) == 0,
+	}, nil
+}
+
+// csvTable returns the progress as one CSV table with a single row
+func (p *generationProgress) csvTable() [][]string {
+	return [][]string{
+		{"dirs", "files", "bytes", "ungenerated", "complete"},
+		{strconv.FormatInt(p.Dirs, 10), strconv.FormatInt(p.Files, 10), strconv.FormatInt(p.Bytes, 10),
+			strconv.Itoa(p.Ungenerated), strconv.FormatBool(p.Complete)},
+	}
+}
+
+// Metadata returns the modification and creation times of the
+// directory and the metadata stored for it, along with its rollup if
+// the database can be queried
+func (d *Directory) Metadata(ctx context.Context) (fs.Metadata, error) {
+	metadata, err := d.fs.nodeMetadata(ctx, d.ID(), d.ModTime(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if d.fs.db == nil {
+		return metadata, nil
+	}
+	r, err := d.fs.rollup(ctx, d.fs.toSpectraPath(d.Remote()))
+	if err != nil {
+		return nil, err
+	}
+	metadata["rollup-dirs"] = strconv.FormatInt(r.Dirs, 10)
+	metadata["rollup-files"] = strconv.FormatInt(r.Files, 10)
+	metadata["rollup-bytes"] = strconv.FormatInt(r.Bytes, 10)
+	return metadata, nil
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Abouter    = (*Fs)(nil)
+	_ fs.Metadataer = (*Directory)(nil)
+)
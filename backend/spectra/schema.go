@@ -0,0 +1,177 @@
+// Database schema versions for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// schemaVersion is the version of the tables the backend keeps in the
+// database alongside the SDK's nodes. Bump it and add a migration to
+// migrations whenever they change in a way older databases need
+// converting for.
+const schemaVersion = 3
+
+// migrations[i] migrates the tables of the backend in the database
+// from version i to i+1 within tx.
+//
+// Version 0 is a database made before the version was recorded. Its
+// tables have the same layout as version 1, and any missing are made
+// when the remote is created.
+var migrations = []func(ctx context.Context, tx *sql.Tx) error{
+	0: func(ctx context.Context, tx *sql.Tx) error { return nil },
+	1: migrateEncryptionRow,
+	2: migrateUploadSessionSource,
+}
+
+// migrateEncryptionRow limits spectra_encryption to the single row
+// with id 1, keeping the salt of the first row if there are several.
+func migrateEncryptionRow(ctx context.Context, tx *sql.Tx) error {
+	var tables int
+	err := tx.QueryRowContext(ctx, `
+SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'spectra_encryption'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+CREATE TABLE spectra_encryption_new (
+	id        INTEGER PRIMARY KEY CHECK (id = 1),
+	salt      BLOB NOT NULL,
+	key_check BLOB NOT NULL
+);
+INSERT INTO spectra_encryption_new (id, salt, key_check)
+	SELECT 1, salt, key_check FROM spectra_encryption ORDER BY rowid LIMIT 1;
+DROP TABLE spectra_encryption;
+ALTER TABLE spectra_encryption_new RENAME TO spectra_encryption`)
+	return err
+}
+
+// migrateUploadSessionSource adds the chunk size and the fingerprint of
+// the source to spectra_upload_sessions, so a session is only resumed
+// by an upload of the same data. Sessions made before then match
+// neither, so they are never resumed. A table made with the columns
+// already is left alone.
+func migrateUploadSessionSource(ctx context.Context, tx *sql.Tx) error {
+	var columns int
+	err := tx.QueryRowContext(ctx, `
+SELECT count(*) FROM pragma_table_info('spectra_upload_sessions') WHERE name = 'chunk_size'`).Scan(&columns)
+	if err != nil || columns > 0 {
+		return err
+	}
+	var tables int
+	err = tx.QueryRowContext(ctx, `
+SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'spectra_upload_sessions'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+ALTER TABLE spectra_upload_sessions ADD COLUMN chunk_size INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE spectra_upload_sessions ADD COLUMN fingerprint TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+// checkSchema checks the database was made by versions of the Spectra
+// SDK and of the backend this one can read, migrating the tables of
+// the backend to the current version if they are older.
+//
+// A database made by a newer version of the backend, or whose nodes
+// lack columns the backend needs, is refused rather than misread.
+func (f *Fs) checkSchema(ctx context.Context) (err error) {
+	if err := f.checkNodeColumns(ctx); err != nil {
+		return err
+	}
+
+	// A database with none of the backend's tables is new
+	var tables int
+	err = f.db.QueryRowContext(ctx, `
+SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name LIKE 'spectra\_%' ESCAPE '\'`).Scan(&tables)
+	if err != nil {
+		return fmt.Errorf("failed to read database schema: %w", err)
+	}
+	_, err = f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_schema (
+	version INTEGER NOT NULL
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema table: %w", err)
+	}
+
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read database schema: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT version FROM spectra_schema`).Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if tables == 0 {
+			version = schemaVersion
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO spectra_schema (version) VALUES (?)`, version)
+		if err != nil {
+			return fmt.Errorf("failed to record database schema version: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to read database schema version: %w", err)
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database %q has schema version %d, newer than the %d this version of rclone supports: upgrade rclone to use it",
+			f.engine.GetConfig().Seed.DBPath, version, schemaVersion)
+	}
+	from := version
+	for ; version < schemaVersion; version++ {
+		if err = migrations[version](ctx, tx); err != nil {
+			return fmt.Errorf("failed to migrate database schema from version %d to %d: %w", version, version+1, err)
+		}
+	}
+	if version != from {
+		if _, err = tx.ExecContext(ctx, `UPDATE spectra_schema SET version = ?`, version); err != nil {
+			return fmt.Errorf("failed to record database schema version: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to migrate database schema: %w", err)
+	}
+	if version != from {
+		fs.Infof(f, "Migrated database schema from version %d to %d", from, version)
+	}
+	return nil
+}
+
+// checkNodeColumns checks the SDK's nodes table has every column in
+// nodeColumns, which the backend reads and writes directly
+func (f *Fs) checkNodeColumns(ctx context.Context) (err error) {
+	rows, err := f.db.QueryContext(ctx, `SELECT name FROM pragma_table_info('nodes')`)
+	if err != nil {
+		return fmt.Errorf("failed to read nodes table: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return fmt.Errorf("failed to read nodes table: %w", err)
+		}
+		have[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to read nodes table: %w", err)
+	}
+	for _, column := range strings.Split(nodeColumns, ", ") {
+		if !have[column] {
+			return fmt.Errorf("database %q has no %q column in its nodes table: it was made by a version of the Spectra SDK incompatible with %s, so regenerate it with this version of rclone",
+				f.engine.GetConfig().Seed.DBPath, column, sdkVersion())
+		}
+	}
+	return nil
+}
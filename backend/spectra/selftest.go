@@ -0,0 +1,218 @@
+// Self test for the Spectra backend
+package spectra
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/object"
+)
+
+// Results of the checks of the selftest command
+const (
+	selftestPass = "pass"
+	selftestFail = "fail"
+	selftestSkip = "skip" // not supported by the remote as configured
+)
+
+// selftestContent is the content of the file the selftest command
+// uploads
+var selftestContent = []byte("spectra selftest\n")
+
+// selftestCheck is the result of one check made by the selftest command
+type selftestCheck struct {
+	Name    string  `json:"name"`
+	Result  string  `json:"result"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// selftestReport is the result of the selftest command
+type selftestReport struct {
+	Passed  bool            `json:"passed"`
+	Scratch string          `json:"scratch,omitempty"`
+	Checks  []selftestCheck `json:"checks"`
+}
+
+// errSelftestSkip is returned by a check which doesn't apply to the
+// remote
+var errSelftestSkip = errors.New("skipped")
+
+// selftest lists the root of the remote, then writes, finds, reads,
+// hashes and moves a file in the scratch directory, which is removed
+// again afterwards, reporting whether each capability works.
+//
+// The checks go through the remote as rclone would, so the simulated
+// latency, faults and limits apply to them. A read only remote is
+// checked by finding, reading and hashing the first file in its root
+// instead of writing one.
+func (f *Fs) selftest(ctx context.Context, scratch string) *selftestReport {
+	report := &selftestReport{Passed: true, Checks: []selftestCheck{}}
+	check := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		c := selftestCheck{Name: name, Result: selftestPass, Seconds: time.Since(start).Seconds()}
+		switch {
+		case errors.Is(err, errSelftestSkip):
+			c.Result = selftestSkip
+		case err != nil:
+			c.Result, c.Error = selftestFail, err.Error()
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, c)
+		return err == nil
+	}
+
+	var (
+		entries fs.DirEntries
+		remote  string
+		content []byte
+		o       fs.Object
+	)
+	listed := check("list", func() (err error) {
+		entries, err = f.List(ctx, "")
+		return err
+	})
+	if f.opt.ReadOnly {
+		check("write", func() error { return errSelftestSkip })
+		for _, entry := range entries {
+			if x, ok := entry.(fs.Object); ok {
+				remote = x.Remote()
+				break
+			}
+		}
+		if !listed || remote == "" {
+			report.Checks = append(report.Checks, skippedChecks("stat", "read", "hash", "move")...)
+			return report
+		}
+	} else {
+		report.Scratch = scratch
+		remote = path.Join(scratch, "selftest.txt")
+		content = selftestContent
+		made := false
+		written := check("write", func() error {
+			_, err := f.List(ctx, scratch)
+			if err == nil {
+				return fmt.Errorf("scratch directory %q already exists", scratch)
+			}
+			if !errors.Is(err, fs.ErrorDirNotFound) {
+				return err
+			}
+			if err := f.Mkdir(ctx, scratch); err != nil {
+				return err
+			}
+			made = true
+			src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(content)), true, nil, f)
+			_, err = f.Put(ctx, bytes.NewReader(content), src)
+			return err
+		})
+		defer check("cleanup", func() error {
+			if !made {
+				// Never remove a directory this didn't make
+				return errSelftestSkip
+			}
+			if purge := f.Features().Purge; purge != nil {
+				return purge(ctx, scratch)
+			}
+			return errSelftestSkip
+		})
+		if !written {
+			report.Checks = append(report.Checks, skippedChecks("stat", "read", "hash", "move")...)
+			return report
+		}
+	}
+
+	if !check("stat", func() (err error) {
+		o, err = f.NewObject(ctx, remote)
+		return err
+	}) {
+		report.Checks = append(report.Checks, skippedChecks("read", "hash", "move")...)
+		return report
+	}
+	check("read", func() error {
+		in, err := o.Open(ctx)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(in)
+		if closeErr := in.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != o.Size() {
+			return fmt.Errorf("read %d bytes of %d", len(data), o.Size())
+		}
+		if content != nil && !bytes.Equal(data, content) {
+			return errors.New("read different content from that written")
+		}
+		content = data
+		return nil
+	})
+	check("hash", func() error {
+		types := f.Hashes()
+		if types.Count() == 0 || content == nil {
+			return errSelftestSkip
+		}
+		want, err := hash.StreamTypes(bytes.NewReader(content), types)
+		if err != nil {
+			return err
+		}
+		for _, ty := range types.Array() {
+			sum, err := o.Hash(ctx, ty)
+			if err != nil {
+				return fmt.Errorf("%v: %w", ty, err)
+			}
+			if sum != "" && sum != want[ty] {
+				return fmt.Errorf("%v is %s but the content read has %s", ty, sum, want[ty])
+			}
+		}
+		return nil
+	})
+	check("move", func() error {
+		move := f.Features().Move
+		if move == nil || f.opt.ReadOnly {
+			return errSelftestSkip
+		}
+		moved, err := move(ctx, o, path.Join(scratch, "moved.txt"))
+		if err != nil {
+			return err
+		}
+		if _, err := f.NewObject(ctx, moved.Remote()); err != nil {
+			return fmt.Errorf("moved file not found: %w", err)
+		}
+		if _, err := f.NewObject(ctx, remote); !errors.Is(err, fs.ErrorObjectNotFound) {
+			return fmt.Errorf("file still found after being moved: %v", err)
+		}
+		return nil
+	})
+	return report
+}
+
+// skippedChecks returns the checks named skipped, as a check they need
+// has failed
+func skippedChecks(names ...string) []selftestCheck {
+	checks := make([]selftestCheck, 0, len(names))
+	for _, name := range names {
+		checks = append(checks, selftestCheck{Name: name, Result: selftestSkip})
+	}
+	return checks
+}
+
+// csvTable returns the report as one CSV table with a row per check
+func (r *selftestReport) csvTable() [][]string {
+	rows := [][]string{{"check", "result", "seconds", "error"}}
+	for _, c := range r.Checks {
+		rows = append(rows, []string{c.Name, c.Result, strconv.FormatFloat(c.Seconds, 'f', -1, 64), c.Error})
+	}
+	return rows
+}
@@ -0,0 +1,575 @@
+// Server side copies and moves for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// sameDatabase returns whether other shows a world of the same on
+// disk database as f, so nodes can be shared between them directly
+func (f *Fs) sameDatabase(other *Fs) bool {
+	return f.db != nil && other.db != nil &&
+		other.engine.GetConfig().Seed.DBPath == f.engine.GetConfig().Seed.DBPath
+}
+
+// sameWorld returns whether other shows the same world of the same on
+// disk database as f, so nodes can be moved between them directly
+func (f *Fs) sameWorld(other *Fs) bool {
+	return f.sameDatabase(other) && other.opt.World == f.opt.World
+}
+
+// sameTree returns whether directories can be moved from other to f:
+// they show the same world of the same on disk database, or without
+// one the same world of the same engine, which renames them
+func (f *Fs) sameTree(other *Fs) bool {
+	if f.db == nil && other.db == nil {
+		return other.engine == f.engine && other.opt.World == f.opt.World
+	}
+	return f.sameWorld(other)
+}
+
+// shareNode makes the node with id exist in this world along with the
+// folders above it, so a node of another world is copied into this one
+// without copying anything. It returns false, changing nothing, if a
+// different node is at the path of any of them in this world.
+//
+// Worlds are views of the one nodes table, each node holding the
+// worlds it exists in, so this is how the Spectra SDK puts a node in
+// several worlds when it generates them.
+func (f *Fs) shareNode(ctx context.Context, id string) (shared bool, err error) {
+	const chain = `
+WITH RECURSIVE chain(id, parent_id, path) AS (
+	SELECT id, parent_id, path FROM nodes WHERE id = ?
+	UNION
+	SELECT n.id, n.parent_id, n.path FROM nodes n JOIN chain c ON n.id = c.parent_id
+)`
+	key := worldKey(f.opt.World)
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to share node with world %q: %w", f.opt.World, err)
+	}
+	defer func() {
+		if err != nil || !shared {
+			_ = tx.Rollback()
+		}
+	}()
+	var conflicts int
+	err = tx.QueryRowContext(ctx, chain+`
+SELECT count(*) FROM nodes n JOIN chain c ON n.path = c.path AND n.id <> c.id
+WHERE json_extract(n.existence_map, ?) = 1`, id, key).Scan(&conflicts)
+	if err != nil {
+		return false, fmt.Errorf("failed to share node with world %q: %w", f.opt.World, err)
+	}
+	if conflicts > 0 {
+		return false, nil
+	}
+	_, err = tx.ExecContext(ctx, chain+`
+UPDATE nodes SET existence_map = json_set(existence_map, ?, json('true'))
+WHERE id IN (SELECT id FROM chain) AND coalesce(json_extract(existence_map, ?), 0) <> 1`,
+		id, key, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to share node with world %q: %w", f.opt.World, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to share node with world %q: %w", f.opt.World, err)
+	}
+	return true, nil
+}
+
+// shareFolder shares a folder at spectraPath in another world of the
+// database with this one, rather than making a new one, and returns
+// whether there was one to share
+func (f *Fs) shareFolder(ctx context.Context, spectraPath string) (bool, error) {
+	rows, err := f.db.QueryContext(ctx, `
+SELECT id FROM nodes WHERE path = ? AND type = ? ORDER BY id`, spectraPath, sdk.NodeTypeFolder)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up %q in other worlds: %w", spectraPath, err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return false, fmt.Errorf("failed to look up %q in other worlds: %w", spectraPath, err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Close(); err != nil {
+		return false, fmt.Errorf("failed to look up %q in other worlds: %w", spectraPath, err)
+	}
+	for _, id := range ids {
+		shared, err := f.shareNode(ctx, id)
+		if shared || err != nil {
+			return shared, err
+		}
+	}
+	return false, nil
+}
+
+// sharedNodes returns the number of nodes at or below spectraPath which
+// exist in worlds other than this one.
+//
+// Nodes are shared between the worlds they exist in, so moving one of
+// these would move it in the other worlds too.
+func (f *Fs) sharedNodes(ctx context.Context, spectraPath string) (n int64, err error) {
+	prefix := spectraPath + "/"
+	err = f.db.QueryRowContext(ctx, `
+SELECT count(DISTINCT nodes.id) FROM nodes, json_each(nodes.existence_map) w
+WHERE (nodes.path = ? OR (nodes.path >= ? AND nodes.path < ?)) AND w.key <> ? AND w.value = 1`,
+		spectraPath, prefix, prefix[:len(prefix)-1]+"0", f.opt.World).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check worlds of %q: %w", spectraPath, err)
+	}
+	return n, nil
+}
+
+// moveTree renames the node at srcPath to dstPath, moving everything
+// below it along with it, in a single statement, and returns the number
+// of nodes renamed.
+//
+// The node IDs are kept so generated content, uploaded content and
+// modification times are unchanged by the move.
+func (f *Fs) moveTree(ctx context.Context, srcPath, dstPath string) (int64, error) {
+	parent, err := f.lookupNode(ctx, parentPath(dstPath))
+	if err != nil {
+		return 0, err
+	}
+	if parent == nil || parent.nodeType != sdk.NodeTypeFolder {
+		return 0, fmt.Errorf("failed to move %q: no directory to move it into", srcPath)
+	}
+	prefix := srcPath + "/"
+	result, err := f.db.ExecContext(ctx, `
+UPDATE nodes SET
+	path = ? || substr(path, ?),
+	parent_path = CASE WHEN path = ? THEN ? ELSE ? || substr(parent_path, ?) END,
+	parent_id = CASE WHEN path = ? THEN ? ELSE parent_id END,
+	name = CASE WHEN path = ? THEN ? ELSE name END,
+	depth_level = depth_level + ?
+WHERE path = ? OR (path >= ? AND path < ?)`,
+		dstPath, len(srcPath)+1,
+		srcPath, parentPath(dstPath), dstPath, len(srcPath)+1,
+		srcPath, parent.id,
+		srcPath, path.Base(dstPath),
+		pathDepth(dstPath)-pathDepth(srcPath),
+		srcPath, prefix, prefix[:len(prefix)-1]+"0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to move %q: %w", srcPath, err)
+	}
+	return result.RowsAffected()
+}
+
+// renameTree renames the directory at srcPath to dstPath along with
+// everything below it and returns the number of nodes renamed.
+//
+// With a database the nodes are renamed there in one statement,
+// otherwise the engine renames them. Either way only the nodes
+// generated so far are renamed, as the rest are generated below the
+// new path when listed, so renaming a prefix the size of the world
+// costs no more than the part of it which has been listed.
+func (f *Fs) renameTree(ctx context.Context, srcPath, dstPath string) (int64, error) {
+	if f.db != nil {
+		return f.moveTree(ctx, srcPath, dstPath)
+	}
+	n, err := retryBusy(f.opt.OpTimeout, func() (int64, error) {
+		return f.engine.(prefixRenamer).RenamePrefix(f.opt.World, srcPath, dstPath)
+	})
+	if errors.Is(err, errRenameShared) {
+		fs.Debugf(f, "Can't move directory - nodes in it exist in other worlds")
+		return 0, fs.ErrorCantDirMove
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to move %q: %w", srcPath, err)
+	}
+	return n, nil
+}
+
+// mkParentDir creates the parent directories of remote as needed,
+// including the root of this remote, which a remote such as the
+// --backup-dir of a sync may not have yet
+func (f *Fs) mkParentDir(ctx context.Context, remote string) error {
+	dir := path.Dir(remote)
+	if dir == "." {
+		dir = ""
+	}
+	if err := f.Mkdir(ctx, dir); err != nil && err != fs.ErrorDirExists {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+	return nil
+}
+
+// replaceable removes the file at dstPath, if there is one, so a file
+// can be moved or copied there
+func (f *Fs) replaceable(ctx context.Context, dstPath string) error {
+	if f.forgetExtra(dstPath) {
+		return nil
+	}
+	existing, err := f.lookupNode(ctx, dstPath)
+	if err != nil || existing == nil {
+		return err
+	}
+	if existing.nodeType == sdk.NodeTypeFolder {
+		return fs.ErrorIsDir
+	}
+	if err := f.checkDelete(ctx, dstPath, false); err != nil {
+		return err
+	}
+	if _, err := f.deleteTrees(ctx, dstPath); err != nil {
+		return err
+	}
+	f.forgetMove(dstPath)
+	return nil
+}
+
+// Move src to this remote using server-side move operations.
+//
+// The file's node is renamed in the database, so its content and
+// modification time are kept without being read or written.
+//
+// Will only be called if src.Fs().Name() == f.Name()
+//
+// If it isn't possible then return fs.ErrorCantMove
+func (f *Fs) Move(ctx context.Context, src fs.Object, remote string) (_ fs.Object, err error) {
+	srcObj, ok := src.(*Object)
+	if !ok || !f.sameWorld(srcObj.fs) {
+		fs.Debugf(src, "Can't move - not same world")
+		return nil, fs.ErrorCantMove
+	}
+	defer f.journalled(&err, journalEntry{Op: journalMove, Path: srcObj.fs.toSpectraPath(srcObj.remote), Dst: f.toSpectraPath(remote)})
+	if err := srcObj.fs.checkWrite("move", srcObj.remote); err != nil {
+		return nil, err
+	}
+	if err := f.checkWrite("move to", remote); err != nil {
+		return nil, err
+	}
+	if err := f.checkName("move to", remote); err != nil {
+		return nil, err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	defer srcObj.fs.nodeCache.change()()
+	f.touch(opWrite, remote)
+	if err := f.fault(faultWrite, remote); err != nil {
+		return nil, err
+	}
+	srcShown := srcObj.fs.toSpectraPath(srcObj.remote)
+	if err := srcObj.fs.checkDelete(ctx, srcShown, false); err != nil {
+		return nil, err
+	}
+	if _, ok := srcObj.fs.extraNode(srcShown); ok {
+		// Moving it would move the file it copies
+		fs.Debugf(src, "Can't move - extra file")
+		return nil, fs.ErrorCantMove
+	}
+	srcPath := srcObj.spectraPath()
+	if n, err := f.sharedNodes(ctx, srcPath); err != nil {
+		return nil, err
+	} else if n > 0 {
+		fs.Debugf(src, "Can't move - file exists in other worlds")
+		return nil, fs.ErrorCantMove
+	}
+	node, err := f.lookupNode(ctx, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fs.ErrorObjectNotFound
+	}
+	if f.uniqueContent() || srcObj.fs.uniqueContent() {
+		_, stored, err := srcObj.dataBlock(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !stored {
+			// Unique content is picked from the path so would change
+			fs.Debugf(src, "Can't move - generated unique content")
+			return nil, fs.ErrorCantMove
+		}
+	}
+
+	// Replace any file already at the destination
+	dstPath := f.toSpectraPath(remote)
+	if dstPath == srcPath {
+		return srcObj, nil
+	}
+	if err := f.mkParentDir(ctx, remote); err != nil {
+		return nil, err
+	}
+	if err := f.replaceable(ctx, dstPath); err != nil {
+		return nil, err
+	}
+	if _, err := f.moveTree(ctx, srcPath, dstPath); err != nil {
+		return nil, err
+	}
+	srcObj.fs.forgetMove(srcShown)
+	o, err := f.NewObject(ctx, remote)
+	if err != nil || !fs.GetConfig(ctx).Metadata || !f.keepsAttributes() {
+		return o, err
+	}
+
+	// The move keeps its metadata, adding any set with --metadata-set
+	var metadata fs.Metadata
+	metadata.MergeOptions(fs.MetadataAsOpenOptions(ctx))
+	if metadata == nil {
+		return o, nil
+	}
+	return o, o.(*Object).writeMetadata(ctx, time.Time{}, metadata, false)
+}
+
+// DirMove moves src, srcRemote to this remote at dstRemote using
+// server-side move operations.
+//
+// The directory's node and every node below it are renamed in the
+// database in one statement, however many files it holds.
+//
+// Will only be called if src.Fs().Name() == f.Name()
+//
+// If it isn't possible then return fs.ErrorCantDirMove
+//
+// If destination exists then return fs.ErrorDirExists
+func (f *Fs) DirMove(ctx context.Context, src fs.Fs, srcRemote, dstRemote string) (err error) {
+	srcFs, ok := src.(*Fs)
+	if !ok || !f.sameTree(srcFs) {
+		fs.Debugf(src, "Can't move directory - not same world")
+		return fs.ErrorCantDirMove
+	}
+	defer f.journalled(&err, journalEntry{Op: journalDirMove, Path: srcFs.toSpectraPath(srcRemote), Dst: f.toSpectraPath(dstRemote)})
+	if err := srcFs.checkWrite("move directory", srcRemote); err != nil {
+		return err
+	}
+	if err := f.checkWrite("move directory to", dstRemote); err != nil {
+		return err
+	}
+	if err := f.checkName("move directory to", dstRemote); err != nil {
+		return err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	defer srcFs.nodeCache.change()()
+	f.touch(opWrite, dstRemote)
+	if err := f.fault(faultWrite, dstRemote); err != nil {
+		return err
+	}
+	srcPath := srcFs.toSpectraPath(srcRemote)
+	dstPath := f.toSpectraPath(dstRemote)
+	if dstPath == srcPath {
+		// The destination is already there
+		return fs.ErrorDirExists
+	}
+	if srcPath == "/" || within(dstPath, srcPath) {
+		fs.Debugf(srcFs, "Can't move directory - destination is inside the source")
+		return fs.ErrorCantDirMove
+	}
+	if err := srcFs.checkDelete(ctx, srcPath, true); err != nil {
+		return err
+	}
+	if len(srcFs.movedDirs(srcPath)) > 0 || len(f.movedDirs(srcPath)) > 0 {
+		fs.Debugf(srcFs, "Can't move directory - move_rate shows files moved in or out of it")
+		return fs.ErrorCantDirMove
+	}
+	if len(srcFs.extraDirs(srcPath)) > 0 || len(f.extraDirs(srcPath)) > 0 {
+		fs.Debugf(srcFs, "Can't move directory - extra_count shows extra files in it")
+		return fs.ErrorCantDirMove
+	}
+	if f.uniqueContent() || srcFs.uniqueContent() {
+		// Files are moved one by one, keeping their content
+		fs.Debugf(srcFs, "Can't move directory - generated unique content")
+		return fs.ErrorCantDirMove
+	}
+
+	// Check the source exists, generating it if necessary
+	node, err := srcFs.getNode(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	if node == nil || node.Type != sdk.NodeTypeFolder {
+		return fs.ErrorDirNotFound
+	}
+	if f.db != nil {
+		if n, err := f.sharedNodes(ctx, srcPath); err != nil {
+			return err
+		} else if n > 0 {
+			fs.Debugf(srcFs, "Can't move directory - %d nodes in it exist in other worlds", n)
+			return fs.ErrorCantDirMove
+		}
+	}
+
+	// Check the destination doesn't, the root always does
+	if dstPath == "/" {
+		return fs.ErrorDirExists
+	}
+	existing, err := f.getNode(ctx, dstPath)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fs.ErrorDirExists
+	}
+	if err := f.mkParentDir(ctx, dstRemote); err != nil {
+		return err
+	}
+	start := time.Now()
+	n, err := f.renameTree(ctx, srcPath, dstPath)
+	if err != nil {
+		return err
+	}
+	fs.Debugf(f, "DirMove(%q, %q): renamed %d nodes in %v", srcRemote, dstRemote, n, time.Since(start))
+	return nil
+}
+
+// Copy src to this remote using server-side copy operations.
+//
+// The content is stored once however many files hold it, so the copy
+// only adds a node and a reference to the source's content.
+//
+// Will only be called if src.Fs().Name() == f.Name()
+//
+// If it isn't possible then return fs.ErrorCantCopy
+func (f *Fs) Copy(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+	srcObj, ok := src.(*Object)
+	if !ok || !f.sameDatabase(srcObj.fs) {
+		fs.Debugf(src, "Can't copy - not same database")
+		return nil, fs.ErrorCantCopy
+	}
+	if !f.sameWorld(srcObj.fs) {
+		return f.copyAcrossWorlds(ctx, srcObj, remote)
+	}
+	srcPath := srcObj.spectraPath()
+	if srcObj.fs.isGiant(srcPath) {
+		// Only the repeated block could be stored, not the content
+		fs.Debugf(src, "Can't copy - giant object")
+		return nil, fs.ErrorCantCopy
+	}
+	if err := f.checkWrite("copy to", remote); err != nil {
+		return nil, err
+	}
+	if err := f.checkName("copy to", remote); err != nil {
+		return nil, err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	f.touch(opWrite, remote)
+	if err := f.fault(faultWrite, remote); err != nil {
+		return nil, err
+	}
+	data, stored, err := srcObj.dataBlock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !stored && srcObj.fs.uniqueContent() {
+		data, err = io.ReadAll(srcObj.contentReader(data, false, 0, srcObj.size))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := f.replaceable(ctx, f.toSpectraPath(remote)); err != nil {
+		return nil, err
+	}
+	o, err := f.upload(ctx, remote, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The copy keeps the modification time and metadata of the
+	// original, apart from any set with --metadata-set
+	attrs, err := srcObj.fs.attributes(ctx, srcObj.ID())
+	if err != nil {
+		return nil, err
+	}
+	metadata := fs.Metadata(attrs)
+	if fs.GetConfig(ctx).Metadata {
+		metadata.MergeOptions(fs.MetadataAsOpenOptions(ctx))
+	}
+	if err := o.writeMetadata(ctx, srcObj.modTime, metadata, true); err != nil {
+		return nil, err
+	}
+	if err := f.journalPut(ctx, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// copyAcrossWorlds copies srcObj from another world of the database to
+// the same path in this one by sharing its node with this world, along
+// with the folders above it, so nothing is copied.
+//
+// Copies to other paths, and over a different file already at the path
+// in this world, can't be made this way.
+func (f *Fs) copyAcrossWorlds(ctx context.Context, srcObj *Object, remote string) (fs.Object, error) {
+	srcPath := srcObj.spectraPath()
+	dstPath := f.toSpectraPath(remote)
+	id := srcObj.ID()
+	_, extra := srcObj.fs.extraNode(srcPath)
+	if srcPath != dstPath || id == "" || extra {
+		fs.Debugf(srcObj, "Can't copy - not the same file in another world")
+		return nil, fs.ErrorCantCopy
+	}
+	if err := f.checkWrite("copy to", remote); err != nil {
+		return nil, err
+	}
+	if err := f.checkName("copy to", remote); err != nil {
+		return nil, err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	f.touch(opWrite, remote)
+	if err := f.fault(faultWrite, remote); err != nil {
+		return nil, err
+	}
+	node, err := f.getNode(ctx, dstPath)
+	if err != nil {
+		return nil, err
+	}
+	if node != nil && node.ID != id {
+		fs.Debugf(srcObj, "Can't copy - a different file is at the path in world %q", f.opt.World)
+		return nil, fs.ErrorCantCopy
+	}
+	if node == nil {
+		if err := f.checkQuota(ctx, remote, 1, srcObj.size); err != nil {
+			return nil, err
+		}
+		shared, err := f.shareNode(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !shared {
+			fs.Debugf(srcObj, "Can't copy - a different directory is above it in world %q", f.opt.World)
+			return nil, fs.ErrorCantCopy
+		}
+		f.nodeCache.clear()
+		if node, err = f.getNode(ctx, dstPath); err != nil {
+			return nil, err
+		}
+		if node == nil {
+			return nil, fmt.Errorf("copied %q to world %q but it isn't there", remote, f.opt.World)
+		}
+	}
+	o := f.newObject(remote, node)
+	if err := f.journalPut(ctx, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
@@ -0,0 +1,103 @@
+// Shared reads of file content for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// sharedBlock is the data block of a file, shared by the objects which
+// fetched it at the same time
+type sharedBlock struct {
+	id     string // node ID of the file
+	block  []byte // data block, which mustn't be modified
+	stored bool   // block is uploaded content rather than generated
+}
+
+// fetchBlock fetches the data block of the file at spectraPath, whose
+// node ID is id if known.
+//
+// Several objects can stand for the same file, as when a mount's
+// readers each look it up, so concurrent fetches of the same file are
+// merged into one, generating the file once, and share its result.
+// The fetch isn't cancelled when the caller which started it is, as
+// the others are still waiting on it.
+func (f *Fs) fetchBlock(ctx context.Context, spectraPath, id string) (*sharedBlock, error) {
+	v, err, shared := f.contentFlight.Do("block\x00"+spectraPath+"\x00"+id, func() (any, error) {
+		return f.loadBlock(context.WithoutCancel(ctx), spectraPath, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		fs.Debugf(f, "Shared fetch of %q", spectraPath)
+	}
+	return v.(*sharedBlock), nil
+}
+
+// loadBlock reads the data block of the file at spectraPath, whose
+// node ID is id if known, generating the file if necessary
+func (f *Fs) loadBlock(ctx context.Context, spectraPath, id string) (*sharedBlock, error) {
+	if id == "" {
+		// Get the node first to ensure it exists and trigger lazy generation
+		node, err := f.getNode(ctx, spectraPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get node: %w", err)
+		}
+		if node == nil {
+			return nil, fs.ErrorObjectNotFound
+		}
+		id = node.ID
+	}
+
+	// Uploaded files are served with the content uploaded
+	blob, err := f.loadBlob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if blob != nil {
+		return &sharedBlock{id: id, block: blob, stored: true}, nil
+	}
+
+	// Get file data using SDK - this is the block which is repeated
+	// to make up the content of giant objects
+	block, err := f.sdkGetFileData(ctx, id)
+	if isNotFound(err) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file data: %w", err)
+	}
+	if keeper, ok := f.engine.(contentKeeper); ok && keeper.Uploaded(id) {
+		// The engine keeps uploaded content itself
+		return &sharedBlock{id: id, block: block, stored: true}, nil
+	}
+	if f.drifted(spectraPath) {
+		block = f.driftBlock(spectraPath, block)
+	}
+	return &sharedBlock{id: id, block: block}, nil
+}
+
+// sharedSum returns the digest ty of the object's generated content as
+// computed by sum.
+//
+// Digests of content which isn't cached, which means reading the whole
+// file, are shared by concurrent callers for the same file in the same
+// way as fetchBlock.
+func (o *Object) sharedSum(ty hash.Type, sum func() (string, error)) (string, error) {
+	o.blockMu.Lock()
+	id := o.id
+	o.blockMu.Unlock()
+	key := "sum\x00" + ty.String() + "\x00" + o.spectraPath() + "\x00" + id + "\x00" + strconv.FormatInt(o.size, 10)
+	v, err, _ := o.fs.contentFlight.Do(key, func() (any, error) {
+		return sum()
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
@@ -0,0 +1,132 @@
+// World snapshots for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// nodeColumns are the columns of the nodes table
+const nodeColumns = `id, parent_id, name, path, parent_path, type, depth_level, size, last_updated, checksum, existence_map`
+
+// exportSnapshot generates the whole dataset and writes a copy of the
+// database to the SQLite file at dst, which mustn't exist.
+func (f *Fs) exportSnapshot(ctx context.Context, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("snapshot %q already exists", dst)
+	}
+	if err := f.generateAll(ctx); err != nil {
+		return err
+	}
+	if _, err := f.db.ExecContext(ctx, `VACUUM INTO ?`, dst); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	fs.Infof(f, "Exported snapshot to %q", dst)
+	return nil
+}
+
+// importSnapshot replaces the nodes in the database with those in the
+// snapshot at src written by exportSnapshot.
+//
+// The SDK recreates the nodes table whenever it starts, so this only
+// lasts until the backend is next created. Use the snapshot option to
+// import it on every start.
+func (f *Fs) importSnapshot(ctx context.Context, src string) (err error) {
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	// ATTACH applies to one connection so hold on to it
+	conn, err := f.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to import snapshot: %w", err)
+	}
+	defer fs.CheckClose(conn, &err)
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS snapshot`, "file:"+src+"?mode=ro"); err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer func() {
+		if _, detachErr := conn.ExecContext(context.Background(), `DETACH DATABASE snapshot`); detachErr != nil && err == nil {
+			err = fmt.Errorf("failed to close snapshot: %w", detachErr)
+		}
+	}()
+	var count int64
+	if err = conn.QueryRowContext(ctx, `SELECT count(*) FROM snapshot.nodes`).Scan(&count); err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if count == 0 {
+		return errors.New("snapshot has no nodes")
+	}
+	var snapshotBlobs bool
+	err = conn.QueryRowContext(ctx, `
+SELECT count(*) = 2 FROM snapshot.sqlite_master
+WHERE type = 'table' AND name IN ('spectra_blobs', 'spectra_file_blobs')`).Scan(&snapshotBlobs)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if snapshotBlobs {
+		if err = f.checkSnapshotKey(ctx, conn); err != nil {
+			return err
+		}
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to import snapshot: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM main.nodes`); err == nil {
+		_, err = tx.ExecContext(ctx, `INSERT INTO main.nodes (`+nodeColumns+`) SELECT `+nodeColumns+` FROM snapshot.nodes`)
+	}
+	if err == nil && snapshotBlobs {
+		// Bring the content of uploaded files along too
+		_, err = tx.ExecContext(ctx, `
+DELETE FROM main.spectra_file_blobs;
+INSERT INTO main.spectra_file_blobs (node_id, sha256) SELECT node_id, sha256 FROM snapshot.spectra_file_blobs;
+INSERT OR IGNORE INTO main.spectra_blobs (sha256, size, compression, encrypted, data) SELECT sha256, size, compression, encrypted, data FROM snapshot.spectra_blobs`)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to import snapshot: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to import snapshot: %w", err)
+	}
+	// The snapshot's trees may not be generated as far as the old ones
+	f.rollupMu.Lock()
+	clear(f.rolledUp)
+	f.rollupMu.Unlock()
+	fs.Infof(f, "Imported %d nodes from snapshot %q", count, src)
+	return nil
+}
+
+// checkSnapshotKey returns an error if the attached snapshot holds
+// encrypted data which can't be read with this database's key.
+//
+// Keys are derived with a salt chosen for each database, so encrypted
+// data can only be imported into the database it was exported from.
+func (f *Fs) checkSnapshotKey(ctx context.Context, conn *sql.Conn) error {
+	var encrypted bool
+	err := conn.QueryRowContext(ctx, `SELECT count(*) > 0 FROM snapshot.spectra_blobs WHERE encrypted`).Scan(&encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if !encrypted {
+		return nil
+	}
+	if !f.encrypted() {
+		return errors.New("snapshot holds encrypted data: set db_key")
+	}
+	var sameKey bool
+	err = conn.QueryRowContext(ctx, `
+SELECT count(*) > 0 FROM snapshot.spectra_encryption s JOIN main.spectra_encryption m ON m.salt = s.salt`).Scan(&sameKey)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if !sameKey {
+		return errors.New("snapshot holds data encrypted for another database")
+	}
+	return nil
+}
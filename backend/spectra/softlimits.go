@@ -0,0 +1,142 @@
+// Soft limit warnings for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// softLimitInterval is how often the soft limits are checked while the
+// remote is in use
+const softLimitInterval = time.Second
+
+// softLimit is a threshold which is warned about when crossed
+type softLimit struct {
+	Name      string     `json:"name"`
+	Limit     int64      `json:"limit"`
+	Value     int64      `json:"value"`
+	Crossed   bool       `json:"crossed"`
+	CrossedAt *time.Time `json:"crossedAt,omitempty"`
+	bytes     bool       // whether Limit and Value are sizes in bytes
+}
+
+// format returns x as the limit shows its values
+func (l *softLimit) format(x int64) string {
+	if l.bytes {
+		return fs.SizeSuffix(x).String()
+	}
+	return strconv.FormatInt(x, 10)
+}
+
+// softLimits are the soft limits of a remote and when they were last
+// checked
+type softLimits struct {
+	mu      sync.Mutex
+	limits  []softLimit
+	checked time.Time
+}
+
+// newSoftLimits returns the soft limits set in opt
+func newSoftLimits(opt *Options) *softLimits {
+	s := &softLimits{}
+	add := func(name string, limit int64, bytes bool) {
+		if limit > 0 {
+			s.limits = append(s.limits, softLimit{Name: name, Limit: limit, bytes: bytes})
+		}
+	}
+	add("objects", opt.WarnObjects, false)
+	add("bytes", int64(opt.WarnBytes), true)
+	add("db_size", int64(opt.WarnDBSize), true)
+	return s
+}
+
+// softLimitValues reads the current value of each soft limit: the
+// files and bytes generated or uploaded in this remote's world so far
+// and the size of the database.
+func (f *Fs) softLimitValues(ctx context.Context) (map[string]int64, error) {
+	r, err := f.storedRollup(ctx, "/")
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.dbSize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int64{"objects": r.Files, "bytes": r.Bytes, "db_size": size}, nil
+}
+
+// checkSoftLimits logs a warning for each soft limit which has been
+// reached since it was last checked.
+//
+// Unless force is set the limits are checked at most once every
+// softLimitInterval, so this is cheap to call on every operation.
+// A limit which is crossed again after falling back below it, as when
+// shrink_rate removes files or the database is compacted, is warned
+// about again.
+func (f *Fs) checkSoftLimits(ctx context.Context, force bool) {
+	s := f.softLimits
+	if len(s.limits) == 0 {
+		return
+	}
+	s.mu.Lock()
+	if !force && time.Since(s.checked) < softLimitInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.checked = time.Now()
+	s.mu.Unlock()
+
+	values, err := f.softLimitValues(ctx)
+	if err != nil {
+		fs.Debugf(f, "Failed to check soft limits: %v", err)
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.limits {
+		l := &s.limits[i]
+		l.Value = values[l.Name]
+		switch {
+		case l.Value >= l.Limit && !l.Crossed:
+			l.Crossed, l.CrossedAt = true, &now
+			fs.Logf(f, "Soft limit %s reached: %s of %s", fs.LogValue("limit", l.Name),
+				fs.LogValue("value", l.format(l.Value)), fs.LogValue("threshold", l.format(l.Limit)))
+		case l.Value < l.Limit && l.Crossed:
+			l.Crossed, l.CrossedAt = false, nil
+			fs.Infof(f, "Soft limit %s no longer reached: %s of %s", l.Name, l.format(l.Value), l.format(l.Limit))
+		}
+	}
+}
+
+// softLimitReport checks the soft limits and returns them for the
+// limits command
+func (f *Fs) softLimitReport(ctx context.Context) softLimitReport {
+	f.checkSoftLimits(ctx, true)
+	f.softLimits.mu.Lock()
+	defer f.softLimits.mu.Unlock()
+	report := make(softLimitReport, len(f.softLimits.limits))
+	copy(report, f.softLimits.limits)
+	return report
+}
+
+// softLimitReport is the result of the limits command
+type softLimitReport []softLimit
+
+// csvTable returns the report as one CSV table with a row per limit
+func (r softLimitReport) csvTable() [][]string {
+	rows := [][]string{{"name", "limit", "value", "crossed", "crossed_at"}}
+	for _, l := range r {
+		crossedAt := ""
+		if l.CrossedAt != nil {
+			crossedAt = l.CrossedAt.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{l.Name, strconv.FormatInt(l.Limit, 10), strconv.FormatInt(l.Value, 10),
+			strconv.FormatBool(l.Crossed), crossedAt})
+	}
+	return rows
+}
@@ -9,19 +9,32 @@
 package spectra
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
-	iofs "io/fs"
+	"math/rand/v2"
+	"net/http"
+	"os"
 	"path"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Project-Sylos/Spectra/sdk"
 	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
 	"github.com/rclone/rclone/fs/config/configmap"
 	"github.com/rclone/rclone/fs/config/configstruct"
 	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/list"
+	"github.com/rclone/rclone/lib/encoder"
+	"golang.org/x/sync/singleflight"
 )
 
 // Register with Fs
@@ -30,6 +43,17 @@ func init() {
 		Name:        "spectra",
 		Description: "Spectra synthetic filesystem for testing",
 		NewFs:       NewFs,
+		MetadataInfo: &fs.MetadataInfo{
+			System: systemMetadataInfo,
+			Help: `Files and directories report their modification and creation
+times, and any metadata set on them, which is kept with the world's
+nodes. The expiry headers are only reported if expiry_headers is set
+and the hotness if cold_object_rate is.
+
+Modification times and metadata can't be set with the sdk engine if
+its database is held in memory.`,
+		},
+		CommandHelp: commandHelp,
 		Options: []fs.Option{
 			{
 				Name:     "config_path",
@@ -37,10 +61,1126 @@ func init() {
 				Required: true,
 			},
 			{
-				Name:    "world",
-				Help:    "World/table name to use (primary, s1, s2, etc.)",
+				Name: "world",
+				Help: `World/table name to use (primary, s1, s2, etc.)
+
+Set to all to show every world under one remote, each as a top level
+directory named after it, so worlds can be compared with
+"rclone check myspectra:primary myspectra:s1".`,
 				Default: "primary",
 			},
+			{
+				Name: "engine",
+				Help: `Engine generating and storing the world.
+
+The Spectra SDK stores the world in the SQLite database named by
+db_path in the Spectra configuration file. The memory engine holds it
+in memory instead, without using SQLite, for lightweight use and
+tests. It generates the same shape of world from the same
+configuration, picking the children of each directory from the seed
+and its path, and keeps the content of uploaded files, but the
+features needing an on disk database aren't available with it.
+
+The remote engine calls a running Spectra API server over HTTP rather
+than opening the database, so several rclone processes can share one
+world. The server is found from api_url or the api section of the
+Spectra configuration file. As with the memory engine, the features
+needing an on disk database aren't available with it.`,
+				Default:  engineSDK,
+				Advanced: true,
+				Examples: []fs.OptionExample{{
+					Value: engineSDK,
+					Help:  "The Spectra SDK",
+				}, {
+					Value: engineMemory,
+					Help:  "Pure in memory engine",
+				}, {
+					Value: engineRemote,
+					Help:  "A Spectra API server over HTTP",
+				}},
+			},
+			{
+				Name: "api_url",
+				Help: `URL of the Spectra API server used by the remote engine.
+
+For example http://spectra.example.com:8086. Leave blank to use the
+host and port in the api section of the Spectra configuration file.`,
+				Advanced: true,
+			},
+			{
+				Name: "namespace",
+				Help: `Namespace to keep the changes made with the remote engine in.
+
+Remotes with different namespaces share the world the API server
+generates but don't see each other's uploads, new directories or
+deletions, so parallel jobs can use one server. Leave blank to change
+the world every client of the server sees.`,
+				Advanced: true,
+			},
+			{
+				Name: "fanout_pattern",
+				Help: `How the children of directories are distributed.
+
+The memory engine can generate trees of different shapes from the same
+configuration, to evaluate traversal schedulers against structurally
+different trees. Each is picked from the seed and the paths, so the
+same tree is generated on every run. Other engines only generate the
+uniform pattern.`,
+				Default:  fanoutUniform,
+				Advanced: true,
+				Examples: []fs.OptionExample{{
+					Value: fanoutUniform,
+					Help:  "Counts picked evenly from the configured ranges",
+				}, {
+					Value: fanoutBalanced,
+					Help:  "The middle of the configured ranges in every directory",
+				}, {
+					Value: fanoutSkewed,
+					Help:  "About 90% of the children in one directory in ten",
+				}, {
+					Value: fanoutHotspot,
+					Help:  "Balanced apart from one directory with a hundred times the files",
+				}},
+			},
+			{
+				Name: "giant_object_rate",
+				Help: `Fraction of files to promote to giant objects (0.0-1.0).
+
+Giant objects are reported with a size of giant_object_size and
+their content is the generated file data repeated to fill that size.
+Which files are chosen depends only on the seed and the file path.
+
+Use this to produce objects larger than the per-object size limit of
+the backend being modelled, for example when validating the chunker
+overlay with spectra as its wrapped remote.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name:     "giant_object_size",
+				Help:     "Size of giant objects selected by giant_object_rate.",
+				Default:  fs.SizeSuffix(5 * fs.Gibi),
+				Advanced: true,
+			},
+			{
+				Name: "content",
+				Help: `How the content of generated files is made.
+
+Spectra generates the same block of data for every file, so by default
+each file is that block repeated to its size. With unique content each
+file is instead read from a keystream of its own, picked from the file
+binary seed and its path, any byte range of which can be generated
+without the bytes before it. This makes every file's checksum
+different, at the cost of computing checksums from the content.`,
+				Default:  contentTiled,
+				Advanced: true,
+				Examples: []fs.OptionExample{{
+					Value: contentTiled,
+					Help:  "The generated block repeated",
+				}, {
+					Value: contentUnique,
+					Help:  "A keystream for each file",
+				}},
+			},
+			{
+				Name: "hashes",
+				Help: `Comma separated list of hash types to support.
+
+SHA-256 comes from the Spectra database. Any other hash type known to
+rclone, for example md5 or crc32, is computed from the generated file
+content, so it is as deterministic as the content is. Choose the hash
+types of the remote being stood in for, so rclone check compares the
+same hashes it would against that remote.
+
+Set to "none" to support no hash types other than those added by
+extra_hashes or spectra.RegisterDigest.`,
+				Default:  "sha256",
+				Advanced: true,
+			},
+			{
+				Name: "extra_hashes",
+				Help: `Comma separated list of extra hash types to support.
+
+These are supported as well as those in hashes. Any hash type known to
+rclone, for example xxh3 or blake3, can be added here and is computed
+from the generated file content. Digests registered by code linked
+into rclone with spectra.RegisterDigest are supported too.`,
+				Advanced: true,
+			},
+			{
+				Name: "no_hash_rate",
+				Help: `Fraction of objects which report no hash (0.0-1.0).
+
+These objects return an empty hash for every hash type, as objects
+uploaded without a checksum do on many providers, so comparisons have
+to fall back to size and modification time or --download.
+
+Which objects have no hash depends only on the world's seed and their
+paths.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "expiry_headers",
+				Help: `Report caching metadata for each object.
+
+Each object reports cache-control, expires and content-type metadata
+with a caching policy picked from the world's seed and its path,
+ranging from no-store to immutable, so "rclone serve http" can be used
+to test CDN and cache behaviour.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "link_base_url",
+				Help: `Base of the URLs returned by "rclone link".
+
+Links are made from this and a token derived from the seed, the path
+and the expiry time. Nothing serves them.`,
+				Default:  "https://spectra.invalid/s/",
+				Advanced: true,
+			},
+			{
+				Name: "link_expiry",
+				Help: `Expiry of links made without --expire.
+
+Set to off for links which never expire.`,
+				Default:  fs.DurationOff,
+				Advanced: true,
+			},
+			{
+				Name: "drift_rate",
+				Help: `Fraction of files whose content drifts in this world.
+
+A drifted file has one byte of its content changed but keeps its size
+and modification time, so syncing with --size-only or comparing
+modification times misses the change and only comparing checksums, for
+example with --checksum or "rclone check", finds it. The files are
+picked from the world's seed and their paths.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "drift_epoch",
+				Help: `Epoch of the content of drifted files.
+
+Change this to simulate the files picked by drift_rate drifting again:
+their content changes but their sizes and modification times don't.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "dir_modtime",
+				Help: `Modification time directories report.
+
+Tools sensitive to directory times can be tested against each of the
+conventions providers follow. Setting the modification times of
+directories is only supported with node.`,
+				Default:  dirModTimeNode,
+				Advanced: true,
+				Examples: []fs.OptionExample{{
+					Value: dirModTimeNode,
+					Help:  "The modification time of the directory's node",
+				}, {
+					Value: dirModTimeEpoch,
+					Help:  "The Unix epoch, 1970-01-01T00:00:00Z, for every directory",
+				}, {
+					Value: dirModTimeParent,
+					Help:  "The modification time of the directory's parent",
+				}, {
+					Value: dirModTimeZero,
+					Help:  "None, so rclone reports --default-time",
+				}},
+			},
+			{
+				Name: "corrupt_rate",
+				Help: `Fraction of objects whose data doesn't match their checksums.
+
+Reads of these objects have one byte changed while their hashes are
+those of the data they should have, to prove that "rclone check
+--download", "rclone copy" and other verification catch corruption.
+Which objects are corrupted, and where, depends only on the world's
+seed and their paths.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "cold_object_rate",
+				Help: `Fraction of objects which are cold.
+
+Cold objects are read at cold_bandwidth while the rest are read at
+stream_bandwidth, or as fast as possible if that isn't set, to study
+scheduling transfers of objects which perform differently. Each object
+reports whether it is hot or cold in its hotness metadata. The objects
+are picked from the world's seed and their paths.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "cold_bandwidth",
+				Help: `Bandwidth each stream reading a cold object is limited to.
+
+In bytes per second.`,
+				Default:  fs.SizeSuffix(1024 * 1024),
+				Advanced: true,
+			},
+			{
+				Name: "stream_bandwidth",
+				Help: `Bandwidth each stream reading or writing an object is limited to.
+
+In bytes per second. Each stream has its own limit, so transfers in
+parallel, and multi-thread transfers of one object, go faster, as
+they would to a remote over a slow network. Use it with the latency
+options to model a WAN remote. Cold objects are read at the lower of
+this and cold_bandwidth. Leave at 0 for no limit.`,
+				Default:  fs.SizeSuffix(0),
+				Advanced: true,
+			},
+			{
+				Name: "archive_rate",
+				Help: `Fraction of objects in the archive tier (0.0-1.0).
+
+Archived objects can't be opened until they are restored with the
+restore backend command and restore_delay has passed.
+
+Which objects are archived depends only on the world's seed and their
+paths. This needs an on disk database to record the restores.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name:     "restore_delay",
+				Help:     "How long restores of archived objects take.",
+				Default:  fs.Duration(5 * time.Minute),
+				Advanced: true,
+			},
+			{
+				Name: "chunk_size",
+				Help: `Chunk size for resumable uploads.
+
+Files above --multi-thread-cutoff are uploaded in chunks of this size
+through an upload session which can be resumed. This needs an on disk
+database to hold the sessions.`,
+				Default:  defaultChunkSize,
+				Advanced: true,
+			},
+			{
+				Name: "upload_cutoff",
+				Help: `Cutoff for switching to chunked upload.
+
+Files larger than this uploaded with a single Put, and streams of
+unknown size such as from rclone rcat once they are longer than this,
+are stored chunk_size at a time as they are read, through an upload
+session which can be resumed, rather than being held in memory while
+they are transferred. This needs an on disk database to hold the
+sessions.
+
+The content of a file is kept in a single row of the database, so it
+is still held in memory whole once, when its chunks are assembled to
+store it at the end of the upload.`,
+				Default:  fs.SizeSuffix(200 * fs.Mebi),
+				Advanced: true,
+			},
+			{
+				Name:     "upload_concurrency",
+				Help:     "Number of chunks of the same file uploaded concurrently.",
+				Default:  4,
+				Advanced: true,
+			},
+			{
+				Name: "upload_kill_rate",
+				Help: `Probability of an upload session being killed at each chunk (0.0-1.0).
+
+A killed session loses the chunks uploaded so far, so the upload has to
+start again from scratch.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "hide_count",
+				Help: `Number of files to hide from this world.
+
+The files hidden are picked from the world's seed and their paths, so
+"rclone check" against another world reports a known set of missing
+files. List them with the hidden backend command.
+
+The whole world is generated to pick them, which needs an on disk
+database.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "extra_count",
+				Help: `Number of extra files to show in this world.
+
+Each extra file is a copy of one of the world's files shown under a
+new name in another directory, picked from the world's seed and their
+paths, so syncing the same world without extra_count to this remote
+with --delete-before, --delete-during or --delete-after deletes a
+known set of files. List them with the extra backend command.
+
+Deleting an extra file only stops it being shown, leaving the file it
+copies alone. The whole world is generated to pick them, which needs
+an on disk database.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "move_rate",
+				Help: `Fraction of files shown moved to another directory in this world.
+
+Each file picked is shown in another directory under a new name with
+the same content, size and modification time, so comparing a world
+with and without this is ready made input for --track-renames. The
+files and where they go are picked from the world's seed and their
+paths. List them with the moved backend command.
+
+The whole world is generated to pick them, which needs an on disk
+database.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "protect",
+				Help: `Comma separated list of paths to protect from deletion.
+
+Deleting a protected file or directory, anything below it, or a
+directory containing it returns a permission denied error, to check
+that a sync with --immutable or filters never deletes the data. Paths
+are from the root of the world, whatever the root of the remote.`,
+				Default:  fs.CommaSepList{},
+				Advanced: true,
+			},
+			{
+				Name: "rmdir_recursive",
+				Help: `Let rmdir remove directories which aren't empty.
+
+Removing a directory deletes it along with everything below it in one
+call, as purge does, rather than failing because it isn't empty, so a
+teardown script can use rclone rmdir without listing the directory
+first. As it deletes whole trees it is off unless set, and the protect
+option still applies to everything in the tree.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "read_only",
+				Help: `Refuse to change anything in the world.
+
+Uploads, deletes, directory changes, server-side moves and copies and
+setting modification times or metadata all fail with a permission
+denied error, as do the backend commands which change the world, so
+a world used as a golden source can't be changed by a sync run in the
+wrong direction.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "read_only_worlds",
+				Help: `Comma separated list of worlds to refuse to change.
+
+A remote showing one of these worlds is read only, as if read_only
+were set, whichever remote or world=all directory it is reached
+through. Remotes showing the other worlds can be written, but refuse
+to change or delete files and directories which also exist in a read
+only world, and keep the files and directories they make out of it,
+so writing to them never changes it. This lets one database serve as
+a pristine source in one world and a scratch destination in another.
+This needs an on disk database.`,
+				Default:  fs.CommaSepList{},
+				Advanced: true,
+			},
+			{
+				Name: "snapshot",
+				Help: `Snapshot to load the dataset from.
+
+This is a file written by the export backend command. Its nodes
+replace those generated from the seed whenever the remote is created,
+so an exact dataset can be shared between machines. The Spectra
+configuration should match the one the snapshot was exported with.
+This needs an on disk database.`,
+				Advanced: true,
+			},
+			{
+				Name: "manifest",
+				Help: `Snapshot to answer metadata from during --dry-run.
+
+This is a file written by the export backend command. With --dry-run
+listings and object lookups are answered from it without touching the
+generator, so planning a sync of an enormous world completes quickly.
+Without --dry-run the remote works as normal.`,
+				Advanced: true,
+			},
+			{
+				Name: "journal",
+				Help: `File to record the operations which change the remote in.
+
+Each upload, update, copy, directory made or removed, deletion, move
+and modification time or metadata set is appended to it as a line of
+JSON once it has succeeded, numbered in order, with the content of the
+files written kept beside it in "<journal>.content", encrypted with
+db_key if set. Replay it onto a fresh world with the replay backend
+command to rebuild what a sync wrote, up to any point, and compare it
+with the world a crashed or partial sync left behind. An existing
+journal is carried on.`,
+				Advanced: true,
+			},
+			{
+				Name: "db_compression",
+				Help: `Compression of uploaded file data stored in the database.
+
+Trades CPU for disk space when storing compressible data. Data which
+doesn't get smaller is stored uncompressed. Changing this only affects
+data stored afterwards. This needs an on disk database.`,
+				Default: compressionOff,
+				Examples: []fs.OptionExample{{
+					Value: compressionOff,
+					Help:  "Store data uncompressed",
+				}, {
+					Value: compressionGzip,
+					Help:  "Compress data with gzip",
+				}, {
+					Value: compressionZstd,
+					Help:  "Compress data with zstd",
+				}},
+				Advanced: true,
+			},
+			{
+				Name: "db_key",
+				Help: `Key to encrypt uploaded file data stored in the database with.
+
+Uploaded files and the chunks of upload sessions are encrypted before
+being stored. The names, paths and checksums of nodes aren't, as the
+Spectra SDK stores them. Data stored without a key stays readable
+after setting one, but data stored with a key can't be read without
+it. This needs an on disk database.`,
+				IsPassword: true,
+				Advanced:   true,
+			},
+			{
+				Name: "db_read_conns",
+				Help: `Number of read only connections looking up generated nodes.
+
+Looking up nodes already in the database, as when stat-ing files or
+listing with lazy=false, goes through a pool of this many read only
+connections, so parallel transfers don't queue behind the single
+connection the backend writes with. Set to 0 to look up nodes on the
+connection used for writes.`,
+				Default:  4,
+				Advanced: true,
+			},
+			{
+				Name: "lazy",
+				Help: `Generate directories on demand when they are first accessed.
+
+If this is disabled, directories whose children haven't been
+generated yet appear empty and their would be children are not found,
+so the remote only shows what has already been materialized in the
+database. Use this for stable object counts and to separate the cost
+of generation from the cost of access.`,
+				Default:  true,
+				Advanced: true,
+			},
+			{
+				Name: "eager",
+				Help: `Generate the whole world when the remote is created.
+
+The world is generated breadth first before the remote is used,
+logging progress as it goes, so later operations measure steady state
+performance without generation costs. Generation stops once
+eager_max_nodes nodes have been generated.
+
+Combine with lazy = false to make sure nothing is generated afterwards.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "eager_max_nodes",
+				Help: `Maximum number of nodes to generate with eager.
+
+Set to 0 for no limit.`,
+				Default:  1000000,
+				Advanced: true,
+			},
+			{
+				Name: "generation_concurrency",
+				Help: `Number of directories to generate in the background at once.
+
+With lazy generation each directory is generated when it is first
+listed, so a deep traversal such as rclone tree or rclone sync waits
+for each one in turn. When this is set the subdirectories of each
+directory listed are generated in the background by this many
+workers, so a traversal finds them generated when it gets to them.
+
+Set to 0 to generate directories only when they are accessed.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "filter_generation",
+				Help: `Don't generate directories excluded by the filters.
+
+When set, directories excluded by the --include, --exclude and
+--filter rules in use are never generated by recursive listings, as
+used with --fast-list, or by eager, so their subtrees are never
+materialized. This makes filtered
+benchmarks over enormous worlds feasible, as only the included part of
+the world is generated.
+
+The rules are matched against paths relative to the root of the remote.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "start_at",
+				Help: `Directory of the world to use as the root of the remote.
+
+Either the path of a directory, for example folder_2/folder_1, or
+random:DEPTH[:VARIANT] to pick a directory DEPTH levels down, chosen
+from the seed at each level. Change VARIANT to pick a different
+directory at the same depth.
+
+Any path given in the remote is relative to this directory, so tests
+can repeatedly target the same slice of a large world.`,
+				Advanced: true,
+			},
+			{
+				Name: "latency_list",
+				Help: `Latency to add to each directory listing.
+
+This is one of
+
+- DURATION for a fixed latency, for example 20ms
+- uniform:MIN,MAX for a latency spread evenly between MIN and MAX
+- normal:MEAN,STDDEV for a normally distributed latency
+- exp:MEAN for an exponentially distributed latency
+
+Leave empty for no added latency. The other latency options take the
+same values, so each class of operation can be given its own profile.`,
+				Advanced: true,
+			},
+			{
+				Name:     "latency_stat",
+				Help:     "Latency to add to each single object lookup, see latency_list.",
+				Advanced: true,
+			},
+			{
+				Name:     "latency_read",
+				Help:     "Latency to add to opening each object for reading, see latency_list.",
+				Advanced: true,
+			},
+			{
+				Name:     "latency_write",
+				Help:     "Latency to add to each upload, delete and directory change, see latency_list.",
+				Advanced: true,
+			},
+			{
+				Name: "latency_trace",
+				Help: `File of latencies observed from a real backend to replay.
+
+Each line is a class of operation, list, stat, read or write, and how
+long one such operation took, separated by a comma, for example
+read,0.235 or list,18ms. The latency added to each operation of a
+class is drawn from those observed for it, so the spread and jitter of
+the real backend are kept. Classes with none observed use the other
+latency options.`,
+				Advanced: true,
+			},
+			{
+				Name: "cold_start_latency",
+				Help: `Latency to add to the first access to each directory.
+
+The first listing of a directory, or lookup or read of an object in
+it, is delayed once by this much, modelling a cache miss or tape
+recall. Later accesses are not delayed, so warm and cold traversals
+can be compared in one run.
+
+Takes the same values as latency_list.`,
+				Advanced: true,
+			},
+			{
+				Name: "max_read_qps",
+				Help: `Maximum number of read operations per second.
+
+Listings, object lookups and reads above this rate fail with a
+retriable rate limit error saying when to retry, as a provider
+enforcing a rate limit would. The cap is shared by all remotes using
+the same world.
+
+Set to 0 for no limit.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "max_write_qps",
+				Help: `Maximum number of write operations per second.
+
+As max_read_qps but for uploads, deletes and directory changes.
+
+Set to 0 for no limit.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "max_metadata_concurrency",
+				Help: `Maximum number of listings and lookups in progress at once.
+
+Listings and object lookups beyond this wait for one to finish, so
+heavy checking traffic queues in its own pool rather than slowing
+transfers, which have their own pools set by max_read_concurrency and
+max_write_concurrency.
+
+Set to 0 for no limit.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "max_read_concurrency",
+				Help: `Maximum number of reads in progress at once.
+
+A read holds its place until the file is closed.
+
+Set to 0 for no limit.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "max_write_concurrency",
+				Help: `Maximum number of uploads, deletes and directory changes in progress at once.
+
+Set to 0 for no limit.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "cost_list",
+				Help: `Simulated cost of 1,000 listing requests.
+
+The costs are added up as the remote is used and the total simulated
+spend reported by the cost backend command and logged when rclone
+finishes, to estimate the cost profile of a migration from a dry run.
+Use whatever currency the provider being modelled charges in.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name:     "cost_stat",
+				Help:     "Simulated cost of 1,000 object lookup and hash requests.",
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name:     "cost_read",
+				Help:     "Simulated cost of 1,000 read requests.",
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name:     "cost_write",
+				Help:     "Simulated cost of 1,000 upload, delete and directory change requests.",
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name:     "cost_egress",
+				Help:     "Simulated cost of reading 1 GiB of file data.",
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "heatmap",
+				Help: `Record the paths accessed for the heatmap backend command.
+
+Every list, lookup, read and write through the remote is recorded
+against its path for the life of the remote, so the heatmap command
+can show the order and locality of the accesses a workload made. This
+uses memory for each path accessed.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "warn_objects",
+				Help: `Number of objects in the world to warn about.
+
+A warning is logged when the files generated or uploaded in the world
+first reach this many, so long generation jobs warn early rather than
+only failing when something runs out. The limits are checked about
+once a second and can be read with the limits backend command.
+
+This needs an on disk database. Set to 0 for no warning.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "warn_bytes",
+				Help: `Total size of the objects in the world to warn about.
+
+As with warn_objects, but for the total size of the files generated or
+uploaded in the world.
+
+This needs an on disk database. Set to 0 for no warning.`,
+				Default:  fs.SizeSuffix(0),
+				Advanced: true,
+			},
+			{
+				Name: "warn_db_size",
+				Help: `Size of the database file to warn about.
+
+As with warn_objects, but for the size of the database shared by all
+the worlds, which grows as they are generated.
+
+This needs an on disk database. Set to 0 for no warning.`,
+				Default:  fs.SizeSuffix(0),
+				Advanced: true,
+			},
+			{
+				Name: "quota_objects",
+				Help: `Number of objects the world may hold.
+
+Uploads and copies which would take the files generated or uploaded in
+the world over this many fail with a quota exceeded error which isn't
+retried, as a full remote's would, so jobs filling the remote part way
+through a transfer can be tested.
+
+This needs an on disk database. Set to 0 for no quota.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "quota_bytes",
+				Help: `Total size of the objects the world may hold.
+
+As with quota_objects, but for the total size of the files generated or
+uploaded in the world, so updates which grow a file may fail too. When
+set, about reports the space left below it as free.
+
+This needs an on disk database. Set to 0 for no quota.`,
+				Default:  fs.SizeSuffix(0),
+				Advanced: true,
+			},
+			{
+				Name: "max_api_calls",
+				Help: `Number of API calls the remote may make.
+
+Once the remote has made this many lists, lookups, reads and writes,
+counted as the cost command counts them, every further call fails with
+an operation budget exceeded error which stops rclone. Use it in CI to
+assert that a command stays within the calls it is expected to make.
+
+The budget is for the life of the remote. Set to 0 for no budget.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "max_read_bytes",
+				Help: `Amount of file data the remote may serve.
+
+As with max_api_calls, but for the bytes of file data read, counted as
+egress is. Reads which would go over it fail with an operation budget
+exceeded error once the budget is used up. Set to 0 for no budget.`,
+				Default:  fs.SizeSuffix(0),
+				Advanced: true,
+			},
+			{
+				Name: "coalesce_window",
+				Help: `Time to gather identical lookups into a single SDK call.
+
+Node lookups and directory listings of the same path issued within
+this window are merged into one call to the Spectra SDK and the
+result shared, as are lookups of entries in the same directory.
+
+This reduces the load on the Spectra database when running with a
+high --checkers count, at the cost of adding up to this much latency
+to each lookup. A few milliseconds is usually enough. Set to 0 to
+disable.`,
+				Default:  fs.Duration(0),
+				Advanced: true,
+			},
+			{
+				Name: "node_cache_size",
+				Help: `Number of nodes to keep in the node cache.
+
+The children of each directory listed are cached, so looking up
+files already listed, as rclone does for every file it checks,
+hashes or reads, needs no further calls to the Spectra SDK or
+database. The oldest listings are dropped to keep to this many nodes.
+
+Changes made through the remote clear the cache so it always sees
+them. Set to 0 to disable the cache.`,
+				Default:  100000,
+				Advanced: true,
+			},
+			{
+				Name: "node_cache_ttl",
+				Help: `Time to keep listings in the node cache.
+
+Changes to the world made by other remotes or processes are seen once
+the listings cached before them expire. Set to 0 to disable the
+cache.`,
+				Default:  fs.Duration(time.Minute),
+				Advanced: true,
+			},
+			{
+				Name: "list_page_size",
+				Help: `Number of entries to read from the database per page of a listing.
+
+Directory listings are normally read whole, which for directories
+with hundreds of thousands of entries allocates them all at once.
+When set, directories are read from the database a page of this many
+entries at a time and each page passed on to rclone before the next
+is read, so huge directories list in constant memory. Paged listings
+aren't kept in the node cache.
+
+This needs an on disk database. Set to 0 to read listings whole.`,
+				Default:  0,
+				Advanced: true,
+			},
+			{
+				Name: "op_timeout",
+				Help: `Time to wait for each call to the Spectra SDK.
+
+A call taking longer, such as the generation of a huge directory,
+fails with a timeout error which rclone retries, rather than holding
+up the transfer until rclone's own --timeout. The call carries on in
+the background, so a retry may find its work done. Set to 0 to wait
+for as long as calls take.`,
+				Default:  fs.Duration(0),
+				Advanced: true,
+			},
+			{
+				Name: "growth_rate",
+				Help: `Number of new files to add to the world per second.
+
+While rclone runs, files called grown_N.txt appear at this rate in
+directories which have already been generated. The directories are
+chosen from the seed so runs against the same dataset grow it the same
+way. Use this to test syncing a source which is still being written to.
+
+Set to 0 to disable.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "shrink_rate",
+				Help: `Number of files to remove from the world per second.
+
+While rclone runs, files which have already been generated vanish at
+this rate, including ones which have been listed but not yet read.
+The files are chosen from the seed so runs against the same dataset
+shrink it the same way. Use this to test handling of source objects
+which disappear mid-transfer.
+
+Set to 0 to disable.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "rewrite_rate",
+				Help: `Fraction of files read which a simulated writer rewrites (0-1).
+
+When rclone opens one of these files, a writer running in the
+background appends to it rewrite_delay later, changing its size and
+checksum. Reads of the file in progress carry on with the new content,
+so a transfer sees the file change part way through, as when copying a
+file which is still being written. Each file is rewritten once, and
+later reads see the new content. The files are chosen from the seed
+and their paths. Use this to test detection of source files changed
+during transfer.
+
+Set to 0 to disable.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "rewrite_delay",
+				Help: `How long after a file is opened the simulated writer rewrites it.
+
+Files read in less time are only seen to change when next read. See
+rewrite_rate.`,
+				Default:  fs.Duration(0),
+				Advanced: true,
+			},
+			{
+				Name: "pin_uploads",
+				Help: `Keep the files uploaded by rclone as they were written.
+
+Files uploaded, updated or copied through the remote are pinned, so
+shrink_rate never removes them and rewrite_rate never rewrites them,
+while the generated files around them keep changing. Use this to keep
+fixtures uploaded for a test stable in an evolving world. Uploaded
+content never drifts, whether pinned or not. Pins follow a file when
+it is moved. This needs an on disk database.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "snapshot_isolation",
+				Help: `List the world as it was when the remote was created.
+
+With growth_rate or shrink_rate set, listings and object lookups
+ignore the files churn has added or removed since the remote was
+created, as a provider offering snapshot isolation would, while the
+world itself keeps changing underneath. Compare runs with and without
+it to see how a sync behaves against snapshot and live listings.
+
+Files removed since are still listed but fail when read.`,
+				Default:  false,
+				Advanced: true,
+			},
+			{
+				Name: "gateway_addr",
+				Help: `Address to serve a read only HTTP gateway to the world on.
+
+When set, e.g. to localhost:8087, the remote serves its files over
+HTTP, with directory indexes and range requests, so tools other than
+rclone in a migration test rig can read the same world. The gateway
+runs for as long as the rclone process using the remote does.
+
+Leave blank to not serve a gateway.`,
+				Advanced: true,
+			},
+			{
+				Name: "flaky_list_rate",
+				Help: `Fraction of entries to omit from listings (0.0-1.0).
+
+The first time each directory is listed, this fraction of its entries
+is left out of the listing. They reappear when it is listed again, so
+this models an eventually consistent or buggy listing API and can be
+used to validate that --retries recovers from it.
+
+Which entries are omitted depends only on the seed and their paths.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "duplicate_list_rate",
+				Help: `Fraction of entries to list twice (0.0-1.0).
+
+This fraction of the entries of every listing appear twice in a row,
+as an entry at the end of one page of a paginated listing API is
+repeated at the start of the next when the listing shifts between
+requests. Use it to validate that rclone ignores the duplicates.
+
+Which entries are repeated depends only on the seed and their paths.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "fault_error_rate",
+				Help: `Fraction of operations to fail (0.0-1.0).
+
+This fraction of the operations chosen by fault_ops fail with one of
+the errors in fault_error_types, to exercise rclone's retries. Each
+attempt at an operation on a path is chosen from the seed, the path
+and how many times it has been tried, so the same attempts fail on
+every run and a retry can succeed.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "fault_ops",
+				Help: `Comma separated list of operations fault_error_rate applies to.
+
+These are list, stat (finding a single object), read, write (uploads,
+directory creation and server-side copies and moves) and delete.`,
+				Default:  fs.CommaSepList{faultList, faultStat, faultRead, faultWrite, faultDelete},
+				Advanced: true,
+			},
+			{
+				Name: "fault_error_types",
+				Help: `Comma separated list of errors fault_error_rate fails operations with.
+
+These are timeout and 5xx, which are retried, and not_found, which
+reports the object or directory missing and isn't. Each failure picks
+one of them from the seed.`,
+				Default:  fs.CommaSepList{faultTimeout, fault5xx},
+				Advanced: true,
+			},
+			{
+				Name: "fault_triggers",
+				Help: `Comma separated list of exact attempts at operations to fail.
+
+Each is an operation from fault_ops, then optionally @ and a glob the
+path must match, # and which attempt at the operation on the matching
+paths to fail, counting from 1, and = and the error from
+fault_error_types to fail it with, the first of fault_error_types if
+not given. Without # every matching attempt fails. For example
+write#1000 fails the thousandth write, and read@*.iso=not_found every
+read of an ISO image. These apply whatever fault_error_rate is.`,
+				Advanced: true,
+			},
+			{
+				Name: "bad_range_rate",
+				Help: `Fraction of ranged reads to serve wrongly (0.0-1.0).
+
+This fraction of the reads asking for part of a file get back
+something other than what they asked for, in one of the ways in
+bad_range_types, as from a server with a broken implementation of
+range requests. Each attempt at a ranged read of a path is chosen from
+the seed, the path and how many times it has been read with a range,
+so the same reads go wrong on every run and a retry can succeed.`,
+				Default:  0.0,
+				Advanced: true,
+			},
+			{
+				Name: "bad_range_types",
+				Help: `Comma separated list of ways bad_range_rate serves ranged reads wrongly.
+
+These are ignore, which serves the whole file from its start as if
+the range wasn't asked for, short, which ends the read half way
+through the range, and long, which carries on past the end of the
+range to the end of the file. Each bad read picks one of them from
+the seed.`,
+				Default:  fs.CommaSepList{badRangeIgnore, badRangeShort, badRangeLong},
+				Advanced: true,
+			}, {
+				Name: "sim_seed",
+				Help: `Seed of the simulated misbehaviour of the remote.
+
+When set, the seed in the Spectra configuration only picks the
+dataset, and this picks everything random about how the remote
+behaves while rclone runs: the faults injected, the corrupt and bad
+reads, the entries left out of or repeated in listings, the uploads
+killed, the latencies, the files rewritten and the files grown and
+shrunk. A failing run replays exactly with the same sim_seed, and
+changing it tries new misbehaviour against the same dataset.
+
+It is derived for each world as the seed is. 0 uses the world's seed.`,
+				Default:  0,
+				Advanced: true,
+			}, {
+				Name: "time_scale",
+				Help: `How many times faster than the wall clock simulated time runs.
+
+Simulated time drives growth_rate and shrink_rate, restore_delay and
+the lifetime of restores, link_expiry, rewrite_delay and the
+modification times of the files churn adds and the simulated writer
+rewrites. Set it to 60 to have a minute of simulated time pass every
+second, so scenarios lasting days run in minutes. Latencies and
+timeouts are always in wall time.
+
+Each remote's clock starts at the wall time it is created. 0 is the
+same as 1.`,
+				Default:  1.0,
+				Advanced: true,
+			}, {
+				Name: "max_name_length",
+				Help: `Longest name of a file or directory which can be written, in bytes.
+
+Writes of a file or directory with a longer name in its path fail, as
+they would on a provider with a limit on the length of names, so
+"rclone test info" reports the limit. The length is of the name as
+stored, after encoding. 0 means no limit.`,
+				Default:  0,
+				Advanced: true,
+			}, {
+				Name:     config.ConfigEncoding,
+				Help:     config.ConfigEncodingHelp,
+				Advanced: true,
+				// Names are stored as given, so rclone test info
+				// reports what Spectra itself can store
+				Default: encoder.EncodeZero,
+			},
 		},
 	})
 }
@@ -75,18 +1215,195 @@ func init() {
 
 // Options defines the configuration for this backend
 type Options struct {
-	ConfigPath string `config:"config_path"`
-	World      string `config:"world"`
+	ConfigPath             string               `config:"config_path"`
+	World                  string               `config:"world"`
+	Engine                 string               `config:"engine"`
+	APIURL                 string               `config:"api_url"`
+	Namespace              string               `config:"namespace"`
+	FanoutPattern          string               `config:"fanout_pattern"`
+	GiantObjectRate        float64              `config:"giant_object_rate"`
+	GiantObjectSize        fs.SizeSuffix        `config:"giant_object_size"`
+	Content                string               `config:"content"`
+	Hashes                 string               `config:"hashes"`
+	ExtraHashes            string               `config:"extra_hashes"`
+	NoHashRate             float64              `config:"no_hash_rate"`
+	ExpiryHeaders          bool                 `config:"expiry_headers"`
+	LinkBaseURL            string               `config:"link_base_url"`
+	LinkExpiry             fs.Duration          `config:"link_expiry"`
+	DriftRate              float64              `config:"drift_rate"`
+	DriftEpoch             int                  `config:"drift_epoch"`
+	CorruptRate            float64              `config:"corrupt_rate"`
+	DirModTime             string               `config:"dir_modtime"`
+	ColdObjectRate         float64              `config:"cold_object_rate"`
+	ColdBandwidth          fs.SizeSuffix        `config:"cold_bandwidth"`
+	StreamBandwidth        fs.SizeSuffix        `config:"stream_bandwidth"`
+	ArchiveRate            float64              `config:"archive_rate"`
+	RestoreDelay           fs.Duration          `config:"restore_delay"`
+	ChunkSize              fs.SizeSuffix        `config:"chunk_size"`
+	UploadCutoff           fs.SizeSuffix        `config:"upload_cutoff"`
+	UploadConcurrency      int                  `config:"upload_concurrency"`
+	UploadKillRate         float64              `config:"upload_kill_rate"`
+	HideCount              int                  `config:"hide_count"`
+	ExtraCount             int                  `config:"extra_count"`
+	MoveRate               float64              `config:"move_rate"`
+	Protect                fs.CommaSepList      `config:"protect"`
+	RmdirRecursive         bool                 `config:"rmdir_recursive"`
+	ReadOnly               bool                 `config:"read_only"`
+	ReadOnlyWorlds         fs.CommaSepList      `config:"read_only_worlds"`
+	Snapshot               string               `config:"snapshot"`
+	Manifest               string               `config:"manifest"`
+	Journal                string               `config:"journal"`
+	DBCompression          string               `config:"db_compression"`
+	DBKey                  string               `config:"db_key"`
+	DBReadConns            int                  `config:"db_read_conns"`
+	Lazy                   bool                 `config:"lazy"`
+	Eager                  bool                 `config:"eager"`
+	EagerMaxNodes          int                  `config:"eager_max_nodes"`
+	GenerationConcurrency  int                  `config:"generation_concurrency"`
+	FilterGeneration       bool                 `config:"filter_generation"`
+	StartAt                string               `config:"start_at"`
+	LatencyList            string               `config:"latency_list"`
+	LatencyStat            string               `config:"latency_stat"`
+	LatencyRead            string               `config:"latency_read"`
+	LatencyWrite           string               `config:"latency_write"`
+	LatencyTrace           string               `config:"latency_trace"`
+	ColdStartLatency       string               `config:"cold_start_latency"`
+	MaxReadQPS             float64              `config:"max_read_qps"`
+	MaxWriteQPS            float64              `config:"max_write_qps"`
+	MaxMetadataConcurrency int                  `config:"max_metadata_concurrency"`
+	MaxReadConcurrency     int                  `config:"max_read_concurrency"`
+	MaxWriteConcurrency    int                  `config:"max_write_concurrency"`
+	CostList               float64              `config:"cost_list"`
+	CostStat               float64              `config:"cost_stat"`
+	CostRead               float64              `config:"cost_read"`
+	CostWrite              float64              `config:"cost_write"`
+	CostEgress             float64              `config:"cost_egress"`
+	Heatmap                bool                 `config:"heatmap"`
+	WarnObjects            int64                `config:"warn_objects"`
+	WarnBytes              fs.SizeSuffix        `config:"warn_bytes"`
+	WarnDBSize             fs.SizeSuffix        `config:"warn_db_size"`
+	QuotaObjects           int64                `config:"quota_objects"`
+	QuotaBytes             fs.SizeSuffix        `config:"quota_bytes"`
+	MaxAPICalls            int64                `config:"max_api_calls"`
+	MaxReadBytes           fs.SizeSuffix        `config:"max_read_bytes"`
+	CoalesceWindow         fs.Duration          `config:"coalesce_window"`
+	NodeCacheSize          int                  `config:"node_cache_size"`
+	NodeCacheTTL           fs.Duration          `config:"node_cache_ttl"`
+	ListPageSize           int                  `config:"list_page_size"`
+	OpTimeout              fs.Duration          `config:"op_timeout"`
+	GrowthRate             float64              `config:"growth_rate"`
+	ShrinkRate             float64              `config:"shrink_rate"`
+	RewriteRate            float64              `config:"rewrite_rate"`
+	RewriteDelay           fs.Duration          `config:"rewrite_delay"`
+	PinUploads             bool                 `config:"pin_uploads"`
+	SnapshotIsolation      bool                 `config:"snapshot_isolation"`
+	GatewayAddr            string               `config:"gateway_addr"`
+	FlakyListRate          float64              `config:"flaky_list_rate"`
+	DuplicateListRate      float64              `config:"duplicate_list_rate"`
+	FaultErrorRate         float64              `config:"fault_error_rate"`
+	FaultOps               fs.CommaSepList      `config:"fault_ops"`
+	FaultErrorTypes        fs.CommaSepList      `config:"fault_error_types"`
+	FaultTriggers          fs.CommaSepList      `config:"fault_triggers"`
+	BadRangeRate           float64              `config:"bad_range_rate"`
+	BadRangeTypes          fs.CommaSepList      `config:"bad_range_types"`
+	SimSeed                int64                `config:"sim_seed"`
+	TimeScale              float64              `config:"time_scale"`
+	MaxNameLength          int                  `config:"max_name_length"`
+	Enc                    encoder.MultiEncoder `config:"encoding"`
 }
 
 // Fs represents a Spectra filesystem
 type Fs struct {
-	name       string         // name of this remote
-	root       string         // the path we are working on if any
-	opt        Options        // parsed config options
-	spectraSDK *sdk.SpectraFS // Spectra SDK instance
-	spectraFS  iofs.FS        // Spectra fs.FS for the selected world
-	features   *fs.Features   // optional features
+	name        string       // name of this remote
+	root        string       // the path we are working on if any
+	worldDir    string       // directory of the world the root is in for world=all
+	opt         Options      // parsed config options
+	engine      engine       // generates and stores the world, normally the Spectra SDK
+	closeEngine func() error // releases engine on shutdown, nil if the remote doesn't own it
+	db          *sql.DB      // direct handle on the Spectra database, may be nil
+	readDB      *sql.DB      // read only connections looking up nodes, db if db_read_conns is 0
+	manifest    *sql.DB      // snapshot --dry-run metadata is answered from, may be nil
+	features    *fs.Features // optional features
+
+	giantHashMu   sync.Mutex         // protects giantHash
+	giantHash     map[int64]string   // SHA256 of tiled file data by size
+	contentCipher cipher.Block       // keys the content of files for content=unique, nil if tiled
+	contentFlight singleflight.Group // merges concurrent fetches and hashes of the same file
+
+	sha256        bool                 // whether SHA-256 is supported
+	digests       map[hash.Type]Digest // extra hash types supported
+	digestCacheMu sync.Mutex           // protects digestCache
+	digestCache   map[digestKey]string // digests of file content by type and size
+
+	nodeCoalescer *coalescer[*sdk.Node]       // merges GetNode calls
+	listCoalescer *coalescer[*sdk.ListResult] // merges ListChildren calls
+	nodeCache     *nodeCache                  // listings of the directories read recently
+
+	churnMu   sync.Mutex // protects churn and isolation
+	churn     churn      // simulated changes to the world
+	isolation isolation  // changes churn has made, for snapshot_isolation
+
+	rewriteMu     sync.Mutex         // protects rewriting and rewritten
+	rewriting     map[string]bool    // files picked by rewrite_rate which have been opened
+	rewritten     map[string]bool    // files the simulated writer has rewritten
+	rewriteCtx    context.Context    // cancelled on Shutdown to stop the writer
+	rewriteCancel context.CancelFunc // cancels rewriteCtx
+	rewriteWG     sync.WaitGroup     // rewrites in progress or waiting
+
+	prefetchMu     sync.Mutex         // protects prefetchQueued
+	prefetchQueued map[string]bool    // directories queued or being generated in the background
+	prefetchQueue  chan string        // directories to generate in the background
+	prefetchCtx    context.Context    // cancelled on Shutdown to stop the workers
+	prefetchCancel context.CancelFunc // cancels prefetchCtx
+	prefetchWG     sync.WaitGroup     // workers generating in the background
+
+	rollupMu sync.Mutex      // protects rolledUp
+	rolledUp map[string]bool // directories whose trees have been generated for their rollups
+	listedMu sync.Mutex      // protects listed
+	listed   map[string]bool // directories listed so far, for flaky_list_rate
+	faultMu  sync.Mutex      // protects tries and the counts of triggers
+	tries    map[string]int  // attempts at each operation on each path, for fault_error_rate and bad_range_rate
+	triggers []*faultTrigger // faults set by fault_triggers
+
+	hidden map[string]bool // files hidden by hide_count, set up by NewFs
+
+	extraMu sync.Mutex          // protects extra and extraIn
+	extra   map[string]string   // paths extra files are shown at to the paths of their nodes
+	extraIn map[string][]string // directories to the extra files shown in them
+	dbKey   *[keySize]byte      // key encrypting data in the database, nil if none
+
+	movedMu   sync.Mutex          // protects moved, movedFrom and movedInto
+	moved     map[string]string   // paths of files moved by move_rate to where they are shown
+	movedFrom map[string]string   // paths files moved by move_rate are shown at to their paths
+	movedInto map[string][]string // directories to the paths of files moved into them
+
+	protect []string     // paths protected from deletion
+	gateway *http.Server // gateway started by this remote, if any
+
+	latency      [numOpClasses]latencyDist // latency to add per operation class
+	latencyMu    sync.Mutex                // protects latency and latencyRand
+	clock        clock                     // simulated time
+	tunedMu      sync.RWMutex              // protects tuned
+	tuned        *tunables                 // options changed by the tune command, nil until it runs
+	latencyRand  *rand.Rand                // source of latencies
+	qps          *qpsLimiters              // QPS caps shared by the world
+	pools        opPools                   // concurrency pools per operation class
+	costs        costs                     // requests made for the simulated costs
+	apiCalls     atomic.Int64              // calls counted against max_api_calls
+	heat         *heatmap                  // paths accessed, nil if not recorded
+	profiles     profiles                  // calls of the operations profiled
+	profileMu    sync.Mutex                // protects profileSince and resets
+	profileSince time.Time                 // when the profiles were started
+	softLimits   *softLimits               // thresholds to warn about when crossed
+	journal      *os.File                  // operations are recorded in, nil if not
+	journalMu    sync.Mutex                // protects journal, journalSeq and journalEnd
+	journalSeq   int64                     // number of the last operation recorded
+	journalEnd   int64                     // size of the journal up to the end of the last entry
+	journalKey   *[keySize]byte            // key the content kept with the journal is encrypted with, nil if not
+
+	coldLatency latencyDist              // latency of the first access to a directory
+	warmMu      sync.Mutex               // protects warm
+	warm        map[string]chan struct{} // directories accessed, closed once warm
 }
 
 // Name of the remote (as passed into NewFs)
@@ -96,7 +1413,7 @@ func (f *Fs) Name() string {
 
 // Root of the remote (as passed into NewFs)
 func (f *Fs) Root() string {
-	return f.root
+	return path.Join(f.worldDir, f.root)
 }
 
 // String converts this Fs to a string
@@ -106,13 +1423,25 @@ func (f *Fs) String() string {
 
 // Precision of the ModTimes in this Fs
 func (f *Fs) Precision() time.Duration {
+	if !f.keepsAttributes() {
+		// Modification times can't be set, so files have the time
+		// they were uploaded
+		return fs.ModTimeNotSupported
+	}
 	// Spectra uses time.Now() for timestamps, so we have nanosecond precision
 	return time.Nanosecond
 }
 
 // Hashes returns the supported hash sets
 func (f *Fs) Hashes() hash.Set {
-	return hash.Set(hash.SHA256)
+	set := hash.NewHashSet()
+	if f.sha256 {
+		set.Add(hash.SHA256)
+	}
+	for ty := range f.digests {
+		set.Add(ty)
+	}
+	return set
 }
 
 // Features returns the optional features of this Fs
@@ -127,14 +1456,11 @@ func parsePath(pth string) string {
 
 // toSpectraPath converts rclone path (where "" is root) to Spectra path (where "/" is root)
 func (f *Fs) toSpectraPath(rclonePath string) string {
-	if rclonePath == "" {
+	// Join with root if there is one, encoding the names as stored
+	fullPath := path.Join(f.opt.Enc.FromStandardPath(f.root), f.opt.Enc.FromStandardPath(rclonePath))
+	if fullPath == "" {
 		return "/"
 	}
-	// Join with root if there is one
-	fullPath := rclonePath
-	if f.root != "" {
-		fullPath = path.Join(f.root, rclonePath)
-	}
 	// Ensure leading slash
 	if !strings.HasPrefix(fullPath, "/") {
 		fullPath = "/" + fullPath
@@ -148,16 +1474,16 @@ func (f *Fs) fromSpectraPath(spectraPath string) string {
 	pth := strings.TrimPrefix(spectraPath, "/")
 
 	// If we have a root, make path relative to it
-	if f.root != "" {
-		rootPrefix := f.root + "/"
+	if root := f.opt.Enc.FromStandardPath(f.root); root != "" {
+		rootPrefix := root + "/"
 		if strings.HasPrefix(pth, rootPrefix) {
 			pth = strings.TrimPrefix(pth, rootPrefix)
-		} else if pth == f.root {
+		} else if pth == root {
 			pth = ""
 		}
 	}
 
-	return pth
+	return f.opt.Enc.ToStandardPath(pth)
 }
 
 // NewFs constructs an Fs from the path
@@ -168,15 +1494,58 @@ func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, e
 	if err != nil {
 		return nil, err
 	}
+	if opt.Enc&(encoder.EncodeSlash|encoder.EncodeDot) != 0 {
+		// These would store names which break up or clean away in
+		// the / separated Spectra paths
+		return nil, errors.New("encoding can't include Slash or Dot")
+	}
+	// The ／ and ． rclone gives for a / in a name and a name of . or ..
+	// are stored as given rather than decoded, for the same reason
+	opt.Enc |= encoder.EncodeSlash | encoder.EncodeDot
+	if opt.World == worldAll {
+		return newAllWorldsFs(ctx, name, root, opt)
+	}
 
-	// Initialize Spectra SDK
-	spectraSDK, err := sdk.New(opt.ConfigPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize Spectra SDK: %w", err)
+	// Initialize the engine generating the world. Remotes using the
+	// SDK share one engine per configuration file, as the SDK
+	// recreates the world whenever it opens the database.
+	var (
+		engine  engine
+		release func() error
+	)
+	if opt.Engine == engineSDK || opt.Engine == "" {
+		var made bool
+		engine, made, release, err = sharedEngine(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		if !made {
+			// The snapshot was loaded and the world generated
+			// eagerly by the remote which made the engine
+			opt.Snapshot, opt.Eager = "", false
+		}
+	} else {
+		engine, err = newEngine(ctx, opt)
+		if err != nil {
+			return nil, err
+		}
+		release = sync.OnceValue(engine.Close)
+	}
+	f, err := newFs(ctx, name, root, opt, engine)
+	if f == nil {
+		_ = release()
+		return nil, err
 	}
+	f.closeEngine = release
+	return f, err
+}
+
+// newFs makes a remote showing the world named in opt, generated by
+// engine
+func newFs(ctx context.Context, name, root string, opt *Options, engine engine) (_ *Fs, err error) {
 
 	// Validate that the requested world exists
-	cfg := spectraSDK.GetConfig()
+	cfg := engine.GetConfig()
 	if opt.World != "primary" {
 		// Check if it exists in secondary tables
 		if _, ok := cfg.SecondaryTables[opt.World]; !ok {
@@ -185,23 +1554,327 @@ func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, e
 		}
 	}
 
-	// Get fs.FS wrapper for the selected world
-	spectraFS := spectraSDK.AsFS(opt.World)
-
-	root = parsePath(root)
-	f := &Fs{
-		name:       name,
-		root:       root,
-		opt:        *opt,
-		spectraSDK: spectraSDK,
-		spectraFS:  spectraFS,
+	for _, world := range opt.ReadOnlyWorlds {
+		world = strings.TrimSpace(world)
+		if world != "primary" && world != "" {
+			if _, ok := cfg.SecondaryTables[world]; !ok {
+				return nil, fmt.Errorf("read_only_worlds: world %q not found in Spectra config", world)
+			}
+		}
+		if world == opt.World {
+			opt.ReadOnly = true
+		}
 	}
 
-	f.features = (&fs.Features{
-		CanHaveEmptyDirectories: true,
-		ReadMimeType:            false,
-		WriteMimeType:           false,
+	// Open the database for the operations the SDK doesn't provide,
+	// which the memory and remote engines haven't got
+	var db, readDB *sql.DB
+	if opt.Engine == engineSDK || opt.Engine == "" {
+		db, err = openDB(cfg.Seed.DBPath)
+		if err != nil {
+			return nil, err
+		}
+		readDB, err = openReadDB(cfg.Seed.DBPath, opt.DBReadConns)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		if readDB == nil {
+			readDB = db
+		}
+		// Don't leak the connections if the remote can't be made
+		defer func() {
+			if err == nil || err == fs.ErrorIsFile || db == nil {
+				return
+			}
+			if readDB != db {
+				_ = readDB.Close()
+			}
+			_ = db.Close()
+		}()
+	}
+	if db == nil && (opt.GrowthRate > 0 || opt.ShrinkRate > 0) {
+		return nil, errors.New("growth_rate and shrink_rate need an on disk database")
+	}
+	if db == nil && len(opt.ReadOnlyWorlds) > 0 {
+		return nil, errors.New("read_only_worlds needs an on disk database")
+	}
+	if db == nil && opt.PinUploads {
+		return nil, errors.New("pin_uploads needs an on disk database")
+	}
+	if db == nil && !opt.Lazy {
+		return nil, errors.New("lazy=false needs an on disk database")
+	}
+	if db == nil && opt.ArchiveRate > 0 {
+		return nil, errors.New("archive_rate needs an on disk database")
+	}
+	if db == nil && opt.HideCount > 0 {
+		return nil, errors.New("hide_count needs an on disk database")
+	}
+	if db == nil && opt.ExtraCount > 0 {
+		return nil, errors.New("extra_count needs an on disk database")
+	}
+	if db == nil && opt.MoveRate > 0 {
+		return nil, errors.New("move_rate needs an on disk database")
+	}
+	if db == nil && opt.Snapshot != "" {
+		return nil, errors.New("snapshot needs an on disk database")
+	}
+	if err := checkFaults(opt); err != nil {
+		return nil, err
+	}
+	triggers, err := parseFaultTriggers(opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.ColdObjectRate > 0 && opt.ColdBandwidth <= 0 {
+		return nil, errors.New("cold_bandwidth must be positive")
+	}
+	if err := checkCompression(opt.DBCompression); err != nil {
+		return nil, err
+	}
+	if db == nil && opt.DBCompression != compressionOff {
+		return nil, errors.New("db_compression needs an on disk database")
+	}
+	if db == nil && opt.DBKey != "" {
+		return nil, errors.New("db_key needs an on disk database")
+	}
+	if db == nil && (opt.WarnObjects > 0 || opt.WarnBytes > 0 || opt.WarnDBSize > 0) {
+		return nil, errors.New("warn_objects, warn_bytes and warn_db_size need an on disk database")
+	}
+	if db == nil && opt.ListPageSize > 0 {
+		return nil, errors.New("list_page_size needs an on disk database")
+	}
+	if db == nil && (opt.QuotaObjects > 0 || opt.QuotaBytes > 0) {
+		return nil, errors.New("quota_objects and quota_bytes need an on disk database")
+	}
+
+	if err := checkDirModTime(opt.DirModTime); err != nil {
+		return nil, err
+	}
+
+	var contentCipher cipher.Block
+	switch opt.Content {
+	case contentTiled, "":
+	case contentUnique:
+		contentCipher, err = newContentCipher(cfg.Seed.FileBinarySeed)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown content %q: must be %q or %q", opt.Content, contentTiled, contentUnique)
+	}
+
+	digests, err := loadDigests(opt.ExtraHashes)
+	if err != nil {
+		return nil, err
+	}
+	sha256, err := loadHashes(opt.Hashes, digests)
+	if err != nil {
+		return nil, err
+	}
+	latency, err := parseLatencies(opt)
+	if err != nil {
+		return nil, err
+	}
+	coldLatency, err := parseLatencyDist(opt.ColdStartLatency)
+	if err != nil {
+		return nil, fmt.Errorf("cold_start_latency: %w", err)
+	}
+	clock, err := newClock(opt.TimeScale)
+	if err != nil {
+		return nil, err
+	}
+	simSeed := cfg.Seed.Seed
+	if opt.SimSeed != 0 {
+		simSeed = opt.SimSeed
+	}
+	latencySeed := uint64(deriveWorldSeed(simSeed, opt.World))
+
+	root = parsePath(root)
+	f := &Fs{
+		name:      name,
+		root:      root,
+		opt:       *opt,
+		engine:    engine,
+		db:        db,
+		readDB:    readDB,
+		giantHash: make(map[int64]string),
+
+		contentCipher: contentCipher,
+
+		sha256:      sha256,
+		digests:     digests,
+		digestCache: make(map[digestKey]string),
+
+		nodeCoalescer: newCoalescer[*sdk.Node](time.Duration(opt.CoalesceWindow)),
+		listCoalescer: newCoalescer[*sdk.ListResult](time.Duration(opt.CoalesceWindow)),
+		nodeCache:     newNodeCache(opt.NodeCacheSize, time.Duration(opt.NodeCacheTTL)),
+
+		clock:    clock,
+		churn:    churn{start: clock.Now()},
+		listed:   make(map[string]bool),
+		tries:    make(map[string]int),
+		triggers: triggers,
+		rolledUp: make(map[string]bool),
+
+		latency:     latency,
+		latencyRand: rand.New(rand.NewPCG(latencySeed, seedHash(simSeed, "latency", opt.World))),
+		qps:         getQPSLimiters(cfg.Seed.DBPath, opt),
+		pools:       newOpPools(opt),
+		softLimits:  newSoftLimits(opt),
+		coldLatency: coldLatency,
+		warm:        make(map[string]chan struct{}),
+
+		protect: parseProtect(opt.Protect),
+	}
+
+	setsAttributes := f.keepsAttributes() && !opt.ReadOnly
+	f.features = (&fs.Features{
+		CanHaveEmptyDirectories: true,
+		ServerSideAcrossConfigs: true,
+		ReadMimeType:            true,
+		WriteMimeType:           false,
+		ReadMetadata:            true,
+		WriteMetadata:           setsAttributes,
+		UserMetadata:            setsAttributes,
+		GetTier:                 opt.ArchiveRate > 0,
+		ReadDirMetadata:         true,
+		WriteDirMetadata:        setsAttributes,
+		WriteDirSetModTime:      setsAttributes && f.dirModTimeSettable(),
+		UserDirMetadata:         setsAttributes,
+		FilterAware:             opt.FilterGeneration,
 	}).Fill(ctx, f)
+	if !setsAttributes {
+		// Modification times and metadata can't be set
+		f.features.Disable("DirSetModTime")
+		f.features.Disable("MkdirMetadata")
+	} else if !f.dirModTimeSettable() {
+		// Directories don't report the modification times set
+		f.features.Disable("DirSetModTime")
+	}
+	if opt.ReadOnly {
+		// Nothing can be written
+		f.features.Disable("Purge")
+		f.features.Disable("Move")
+		f.features.Disable("DirMove")
+		f.features.Disable("Copy")
+		f.features.Disable("PutStream")
+		f.features.Disable("OpenChunkWriter")
+	}
+	if db == nil {
+		// Purging, server-side moves, recursive listing, upload
+		// sessions, rollups and change notification need direct
+		// database access, though engines which rename folders
+		// themselves can move directories
+		f.features.Disable("Purge")
+		f.features.Disable("Move")
+		if !renamesPrefixes(f.engine) {
+			f.features.Disable("DirMove")
+		}
+		f.features.Disable("Copy")
+		f.features.Disable("ListR")
+		f.features.Disable("OpenChunkWriter")
+		f.features.Disable("About")
+		f.features.Disable("ChangeNotify")
+	} else if err := f.checkSchema(ctx); err != nil {
+		return nil, err
+	} else if err := f.initUploads(ctx); err != nil {
+		return nil, err
+	} else if err := f.initBlobs(ctx); err != nil {
+		return nil, err
+	} else if err := f.initAttributes(ctx); err != nil {
+		return nil, err
+	} else if err := f.initHashes(ctx); err != nil {
+		return nil, err
+	} else if err := f.initPins(ctx); err != nil {
+		return nil, err
+	} else if err := f.initRollups(ctx); err != nil {
+		return nil, err
+	} else if err := f.initWorldManifest(ctx); err != nil {
+		return nil, err
+	} else if err := f.initWorldSnapshots(ctx); err != nil {
+		return nil, err
+	}
+	if opt.DBKey != "" {
+		if err := f.initEncryption(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.Snapshot != "" {
+		if err := f.importSnapshot(ctx, opt.Snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.ArchiveRate > 0 {
+		if err := f.initRestores(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.Manifest != "" {
+		if err := f.openManifest(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.Eager && f.planning(ctx) {
+		fs.Infof(f, "Not generating eagerly as --dry-run is answered from the manifest")
+	} else if opt.Eager {
+		if err := f.generateAll(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.HideCount > 0 {
+		if err := f.pickHidden(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if opt.ExtraCount > 0 {
+		if err := f.pickExtra(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if opt.MoveRate > 0 {
+		if err := f.pickMoved(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if opt.RewriteRate > 0 {
+		f.startRewriter()
+	}
+	if opt.GenerationConcurrency > 0 && opt.Lazy {
+		f.startPrefetch()
+	}
+	if opt.Heatmap {
+		f.heat = newHeatmap()
+	}
+	f.profileSince = time.Now()
+	if opt.Journal != "" {
+		if err := f.openJournal(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Move the root under the start_at directory
+	if opt.StartAt != "" {
+		start, err := f.resolveStartAt(ctx)
+		if err != nil {
+			return nil, err
+		}
+		fs.Debugf(f, "Starting at %q", start)
+		root = path.Join(start, root)
+		f.root = root
+	}
+
+	if opt.GatewayAddr != "" {
+		if err := f.startGateway(opt.GatewayAddr); err != nil {
+			return nil, err
+		}
+	}
 
 	// Check if root points to a file
 	if root != "" {
@@ -209,30 +1882,17 @@ func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, e
 		spectraPath := "/" + root
 		fs.Debugf(nil, "NewFs: Checking if root '%s' (spectraPath='%s') is a file in world '%s'", root, spectraPath, opt.World)
 
-		// Trigger lazy generation for parent directory
-		parentPath := path.Dir(spectraPath)
-		if parentPath == "." {
-			parentPath = "/"
-		}
-
-		result, err := spectraSDK.ListChildren(&sdk.ListChildrenRequest{
-			ParentPath: parentPath,
-			TableName:  opt.World,
-		})
-		fs.Debugf(nil, "NewFs: ListChildren(parentPath='%s') result.Success=%v, err=%v", parentPath, result != nil && result.Success, err)
-
-		// Now check if it's a file using SDK
-		node, err := spectraSDK.GetNode(&sdk.GetNodeRequest{
-			Path:      spectraPath,
-			TableName: opt.World,
-		})
+		// Look the root up via its parent, which also triggers lazy
+		// generation of the parent directory
+		nodes, err := f.getNodes(ctx, spectraPath)
+		node := nodes[spectraPath]
 		nodeType := ""
 		if node != nil {
 			nodeType = node.Type
 		}
-		fs.Debugf(nil, "NewFs: GetNode(path='%s') node=%v (type=%s), err=%v", spectraPath, node != nil, nodeType, err)
+		fs.Debugf(nil, "NewFs: getNodes(path='%s') node=%v (type=%s), err=%v", spectraPath, node != nil, nodeType, err)
 		if err == nil && node != nil {
-			if node.Type != "folder" {
+			if node.Type != sdk.NodeTypeFolder {
 				fs.Debugf(nil, "NewFs: Root is a file, returning ErrorIsFile")
 				// Root points to a file, adjust root to parent
 				newRoot := path.Dir(root)
@@ -259,227 +1919,733 @@ func getSecondaryTableNames(cfg *sdk.Config) []string {
 
 // List the objects and directories in dir into entries
 func (f *Fs) List(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
+	return list.WithListP(ctx, dir, f)
+}
+
+// ListP lists the objects and directories in dir, calling callback with
+// each tranche of entries as they are made rather than collecting the
+// whole directory first
+func (f *Fs) ListP(ctx context.Context, dir string, callback fs.ListRCallback) (err error) {
+	defer f.profiled(profList, time.Now(), &err)
+	ctx, done, err := f.beginOp(ctx, opList)
+	if err != nil {
+		return err
+	}
+	defer done()
+	f.touch(opList, dir)
+	if err := f.fault(faultList, dir); err != nil {
+		return err
+	}
 	spectraPath := f.toSpectraPath(dir)
-	// Remove leading slash for fs.FS (it expects relative paths)
-	fsPath := strings.TrimPrefix(spectraPath, "/")
-	if fsPath == "" {
-		fsPath = "."
+	if f.planning(ctx) {
+		entries, err := f.manifestList(ctx, dir, spectraPath)
+		if err != nil {
+			return err
+		}
+		return callback(entries)
+	}
+	if err := f.coldStart(ctx, spectraPath); err != nil {
+		return err
 	}
 
-	dirEntries, err := iofs.ReadDir(f.spectraFS, fsPath)
+	// Check the directory exists and isn't a file
+	if spectraPath != "/" {
+		node, err := f.getNode(ctx, spectraPath)
+		if err != nil {
+			return err
+		}
+		if node == nil || node.Type != sdk.NodeTypeFolder {
+			return fs.ErrorDirNotFound
+		}
+	}
+
+	if f.opt.ListPageSize > 0 {
+		return f.listPaged(ctx, dir, spectraPath, callback)
+	}
+
+	// The listing returns whole nodes so the entries are fully
+	// populated, hashes included, without stat-ing each one
+	result, err := f.listChildren(ctx, spectraPath)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "not found") {
-			return nil, fs.ErrorDirNotFound
+		return err
+	}
+	if result == nil {
+		return fs.ErrorDirNotFound
+	}
+
+	if f.prefetchQueue != nil {
+		folders := make([]string, len(result.Folders))
+		for i := range result.Folders {
+			folders[i] = result.Folders[i].Path
 		}
-		return nil, err
+		f.prefetch(folders...)
 	}
 
-	for _, entry := range dirEntries {
-		remote := entry.Name()
-		if dir != "" {
-			remote = path.Join(dir, entry.Name())
+	l := f.newDirLister(dir, spectraPath, callback)
+	for i := range result.Folders {
+		node := &result.Folders[i].Node
+		if err := l.add(f.newDirectory(ctx, path.Join(dir, f.opt.Enc.ToStandardName(node.Name)), node)); err != nil {
+			return err
+		}
+	}
+	for i := range result.Files {
+		node := &result.Files[i].Node
+		if err := l.add(f.newObject(path.Join(dir, f.opt.Enc.ToStandardName(node.Name)), node)); err != nil {
+			return err
 		}
+	}
+	return l.finish(ctx)
+}
 
-		if entry.IsDir() {
-			entries = append(entries, fs.NewDir(remote, time.Time{}))
-		} else {
-			// Get file info
-			info, err := entry.Info()
-			if err != nil {
-				continue
+// ListR lists the objects and directories of the Fs starting from
+// dir recursively into out.
+//
+// The whole tree is read from the database in one query with the
+// hashes included, so "rclone hashsum" and "rclone check" don't need
+// to stat or read any objects. Directories which haven't been
+// generated yet are generated first.
+func (f *Fs) ListR(ctx context.Context, dir string, callback fs.ListRCallback) (err error) {
+	defer f.profiled(profList, time.Now(), &err)
+	ctx, done, err := f.beginOp(ctx, opList)
+	if err != nil {
+		return err
+	}
+	defer done()
+	f.touch(opList, dir)
+	if err := f.fault(faultList, dir); err != nil {
+		return err
+	}
+	spectraPath := f.toSpectraPath(dir)
+	maxDepth := depthLimit(ctx, spectraPath)
+	gen := f.nodeCache.generation()
+	nodes, err := f.treeNodes(ctx, spectraPath, maxDepth)
+	if err != nil {
+		return err
+	}
+	if maxDepth < 0 && !f.planning(ctx) {
+		f.cacheTree(gen, spectraPath, nodes)
+	}
+
+	// Group the entries by directory so flaky listings apply to each
+	prefix := strings.TrimSuffix(spectraPath, "/") + "/"
+	byDir := make(map[string]fs.DirEntries)
+	var dirs []string
+	for i := range nodes {
+		node := &nodes[i]
+		remote := path.Join(dir, f.opt.Enc.ToStandardPath(strings.TrimPrefix(node.Path, prefix)))
+		if _, ok := byDir[node.ParentPath]; !ok {
+			dirs = append(dirs, node.ParentPath)
+		}
+		switch node.Type {
+		case sdk.NodeTypeFolder:
+			byDir[node.ParentPath] = append(byDir[node.ParentPath], f.newDirectory(ctx, remote, node))
+		case sdk.NodeTypeFile:
+			byDir[node.ParentPath] = append(byDir[node.ParentPath], f.newObject(remote, node))
+		}
+	}
+	for _, removed := range f.removedDirs(spectraPath) {
+		if maxDepth >= 0 && pathDepth(removed) >= maxDepth {
+			continue
+		}
+		if _, ok := byDir[removed]; !ok {
+			dirs = append(dirs, removed)
+		}
+	}
+	for _, moved := range append(f.movedDirs(spectraPath), f.extraDirs(spectraPath)...) {
+		if maxDepth >= 0 && pathDepth(moved) >= maxDepth {
+			continue
+		}
+		if _, ok := byDir[moved]; !ok {
+			dirs = append(dirs, moved)
+			byDir[moved] = nil
+		}
+	}
+	helper := list.NewHelper(callback)
+	for _, parent := range dirs {
+		entries := f.asOfStart(f.fromSpectraPath(parent), parent, byDir[parent])
+		entries, err := f.addExtra(ctx, f.fromSpectraPath(parent), parent, f.dropHidden(f.dropFlaky(parent, entries)))
+		if err != nil {
+			return err
+		}
+		entries, err = f.applyMoves(ctx, f.fromSpectraPath(parent), parent, f.duplicateListed(entries))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := helper.Add(entry); err != nil {
+				return err
 			}
+		}
+	}
+	return helper.Flush()
+}
 
-			obj := &Object{
-				fs:      f,
-				remote:  remote,
-				size:    info.Size(),
-				modTime: info.ModTime(),
+// cacheTree keeps the children of the directory at spectraPath and of
+// every directory below it, all of whose nodes are in nodes, in the
+// node cache
+func (f *Fs) cacheTree(gen uint64, spectraPath string, nodes []sdk.Node) {
+	children := map[string][]*sdk.Node{spectraPath: nil}
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Type == sdk.NodeTypeFolder {
+			if _, ok := children[node.Path]; !ok {
+				children[node.Path] = nil
 			}
-			entries = append(entries, obj)
 		}
+		children[node.ParentPath] = append(children[node.ParentPath], node)
+	}
+	for dir, nodes := range children {
+		f.nodeCache.put(gen, dir, nodes)
+	}
+}
+
+// treeNodes returns the nodes below the directory at spectraPath for
+// ListR, generating them first if needed, or reading them from the
+// manifest when planning a --dry-run
+func (f *Fs) treeNodes(ctx context.Context, spectraPath string, maxDepth int) ([]sdk.Node, error) {
+	if f.planning(ctx) {
+		if err := f.manifestDir(ctx, spectraPath); err != nil {
+			return nil, err
+		}
+		return f.listTreeIn(ctx, f.manifest, spectraPath, maxDepth)
+	}
+	if err := f.coldStart(ctx, spectraPath); err != nil {
+		return nil, err
+	}
+	if spectraPath != "/" {
+		node, err := f.getNode(ctx, spectraPath)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil || node.Type != sdk.NodeTypeFolder {
+			return nil, fs.ErrorDirNotFound
+		}
+	}
+	// Generation only churns if there is something left to generate
+	if err := f.simulateChurn(ctx); err != nil {
+		return nil, err
+	}
+	if f.opt.Lazy {
+		if err := f.generateBelow(ctx, spectraPath, maxDepth, f.listFilter(ctx)); err != nil {
+			return nil, err
+		}
+	}
+	return f.listTree(ctx, spectraPath, maxDepth)
+}
+
+// newObject creates an Object at remote from its Spectra node
+func (f *Fs) newObject(remote string, node *sdk.Node) *Object {
+	spectraPath := f.nodePath(f.toSpectraPath(remote))
+	checksum := ""
+	if node.Checksum != nil && !f.uniqueContent() && !f.isGiant(spectraPath) && !f.drifted(spectraPath) {
+		checksum = *node.Checksum
 	}
+	return &Object{
+		fs:       f,
+		remote:   remote,
+		id:       node.ID,
+		size:     f.fileSize(spectraPath, node.Size),
+		modTime:  node.LastUpdated,
+		checksum: checksum,
+	}
+}
 
-	return entries, nil
+// newDirectory creates a Directory at remote from its Spectra node
+func (f *Fs) newDirectory(ctx context.Context, remote string, node *sdk.Node) *Directory {
+	d := fs.NewDir(remote, f.dirModTime(ctx, node))
+	d.SetID(node.ID)
+	return &Directory{Dir: d, fs: f}
 }
 
 // NewObject finds the Object at remote
-func (f *Fs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+func (f *Fs) NewObject(ctx context.Context, remote string) (_ fs.Object, err error) {
+	defer f.profiled(profNewObject, time.Now(), &err)
+	ctx, done, err := f.beginOp(ctx, opStat)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	f.touch(opStat, remote)
+	if err := f.fault(faultStat, remote); err != nil {
+		return nil, err
+	}
 	spectraPath := f.toSpectraPath(remote)
-
-	// Trigger lazy generation by listing the parent directory
-	parentPath := path.Dir(spectraPath)
-	if parentPath == "." {
-		parentPath = "/"
+	if f.planning(ctx) {
+		return f.manifestObject(ctx, remote, spectraPath)
+	}
+	if err := f.coldStart(ctx, parentPath(spectraPath)); err != nil {
+		return nil, err
 	}
 
-	// List children to ensure lazy generation has occurred
-	result, err := f.spectraSDK.ListChildren(&sdk.ListChildrenRequest{
-		ParentPath: parentPath,
-		TableName:  f.opt.World,
-	})
-	fs.Debugf(nil, "NewObject(%s): ListChildren result.Success=%v, err=%v", remote, result != nil && result.Success, err)
-
-	// Now get the specific node
-	node, err := f.spectraSDK.GetNode(&sdk.GetNodeRequest{
-		Path:      spectraPath,
-		TableName: f.opt.World,
-	})
-	fs.Debugf(nil, "NewObject(%s): GetNode node=%v, err=%v", remote, node != nil, err)
+	if f.movedAway(spectraPath) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	nodePath := f.nodePath(spectraPath)
 
+	// Look the node up via its parent, which also triggers lazy
+	// generation of the parent directory
+	nodes, err := f.getNodes(ctx, nodePath)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "not found") {
-			return nil, fs.ErrorObjectNotFound
-		}
 		return nil, err
 	}
-	if node == nil {
+	node := f.startNode(nodePath, nodes[nodePath])
+	fs.Debugf(nil, "NewObject(%s): node=%v", remote, node != nil)
+	if node == nil || f.hidden[spectraPath] {
 		return nil, fs.ErrorObjectNotFound
 	}
 
-	if node.Type == "folder" {
+	if node.Type == sdk.NodeTypeFolder {
 		return nil, fs.ErrorIsDir
 	}
 
-	checksum := ""
-	if node.Checksum != nil {
-		checksum = *node.Checksum
+	return f.newObject(remote, node), nil
+}
+
+// Put uploads a new object
+func (f *Fs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (_ fs.Object, err error) {
+	defer f.profiled(profPut, time.Now(), &err)
+	if err := f.checkWrite("upload", src.Remote()); err != nil {
+		return nil, err
+	}
+	if err := f.checkName("upload", src.Remote()); err != nil {
+		return nil, err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	f.touch(opWrite, src.Remote())
+	if err := f.fault(faultWrite, src.Remote()); err != nil {
+		return nil, err
+	}
+	// Hash the data as it is read, to check it against the file
+	// committed
+	verify := newStreamSum()
+	in = verify.reader(f.uploadStream(ctx, in))
+	size, cutoff := src.Size(), int64(f.opt.UploadCutoff)
+	var o *Object
+	if f.db != nil && size > cutoff {
+		// Store large files a chunk at a time as they are read
+		o, err = f.putChunked(ctx, in, src, size, verify)
+	} else {
+		limited := in
+		if f.db != nil && size < 0 {
+			// Read streams whole unless they turn out to be large
+			limited = io.LimitReader(in, cutoff+1)
+		}
+		var data []byte
+		data, err = io.ReadAll(limited)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read data: %w", err)
+		}
+		if int64(len(data)) > cutoff && size < 0 && f.db != nil {
+			o, err = f.putChunked(ctx, io.MultiReader(bytes.NewReader(data), in), src, -1, verify)
+		} else {
+			o, err = f.upload(ctx, src.Remote(), data, verify)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := o.putMetadata(ctx, src, options); err != nil {
+		return nil, err
 	}
+	if err := f.journalPut(ctx, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
 
-	return &Object{
-		fs:       f,
-		remote:   remote,
-		size:     node.Size,
-		modTime:  node.LastUpdated,
-		checksum: checksum,
-	}, nil
+// PutStream uploads an object of unknown size, as from rclone rcat
+//
+// Put reads the data before uploading it, or stores it in chunks once
+// it is longer than upload_cutoff, so it doesn't need the size in
+// advance.
+func (f *Fs) PutStream(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	return f.Put(ctx, in, src, options...)
 }
 
-// Put uploads a new object
-func (f *Fs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
-	remote := src.Remote()
+// upload creates the object at remote holding data, creating its
+// parent directories as needed.
+//
+// If verify is set the file committed is checked against the data
+// verify read, and removed again if they differ.
+func (f *Fs) upload(ctx context.Context, remote string, data []byte, verify *streamSum) (*Object, error) {
 	spectraPath := f.toSpectraPath(remote)
+	// The SDK would add a second file of the same name, so a file
+	// already there has its content replaced instead
+	existing, err := f.getNode(ctx, spectraPath)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Type == sdk.NodeTypeFile && !f.movedAway(spectraPath) {
+		return f.uploadOver(ctx, remote, existing, data)
+	}
+	if err := f.checkQuota(ctx, remote, 1, int64(len(data))); err != nil {
+		return nil, err
+	}
 
 	// Ensure parent directory exists
-	parentPath := path.Dir(spectraPath)
-	if parentPath != "/" && parentPath != "." {
-		err := f.Mkdir(ctx, path.Dir(remote))
-		if err != nil && err != fs.ErrorDirExists {
-			return nil, fmt.Errorf("failed to create parent directory: %w", err)
+	if parentPath := path.Dir(spectraPath); parentPath != "/" && parentPath != "." {
+		if err := f.mkParentDir(ctx, remote); err != nil {
+			return nil, err
 		}
 	}
 
-	// Read the data
-	data, err := io.ReadAll(in)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %w", err)
-	}
+	// An extra file shown at the path is replaced by the upload
+	f.forgetExtra(spectraPath)
 
 	// Upload via SDK
 	req := &sdk.UploadFileRequest{
 		ParentPath: path.Dir(spectraPath),
 		TableName:  f.opt.World,
-		Name:       path.Base(remote),
-		Data:       data,
+		Name:       path.Base(spectraPath),
+		Data:       f.sdkData(data),
 	}
 
-	node, err := f.spectraSDK.UploadFile(req)
+	node, err := retryBusy(f.opt.OpTimeout, func() (*sdk.Node, error) {
+		return f.engine.UploadFile(ctx, req)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to upload file: %w", err)
 	}
+	if err := f.isolate(ctx, node.ID); err != nil {
+		return nil, err
+	}
+	checksum, err := f.storeBlob(ctx, node.ID, data)
+	if err != nil {
+		return nil, err
+	}
+	if keeper, ok := f.engine.(contentKeeper); ok && checksum == "" && node.Checksum != nil && keeper.Uploaded(node.ID) {
+		// The engine keeps the content and its checksum itself
+		checksum = *node.Checksum
+	}
+	if err := verify.check(remote, checksum); err != nil {
+		// A provider keeps nothing of a write failing verification
+		if err := f.sdkDeleteNode(ctx, spectraPath); err != nil {
+			fs.Errorf(f, "Failed to remove %q after it failed verification: %v", remote, err)
+		}
+		return nil, err
+	}
+	if err := f.pin(ctx, node.ID); err != nil {
+		return nil, err
+	}
+	size := f.fileSize(spectraPath, node.Size)
+	if f.db != nil {
+		size = int64(len(data))
+	}
 
 	return &Object{
 		fs:      f,
 		remote:  remote,
-		size:    node.Size,
+		id:      node.ID,
+		size:    size,
 		modTime: node.LastUpdated,
 	}, nil
 }
 
-// Mkdir makes the directory
-func (f *Fs) Mkdir(ctx context.Context, dir string) error {
-	if dir == "" {
-		return nil // root always exists
+// uploadOver replaces the content of the file at remote, whose node is
+// existing, with data for upload
+func (f *Fs) uploadOver(ctx context.Context, remote string, existing *sdk.Node, data []byte) (*Object, error) {
+	spectraPath := f.toSpectraPath(remote)
+	if err := f.checkShared(ctx, "update", spectraPath); err != nil {
+		return nil, err
+	}
+	if err := f.checkQuota(ctx, remote, 0, int64(len(data))-f.fileSize(spectraPath, existing.Size)); err != nil {
+		return nil, err
 	}
+	id, size, modTime, err := f.replaceContent(ctx, spectraPath, existing.ID, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.pin(ctx, id); err != nil {
+		return nil, err
+	}
+	return &Object{
+		fs:      f,
+		remote:  remote,
+		id:      id,
+		size:    size,
+		modTime: modTime,
+	}, nil
+}
 
+// Mkdir makes the directory
+func (f *Fs) Mkdir(ctx context.Context, dir string) (err error) {
+	defer f.profiled(profMkdir, time.Now(), &err)
+	defer f.journalled(&err, journalEntry{Op: journalMkdir, Path: f.toSpectraPath(dir)})
+	if err := f.checkWrite("make directory", dir); err != nil {
+		return err
+	}
+	if err := f.checkName("make directory", dir); err != nil {
+		return err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	f.touch(opWrite, dir)
+	if err := f.fault(faultWrite, dir); err != nil {
+		return err
+	}
 	spectraPath := f.toSpectraPath(dir)
-
-	// Check if it already exists
-	fsPath := strings.TrimPrefix(spectraPath, "/")
-	info, err := iofs.Stat(f.spectraFS, fsPath)
-	if err == nil {
-		if info.IsDir() {
-			return nil // already exists
-		}
-		return fs.ErrorIsFile
+	if spectraPath == "/" {
+		return nil // root of the world always exists
 	}
 
-	// Create parent directories first
-	parentPath := path.Dir(dir)
-	if parentPath != "" && parentPath != "." {
-		err := f.Mkdir(ctx, parentPath)
-		if err != nil && err != fs.ErrorDirExists {
-			return err
-		}
+	// Look up the directory and all its parents in one batch
+	var chain []string
+	for p := spectraPath; p != "/"; p = parentPath(p) {
+		chain = append(chain, p)
 	}
-
-	// Create the directory
-	req := &sdk.CreateFolderRequest{
-		ParentPath: path.Dir(spectraPath),
-		TableName:  f.opt.World,
-		Name:       path.Base(dir),
+	slices.Reverse(chain)
+	nodes, err := f.getNodes(ctx, chain...)
+	if err != nil {
+		return err
 	}
 
-	_, err = f.spectraSDK.CreateFolder(req)
-	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			return nil
+	// Create any which are missing from the top down
+	for _, p := range chain {
+		if node, ok := nodes[p]; ok {
+			if node.Type != sdk.NodeTypeFolder {
+				return fs.ErrorIsFile
+			}
+			continue
+		}
+		if f.db != nil {
+			// Share the folder if another world has it
+			shared, err := f.shareFolder(ctx, p)
+			if err != nil {
+				return err
+			}
+			if shared {
+				continue
+			}
+		}
+		node, err := retryBusy(f.opt.OpTimeout, func() (*sdk.Node, error) {
+			return f.engine.CreateFolder(ctx, &sdk.CreateFolderRequest{
+				ParentPath: parentPath(p),
+				TableName:  f.opt.World,
+				Name:       path.Base(p),
+			})
+		})
+		if err != nil {
+			if isExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := f.isolate(ctx, node.ID); err != nil {
+			return err
 		}
-		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	return nil
 }
 
 // Rmdir removes the directory
-func (f *Fs) Rmdir(ctx context.Context, dir string) error {
-	if dir == "" {
-		return fs.ErrorPermissionDenied
+func (f *Fs) Rmdir(ctx context.Context, dir string) (err error) {
+	defer f.profiled(profRmdir, time.Now(), &err)
+	defer f.journalled(&err, journalEntry{Op: journalRmdir, Path: f.toSpectraPath(dir)})
+	if err := f.checkWrite("remove directory", dir); err != nil {
+		return err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	f.touch(opWrite, dir)
+	if err := f.fault(faultDelete, dir); err != nil {
+		return err
 	}
-
 	spectraPath := f.toSpectraPath(dir)
+	if spectraPath == "/" {
+		return fs.ErrorPermissionDenied
+	}
+	recursive := f.opt.RmdirRecursive
+	if err := f.checkDelete(ctx, spectraPath, recursive); err != nil {
+		return err
+	}
 
 	// Check if directory exists and is empty
-	fsPath := strings.TrimPrefix(spectraPath, "/")
-	entries, err := iofs.ReadDir(f.spectraFS, fsPath)
+	node, err := f.getNode(ctx, spectraPath)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	if node == nil || node.Type != sdk.NodeTypeFolder {
+		return fs.ErrorDirNotFound
+	}
+	if !recursive {
+		result, err := f.listChildren(ctx, spectraPath)
+		if err != nil {
+			return err
+		}
+		if result == nil {
 			return fs.ErrorDirNotFound
 		}
-		return err
+		if len(result.Folders)+len(result.Files) > 0 || len(f.movedDirs(spectraPath)) > 0 || len(f.extraDirs(spectraPath)) > 0 {
+			return fs.ErrorDirectoryNotEmpty
+		}
 	}
 
-	if len(entries) > 0 {
-		return fs.ErrorDirectoryNotEmpty
+	// Delete the directory, along with any children which don't
+	// exist in this world so they aren't left orphaned, or with
+	// everything in it if rmdir is recursive
+	if f.db != nil {
+		trees := []string{spectraPath}
+		if recursive {
+			trees = append(trees, f.movedWithin(spectraPath)...)
+		}
+		_, err = f.deleteTrees(ctx, trees...)
+	} else {
+		err = f.sdkDeleteNode(ctx, spectraPath)
 	}
-
-	// Delete the directory
-	req := &sdk.DeleteNodeRequest{
-		Path:      spectraPath,
-		TableName: f.opt.World,
+	if err != nil {
+		if isNotFound(err) {
+			return fs.ErrorDirNotFound
+		}
+		return fmt.Errorf("failed to remove directory: %w", err)
+	}
+	if recursive {
+		f.forgetMovesWithin(spectraPath)
+		f.forgetExtraWithin(spectraPath)
 	}
 
-	err = f.spectraSDK.DeleteNode(req)
+	return nil
+}
+
+// Purge deletes all the files and directories in dir, including dir
+// itself unless it is the root
+//
+// The whole tree is deleted with a single database transaction rather
+// than a delete per node. Files shown moved into the tree by move_rate
+// are deleted with it.
+func (f *Fs) Purge(ctx context.Context, dir string) (err error) {
+	defer f.profiled(profPurge, time.Now(), &err)
+	defer f.journalled(&err, journalEntry{Op: journalPurge, Path: f.toSpectraPath(dir)})
+	if err := f.checkWrite("purge", dir); err != nil {
+		return err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") || strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	defer done()
+	defer f.nodeCache.change()()
+	f.touch(opWrite, dir)
+	if err := f.fault(faultDelete, dir); err != nil {
+		return err
+	}
+	spectraPath := f.toSpectraPath(dir)
+	if err := f.checkDelete(ctx, spectraPath, true); err != nil {
+		return err
+	}
+	if spectraPath != "/" {
+		// Generating the directory if need be, as it may not
+		// have been listed yet
+		node, err := f.getNode(ctx, spectraPath)
+		if err != nil {
+			return err
+		}
+		if node == nil || node.Type != sdk.NodeTypeFolder {
 			return fs.ErrorDirNotFound
 		}
-		return fmt.Errorf("failed to remove directory: %w", err)
 	}
+	deleted, err := f.deleteTrees(ctx, append([]string{spectraPath}, f.movedWithin(spectraPath)...)...)
+	if err != nil {
+		return fmt.Errorf("failed to purge: %w", err)
+	}
+	f.forgetMovesWithin(spectraPath)
+	f.forgetExtraWithin(spectraPath)
+	fs.Debugf(f, "Purge(%q): deleted %d nodes", dir, deleted)
+	return nil
+}
 
+// Shutdown the backend, stopping its background work and closing the
+// database handles and the engine.
+//
+// Everything is closed even if closing something fails, and the first
+// error is returned.
+func (f *Fs) Shutdown(ctx context.Context) (err error) {
+	keep := func(closeErr error) {
+		if err == nil {
+			err = closeErr
+		}
+	}
+	f.stopRewriter()
+	f.stopPrefetch()
+	f.logCosts()
+	keep(f.stopGateway(ctx))
+	if f.manifest != nil {
+		keep(f.manifest.Close())
+	}
+	if f.db != nil {
+		f.checkSoftLimits(ctx, true)
+		if f.readDB != f.db {
+			keep(f.readDB.Close())
+		}
+		keep(f.db.Close())
+	}
+	keep(f.shutdownEngine())
+	keep(f.closeJournal())
+	return err
+}
+
+// shutdownEngine closes the engine if the remote owns it, releasing
+// the Spectra SDK's own connection to the database
+func (f *Fs) shutdownEngine() error {
+	if f.closeEngine == nil {
+		return nil
+	}
+	if err := f.closeEngine(); err != nil {
+		return fmt.Errorf("failed to close engine: %w", err)
+	}
 	return nil
 }
 
+// Directory describes a Spectra directory
+type Directory struct {
+	*fs.Dir
+	fs *Fs
+}
+
+// Inode returns a stable inode number derived from where the
+// directory is shown
+func (d *Directory) Inode() uint64 {
+	return d.fs.pathInode(d.fs.toSpectraPath(d.Remote()))
+}
+
+// pathInode derives a stable 64 bit inode number from the seed and
+// world of the remote and spectraPath, the path an entry is shown at.
+//
+// Node IDs aren't used as the same node is shown at more than one path
+// by extra_count and move_rate, and the SDK makes new IDs each time it
+// opens the database, whereas the path is the same on every mount of a
+// world generated from the same seed.
+//
+// Bit 62 is always set so the numbers can't collide with the small
+// sequential numbers the VFS hands out and bit 63 is clear as the VFS
+// reserves it for its metadata files.
+func (f *Fs) pathInode(spectraPath string) uint64 {
+	return seedHash(f.worldSeed(), "inode", spectraPath)&^(1<<63) | 1<<62
+}
+
 // Check the interfaces are satisfied
 var (
-	_ fs.Fs = (*Fs)(nil)
+	_ fs.Fs          = (*Fs)(nil)
+	_ fs.Commander   = (*Fs)(nil)
+	_ fs.Purger      = (*Fs)(nil)
+	_ fs.Mover       = (*Fs)(nil)
+	_ fs.DirMover    = (*Fs)(nil)
+	_ fs.Copier      = (*Fs)(nil)
+	_ fs.PutStreamer = (*Fs)(nil)
+	_ fs.Shutdowner  = (*Fs)(nil)
+	_ fs.Directory   = (*Directory)(nil)
+	_ fs.Inoder      = (*Directory)(nil)
 )
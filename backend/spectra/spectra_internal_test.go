@@ -0,0 +1,6399 @@
+package spectra
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/mattn/go-sqlite3"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/walk"
+	libhttp "github.com/rclone/rclone/lib/http"
+	"github.com/rclone/rclone/lib/http/serve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTiledReader(t *testing.T) {
+	block := []byte("0123456789")
+	full := bytes.Repeat(block, 5)[:47]
+	for _, test := range []struct {
+		off, end int64
+	}{
+		{0, 47},
+		{0, 0},
+		{3, 7},
+		{9, 11},
+		{10, 47},
+		{46, 47},
+		{47, 47},
+	} {
+		got, err := io.ReadAll(newTiledReader(block, test.off, test.end))
+		require.NoError(t, err)
+		assert.Equal(t, full[test.off:test.end], got, "off=%d end=%d", test.off, test.end)
+	}
+}
+
+func TestTiledReaderStreams(t *testing.T) {
+	block := make([]byte, 1024)
+	for i := range block {
+		block[i] = byte(i)
+	}
+
+	// Reads deep into a giant object start at the offset
+	const off = 5<<30 + 100
+	got := make([]byte, 4)
+	_, err := io.ReadFull(newTiledReader(block, off, off+4), got)
+	require.NoError(t, err)
+	assert.Equal(t, block[100:104], got)
+
+	// Reading the whole of a large object uses constant memory
+	const size = 256 << 20
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	n, err := io.Copy(io.Discard, newTiledReader(block, 0, size))
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestTiledReaderLargeReads(t *testing.T) {
+	block := []byte("0123456789")
+	full := bytes.Repeat(block, 20)
+	for _, off := range []int64{0, 3, 10, 17} {
+		got := make([]byte, 150)
+		n, err := newTiledReader(block, off, 200).Read(got)
+		require.NoError(t, err)
+		assert.Equal(t, min(150, 200-int(off)), n)
+		assert.Equal(t, full[off:off+int64(n)], got[:n], "off=%d", off)
+	}
+}
+
+// TestCheckDownloadMemory checks that rclone check --download compares
+// two multi-GB objects with bounded memory, as both sides are generated
+// as they are read
+func TestCheckDownloadMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("reads multi-GB objects")
+	}
+	ctx := context.Background()
+	for _, content := range []string{contentTiled, contentUnique} {
+		t.Run(content, func(t *testing.T) {
+			m := configmap.Simple{
+				"config_path":       "testdata/spectra-test.json",
+				"engine":            engineMemory,
+				"world":             "primary",
+				"lazy":              "true",
+				"content":           content,
+				"db_compression":    compressionOff,
+				"giant_object_rate": "1",
+				"giant_object_size": "2G",
+			}
+			primary, err := NewFs(ctx, "test", "", m)
+			require.NoError(t, err)
+			m["world"] = "s1"
+			s1, err := NewFs(ctx, "test", "", m)
+			require.NoError(t, err)
+			entries, err := primary.List(ctx, "")
+			require.NoError(t, err)
+			var src, dst fs.Object
+			for _, entry := range entries {
+				if o, ok := entry.(fs.Object); ok {
+					if dst, err = s1.NewObject(ctx, o.Remote()); err == nil {
+						src = o
+						break
+					}
+				}
+			}
+			require.NotNil(t, src, "no file in both worlds")
+			require.Equal(t, int64(2<<30), src.Size())
+
+			// Sample the heap while both objects are read side by side
+			runtime.GC()
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			base, peak := stats.HeapInuse, stats.HeapInuse
+			done := make(chan struct{})
+			sampled := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				ticker := time.NewTicker(5 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						var stats runtime.MemStats
+						runtime.ReadMemStats(&stats)
+						peak = max(peak, stats.HeapInuse)
+					}
+				}
+			}()
+			equal, err := operations.CheckIdenticalDownload(ctx, src, dst)
+			close(done)
+			<-sampled
+			require.NoError(t, err)
+			assert.True(t, equal)
+			assert.Less(t, peak-min(peak, base), uint64(64<<20))
+		})
+	}
+}
+
+func TestTiledSHA256(t *testing.T) {
+	block := []byte("abc")
+	sum, err := tiledSHA256(block, 10)
+	require.NoError(t, err)
+	want := sha256.Sum256([]byte("abcabcabca"))
+	assert.Equal(t, hex.EncodeToString(want[:]), sum)
+
+	_, err = tiledSHA256(nil, 10)
+	assert.Error(t, err)
+}
+
+func TestStreamReader(t *testing.T) {
+	block, err := newContentCipher(0)
+	require.NoError(t, err)
+	full, err := io.ReadAll(newStreamReader(block, 1, 0, 100))
+	require.NoError(t, err)
+	require.Len(t, full, 100)
+
+	// Any range reads the same bytes as reading from the start
+	for _, test := range []struct {
+		off, end int64
+	}{
+		{0, 0},
+		{3, 7},
+		{15, 17},
+		{16, 48},
+		{33, 100},
+		{100, 100},
+	} {
+		got, err := io.ReadAll(newStreamReader(block, 1, test.off, test.end))
+		require.NoError(t, err)
+		assert.Equal(t, full[test.off:test.end], got, "off=%d end=%d", test.off, test.end)
+	}
+
+	// Other nonces and keys give other content
+	other, err := io.ReadAll(newStreamReader(block, 2, 0, 100))
+	require.NoError(t, err)
+	assert.NotEqual(t, full, other)
+	otherKey, err := newContentCipher(1)
+	require.NoError(t, err)
+	other, err = io.ReadAll(newStreamReader(otherKey, 1, 0, 100))
+	require.NoError(t, err)
+	assert.NotEqual(t, full, other)
+
+	// Reads deep into a giant object start at the offset
+	const off = 5<<30 + 100
+	got := make([]byte, 4)
+	_, err = io.ReadFull(newStreamReader(block, 1, off, off+4), got)
+	require.NoError(t, err)
+	assert.Len(t, got, 4)
+}
+
+func TestPathFraction(t *testing.T) {
+	a := pathFraction(42, "giant", "/folder_1/file_1.txt")
+	assert.Equal(t, a, pathFraction(42, "giant", "/folder_1/file_1.txt"))
+	assert.NotEqual(t, a, pathFraction(43, "giant", "/folder_1/file_1.txt"))
+	assert.NotEqual(t, a, pathFraction(42, "other", "/folder_1/file_1.txt"))
+
+	// Check the fractions are spread over [0, 1)
+	n, below := 10000, 0
+	for i := range n {
+		x := pathFraction(1, "giant", fmt.Sprintf("/folder_%d/file_%d.txt", i%7, i))
+		require.True(t, x >= 0 && x < 1)
+		if x < 0.25 {
+			below++
+		}
+	}
+	assert.InDelta(t, 0.25, float64(below)/float64(n), 0.03)
+}
+
+func TestDeriveWorldSeed(t *testing.T) {
+	assert.Equal(t, int64(42), deriveWorldSeed(42, "primary"))
+	s1 := deriveWorldSeed(42, "s1")
+	assert.Equal(t, s1, deriveWorldSeed(42, "s1"))
+	assert.NotEqual(t, int64(42), s1)
+	assert.NotEqual(t, s1, deriveWorldSeed(42, "s2"))
+	assert.NotEqual(t, s1, deriveWorldSeed(43, "s1"))
+}
+
+func TestInode(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	o := firstObject(ctx, t, f).(*Object)
+	a := o.Inode()
+	assert.Equal(t, uint64(1<<62), a&(3<<62))
+
+	// The same on every mount
+	again, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	other, err := again.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, a, other.(*Object).Inode())
+
+	// But not for the same node shown at another path
+	node, err := f.getNode(ctx, f.toSpectraPath(o.Remote()))
+	require.NoError(t, err)
+	assert.NotEqual(t, a, f.newObject(o.Remote()+".extra", node).Inode())
+
+	// Or in another world
+	m["world"] = "s1"
+	s1, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	assert.NotEqual(t, a, s1.(*Fs).pathInode(f.toSpectraPath(o.Remote())))
+
+	// Directories have them too
+	d := &Directory{Dir: fs.NewDir("dir", time.Time{}), fs: f}
+	assert.NotEqual(t, a, d.Inode())
+	assert.Equal(t, f.pathInode("/dir"), d.Inode())
+}
+
+func TestFormatResult(t *testing.T) {
+	stats := &lsStats{
+		Dirs:        1,
+		Files:       2,
+		Bytes:       2048,
+		ByExtension: []extensionStats{{Extension: ".txt", sizeCount: sizeCount{Files: 2, Bytes: 2048}}},
+	}
+
+	out, err := formatResult(stats, map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, stats, out)
+
+	out, err = formatResult(stats, map[string]string{"format": "CSV"})
+	require.NoError(t, err)
+	assert.Equal(t, "section,key,dirs,files,bytes\ntotal,,1,2,2048\nextension,.txt,,2,2048\n", out)
+
+	_, err = formatResult("text", map[string]string{"format": "csv"})
+	assert.Error(t, err)
+	_, err = formatResult(stats, map[string]string{"format": "parquet"})
+	assert.Error(t, err)
+}
+
+func TestIntOpt(t *testing.T) {
+	i, err := intOpt(map[string]string{}, "max-depth", -1)
+	require.NoError(t, err)
+	assert.Equal(t, -1, i)
+	i, err = intOpt(map[string]string{"max-depth": ""}, "max-depth", -1)
+	require.NoError(t, err)
+	assert.Equal(t, -1, i)
+	i, err = intOpt(map[string]string{"max-depth": "2"}, "max-depth", -1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, i)
+	_, err = intOpt(map[string]string{"max-depth": "potato"}, "max-depth", -1)
+	assert.ErrorContains(t, err, `bad value for "max-depth"`)
+}
+
+func TestLsStats(t *testing.T) {
+	ctx := context.Background()
+	newRemote := func(root string) *Fs {
+		fsys, err := NewFs(ctx, "test", root, configmap.Simple{
+			"config_path":    "testdata/spectra-test.json",
+			"engine":         engineMemory,
+			"world":          "primary",
+			"lazy":           "true",
+			"db_compression": compressionOff,
+		})
+		require.NoError(t, err)
+		return fsys.(*Fs)
+	}
+	f := newRemote("")
+	out, err := f.Command(ctx, "ls-stats", nil, nil)
+	require.NoError(t, err)
+	stats := out.(*lsStats)
+	assert.Positive(t, stats.Files)
+	require.NotEmpty(t, stats.ByDepth)
+	assert.Equal(t, 0, stats.ByDepth[0].Depth)
+	assert.Equal(t, int64(1), stats.ByDepth[0].Dirs)
+
+	// Depths are counted from the root of the remote
+	var dir string
+	var files int64
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if _, ok := entry.(fs.Directory); ok && dir == "" {
+			dir = entry.Remote()
+		}
+	}
+	require.NotEmpty(t, dir)
+	entries, err = f.List(ctx, dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if _, ok := entry.(fs.Object); ok {
+			files++
+		}
+	}
+	sub := newRemote(dir)
+	out, err = sub.Command(ctx, "ls-stats", nil, map[string]string{"max-depth": "1"})
+	require.NoError(t, err)
+	subStats := out.(*lsStats)
+	assert.Equal(t, int64(1), subStats.Dirs)
+	assert.Equal(t, 0, subStats.MaxDepth)
+	assert.Equal(t, []depthStats{
+		{Depth: 0, Dirs: 1},
+		{Depth: 1, sizeCount: sizeCount{Files: files, Bytes: subStats.Bytes}},
+	}, subStats.ByDepth)
+	assert.Equal(t, files, subStats.Files)
+
+	// The same statistics as CSV
+	out, err = f.Command(ctx, "ls-stats", nil, map[string]string{"format": "csv"})
+	require.NoError(t, err)
+	lines := strings.Split(out.(string), "\n")
+	require.Greater(t, len(lines), 2)
+	assert.Equal(t, "section,key,dirs,files,bytes", lines[0])
+	assert.Equal(t, fmt.Sprintf("total,,%d,%d,%d", stats.Dirs, stats.Files, stats.Bytes), lines[1])
+	assert.Contains(t, lines, "depth,0,1,0,0")
+
+	_, err = f.Command(ctx, "ls-stats", nil, map[string]string{"max-depth": "potato"})
+	assert.Error(t, err)
+}
+
+func TestCoalescer(t *testing.T) {
+	var calls atomic.Int32
+	fn := func() (int, error) {
+		return int(calls.Add(1)), nil
+	}
+
+	// Disabled calls straight through
+	c := newCoalescer[int](0)
+	for i := range 3 {
+		got, err := c.do("a", fn)
+		require.NoError(t, err)
+		assert.Equal(t, i+1, got)
+	}
+
+	// Concurrent calls with the same key share one result
+	calls.Store(0)
+	c = newCoalescer[int](50 * time.Millisecond)
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := "a"
+			if i%2 == 1 {
+				key = "b"
+			}
+			results[i], _ = c.do(key, fn)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), calls.Load())
+	for i := 2; i < len(results); i++ {
+		assert.Equal(t, results[i%2], results[i])
+	}
+	assert.NotEqual(t, results[0], results[1])
+	assert.Empty(t, c.pending)
+}
+
+func TestParseLatencyDist(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want latencyDist
+		err  bool
+	}{
+		{in: "", want: latencyDist{}},
+		{in: "20ms", want: latencyDist{kind: "fixed", a: 20 * time.Millisecond}},
+		{in: "fixed:1s", want: latencyDist{kind: "fixed", a: time.Second}},
+		{in: "uniform:10ms, 50ms", want: latencyDist{kind: "uniform", a: 10 * time.Millisecond, b: 50 * time.Millisecond}},
+		{in: "normal:20ms,5ms", want: latencyDist{kind: "normal", a: 20 * time.Millisecond, b: 5 * time.Millisecond}},
+		{in: "exp:30ms", want: latencyDist{kind: "exp", a: 30 * time.Millisecond}},
+		{in: "uniform:50ms,10ms", err: true},
+		{in: "uniform:10ms", err: true},
+		{in: "exp:1ms,2ms", err: true},
+		{in: "pareto:1ms", err: true},
+		{in: "soon", err: true},
+	} {
+		got, err := parseLatencyDist(test.in)
+		if test.err {
+			assert.Error(t, err, test.in)
+			continue
+		}
+		require.NoError(t, err, test.in)
+		assert.Equal(t, test.want, got, test.in)
+	}
+}
+
+func TestLatencyDistSample(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	assert.Equal(t, time.Duration(0), latencyDist{}.sample(rng))
+	assert.Equal(t, time.Second, latencyDist{kind: "fixed", a: time.Second}.sample(rng))
+	uniform := latencyDist{kind: "uniform", a: 10 * time.Millisecond, b: 20 * time.Millisecond}
+	normal := latencyDist{kind: "normal", a: time.Millisecond, b: 10 * time.Millisecond}
+	exp := latencyDist{kind: "exp", a: 10 * time.Millisecond}
+	var sum time.Duration
+	const n = 10000
+	for range n {
+		d := uniform.sample(rng)
+		require.True(t, d >= 10*time.Millisecond && d <= 20*time.Millisecond)
+		require.True(t, normal.sample(rng) >= 0)
+		sum += exp.sample(rng)
+	}
+	assert.InDelta(t, float64(10*time.Millisecond), float64(sum/n), float64(time.Millisecond))
+}
+
+func TestLatencyTrace(t *testing.T) {
+	dir := t.TempDir()
+	trace := filepath.Join(dir, "trace.csv")
+	require.NoError(t, os.WriteFile(trace, []byte("op,latency\n# observed\nread,0.25\nread, 100ms\n\nlist,5ms\n"), 0600))
+	latencies, err := parseLatencies(&Options{LatencyTrace: trace, LatencyWrite: "1s"})
+	require.NoError(t, err)
+	assert.Equal(t, latencyDist{kind: "trace", samples: []time.Duration{250 * time.Millisecond, 100 * time.Millisecond}}, latencies[opRead])
+	assert.Equal(t, latencyDist{kind: "trace", samples: []time.Duration{5 * time.Millisecond}}, latencies[opList])
+	assert.Equal(t, latencyDist{kind: "fixed", a: time.Second}, latencies[opWrite])
+	assert.Equal(t, latencyDist{}, latencies[opStat])
+
+	// Only the latencies observed are replayed
+	rng := rand.New(rand.NewPCG(1, 2))
+	seen := map[time.Duration]bool{}
+	for range 100 {
+		seen[latencies[opRead].sample(rng)] = true
+	}
+	assert.Equal(t, map[time.Duration]bool{250 * time.Millisecond: true, 100 * time.Millisecond: true}, seen)
+
+	for _, bad := range []string{"rename,1s\n", "read\n", "read,soon\n", "read,-1s\n", "# nothing\n"} {
+		require.NoError(t, os.WriteFile(trace, []byte(bad), 0600))
+		_, err := parseLatencies(&Options{LatencyTrace: trace})
+		assert.Error(t, err, bad)
+	}
+	_, err = parseLatencies(&Options{LatencyTrace: filepath.Join(dir, "missing.csv")})
+	assert.Error(t, err)
+}
+
+func TestThrottle(t *testing.T) {
+	opt := &Options{World: "primary", MaxReadQPS: 2}
+	f := &Fs{opt: *opt, qps: getQPSLimiters("test.db", opt)}
+	assert.Same(t, f.qps, getQPSLimiters("test.db", opt))
+
+	// Writes aren't capped
+	for range 10 {
+		require.NoError(t, f.throttle(opWrite))
+	}
+
+	// Reads are allowed up to the burst then throttled
+	require.NoError(t, f.throttle(opList))
+	require.NoError(t, f.throttle(opRead))
+	err := f.throttle(opStat)
+	require.Error(t, err)
+	assert.True(t, fserrors.ShouldRetry(err))
+	assert.True(t, fserrors.IsRetryError(err))
+	assert.True(t, fserrors.IsRetryAfterError(err))
+	retryAfter := fserrors.RetryAfterErrorTime(err)
+	assert.WithinDuration(t, time.Now().Add(500*time.Millisecond), retryAfter, 100*time.Millisecond)
+}
+
+func TestConcurrencyPools(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["max_metadata_concurrency"] = "1"
+	m["max_read_concurrency"] = "1"
+	m["max_write_concurrency"] = "1"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	o := firstObject(ctx, t, fsys)
+
+	// A read holds its slot until closed
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = o.Open(short)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Other pools aren't held up by it
+	_, err = fsys.List(ctx, "")
+	require.NoError(t, err)
+	content := []byte("pooled")
+	src := object.NewStaticObjectInfo("new/dir/file.txt", time.Now(), int64(len(content)), true, nil, fsys)
+	_, err = fsys.Put(ctx, bytes.NewReader(content), src)
+	require.NoError(t, err, "the directories made by the upload use its slot")
+
+	require.NoError(t, in.Close())
+	require.NoError(t, in.Close())
+	in, err = o.Open(ctx)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+
+	report := f.contentionReport()
+	require.Len(t, report.Ops, 3)
+	for _, p := range report.Ops {
+		assert.Equal(t, 1, p.Open, p.Pool)
+		assert.Equal(t, 0, p.InUse, p.Pool)
+		if p.Pool == "read" {
+			assert.Equal(t, int64(1), p.Waits)
+			assert.Greater(t, p.WaitSeconds, 0.0)
+		} else {
+			assert.Equal(t, int64(0), p.Waits, p.Pool)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	mem, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	f := &Fs{engine: mem}
+	f.opt.World = "primary"
+	f.opt.ColdBandwidth = 1024
+	assert.Equal(t, int64(0), f.readBandwidth("/file_1.txt"))
+	in := bytes.NewReader(nil)
+	assert.Same(t, in, f.uploadStream(context.Background(), in))
+
+	// Cold objects are read at the lower of the limits
+	f.opt.StreamBandwidth = 4096
+	assert.Equal(t, int64(4096), f.readBandwidth("/file_1.txt"))
+	f.opt.ColdObjectRate = 1
+	assert.Equal(t, int64(1024), f.readBandwidth("/file_1.txt"))
+	f.opt.StreamBandwidth = 512
+	assert.Equal(t, int64(512), f.readBandwidth("/file_1.txt"))
+
+	// Uploads are limited too
+	start := time.Now()
+	data, err := io.ReadAll(f.uploadStream(context.Background(), bytes.NewReader(make([]byte, 1024))))
+	require.NoError(t, err)
+	assert.Len(t, data, 1024)
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestLoadDigests(t *testing.T) {
+	got, err := loadDigests("")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	got, err = loadDigests(" xxh3,sha256, blake3 ")
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+	assert.Equal(t, hash.XXH3, got[hash.XXH3].Type())
+	assert.Equal(t, hash.BLAKE3, got[hash.BLAKE3].Type())
+
+	_, err = loadDigests("potato")
+	assert.Error(t, err)
+
+	sum, err := NewHashDigest(hash.MD5).Sum(bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", sum)
+}
+
+func TestLoadHashes(t *testing.T) {
+	got := map[hash.Type]Digest{}
+	withSHA256, err := loadHashes(" md5, sha256 ,crc32", got)
+	require.NoError(t, err)
+	assert.True(t, withSHA256)
+	assert.Len(t, got, 2)
+	assert.Equal(t, hash.CRC32, got[hash.CRC32].Type())
+
+	got = map[hash.Type]Digest{}
+	withSHA256, err = loadHashes("none", got)
+	require.NoError(t, err)
+	assert.False(t, withSHA256)
+	assert.Empty(t, got)
+
+	_, err = loadHashes("potato", got)
+	assert.ErrorContains(t, err, "hashes:")
+}
+
+func TestHashes(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+		"hashes":         "md5,crc32",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, hash.NewHashSet(hash.MD5, hash.CRC32), fsys.Hashes())
+
+	var o fs.Object
+	entries, err := fsys.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if x, ok := entry.(fs.Object); ok {
+			o = x
+			break
+		}
+	}
+	require.NotNil(t, o)
+	_, err = o.Hash(ctx, hash.SHA256)
+	assert.ErrorIs(t, err, hash.ErrUnsupported)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	hasher, err := hash.NewMultiHasherTypes(fsys.Hashes())
+	require.NoError(t, err)
+	_, err = io.Copy(hasher, in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	for _, ty := range []hash.Type{hash.MD5, hash.CRC32} {
+		sum, err := o.Hash(ctx, ty)
+		require.NoError(t, err)
+		want, err := hasher.SumString(ty, false)
+		require.NoError(t, err)
+		assert.Equal(t, want, sum)
+	}
+}
+
+func TestHashAll(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["hashes"] = "md5,sha256"
+	m["drift_rate"] = "1"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	o := firstObject(ctx, t, fsys).(*Object)
+	want, err := o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	_, ok := f.storedHash(ctx, o.ID(), hash.MD5)
+	assert.False(t, ok)
+
+	out, err := f.Command(ctx, "hash-all", nil, nil)
+	require.NoError(t, err)
+	result := out.(hashAllResult)
+	assert.Equal(t, []string{"md5", "sha256"}, result.Types)
+	assert.Greater(t, result.Files, int64(0))
+	assert.Equal(t, 2*result.Files, result.Hashes, "drifted files have their SHA-256 stored too")
+	got, ok := f.storedHash(ctx, o.ID(), hash.MD5)
+	assert.True(t, ok)
+	assert.Equal(t, want, got)
+	_, ok = f.storedHash(ctx, o.ID(), hash.SHA256)
+	assert.True(t, ok)
+
+	// Hashes of other content aren't used
+	f.opt.DriftEpoch++
+	_, ok = f.storedHash(ctx, o.ID(), hash.MD5)
+	assert.False(t, ok)
+	f.opt.DriftEpoch--
+	content := []byte("new content")
+	src := object.NewStaticObjectInfo(o.Remote(), time.Now(), int64(len(content)), true, nil, fsys)
+	require.NoError(t, o.Update(ctx, bytes.NewReader(content), src))
+	_, ok = f.storedHash(ctx, o.ID(), hash.MD5)
+	assert.False(t, ok)
+}
+
+func TestResolveHashType(t *testing.T) {
+	ty, err := resolveHashType("quickxor")
+	require.NoError(t, err)
+	assert.Equal(t, "quickxor", ty.String())
+	again, err := resolveHashType("QuickXorHash")
+	require.NoError(t, err)
+	assert.Equal(t, ty, again)
+
+	// Known answer from the OneDrive documentation
+	sum, err := NewHashDigest(ty).Sum(bytes.NewBufferString(""))
+	require.NoError(t, err)
+	assert.Equal(t, "0000000000000000000000000000000000000000", sum)
+
+	ty, err = resolveHashType("dropbox")
+	require.NoError(t, err)
+	assert.Equal(t, "dropbox", ty.String())
+
+	// Dropbox hashes 4 MiB blocks then hashes the block hashes
+	block := bytes.Repeat([]byte{'x'}, 4*1024*1024)
+	blockSum := sha256.Sum256(block)
+	want := sha256.Sum256(append(blockSum[:], blockSum[:]...))
+	sum, err = NewHashDigest(ty).Sum(bytes.NewReader(append(block, block...)))
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(want[:]), sum)
+
+	_, err = resolveHashType("potato")
+	assert.Error(t, err)
+}
+
+func TestPathDepth(t *testing.T) {
+	assert.Equal(t, 0, pathDepth("/"))
+	assert.Equal(t, 1, pathDepth("/folder_1"))
+	assert.Equal(t, 3, pathDepth("/folder_1/folder_2/file_1.txt"))
+}
+
+func TestCostReport(t *testing.T) {
+	f := &Fs{opt: Options{CostList: 5, CostRead: 0.4, CostEgress: 0.09}}
+	assert.True(t, f.opt.costed())
+	f.costs.requests[opList].Add(200)
+	f.costs.requests[opRead].Add(3)
+	f.costs.requests[opWrite].Add(7)
+	f.costs.egress.Add(2 << 30)
+	r := f.costReport()
+	assert.Equal(t, int64(200), r.Requests["list"])
+	assert.Equal(t, int64(7), r.Requests["write"])
+	assert.Equal(t, 1.0, r.Spend["list"])
+	assert.Equal(t, 0.0012, r.Spend["read"])
+	assert.Equal(t, 0.0, r.Spend["write"])
+	assert.Equal(t, 0.18, r.Spend["egress"])
+	assert.Equal(t, 1.1812, r.Total)
+	assert.False(t, (&Options{}).costed())
+}
+
+func TestBudget(t *testing.T) {
+	ctx := context.Background()
+	newBudget := func(calls, bytes string) fs.Fs {
+		fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+			"config_path":    "testdata/spectra-test.json",
+			"engine":         engineMemory,
+			"world":          "primary",
+			"lazy":           "true",
+			"db_compression": compressionOff,
+			"max_api_calls":  calls,
+			"max_read_bytes": bytes,
+		})
+		require.NoError(t, err)
+		return fsys
+	}
+
+	// Calls over the budget fail and stop rclone
+	fsys := newBudget("2", "0")
+	o := firstObject(ctx, t, fsys)
+	_, err := fsys.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	_, err = fsys.List(ctx, "")
+	var budgetErr *budgetError
+	require.ErrorAs(t, err, &budgetErr)
+	assert.ErrorContains(t, err, "max_api_calls")
+	assert.True(t, fserrors.IsFatalError(err))
+
+	// Data is served up to the budget and no further
+	fsys = newBudget("0", "1500B")
+	o = firstObject(ctx, t, fsys)
+	require.Equal(t, int64(1024), o.Size())
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Len(t, data, 1024)
+	require.NoError(t, in.Close())
+	in, err = o.Open(ctx)
+	require.NoError(t, err)
+	data, err = io.ReadAll(in)
+	require.ErrorAs(t, err, &budgetErr)
+	assert.ErrorContains(t, err, "max_read_bytes")
+	assert.Len(t, data, 1500-1024)
+	require.NoError(t, in.Close())
+}
+
+func TestTune(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["fault_ops"] = faultList
+	m["fault_error_types"] = fault5xx
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	_, err = f.List(ctx, "")
+	require.NoError(t, err)
+
+	// Faults and latencies start and stop without a restart
+	out, err := f.Command(ctx, "tune", nil, map[string]string{"fault_error_rate": "1", "latency_stat": "uniform:1ms,2ms"})
+	require.NoError(t, err)
+	r := out.(*tuneReport)
+	assert.Equal(t, 1.0, r.FaultErrorRate)
+	assert.Equal(t, "uniform:1ms,2ms", r.Latency["stat"])
+	assert.Equal(t, "", r.Latency["list"])
+	_, err = f.List(ctx, "")
+	var faultErr *faultError
+	assert.ErrorAs(t, err, &faultErr)
+	_, err = f.tune(ctx, map[string]string{"fault_error_rate": "0"})
+	require.NoError(t, err)
+	_, err = f.List(ctx, "")
+	assert.NoError(t, err)
+
+	// Nothing changes unless every value is good
+	for _, bad := range []map[string]string{
+		{"fault_error_rate": "2"},
+		{"stream_bandwidth": "1M", "latency_read": "soon"},
+		{"growth_rate": "-1"},
+		{"drift_rate": "0.5"},
+	} {
+		_, err = f.tune(ctx, bad)
+		assert.Error(t, err, bad)
+	}
+	assert.Equal(t, "0", f.tuneReport().StreamBandwidth)
+
+	// Churn started part way through a run carries on from then
+	// rather than catching up with the time since the start
+	f.churn.start = time.Now().Add(-time.Hour)
+	_, err = f.tune(ctx, map[string]string{"growth_rate": "10"})
+	require.NoError(t, err)
+	require.NoError(t, f.simulateChurn(ctx))
+	assert.Less(t, f.churn.grown, int64(10))
+	f.churn.start = f.churn.start.Add(-time.Second)
+	require.NoError(t, f.simulateChurn(ctx))
+	assert.GreaterOrEqual(t, f.churn.grown, int64(10))
+
+	// Churn needs an on disk database
+	mem, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	})
+	require.NoError(t, err)
+	_, err = mem.(*Fs).tune(ctx, map[string]string{"growth_rate": "1"})
+	assert.ErrorContains(t, err, "on disk database")
+}
+
+// testClock is a clock which only moves when the test moves it
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func TestClock(t *testing.T) {
+	ctx := context.Background()
+
+	// The scaled clock runs time_scale times as fast as the wall clock
+	_, err := newClock(-1)
+	assert.Error(t, err)
+	c, err := newClock(3600)
+	require.NoError(t, err)
+	wall := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	assert.Greater(t, c.Now().Sub(wall), 30*time.Second)
+	select {
+	case <-c.After(time.Minute):
+	case <-time.After(5 * time.Second):
+		t.Fatal("a minute at 3600x took more than 5s")
+	}
+
+	m := diskConfig(t)
+	m["time_scale"] = "-2"
+	_, err = NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "time_scale")
+
+	// Churn runs and stamps the files it adds in simulated time
+	m = diskConfig(t)
+	m["growth_rate"] = "0.0001"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	f.clock = clock
+	f.churn.start = start
+	_, err = f.List(ctx, "")
+	require.NoError(t, err)
+	clock.now = start.Add(48 * time.Hour)
+	require.NoError(t, f.simulateChurn(ctx))
+	assert.Equal(t, int64(17), f.churn.grown)
+	var grown int
+	require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			if strings.HasPrefix(path.Base(entry.Remote()), "grown_") {
+				grown++
+				assert.True(t, entry.ModTime(ctx).Equal(clock.now), entry.Remote())
+			}
+		}
+		return nil
+	}))
+	assert.Equal(t, 17, grown)
+
+	// Restores are ready and expire in simulated time
+	require.NoError(t, f.initRestores(ctx))
+	f.opt.RestoreDelay = fs.Duration(5 * time.Hour)
+	_, err = f.restore(ctx, "/file.txt", time.Hour)
+	require.NoError(t, err)
+	assert.ErrorContains(t, f.checkRestored(ctx, "/file.txt"), "restore in progress: ready in 5h0m0s")
+	clock.now = clock.now.Add(5 * time.Hour)
+	assert.NoError(t, f.checkRestored(ctx, "/file.txt"))
+	clock.now = clock.now.Add(time.Hour)
+	assert.ErrorContains(t, f.checkRestored(ctx, "/file.txt"), "object is archived")
+}
+
+func TestMemEngine(t *testing.T) {
+	ctx := context.Background()
+	// Walk the tree depth first listing each folder, in forward or
+	// reverse order, returning the paths of the nodes in world
+	walkTree := func(e *memEngine, world string, reverse bool) (paths []string) {
+		queue := []string{"/"}
+		for len(queue) > 0 {
+			dir := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			result, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: dir, TableName: world})
+			require.NoError(t, err)
+			require.True(t, result.Success, result.Message)
+			for _, folder := range result.Folders {
+				paths = append(paths, folder.Path)
+				queue = append(queue, folder.Path)
+			}
+			for _, file := range result.Files {
+				paths = append(paths, file.Path)
+			}
+			if reverse {
+				slices.Reverse(queue)
+			}
+		}
+		slices.Sort(paths)
+		return paths
+	}
+	a, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	b, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	assert.Equal(t, walkTree(a, "primary", false), walkTree(b, "primary", true))
+	assert.Equal(t, walkTree(a, "s2", false), walkTree(b, "s2", true))
+
+	// Uploaded content is kept and deleted with its folder
+	folder, err := a.CreateFolder(ctx, &sdk.CreateFolderRequest{ParentPath: "/", TableName: "primary", Name: "up"})
+	require.NoError(t, err)
+	file, err := a.UploadFile(ctx, &sdk.UploadFileRequest{ParentPath: "/up", TableName: "primary", Name: "x.txt", Data: []byte("hello")})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), file.Size)
+	data, _, err := a.GetFileData(ctx, file.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	_, err = a.UploadFile(ctx, &sdk.UploadFileRequest{ParentPath: "/up", TableName: "primary", Name: "x.txt", Data: []byte("again")})
+	assert.ErrorContains(t, err, "already exists")
+	assert.ErrorIs(t, err, iofs.ErrExist)
+	replaced, err := a.ReplaceFile(file.ID, []byte("replaced"))
+	require.NoError(t, err)
+	assert.Equal(t, file.ID, replaced.ID)
+	assert.Equal(t, int64(8), replaced.Size)
+	data, _, err = a.GetFileData(ctx, file.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "replaced", string(data))
+	_, err = a.ReplaceFile(folder.ID, []byte("x"))
+	assert.Error(t, err)
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	node, err := a.SetModTime(file.ID, modTime)
+	require.NoError(t, err)
+	assert.Equal(t, modTime, node.LastUpdated)
+	require.NoError(t, a.SetAttributes(file.ID, map[string]string{"color": "blue"}))
+	attrs, err := a.Attributes(file.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"color": "blue"}, attrs)
+	require.NoError(t, a.DeleteNode(ctx, &sdk.DeleteNodeRequest{ID: folder.ID}))
+	_, err = a.GetNode(ctx, &sdk.GetNodeRequest{Path: "/up/x.txt", TableName: "primary"})
+	assert.ErrorContains(t, err, "not found")
+	assert.ErrorIs(t, err, iofs.ErrNotExist)
+	assert.Error(t, a.DeleteNode(ctx, &sdk.DeleteNodeRequest{Path: "/", TableName: "primary"}))
+
+	// Reset generates a new tree from a new seed
+	before := walkTree(a, "primary", false)
+	a.GetConfig().Seed.Seed++
+	require.NoError(t, a.Reset(ctx))
+	b.GetConfig().Seed.Seed++
+	require.NoError(t, b.Reset(ctx))
+	assert.Equal(t, walkTree(a, "primary", false), walkTree(b, "primary", true))
+	assert.NotEqual(t, before, walkTree(a, "primary", false))
+}
+
+func TestFanoutPattern(t *testing.T) {
+	ctx := context.Background()
+	// files returns the number of files in each directory of f
+	var files func(f fs.Fs, dir string, counts map[string]int)
+	files = func(f fs.Fs, dir string, counts map[string]int) {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		counts[dir] = 0
+		for _, entry := range entries {
+			switch entry.(type) {
+			case fs.Object:
+				counts[dir]++
+			case fs.Directory:
+				files(f, entry.Remote(), counts)
+			}
+		}
+	}
+	tree := func(pattern string) map[string]int {
+		fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+			"config_path":    "testdata/spectra-test.json",
+			"engine":         engineMemory,
+			"world":          "primary",
+			"lazy":           "true",
+			"db_compression": compressionOff,
+			"fanout_pattern": pattern,
+		})
+		require.NoError(t, err)
+		counts := map[string]int{}
+		files(fsys, "", counts)
+		return counts
+	}
+
+	// Every directory above max_depth gets the middle of the ranges
+	balanced := tree(fanoutBalanced)
+	assert.Len(t, balanced, 1+2+4+8)
+	for dir, n := range balanced {
+		if strings.Count(dir, "/") < 2 {
+			assert.Equal(t, 3, n, dir)
+		}
+	}
+
+	// One directory gets a hundred times the files
+	hotspot := tree(fanoutHotspot)
+	assert.Len(t, hotspot, len(balanced))
+	var hot []string
+	for dir, n := range hotspot {
+		if n == 300 {
+			hot = append(hot, dir)
+		}
+	}
+	assert.Len(t, hot, 1)
+
+	// Most of the files are in a few directories
+	skewed := tree(fanoutSkewed)
+	var total, heavy, heavyDirs int
+	for _, n := range skewed {
+		total += n
+		if n == 27 {
+			heavy += n
+			heavyDirs++
+		}
+	}
+	assert.Greater(t, heavy, total*8/10)
+	assert.Less(t, heavyDirs, len(skewed)/5)
+
+	// The same tree is generated every time
+	assert.Equal(t, skewed, tree(fanoutSkewed))
+	assert.Equal(t, hotspot, tree(fanoutHotspot))
+
+	// Only the memory engine picks the counts
+	assert.NoError(t, checkFanout(&Options{Engine: engineSDK, FanoutPattern: fanoutUniform}))
+	assert.Error(t, checkFanout(&Options{Engine: engineSDK, FanoutPattern: fanoutSkewed}))
+	assert.Error(t, checkFanout(&Options{Engine: engineMemory, FanoutPattern: "zipf"}))
+}
+
+func TestTypedError(t *testing.T) {
+	assert.NoError(t, typedError(nil))
+
+	// The SDK's messages for missing and existing nodes
+	for _, msg := range []string{
+		"node not found with path /folder_0: sql: no rows in result set",
+		"Parent node not found",
+		"Node does not exist in world s1",
+	} {
+		err := typedError(errors.New(msg))
+		assert.ErrorIs(t, err, iofs.ErrNotExist, msg)
+		assert.NotErrorIs(t, err, iofs.ErrExist, msg)
+		assert.Equal(t, msg, err.Error())
+		assert.True(t, isNotFound(errors.New(msg)), msg)
+	}
+	err := typedError(fmt.Errorf("failed to get node: %w", sql.ErrNoRows))
+	assert.ErrorIs(t, err, iofs.ErrNotExist)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	err = typedError(errors.New("folder with name folder_0 already exists"))
+	assert.ErrorIs(t, err, iofs.ErrExist)
+	assert.True(t, isExist(err))
+	assert.False(t, isNotFound(err))
+
+	// Errors already typed and other errors are left alone
+	typed := newEngineError(iofs.ErrNotExist, "no node with id %q", "x")
+	assert.Same(t, typed, typedError(typed))
+	other := errors.New("database is locked")
+	assert.Same(t, other, typedError(other))
+	assert.False(t, isNotFound(other))
+	assert.False(t, isExist(other))
+
+	// Failed listings are typed by their message
+	assert.NoError(t, resultError(&sdk.ListResult{Success: true}))
+	err = resultError(&sdk.ListResult{Message: "Parent node not found"})
+	assert.ErrorIs(t, err, iofs.ErrNotExist)
+	assert.EqualError(t, err, "Parent node not found")
+}
+
+// gatedEngine is an engine whose GetFileData waits to be released,
+// counting the calls made
+type gatedEngine struct {
+	engine
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+// GetFileData returns the data block of a file once released
+func (e *gatedEngine) GetFileData(ctx context.Context, id string) ([]byte, string, error) {
+	e.calls.Add(1)
+	<-e.release
+	return e.engine.GetFileData(ctx, id)
+}
+
+func TestFault(t *testing.T) {
+	mem, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	newFault := func(rate float64, ops, types fs.CommaSepList) *Fs {
+		f := &Fs{engine: mem, tries: make(map[string]int)}
+		f.opt.World = "primary"
+		f.opt.FaultErrorRate = rate
+		f.opt.FaultOps = ops
+		f.opt.FaultErrorTypes = types
+		require.NoError(t, checkFaults(&f.opt))
+		return f
+	}
+	all := fs.CommaSepList{faultList, faultStat, faultRead, faultWrite, faultDelete}
+	retried := fs.CommaSepList{faultTimeout, fault5xx}
+
+	// The same attempts fail every time and retries can succeed
+	attempts := func(f *Fs) (errs []string) {
+		for i := range 100 {
+			err := f.fault(faultRead, fmt.Sprintf("file_%d.txt", i%10))
+			errs = append(errs, fmt.Sprint(err))
+		}
+		return errs
+	}
+	first := attempts(newFault(0.5, all, retried))
+	assert.Equal(t, first, attempts(newFault(0.5, all, retried)))
+	var failed int
+	for _, err := range first {
+		if err != "<nil>" {
+			failed++
+		}
+	}
+	assert.InDelta(t, 50, failed, 20)
+
+	// Timeouts and server errors are retried, missing objects aren't
+	f := newFault(1, all, retried)
+	err = f.fault(faultWrite, "a")
+	var faultErr *faultError
+	require.ErrorAs(t, err, &faultErr)
+	assert.True(t, fserrors.ShouldRetry(err))
+	f = newFault(1, all, fs.CommaSepList{faultNotFound})
+	assert.Equal(t, fs.ErrorDirNotFound, f.fault(faultList, "dir"))
+	assert.Equal(t, fs.ErrorObjectNotFound, f.fault(faultStat, "a"))
+
+	// Only the operations in fault_ops fail
+	f = newFault(1, fs.CommaSepList{faultDelete}, retried)
+	assert.NoError(t, f.fault(faultRead, "a"))
+	assert.Error(t, f.fault(faultDelete, "a"))
+
+	f.opt.FaultOps = fs.CommaSepList{"rename"}
+	assert.Error(t, checkFaults(&f.opt))
+	f.opt.FaultOps, f.opt.FaultErrorTypes = all, fs.CommaSepList{"404"}
+	assert.Error(t, checkFaults(&f.opt))
+}
+
+func TestFaultTriggers(t *testing.T) {
+	newTriggered := func(triggers ...string) *Fs {
+		f := &Fs{tries: make(map[string]int)}
+		f.opt.FaultErrorTypes = fs.CommaSepList{faultTimeout, fault5xx}
+		f.opt.FaultTriggers = triggers
+		var err error
+		f.triggers, err = parseFaultTriggers(&f.opt)
+		require.NoError(t, err)
+		return f
+	}
+
+	// Only the exact attempt fails
+	f := newTriggered("write#3")
+	for i := 1; i <= 5; i++ {
+		err := f.fault(faultWrite, fmt.Sprintf("file_%d.txt", i))
+		if i == 3 {
+			var faultErr *faultError
+			require.ErrorAs(t, err, &faultErr)
+			assert.True(t, faultErr.Timeout())
+		} else {
+			assert.NoError(t, err, "attempt %d", i)
+		}
+		assert.NoError(t, f.fault(faultRead, "file_3.txt"))
+	}
+
+	// Every attempt on the paths matching fails, or the nth of them
+	f = newTriggered("stat@dir/*.iso=not_found", "read@**.txt#2=5xx")
+	assert.Equal(t, fs.ErrorObjectNotFound, f.fault(faultStat, "dir/a.iso"))
+	assert.Equal(t, fs.ErrorObjectNotFound, f.fault(faultStat, "dir/a.iso"))
+	assert.NoError(t, f.fault(faultStat, "dir/sub/a.iso"))
+	assert.NoError(t, f.fault(faultStat, "dir/a.txt"))
+	assert.NoError(t, f.fault(faultRead, "a.txt"))
+	assert.NoError(t, f.fault(faultRead, "a.bin"))
+	err := f.fault(faultRead, "dir/b.txt")
+	var faultErr *faultError
+	require.ErrorAs(t, err, &faultErr)
+	assert.False(t, faultErr.Timeout())
+	assert.NoError(t, f.fault(faultRead, "dir/b.txt"))
+
+	for _, bad := range []string{"rename", "write#0", "write#x", "write=404", "read@[", ""} {
+		f.opt.FaultTriggers = fs.CommaSepList{bad}
+		_, err := parseFaultTriggers(&f.opt)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestSimSeed(t *testing.T) {
+	mem, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	newSim := func(simSeed int64) *Fs {
+		f := &Fs{engine: mem, tries: make(map[string]int)}
+		f.opt.World = "primary"
+		f.opt.SimSeed = simSeed
+		f.opt.FaultErrorRate = 0.5
+		f.opt.FaultOps = fs.CommaSepList{faultRead}
+		f.opt.FaultErrorTypes = fs.CommaSepList{faultTimeout, fault5xx}
+		f.opt.CorruptRate = 0.5
+		return f
+	}
+	run := func(f *Fs) (out []string) {
+		for i := range 100 {
+			remote := fmt.Sprintf("file_%d.txt", i%10)
+			off, mask := f.corruption("/"+remote, 1024)
+			out = append(out, fmt.Sprint(f.fault(faultRead, remote), off, mask))
+		}
+		return out
+	}
+
+	// Unset, the world's seed is used
+	assert.Equal(t, run(newSim(0)), run(newSim(mem.GetConfig().Seed.Seed)))
+
+	// The same sim_seed replays the same run and another changes it
+	first := run(newSim(1234))
+	assert.Equal(t, first, run(newSim(1234)))
+	assert.NotEqual(t, first, run(newSim(1235)))
+	assert.NotEqual(t, first, run(newSim(0)))
+
+	// It doesn't change the dataset
+	f := newSim(1234)
+	assert.Equal(t, mem.GetConfig().Seed.Seed, f.worldSeed())
+	info, err := f.seedInfo()
+	require.NoError(t, err)
+	assert.Equal(t, mem.GetConfig().Seed.Seed, info.Worlds[0].Seed)
+	assert.Equal(t, int64(1234), info.Worlds[0].SimSeed)
+	assert.Equal(t, deriveWorldSeed(1234, "s1"), info.Worlds[1].SimSeed)
+}
+
+func TestBadRange(t *testing.T) {
+	mem, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	newBadRange := func(rate float64, types fs.CommaSepList) *Fs {
+		f := &Fs{engine: mem, tries: make(map[string]int)}
+		f.opt.World = "primary"
+		f.opt.BadRangeRate = rate
+		f.opt.BadRangeTypes = types
+		require.NoError(t, checkFaults(&f.opt))
+		return f
+	}
+
+	// Each way of serving a range wrongly
+	for _, test := range []struct {
+		kind       string
+		offset     int64
+		end        int64
+		wantOffset int64
+		wantEnd    int64
+	}{
+		{badRangeIgnore, 10, 30, 0, 100},
+		{badRangeShort, 10, 30, 10, 20},
+		{badRangeLong, 10, 30, 10, 100},
+	} {
+		f := newBadRange(1, fs.CommaSepList{test.kind})
+		offset, end := f.badRange("/a", 100, test.offset, test.end)
+		assert.Equal(t, test.wantOffset, offset, test.kind)
+		assert.Equal(t, test.wantEnd, end, test.kind)
+
+		// Reads of the whole file are left alone
+		offset, end = f.badRange("/a", 100, 0, 100)
+		assert.Equal(t, int64(0), offset, test.kind)
+		assert.Equal(t, int64(100), end, test.kind)
+	}
+
+	// The same reads go wrong every time and reading again can succeed
+	reads := func(f *Fs) (ranges []string) {
+		for i := range 100 {
+			offset, end := f.badRange(fmt.Sprintf("/file_%d.txt", i%10), 100, 10, 30)
+			ranges = append(ranges, fmt.Sprintf("%d-%d", offset, end))
+		}
+		return ranges
+	}
+	all := fs.CommaSepList{badRangeIgnore, badRangeShort, badRangeLong}
+	first := reads(newBadRange(0.5, all))
+	assert.Equal(t, first, reads(newBadRange(0.5, all)))
+	var bad int
+	for _, r := range first {
+		if r != "10-30" {
+			bad++
+		}
+	}
+	assert.InDelta(t, 50, bad, 20)
+
+	f := newBadRange(0.5, all)
+	f.opt.BadRangeTypes = fs.CommaSepList{"truncate"}
+	assert.Error(t, checkFaults(&f.opt))
+	f.opt.BadRangeTypes, f.opt.BadRangeRate = all, 2
+	assert.Error(t, checkFaults(&f.opt))
+}
+
+func TestDuplicateListed(t *testing.T) {
+	mem, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	f := &Fs{engine: mem}
+	f.opt.World = "primary"
+	var entries fs.DirEntries
+	for i := range 100 {
+		entries = append(entries, fs.NewDir(fmt.Sprintf("dir_%d", i), time.Time{}))
+	}
+	assert.Equal(t, entries, f.duplicateListed(slices.Clone(entries)))
+
+	f.opt.DuplicateListRate = 0.2
+	out := f.duplicateListed(slices.Clone(entries))
+	assert.Equal(t, out, f.duplicateListed(slices.Clone(entries)))
+	assert.InDelta(t, 120, len(out), 10)
+	// Each repeat follows the entry it repeats
+	seen := map[string]bool{}
+	for i, entry := range out {
+		if seen[entry.Remote()] {
+			assert.Equal(t, out[i-1].Remote(), entry.Remote())
+		}
+		seen[entry.Remote()] = true
+	}
+	assert.Len(t, seen, len(entries))
+}
+
+func TestListP(t *testing.T) {
+	ctx := context.Background()
+	config := func() configmap.Simple {
+		return configmap.Simple{
+			"config_path":         "testdata/spectra-test.json",
+			"engine":              engineMemory,
+			"world":               "primary",
+			"lazy":                "true",
+			"db_compression":      compressionOff,
+			"flaky_list_rate":     "0.3",
+			"duplicate_list_rate": "0.3",
+		}
+	}
+	fsys, err := NewFs(ctx, "test", "", config())
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	var got fs.DirEntries
+	require.NoError(t, f.ListP(ctx, "", func(entries fs.DirEntries) error {
+		got = append(got, entries...)
+		return nil
+	}))
+
+	// The same entries as filtering the whole listing
+	other, err := NewFs(ctx, "test", "", config())
+	require.NoError(t, err)
+	o := other.(*Fs)
+	result, err := o.listChildren(ctx, "/")
+	require.NoError(t, err)
+	var want fs.DirEntries
+	for i := range result.Folders {
+		want = append(want, o.newDirectory(ctx, result.Folders[i].Node.Name, &result.Folders[i].Node))
+	}
+	for i := range result.Files {
+		want = append(want, o.newObject(result.Files[i].Node.Name, &result.Files[i].Node))
+	}
+	want = o.duplicateListed(o.dropHidden(o.dropFlaky("/", want)))
+	remotes := func(entries fs.DirEntries) (out []string) {
+		for _, entry := range entries {
+			out = append(out, entry.Remote())
+		}
+		return out
+	}
+	assert.Equal(t, remotes(want), remotes(got))
+
+	// An error from the callback stops the listing
+	stop := errors.New("stop")
+	assert.ErrorIs(t, f.ListP(ctx, "", func(fs.DirEntries) error { return stop }), stop)
+}
+
+func TestCorruptRate(t *testing.T) {
+	ctx := context.Background()
+	config := configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+		"corrupt_rate":   "1",
+	}
+	fsys, err := NewFs(ctx, "test", "", config)
+	require.NoError(t, err)
+	o := firstObject(ctx, t, fsys)
+	require.Greater(t, o.Size(), int64(0))
+	read := func(options ...fs.OpenOption) []byte {
+		in, err := o.Open(ctx, options...)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return data
+	}
+
+	// The data doesn't match the hash, the same way every time
+	data := read()
+	assert.Len(t, data, int(o.Size()))
+	want, err := o.Hash(ctx, hash.SHA256)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	assert.NotEqual(t, want, hex.EncodeToString(sum[:]))
+	assert.Equal(t, data, read())
+
+	// Ranges read the same corrupted data
+	off, _ := fsys.(*Fs).corruption(o.(*Object).spectraPath(), o.Size())
+	assert.Equal(t, data[off:off+1], read(&fs.RangeOption{Start: off, End: off}))
+	assert.Equal(t, data[off:], read(&fs.SeekOption{Offset: off}))
+
+	// Without corrupt_rate the data matches
+	config["corrupt_rate"] = "0"
+	fsys, err = NewFs(ctx, "test", "", config)
+	require.NoError(t, err)
+	o = firstObject(ctx, t, fsys)
+	data = read()
+	sum = sha256.Sum256(data)
+	assert.Equal(t, want, hex.EncodeToString(sum[:]))
+}
+
+func TestDirModTime(t *testing.T) {
+	ctx := context.Background()
+	dirTime := func(mode string) (fs.Fs, time.Time) {
+		m := diskConfig(t)
+		m["dir_modtime"] = mode
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		entries, err := fsys.List(ctx, "")
+		require.NoError(t, err)
+		for _, entry := range entries {
+			if d, ok := entry.(fs.Directory); ok {
+				return fsys, d.ModTime(ctx)
+			}
+		}
+		t.Fatal("no directory listed")
+		return nil, time.Time{}
+	}
+
+	fsys, got := dirTime(dirModTimeNode)
+	assert.NotNil(t, fsys.Features().DirSetModTime)
+	assert.False(t, got.IsZero())
+
+	fsys, got = dirTime(dirModTimeEpoch)
+	assert.True(t, got.Equal(time.Unix(0, 0)))
+	assert.Nil(t, fsys.Features().DirSetModTime)
+	assert.False(t, fsys.Features().WriteDirSetModTime)
+	assert.ErrorIs(t, fsys.(*Fs).DirSetModTime(ctx, "", time.Now()), fs.ErrorCantSetModTime)
+
+	fsys, got = dirTime(dirModTimeParent)
+	root, err := fsys.(*Fs).getNode(ctx, "/")
+	require.NoError(t, err)
+	require.NotNil(t, root)
+	assert.True(t, got.Equal(root.LastUpdated))
+
+	_, got = dirTime(dirModTimeZero)
+	assert.True(t, got.Equal(time.Time(fs.GetConfig(ctx).DefaultTime)))
+
+	m := diskConfig(t)
+	m["dir_modtime"] = "newest"
+	_, err = NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "unknown dir_modtime")
+}
+
+func TestMimeType(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	})
+	require.NoError(t, err)
+	assert.True(t, fsys.Features().ReadMimeType)
+	f := fsys.(*Fs)
+	for remote, want := range map[string]string{
+		"dir/photo.jpg":  "image/jpeg",
+		"report.pdf":     "application/pdf",
+		"README":         "application/octet-stream",
+		"archive.tar.gz": "application/gzip",
+	} {
+		o := &Object{fs: f, remote: remote}
+		assert.Equal(t, want, o.MimeType(ctx), remote)
+	}
+}
+
+func TestExtraName(t *testing.T) {
+	assert.Equal(t, "file_1-extra-12345678.txt", extraName("file_1.txt", 0x12345678_9abcdef0))
+	assert.Equal(t, "README-extra-00000001", extraName("README", 1<<32))
+}
+
+func TestCallWithin(t *testing.T) {
+	val, err := callWithin(0, func() (int, error) { return 1, nil })
+	require.NoError(t, err)
+	assert.Equal(t, 1, val)
+
+	val, err = callWithin(time.Second, func() (int, error) { return 2, nil })
+	require.NoError(t, err)
+	assert.Equal(t, 2, val)
+
+	// A slow call times out with a retriable error
+	release := make(chan struct{})
+	defer close(release)
+	_, err = callWithin(10*time.Millisecond, func() (int, error) {
+		<-release
+		return 3, nil
+	})
+	var timeoutErr *opTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.True(t, timeoutErr.Timeout())
+	assert.True(t, fserrors.ShouldRetry(err))
+
+	// Timeouts aren't retried as busy errors
+	var calls atomic.Int32
+	_, err = retryBusy(fs.Duration(10*time.Millisecond), func() (int, error) {
+		calls.Add(1)
+		<-release
+		return 4, nil
+	})
+	assert.ErrorAs(t, err, &timeoutErr)
+	assert.LessOrEqual(t, calls.Load(), int32(1))
+}
+
+func TestLockedEngine(t *testing.T) {
+	mem, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	e := newLockedEngine(mem)
+	ctx := context.Background()
+
+	// A listing of a folder another call holds waits for it
+	folder := e.stripe("", "/")
+	folder.Lock()
+	done := make(chan *sdk.ListResult)
+	go func() {
+		result, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: "/", TableName: "primary"})
+		assert.NoError(t, err)
+		done <- result
+	}()
+	time.Sleep(20 * time.Millisecond)
+	folder.Unlock()
+	result := <-done
+	require.True(t, result.Success, result.Message)
+
+	_, err = e.GetNode(ctx, &sdk.GetNodeRequest{Path: "/", TableName: "primary"})
+	require.NoError(t, err)
+	require.NoError(t, e.Reset(ctx))
+
+	f := &Fs{engine: e}
+	r := f.contentionReport()
+	require.Len(t, r.Engine, numEngineCalls)
+	assert.Equal(t, "list_children", r.Engine[engineListChildren].Call)
+	assert.Equal(t, int64(1), r.Engine[engineListChildren].Calls)
+	assert.Equal(t, int64(1), r.Engine[engineListChildren].Contended)
+	assert.Greater(t, r.Engine[engineListChildren].MaxWait, 0.0)
+	assert.Equal(t, int64(1), r.Engine[engineGetNode].Calls)
+	assert.Equal(t, int64(0), r.Engine[engineGetNode].Contended)
+	assert.Equal(t, int64(1), r.Engine[engineReset].Calls)
+	assert.Empty(t, r.Pools)
+}
+
+func TestSharedFetch(t *testing.T) {
+	ctx := context.Background()
+	for _, content := range []string{contentTiled, contentUnique} {
+		t.Run(content, func(t *testing.T) {
+			fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+				"config_path":    "testdata/spectra-test.json",
+				"engine":         engineMemory,
+				"world":          "primary",
+				"lazy":           "true",
+				"content":        content,
+				"db_compression": compressionOff,
+			})
+			require.NoError(t, err)
+			f := fsys.(*Fs)
+			gated := &gatedEngine{engine: f.engine, release: make(chan struct{})}
+			f.engine = gated
+			entries, err := f.List(ctx, "")
+			require.NoError(t, err)
+			var remote string
+			for _, entry := range entries {
+				if _, ok := entry.(fs.Object); ok {
+					remote = entry.Remote()
+					break
+				}
+			}
+			require.NotEmpty(t, remote)
+
+			// Readers opening the file at once through objects of
+			// their own fetch it once and read the same content
+			const readers = 8
+			var wg sync.WaitGroup
+			contents := make([][]byte, readers)
+			sums := make([]string, readers)
+			errs := make([]error, readers)
+			for i := range readers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					o, err := f.NewObject(ctx, remote)
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					in, err := o.Open(ctx)
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					contents[i], errs[i] = io.ReadAll(in)
+					if errs[i] == nil {
+						sums[i], errs[i] = o.Hash(ctx, hash.SHA256)
+					}
+				}()
+			}
+			require.Eventually(t, func() bool { return gated.calls.Load() > 0 }, time.Second, time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+			close(gated.release)
+			wg.Wait()
+			for i := range readers {
+				require.NoError(t, errs[i])
+				assert.Equal(t, contents[0], contents[i])
+				assert.Equal(t, sums[0], sums[i])
+			}
+			assert.Equal(t, int32(1), gated.calls.Load())
+			want := sha256.Sum256(contents[0])
+			assert.Equal(t, hex.EncodeToString(want[:]), sums[0])
+		})
+	}
+}
+
+func TestAllWorlds(t *testing.T) {
+	ctx := context.Background()
+	m := configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          worldAll,
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	}
+	top, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	entries, err := top.List(ctx, "")
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Remote())
+	}
+	assert.Equal(t, []string{"primary", "s1", "s2"}, names)
+
+	// Paths below a world are routed to it
+	entries, err = top.List(ctx, "primary")
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		assert.True(t, strings.HasPrefix(entry.Remote(), "primary/"), entry.Remote())
+	}
+
+	// A root in a world is the remote of that world, sharing the engine
+	primary, err := NewFs(ctx, "test", "primary", m)
+	require.NoError(t, err)
+	assert.Equal(t, "primary", primary.Root())
+	assert.Same(t, top.(*worldsFs).worlds["primary"].engine, primary.(*Fs).engine)
+
+	_, err = NewFs(ctx, "test", "nope", m)
+	assert.Error(t, err)
+	assert.Error(t, top.Rmdir(ctx, "s1"))
+
+	// The engine is closed once neither remote uses it
+	key := engineMemory + "\x00" + m["config_path"]
+	require.NoError(t, top.(fs.Shutdowner).Shutdown(ctx))
+	assert.Contains(t, sharedEngines, key)
+	require.NoError(t, primary.(fs.Shutdowner).Shutdown(ctx))
+	assert.NotContains(t, sharedEngines, key)
+}
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	_, err = f.List(ctx, "")
+	require.NoError(t, err)
+
+	// The SDK's database is closed along with the backend's
+	require.NoError(t, f.Shutdown(ctx))
+	_, err = f.engine.GetNode(ctx, &sdk.GetNodeRequest{Path: "/", TableName: "primary"})
+	assert.Error(t, err)
+	require.NoError(t, f.Shutdown(ctx))
+}
+
+// diskConfig writes a Spectra config with a database in a temporary
+// directory and returns the config of a remote of its primary world.
+//
+// The secondary world has none of the generated nodes, so they can be
+// moved and changed without affecting it.
+func diskConfig(t *testing.T) configmap.Simple {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "spectra.json")
+	require.NoError(t, os.WriteFile(config, []byte(`{
+  "seed": {"max_depth": 2, "min_folders": 1, "max_folders": 1, "min_files": 2, "max_files": 2, "seed": 1, "db_path": "`+filepath.Join(dir, "spectra.db")+`"},
+  "api": {"host": "localhost", "port": 8086},
+  "secondary_tables": {"s1": 0}
+}`), 0600))
+	return configmap.Simple{
+		"config_path":    config,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	}
+}
+
+// firstObject returns the first file listed in the root of f
+func firstObject(ctx context.Context, t *testing.T, f fs.Fs) fs.Object {
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if o, ok := entry.(fs.Object); ok {
+			return o
+		}
+	}
+	t.Fatal("no files listed")
+	return nil
+}
+
+func TestChangeNotify(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	other, err := NewFs(ctx, "other", "", m)
+	require.NoError(t, err)
+	assert.NotNil(t, fsys.Features().ChangeNotify)
+
+	seq, err := f.startChanges(ctx)
+	require.NoError(t, err)
+	content := []byte("changed elsewhere")
+	src := object.NewStaticObjectInfo("new.txt", time.Now(), int64(len(content)), true, nil, other)
+	_, err = other.Put(ctx, bytes.NewReader(content), src)
+	require.NoError(t, err)
+	require.NoError(t, other.Mkdir(ctx, "dir"))
+
+	got := map[string]fs.EntryType{}
+	seq, err = f.pollChanges(ctx, seq, func(remote string, entryType fs.EntryType) {
+		got[remote] = entryType
+	})
+	require.NoError(t, err)
+	assert.Equal(t, fs.EntryObject, got["new.txt"])
+	assert.Equal(t, fs.EntryDirectory, got["dir"])
+
+	// Only new changes are notified
+	clear(got)
+	_, err = f.pollChanges(ctx, seq, func(remote string, entryType fs.EntryType) {
+		got[remote] = entryType
+	})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// Changes made as soon as ChangeNotify returns are notified
+	notified := make(chan string, 10)
+	pollInterval := make(chan time.Duration)
+	f.ChangeNotify(ctx, func(remote string, entryType fs.EntryType) {
+		notified <- remote
+	}, pollInterval)
+	require.NoError(t, other.Mkdir(ctx, "early"))
+	pollInterval <- 10 * time.Millisecond
+	select {
+	case remote := <-notified:
+		assert.Equal(t, "early", remote)
+	case <-time.After(10 * time.Second):
+		t.Fatal("change not notified")
+	}
+	close(pollInterval)
+
+	// Changes need the database
+	mem, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	})
+	require.NoError(t, err)
+	assert.Nil(t, mem.Features().ChangeNotify)
+}
+
+func TestNodeCache(t *testing.T) {
+	c := newNodeCache(3, time.Minute)
+	a, b := &sdk.Node{Path: "/d/a"}, &sdk.Node{Path: "/d/b"}
+	c.put(c.generation(), "/d", []*sdk.Node{a, b})
+	node, ok := c.lookup("/d/a")
+	assert.True(t, ok)
+	assert.Same(t, a, node)
+	node, ok = c.lookup("/d/missing")
+	assert.True(t, ok)
+	assert.Nil(t, node)
+	_, ok = c.lookup("/e/a")
+	assert.False(t, ok)
+
+	// The oldest listing is dropped to keep to the size
+	c.put(c.generation(), "/e", []*sdk.Node{{Path: "/e/a"}, {Path: "/e/b"}})
+	_, ok = c.lookup("/d/a")
+	assert.False(t, ok)
+	_, ok = c.lookup("/e/a")
+	assert.True(t, ok)
+
+	// Listings read across a change aren't cached
+	gen := c.generation()
+	done := c.change()
+	c.put(gen, "/d", []*sdk.Node{a})
+	done()
+	_, ok = c.lookup("/d/a")
+	assert.False(t, ok)
+	_, ok = c.lookup("/e/a")
+	assert.False(t, ok)
+
+	c = newNodeCache(3, time.Nanosecond)
+	c.put(c.generation(), "/d", []*sdk.Node{a})
+	time.Sleep(time.Millisecond)
+	_, ok = c.lookup("/d/a")
+	assert.False(t, ok)
+
+	// Looking up files already listed costs no engine calls
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":     "testdata/spectra-test.json",
+		"engine":          engineMemory,
+		"world":           "primary",
+		"lazy":            "true",
+		"db_compression":  compressionOff,
+		"node_cache_size": "1000",
+		"node_cache_ttl":  "1m",
+	})
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	o := firstObject(ctx, t, f)
+	stats := &f.engine.(*lockedEngine).stats
+	calls := func() int64 {
+		return stats[engineListChildren].calls.Load() + stats[engineGetNode].calls.Load()
+	}
+	before := calls()
+	got, err := f.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	_, err = got.Hash(ctx, hash.SHA256)
+	require.NoError(t, err)
+	_, err = f.NewObject(ctx, "missing.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.Equal(t, before, calls())
+
+	// Changes made through the remote are seen at once
+	content := []byte("new file")
+	src := object.NewStaticObjectInfo("missing.txt", time.Now(), int64(len(content)), true, nil, f)
+	_, err = f.Put(ctx, bytes.NewReader(content), src)
+	require.NoError(t, err)
+	got, err = f.NewObject(ctx, "missing.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), got.Size())
+	require.NoError(t, o.Remove(ctx))
+	_, err = f.NewObject(ctx, o.Remote())
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestMoveIntoNewDir(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	// As with --backup-dir, the root of the remote moved into doesn't
+	// exist yet. Each remote recreates the database, so like sync make
+	// both before using either.
+	backup, err := NewFs(ctx, "test", "backup/2024", m)
+	require.NoError(t, err)
+	src := firstObject(ctx, t, fsys)
+	id := src.(*Object).id
+
+	dst, err := backup.(*Fs).Move(ctx, src, src.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, id, dst.(*Object).id)
+	assert.Equal(t, src.Remote(), dst.Remote())
+	_, err = fsys.NewObject(ctx, src.Remote())
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = fsys.NewObject(ctx, path.Join("backup/2024", src.Remote()))
+	assert.NoError(t, err)
+}
+
+func TestCopyAcrossWorlds(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	primary, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	m["world"] = "s1"
+	s1, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	src := firstObject(ctx, t, primary)
+	id := src.(*Object).id
+
+	// The file is shared with s1 rather than copied
+	dst, err := s1.(*Fs).Copy(ctx, src, src.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, id, dst.(*Object).id)
+	got, err := s1.NewObject(ctx, src.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, src.Size(), got.Size())
+	_, err = primary.NewObject(ctx, src.Remote())
+	require.NoError(t, err)
+
+	// Copying it again finds it there
+	dst, err = s1.(*Fs).Copy(ctx, src, src.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, id, dst.(*Object).id)
+
+	// Only copies to the same path can be made
+	_, err = s1.(*Fs).Copy(ctx, src, "elsewhere/"+src.Remote())
+	assert.ErrorIs(t, err, fs.ErrorCantCopy)
+
+	// Making a directory s1 lacks shares that of primary
+	entries, err := primary.List(ctx, "")
+	require.NoError(t, err)
+	var dir fs.Directory
+	for _, entry := range entries {
+		if d, ok := entry.(fs.Directory); ok {
+			dir = d
+			break
+		}
+	}
+	require.NotNil(t, dir)
+	require.NoError(t, s1.Mkdir(ctx, dir.Remote()))
+	shared, err := s1.(*Fs).getNode(ctx, "/"+dir.Remote())
+	require.NoError(t, err)
+	require.NotNil(t, shared)
+	var worlds string
+	require.NoError(t, primary.(*Fs).db.QueryRowContext(ctx,
+		`SELECT existence_map FROM nodes WHERE id = ?`, shared.ID).Scan(&worlds))
+	assert.JSONEq(t, `{"primary":true,"s1":true}`, worlds)
+	entries, err = s1.List(ctx, dir.Remote())
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestUpdateInPlace(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "folder_1", diskConfig(t))
+	require.NoError(t, err)
+	o := firstObject(ctx, t, fsys)
+	id := o.(*Object).id
+
+	// The file keeps its node and place
+	content := []byte("updated content")
+	src := object.NewStaticObjectInfo(o.Remote(), time.Now(), int64(len(content)), true, nil, fsys)
+	require.NoError(t, o.Update(ctx, bytes.NewReader(content), src))
+	assert.Equal(t, id, o.(*Object).id)
+	assert.Equal(t, int64(len(content)), o.Size())
+	got, err := fsys.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, id, got.(*Object).id)
+	assert.Equal(t, int64(len(content)), got.Size())
+	assert.WithinDuration(t, o.ModTime(ctx), got.ModTime(ctx), time.Millisecond)
+	in, err := got.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, content, data)
+
+	// Updating a removed file fails without making it again
+	require.NoError(t, got.Remove(ctx))
+	assert.ErrorIs(t, o.Update(ctx, bytes.NewReader(content), src), fs.ErrorObjectNotFound)
+	_, err = fsys.NewObject(ctx, o.Remote())
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["read_only"] = "true"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	o := firstObject(ctx, t, fsys)
+
+	features := fsys.Features()
+	assert.Nil(t, features.Purge)
+	assert.Nil(t, features.Move)
+	assert.Nil(t, features.Copy)
+	assert.Nil(t, features.PutStream)
+	assert.False(t, features.WriteMetadata)
+
+	content := []byte("updated content")
+	src := object.NewStaticObjectInfo("new.txt", time.Now(), int64(len(content)), true, nil, fsys)
+	_, err = fsys.Put(ctx, bytes.NewReader(content), src)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.Update(ctx, bytes.NewReader(content), src), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.SetModTime(ctx, time.Now()), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, o.Remove(ctx), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, fsys.Mkdir(ctx, "new"), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, fsys.Rmdir(ctx, "folder_1"), fs.ErrorPermissionDenied)
+	_, err = fsys.(*Fs).Command(ctx, "reseed", nil, map[string]string{"seed": "2"})
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+
+	got, err := fsys.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, o.Size(), got.Size())
+	_, err = fsys.NewObject(ctx, "new.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	ctx, ci := fs.AddConfig(ctx)
+	ci.Metadata = true
+	for _, test := range []struct {
+		name string
+		m    configmap.Simple
+	}{
+		{"sdk", diskConfig(t)},
+		{"memory", configmap.Simple{
+			"config_path":    "testdata/spectra-test.json",
+			"engine":         engineMemory,
+			"world":          "primary",
+			"lazy":           "true",
+			"db_compression": compressionOff,
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fsys, err := NewFs(ctx, "test", "", test.m)
+			require.NoError(t, err)
+			f := fsys.(*Fs)
+			assert.True(t, f.Features().WriteMetadata)
+			assert.NotNil(t, f.Features().DirSetModTime)
+
+			// Uploads keep the modification time and metadata given
+			modTime := time.Date(2001, 2, 3, 4, 5, 6, 789, time.UTC)
+			src := object.NewStaticObjectInfo("dir/file.txt", modTime, 5, true, nil, nil)
+			_, err = f.Put(ctx, strings.NewReader("hello"), src, fs.MetadataOption{
+				"color":   "blue",
+				"btime":   "2000-01-01T00:00:00Z",
+				"hotness": hotnessCold, // read only so dropped
+			})
+			require.NoError(t, err)
+			o, err := f.NewObject(ctx, "dir/file.txt")
+			require.NoError(t, err)
+			assert.True(t, modTime.Equal(o.ModTime(ctx)))
+			metadata, err := o.(fs.Metadataer).Metadata(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, fs.Metadata{
+				"mtime": "2001-02-03T04:05:06.000000789Z",
+				"btime": "2000-01-01T00:00:00Z",
+				"color": "blue",
+			}, metadata)
+
+			// Setting metadata adds to it
+			require.NoError(t, o.(fs.SetMetadataer).SetMetadata(ctx, fs.Metadata{"size": "L", "mtime": "2010-01-01T00:00:00Z"}))
+			o, err = f.NewObject(ctx, "dir/file.txt")
+			require.NoError(t, err)
+			metadata, err = o.(fs.Metadataer).Metadata(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "blue", metadata["color"])
+			assert.Equal(t, "L", metadata["size"])
+			assert.Equal(t, "2010-01-01T00:00:00Z", metadata["mtime"])
+			assert.Error(t, o.(fs.SetMetadataer).SetMetadata(ctx, fs.Metadata{"mtime": "yesterday"}))
+
+			require.NoError(t, o.SetModTime(ctx, modTime))
+			o, err = f.NewObject(ctx, "dir/file.txt")
+			require.NoError(t, err)
+			assert.True(t, modTime.Equal(o.ModTime(ctx)))
+
+			// Directories are listed with their modification times,
+			// which can be set
+			require.NoError(t, f.DirSetModTime(ctx, "dir", modTime))
+			d, err := f.MkdirMetadata(ctx, "made", fs.Metadata{"mtime": "2011-01-01T00:00:00Z", "owner": "me"})
+			require.NoError(t, err)
+			assert.Equal(t, 2011, d.ModTime(ctx).Year())
+			entries, err := f.List(ctx, "")
+			require.NoError(t, err)
+			for _, entry := range entries {
+				d, ok := entry.(fs.Directory)
+				if !ok {
+					continue
+				}
+				assert.False(t, d.ModTime(ctx).IsZero(), d.Remote())
+				metadata, err := d.(fs.Metadataer).Metadata(ctx)
+				require.NoError(t, err)
+				switch d.Remote() {
+				case "dir":
+					assert.True(t, modTime.Equal(d.ModTime(ctx)))
+				case "made":
+					assert.Equal(t, 2011, d.ModTime(ctx).Year())
+					assert.Equal(t, "me", metadata["owner"])
+				}
+			}
+			assert.ErrorIs(t, f.DirSetModTime(ctx, "missing", modTime), fs.ErrorDirNotFound)
+		})
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+	ts := &timeSeries{
+		measurement: "spectra_bench",
+		time:        time.Unix(1700000000, 500000000),
+		points: []seriesPoint{{
+			tags:   []seriesTag{{"remote", "my spectra"}, {"world", ""}, {"phase", "list"}},
+			fields: []seriesField{{"ops", "Operations.", 12}, {"seconds", "Duration.", 0.25}},
+		}, {
+			tags:   []seriesTag{{"remote", "my spectra"}, {"world", ""}, {"phase", "read"}},
+			fields: []seriesField{{"ops", "Operations.", 3}, {"seconds", "Duration.", 1.5}},
+		}},
+	}
+	assert.Equal(t, `spectra_bench,remote=my\ spectra,phase=list ops=12,seconds=0.25 1700000000500000000
+spectra_bench,remote=my\ spectra,phase=read ops=3,seconds=1.5 1700000000500000000
+`, ts.influx())
+	assert.Equal(t, `# HELP spectra_bench_ops Operations.
+# TYPE spectra_bench_ops gauge
+spectra_bench_ops{remote="my spectra",world="",phase="list"} 12
+spectra_bench_ops{remote="my spectra",world="",phase="read"} 3
+# HELP spectra_bench_seconds Duration.
+# TYPE spectra_bench_seconds gauge
+spectra_bench_seconds{remote="my spectra",world="",phase="list"} 0.25
+spectra_bench_seconds{remote="my spectra",world="",phase="read"} 1.5
+# HELP spectra_bench_timestamp_seconds When the measurements were made, in seconds since the Unix epoch.
+# TYPE spectra_bench_timestamp_seconds gauge
+spectra_bench_timestamp_seconds 1700000000.5
+`, ts.prom())
+}
+
+func TestBench(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	})
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	out, err := f.Command(ctx, "bench", nil, map[string]string{"max-depth": "2", "files": "3"})
+	require.NoError(t, err)
+	result := out.(*benchResult)
+	require.Len(t, result.Phases, 3)
+	assert.Equal(t, benchList, result.Phases[0].Phase)
+	assert.Positive(t, result.Phases[0].Ops)
+	assert.Equal(t, int64(3), result.Phases[1].Ops)
+	assert.Equal(t, int64(3), result.Phases[2].Ops)
+	assert.Positive(t, result.Phases[2].Bytes)
+
+	out, err = f.Command(ctx, "bench", nil, map[string]string{"max-depth": "1", "format": "influx"})
+	require.NoError(t, err)
+	assert.Contains(t, out, "spectra_bench,remote=test,world=primary,engine=memory,phase=read ops=")
+	_, err = f.Command(ctx, "cost", nil, map[string]string{"format": "prom"})
+	assert.Error(t, err)
+}
+
+func TestHeatmap(t *testing.T) {
+	ctx := context.Background()
+	m := configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+		"heatmap":        "true",
+	}
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	var dir string
+	var o fs.Object
+	for _, entry := range entries {
+		switch x := entry.(type) {
+		case fs.Directory:
+			dir = x.Remote()
+		case fs.Object:
+			o = x
+		}
+	}
+	require.NotEmpty(t, dir)
+	require.NotNil(t, o)
+	sub, err := f.List(ctx, dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, sub)
+	_, err = f.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+
+	r, err := f.heatReport(-1, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), r.Accesses)
+	assert.Equal(t, []heatEntry{
+		{Path: "", Lists: 1, Total: 1, First: 1, Last: 1},
+		{Path: dir, Lists: 1, Total: 1, First: 2, Last: 2},
+		{Path: o.Remote(), Stats: 1, Reads: 1, Total: 2, First: 3, Last: 4},
+	}, r.Paths)
+
+	r, err = f.heatReport(0, heatSortTotal, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []heatEntry{{Path: "", Lists: 2, Stats: 1, Reads: 1, Total: 4, First: 1, Last: 4}}, r.Paths)
+
+	out, err := f.Command(ctx, "heatmap", nil, map[string]string{"sort": heatSortLast, "format": "csv"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.(string), "path,lists,stats,reads,writes,total,first,last\n"+o.Remote()+",0,1,1,0,2,3,4\n"), out)
+	_, err = f.Command(ctx, "heatmap", nil, map[string]string{"sort": "potato"})
+	assert.Error(t, err)
+
+	delete(m, "heatmap")
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	_, err = fsys.(*Fs).Command(ctx, "heatmap", nil, nil)
+	assert.Error(t, err)
+}
+
+func TestRewrite(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+		"rewrite_rate":   "1",
+	})
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	o := firstObject(ctx, t, f)
+	spectraPath := o.(*Object).spectraPath()
+
+	// A read in progress carries on with the new content
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	start := make([]byte, 10)
+	_, err = io.ReadFull(in, start)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return f.isRewritten(spectraPath) }, time.Second, time.Millisecond)
+	rest, err := io.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, o.Size()+int64(len(rewriteSuffix)), int64(len(start)+len(rest)))
+	assert.True(t, strings.HasSuffix(string(rest), rewriteSuffix))
+
+	// Later reads see it, and it is only rewritten once
+	got, err := f.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, o.Size()+int64(len(rewriteSuffix)), got.Size())
+	in, err = got.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, f.Shutdown(ctx))
+	assert.Equal(t, append(start, rest...), data)
+}
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	o := firstObject(ctx, t, f)
+	r, err := f.storedRollup(ctx, "/")
+	require.NoError(t, err)
+
+	// One more file fits, the one after doesn't
+	f.opt.QuotaObjects = r.Files + 1
+	put := func(remote string, data string) error {
+		src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(data)), true, nil, nil)
+		_, err := f.Put(ctx, strings.NewReader(data), src)
+		return err
+	}
+	require.NoError(t, put("quota1.txt", "hello"))
+	err = put("quota2.txt", "hello")
+	var quotaErr *quotaError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, "objects", quotaErr.limit)
+	assert.True(t, fserrors.IsNoRetryError(err))
+
+	// Updates only count the bytes they add
+	f.opt.QuotaObjects = 0
+	_, err = f.About(ctx)
+	require.NoError(t, err)
+	r, err = f.storedRollup(ctx, "/")
+	require.NoError(t, err)
+	f.opt.QuotaBytes = fs.SizeSuffix(r.Bytes + 1)
+	usage, err := f.About(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, r.Bytes+1, *usage.Total)
+	assert.Equal(t, int64(1), *usage.Free)
+	update := func(data string) error {
+		src := object.NewStaticObjectInfo(o.Remote(), time.Now(), int64(len(data)), true, nil, nil)
+		return o.Update(ctx, strings.NewReader(data), src)
+	}
+	require.NoError(t, update(strings.Repeat("x", int(o.Size())+1)))
+	err = update(strings.Repeat("x", int(o.Size())+1))
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, "bytes", quotaErr.limit)
+	require.NoError(t, update("x"))
+
+	// The quotas need the database
+	_, err = NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":   "testdata/spectra-test.json",
+		"engine":        engineMemory,
+		"world":         "primary",
+		"quota_objects": "1",
+	})
+	assert.Error(t, err)
+}
+
+func TestWorldManifest(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	out, err := f.Command(ctx, "world-manifest", nil, nil)
+	require.NoError(t, err)
+	report := out.(*manifestReport)
+	assert.Equal(t, "primary", report.Manifest.World)
+	assert.Equal(t, f.worldSeed(), report.Manifest.Seed)
+	assert.Equal(t, fs.Version, report.Manifest.RcloneVersion)
+	assert.Contains(t, string(report.Manifest.Config), `"max_depth":2`)
+	assert.Empty(t, report.Differs)
+	generatedAt := report.Manifest.GeneratedAt
+
+	// The manifest of the first remote is kept
+	m["content"] = contentUnique
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	out, err = fsys.(*Fs).Command(ctx, "world-manifest", nil, nil)
+	require.NoError(t, err)
+	report = out.(*manifestReport)
+	assert.Equal(t, generatedAt, report.Manifest.GeneratedAt)
+	assert.Equal(t, []string{"profile"}, report.Differs)
+}
+
+func TestListPaged(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	whole, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	m["list_page_size"] = "1"
+	paged, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	remotes := func(entries fs.DirEntries) (out []string) {
+		for _, entry := range entries {
+			out = append(out, entry.Remote())
+		}
+		slices.Sort(out)
+		return out
+	}
+
+	// The paged listing generates the directory and then lists the
+	// same entries as the whole one
+	got, err := paged.List(ctx, "")
+	require.NoError(t, err)
+	want, err := whole.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, remotes(want), remotes(got))
+	assert.Len(t, got, 3)
+	var dir string
+	for _, entry := range got {
+		if _, ok := entry.(fs.Directory); ok {
+			dir = entry.Remote()
+		}
+	}
+	require.NotEmpty(t, dir)
+	got, err = paged.List(ctx, dir)
+	require.NoError(t, err)
+	want, err = whole.List(ctx, dir)
+	require.NoError(t, err)
+	assert.Equal(t, remotes(want), remotes(got))
+	assert.NotEmpty(t, got)
+
+	_, err = paged.List(ctx, "potato")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	// Paging needs the database
+	_, err = NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"list_page_size": "1",
+	})
+	assert.Error(t, err)
+}
+
+func TestSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	version := func() (v int) {
+		require.NoError(t, f.db.QueryRow(`SELECT version FROM spectra_schema`).Scan(&v))
+		return v
+	}
+	assert.Equal(t, schemaVersion, version())
+
+	// Databases made before versions were recorded are migrated
+	_, err = f.db.Exec(`UPDATE spectra_schema SET version = 0`)
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	assert.Equal(t, schemaVersion, version())
+
+	// Newer databases are refused
+	_, err = f.db.Exec(`UPDATE spectra_schema SET version = ?`, schemaVersion+1)
+	require.NoError(t, err)
+	_, err = NewFs(ctx, "test", "", m)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "upgrade rclone")
+	_, err = f.db.Exec(`UPDATE spectra_schema SET version = ?`, schemaVersion)
+	require.NoError(t, err)
+
+	// As are nodes missing columns
+	_, err = f.db.Exec(`ALTER TABLE nodes DROP COLUMN checksum`)
+	require.NoError(t, err)
+	err = f.checkSchema(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"checksum"`)
+}
+
+func TestHealth(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	out, err := f.Command(ctx, "health", nil, nil)
+	require.NoError(t, err)
+	report := out.(*healthReport)
+	assert.True(t, report.Healthy)
+	var names []string
+	for _, c := range report.Checks {
+		assert.True(t, c.OK, c.Name)
+		names = append(names, c.Name)
+	}
+	assert.Equal(t, []string{"engine", "database", "write", "generation"}, names)
+
+	// Slow generation fails the probe
+	_, err = f.Command(ctx, "health", nil, map[string]string{"max-latency": "1ns"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "generation: took")
+
+	// As does an unusable database
+	require.NoError(t, f.readDB.Close())
+	_, err = f.Command(ctx, "health", nil, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "database:")
+}
+
+// newAPIServer starts a server answering the calls of the Spectra API
+// server from a memory engine
+func newAPIServer(t *testing.T) *httptest.Server {
+	e, err := newMemEngine("testdata/spectra-test.json")
+	require.NoError(t, err)
+	reply := func(w http.ResponseWriter, data any, err error) {
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(sdk.APIResponse{Message: err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(sdk.APIResponse{Success: true, Data: data})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/config", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, e.GetConfig(), nil)
+	})
+	mux.HandleFunc("POST /api/v1/items/list", func(w http.ResponseWriter, r *http.Request) {
+		var req sdk.ListChildrenRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		result, err := e.ListChildren(r.Context(), &req)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	})
+	mux.HandleFunc("POST /api/v1/items/file", func(w http.ResponseWriter, r *http.Request) {
+		var req sdk.UploadFileRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		node, err := e.UploadFile(r.Context(), &req)
+		reply(w, node, err)
+	})
+	mux.HandleFunc("POST /api/v1/items/folder", func(w http.ResponseWriter, r *http.Request) {
+		var req sdk.CreateFolderRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		node, err := e.CreateFolder(r.Context(), &req)
+		reply(w, node, err)
+	})
+	mux.HandleFunc("GET /api/v1/items/{id}/data", func(w http.ResponseWriter, r *http.Request) {
+		data, checksum, err := e.GetFileData(r.Context(), r.PathValue("id"))
+		reply(w, map[string]any{"data": data, "checksum": checksum}, err)
+	})
+	mux.HandleFunc("GET /api/v1/node/{id}", func(w http.ResponseWriter, r *http.Request) {
+		node, err := e.GetNode(r.Context(), &sdk.GetNodeRequest{ID: r.PathValue("id")})
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(sdk.APIResponse{Message: "Node not found: " + err.Error()})
+			return
+		}
+		reply(w, node, nil)
+	})
+	mux.HandleFunc("DELETE /api/v1/node/{id}", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, nil, e.DeleteNode(r.Context(), &sdk.DeleteNodeRequest{ID: r.PathValue("id")}))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRemoteEngine(t *testing.T) {
+	ctx := context.Background()
+	srv := newAPIServer(t)
+	config := func(engine string) configmap.Simple {
+		return configmap.Simple{
+			"config_path":    "testdata/spectra-test.json",
+			"engine":         engine,
+			"api_url":        srv.URL,
+			"world":          "primary",
+			"lazy":           "true",
+			"db_compression": compressionOff,
+		}
+	}
+	fsys, err := NewFs(ctx, "test", "", config(engineRemote))
+	require.NoError(t, err)
+	local, err := NewFs(ctx, "test", "", config(engineMemory))
+	require.NoError(t, err)
+
+	// The same world as the engine the server uses
+	remotes := func(entries fs.DirEntries) (out []string) {
+		for _, entry := range entries {
+			out = append(out, entry.Remote())
+		}
+		return out
+	}
+	got, err := fsys.List(ctx, "")
+	require.NoError(t, err)
+	want, err := local.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, remotes(want), remotes(got))
+
+	// Files can be found, read, uploaded and deleted
+	o := firstObject(ctx, t, fsys)
+	found, err := fsys.NewObject(ctx, o.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, o.Size(), found.Size())
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, o.Size(), int64(len(data)))
+
+	src := object.NewStaticObjectInfo("up/new.txt", time.Now(), 5, true, nil, nil)
+	up, err := fsys.Put(ctx, strings.NewReader("hello"), src)
+	require.NoError(t, err)
+	found, err = fsys.NewObject(ctx, "up/new.txt")
+	require.NoError(t, err)
+	in, err = found.Open(ctx)
+	require.NoError(t, err)
+	data, err = io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "hello", string(data))
+	require.NoError(t, up.Remove(ctx))
+	_, err = fsys.NewObject(ctx, "up/new.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = fsys.NewObject(ctx, "potato/new.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	// An unreachable server is noticed when the remote is created
+	m := config(engineRemote)
+	m["api_url"] = "http://127.0.0.1:1"
+	_, err = NewFs(ctx, "test", "", m)
+	assert.Error(t, err)
+}
+
+func TestRemoteEngineRetry(t *testing.T) {
+	ctx := context.Background()
+	srv := newAPIServer(t)
+	target, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var calls, unavailable atomic.Int32
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if unavailable.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(front.Close)
+	e, err := newRemoteEngine(ctx, &Options{APIURL: front.URL})
+	require.NoError(t, err)
+
+	// A server which is briefly unavailable is retried
+	calls.Store(0)
+	unavailable.Store(2)
+	result, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: "/", TableName: "primary"})
+	require.NoError(t, err)
+	assert.True(t, result.Success)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// Failures of the SDK aren't
+	calls.Store(0)
+	_, _, err = e.GetFileData(ctx, "potato")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Nor are calls whose context is done
+	calls.Store(0)
+	unavailable.Store(100)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = e.GetNode(cancelCtx, &sdk.GetNodeRequest{ID: "root"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(0), calls.Load())
+}
+
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+	srv := newAPIServer(t)
+	newRemote := func(namespace string) *Fs {
+		fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+			"config_path":    "testdata/spectra-test.json",
+			"engine":         engineRemote,
+			"api_url":        srv.URL,
+			"namespace":      namespace,
+			"world":          "primary",
+			"lazy":           "true",
+			"db_compression": compressionOff,
+		})
+		require.NoError(t, err)
+		return fsys.(*Fs)
+	}
+	a, b, shared := newRemote("a"), newRemote("b"), newRemote("")
+	read := func(f *Fs, remote string) string {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+	put := func(f *Fs, remote, data string) {
+		src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(data)), true, nil, nil)
+		_, err := f.Put(ctx, strings.NewReader(data), src)
+		require.NoError(t, err)
+	}
+	list := func(f *Fs, dir string) (remotes []string) {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			remotes = append(remotes, entry.Remote())
+		}
+		return remotes
+	}
+
+	// Every namespace starts with the world the server generates
+	root := list(shared, "")
+	assert.Equal(t, root, list(a, ""))
+	assert.Equal(t, root, list(b, ""))
+	o := firstObject(ctx, t, shared)
+	original := read(shared, o.Remote())
+	var dir string
+	for _, remote := range root {
+		if remote != o.Remote() && !strings.Contains(remote, ".") {
+			dir = remote
+			break
+		}
+	}
+	require.NotEmpty(t, dir)
+	below := list(shared, dir)
+	require.NotEmpty(t, below)
+
+	// Uploads, replacements and deletions only show in their namespace
+	put(a, "new/file.txt", "hello")
+	put(a, o.Remote(), "changed")
+	obj, err := a.NewObject(ctx, below[len(below)-1])
+	if err == nil {
+		require.NoError(t, obj.Remove(ctx))
+	} else {
+		require.NoError(t, operations.Purge(ctx, a, below[len(below)-1]))
+	}
+	assert.Equal(t, "hello", read(a, "new/file.txt"))
+	assert.Equal(t, "changed", read(a, o.Remote()))
+	assert.NotContains(t, list(a, dir), below[len(below)-1])
+	assert.Contains(t, list(a, ""), "new")
+	for _, f := range []*Fs{b, shared} {
+		_, err := f.NewObject(ctx, "new/file.txt")
+		assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+		assert.Equal(t, original, read(f, o.Remote()))
+		assert.Equal(t, below, list(f, dir))
+		assert.Equal(t, root, list(f, ""))
+	}
+
+	// A directory made where one was deleted is empty
+	require.NoError(t, operations.Purge(ctx, b, dir))
+	_, err = b.List(ctx, dir)
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	_, err = b.NewObject(ctx, below[0])
+	assert.Error(t, err)
+	require.NoError(t, b.Mkdir(ctx, dir))
+	assert.Empty(t, list(b, dir))
+	put(b, path.Join(dir, "again.txt"), "again")
+	assert.Equal(t, []string{path.Join(dir, "again.txt")}, list(b, dir))
+	assert.Equal(t, below[:len(below)-1], list(a, dir))
+
+	// A namespace is kept by the server for the next remote using it
+	assert.Equal(t, "hello", read(newRemote("a"), "new/file.txt"))
+	assert.Equal(t, []string{path.Join(dir, "again.txt")}, list(newRemote("b"), dir))
+
+	// The world can't be reset under the other namespaces
+	_, err = a.Command(ctx, "reseed", nil, map[string]string{"seed": "99"})
+	assert.ErrorIs(t, err, errNamespaceReset)
+	_, err = NewFs(ctx, "test", "", configmap.Simple{"config_path": "testdata/spectra-test.json", "engine": engineMemory, "namespace": "a"})
+	assert.Error(t, err)
+	_, err = NewFs(ctx, "test", "", configmap.Simple{"config_path": "testdata/spectra-test.json", "engine": engineRemote, "api_url": srv.URL, "namespace": "a/b"})
+	assert.Error(t, err)
+}
+
+func TestDelta(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	dir := t.TempDir()
+	before := filepath.Join(dir, "before.db")
+	require.NoError(t, f.exportSnapshot(ctx, before))
+	r, err := f.storedRollup(ctx, "/")
+	require.NoError(t, err)
+
+	// Add one file, grow another and delete a third
+	src := object.NewStaticObjectInfo("new.txt", time.Now(), 5, true, nil, nil)
+	_, err = f.Put(ctx, strings.NewReader("hello"), src)
+	require.NoError(t, err)
+	var objects []fs.Object
+	require.NoError(t, operations.ListFn(ctx, f, func(o fs.Object) {
+		if o.Remote() != "new.txt" {
+			objects = append(objects, o)
+		}
+	}))
+	require.GreaterOrEqual(t, len(objects), 2)
+	grown, gone := objects[0], objects[1]
+	data := strings.Repeat("x", int(grown.Size())+1)
+	require.NoError(t, grown.Update(ctx, strings.NewReader(data), object.NewStaticObjectInfo(grown.Remote(), time.Now(), int64(len(data)), true, nil, nil)))
+	require.NoError(t, gone.Remove(ctx))
+
+	check := func(out any) *deltaReport {
+		report := out.(*deltaReport)
+		assert.Equal(t, deltaCount{Files: 1, Bytes: 5}, report.Added)
+		assert.Equal(t, deltaCount{Files: 1, Bytes: int64(len(data))}, report.Modified)
+		assert.Equal(t, deltaCount{Files: 1, Bytes: gone.Size()}, report.Deleted)
+		assert.Equal(t, r.Files-2, report.Unchanged.Files)
+		assert.Equal(t, int64(5+len(data)), report.TransferBytes)
+		return report
+	}
+	out, err := f.Command(ctx, "delta", []string{before}, map[string]string{"bandwidth": "1B"})
+	require.NoError(t, err)
+	report := check(out)
+	assert.Equal(t, "database", report.To)
+	assert.Equal(t, float64(5+len(data)), report.TransferSeconds)
+
+	after := filepath.Join(dir, "after.db")
+	require.NoError(t, f.exportSnapshot(ctx, after))
+	out, err = f.Command(ctx, "delta", []string{before, after}, nil)
+	require.NoError(t, err)
+	check(out)
+
+	// Drift between epochs modifies the drifted files
+	f.opt.DriftRate = 1
+	out, err = f.Command(ctx, "delta", []string{after}, map[string]string{"to-epoch": "1"})
+	require.NoError(t, err)
+	report = out.(*deltaReport)
+	assert.Equal(t, int64(0), report.Unchanged.Files)
+	assert.Equal(t, r.Files, report.Modified.Files)
+
+	out, err = f.Command(ctx, "delta", []string{before}, map[string]string{"format": "csv"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.(string), "change,files,bytes\nadded,1,5\n"), out)
+	_, err = f.Command(ctx, "delta", nil, nil)
+	assert.Error(t, err)
+}
+
+func TestRmdirRecursive(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	assert.ErrorIs(t, fsys.Rmdir(ctx, "folder_1"), fs.ErrorDirectoryNotEmpty)
+
+	m["rmdir_recursive"] = "true"
+	m["protect"] = "/folder_1/file_1.txt"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	_, err = fsys.List(ctx, "folder_1")
+	require.NoError(t, err)
+	assert.ErrorIs(t, fsys.Rmdir(ctx, "folder_1"), fs.ErrorPermissionDenied)
+
+	delete(m, "protect")
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	_, err = fsys.List(ctx, "folder_1")
+	require.NoError(t, err)
+	require.NoError(t, fsys.Rmdir(ctx, "folder_1"))
+	_, err = fsys.NewObject(ctx, "folder_1/file_1.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	entries, err := fsys.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.NotEqual(t, "folder_1", entry.Remote())
+	}
+	assert.ErrorIs(t, fsys.Rmdir(ctx, "folder_1"), fs.ErrorDirNotFound)
+}
+
+func TestDeleteWorlds(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := filepath.Join(dir, "spectra.json")
+	require.NoError(t, os.WriteFile(config, []byte(`{
+  "seed": {"max_depth": 2, "min_folders": 2, "max_folders": 2, "min_files": 2, "max_files": 2, "seed": 1, "db_path": "`+filepath.Join(dir, "spectra.db")+`"},
+  "api": {"host": "localhost", "port": 8086},
+  "secondary_tables": {"s1": 1}
+}`), 0600))
+	newRemote := func(world string, extra ...string) fs.Fs {
+		m := configmap.Simple{
+			"config_path":    config,
+			"world":          world,
+			"lazy":           "false",
+			"db_compression": compressionOff,
+		}
+		for i := 0; i < len(extra); i += 2 {
+			m[extra[i]] = extra[i+1]
+		}
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		return fsys
+	}
+	listed := func(fsys fs.Fs, dir string) (names []string) {
+		require.NoError(t, walk.ListR(ctx, fsys, dir, true, -1, walk.ListAll, func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				names = append(names, entry.Remote())
+			}
+			return nil
+		}))
+		slices.Sort(names)
+		return names
+	}
+	// Generate the whole tree, so new directories stay empty
+	listed(newRemote("primary", "lazy", "true"), "")
+	primary, s1 := newRemote("primary"), newRemote("s1")
+	before := listed(s1, "")
+	require.Equal(t, before, listed(primary, ""))
+	require.Contains(t, before, "folder_1")
+
+	// Purging a directory from one world leaves it in the others
+	require.NoError(t, primary.Features().Purge(ctx, "folder_1"))
+	_, err := primary.List(ctx, "folder_1")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	assert.Equal(t, before, listed(s1, ""))
+
+	// As does removing a directory
+	require.NoError(t, primary.Mkdir(ctx, "empty"))
+	require.NoError(t, s1.Mkdir(ctx, "empty"))
+	require.NoError(t, primary.Rmdir(ctx, "empty"))
+	_, err = primary.List(ctx, "empty")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	_, err = s1.List(ctx, "empty")
+	assert.NoError(t, err)
+	require.NoError(t, s1.Rmdir(ctx, "empty"))
+	_, err = s1.List(ctx, "empty")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	// Or removing one recursively
+	recursive := newRemote("primary", "rmdir_recursive", "true")
+	require.NoError(t, recursive.Rmdir(ctx, "folder_2"))
+	_, err = primary.List(ctx, "folder_2")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	assert.Equal(t, before, listed(s1, ""))
+
+	// As does deleting a file
+	o, err := primary.NewObject(ctx, "file_1.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	_, err = primary.NewObject(ctx, "file_1.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.ErrorIs(t, o.Remove(ctx), fs.ErrorObjectNotFound)
+	assert.Equal(t, before, listed(s1, ""))
+
+	// Purging the root of a world empties only that world
+	require.NoError(t, primary.Features().Purge(ctx, ""))
+	assert.Empty(t, listed(primary, ""))
+	assert.Equal(t, before, listed(s1, ""))
+
+	// Nodes left in no world are removed from the database
+	require.NoError(t, s1.Features().Purge(ctx, ""))
+	assert.Empty(t, listed(s1, ""))
+	var nodes int
+	require.NoError(t, primary.(*Fs).db.QueryRow(`SELECT count(*) FROM nodes WHERE path <> '/'`).Scan(&nodes))
+	assert.Zero(t, nodes)
+}
+
+func TestWorldSnapshot(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	_, err = fsys.List(ctx, "")
+	require.NoError(t, err)
+	content := []byte("snapshot content")
+	src := object.NewStaticObjectInfo("new.txt", time.Now(), int64(len(content)), true, nil, fsys)
+	o, err := fsys.Put(ctx, bytes.NewReader(content), src)
+	require.NoError(t, err)
+
+	out, err := f.Command(ctx, "snapshot", nil, map[string]string{"target": "before"})
+	require.NoError(t, err)
+	snapshot := out.(worldSnapshot)
+	assert.Equal(t, "primary", snapshot.World)
+	assert.Greater(t, snapshot.Files, int64(1))
+	assert.Greater(t, snapshot.Dirs, int64(0))
+
+	// Change the world destructively
+	updated := []byte("changed")
+	require.NoError(t, o.Update(ctx, bytes.NewReader(updated), object.NewStaticObjectInfo("new.txt", time.Now(), int64(len(updated)), true, nil, fsys)))
+	require.NoError(t, fsys.Features().Purge(ctx, "folder_1"))
+	old, err := fsys.NewObject(ctx, "file_1.txt")
+	require.NoError(t, err)
+	require.NoError(t, old.Remove(ctx))
+
+	check := func(fsys fs.Fs) {
+		_, err := fsys.NewObject(ctx, "file_1.txt")
+		assert.NoError(t, err)
+		entries, err := fsys.List(ctx, "folder_1")
+		require.NoError(t, err)
+		assert.NotEmpty(t, entries)
+		got, err := fsys.NewObject(ctx, "new.txt")
+		require.NoError(t, err)
+		in, err := got.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, content, data)
+	}
+	_, err = f.Command(ctx, "restore", nil, map[string]string{"snapshot": "before"})
+	require.NoError(t, err)
+	check(fsys)
+
+	// The snapshot outlives the SDK recreating the nodes
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	out, err = f.Command(ctx, "snapshot", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []worldSnapshot{snapshot}, out)
+	_, err = f.Command(ctx, "restore", nil, map[string]string{"snapshot": "before"})
+	require.NoError(t, err)
+	check(fsys)
+
+	_, err = f.Command(ctx, "restore", nil, map[string]string{"snapshot": "potato"})
+	assert.ErrorContains(t, err, "no world snapshot")
+}
+
+func TestGenerationConcurrency(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["generation_concurrency"] = "2"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	defer func() { require.NoError(t, f.Shutdown(ctx)) }()
+
+	// Listing the root generates folder_1 in the background
+	_, err = fsys.List(ctx, "")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		dirs, err := f.ungenerated(ctx, "/folder_1", 2)
+		return err == nil && len(dirs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Folders at the maximum depth aren't queued
+	f.prefetch("/folder_1/folder_1")
+	f.prefetchMu.Lock()
+	assert.False(t, f.prefetchQueued["/folder_1/folder_1"])
+	f.prefetchMu.Unlock()
+	entries, err := fsys.List(ctx, "folder_1")
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+// mandatoryOption is an option rclone might add which the backend
+// doesn't know
+type mandatoryOption struct{ fs.NullOption }
+
+func (mandatoryOption) Mandatory() bool { return true }
+
+func TestOpenOptions(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	o := firstObject(ctx, t, fsys)
+	require.Greater(t, o.Size(), int64(4))
+	read := func(options ...fs.OpenOption) []byte {
+		in, err := o.Open(ctx, options...)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return data
+	}
+	data := read()
+
+	// Advisory and unknown options are ignored
+	assert.Equal(t, data, read(fs.NullOption{}, &fs.HashesOption{Hashes: hash.Set(hash.None)},
+		&fs.HTTPOption{Key: "X-Unknown", Value: "1"}, mandatoryOption{}))
+
+	// A Range header reads like a range option
+	assert.Equal(t, data[1:4], read(&fs.HTTPOption{Key: "Range", Value: "bytes=1-3"}))
+	assert.Equal(t, data[len(data)-2:], read(&fs.HTTPOption{Key: "range", Value: "bytes=-2"}))
+	assert.Equal(t, data, read(&fs.HTTPOption{Key: "Range", Value: "potato"}))
+
+	// The chunk size asked for is used
+	src := object.NewStaticObjectInfo("chunked.txt", time.Now(), 10, true, nil, fsys)
+	info, writer, err := fsys.Features().OpenChunkWriter(ctx, "chunked.txt", src, &fs.ChunkOption{ChunkSize: 5})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.ChunkSize)
+	require.NoError(t, writer.Abort(ctx))
+}
+
+func TestUploadCutoff(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["upload_cutoff"] = "10B"
+	m["chunk_size"] = "4B"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	put := func(remote string, content []byte, size int64) error {
+		src := object.NewStaticObjectInfo(remote, time.Now(), size, true, nil, fsys)
+		o, err := fsys.Features().PutStream(ctx, bytes.NewReader(content), src)
+		if err != nil {
+			return err
+		}
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, content, data)
+		assert.Equal(t, int64(len(content)), o.Size())
+		return nil
+	}
+	sessions := func() (n int) {
+		require.NoError(t, f.db.QueryRowContext(ctx, `SELECT count(*) FROM spectra_upload_sessions`).Scan(&n))
+		return n
+	}
+
+	large := []byte("content stored in chunks")
+	small := []byte("small")
+	require.NoError(t, put("known.txt", large, int64(len(large))))
+	require.NoError(t, put("stream.txt", large, -1))
+	require.NoError(t, put("small.txt", small, -1))
+	assert.Equal(t, 0, sessions())
+
+	// Only uploads above the cutoff go through a session
+	m["upload_kill_rate"] = "1"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	require.NoError(t, put("small.txt", small, int64(len(small))))
+	assert.ErrorIs(t, put("known.txt", large, int64(len(large))), errSessionGone)
+	assert.ErrorIs(t, put("stream.txt", large, -1), errSessionGone)
+	assert.Equal(t, 0, sessions())
+}
+
+func TestSharedSDKEngine(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["lazy"] = "false"
+	a, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	put := func(remote string, content []byte) {
+		src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(content)), true, nil, nil)
+		_, err := a.Put(ctx, bytes.NewReader(content), src)
+		require.NoError(t, err)
+	}
+
+	// Uploading over a file replaces it, and files can be empty
+	put("dir/file.txt", []byte("first"))
+	put("dir/file.txt", []byte("second"))
+	put("dir/empty.txt", nil)
+	entries, err := a.List(ctx, "dir")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Another remote on the configuration file sees the same world
+	// rather than recreating it
+	b, err := NewFs(ctx, "test", "dir", m)
+	require.NoError(t, err)
+	o, err := b.NewObject(ctx, "file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("second")), o.Size())
+	o, err = b.NewObject(ctx, "empty.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), o.Size())
+	require.NoError(t, b.Features().Shutdown(ctx))
+	_, err = a.NewObject(ctx, "dir/file.txt")
+	assert.NoError(t, err)
+	require.NoError(t, a.Features().Shutdown(ctx))
+}
+
+func TestSourceHashes(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["hashes"] = "sha256,md5,sha1"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	content := []byte("uploaded content")
+	const md5sum = "0123456789abcdef0123456789abcdef"
+	src := object.NewStaticObjectInfo("uploaded.txt", time.Now(), int64(len(content)), true,
+		map[hash.Type]string{hash.MD5: md5sum, hash.SHA256: "not spectra's"}, nil)
+	o, err := fsys.Put(ctx, bytes.NewReader(content), src)
+	require.NoError(t, err)
+
+	// The source's hash is kept, even when it isn't of the content
+	o, err = fsys.NewObject(ctx, "uploaded.txt")
+	require.NoError(t, err)
+	sum, err := o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, md5sum, sum)
+
+	// Hashes the source hasn't are computed and SHA-256 is Spectra's own
+	want, err := hash.StreamTypes(bytes.NewReader(content), hash.NewHashSet(hash.SHA1, hash.SHA256))
+	require.NoError(t, err)
+	for _, ty := range []hash.Type{hash.SHA1, hash.SHA256} {
+		sum, err = o.Hash(ctx, ty)
+		require.NoError(t, err)
+		assert.Equal(t, want[ty], sum, ty)
+	}
+
+	// New content drops the source's hashes
+	src = object.NewStaticObjectInfo("uploaded.txt", time.Now(), 3, true, nil, nil)
+	require.NoError(t, o.Update(ctx, bytes.NewReader([]byte("new")), src))
+	o, err = fsys.NewObject(ctx, "uploaded.txt")
+	require.NoError(t, err)
+	sum, err = o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, "22af645d1859cb5ca6da0c484f1f37ea", sum)
+}
+
+func TestProfile(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	})
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+
+	_, err = f.List(ctx, "")
+	require.NoError(t, err)
+	o := firstObject(ctx, t, f)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	_, err = f.NewObject(ctx, "potato.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	out, err := f.Command(ctx, "profile", nil, map[string]string{"reset": ""})
+	require.NoError(t, err)
+	r := out.(*profileReport)
+	require.Len(t, r.Ops, numProfileOps)
+	calls := map[string][2]int64{}
+	for _, op := range r.Ops {
+		var inBuckets int64
+		for _, b := range op.Buckets {
+			inBuckets += b.Calls
+		}
+		assert.Equal(t, op.Calls, inBuckets, op.Op)
+		assert.LessOrEqual(t, op.MaxSeconds, op.Seconds, op.Op)
+		calls[op.Op] = [2]int64{op.Calls, op.Errors}
+	}
+	assert.Equal(t, [2]int64{2, 0}, calls["list"])
+	assert.Equal(t, [2]int64{1, 1}, calls["new_object"])
+	assert.Equal(t, [2]int64{1, 0}, calls["open"])
+	assert.Equal(t, [2]int64{0, 0}, calls["put"])
+	assert.Equal(t, "+Inf", r.Ops[0].Buckets[numProfileBuckets-1].LE)
+
+	// The counts were reset once shown
+	r = f.profileReport(false)
+	for _, op := range r.Ops {
+		assert.Zero(t, op.Calls, op.Op)
+	}
+	out, err = f.Command(ctx, "profile", nil, map[string]string{"format": "csv"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.(string), "op,calls,errors,seconds,mean_seconds,max_seconds,le_0.0001,"), out)
+	out, err = f.Command(ctx, "profile", nil, map[string]string{"format": "prom"})
+	require.NoError(t, err)
+	assert.Contains(t, out.(string), `spectra_profile_bucket_calls{op="put",le="+Inf"} 0`)
+
+	// Recursive listings are profiled as lists too
+	fsys, err = NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	require.NoError(t, f.ListR(ctx, "", func(fs.DirEntries) error { return nil }))
+	r = f.profileReport(false)
+	assert.Equal(t, int64(1), r.Ops[profList].Calls)
+
+	// So are purges
+	require.NoError(t, f.Purge(ctx, "folder_1"))
+	r = f.profileReport(false)
+	assert.Equal(t, int64(1), r.Ops[profPurge].Calls)
+	assert.Zero(t, r.Ops[profPurge].Errors)
+}
+
+func TestPinUploads(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["pin_uploads"] = "true"
+	m["rewrite_rate"] = "1"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	generated := firstObject(ctx, t, f)
+	content := "fixture"
+	src := object.NewStaticObjectInfo("fixture.txt", time.Now(), int64(len(content)), true, nil, nil)
+	uploaded, err := f.Put(ctx, strings.NewReader(content), src)
+	require.NoError(t, err)
+	assert.True(t, f.pinned(ctx, uploaded.(*Object).ID()))
+	assert.False(t, f.pinned(ctx, generated.(*Object).ID()))
+
+	// Shrinking never picks the pinned file
+	picks := func() (picked bool) {
+		for n := range int64(100) {
+			file, err := f.pickGenerated(sdk.NodeTypeFile, "shrink", n, false)
+			require.NoError(t, err)
+			picked = picked || file == "/fixture.txt"
+		}
+		return picked
+	}
+	assert.False(t, picks())
+	f.opt.PinUploads = false
+	assert.True(t, picks())
+	f.opt.PinUploads = true
+
+	// The simulated writer leaves the pinned file alone
+	for _, o := range []fs.Object{generated, uploaded} {
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		_, err = io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+	}
+	require.Eventually(t, func() bool { return f.isRewritten(generated.(*Object).spectraPath()) }, time.Second, time.Millisecond)
+	require.NoError(t, f.Shutdown(ctx))
+	assert.False(t, f.isRewritten("/fixture.txt"))
+
+	_, err = NewFs(ctx, "test", "", configmap.Simple{
+		"config_path": "testdata/spectra-test.json",
+		"engine":      engineMemory,
+		"pin_uploads": "true",
+	})
+	assert.Error(t, err)
+}
+
+func TestReadOnlyWorlds(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["read_only_worlds"] = "primary"
+	primary, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	m["world"] = "s1"
+	s1, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	put := func(f fs.Fs, remote string) (fs.Object, error) {
+		src := object.NewStaticObjectInfo(remote, time.Now(), 5, true, nil, nil)
+		return f.Put(ctx, strings.NewReader("hello"), src)
+	}
+
+	// The read only world can't be written
+	_, err = put(primary, "new.txt")
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.Nil(t, primary.Features().Copy)
+
+	// The other world can, except for what it shares with it
+	src := firstObject(ctx, t, primary)
+	shared, err := s1.(*Fs).Copy(ctx, src, src.Remote())
+	require.NoError(t, err)
+	err = shared.Update(ctx, strings.NewReader("hello"), object.NewStaticObjectInfo(src.Remote(), time.Now(), 5, true, nil, nil))
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, shared.SetModTime(ctx, time.Now()), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, shared.Remove(ctx), fs.ErrorPermissionDenied)
+	_, err = primary.NewObject(ctx, src.Remote())
+	require.NoError(t, err)
+
+	// What it makes is kept out of the read only world
+	o, err := put(s1, "scratch/new.txt")
+	require.NoError(t, err)
+	_, err = primary.NewObject(ctx, "scratch/new.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	entries, err := primary.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.NotEqual(t, "scratch", entry.Remote())
+	}
+	require.NoError(t, o.Update(ctx, strings.NewReader("hi"), object.NewStaticObjectInfo(o.Remote(), time.Now(), 2, true, nil, nil)))
+	require.NoError(t, o.Remove(ctx))
+	require.NoError(t, s1.Rmdir(ctx, "scratch"))
+
+	m["read_only_worlds"] = "potato"
+	_, err = NewFs(ctx, "test", "", m)
+	assert.Error(t, err)
+}
+
+func TestSelftest(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	results := func(out any) map[string]string {
+		got := map[string]string{}
+		for _, c := range out.(*selftestReport).Checks {
+			got[c.Name] = c.Result
+			assert.Empty(t, c.Error, c.Name)
+		}
+		return got
+	}
+	out, err := fsys.(*Fs).Command(ctx, "selftest", nil, map[string]string{"dir": "scratch"})
+	require.NoError(t, err)
+	assert.True(t, out.(*selftestReport).Passed)
+	assert.Equal(t, map[string]string{
+		"list": selftestPass, "write": selftestPass, "stat": selftestPass, "read": selftestPass,
+		"hash": selftestPass, "move": selftestPass, "cleanup": selftestPass,
+	}, results(out))
+	_, err = fsys.List(ctx, "scratch")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	// A directory which exists is left alone
+	out, err = fsys.(*Fs).Command(ctx, "selftest", nil, map[string]string{"dir": "folder_1"})
+	require.NoError(t, err)
+	assert.False(t, out.(*selftestReport).Passed)
+	assert.Equal(t, selftestFail, out.(*selftestReport).Checks[1].Result)
+	_, err = fsys.List(ctx, "folder_1")
+	assert.NoError(t, err)
+
+	// A read only remote is checked without writing
+	m["read_only"] = "true"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	out, err = fsys.(*Fs).Command(ctx, "selftest", nil, map[string]string{"format": "csv"})
+	require.NoError(t, err)
+	assert.Equal(t, "check,result,seconds,error\nlist,pass,", out.(string)[:len("check,result,seconds,error\nlist,pass,")])
+	out, err = fsys.(*Fs).Command(ctx, "selftest", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"list": selftestPass, "write": selftestSkip, "stat": selftestPass, "read": selftestPass,
+		"hash": selftestPass, "move": selftestSkip,
+	}, results(out))
+}
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	})
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	tmpl, err := libhttp.GetTemplate("")
+	require.NoError(t, err)
+	srv := httptest.NewServer(&gateway{f: f, tmpl: tmpl})
+	t.Cleanup(srv.Close)
+	get := func(method, pth string, headers ...string) (*http.Response, string) {
+		req, err := http.NewRequestWithContext(ctx, method, srv.URL+pth, nil)
+		require.NoError(t, err)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, resp.Body.Close()) }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	// The root is served as an index of its entries
+	resp, body := get(http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	var o fs.Object
+	var dir fs.Directory
+	for _, entry := range entries {
+		assert.Contains(t, body, path.Base(entry.Remote()))
+		switch x := entry.(type) {
+		case fs.Object:
+			o = x
+		case fs.Directory:
+			dir = x
+		}
+	}
+	require.NotNil(t, o)
+	require.NotNil(t, dir)
+
+	// Directories without the trailing slash are redirected to it
+	resp, _ = get(http.MethodGet, "/"+dir.Remote())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/"+dir.Remote()+"/", resp.Request.URL.Path)
+
+	// Files are read whole or by range
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	want, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	require.Greater(t, len(want), 20)
+	resp, body = get(http.MethodGet, "/"+o.Remote())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(want), body)
+	resp, body = get(http.MethodGet, "/"+o.Remote(), "Range", "bytes=10-19")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, string(want[10:20]), body)
+	resp, body = get(http.MethodHead, "/"+o.Remote())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(want)), resp.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+
+	// Missing paths aren't found
+	resp, _ = get(http.MethodGet, "/potato")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Writes are refused and change nothing
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+		resp, _ = get(method, "/"+o.Remote())
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, method)
+		assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+	}
+	_, err = f.NewObject(ctx, o.Remote())
+	assert.NoError(t, err)
+
+	// Remotes starting a gateway on the same address share it and
+	// the one which started it stops it
+	const addr = "127.0.0.1:0"
+	require.NoError(t, f.startGateway(addr))
+	require.NotNil(t, f.gateway)
+	other := &Fs{name: "other"}
+	require.NoError(t, other.startGateway(addr))
+	assert.Nil(t, other.gateway)
+	require.NoError(t, other.stopGateway(ctx))
+	gatewaysMu.Lock()
+	assert.Contains(t, gateways, addr)
+	gatewaysMu.Unlock()
+	require.NoError(t, f.stopGateway(ctx))
+	assert.Nil(t, f.gateway)
+	gatewaysMu.Lock()
+	assert.NotContains(t, gateways, addr)
+	gatewaysMu.Unlock()
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	journal := filepath.Join(t.TempDir(), "spectra.journal")
+	m := diskConfig(t)
+	m["journal"] = journal
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	put := func(remote, content string) fs.Object {
+		src := object.NewStaticObjectInfo(remote, time.Unix(1700000000, 0), int64(len(content)), true, nil, nil)
+		o, err := f.Put(ctx, strings.NewReader(content), src)
+		require.NoError(t, err)
+		return o
+	}
+	generated := firstObject(ctx, t, f)
+	require.NoError(t, f.Mkdir(ctx, "dir"))
+	a := put("dir/a.txt", "first")
+	b := put("b.txt", "second")
+	_, err = f.Move(ctx, b, "dir/b.txt")
+	require.NoError(t, err)
+	require.NoError(t, a.Update(ctx, strings.NewReader("updated"), object.NewStaticObjectInfo("dir/a.txt", time.Now(), 7, true, nil, nil)))
+	modTime := time.Unix(1600000000, 0)
+	require.NoError(t, a.SetModTime(ctx, modTime))
+	require.NoError(t, f.Mkdir(ctx, "gone"))
+	require.NoError(t, f.Purge(ctx, "gone"))
+	require.NoError(t, generated.Remove(ctx))
+	assert.Error(t, f.Rmdir(ctx, "missing"))
+	require.NoError(t, f.Shutdown(ctx))
+
+	// Carried on when opened again
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), fsys.(*Fs).journalSeq)
+	require.NoError(t, fsys.(*Fs).Shutdown(ctx))
+
+	replayed, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	out, err := replayed.(*Fs).Command(ctx, "replay", []string{journal}, nil)
+	require.NoError(t, err)
+	report := out.(*replayReport)
+	assert.Equal(t, int64(11), report.Applied)
+	assert.Equal(t, int64(11), report.LastSeq)
+	assert.Equal(t, int64(3), report.Ops[journalPut])
+	content := func(remote string) string {
+		o, err := replayed.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+	assert.Equal(t, "updated", content("dir/a.txt"))
+	assert.Equal(t, "second", content("dir/b.txt"))
+	o, err := replayed.NewObject(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(o.ModTime(ctx)))
+	_, err = replayed.NewObject(ctx, "b.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = replayed.NewObject(ctx, generated.Remote())
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = replayed.List(ctx, "gone")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+
+	// Replayed up to a point
+	partial, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	out, err = partial.(*Fs).Command(ctx, "replay", []string{journal}, map[string]string{"until": "3"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), out.(*replayReport).Applied)
+	_, err = partial.NewObject(ctx, "dir/a.txt")
+	assert.NoError(t, err)
+	_, err = partial.NewObject(ctx, "b.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestJournalCrash(t *testing.T) {
+	ctx := context.Background()
+	journal := filepath.Join(t.TempDir(), "spectra.journal")
+	m := diskConfig(t)
+	m["journal"] = journal
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	require.NoError(t, fsys.Mkdir(ctx, "dir"))
+	src := object.NewStaticObjectInfo("dir/a.txt", time.Now(), 5, true, nil, nil)
+	_, err = fsys.Put(ctx, strings.NewReader("hello"), src)
+	require.NoError(t, err)
+	seq := fsys.(*Fs).journalSeq
+	require.NoError(t, fsys.(*Fs).Shutdown(ctx))
+	whole, err := os.ReadFile(journal)
+	require.NoError(t, err)
+
+	// The content is kept beside the journal rather than in it
+	assert.NotContains(t, string(whole), base64.StdEncoding.EncodeToString([]byte("hello")))
+	names, err := os.ReadDir(journalContentDir(journal))
+	require.NoError(t, err)
+	assert.Len(t, names, 1)
+
+	// A partial entry left by a crash is dropped
+	torn := append(slices.Clone(whole), `{"seq":9,"op":"mkd`...)
+	require.NoError(t, os.WriteFile(journal, torn, 0600))
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	assert.Equal(t, seq, f.journalSeq)
+	require.NoError(t, f.Mkdir(ctx, "after"))
+	require.NoError(t, f.Shutdown(ctx))
+	replayed, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	out, err := replayed.(*Fs).Command(ctx, "replay", []string{journal}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, seq+1, out.(*replayReport).LastSeq)
+	o, err := replayed.NewObject(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), o.Size())
+	_, err = replayed.List(ctx, "after")
+	assert.NoError(t, err)
+
+	// A damaged entry before the end isn't a crash so fails
+	damaged := append([]byte("{\"seq\":\n"), whole...)
+	require.NoError(t, os.WriteFile(journal, damaged, 0600))
+	_, err = NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "failed to read journal entry")
+
+	// Failing to journal fails the operation
+	require.NoError(t, os.WriteFile(journal, whole, 0600))
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	require.NoError(t, f.journal.Close())
+	assert.ErrorContains(t, f.Mkdir(ctx, "unjournalled"), "failed to journal mkdir")
+	_, err = f.Put(ctx, strings.NewReader("hello"), object.NewStaticObjectInfo("b.txt", time.Now(), 5, true, nil, nil))
+	assert.ErrorContains(t, err, "failed to journal put")
+}
+
+func TestJournalEncrypted(t *testing.T) {
+	ctx := context.Background()
+	journal := filepath.Join(t.TempDir(), "spectra.journal")
+	m := diskConfig(t)
+	m["journal"] = journal
+	m["db_key"] = obscure.MustObscure("secret")
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+
+	// Content over a chunk long is sealed a chunk at a time
+	data := []byte(strings.Repeat("plaintext", journalChunkSize/9+1000))
+	src := object.NewStaticObjectInfo("big.txt", time.Now(), int64(len(data)), true, nil, nil)
+	_, err = fsys.Put(ctx, bytes.NewReader(data), src)
+	require.NoError(t, err)
+	require.NoError(t, fsys.(*Fs).Shutdown(ctx))
+	names, err := os.ReadDir(journalContentDir(journal))
+	require.NoError(t, err)
+	for _, name := range names {
+		stored, err := os.ReadFile(filepath.Join(journalContentDir(journal), name.Name()))
+		require.NoError(t, err)
+		assert.NotContains(t, string(stored), "plaintext")
+	}
+	line, err := os.ReadFile(journal)
+	require.NoError(t, err)
+	assert.NotContains(t, string(line), "plaintext")
+	assert.Contains(t, string(line), `"encrypted":true`)
+
+	// Replayed onto a database with its own salt given the same key
+	fresh := diskConfig(t)
+	fresh["db_key"] = obscure.MustObscure("secret")
+	replayed, err := NewFs(ctx, "test", "", fresh)
+	require.NoError(t, err)
+	_, err = replayed.(*Fs).Command(ctx, "replay", []string{journal}, nil)
+	require.NoError(t, err)
+	o, err := replayed.NewObject(ctx, "big.txt")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	got, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.True(t, bytes.Equal(data, got))
+
+	// But not without it, or with another
+	plain, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	_, err = plain.(*Fs).Command(ctx, "replay", []string{journal}, nil)
+	assert.ErrorContains(t, err, "set db_key")
+	wrong := diskConfig(t)
+	wrong["db_key"] = obscure.MustObscure("wrong")
+	other, err := NewFs(ctx, "test", "", wrong)
+	require.NoError(t, err)
+	_, err = other.(*Fs).Command(ctx, "replay", []string{journal}, nil)
+	assert.ErrorContains(t, err, "wrong db_key")
+}
+
+func TestRenamePrefix(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["engine"] = engineMemory
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	require.NotNil(t, f.Features().DirMove)
+	names := func(entries fs.DirEntries) (names []string) {
+		for _, entry := range entries {
+			names = append(names, path.Base(entry.Remote()))
+		}
+		return names
+	}
+	before, err := f.List(ctx, "folder_1")
+	require.NoError(t, err)
+	require.NoError(t, f.DirMove(ctx, f, "folder_1", "renamed/deep"))
+	after, err := f.List(ctx, "renamed/deep")
+	require.NoError(t, err)
+	assert.Equal(t, names(before), names(after))
+	_, err = f.List(ctx, "folder_1")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	assert.ErrorIs(t, f.DirMove(ctx, f, "renamed", "renamed/deep/inside"), fs.ErrorCantDirMove)
+	assert.ErrorIs(t, f.DirMove(ctx, f, "renamed/deep", "renamed"), fs.ErrorDirExists)
+
+	// Only the nodes generated so far are renamed
+	e, err := newMemEngine(m["config_path"])
+	require.NoError(t, err)
+	result, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: "/", TableName: "primary"})
+	require.NoError(t, err)
+	n, err := e.RenamePrefix("primary", "/folder_1", "/moved")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	moved, err := e.ListChildren(ctx, &sdk.ListChildrenRequest{ParentPath: "/moved", TableName: "primary"})
+	require.NoError(t, err)
+	require.NotEmpty(t, moved.Files)
+	assert.Equal(t, "/moved/"+moved.Files[0].Name, moved.Files[0].Path)
+	assert.Equal(t, 2, moved.Files[0].DepthLevel)
+	n, err = e.RenamePrefix("primary", "/moved", "/again")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1+len(moved.Folders)+len(moved.Files)), n)
+
+	// Nodes shared with other worlds aren't renamed
+	e.nodes[result.Files[0].ID].ExistenceMap["s1"] = true
+	_, err = e.RenamePrefix("primary", "/again", "/shared")
+	assert.NoError(t, err)
+	e.nodes[moved.Files[0].ID].ExistenceMap["s1"] = true
+	_, err = e.RenamePrefix("primary", "/shared", "/refused")
+	assert.ErrorIs(t, err, errRenameShared)
+}
+
+func TestNames(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":     "testdata/spectra-test.json",
+		"engine":          engineMemory,
+		"world":           "primary",
+		"lazy":            "true",
+		"db_compression":  compressionOff,
+		"encoding":        "Colon",
+		"max_name_length": "12",
+	})
+	require.NoError(t, err)
+	put := func(remote string) error {
+		src := object.NewStaticObjectInfo(remote, time.Now(), 1, true, nil, nil)
+		_, err := fsys.Put(ctx, bytes.NewReader([]byte{1}), src)
+		return err
+	}
+
+	// Names are encoded as stored and decoded as listed
+	require.NoError(t, put("dir/a:b.txt"))
+	entries, err := fsys.List(ctx, "dir")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "dir/a:b.txt", entries[0].Remote())
+	_, err = fsys.NewObject(ctx, "dir/a:b.txt")
+	assert.NoError(t, err)
+	node, err := fsys.(*Fs).getNode(ctx, "/dir/a：b.txt")
+	require.NoError(t, err)
+	assert.NotNil(t, node)
+
+	// Names are limited in bytes as stored
+	assert.ErrorIs(t, put("too_long_a_name.txt"), fs.ErrorFileNameTooLong)
+	assert.ErrorIs(t, put("too_long_a_name/a.txt"), fs.ErrorFileNameTooLong)
+	assert.ErrorIs(t, fsys.Mkdir(ctx, "dir/too_long_a_name"), fs.ErrorFileNameTooLong)
+	assert.NoError(t, put("twelve_bytes"))
+
+	_, err = NewFs(ctx, "test", "", configmap.Simple{
+		"config_path": "testdata/spectra-test.json",
+		"engine":      engineMemory,
+		"encoding":    "Slash",
+	})
+	assert.ErrorContains(t, err, "encoding")
+}
+
+// corruptingEngine flips the first byte of the files uploaded to the
+// memory engine it wraps, as a faulty store would
+type corruptingEngine struct {
+	engine
+}
+
+// UploadFile uploads the file with its first byte flipped
+func (e corruptingEngine) UploadFile(ctx context.Context, req *sdk.UploadFileRequest) (*sdk.Node, error) {
+	corrupt := *req
+	corrupt.Data = slices.Clone(req.Data)
+	corrupt.Data[0] ^= 0xff
+	return e.engine.UploadFile(ctx, &corrupt)
+}
+
+// Uploaded returns whether the file with id holds uploaded content
+func (e corruptingEngine) Uploaded(id string) bool {
+	return e.engine.(contentKeeper).Uploaded(id)
+}
+
+func TestVerifyUpload(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	})
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	content := []byte("verified content")
+	put := func(remote string, size int64) error {
+		src := object.NewStaticObjectInfo(remote, time.Now(), size, true, nil, fsys)
+		_, err := fsys.Put(ctx, bytes.NewReader(content), src)
+		return err
+	}
+
+	// Uploads which are committed as read pass
+	require.NoError(t, put("good.txt", int64(len(content))))
+	require.NoError(t, put("good_stream.txt", -1))
+
+	// Those which aren't fail, retriably, leaving nothing behind
+	f.engine = corruptingEngine{f.engine}
+	for _, remote := range []string{"bad.txt", "bad_stream.txt"} {
+		size := int64(len(content))
+		if remote == "bad_stream.txt" {
+			size = -1
+		}
+		err := put(remote, size)
+		assert.ErrorIs(t, err, errVerify, remote)
+		assert.True(t, fserrors.IsRetryError(err), remote)
+		_, err = fsys.NewObject(ctx, remote)
+		assert.ErrorIs(t, err, fs.ErrorObjectNotFound, remote)
+	}
+
+	// The data read is checked against the checksum committed, if the
+	// content is kept
+	s := newStreamSum()
+	_, err = io.Copy(io.Discard, s.reader(bytes.NewReader(content)))
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+	assert.NoError(t, s.check("a", hex.EncodeToString(sum[:])))
+	assert.NoError(t, s.check("a", ""))
+	assert.ErrorIs(t, newStreamSum().check("a", hex.EncodeToString(sum[:])), errVerify)
+}
+
+func TestEncryption(t *testing.T) {
+	// Data sealed with a key only unseals with the same key
+	f, other := &Fs{}, &Fs{}
+	salt := []byte("0123456789abcdef")
+	require.NoError(t, f.deriveKey("secret", salt))
+	require.NoError(t, other.deriveKey("other", salt))
+	data := []byte("hello world")
+	sealed, err := f.seal(data)
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "hello")
+	assert.Equal(t, int64(len(data)), unsealedSize(int64(len(sealed))))
+	again, err := f.seal(data)
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "nonces must differ")
+	got, err := f.unseal(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	_, err = other.unseal(sealed)
+	assert.ErrorContains(t, err, "wrong db_key")
+	_, err = (&Fs{}).unseal(sealed)
+	assert.ErrorContains(t, err, "set db_key")
+	_, err = f.unseal(sealed[:nonceSize])
+	assert.ErrorContains(t, err, "too short")
+	empty, err := f.seal(nil)
+	require.NoError(t, err)
+	got, err = f.unseal(empty)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{}, got)
+
+	// Uploads are stored encrypted and read back decrypted
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["db_key"] = obscure.MustObscure("secret")
+	m["db_compression"] = compressionZstd
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	content := bytes.Repeat([]byte("plaintext "), 100)
+	src := object.NewStaticObjectInfo("secret.txt", time.Now(), int64(len(content)), true, nil, nil)
+	_, err = f.Put(ctx, bytes.NewReader(content), src)
+	require.NoError(t, err)
+	var raw []byte
+	var encrypted bool
+	require.NoError(t, f.db.QueryRow(`SELECT encrypted, data FROM spectra_blobs`).Scan(&encrypted, &raw))
+	assert.True(t, encrypted)
+	assert.NotContains(t, string(raw), "plaintext")
+	readBack := func(fsys fs.Fs) ([]byte, error) {
+		o, err := fsys.NewObject(ctx, "secret.txt")
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = in.Close() }()
+		return io.ReadAll(in)
+	}
+	got, err = readBack(f)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// Remotes given another key or none are refused or can't read
+	m["db_key"] = obscure.MustObscure("wrong")
+	_, err = NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "db_key doesn't match")
+	m["db_key"] = ""
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	_, err = readBack(fsys)
+	assert.ErrorContains(t, err, "set db_key")
+	m["db_key"] = obscure.MustObscure("secret")
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	got, err = readBack(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestEncryptionSalt(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	var remotes []*Fs
+	for range 4 {
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		f := fsys.(*Fs)
+		f.opt.DBKey = obscure.MustObscure("secret")
+		remotes = append(remotes, f)
+	}
+
+	// Remotes encrypting a new database at once agree on the salt
+	var wg sync.WaitGroup
+	errs := make([]error, len(remotes))
+	for i, f := range remotes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f.initEncryption(ctx)
+		}()
+	}
+	wg.Wait()
+	for i, f := range remotes {
+		require.NoError(t, errs[i])
+		assert.Equal(t, remotes[0].dbKey, f.dbKey)
+	}
+	f := remotes[0]
+	var rows int
+	require.NoError(t, f.db.QueryRow(`SELECT count(*) FROM spectra_encryption`).Scan(&rows))
+	assert.Equal(t, 1, rows)
+	_, err := f.db.Exec(`INSERT INTO spectra_encryption (id, salt, key_check) VALUES (2, x'00', x'00')`)
+	assert.Error(t, err)
+
+	// Tables of older databases keep their first salt
+	var salt []byte
+	require.NoError(t, f.db.QueryRow(`SELECT salt FROM spectra_encryption`).Scan(&salt))
+	_, err = f.db.Exec(`
+DROP TABLE spectra_encryption;
+CREATE TABLE spectra_encryption (salt BLOB NOT NULL, key_check BLOB NOT NULL);
+INSERT INTO spectra_encryption (salt, key_check) VALUES (?, ?);
+INSERT INTO spectra_encryption (salt, key_check) VALUES (x'00', x'00');
+UPDATE spectra_schema SET version = 1`, salt, []byte("unused"))
+	require.NoError(t, err)
+	require.NoError(t, f.checkSchema(ctx))
+	var id int
+	var migrated []byte
+	require.NoError(t, f.db.QueryRow(`SELECT count(*) FROM spectra_encryption`).Scan(&rows))
+	assert.Equal(t, 1, rows)
+	require.NoError(t, f.db.QueryRow(`SELECT id, salt FROM spectra_encryption`).Scan(&id, &migrated))
+	assert.Equal(t, 1, id)
+	assert.Equal(t, salt, migrated)
+}
+
+func TestCompressBlob(t *testing.T) {
+	compressible := bytes.Repeat([]byte("spectra "), 1000)
+	incompressible := make([]byte, 1000)
+	for i := range incompressible {
+		incompressible[i] = byte(rand.IntN(256))
+	}
+	for _, method := range []string{compressionOff, compressionGzip, compressionZstd} {
+		t.Run(method, func(t *testing.T) {
+			stored, storedWith, err := compressBlob(method, compressible)
+			require.NoError(t, err)
+			assert.Equal(t, method, storedWith)
+			if method != compressionOff {
+				assert.Less(t, len(stored), len(compressible))
+			}
+			got, err := decompressBlob(storedWith, stored)
+			require.NoError(t, err)
+			assert.Equal(t, compressible, got)
+
+			// Data which doesn't shrink is stored as it is
+			stored, storedWith, err = compressBlob(method, incompressible)
+			require.NoError(t, err)
+			assert.Equal(t, compressionOff, storedWith)
+			assert.Equal(t, incompressible, stored)
+		})
+	}
+	_, err := decompressBlob(compressionGzip, []byte("not gzip"))
+	assert.Error(t, err)
+	_, err = decompressBlob(compressionZstd, []byte("not zstd"))
+	assert.Error(t, err)
+	_, err = decompressBlob("lz4", nil)
+	assert.ErrorContains(t, err, "unknown compression")
+	assert.Error(t, checkCompression("lz4"))
+}
+
+func TestCompressionMixed(t *testing.T) {
+	// Blobs stored with each setting can be read whatever the current one
+	ctx := context.Background()
+	m := diskConfig(t)
+	content := map[string][]byte{}
+	for _, method := range []string{compressionOff, compressionGzip, compressionZstd} {
+		m["db_compression"] = method
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		data := bytes.Repeat([]byte(method+" "), 500)
+		remote := method + ".txt"
+		src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(data)), true, nil, nil)
+		_, err = fsys.Put(ctx, bytes.NewReader(data), src)
+		require.NoError(t, err)
+		content[remote] = data
+		var stored string
+		require.NoError(t, fsys.(*Fs).db.QueryRow(`SELECT compression FROM spectra_blobs WHERE size = ? AND sha256 = (
+SELECT sha256 FROM spectra_file_blobs fb JOIN nodes n ON n.id = fb.node_id WHERE n.name = ?)`, len(data), remote).Scan(&stored))
+		assert.Equal(t, method, stored)
+	}
+	for _, method := range []string{compressionOff, compressionGzip, compressionZstd} {
+		m["db_compression"] = method
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		for remote, data := range content {
+			o, err := fsys.NewObject(ctx, remote)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(data)), o.Size())
+			in, err := o.Open(ctx)
+			require.NoError(t, err)
+			got, err := io.ReadAll(in)
+			require.NoError(t, err)
+			require.NoError(t, in.Close())
+			assert.Equal(t, data, got, "%s read with %s", remote, method)
+		}
+	}
+}
+
+// memConfig returns the config of a remote on the in memory engine
+func memConfig() configmap.Simple {
+	return configmap.Simple{
+		"config_path":    "testdata/spectra-test.json",
+		"engine":         engineMemory,
+		"world":          "primary",
+		"lazy":           "true",
+		"db_compression": compressionOff,
+	}
+}
+
+// listObjects returns all the objects of f
+func listObjects(ctx context.Context, t *testing.T, f fs.Fs) (objects []fs.Object) {
+	require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		entries.ForObject(func(o fs.Object) {
+			objects = append(objects, o)
+		})
+		return nil
+	}))
+	require.NotEmpty(t, objects)
+	return objects
+}
+
+func TestNoHash(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	m["extra_hashes"] = "md5"
+	m["no_hash_rate"] = "0.5"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	absent := map[string]bool{}
+	for _, o := range listObjects(ctx, t, f) {
+		gone := f.hashAbsent(o.(*Object).spectraPath())
+		absent[o.Remote()] = gone
+		for _, ty := range []hash.Type{hash.SHA256, hash.MD5} {
+			sum, err := o.Hash(ctx, ty)
+			require.NoError(t, err)
+			assert.Equal(t, gone, sum == "", "%s %v", o.Remote(), ty)
+		}
+	}
+	assert.Contains(t, slices.Collect(maps.Values(absent)), true)
+	assert.Contains(t, slices.Collect(maps.Values(absent)), false)
+
+	// The same objects have no hash each time the world is opened
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	for _, o := range listObjects(ctx, t, fsys) {
+		sum, err := o.Hash(ctx, hash.SHA256)
+		require.NoError(t, err)
+		assert.Equal(t, absent[o.Remote()], sum == "", o.Remote())
+	}
+
+	// And every object has none at a rate of 1
+	m["no_hash_rate"] = "1"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	for _, o := range listObjects(ctx, t, fsys) {
+		sum, err := o.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.Empty(t, sum)
+	}
+}
+
+func TestExpiryHeaders(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	metadata, err := fs.GetMetadata(ctx, firstObject(ctx, t, fsys))
+	require.NoError(t, err)
+	assert.NotContains(t, metadata, "cache-control")
+	assert.NotContains(t, metadata, "expires")
+
+	m["expiry_headers"] = "true"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	policies := map[string]time.Duration{}
+	for _, policy := range cachePolicies {
+		policies[policy.cacheControl] = policy.maxAge
+	}
+	policy := map[string]string{}
+	for _, o := range listObjects(ctx, t, fsys) {
+		metadata, err := fs.GetMetadata(ctx, o)
+		require.NoError(t, err)
+		maxAge, ok := policies[metadata["cache-control"]]
+		require.True(t, ok, metadata["cache-control"])
+		expires, err := http.ParseTime(metadata["expires"])
+		require.NoError(t, err)
+		assert.True(t, o.ModTime(ctx).Add(maxAge).Truncate(time.Second).Equal(expires), o.Remote())
+		assert.Equal(t, fs.MimeType(ctx, o), metadata["content-type"])
+		policy[o.Remote()] = metadata["cache-control"]
+	}
+	assert.Greater(t, len(slices.Compact(slices.Sorted(maps.Values(policy)))), 1)
+
+	// The policies are the same each time the world is opened
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	for _, o := range listObjects(ctx, t, fsys) {
+		metadata, err := fs.GetMetadata(ctx, o)
+		require.NoError(t, err)
+		assert.Equal(t, policy[o.Remote()], metadata["cache-control"], o.Remote())
+	}
+
+	// Which serve http sends as headers
+	o := firstObject(ctx, t, fsys)
+	w := httptest.NewRecorder()
+	serve.SetCacheHeaders(ctx, w, o)
+	assert.Equal(t, policy[o.Remote()], w.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, w.Header().Get("Expires"))
+}
+
+func TestPublicLink(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	m["link_base_url"] = "https://links.example/s"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	clock := &testClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	f.clock = clock
+	o := firstObject(ctx, t, f)
+
+	// Links without an expiry never expire by default
+	link, err := f.PublicLink(ctx, o.Remote(), fs.DurationOff, false)
+	require.NoError(t, err)
+	assert.Regexp(t, `^https://links\.example/s/[0-9a-f]{16}/`+regexp.QuoteMeta(url.PathEscape(path.Base(o.Remote())))+`$`, link)
+	again, err := f.PublicLink(ctx, o.Remote(), fs.DurationOff, false)
+	require.NoError(t, err)
+	assert.Equal(t, link, again)
+
+	// Links which expire say when, and differ by expiry
+	expiring, err := f.PublicLink(ctx, o.Remote(), fs.Duration(time.Hour), false)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(expiring, "?expires="+strconv.FormatInt(clock.now.Add(time.Hour).Unix(), 10)), expiring)
+	assert.NotEqual(t, strings.SplitN(link, "/", 6)[4], strings.SplitN(expiring, "/", 6)[4])
+
+	// link_expiry applies when no expiry is given
+	f.opt.LinkExpiry = fs.Duration(time.Hour)
+	defaulted, err := f.PublicLink(ctx, o.Remote(), fs.DurationOff, false)
+	require.NoError(t, err)
+	assert.Equal(t, expiring, defaulted)
+	f.opt.LinkExpiry = fs.DurationOff
+
+	// The same link is made by another remote on the same world
+	other, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	other.(*Fs).clock = clock
+	otherLink, err := other.(*Fs).PublicLink(ctx, o.Remote(), fs.Duration(time.Hour), false)
+	require.NoError(t, err)
+	assert.Equal(t, expiring, otherLink)
+
+	// Directories have links too but missing paths don't
+	root, err := f.PublicLink(ctx, "", fs.DurationOff, false)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(root, "/"), root)
+	_, err = f.PublicLink(ctx, "potato", fs.DurationOff, false)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.PublicLink(ctx, o.Remote(), fs.DurationOff, true)
+	assert.ErrorContains(t, err, "can't be removed")
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	_, err = fsys.(*Fs).Command(ctx, "restore", nil, nil)
+	assert.ErrorContains(t, err, "set archive_rate")
+
+	m["archive_rate"] = "0.5"
+	m["restore_delay"] = "1h"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	clock := &testClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	f.clock = clock
+	open := func(o fs.Object) error {
+		in, err := o.Open(ctx)
+		if err == nil {
+			require.NoError(t, in.Close())
+		}
+		return err
+	}
+	objects := listObjects(ctx, t, f)
+	var archived, standard []fs.Object
+	for _, o := range objects {
+		if f.archived(o.(*Object).spectraPath()) {
+			archived = append(archived, o)
+			assert.Equal(t, tierArchive, o.(fs.GetTierer).GetTier())
+			err := open(o)
+			assert.ErrorContains(t, err, "object is archived")
+			assert.True(t, fserrors.IsNoRetryError(err))
+		} else {
+			standard = append(standard, o)
+			assert.Equal(t, tierStandard, o.(fs.GetTierer).GetTier())
+			assert.NoError(t, open(o))
+		}
+	}
+	require.NotEmpty(t, archived)
+	require.NotEmpty(t, standard)
+
+	// Restores are ready after restore_delay for the duration asked for
+	out, err := f.Command(ctx, "restore", nil, map[string]string{"duration": "2h"})
+	require.NoError(t, err)
+	statuses := out.([]restoreStatus)
+	assert.Len(t, statuses, len(objects))
+	for _, st := range statuses {
+		if f.archived(f.toSpectraPath(st.Remote)) {
+			assert.Equal(t, "OK", st.Status, st.Remote)
+			assert.Equal(t, "2026-01-01T01:00:00Z", st.ReadyAt)
+		} else {
+			assert.Equal(t, "not archived", st.Status, st.Remote)
+		}
+	}
+	assert.ErrorContains(t, open(archived[0]), "restore in progress: ready in 1h0m0s")
+	clock.now = clock.now.Add(time.Hour)
+	for _, o := range archived {
+		assert.NoError(t, open(o))
+	}
+
+	// Restoring again extends the restore without delaying it
+	clock.now = clock.now.Add(time.Hour)
+	readyAt, err := f.restore(ctx, archived[0].(*Object).spectraPath(), 2*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, clock.now.Add(-time.Hour), readyAt.UTC())
+	clock.now = clock.now.Add(time.Hour + time.Minute)
+	assert.NoError(t, open(archived[0]))
+	if len(archived) > 1 {
+		assert.ErrorContains(t, open(archived[1]), "object is archived")
+	}
+
+	// Restores are kept in the database for the next run
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	fsys.(*Fs).clock = clock
+	o, err := fsys.NewObject(ctx, archived[0].Remote())
+	require.NoError(t, err)
+	assert.NoError(t, open(o))
+}
+
+// failingReader fails every read
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("read again") }
+
+func (failingReader) Seek(int64, int) (int64, error) { return 0, errors.New("read again") }
+
+func TestUploadSession(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["chunk_size"] = "4B"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	data := []byte("0123456789ab")
+	src := object.NewStaticObjectInfo("dir/up.txt", time.Now(), int64(len(data)), true, nil, nil)
+	sessions := func(f *Fs) (n int) {
+		require.NoError(t, f.db.QueryRowContext(ctx, `SELECT count(*) FROM spectra_upload_sessions`).Scan(&n))
+		return n
+	}
+	read := func(o fs.Object) []byte {
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		got, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return got
+	}
+
+	// An interrupted upload leaves its chunks in the session
+	info, writer, err := f.OpenChunkWriter(ctx, src.Remote(), src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.ChunkSize)
+	assert.True(t, info.LeavePartsOnError)
+	for chunk := range 2 {
+		n, err := writer.WriteChunk(ctx, chunk, bytes.NewReader(data[chunk*4:chunk*4+4]))
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), n)
+	}
+
+	// Which are resumed after a restart without being sent again
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	assert.Equal(t, 1, sessions(f))
+	_, writer, err = f.OpenChunkWriter(ctx, src.Remote(), src, &fs.ChunkOption{ChunkSize: 4})
+	require.NoError(t, err)
+	for chunk := range 2 {
+		n, err := writer.WriteChunk(ctx, chunk, failingReader{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), n)
+	}
+	_, err = writer.WriteChunk(ctx, 2, bytes.NewReader(data[8:]))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close(ctx))
+	assert.Equal(t, 0, sessions(f))
+	o, err := f.NewObject(ctx, src.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, data, read(o))
+
+	// An upload of another size, source or chunk size starts again,
+	// ending the session it can't use
+	shorter := object.NewStaticObjectInfo(src.Remote(), src.ModTime(ctx), 4, true, nil, nil)
+	changed := object.NewStaticObjectInfo(src.Remote(), src.ModTime(ctx).Add(time.Second), src.Size(), true, nil, nil)
+	for _, test := range []struct {
+		name    string
+		src     fs.ObjectInfo
+		options []fs.OpenOption
+	}{
+		{"size", shorter, nil},
+		{"modtime", changed, nil},
+		{"chunk size", src, []fs.OpenOption{&fs.ChunkOption{ChunkSize: 6}}},
+	} {
+		_, writer, err = f.OpenChunkWriter(ctx, src.Remote(), src)
+		require.NoError(t, err, test.name)
+		_, err = writer.WriteChunk(ctx, 0, bytes.NewReader(data[:4]))
+		require.NoError(t, err, test.name)
+		_, other, err := f.OpenChunkWriter(ctx, src.Remote(), test.src, test.options...)
+		require.NoError(t, err, test.name)
+		assert.NotEqual(t, writer.(*uploadSession).id, other.(*uploadSession).id, test.name)
+		assert.Equal(t, 1, sessions(f), test.name)
+		require.NoError(t, other.Abort(ctx), test.name)
+		assert.Equal(t, 0, sessions(f), test.name)
+	}
+
+	// A chunk cut short is written again when the session is resumed
+	_, writer, err = f.OpenChunkWriter(ctx, src.Remote(), src)
+	require.NoError(t, err)
+	_, err = writer.WriteChunk(ctx, 0, bytes.NewReader(data[:2]))
+	require.NoError(t, err)
+	_, writer, err = f.OpenChunkWriter(ctx, src.Remote(), src)
+	require.NoError(t, err)
+	for chunk := range 3 {
+		n, err := writer.WriteChunk(ctx, chunk, bytes.NewReader(data[chunk*4:chunk*4+4]))
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), n)
+	}
+	require.NoError(t, writer.Close(ctx))
+	o, err = f.NewObject(ctx, src.Remote())
+	require.NoError(t, err)
+	assert.Equal(t, data, read(o))
+
+	// A session missing data is ended when it is closed
+	_, writer, err = f.OpenChunkWriter(ctx, src.Remote(), src)
+	require.NoError(t, err)
+	_, err = writer.WriteChunk(ctx, 0, bytes.NewReader(data[:4]))
+	require.NoError(t, err)
+	_, err = writer.WriteChunk(ctx, 2, bytes.NewReader(data[8:10]))
+	require.NoError(t, err)
+	_, err = writer.WriteChunk(ctx, 1, bytes.NewReader(data[4:8]))
+	require.NoError(t, err)
+	assert.ErrorContains(t, writer.Close(ctx), "has 10 bytes but expected 12")
+	assert.Equal(t, 0, sessions(f))
+
+	// As is one whose data doesn't match the hash of the source
+	hashed := object.NewStaticObjectInfo(src.Remote(), src.ModTime(ctx), src.Size(), true, map[hash.Type]string{
+		hash.SHA256: strings.Repeat("0", 64),
+	}, nil)
+	_, writer, err = f.OpenChunkWriter(ctx, src.Remote(), hashed)
+	require.NoError(t, err)
+	for chunk := range 3 {
+		_, err = writer.WriteChunk(ctx, chunk, bytes.NewReader(data[chunk*4:chunk*4+4]))
+		require.NoError(t, err)
+	}
+	assert.ErrorIs(t, writer.Close(ctx), errVerify)
+	assert.Equal(t, 0, sessions(f))
+
+	// Killed sessions lose their chunks and can't be used again
+	m["upload_kill_rate"] = "1"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	_, writer, err = f.OpenChunkWriter(ctx, src.Remote(), src)
+	require.NoError(t, err)
+	_, err = writer.WriteChunk(ctx, 0, bytes.NewReader(data[:4]))
+	assert.ErrorIs(t, err, errSessionGone)
+	_, err = writer.WriteChunk(ctx, 1, bytes.NewReader(data[4:8]))
+	assert.ErrorIs(t, err, errSessionGone)
+	assert.ErrorIs(t, writer.Close(ctx), errSessionGone)
+	assert.Equal(t, 0, sessions(f))
+
+	// Which uploads are killed is the same on every run
+	m["upload_kill_rate"] = "0.5"
+	killed := func() (kills []bool) {
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		s, err := fsys.(*Fs).openSession(ctx, src.Remote(), src.Size(), 4, "", false)
+		require.NoError(t, err)
+		for chunk := range 8 {
+			kills = append(kills, s.killed(chunk))
+		}
+		require.NoError(t, s.Abort(ctx))
+		return kills
+	}
+	kills := killed()
+	assert.Contains(t, kills, true)
+	assert.Contains(t, kills, false)
+	assert.Equal(t, kills, killed())
+
+	// Put above the cutoff resumes what an earlier attempt sent
+	m["upload_kill_rate"] = "0"
+	m["upload_cutoff"] = "4B"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	put := object.NewStaticObjectInfo("put.txt", src.ModTime(ctx), int64(len(data)), true, nil, nil)
+	_, err = f.putChunked(ctx, io.MultiReader(bytes.NewReader(data[:6]), failingReader{}), put, put.Size(), nil)
+	assert.ErrorContains(t, err, "read again")
+	assert.Equal(t, 1, sessions(f))
+	o, err = f.putChunked(ctx, bytes.NewReader(data), put, put.Size(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, data, read(o))
+	assert.Equal(t, 0, sessions(f))
+}
+
+func TestHidden(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	m["hide_count"] = "2"
+	_, err := NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "hide_count needs an on disk database")
+
+	m = diskConfig(t)
+	whole, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	all := map[string]bool{}
+	for _, o := range listObjects(ctx, t, whole) {
+		all[o.Remote()] = true
+	}
+	require.Greater(t, len(all), 2)
+
+	m["hide_count"] = "2"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	out, err := fsys.(*Fs).Command(ctx, "hidden", nil, nil)
+	require.NoError(t, err)
+	hidden := out.([]string)
+	require.Len(t, hidden, 2)
+	assert.True(t, slices.IsSorted(hidden))
+
+	// The hidden files are missing from listings and can't be found
+	var listed []string
+	for _, o := range listObjects(ctx, t, fsys) {
+		listed = append(listed, o.Remote())
+	}
+	for _, remote := range hidden {
+		assert.True(t, all[remote], remote)
+		assert.NotContains(t, listed, remote)
+		_, err := fsys.NewObject(ctx, remote)
+		assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	}
+	assert.Len(t, listed, len(all)-2)
+	var lsed []string
+	require.NoError(t, operations.ListFn(ctx, fsys, func(o fs.Object) {
+		lsed = append(lsed, o.Remote())
+	}))
+	assert.ElementsMatch(t, listed, lsed)
+
+	// The same files are hidden on every run
+	again, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	out, err = again.(*Fs).Command(ctx, "hidden", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, hidden, out)
+
+	// All the files are hidden if there aren't enough
+	m["hide_count"] = strconv.Itoa(len(all) + 1)
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	out, err = fsys.(*Fs).Command(ctx, "hidden", nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, out, len(all))
+	require.NoError(t, walk.ListR(ctx, fsys, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		assert.Empty(t, entries)
+		return nil
+	}))
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	_, err = fsys.(*Fs).Command(ctx, "compact", nil, nil)
+	assert.ErrorContains(t, err, "compact needs an on disk database")
+
+	m := diskConfig(t)
+	m["archive_rate"] = "0.5"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	data := bytes.Repeat([]byte("left behind "), 1000)
+	src := object.NewStaticObjectInfo("gone/deeper/file.txt", time.Now(), int64(len(data)), true, nil, nil)
+	_, err = f.Put(ctx, bytes.NewReader(data), src)
+	require.NoError(t, err)
+	kept := object.NewStaticObjectInfo("kept.txt", time.Now(), 4, true, nil, nil)
+	_, err = f.Put(ctx, strings.NewReader("kept"), kept)
+	require.NoError(t, err)
+
+	// Deleting a directory with the SDK leaves its children behind
+	require.NoError(t, f.engine.DeleteNode(ctx, &sdk.DeleteNodeRequest{Path: "/gone", TableName: f.opt.World}))
+	for _, query := range []string{
+		`INSERT INTO spectra_upload_chunks (session_id, chunk, data) VALUES ('ended', 0, x'00')`,
+		`INSERT INTO spectra_hashes (node_id, hash, profile, value) VALUES ('removed', 'md5', '', 'x')`,
+		`INSERT INTO spectra_restores (world, path, ready_at, expires_at) VALUES ('primary', '/expired', 0, 1)`,
+		`INSERT INTO spectra_restores (world, path, ready_at, expires_at) VALUES ('primary', '/live', 0, 1 << 62)`,
+	} {
+		_, err := f.db.ExecContext(ctx, query)
+		require.NoError(t, err, query)
+	}
+	out, err := f.Command(ctx, "compact", nil, nil)
+	require.NoError(t, err)
+	stats := out.(compactStats)
+	assert.Equal(t, int64(2), stats.OrphanedNodes)
+	assert.Equal(t, int64(1), stats.OrphanedChunks)
+	assert.Equal(t, int64(1), stats.OrphanedBlobs)
+	assert.Equal(t, int64(1), stats.OrphanedHashes)
+	assert.Equal(t, int64(1), stats.ExpiredRestores)
+	assert.Less(t, stats.BytesAfter, stats.BytesBefore)
+	var n int
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT count(*) FROM nodes WHERE path LIKE '/gone/%'`).Scan(&n))
+	assert.Equal(t, 0, n)
+
+	// What is still in use is kept
+	o, err := f.NewObject(ctx, kept.Remote())
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	got, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "kept", string(got))
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT count(*) FROM spectra_restores`).Scan(&n))
+	assert.Equal(t, 1, n)
+
+	// And compacting again finds nothing to remove
+	out, err = f.Command(ctx, "compact", nil, nil)
+	require.NoError(t, err)
+	stats = out.(compactStats)
+	assert.Zero(t, stats.OrphanedNodes+stats.OrphanedChunks+stats.OrphanedBlobs+stats.OrphanedHashes+stats.ExpiredRestores)
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	_, err = fsys.(*Fs).Command(ctx, "fsck", nil, nil)
+	assert.ErrorContains(t, err, "fsck needs an on disk database")
+
+	fsys, err = NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	require.NoError(t, f.generateBelow(ctx, "/", -1, nil))
+	src := object.NewStaticObjectInfo("up.txt", time.Now(), 8, true, nil, nil)
+	_, err = f.Put(ctx, strings.NewReader("uploaded"), src)
+	require.NoError(t, err)
+	fsck := func(repair bool) fsckResult {
+		opt := map[string]string{}
+		if repair {
+			opt["repair"] = ""
+		}
+		out, err := f.Command(ctx, "fsck", nil, opt)
+		require.NoError(t, err)
+		return out.(fsckResult)
+	}
+	result := fsck(false)
+	assert.Empty(t, result.Issues)
+	nodes := result.Nodes
+	exec := func(query string, args ...any) {
+		_, err := f.db.ExecContext(ctx, query, args...)
+		require.NoError(t, err, query)
+	}
+	pathOf := func(query string) (spectraPath string) {
+		require.NoError(t, f.db.QueryRowContext(ctx, query).Scan(&spectraPath))
+		return spectraPath
+	}
+
+	// Break one node of each kind
+	folder := pathOf(`SELECT path FROM nodes WHERE type = 'folder' AND depth_level = 1 ORDER BY path LIMIT 1`)
+	var below int64
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT count(*) FROM nodes WHERE path LIKE ? || '/%'`, folder).Scan(&below))
+	require.NotZero(t, below)
+	exec(`UPDATE nodes SET parent_id = 'nowhere' WHERE path = ?`, folder)
+	rootFiles := `SELECT path FROM nodes WHERE type = 'file' AND depth_level = 1 AND name <> 'up.txt' ORDER BY path`
+	misplaced := pathOf(rootFiles + ` LIMIT 1`)
+	wrongSize := pathOf(rootFiles + ` LIMIT 1 OFFSET 1`)
+	exec(`UPDATE nodes SET depth_level = 5 WHERE path = ?`, misplaced)
+	exec(`UPDATE nodes SET size = size + 1 WHERE path = ?`, wrongSize)
+	exec(`UPDATE nodes SET checksum = 'bad' WHERE path = '/up.txt'`)
+	exec(`UPDATE nodes SET size = 1 WHERE path = '/'`)
+	want := map[string]string{
+		folder:    problemMissingParent,
+		misplaced: problemLocation,
+		wrongSize: problemFileContent,
+		"/up.txt": problemFileContent,
+		"/":       problemFolderContent,
+	}
+	issues := func(result fsckResult, repaired bool) map[string]string {
+		got := map[string]string{}
+		for _, issue := range result.Issues {
+			got[issue.Path] = issue.Problem
+			assert.Equal(t, repaired, issue.Repaired, issue.Path)
+		}
+		return got
+	}
+
+	// Checking reports the problems without repairing them
+	assert.Equal(t, want, issues(fsck(false), false))
+	assert.Equal(t, want, issues(fsck(false), false))
+
+	// Repairing deletes the orphans and what is below them and
+	// corrects the rest
+	result = fsck(true)
+	got := issues(result, true)
+	assert.Equal(t, problemMissingParent, got[folder])
+	assert.Len(t, got, len(want)+int(below))
+	result = fsck(false)
+	assert.Empty(t, result.Issues)
+	assert.Equal(t, nodes-1-below, result.Nodes)
+	o, err := f.NewObject(ctx, "up.txt")
+	require.NoError(t, err)
+	sum, err := o.Hash(ctx, hash.SHA256)
+	require.NoError(t, err)
+	want256 := sha256.Sum256([]byte("uploaded"))
+	assert.Equal(t, hex.EncodeToString(want256[:]), sum)
+}
+
+func TestCorrupt(t *testing.T) {
+	ctx := context.Background()
+	newRemote := func() *Fs {
+		fsys, err := NewFs(ctx, "test", "", diskConfig(t))
+		require.NoError(t, err)
+		f := fsys.(*Fs)
+		require.NoError(t, f.generateBelow(ctx, "/", -1, nil))
+		return f
+	}
+	corrupt := func(f *Fs, opt map[string]string) []corruption {
+		out, err := f.Command(ctx, "corrupt", nil, opt)
+		require.NoError(t, err)
+		return out.([]corruption)
+	}
+	f := newRemote()
+	_, err := f.Command(ctx, "corrupt", nil, map[string]string{"kinds": "size,potato"})
+	assert.ErrorContains(t, err, `unknown kind of corruption "potato"`)
+
+	// Each kind is used in turn, sizes and checksums only on files
+	corrupted := corrupt(f, map[string]string{"count": "3"})
+	require.Len(t, corrupted, 3)
+	for i, c := range corrupted {
+		assert.Equal(t, corruptionKinds[i], c.Kind)
+		if c.Kind != "parent" {
+			node, err := f.getNode(ctx, c.Path)
+			require.NoError(t, err)
+			require.NotNil(t, node)
+			assert.Equal(t, sdk.NodeTypeFile, node.Type, c.Path)
+		}
+	}
+
+	// Fsck finds them
+	out, err := f.Command(ctx, "fsck", nil, nil)
+	require.NoError(t, err)
+	problems := map[string]string{}
+	for _, issue := range out.(fsckResult).Issues {
+		problems[issue.Path] = issue.Problem
+	}
+	assert.Equal(t, problemMissingParent, problems[corrupted[0].Path])
+	assert.Equal(t, problemFileContent, problems[corrupted[1].Path])
+	assert.Equal(t, problemFileContent, problems[corrupted[2].Path])
+
+	// The same nodes are corrupted in the same world each time, and
+	// others with another variant
+	assert.Equal(t, corruptPaths(corrupted), corruptPaths(corrupt(newRemote(), map[string]string{"count": "3"})))
+	other := corrupt(newRemote(), map[string]string{"count": "3", "kinds": "parent", "variant": "2"})
+	assert.NotEqual(t, corruptPaths(corrupted), corruptPaths(other))
+	for _, c := range other {
+		assert.Equal(t, "parent", c.Kind)
+	}
+
+	// No more nodes are corrupted than there are
+	var files int
+	require.NoError(t, f.db.QueryRowContext(ctx, `SELECT count(*) FROM nodes WHERE type = ?`, sdk.NodeTypeFile).Scan(&files))
+	assert.Len(t, corrupt(newRemote(), map[string]string{"count": "100", "kinds": "size"}), files)
+}
+
+// corruptPaths returns the paths of the corrupted nodes
+func corruptPaths(corrupted []corruption) (paths []string) {
+	for _, c := range corrupted {
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+func TestSnapshotExportImport(t *testing.T) {
+	ctx := context.Background()
+	ids := func(f fs.Fs) map[string]string {
+		out := map[string]string{}
+		require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListAll, func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				out[entry.Remote()] = entry.(fs.IDer).ID()
+			}
+			return nil
+		}))
+		return out
+	}
+	read := func(f fs.Fs, remote string) string {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+	fsys, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	_, err = fsys.(*Fs).Command(ctx, "export", []string{"snap.db"}, nil)
+	assert.ErrorContains(t, err, "export needs an on disk database")
+
+	src, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	info := object.NewStaticObjectInfo("dir/up.txt", time.Now(), 8, true, nil, nil)
+	_, err = src.Put(ctx, strings.NewReader("uploaded"), info)
+	require.NoError(t, err)
+	snap := filepath.Join(t.TempDir(), "snap.db")
+	_, err = src.(*Fs).Command(ctx, "export", []string{snap}, nil)
+	require.NoError(t, err)
+	_, err = src.(*Fs).Command(ctx, "export", []string{snap}, nil)
+	assert.ErrorContains(t, err, "already exists")
+	want := ids(src)
+
+	// The snapshot option loads the whole dataset, uploads included
+	loaded := diskConfig(t)
+	loaded["snapshot"] = snap
+	dst, err := NewFs(ctx, "test", "", loaded)
+	require.NoError(t, err)
+	assert.Equal(t, want, ids(dst))
+	assert.Equal(t, "uploaded", read(dst, info.Remote()))
+
+	// Importing replaces what the database held
+	other, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	_, err = other.Put(ctx, strings.NewReader("replaced"), object.NewStaticObjectInfo("other.txt", time.Now(), 8, true, nil, nil))
+	require.NoError(t, err)
+	_, err = other.(*Fs).Command(ctx, "import", []string{snap}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, want, ids(other))
+	_, err = other.NewObject(ctx, "other.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = other.(*Fs).Command(ctx, "import", []string{filepath.Join(t.TempDir(), "potato.db")}, nil)
+	assert.ErrorContains(t, err, "failed to open snapshot")
+
+	// Encrypted uploads can only go back into their own database
+	enc := diskConfig(t)
+	enc["db_key"] = obscure.MustObscure("secret")
+	encrypted, err := NewFs(ctx, "test", "", enc)
+	require.NoError(t, err)
+	_, err = encrypted.Put(ctx, strings.NewReader("sealed"), object.NewStaticObjectInfo("sealed.txt", time.Now(), 6, true, nil, nil))
+	require.NoError(t, err)
+	sealed := filepath.Join(t.TempDir(), "sealed.db")
+	_, err = encrypted.(*Fs).Command(ctx, "export", []string{sealed}, nil)
+	require.NoError(t, err)
+	_, err = other.(*Fs).Command(ctx, "import", []string{sealed}, nil)
+	assert.ErrorContains(t, err, "set db_key")
+	foreign := diskConfig(t)
+	foreign["db_key"] = obscure.MustObscure("secret")
+	stranger, err := NewFs(ctx, "test", "", foreign)
+	require.NoError(t, err)
+	_, err = stranger.(*Fs).Command(ctx, "import", []string{sealed}, nil)
+	assert.ErrorContains(t, err, "encrypted for another database")
+	_, err = encrypted.(*Fs).Command(ctx, "import", []string{sealed}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "sealed", read(encrypted, "sealed.txt"))
+}
+
+func TestBlobDedupe(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["extra_hashes"] = "md5"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	count := func(table string) (n int) {
+		require.NoError(t, f.db.QueryRowContext(ctx, `SELECT count(*) FROM `+table).Scan(&n))
+		return n
+	}
+	put := func(remote, content string) fs.Object {
+		src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(content)), true, nil, nil)
+		o, err := f.Put(ctx, strings.NewReader(content), src)
+		require.NoError(t, err)
+		return o
+	}
+	data := "the same content"
+	sha := sha256.Sum256([]byte(data))
+	md := md5.Sum([]byte(data))
+	for _, remote := range []string{"a.txt", "dir/b.txt", "dir/deeper/c.txt"} {
+		put(remote, data)
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), o.Size())
+		sum, err := o.Hash(ctx, hash.SHA256)
+		require.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(sha[:]), sum)
+		sum, err = o.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.Equal(t, hex.EncodeToString(md[:]), sum)
+	}
+
+	// Files with the same content share a blob
+	assert.Equal(t, 1, count("spectra_blobs"))
+	assert.Equal(t, 3, count("spectra_file_blobs"))
+	put("other.txt", "other content")
+	assert.Equal(t, 2, count("spectra_blobs"))
+
+	// Empty files have content of their own rather than generated
+	empty := put("empty.txt", "")
+	assert.Equal(t, int64(0), empty.Size())
+	stored, err := f.loadBlob(ctx, empty.(*Object).ID())
+	require.NoError(t, err)
+	assert.Equal(t, []byte{}, stored)
+	generated, err := f.NewObject(ctx, "file_1.txt")
+	require.NoError(t, err)
+	stored, err = f.loadBlob(ctx, generated.(*Object).ID())
+	require.NoError(t, err)
+	assert.Nil(t, stored)
+
+	// A blob is kept until the last file using it is removed
+	for _, remote := range []string{"a.txt", "dir/b.txt"} {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		require.NoError(t, o.Remove(ctx))
+	}
+	out, err := f.Command(ctx, "compact", nil, nil)
+	require.NoError(t, err)
+	assert.Zero(t, out.(compactStats).OrphanedBlobs)
+	o, err := f.NewObject(ctx, "dir/deeper/c.txt")
+	require.NoError(t, err)
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	got, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, data, string(got))
+	require.NoError(t, o.Remove(ctx))
+	out, err = f.Command(ctx, "compact", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), out.(compactStats).OrphanedBlobs)
+
+	// Without an on disk database nothing is stored
+	fsys, err = NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	key, err := fsys.(*Fs).storeBlob(ctx, "id", []byte(data))
+	require.NoError(t, err)
+	assert.Empty(t, key)
+}
+
+// countingEngine is an engine counting the listings and lookups made
+type countingEngine struct {
+	engine
+	lists, gets, reads atomic.Int32
+}
+
+// ListChildren lists the children of a folder
+func (e *countingEngine) ListChildren(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	e.lists.Add(1)
+	return e.engine.ListChildren(ctx, req)
+}
+
+// GetNode looks up a node
+func (e *countingEngine) GetNode(ctx context.Context, req *sdk.GetNodeRequest) (*sdk.Node, error) {
+	e.gets.Add(1)
+	return e.engine.GetNode(ctx, req)
+}
+
+// GetFileData reads the data block of a file
+func (e *countingEngine) GetFileData(ctx context.Context, id string) ([]byte, string, error) {
+	e.reads.Add(1)
+	return e.engine.GetFileData(ctx, id)
+}
+
+func TestGetNodes(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["node_cache_size"] = "1000"
+	m["node_cache_ttl"] = "1m"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	counting := &countingEngine{engine: f.engine}
+	f.engine = counting
+	calls := func() (lists, gets int32) {
+		return counting.lists.Swap(0), counting.gets.Swap(0)
+	}
+
+	// Paths below directories not generated yet are found
+	nodes, err := f.getNodes(ctx, "/folder_1/file_1.txt", "/folder_1/potato.txt")
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "/folder_1/file_1.txt", nodes["/folder_1/file_1.txt"].Path)
+	lists, gets := calls()
+	assert.Equal(t, int32(3), lists)
+	assert.Zero(t, gets)
+
+	// Siblings are looked up with one listing of their parent
+	f.nodeCache.change()()
+	nodes, err = f.getNodes(ctx, "/file_1.txt", "/file_2.txt", "/folder_1", "/potato")
+	require.NoError(t, err)
+	assert.Len(t, nodes, 3)
+	assert.NotContains(t, nodes, "/potato")
+	assert.Equal(t, sdk.NodeTypeFolder, nodes["/folder_1"].Type)
+	lists, gets = calls()
+	assert.Equal(t, int32(1), lists)
+	assert.Zero(t, gets)
+
+	// And then taken from the node cache
+	nodes, err = f.getNodes(ctx, "/file_1.txt", "/file_2.txt", "/potato")
+	require.NoError(t, err)
+	assert.Len(t, nodes, 2)
+	lists, gets = calls()
+	assert.Zero(t, lists+gets)
+
+	// The root has no parent to list
+	mem, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	counting.engine = mem.(*Fs).engine
+	mem.(*Fs).engine = counting
+	node, err := mem.(*Fs).getNode(ctx, "/")
+	require.NoError(t, err)
+	assert.Equal(t, "/", node.Path)
+	lists, gets = calls()
+	assert.Zero(t, lists)
+	assert.Equal(t, int32(1), gets)
+
+	// Nodes already generated are read from the database
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	counting = &countingEngine{engine: f.engine}
+	f.engine = counting
+	nodes, err = f.getNodes(ctx, "/folder_1/file_1.txt", "/folder_1/file_2.txt", "/file_1.txt")
+	require.NoError(t, err)
+	assert.Len(t, nodes, 3)
+	lists, gets = calls()
+	assert.Zero(t, lists+gets)
+	_, err = fsys.NewObject(ctx, "folder_1/file_2.txt")
+	assert.NoError(t, err)
+}
+
+func TestProtect(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["protect"] = " folder_1/file_1.txt ,"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	assert.Equal(t, []string{"/folder_1/file_1.txt"}, f.protect)
+	object := func(remote string) fs.Object {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		return o
+	}
+
+	// Protected files can't be deleted, moved or moved over
+	err = object("folder_1/file_1.txt").Remove(ctx)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.ErrorContains(t, err, "is protected from deletion")
+	_, err = f.Move(ctx, object("folder_1/file_1.txt"), "moved.txt")
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	_, err = f.Move(ctx, object("file_1.txt"), "folder_1/file_1.txt")
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	object("file_1.txt")
+
+	// Nor can the directories holding them
+	assert.ErrorIs(t, f.Purge(ctx, "folder_1"), fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, f.DirMove(ctx, f, "folder_1", "elsewhere"), fs.ErrorPermissionDenied)
+	object("folder_1/file_1.txt")
+
+	// But what is beside them can
+	require.NoError(t, object("folder_1/file_2.txt").Remove(ctx))
+	require.NoError(t, object("file_2.txt").Remove(ctx))
+	_, err = f.Move(ctx, object("file_1.txt"), "folder_1/moved.txt")
+	require.NoError(t, err)
+
+	// Protected paths are from the root of the world
+	sub, err := NewFs(ctx, "test", "folder_1", m)
+	require.NoError(t, err)
+	o, err := sub.NewObject(ctx, "file_1.txt")
+	require.NoError(t, err)
+	assert.ErrorIs(t, o.Remove(ctx), fs.ErrorPermissionDenied)
+	o, err = sub.NewObject(ctx, "moved.txt")
+	require.NoError(t, err)
+	assert.NoError(t, o.Remove(ctx))
+}
+
+func TestDrift(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	base, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	m["drift_rate"] = "0.5"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	type file struct {
+		modTime time.Time
+		size    int64
+		sum     string
+		data    []byte
+	}
+	read := func(f fs.Fs) map[string]file {
+		files := map[string]file{}
+		for _, o := range listObjects(ctx, t, f) {
+			in, err := o.Open(ctx)
+			require.NoError(t, err)
+			data, err := io.ReadAll(in)
+			require.NoError(t, err)
+			require.NoError(t, in.Close())
+			sum, err := o.Hash(ctx, hash.SHA256)
+			require.NoError(t, err)
+			want := sha256.Sum256(data)
+			assert.Equal(t, hex.EncodeToString(want[:]), sum, o.Remote())
+			files[o.Remote()] = file{modTime: o.ModTime(ctx), size: o.Size(), sum: sum, data: data}
+		}
+		return files
+	}
+	diff := func(a, b []byte) (n int) {
+		for i := range a {
+			if a[i] != b[i] {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Drifted files differ by a byte but keep their size and time
+	original := read(base)
+	drifted := read(f)
+	var changed int
+	for remote, want := range original {
+		got := drifted[remote]
+		assert.Equal(t, want.size, got.size, remote)
+		assert.True(t, want.modTime.Equal(got.modTime), remote)
+		if f.drifted(f.toSpectraPath(remote)) {
+			changed++
+			assert.NotEqual(t, want.sum, got.sum, remote)
+			assert.Equal(t, 1, diff(want.data, got.data), remote)
+		} else {
+			assert.Equal(t, want.sum, got.sum, remote)
+		}
+	}
+	assert.NotZero(t, changed)
+	assert.Less(t, changed, len(original))
+
+	// The same content each run until drift_epoch changes
+	again, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	assert.Equal(t, drifted, read(again))
+	m["drift_epoch"] = "1"
+	again, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	for remote, got := range read(again) {
+		if f.drifted(f.toSpectraPath(remote)) {
+			assert.NotEqual(t, drifted[remote].sum, got.sum, remote)
+			assert.Equal(t, 1, diff(original[remote].data, got.data), remote)
+		} else {
+			assert.Equal(t, original[remote].sum, got.sum, remote)
+		}
+	}
+}
+
+func TestMoves(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	m["move_rate"] = "0.5"
+	_, err := NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "move_rate needs an on disk database")
+
+	m = diskConfig(t)
+	base, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	m["move_rate"] = "0.5"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	out, err := fsys.(*Fs).Command(ctx, "moved", nil, nil)
+	require.NoError(t, err)
+	moves := out.([]fileMove)
+	require.NotEmpty(t, moves)
+	sum := func(f fs.Fs, remote string) string {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		sum, err := o.Hash(ctx, hash.SHA256)
+		require.NoError(t, err)
+		return sum
+	}
+
+	// Moved files are shown in another directory with their content
+	var listed, walked []string
+	for _, o := range listObjects(ctx, t, fsys) {
+		listed = append(listed, o.Remote())
+	}
+	require.NoError(t, walk.Walk(ctx, fsys, "", true, -1, func(dir string, entries fs.DirEntries, err error) error {
+		entries.ForObject(func(o fs.Object) { walked = append(walked, o.Remote()) })
+		return err
+	}))
+	assert.ElementsMatch(t, listed, walked)
+	assert.Len(t, listed, len(listObjects(ctx, t, base)))
+	for _, move := range moves {
+		assert.NotEqual(t, path.Dir(move.From), path.Dir(move.To))
+		assert.Contains(t, listed, move.To)
+		assert.NotContains(t, listed, move.From)
+		_, err := fsys.NewObject(ctx, move.From)
+		assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+		assert.Equal(t, sum(base, move.From), sum(fsys, move.To))
+	}
+
+	// The same moves are made on every run
+	again, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	assert.Equal(t, moves, again.(*Fs).listMoves())
+
+	// Removing a moved file removes the file it shows
+	o, err := fsys.NewObject(ctx, moves[0].To)
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	_, err = fsys.NewObject(ctx, moves[0].To)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = base.NewObject(ctx, moves[0].From)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.Equal(t, moves[1:], fsys.(*Fs).listMoves())
+}
+
+func TestColdObjects(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	m["cold_object_rate"] = "0.5"
+	m["cold_bandwidth"] = "512B"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	var cold, hot fs.Object
+	for _, o := range listObjects(ctx, t, f) {
+		metadata, err := fs.GetMetadata(ctx, o)
+		require.NoError(t, err)
+		if f.cold(o.(*Object).spectraPath()) {
+			cold = o
+			assert.Equal(t, hotnessCold, metadata["hotness"], o.Remote())
+			assert.Equal(t, int64(512), f.readBandwidth(o.(*Object).spectraPath()))
+		} else {
+			hot = o
+			assert.Equal(t, hotnessHot, metadata["hotness"], o.Remote())
+			assert.Zero(t, f.readBandwidth(o.(*Object).spectraPath()))
+		}
+	}
+	require.NotNil(t, cold)
+	require.NotNil(t, hot)
+	require.Greater(t, cold.Size(), int64(512))
+
+	// Cold objects are read at cold_bandwidth, hot ones at full speed
+	read := func(o fs.Object) time.Duration {
+		start := time.Now()
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		n, err := io.Copy(io.Discard, in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, o.Size(), n)
+		return time.Since(start)
+	}
+	assert.Less(t, read(hot), 250*time.Millisecond)
+	assert.GreaterOrEqual(t, read(cold), time.Duration(float64(cold.Size()-512)/512*float64(time.Second))-100*time.Millisecond)
+
+	// The lower of stream_bandwidth and cold_bandwidth applies
+	f.opt.StreamBandwidth = 256
+	f.opt.ColdBandwidth = 1024
+	assert.Equal(t, int64(256), f.readBandwidth(cold.(*Object).spectraPath()))
+	assert.Equal(t, int64(256), f.readBandwidth(hot.(*Object).spectraPath()))
+
+	// Without cold_object_rate there is no hotness
+	fsys, err = NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	metadata, err := fs.GetMetadata(ctx, firstObject(ctx, t, fsys))
+	require.NoError(t, err)
+	assert.NotContains(t, metadata, "hotness")
+}
+
+// busyEngine is an engine whose listings report the database busy the
+// first times they are made
+type busyEngine struct {
+	engine
+	busy atomic.Int32
+}
+
+// ListChildren lists the children of a folder unless still busy
+func (e *busyEngine) ListChildren(ctx context.Context, req *sdk.ListChildrenRequest) (*sdk.ListResult, error) {
+	if e.busy.Add(-1) >= 0 {
+		return &sdk.ListResult{Success: false, Message: "failed to list: database is locked"}, nil
+	}
+	return e.engine.ListChildren(ctx, req)
+}
+
+func TestRetryBusy(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		err  error
+		busy bool
+	}{
+		{nil, false},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{fmt.Errorf("wrapped: %w", sqlite3.Error{Code: sqlite3.ErrLocked}), true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{errors.New("query failed: database is locked"), true},
+		{errors.New("database table is locked"), true},
+		{errors.New("SQLITE_BUSY"), true},
+		{errors.New("not found"), false},
+	} {
+		assert.Equal(t, test.busy, isBusy(test.err), fmt.Sprint(test.err))
+	}
+
+	// Busy calls are retried until they succeed
+	var calls int
+	got, err := retryBusy(0, func() (int, error) {
+		calls++
+		if calls < 3 {
+			return 0, sqlite3.Error{Code: sqlite3.ErrBusy}
+		}
+		return 42, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 42, got)
+	assert.Equal(t, 3, calls)
+
+	// Other failures aren't
+	calls = 0
+	_, err = retryBusy(0, func() (int, error) {
+		calls++
+		return 0, errors.New("not found")
+	})
+	assert.ErrorContains(t, err, "not found")
+	assert.Equal(t, 1, calls)
+
+	// Nor are calls which time out
+	var slow atomic.Int32
+	_, err = retryBusy(fs.Duration(10*time.Millisecond), func() (int, error) {
+		slow.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return 0, nil
+	})
+	var timeout *opTimeoutError
+	assert.ErrorAs(t, err, &timeout)
+	assert.Equal(t, int32(1), slow.Load())
+
+	// Listings the SDK reports failed as busy are retried too
+	fsys, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	busy := &busyEngine{engine: f.engine}
+	busy.busy.Store(2)
+	f.engine = busy
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	assert.Equal(t, int32(-1), busy.busy.Load())
+
+	// Remotes generating the same database at once see the same tree
+	m := diskConfig(t)
+	var wg sync.WaitGroup
+	trees := make([][]string, 8)
+	for i := range trees {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fsys, err := NewFs(ctx, "test", "", m)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, walk.ListR(ctx, fsys, "", true, -1, walk.ListAll, func(entries fs.DirEntries) error {
+				for _, entry := range entries {
+					trees[i] = append(trees[i], entry.Remote())
+				}
+				return nil
+			}))
+			slices.Sort(trees[i])
+		}()
+	}
+	wg.Wait()
+	require.NotEmpty(t, trees[0])
+	for _, tree := range trees[1:] {
+		assert.Equal(t, trees[0], tree)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["node_cache_size"] = "100"
+	m["node_cache_ttl"] = "1m"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	_, err = f.Command(ctx, "warm", nil, nil)
+	assert.ErrorContains(t, err, "warm needs paths")
+	list := filepath.Join(t.TempDir(), "paths.txt")
+	require.NoError(t, os.WriteFile(list, []byte(`# comment
+folder_1/folder_1
+
+; another comment
+  folder_1/file_2.txt  
+potato/file.txt
+`), 0600))
+
+	// Each directory on the way is listed once, the missing one too
+	counting := &countingEngine{engine: f.engine}
+	f.engine = counting
+	out, err := f.Command(ctx, "warm", []string{"folder_1/file_1.txt"}, map[string]string{"files-from": list})
+	require.NoError(t, err)
+	assert.Equal(t, warmResult{
+		Paths:       4,
+		Found:       3,
+		Directories: 3,
+		Missing:     []string{"potato/file.txt"},
+	}, out)
+	assert.Equal(t, int32(3), counting.lists.Load())
+
+	// After which the paths are read from the database
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f = fsys.(*Fs)
+	counting = &countingEngine{engine: f.engine}
+	f.engine = counting
+	for _, remote := range []string{"folder_1/file_1.txt", "folder_1/file_2.txt"} {
+		_, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+	}
+	assert.Zero(t, counting.lists.Load()+counting.gets.Load())
+
+	_, err = f.Command(ctx, "warm", nil, map[string]string{"files-from": filepath.Join(t.TempDir(), "potato")})
+	assert.ErrorContains(t, err, "failed to open path list")
+}
+
+func TestLookupNodes(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	objects := listObjects(ctx, t, f)
+
+	// Paths spread over several batches are all looked up
+	var paths []string
+	for i := range 2*lookupBatchSize + 1 {
+		paths = append(paths, fmt.Sprintf("/potato_%d.txt", i))
+	}
+	paths[0] = "/"
+	paths[lookupBatchSize] = "/folder_1/folder_1"
+	paths[2*lookupBatchSize] = "/" + objects[0].Remote()
+	nodes, err := f.lookupNodes(ctx, paths)
+	require.NoError(t, err)
+	assert.Len(t, nodes, 3)
+	assert.Equal(t, sdk.NodeTypeFolder, nodes["/folder_1/folder_1"].Type)
+	assert.Equal(t, objects[0].Size(), nodes["/"+objects[0].Remote()].Size)
+
+	// Only the nodes in the current world are found
+	m["world"] = "s1"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	nodes, err = fsys.(*Fs).lookupNodes(ctx, paths)
+	require.NoError(t, err)
+	assert.NotContains(t, nodes, "/"+objects[0].Remote())
+}
+
+func TestRollup(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	walked := func(dir string) (r rollup) {
+		require.NoError(t, walk.Walk(ctx, f, dir, true, -1, func(_ string, entries fs.DirEntries, err error) error {
+			require.NoError(t, err)
+			for _, entry := range entries {
+				if o, ok := entry.(fs.Object); ok {
+					r.Files++
+					r.Bytes += o.Size()
+				} else {
+					r.Dirs++
+				}
+			}
+			return nil
+		}))
+		return r
+	}
+	check := func(dir string) {
+		t.Helper()
+		r, err := f.rollup(ctx, f.toSpectraPath(dir))
+		require.NoError(t, err)
+		assert.Equal(t, walked(dir), r, dir)
+	}
+
+	// About only counts what has been generated so far
+	stored, err := f.storedRollup(ctx, "/")
+	require.NoError(t, err)
+	usage, err := f.About(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, stored.Bytes, *usage.Used)
+	assert.Equal(t, stored.Files, *usage.Objects)
+	p, err := f.progress(ctx, "/")
+	require.NoError(t, err)
+	assert.False(t, p.Complete)
+
+	// The trees are generated the first time
+	check("")
+	check("folder_1")
+	r, err := f.rollup(ctx, "/folder_1/folder_1")
+	require.NoError(t, err)
+	assert.Equal(t, rollup{}, r)
+
+	// And kept up to date as they change
+	data := "hello rollups"
+	_, err = f.Put(ctx, strings.NewReader(data), object.NewStaticObjectInfo("folder_1/folder_1/new.txt", time.Now(), int64(len(data)), true, nil, nil))
+	require.NoError(t, err)
+	require.NoError(t, f.Mkdir(ctx, "folder_1/new"))
+	o, err := f.NewObject(ctx, "file_1.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	check("")
+	check("folder_1")
+	r, err = f.rollup(ctx, "/folder_1/folder_1")
+	require.NoError(t, err)
+	assert.Equal(t, rollup{Files: 1, Bytes: int64(len(data))}, r)
+
+	// Which About, ls-stats and the directory metadata read
+	total := walked("")
+	usage, err = f.About(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, total.Bytes, *usage.Used)
+	assert.Equal(t, total.Files, *usage.Objects)
+	out, err := f.Command(ctx, "ls-stats", nil, map[string]string{"rollup": ""})
+	require.NoError(t, err)
+	assert.Equal(t, &lsStats{Dirs: total.Dirs + 1, Files: total.Files, Bytes: total.Bytes}, out)
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	var dir fs.Directory
+	for _, entry := range entries {
+		if d, ok := entry.(fs.Directory); ok {
+			dir = d
+		}
+	}
+	require.NotNil(t, dir)
+	metadata, err := dir.(fs.Metadataer).Metadata(ctx)
+	require.NoError(t, err)
+	sub := walked(dir.Remote())
+	assert.Equal(t, strconv.FormatInt(sub.Dirs, 10), metadata["rollup-dirs"])
+	assert.Equal(t, strconv.FormatInt(sub.Files, 10), metadata["rollup-files"])
+	assert.Equal(t, strconv.FormatInt(sub.Bytes, 10), metadata["rollup-bytes"])
+
+	// The rollups are kept up to date for the next remote using the
+	// database rather than rebuilt
+	_, err = f.db.ExecContext(ctx, `UPDATE spectra_rollups SET files = files + 100 WHERE world = 'primary' AND path = '/'`)
+	require.NoError(t, err)
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	r, err = fsys.(*Fs).storedRollup(ctx, "/")
+	require.NoError(t, err)
+	assert.Equal(t, total.Files+100, r.Files)
+
+	// And rebuilt when the triggers have gone with the nodes table
+	_, err = f.db.ExecContext(ctx, `DROP TRIGGER spectra_rollups_update`)
+	require.NoError(t, err)
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	r, err = fsys.(*Fs).storedRollup(ctx, "/")
+	require.NoError(t, err)
+	assert.Equal(t, total, r)
+
+	// And need the database
+	mem, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	assert.Nil(t, mem.Features().About)
+	_, err = mem.(*Fs).rollup(ctx, "/")
+	assert.ErrorContains(t, err, "on disk database")
+}
+
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	o := firstObject(ctx, t, f)
+	counting := &countingEngine{engine: f.engine}
+	f.engine = counting
+	read := func(options ...fs.OpenOption) []byte {
+		in, err := o.Open(ctx, options...)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return data
+	}
+
+	// Ranges read the same bytes as the whole object
+	data := read()
+	require.Len(t, data, int(o.Size()))
+	size := int64(len(data))
+	assert.Equal(t, data[10:21], read(&fs.RangeOption{Start: 10, End: 20}))
+	assert.Equal(t, data[size-5:], read(&fs.RangeOption{Start: -1, End: 5}))
+	assert.Equal(t, data[100:], read(&fs.RangeOption{Start: 100, End: -1}))
+	assert.Equal(t, data[size-1:], read(&fs.SeekOption{Offset: size - 1}))
+	assert.Empty(t, read(&fs.SeekOption{Offset: size}))
+
+	// Without fetching the data block again
+	assert.Equal(t, int32(1), counting.reads.Load())
+	assert.Zero(t, counting.lists.Load()+counting.gets.Load())
+
+	// Updating the object reads the new data
+	update := []byte("reopened")
+	require.NoError(t, o.Update(ctx, bytes.NewReader(update), object.NewStaticObjectInfo(o.Remote(), time.Now(), int64(len(update)), true, nil, nil)))
+	assert.Equal(t, update, read())
+	assert.Equal(t, update[2:4], read(&fs.RangeOption{Start: 2, End: 3}))
+}
+
+func TestGrowth(t *testing.T) {
+	ctx := context.Background()
+	grow := func() (grown []string) {
+		m := diskConfig(t)
+		m["growth_rate"] = "1"
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		f := fsys.(*Fs)
+		start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := &testClock{now: start}
+		f.clock = clock
+		f.churn.start = start
+
+		// Nothing grows until there is somewhere to grow
+		clock.now = start.Add(10 * time.Second)
+		require.NoError(t, f.simulateChurn(ctx))
+		assert.Zero(t, f.churn.grown)
+
+		// Then files appear at the rate since the start
+		_, err = f.List(ctx, "")
+		require.NoError(t, err)
+		clock.now = start.Add(15 * time.Second)
+		require.NoError(t, f.simulateChurn(ctx))
+		assert.Equal(t, int64(15), f.churn.grown)
+		for _, o := range listObjects(ctx, t, f) {
+			if strings.HasPrefix(path.Base(o.Remote()), "grown_") {
+				grown = append(grown, o.Remote())
+				in, err := o.Open(ctx)
+				require.NoError(t, err)
+				data, err := io.ReadAll(in)
+				require.NoError(t, err)
+				require.NoError(t, in.Close())
+				assert.Len(t, data, int(o.Size()))
+			}
+		}
+		return grown
+	}
+	grown := grow()
+	var names []string
+	for _, remote := range grown {
+		names = append(names, path.Base(remote))
+	}
+	for n := 1; n <= 15; n++ {
+		assert.Contains(t, names, fmt.Sprintf("grown_%d.txt", n))
+	}
+
+	// The same way every run
+	assert.Equal(t, grown, grow())
+}
+
+func TestShrink(t *testing.T) {
+	ctx := context.Background()
+	shrink := func() (removed []string) {
+		m := diskConfig(t)
+		m["shrink_rate"] = "1"
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		f := fsys.(*Fs)
+		start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := &testClock{now: start}
+		f.clock = clock
+		f.churn.start = start
+		remotes := func() (remotes []string) {
+			require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+				entries.ForObject(func(o fs.Object) {
+					remotes = append(remotes, o.Remote())
+				})
+				return nil
+			}))
+			return remotes
+		}
+		before := remotes()
+
+		// Files vanish at the rate since the start
+		clock.now = start.Add(2 * time.Second)
+		require.NoError(t, f.simulateChurn(ctx))
+		assert.Equal(t, int64(2), f.churn.shrunk)
+		after := remotes()
+		assert.Len(t, after, len(before)-2)
+		for _, remote := range before {
+			if !slices.Contains(after, remote) {
+				removed = append(removed, remote)
+				_, err := f.NewObject(ctx, remote)
+				assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+			}
+		}
+
+		// But no directory is emptied, as it would be generated afresh
+		clock.now = start.Add(time.Hour)
+		require.NoError(t, f.simulateChurn(ctx))
+		assert.Less(t, f.churn.shrunk, int64(3600))
+		for _, remote := range before {
+			dir := path.Dir(remote)
+			if dir == "." {
+				dir = ""
+			}
+			entries, err := f.List(ctx, dir)
+			require.NoError(t, err)
+			assert.NotEmpty(t, entries, remote)
+		}
+		return removed
+	}
+	removed := shrink()
+	assert.Len(t, removed, 2)
+
+	// The same way every run
+	assert.Equal(t, removed, shrink())
+}
+
+func TestFlakyList(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	m["flaky_list_rate"] = "0.5"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	remotes := func(entries fs.DirEntries) (out []string) {
+		for _, entry := range entries {
+			out = append(out, entry.Remote())
+		}
+		return out
+	}
+
+	// The first listing drops the flaky entries
+	first, err := f.List(ctx, "")
+	require.NoError(t, err)
+	all, err := f.List(ctx, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, all)
+	var dropped []string
+	for _, entry := range all {
+		if f.flaky(entry) {
+			dropped = append(dropped, entry.Remote())
+		}
+	}
+	require.NotEmpty(t, dropped, "no entries chosen at this rate")
+	require.Less(t, len(dropped), len(all), "every entry chosen at this rate")
+	assert.ElementsMatch(t, remotes(all), append(remotes(first), dropped...))
+
+	// Which a fresh remote drops the same way
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	again, err := fsys.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, remotes(first), remotes(again))
+
+	// The files dropped can still be found
+	for _, entry := range all {
+		if o, ok := entry.(fs.Object); ok && slices.Contains(dropped, o.Remote()) {
+			_, err := fsys.NewObject(ctx, o.Remote())
+			assert.NoError(t, err)
+		}
+	}
+
+	// And nothing is dropped without flaky_list_rate
+	fsys, err = NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	entries, err := fsys.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, remotes(all), remotes(entries))
+}
+
+func TestNotLazy(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	newRemote := func(lazy string) (*Fs, *countingEngine) {
+		m["lazy"] = lazy
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		f := fsys.(*Fs)
+		counting := &countingEngine{engine: f.engine}
+		f.engine = counting
+		return f, counting
+	}
+	names := func(entries fs.DirEntries) (out []string) {
+		for _, entry := range entries {
+			out = append(out, entry.Remote())
+		}
+		return out
+	}
+
+	// Nothing is generated without lazy generation
+	f, counting := newRemote("false")
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = f.List(ctx, "folder_1")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	_, err = f.NewObject(ctx, "file_1.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	// So only what has been generated is shown
+	lazy, _ := newRemote("true")
+	want, err := lazy.List(ctx, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, want)
+	entries, err = f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, names(want), names(entries))
+	_, err = f.NewObject(ctx, "file_1.txt")
+	assert.NoError(t, err)
+	entries, err = f.List(ctx, "folder_1")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	var all []string
+	require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListAll, func(entries fs.DirEntries) error {
+		all = append(all, names(entries)...)
+		return nil
+	}))
+	assert.ElementsMatch(t, names(want), all)
+	assert.Zero(t, counting.lists.Load())
+
+	// Which needs the database
+	m = memConfig()
+	m["lazy"] = "false"
+	_, err = NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "lazy=false needs an on disk database")
+}
+
+func TestEager(t *testing.T) {
+	ctx := context.Background()
+	walked := func(f fs.Fs) (names []string) {
+		require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListAll, func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				names = append(names, entry.Remote())
+			}
+			return nil
+		}))
+		slices.Sort(names)
+		return names
+	}
+	lazy, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	want := walked(lazy)
+
+	// The whole world is there before anything is listed
+	m := diskConfig(t)
+	m["eager"] = "true"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	ungenerated, err := fsys.(*Fs).ungenerated(ctx, "/", -1)
+	require.NoError(t, err)
+	assert.Empty(t, ungenerated)
+	m["eager"], m["lazy"] = "false", "false"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	assert.Equal(t, want, walked(fsys))
+
+	// Unless it has more nodes than eager_max_nodes
+	m = diskConfig(t)
+	m["eager"], m["eager_max_nodes"] = "true", "1"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	ungenerated, err = fsys.(*Fs).ungenerated(ctx, "/", -1)
+	require.NoError(t, err)
+	assert.NotEmpty(t, ungenerated)
+}
+
+func TestStartAt(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	newRemote := func(startAt, root string) (fs.Fs, error) {
+		m["start_at"] = startAt
+		return NewFs(ctx, "test", root, m)
+	}
+	remotes := func(entries fs.DirEntries) (out []string) {
+		for _, entry := range entries {
+			out = append(out, path.Base(entry.Remote()))
+		}
+		return out
+	}
+
+	// The remote is rooted at the directory
+	whole, err := newRemote("", "")
+	require.NoError(t, err)
+	want, err := whole.List(ctx, "folder_1")
+	require.NoError(t, err)
+	fsys, err := newRemote("/folder_1/", "")
+	require.NoError(t, err)
+	assert.Equal(t, "folder_1", fsys.Root())
+	entries, err := fsys.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, remotes(want), remotes(entries))
+	o, err := fsys.NewObject(ctx, "file_1.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "/folder_1/file_1.txt", o.(*Object).spectraPath())
+
+	// With the path of the remote below it
+	fsys, err = newRemote("folder_1", "folder_1")
+	require.NoError(t, err)
+	assert.Equal(t, "folder_1/folder_1", fsys.Root())
+
+	// Picked from the seed the same way each time
+	fsys, err = newRemote("random:0", "")
+	require.NoError(t, err)
+	assert.Equal(t, "", fsys.Root())
+	mem := memConfig()
+	mem["start_at"] = "random:2"
+	a, err := NewFs(ctx, "test", "", mem)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(a.Root(), "/"))
+	b, err := NewFs(ctx, "test", "", mem)
+	require.NoError(t, err)
+	assert.Equal(t, a.Root(), b.Root())
+
+	for _, bad := range []string{"potato", "file_1.txt", "random:x", "random:-1", "random:1:y", "random:5"} {
+		_, err = newRemote(bad, "")
+		assert.ErrorContains(t, err, "start_at", bad)
+	}
+}
+
+func TestColdStart(t *testing.T) {
+	ctx := context.Background()
+	m := memConfig()
+	m["cold_start_latency"] = "100ms"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	timed := func(fn func()) time.Duration {
+		start := time.Now()
+		fn()
+		return time.Since(start)
+	}
+	var dir string
+	list := func(dir string) {
+		_, err := fsys.List(ctx, dir)
+		assert.NoError(t, err)
+	}
+
+	// The first access to a directory waits, later ones don't
+	assert.GreaterOrEqual(t, timed(func() {
+		entries, err := fsys.List(ctx, "")
+		require.NoError(t, err)
+		for _, entry := range entries {
+			if _, ok := entry.(fs.Directory); ok {
+				dir = entry.Remote()
+			}
+		}
+	}), 100*time.Millisecond)
+	require.NotEmpty(t, dir)
+	assert.Less(t, timed(func() { list("") }), 50*time.Millisecond)
+
+	// Concurrent first accesses wait for the same delay
+	elapsed := timed(func() {
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				list(dir)
+			}()
+		}
+		wg.Wait()
+	})
+	assert.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	assert.Less(t, elapsed, 200*time.Millisecond)
+	assert.Less(t, timed(func() { list(dir) }), 50*time.Millisecond)
+
+	m["cold_start_latency"] = "soon"
+	_, err = NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "cold_start_latency")
+}
+
+func TestFilterGeneration(t *testing.T) {
+	ctx := context.Background()
+	fi, err := filter.NewFilter(nil)
+	require.NoError(t, err)
+	require.NoError(t, fi.AddRule("- /folder_1/**"))
+	filtered := filter.SetUseFilter(filter.ReplaceConfig(ctx, fi), true)
+	listR := func(ctx context.Context, filterGeneration string) (names, ungenerated []string) {
+		m := diskConfig(t)
+		m["filter_generation"] = filterGeneration
+		fsys, err := NewFs(ctx, "test", "", m)
+		require.NoError(t, err)
+		f := fsys.(*Fs)
+		require.NoError(t, f.ListR(ctx, "", func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				names = append(names, entry.Remote())
+			}
+			return nil
+		}))
+		ungenerated, err = f.ungenerated(ctx, "/", -1)
+		require.NoError(t, err)
+		return names, ungenerated
+	}
+
+	// Excluded directories aren't generated
+	names, ungenerated := listR(filtered, "true")
+	assert.Contains(t, names, "folder_1")
+	assert.NotContains(t, names, "folder_1/file_1.txt")
+	assert.Equal(t, []string{"/folder_1"}, ungenerated)
+
+	// Unless the listing isn't filtered or filter_generation is off
+	names, ungenerated = listR(filter.SetUseFilter(filtered, false), "true")
+	assert.Contains(t, names, "folder_1/file_1.txt")
+	assert.Empty(t, ungenerated)
+	names, ungenerated = listR(filtered, "false")
+	assert.Contains(t, names, "folder_1/file_1.txt")
+	assert.Empty(t, ungenerated)
+
+	// Eager generation skips them too
+	m := diskConfig(t)
+	m["filter_generation"], m["eager"] = "true", "true"
+	fsys, err := NewFs(filtered, "test", "", m)
+	require.NoError(t, err)
+	ungenerated, err = fsys.(*Fs).ungenerated(ctx, "/", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/folder_1"}, ungenerated)
+}
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	walked := func(ctx context.Context, f fs.Fs) (names []string) {
+		require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListAll, func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				names = append(names, entry.Remote())
+			}
+			return nil
+		}))
+		slices.Sort(names)
+		return names
+	}
+	src, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	want := walked(ctx, src)
+	manifest := filepath.Join(t.TempDir(), "manifest.db")
+	_, err = src.(*Fs).Command(ctx, "export", []string{manifest}, nil)
+	require.NoError(t, err)
+
+	m := diskConfig(t)
+	m["manifest"] = manifest
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	counting := &countingEngine{engine: f.engine}
+	f.engine = counting
+	dryRun, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+
+	// With --dry-run everything is answered from the manifest
+	assert.Equal(t, want, walked(dryRun, f))
+	entries, err := f.List(dryRun, "folder_1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	o, err := f.NewObject(dryRun, "folder_1/file_1.txt")
+	require.NoError(t, err)
+	srcObject, err := src.NewObject(ctx, "folder_1/file_1.txt")
+	require.NoError(t, err)
+	assert.Equal(t, srcObject.Size(), o.Size())
+	_, err = f.NewObject(dryRun, "potato.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.NewObject(dryRun, "folder_1")
+	assert.ErrorIs(t, err, fs.ErrorIsDir)
+	_, err = f.List(dryRun, "potato")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	assert.Zero(t, counting.lists.Load()+counting.gets.Load())
+
+	// Without it the world is generated as normal
+	assert.Equal(t, want, walked(ctx, f))
+	assert.Positive(t, counting.lists.Load())
+
+	m["manifest"] = filepath.Join(t.TempDir(), "potato.db")
+	_, err = NewFs(ctx, "test", "", m)
+	assert.ErrorContains(t, err, "failed to open manifest")
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["growth_rate"], m["shrink_rate"], m["snapshot_isolation"] = "1", "1", "true"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	f.clock = clock
+	f.churn.start = start
+	walked := func(listR bool) (names []string) {
+		callback := func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				names = append(names, entry.Remote())
+			}
+			return nil
+		}
+		if listR {
+			require.NoError(t, f.ListR(ctx, "", callback))
+		} else {
+			require.NoError(t, walk.Walk(ctx, f, "", true, -1, func(_ string, entries fs.DirEntries, err error) error {
+				require.NoError(t, err)
+				return callback(entries)
+			}))
+		}
+		slices.Sort(names)
+		return names
+	}
+	before := walked(false)
+
+	// Listings show the world as it was at the start
+	clock.now = start.Add(3 * time.Second)
+	require.NoError(t, f.simulateChurn(ctx))
+	require.Equal(t, int64(3), f.churn.grown)
+	require.Equal(t, int64(3), f.churn.shrunk)
+	assert.Equal(t, before, walked(false))
+	assert.Equal(t, before, walked(true))
+
+	// Files added since can't be found
+	for grown := range f.isolation.grown {
+		_, err := f.NewObject(ctx, f.fromSpectraPath(grown))
+		assert.ErrorIs(t, err, fs.ErrorObjectNotFound, grown)
+	}
+
+	// And those there at the start removed since are found but can't
+	// be read
+	var removed int
+	for _, nodes := range f.isolation.removed {
+		for _, node := range nodes {
+			removed++
+			o, err := f.NewObject(ctx, f.fromSpectraPath(node.Path))
+			require.NoError(t, err, node.Path)
+			_, err = o.Open(ctx)
+			assert.Error(t, err, node.Path)
+		}
+	}
+	assert.Positive(t, removed)
+
+	// Which without isolation are shown as they are
+	f.opt.SnapshotIsolation = false
+	assert.NotEqual(t, before, walked(false))
+}
+
+func TestServerSide(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	object := func(remote string) *Object {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		return o.(*Object)
+	}
+	read := func(o fs.Object) string {
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+	names := func(dir string) (names []string) {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			names = append(names, path.Base(entry.Remote()))
+		}
+		return names
+	}
+
+	// Copies keep the content and modification time
+	src := object("folder_1/file_1.txt")
+	content := read(src)
+	copied, err := f.Copy(ctx, src, "copies/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, content, read(copied))
+	assert.True(t, src.ModTime(ctx).Equal(copied.ModTime(ctx)))
+	assert.NotEqual(t, src.ID(), copied.(*Object).ID())
+	assert.Equal(t, content, read(object("folder_1/file_1.txt")))
+
+	// Moves keep the node, replacing any file in the way
+	id := src.ID()
+	moved, err := f.Move(ctx, src, "copies/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, id, moved.(*Object).ID())
+	assert.Equal(t, content, read(moved))
+	assert.True(t, src.ModTime(ctx).Equal(moved.ModTime(ctx)))
+	_, err = f.NewObject(ctx, "folder_1/file_1.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	// Directory moves take everything below with them
+	before := names("folder_1")
+	folderID := object("folder_1/file_2.txt").ID()
+	require.NoError(t, f.DirMove(ctx, f, "folder_1", "renamed/folder"))
+	assert.Equal(t, before, names("renamed/folder"))
+	assert.Equal(t, folderID, object("renamed/folder/file_2.txt").ID())
+	_, err = f.List(ctx, "folder_1")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	assert.ErrorIs(t, f.DirMove(ctx, f, "renamed/folder", "copies"), fs.ErrorDirExists)
+	assert.ErrorIs(t, f.DirMove(ctx, f, "renamed", "renamed/folder/inside"), fs.ErrorCantDirMove)
+	assert.ErrorIs(t, f.DirMove(ctx, f, "potato", "elsewhere"), fs.ErrorDirNotFound)
+
+	// Nodes in other worlds would move there too so aren't moved
+	m := diskConfig(t)
+	config, err := os.ReadFile(m["config_path"])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(m["config_path"], bytes.Replace(config, []byte(`"s1": 0`), []byte(`"s1": 1`), 1), 0600))
+	shared, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	o, err := shared.NewObject(ctx, "folder_1/file_1.txt")
+	require.NoError(t, err)
+	_, err = shared.(*Fs).Move(ctx, o, "moved.txt")
+	assert.ErrorIs(t, err, fs.ErrorCantMove)
+	assert.ErrorIs(t, shared.(*Fs).DirMove(ctx, shared, "folder_1", "moved"), fs.ErrorCantDirMove)
+
+	// Nor are files of another database
+	_, err = f.Move(ctx, o, "moved.txt")
+	assert.ErrorIs(t, err, fs.ErrorCantMove)
+	_, err = f.Copy(ctx, o, "copied.txt")
+	assert.ErrorIs(t, err, fs.ErrorCantCopy)
+	assert.ErrorIs(t, f.DirMove(ctx, shared, "folder_1", "moved"), fs.ErrorCantDirMove)
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+
+	// Directories are generated to be purged if need be
+	fsys, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	require.NoError(t, fsys.Features().Purge(ctx, "folder_1"))
+	_, err = fsys.List(ctx, "folder_1")
+	assert.ErrorIs(t, err, fs.ErrorDirNotFound)
+	entries, err := fsys.List(ctx, "")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.NotEqual(t, "folder_1", entry.Remote())
+	}
+	assert.ErrorIs(t, fsys.Features().Purge(ctx, "potato"), fs.ErrorDirNotFound)
+
+	// Files shown moved into the directory go with it
+	m := diskConfig(t)
+	base, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	m["move_rate"] = "0.5"
+	fsys, err = NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	var into *fileMove
+	for _, move := range f.listMoves() {
+		if path.Dir(move.To) != "." && !strings.HasPrefix(move.From, path.Dir(move.To)+"/") {
+			into = &move
+			break
+		}
+	}
+	require.NotNil(t, into, "no file moved into a directory")
+	dir := path.Dir(into.To)
+	require.NoError(t, f.Purge(ctx, dir))
+	_, err = base.NewObject(ctx, into.From)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.NewObject(ctx, into.To)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	for _, move := range f.listMoves() {
+		assert.False(t, within("/"+move.To, "/"+dir), move.To)
+		assert.False(t, within("/"+move.From, "/"+dir), move.From)
+	}
+}
+
+func TestSoftLimits(t *testing.T) {
+	ctx := context.Background()
+	m := diskConfig(t)
+	m["warn_objects"], m["warn_bytes"] = "3", "1G"
+	fsys, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	limits := func() softLimitReport {
+		out, err := f.Command(ctx, "limits", nil, nil)
+		require.NoError(t, err)
+		report := out.(softLimitReport)
+		require.Len(t, report, 2)
+		assert.Equal(t, "objects", report[0].Name)
+		assert.Equal(t, "bytes", report[1].Name)
+		return report
+	}
+	report := limits()
+	assert.False(t, report[0].Crossed)
+	assert.Equal(t, int64(1<<30), report[1].Limit)
+
+	// Limits are crossed as the world grows
+	objects := listObjects(ctx, t, f)
+	require.Greater(t, len(objects), 3)
+	report = limits()
+	assert.Equal(t, int64(len(objects)), report[0].Value)
+	assert.True(t, report[0].Crossed)
+	assert.NotNil(t, report[0].CrossedAt)
+	assert.False(t, report[1].Crossed)
+
+	// And no longer when it shrinks back below them
+	for _, o := range objects[2:] {
+		require.NoError(t, o.Remove(ctx))
+	}
+	report = limits()
+	assert.Equal(t, int64(2), report[0].Value)
+	assert.False(t, report[0].Crossed)
+	assert.Nil(t, report[0].CrossedAt)
+
+	out, err := f.Command(ctx, "limits", nil, map[string]string{"format": "csv"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.(string), "name,limit,value,crossed,crossed_at\nobjects,3,2,false,\n"), out)
+
+	// Nothing is checked without limits
+	fsys, err = NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	out, err = fsys.(*Fs).Command(ctx, "limits", nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", diskConfig(t))
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	progress := func() *generationProgress {
+		out, err := f.Command(ctx, "progress", nil, nil)
+		require.NoError(t, err)
+		return out.(*generationProgress)
+	}
+
+	// Nothing is generated to find out
+	assert.Equal(t, &generationProgress{Ungenerated: 1}, progress())
+	assert.Equal(t, &generationProgress{Ungenerated: 1}, progress())
+
+	// Listing generates part of it
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	p := progress()
+	assert.Equal(t, int64(len(entries)), p.Dirs+p.Files)
+	assert.Positive(t, p.Ungenerated)
+	assert.False(t, p.Complete)
+
+	// And walking the rest completes it
+	objects := listObjects(ctx, t, f)
+	var size int64
+	for _, o := range objects {
+		size += o.Size()
+	}
+	p = progress()
+	assert.Equal(t, int64(len(objects)), p.Files)
+	assert.Equal(t, size, p.Bytes)
+	assert.Zero(t, p.Ungenerated)
+	assert.True(t, p.Complete)
+	out, err := f.Command(ctx, "progress", nil, map[string]string{"format": "csv"})
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("dirs,files,bytes,ungenerated,complete\n%d,%d,%d,0,true\n", p.Dirs, p.Files, p.Bytes), out)
+
+	mem, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	_, err = mem.(*Fs).Command(ctx, "progress", nil, nil)
+	assert.ErrorContains(t, err, "progress needs an on disk database")
+}
+
+func TestPutStream(t *testing.T) {
+	ctx := context.Background()
+	fsys, err := NewFs(ctx, "test", "", memConfig())
+	require.NoError(t, err)
+	read := func(o fs.Object) string {
+		in, err := o.Open(ctx)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+
+	// Uploads of unknown size are stored whole
+	content := "streamed without a size"
+	src := object.NewStaticObjectInfo("stream/file.txt", time.Now(), -1, true, nil, nil)
+	o, err := fsys.Features().PutStream(ctx, strings.NewReader(content), src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), o.Size())
+	o, err = fsys.NewObject(ctx, "stream/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, content, read(o))
+
+	// As rclone rcat makes them
+	o, err = operations.Rcat(ctx, fsys, "stream/rcat.txt", io.NopCloser(strings.NewReader(content)), time.Now(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, content, read(o))
+
+	// Into the world of the path with world=all
+	m := memConfig()
+	m["world"] = worldAll
+	top, err := NewFs(ctx, "test", "", m)
+	require.NoError(t, err)
+	require.NotNil(t, top.Features().PutStream)
+	src = object.NewStaticObjectInfo("primary/stream.txt", time.Now(), -1, true, nil, nil)
+	o, err = top.Features().PutStream(ctx, strings.NewReader(content), src)
+	require.NoError(t, err)
+	assert.Equal(t, "primary/stream.txt", o.Remote())
+	o, err = top.NewObject(ctx, "primary/stream.txt")
+	require.NoError(t, err)
+	assert.Equal(t, content, read(o))
+}
@@ -0,0 +1,17 @@
+// Test Spectra filesystem interface
+package spectra_test
+
+import (
+	"testing"
+
+	"github.com/rclone/rclone/backend/spectra"
+	"github.com/rclone/rclone/fstest/fstests"
+)
+
+// TestIntegration runs integration tests against the remote
+func TestIntegration(t *testing.T) {
+	fstests.Run(t, &fstests.Opt{
+		RemoteName: "TestSpectra:",
+		NilObject:  (*spectra.Object)(nil),
+	})
+}
@@ -0,0 +1,99 @@
+// Node statistics for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/fs"
+)
+
+// worldStats are the nodes of one world stored in the database
+type worldStats struct {
+	World   string       `json:"world"`
+	Nodes   int64        `json:"nodes"`
+	Dirs    int64        `json:"dirs"`
+	ByDepth []depthStats `json:"byDepth"`
+	sizeCount
+}
+
+// nodeStats is the result of the stats command
+type nodeStats struct {
+	Nodes  int64        `json:"nodes"` // nodes in any world
+	Worlds []worldStats `json:"worlds"`
+}
+
+// nodeStats counts the nodes stored at and below the root of the
+// remote, without generating any more of them, by world and by depth
+// level.
+//
+// Nodes in several worlds are counted in each of them.
+func (f *Fs) nodeStats(ctx context.Context) (out *nodeStats, err error) {
+	spectraPath := f.toSpectraPath("")
+	prefix := spectraPath + "/"
+	if spectraPath == "/" {
+		prefix = "/"
+	}
+	const inTree = `(nodes.path = ? OR (nodes.path >= ? AND nodes.path < ?))`
+	treeArgs := []any{spectraPath, prefix, prefix[:len(prefix)-1] + "0"}
+	out = &nodeStats{Worlds: []worldStats{}}
+	err = f.db.QueryRowContext(ctx, `SELECT count(*) FROM nodes WHERE `+inTree, treeArgs...).Scan(&out.Nodes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count nodes: %w", err)
+	}
+	rows, err := f.db.QueryContext(ctx, `
+SELECT w.key, nodes.depth_level,
+	sum(nodes.type = ?),
+	sum(nodes.type = ?),
+	sum(CASE WHEN nodes.type = ? THEN nodes.size ELSE 0 END)
+FROM nodes, json_each(nodes.existence_map) w
+WHERE w.value = 1 AND `+inTree+`
+GROUP BY w.key, nodes.depth_level
+ORDER BY w.key, nodes.depth_level`,
+		append([]any{sdk.NodeTypeFolder, sdk.NodeTypeFile, sdk.NodeTypeFile}, treeArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count nodes: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	for rows.Next() {
+		var (
+			world string
+			d     depthStats
+		)
+		if err = rows.Scan(&world, &d.Depth, &d.Dirs, &d.Files, &d.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to read node counts: %w", err)
+		}
+		if n := len(out.Worlds); n == 0 || out.Worlds[n-1].World != world {
+			out.Worlds = append(out.Worlds, worldStats{World: world})
+		}
+		w := &out.Worlds[len(out.Worlds)-1]
+		w.Nodes += d.Dirs + d.Files
+		w.Dirs += d.Dirs
+		w.Files += d.Files
+		w.Bytes += d.Bytes
+		w.ByDepth = append(w.ByDepth, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count nodes: %w", err)
+	}
+	return out, nil
+}
+
+// csvTable returns the statistics as one CSV table with a total row
+// and a row per depth level for each world
+func (s *nodeStats) csvTable() [][]string {
+	i64 := func(i int64) string { return strconv.FormatInt(i, 10) }
+	rows := [][]string{
+		{"world", "depth", "nodes", "dirs", "files", "bytes"},
+		{"", "", i64(s.Nodes), "", "", ""},
+	}
+	for _, w := range s.Worlds {
+		rows = append(rows, []string{w.World, "", i64(w.Nodes), i64(w.Dirs), i64(w.Files), i64(w.Bytes)})
+		for _, d := range w.ByDepth {
+			rows = append(rows, []string{w.World, strconv.Itoa(d.Depth), i64(d.Dirs + d.Files), i64(d.Dirs), i64(d.Files), i64(d.Bytes)})
+		}
+	}
+	return rows
+}
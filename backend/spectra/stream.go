@@ -0,0 +1,101 @@
+// Unique file content for the Spectra backend
+package spectra
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Ways the content of generated files is made
+const (
+	contentTiled  = "tiled"  // the SDK's data block repeated to the size of the file
+	contentUnique = "unique" // a keystream of its own for each file
+)
+
+// newContentCipher returns the cipher keying the unique content of
+// files, derived from the file binary seed so the content is the same
+// on every run.
+func newContentCipher(fileBinarySeed int64) (cipher.Block, error) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(fileBinarySeed))
+	key := sha256.Sum256(append([]byte("spectra content\x00"), buf[:]...))
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, fmt.Errorf("failed to make content cipher: %w", err)
+	}
+	return block, nil
+}
+
+// uniqueContent returns whether each generated file has content of its
+// own rather than the repeated data block
+func (f *Fs) uniqueContent() bool {
+	return f.contentCipher != nil
+}
+
+// contentNonce returns the nonce of the keystream making up the unique
+// content of the file at spectraPath.
+//
+// It is chosen from the path so every file has its own content, the
+// same in every world, except that drifted files take theirs from the
+// world's seed and drift_epoch too.
+func (f *Fs) contentNonce(spectraPath string) uint64 {
+	if f.drifted(spectraPath) {
+		return seedHash(f.worldSeed(), "drift_content", strconv.Itoa(f.opt.DriftEpoch)+"/"+spectraPath)
+	}
+	return seedHash(f.engine.GetConfig().Seed.FileBinarySeed, "content", spectraPath)
+}
+
+// streamReader reads the bytes [off, end) of the keystream of an AES
+// cipher in counter mode.
+//
+// The counter block is the nonce followed by the index of the cipher
+// block, so reading can start at any offset without generating the
+// bytes before it.
+type streamReader struct {
+	ctr cipher.Stream
+	off int64
+	end int64
+}
+
+// newStreamReader returns a reader for bytes [off, end) of the
+// keystream of block with nonce
+func newStreamReader(block cipher.Block, nonce uint64, off, end int64) *streamReader {
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(iv[:8], nonce)
+	binary.BigEndian.PutUint64(iv[8:], uint64(off/aes.BlockSize))
+	r := &streamReader{ctr: cipher.NewCTR(block, iv[:]), off: off, end: end}
+	// Skip to off within its cipher block
+	var skip [aes.BlockSize]byte
+	n := off % aes.BlockSize
+	r.ctr.XORKeyStream(skip[:n], skip[:n])
+	return r
+}
+
+// Read implements io.Reader
+func (r *streamReader) Read(p []byte) (n int, err error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	if remaining := r.end - r.off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	clear(p)
+	r.ctr.XORKeyStream(p, p)
+	r.off += int64(len(p))
+	return len(p), nil
+}
+
+// streamSHA256 returns the hex SHA256 of the content read from in
+func streamSHA256(in io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
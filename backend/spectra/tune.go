@@ -0,0 +1,149 @@
+// Live tuning of the simulation for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// tunables are the options the tune command changes while the remote
+// runs. They are read with tuning so the reads don't race with it. The
+// latencies it changes are in latency, protected by latencyMu.
+type tunables struct {
+	faultErrorRate  float64
+	streamBandwidth fs.SizeSuffix
+	growthRate      float64
+	shrinkRate      float64
+}
+
+// tunableNames are the options tune can change, in the order they are
+// listed in errors
+var tunableNames = []string{
+	"latency_list", "latency_stat", "latency_read", "latency_write",
+	"fault_error_rate", "stream_bandwidth", "growth_rate", "shrink_rate",
+}
+
+// newTunables returns the tunables as set by opt
+func newTunables(opt *Options) tunables {
+	return tunables{
+		faultErrorRate:  opt.FaultErrorRate,
+		streamBandwidth: opt.StreamBandwidth,
+		growthRate:      opt.GrowthRate,
+		shrinkRate:      opt.ShrinkRate,
+	}
+}
+
+// tuning returns the tunables in effect now, those in the options
+// until the tune command has run
+func (f *Fs) tuning() tunables {
+	f.tunedMu.RLock()
+	defer f.tunedMu.RUnlock()
+	if f.tuned != nil {
+		return *f.tuned
+	}
+	return newTunables(&f.opt)
+}
+
+// tuneReport is the result of the tune command
+type tuneReport struct {
+	Latency         map[string]string `json:"latency"`
+	FaultErrorRate  float64           `json:"faultErrorRate"`
+	StreamBandwidth string            `json:"streamBandwidth"`
+	GrowthRate      float64           `json:"growthRate"`
+	ShrinkRate      float64           `json:"shrinkRate"`
+}
+
+// tuneReport returns the tunables and latencies in effect now
+func (f *Fs) tuneReport() *tuneReport {
+	t := f.tuning()
+	r := &tuneReport{
+		Latency:         make(map[string]string, numOpClasses),
+		FaultErrorRate:  t.faultErrorRate,
+		StreamBandwidth: t.streamBandwidth.String(),
+		GrowthRate:      t.growthRate,
+		ShrinkRate:      t.shrinkRate,
+	}
+	f.latencyMu.Lock()
+	defer f.latencyMu.Unlock()
+	for class, dist := range f.latency {
+		r.Latency[opClass(class).String()] = dist.String()
+	}
+	return r
+}
+
+// tune changes the options in opt, which are named as the backend
+// options are, while the remote runs, and returns those in effect.
+//
+// The values are all checked before any is changed. Churn is brought up
+// to date at the old rates before the new ones take over, so changing
+// a rate doesn't add or remove the files due at it since the start.
+func (f *Fs) tune(ctx context.Context, opt map[string]string) (*tuneReport, error) {
+	t := f.tuning()
+	latency := make(map[opClass]latencyDist)
+	for name, value := range opt {
+		var err error
+		switch name {
+		case "latency_list", "latency_stat", "latency_read", "latency_write":
+			class := slices.Index(opClassNames[:], strings.TrimPrefix(name, "latency_"))
+			latency[opClass(class)], err = parseLatencyDist(value)
+		case "fault_error_rate":
+			t.faultErrorRate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (t.faultErrorRate < 0 || t.faultErrorRate > 1) {
+				err = fmt.Errorf("must be between 0 and 1, got %g", t.faultErrorRate)
+			}
+			if err == nil && t.faultErrorRate > 0 && len(f.opt.FaultErrorTypes) == 0 {
+				err = errors.New("needs at least one fault_error_types error")
+			}
+		case "stream_bandwidth":
+			err = t.streamBandwidth.Set(value)
+		case "growth_rate":
+			t.growthRate, err = parseChurnRate(value)
+		case "shrink_rate":
+			t.shrinkRate, err = parseChurnRate(value)
+		default:
+			return nil, fmt.Errorf("can't tune %q: must be one of %s", name, strings.Join(tunableNames, ", "))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %q: %w", name, err)
+		}
+	}
+	if f.db == nil && (t.growthRate > 0 || t.shrinkRate > 0) {
+		return nil, errors.New("growth_rate and shrink_rate need an on disk database")
+	}
+
+	f.churnMu.Lock()
+	defer f.churnMu.Unlock()
+	if err := f.catchUpChurn(ctx); err != nil {
+		return nil, err
+	}
+	f.churn.start = f.clock.Now()
+	f.churn.grownBefore, f.churn.shrunkBefore = f.churn.grown, f.churn.shrunk
+	f.tunedMu.Lock()
+	f.tuned = &t
+	f.tunedMu.Unlock()
+	f.latencyMu.Lock()
+	for class, dist := range latency {
+		f.latency[class] = dist
+	}
+	f.latencyMu.Unlock()
+	fs.Infof(f, "Tuned simulation: %v", opt)
+	return f.tuneReport(), nil
+}
+
+// parseChurnRate parses a growth_rate or shrink_rate
+func parseChurnRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 {
+		return 0, fmt.Errorf("must not be negative, got %g", rate)
+	}
+	return rate, nil
+}
@@ -0,0 +1,460 @@
+// Resumable upload sessions for the Spectra backend
+package spectra
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// defaultChunkSize is the default of chunk_size, also used if it isn't
+// set
+const defaultChunkSize = fs.SizeSuffix(5 * fs.Mebi)
+
+// errSessionGone is returned when using an upload session which has
+// been killed by upload_kill_rate or has ended
+var errSessionGone = errors.New("upload session was killed or has ended")
+
+// initUploads creates the tables holding upload sessions and their
+// chunks.
+//
+// They live alongside the nodes in the database, which the SDK leaves
+// alone, so sessions survive the backend restarting and an interrupted
+// upload of the same file can be resumed.
+func (f *Fs) initUploads(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_upload_sessions (
+	id          TEXT PRIMARY KEY,
+	world       TEXT NOT NULL,
+	path        TEXT NOT NULL,
+	size        INTEGER NOT NULL,
+	created_at  INTEGER NOT NULL, -- Unix milliseconds
+	chunk_size  INTEGER NOT NULL DEFAULT 0,
+	fingerprint TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS spectra_upload_chunks (
+	session_id TEXT NOT NULL,
+	chunk      INTEGER NOT NULL,
+	encrypted  INTEGER NOT NULL DEFAULT 0,
+	data       BLOB NOT NULL,
+	PRIMARY KEY (session_id, chunk)
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create upload session tables: %w", err)
+	}
+	return nil
+}
+
+// uploadSession is a resumable upload of a single object
+type uploadSession struct {
+	f         *Fs
+	id        string        // session ID
+	remote    string        // remote path of the object being uploaded
+	size      int64         // size of the object or -1 if unknown
+	chunkSize int64         // size of every chunk but the last
+	src       fs.ObjectInfo // source of the object, if known
+}
+
+// sourceFingerprint returns a string which changes when the content of
+// the source src of an upload does, from its size, modification time
+// and any hash which is quick to read, or "" if there is no source
+func sourceFingerprint(ctx context.Context, src fs.ObjectInfo) string {
+	if src == nil {
+		return ""
+	}
+	if info := src.Fs(); info != nil && info.Features() != nil {
+		return fs.Fingerprint(ctx, src, true)
+	}
+	return fmt.Sprintf("%d,%v", src.Size(), src.ModTime(ctx).UTC())
+}
+
+// OpenChunkWriter returns the chunk size and a ChunkWriter which
+// uploads the object in a resumable upload session.
+//
+// If a live session for an object of the same path, size and source
+// written in chunks of the same size is left over from an earlier
+// upload, including one made before the backend restarted, it is
+// resumed and the chunks it already holds aren't sent again.
+func (f *Fs) OpenChunkWriter(ctx context.Context, remote string, src fs.ObjectInfo, options ...fs.OpenOption) (info fs.ChunkWriterInfo, writer fs.ChunkWriter, err error) {
+	if err := f.checkWrite("upload", remote); err != nil {
+		return info, nil, err
+	}
+	if err := f.checkName("upload", remote); err != nil {
+		return info, nil, err
+	}
+	ctx, done, err := f.beginOp(ctx, opWrite)
+	if err != nil {
+		return info, nil, err
+	}
+	defer done()
+	f.touch(opWrite, remote)
+	if err := f.fault(faultWrite, remote); err != nil {
+		return info, nil, err
+	}
+	chunkSize := int64(f.opt.ChunkSize)
+	for _, option := range options {
+		// The caller's preferred chunk size
+		if x, ok := option.(*fs.ChunkOption); ok && x.ChunkSize > 0 {
+			chunkSize = x.ChunkSize
+		}
+	}
+	session, err := f.openSession(ctx, remote, src.Size(), chunkSize, sourceFingerprint(ctx, src), true)
+	if err != nil {
+		return info, nil, err
+	}
+	session.src = src
+	info = fs.ChunkWriterInfo{
+		ChunkSize:   chunkSize,
+		Concurrency: f.opt.UploadConcurrency,
+		// Keep the chunks so the upload can be resumed
+		LeavePartsOnError: true,
+	}
+	return info, session, nil
+}
+
+// openSession starts an upload session for the object at remote of
+// size, or -1 if unknown, written in chunks of chunkSize from the
+// source with fingerprint.
+//
+// If resume is set a live session for an object of the same path and
+// size, chunk size and source fingerprint is resumed instead. Sessions
+// for the path which don't match are ended, as their chunks can't be
+// used.
+func (f *Fs) openSession(ctx context.Context, remote string, size, chunkSize int64, fingerprint string, resume bool) (*uploadSession, error) {
+	spectraPath := f.toSpectraPath(remote)
+	var id string
+	err := sql.ErrNoRows
+	if resume {
+		err = f.db.QueryRowContext(ctx, `
+SELECT id FROM spectra_upload_sessions
+WHERE world = ? AND path = ? AND size = ? AND chunk_size = ? AND fingerprint = ?
+ORDER BY created_at DESC LIMIT 1`,
+			f.opt.World, spectraPath, size, chunkSize, fingerprint).Scan(&id)
+	}
+	switch {
+	case err == nil:
+		fs.Debugf(f, "Resuming upload session %s for %q", id, remote)
+	case errors.Is(err, sql.ErrNoRows):
+		if resume {
+			if err := f.endStaleSessions(ctx, spectraPath); err != nil {
+				return nil, err
+			}
+		}
+		id, err = newSessionID()
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.db.ExecContext(ctx, `
+INSERT INTO spectra_upload_sessions (id, world, path, size, created_at, chunk_size, fingerprint) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, f.opt.World, spectraPath, size, time.Now().UnixMilli(), chunkSize, fingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create upload session: %w", err)
+		}
+		fs.Debugf(f, "Started upload session %s for %q", id, remote)
+	default:
+		return nil, fmt.Errorf("failed to find upload session: %w", err)
+	}
+	return &uploadSession{f: f, id: id, remote: remote, size: size, chunkSize: chunkSize}, nil
+}
+
+// endStaleSessions ends the sessions left over for the object at
+// spectraPath which didn't match an upload resuming them
+func (f *Fs) endStaleSessions(ctx context.Context, spectraPath string) error {
+	_, err := f.db.ExecContext(ctx, `
+DELETE FROM spectra_upload_chunks WHERE session_id IN (
+	SELECT id FROM spectra_upload_sessions WHERE world = ? AND path = ?
+)`, f.opt.World, spectraPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove stale upload sessions: %w", err)
+	}
+	_, err = f.db.ExecContext(ctx, `DELETE FROM spectra_upload_sessions WHERE world = ? AND path = ?`, f.opt.World, spectraPath)
+	if err != nil {
+		return fmt.Errorf("failed to remove stale upload sessions: %w", err)
+	}
+	return nil
+}
+
+// putChunked uploads the object src of size, or -1 if unknown,
+// reading it from in chunk_size at a time and storing each chunk in an
+// upload session as it is read, so the data isn't held while it is
+// transferred. It is held once when finish assembles it.
+//
+// An upload of a known size resumes a session left by an earlier
+// attempt from the same source, keeping the chunks it already holds.
+// The object is checked against the data verify read as it is
+// assembled.
+func (f *Fs) putChunked(ctx context.Context, in io.Reader, src fs.ObjectInfo, size int64, verify *streamSum) (o *Object, err error) {
+	chunkSize := f.opt.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	session, err := f.openSession(ctx, src.Remote(), size, int64(chunkSize), sourceFingerprint(ctx, src), size >= 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil && size < 0 {
+			// A stream can't be resumed so drop what it sent
+			_ = session.Abort(ctx)
+		}
+	}()
+	buf := make([]byte, chunkSize)
+	for chunk := 0; ; chunk++ {
+		n, readErr := io.ReadFull(in, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			// A chunk cut short would be kept for the resume
+			return nil, fmt.Errorf("failed to read data: %w", readErr)
+		}
+		if n > 0 || chunk == 0 {
+			if _, err = session.writeChunk(ctx, chunk, bytes.NewReader(buf[:n])); err != nil {
+				return nil, err
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	return session.finish(ctx, verify)
+}
+
+// newSessionID returns a new random upload session ID
+func newSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to make upload session ID: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// killed returns whether upload_kill_rate kills the session as it
+// writes chunk number chunkNumber
+func (s *uploadSession) killed(chunkNumber int) bool {
+	spectraPath := s.f.toSpectraPath(s.remote)
+	key := "upload_kill\x00" + spectraPath + "\x00" + strconv.Itoa(chunkNumber)
+	s.f.faultMu.Lock()
+	try := s.f.tries[key]
+	s.f.tries[key] = try + 1
+	s.f.faultMu.Unlock()
+	salt := "upload_kill/" + strconv.Itoa(chunkNumber) + "/" + strconv.Itoa(try)
+	return pathFraction(s.f.simSeed(), salt, spectraPath) < s.f.opt.UploadKillRate
+}
+
+// checkLive returns errSessionGone if the session no longer exists
+func (s *uploadSession) checkLive(ctx context.Context) error {
+	var id string
+	err := s.f.db.QueryRowContext(ctx, `SELECT id FROM spectra_upload_sessions WHERE id = ?`, s.id).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s: %w", s.id, errSessionGone)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload session: %w", err)
+	}
+	return nil
+}
+
+// WriteChunk stores chunk number chunkNumber in the session.
+//
+// A chunk the session already holds from an earlier attempt is kept
+// rather than sent again. The session is killed part way through with
+// probability upload_kill_rate per chunk, chosen from sim_seed, the
+// path, the chunk number and how many times the chunk of the path has
+// been written before, so the same uploads are killed on every run.
+func (s *uploadSession) WriteChunk(ctx context.Context, chunkNumber int, reader io.ReadSeeker) (bytesWritten int64, err error) {
+	ctx, done, err := s.f.beginOp(ctx, opWrite)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return s.writeChunk(ctx, chunkNumber, s.f.uploadStream(ctx, reader))
+}
+
+// chunkLength returns the length of chunk number chunkNumber of the
+// object, or -1 if the size of the object isn't known
+func (s *uploadSession) chunkLength(chunkNumber int) int64 {
+	if s.size < 0 || s.chunkSize <= 0 {
+		return -1
+	}
+	return max(0, min(s.chunkSize, s.size-int64(chunkNumber)*s.chunkSize))
+}
+
+// writeChunk stores chunk number chunkNumber read from reader in the
+// session for WriteChunk.
+//
+// A chunk held from an earlier attempt is only kept if it is as long as
+// the chunk should be, as one cut short would spoil the object.
+func (s *uploadSession) writeChunk(ctx context.Context, chunkNumber int, reader io.Reader) (bytesWritten int64, err error) {
+	if err := s.checkLive(ctx); err != nil {
+		return 0, err
+	}
+	var (
+		stored    int64
+		encrypted bool
+	)
+	err = s.f.db.QueryRowContext(ctx, `
+SELECT length(data), encrypted FROM spectra_upload_chunks WHERE session_id = ? AND chunk = ?`,
+		s.id, chunkNumber).Scan(&stored, &encrypted)
+	if err == nil {
+		if encrypted {
+			stored = unsealedSize(stored)
+		}
+		if want := s.chunkLength(chunkNumber); want < 0 || stored == want {
+			fs.Debugf(s.f, "Upload session %s already has chunk %d", s.id, chunkNumber)
+			return stored, nil
+		}
+		fs.Debugf(s.f, "Upload session %s has chunk %d of %d bytes, expected %d, so writing it again", s.id, chunkNumber, stored, s.chunkLength(chunkNumber))
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to read chunk %d: %w", chunkNumber, err)
+	}
+	if s.f.opt.UploadKillRate > 0 && s.killed(chunkNumber) {
+		fs.Debugf(s.f, "Killing upload session %s at chunk %d", s.id, chunkNumber)
+		// The whole upload has to start again
+		if err := s.Abort(ctx); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%s: %w", s.id, errSessionGone)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read chunk %d: %w", chunkNumber, err)
+	}
+	size := int64(len(data))
+	if s.f.encrypted() {
+		if data, err = s.f.seal(data); err != nil {
+			return 0, err
+		}
+	}
+	_, err = s.f.db.ExecContext(ctx, `
+INSERT OR REPLACE INTO spectra_upload_chunks (session_id, chunk, encrypted, data) VALUES (?, ?, ?, ?)`,
+		s.id, chunkNumber, s.f.encrypted(), data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write chunk %d: %w", chunkNumber, err)
+	}
+	return size, nil
+}
+
+// Close assembles the chunks into the object, ends the session,
+// stores the hashes of the source with the object and journals it.
+//
+// The chunks may have arrived in any order, so the object is checked
+// against the SHA-256 of the source instead, if the source has one.
+func (s *uploadSession) Close(ctx context.Context) error {
+	var verify *streamSum
+	if s.src != nil {
+		if sum, err := s.src.Hash(ctx, hash.SHA256); err == nil && sum != "" {
+			verify = knownSum(sum)
+		}
+	}
+	o, err := s.finish(ctx, verify)
+	if err != nil {
+		return err
+	}
+	if s.src != nil {
+		if err := s.f.storeSourceHashes(ctx, o.ID(), s.src); err != nil {
+			return err
+		}
+	}
+	return s.f.journalPut(ctx, o)
+}
+
+// finish assembles the chunks into the object, ends the session and
+// returns the object.
+//
+// The SDK takes the content of a file whole and the backend keeps it
+// in a single row of the database, so the object is held in memory
+// once here, in a buffer of its size if that is known. If verify is
+// set the object is checked against the data it read, both as
+// assembled and as committed, and the session is ended if they differ,
+// as resuming it would give the same object.
+func (s *uploadSession) finish(ctx context.Context, verify *streamSum) (o *Object, err error) {
+	if err := s.checkLive(ctx); err != nil {
+		return nil, err
+	}
+	defer s.f.nodeCache.change()()
+	rows, err := s.f.db.QueryContext(ctx, `
+SELECT chunk, encrypted, data FROM spectra_upload_chunks WHERE session_id = ? ORDER BY chunk`, s.id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunks: %w", err)
+	}
+	var buf bytes.Buffer
+	if s.size > 0 {
+		buf.Grow(int(s.size))
+	}
+	for want := 0; rows.Next(); want++ {
+		var (
+			chunk     int
+			encrypted bool
+			data      []byte
+		)
+		if err := rows.Scan(&chunk, &encrypted, &data); err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		if encrypted {
+			if data, err = s.f.unseal(data); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+		}
+		if chunk != want {
+			_ = rows.Close()
+			return nil, fmt.Errorf("upload session %s is missing chunk %d", s.id, want)
+		}
+		buf.Write(data)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, fmt.Errorf("failed to read chunks: %w", err)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, fmt.Errorf("failed to read chunks: %w", err)
+	}
+	if s.size >= 0 && int64(buf.Len()) != s.size {
+		// Resuming the session would give the same object
+		_ = s.Abort(ctx)
+		return nil, fmt.Errorf("upload session %s has %d bytes but expected %d", s.id, buf.Len(), s.size)
+	}
+	// Checked before it is committed too, as a file uploaded over
+	// isn't checked once it is
+	sum := sha256.Sum256(buf.Bytes())
+	if err := verify.check(s.remote, hex.EncodeToString(sum[:])); err != nil {
+		_ = s.Abort(ctx)
+		return nil, err
+	}
+	if o, err = s.f.upload(ctx, s.remote, buf.Bytes(), verify); err != nil {
+		if errors.Is(err, errVerify) {
+			_ = s.Abort(ctx)
+		}
+		return nil, err
+	}
+	return o, s.Abort(ctx)
+}
+
+// Abort ends the session discarding its chunks
+func (s *uploadSession) Abort(ctx context.Context) error {
+	_, err := s.f.db.ExecContext(ctx, `DELETE FROM spectra_upload_chunks WHERE session_id = ?`, s.id)
+	if err != nil {
+		return fmt.Errorf("failed to remove upload session: %w", err)
+	}
+	_, err = s.f.db.ExecContext(ctx, `DELETE FROM spectra_upload_sessions WHERE id = ?`, s.id)
+	if err != nil {
+		return fmt.Errorf("failed to remove upload session: %w", err)
+	}
+	return nil
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.OpenChunkWriter = (*Fs)(nil)
+	_ fs.ChunkWriter     = (*uploadSession)(nil)
+)
@@ -0,0 +1,60 @@
+// Upload verification for the Spectra backend
+package spectra
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/rclone/rclone/fs/fserrors"
+)
+
+// errVerify is returned when an upload fails verification
+var errVerify = errors.New("upload failed verification")
+
+// streamSum hashes an upload with SHA-256 as it is read, so the data
+// read can be checked against the file committed without reading it
+// again
+type streamSum struct {
+	h   hash.Hash
+	sum string // SHA-256 known in advance, if h is nil
+}
+
+// newStreamSum returns a streamSum which hasn't hashed anything yet
+func newStreamSum() *streamSum {
+	return &streamSum{h: sha256.New()}
+}
+
+// knownSum returns a streamSum for data whose SHA-256 is already known
+// as the hex string sum, such as from the source of an upload
+func knownSum(sum string) *streamSum {
+	return &streamSum{sum: sum}
+}
+
+// reader returns in hashing what is read from it
+func (s *streamSum) reader(in io.Reader) io.Reader {
+	return io.TeeReader(in, s.h)
+}
+
+// check returns an error if the data read has a different SHA-256 from
+// checksum, that of the content committed.
+//
+// Nothing is checked if s is nil or checksum is "", as it is when the
+// content isn't kept. The error is retriable, as a provider's
+// verification failure would be.
+func (s *streamSum) check(remote, checksum string) error {
+	if s == nil || checksum == "" {
+		return nil
+	}
+	read := s.sum
+	if s.h != nil {
+		read = hex.EncodeToString(s.h.Sum(nil))
+	}
+	if read == checksum {
+		return nil
+	}
+	return fserrors.RetryError(fmt.Errorf("%q has SHA-256 %s as read but %s as committed: %w", remote, read, checksum, errVerify))
+}
@@ -0,0 +1,91 @@
+// Warming up paths for the Spectra backend
+package spectra
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// warmResult is the result of the warm command
+type warmResult struct {
+	Paths       int      `json:"paths"`
+	Found       int      `json:"found"`
+	Directories int      `json:"directories"`
+	Missing     []string `json:"missing,omitempty"`
+}
+
+// warmPaths generates the directories leading to each of remotes, so a
+// later run which touches them, such as "rclone copy --files-from",
+// doesn't pay for generating them as it goes.
+//
+// Each directory is listed once however many of the paths are in it,
+// parents before their children.
+func (f *Fs) warmPaths(ctx context.Context, remotes []string) (result warmResult, err error) {
+	ctx, done, err := f.beginOp(ctx, opList)
+	if err != nil {
+		return result, err
+	}
+	defer done()
+	seen := make(map[string]bool)
+	var paths []string
+	for _, remote := range remotes {
+		for p := f.nodePath(f.toSpectraPath(remote)); !seen[p]; p = parentPath(p) {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	slices.SortFunc(paths, func(a, b string) int {
+		return cmp.Or(cmp.Compare(strings.Count(a, "/"), strings.Count(b, "/")), strings.Compare(a, b))
+	})
+	nodes, err := f.getNodes(ctx, paths...)
+	if err != nil {
+		return result, err
+	}
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		if p != "/" {
+			dirs[parentPath(p)] = true
+		}
+	}
+	result.Paths = len(remotes)
+	result.Directories = len(dirs)
+	for _, remote := range remotes {
+		spectraPath := f.toSpectraPath(remote)
+		if !f.hidden[spectraPath] && !f.movedAway(spectraPath) && nodes[f.nodePath(spectraPath)] != nil {
+			result.Found++
+		} else {
+			result.Missing = append(result.Missing, remote)
+		}
+	}
+	return result, nil
+}
+
+// readPathList reads the paths in the file at name, one per line,
+// ignoring blank lines and comments starting with # or ; as
+// --files-from does
+func readPathList(name string) (paths []string, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open path list: %w", err)
+	}
+	defer fs.CheckClose(file, &err)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read path list: %w", err)
+	}
+	return paths, nil
+}
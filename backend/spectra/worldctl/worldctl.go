@@ -0,0 +1,162 @@
+// Package worldctl creates and changes Spectra worlds from Go.
+//
+// It is for test harnesses in the rclone tree which need a simulated
+// filesystem in a known state. It sets up the same worlds the spectra
+// backend does and makes the changes its backend commands make,
+// without shelling out to rclone backend.
+//
+//	w, err := worldctl.Create(ctx, t.TempDir(), worldctl.Config{Seed: 1, MaxDepth: 2}, nil)
+//	...
+//	defer w.Close(ctx)
+//	_, err = w.Materialize(ctx, "", -1)
+//	_, _, err = w.Churn(ctx, 10, 5)
+//	err = fstest.CheckListing(t, w.Fs(), ...)
+package worldctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Project-Sylos/Spectra/sdk"
+	"github.com/rclone/rclone/backend/spectra"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config/configmap"
+)
+
+// Config describes the world Create makes. Zero counts are set to the
+// defaults below.
+type Config struct {
+	Seed       int64 // seed the world is generated from
+	MaxDepth   int   // depth of the tree below the root
+	MinFolders int   // fewest directories in each directory
+	MaxFolders int   // most directories in each directory
+	MinFiles   int   // fewest files in each directory
+	MaxFiles   int   // most files in each directory
+
+	// Secondary worlds with the probability each node of the primary
+	// world is in them too
+	Secondary map[string]float64
+}
+
+// Defaults of the counts in Config
+const (
+	DefaultMaxDepth   = 3
+	DefaultMinFolders = 1
+	DefaultMaxFolders = 2
+	DefaultMinFiles   = 2
+	DefaultMaxFiles   = 4
+)
+
+// World is a Spectra world made by Create or opened by Open
+type World struct {
+	f *spectra.Fs
+}
+
+// Create makes a world as described by cfg, keeping its Spectra
+// configuration file and database in dir, and returns it.
+//
+// The world is the primary one unless options sets another. Any other
+// spectra backend options may be set in options too, such as lazy or
+// growth_rate.
+func Create(ctx context.Context, dir string, cfg Config, options map[string]string) (*World, error) {
+	var sc sdk.Config
+	sc.Seed.Seed = cfg.Seed
+	sc.Seed.MaxDepth = orDefault(cfg.MaxDepth, DefaultMaxDepth)
+	sc.Seed.MinFolders = orDefault(cfg.MinFolders, DefaultMinFolders)
+	sc.Seed.MaxFolders = orDefault(cfg.MaxFolders, DefaultMaxFolders)
+	sc.Seed.MinFiles = orDefault(cfg.MinFiles, DefaultMinFiles)
+	sc.Seed.MaxFiles = orDefault(cfg.MaxFiles, DefaultMaxFiles)
+	sc.Seed.DBPath = filepath.Join(dir, "spectra.db")
+	sc.API.Host, sc.API.Port = "localhost", 8086
+	sc.SecondaryTables = cfg.Secondary
+	if sc.SecondaryTables == nil {
+		sc.SecondaryTables = map[string]float64{}
+	}
+	data, err := json.MarshalIndent(&sc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write spectra configuration: %w", err)
+	}
+	configPath := filepath.Join(dir, "spectra.json")
+	if err := os.WriteFile(configPath, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write spectra configuration: %w", err)
+	}
+	m := configmap.Simple{
+		"config_path": configPath,
+		"world":       "primary",
+	}
+	for k, v := range options {
+		m[k] = v
+	}
+	return Open(ctx, "", m)
+}
+
+// Open opens the world the spectra backend options describe, with the
+// remote at root. Options not set take their defaults, as they would
+// in the rclone configuration file.
+func Open(ctx context.Context, root string, options configmap.Simple) (*World, error) {
+	ri, err := fs.Find("spectra")
+	if err != nil {
+		return nil, err
+	}
+	m := fs.ConfigMap(ri.Prefix, ri.Options, "", options)
+	f, err := spectra.NewFs(ctx, "worldctl", root, m)
+	if err != nil {
+		return nil, err
+	}
+	sf, ok := f.(*spectra.Fs)
+	if !ok {
+		return nil, errors.New("not a spectra remote")
+	}
+	return &World{f: sf}, nil
+}
+
+// orDefault returns n, or def if n isn't set
+func orDefault(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+	return n
+}
+
+// Fs returns the remote the world is seen through
+func (w *World) Fs() fs.Fs {
+	return w.f
+}
+
+// Materialize generates everything below the directory dir which
+// hasn't been generated yet, down to maxDepth levels below it unless
+// maxDepth is negative, and returns how much of it has been generated
+func (w *World) Materialize(ctx context.Context, dir string, maxDepth int) (*spectra.GenerationProgress, error) {
+	return w.f.Materialize(ctx, dir, maxDepth)
+}
+
+// Churn adds grow files to the world and removes shrink files from
+// it, and returns how many were added and removed
+func (w *World) Churn(ctx context.Context, grow, shrink int64) (grown, shrunk int64, err error) {
+	return w.f.Churn(ctx, grow, shrink)
+}
+
+// Reseed rebuilds the world from seed
+func (w *World) Reseed(ctx context.Context, seed int64) error {
+	return w.f.Reseed(ctx, seed)
+}
+
+// Snapshot stores a copy of the world under name, so Restore can roll
+// it back to it
+func (w *World) Snapshot(ctx context.Context, name string) (*spectra.WorldSnapshot, error) {
+	return w.f.SnapshotWorld(ctx, name)
+}
+
+// Restore rolls the world back to the snapshot called name
+func (w *World) Restore(ctx context.Context, name string) (*spectra.WorldSnapshot, error) {
+	return w.f.RestoreWorld(ctx, name)
+}
+
+// Close shuts the world down, closing its database
+func (w *World) Close(ctx context.Context) error {
+	return w.f.Shutdown(ctx)
+}
@@ -0,0 +1,42 @@
+package worldctl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rclone/rclone/fs/walk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countFiles returns the number of files in w
+func countFiles(ctx context.Context, t *testing.T, w *World) int {
+	objs, _, err := walk.GetAll(ctx, w.Fs(), "", true, -1)
+	require.NoError(t, err)
+	return len(objs)
+}
+
+func TestWorld(t *testing.T) {
+	ctx := context.Background()
+	w, err := Create(ctx, t.TempDir(), Config{Seed: 1, MaxDepth: 2, MaxFolders: 1, MinFiles: 2, MaxFiles: 2}, map[string]string{"lazy": "true"})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close(ctx)) }()
+
+	p, err := w.Materialize(ctx, "", -1)
+	require.NoError(t, err)
+	assert.True(t, p.Complete)
+	before := countFiles(ctx, t, w)
+	assert.Equal(t, int(p.Files), before)
+
+	_, err = w.Snapshot(ctx, "start")
+	require.NoError(t, err)
+	grown, shrunk, err := w.Churn(ctx, 3, 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), grown)
+	assert.Equal(t, int64(1), shrunk)
+	assert.Equal(t, before+2, countFiles(ctx, t, w))
+
+	_, err = w.Restore(ctx, "start")
+	require.NoError(t, err)
+	assert.Equal(t, before, countFiles(ctx, t, w))
+}
@@ -0,0 +1,144 @@
+// World manifests for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// sdkModule is the module path of the Spectra SDK
+const sdkModule = "github.com/Project-Sylos/Spectra"
+
+// worldManifest records what generated a world, so a database shared
+// between teams can be reproduced and audited
+type worldManifest struct {
+	World         string          `json:"world"`
+	Seed          int64           `json:"seed"`          // seed derived for the world
+	Profile       string          `json:"profile"`       // settings the content of files depends on
+	SDKVersion    string          `json:"sdkVersion"`    // version of the Spectra SDK which generated it
+	RcloneVersion string          `json:"rcloneVersion"` // version of rclone which generated it
+	GeneratedAt   time.Time       `json:"generatedAt"`   // when the world was first used
+	Config        json.RawMessage `json:"config"`        // the Spectra configuration it was generated from
+}
+
+// manifestReport is the result of the world-manifest command: the
+// manifest stored in the world and the fields of it which differ from
+// this remote's
+type manifestReport struct {
+	Manifest *worldManifest `json:"manifest"`
+	Differs  []string       `json:"differs"`
+}
+
+// sdkVersion returns the version of the Spectra SDK built in
+func sdkVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == sdkModule {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// currentManifest returns the manifest of the world as this remote
+// would generate it
+func (f *Fs) currentManifest() (*worldManifest, error) {
+	config, err := json.Marshal(f.engine.GetConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	return &worldManifest{
+		World:         f.opt.World,
+		Seed:          f.worldSeed(),
+		Profile:       f.hashProfile(),
+		SDKVersion:    sdkVersion(),
+		RcloneVersion: fs.Version,
+		GeneratedAt:   time.Now().UTC(),
+		Config:        config,
+	}, nil
+}
+
+// initWorldManifest creates the table of world manifests and records
+// the manifest of this remote's world unless one was recorded by the
+// remote which first used it
+func (f *Fs) initWorldManifest(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_world_manifests (
+	world          TEXT PRIMARY KEY,
+	seed           INTEGER NOT NULL,
+	profile        TEXT NOT NULL,
+	sdk_version    TEXT NOT NULL,
+	rclone_version TEXT NOT NULL,
+	generated_at   INTEGER NOT NULL,
+	config         TEXT NOT NULL
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create world manifests table: %w", err)
+	}
+	m, err := f.currentManifest()
+	if err != nil {
+		return err
+	}
+	_, err = f.db.ExecContext(ctx, `
+INSERT OR IGNORE INTO spectra_world_manifests (world, seed, profile, sdk_version, rclone_version, generated_at, config)
+VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.World, m.Seed, m.Profile, m.SDKVersion, m.RcloneVersion, m.GeneratedAt.UnixNano(), string(m.Config))
+	if err != nil {
+		return fmt.Errorf("failed to record world manifest: %w", err)
+	}
+	return nil
+}
+
+// worldManifestReport reads the manifest stored in this remote's world
+// and compares it with the manifest the remote would record
+func (f *Fs) worldManifestReport(ctx context.Context) (*manifestReport, error) {
+	var (
+		m           = &worldManifest{}
+		generatedAt int64
+		config      string
+	)
+	err := f.readDB.QueryRowContext(ctx, `
+SELECT world, seed, profile, sdk_version, rclone_version, generated_at, config
+FROM spectra_world_manifests WHERE world = ?`, f.opt.World).Scan(
+		&m.World, &m.Seed, &m.Profile, &m.SDKVersion, &m.RcloneVersion, &generatedAt, &config)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("no manifest recorded for world %q", f.opt.World)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read world manifest: %w", err)
+	}
+	m.GeneratedAt = time.Unix(0, generatedAt).UTC()
+	m.Config = json.RawMessage(config)
+
+	current, err := f.currentManifest()
+	if err != nil {
+		return nil, err
+	}
+	report := &manifestReport{Manifest: m, Differs: []string{}}
+	if m.Seed != current.Seed {
+		report.Differs = append(report.Differs, "seed")
+	}
+	if m.Profile != current.Profile {
+		report.Differs = append(report.Differs, "profile")
+	}
+	if m.SDKVersion != current.SDKVersion {
+		report.Differs = append(report.Differs, "sdkVersion")
+	}
+	if string(m.Config) != string(current.Config) {
+		report.Differs = append(report.Differs, "config")
+	}
+	return report, nil
+}
@@ -0,0 +1,349 @@
+// Every world under one remote for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// worldAll is the world which shows every world as a top level
+// directory
+const worldAll = "all"
+
+// sharedEngines are the engines of world=all remotes and remotes using
+// the SDK by engine and configuration file, so the remotes showing
+// their worlds share one world rather than each recreating the database
+var (
+	sharedEnginesMu sync.Mutex
+	sharedEngines   = map[string]*sharedEngineRef{}
+)
+
+// sharedEngineRef is a shared engine and the number of remotes using it
+type sharedEngineRef struct {
+	engine engine
+	refs   int
+}
+
+// sharedEngine returns the engine for opt shared by the remotes using
+// its configuration file, whether this call made it and
+// the function to call once the remote is done with it, which closes
+// the engine when no remote is using it any more
+func sharedEngine(ctx context.Context, opt *Options) (e engine, made bool, release func() error, err error) {
+	kind := opt.Engine
+	if kind == "" {
+		kind = engineSDK
+	}
+	key := kind + "\x00" + opt.ConfigPath
+	if opt.Engine == engineRemote {
+		key += "\x00" + opt.APIURL + "\x00" + opt.Namespace
+	}
+	sharedEnginesMu.Lock()
+	defer sharedEnginesMu.Unlock()
+	ref := sharedEngines[key]
+	if ref == nil {
+		e, err = newEngine(ctx, opt)
+		if err != nil {
+			return nil, false, nil, err
+		}
+		ref = &sharedEngineRef{engine: e}
+		sharedEngines[key] = ref
+		made = true
+	}
+	ref.refs++
+	release = sync.OnceValue(func() error {
+		sharedEnginesMu.Lock()
+		defer sharedEnginesMu.Unlock()
+		ref.refs--
+		if ref.refs > 0 {
+			return nil
+		}
+		delete(sharedEngines, key)
+		return ref.engine.Close()
+	})
+	return ref.engine, made, release, nil
+}
+
+// worldNames returns the names of the worlds in cfg, primary first
+// then the secondary worlds in order
+func worldNames(e engine) []string {
+	names := getSecondaryTableNames(e.GetConfig())
+	sort.Strings(names)
+	return append([]string{"primary"}, names...)
+}
+
+// newAllWorldsFs makes the remote for world=all.
+//
+// At the top level this shows each world as a directory. Below it the
+// remote is the remote of the world the root is in, so
+// "myspectra:s1/folder_1" is the same as folder_1 of a remote with
+// world=s1, except that all the worlds share one engine.
+func newAllWorldsFs(ctx context.Context, name, root string, opt *Options) (fs.Fs, error) {
+	if opt.GatewayAddr != "" {
+		return nil, errors.New("gateway_addr can't be used with world=all")
+	}
+	engine, made, release, err := sharedEngine(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	names := worldNames(engine)
+	worldOpt := func(world string) *Options {
+		o := *opt
+		o.World = world
+		if !made {
+			// The snapshot is loaded and the world generated
+			// eagerly once for all the worlds
+			o.Snapshot, o.Eager = "", false
+		}
+		made = false
+		return &o
+	}
+
+	root = parsePath(root)
+	if root != "" {
+		world, rest, _ := strings.Cut(root, "/")
+		if !slices.Contains(names, world) {
+			_ = release()
+			return nil, fmt.Errorf("world %q not found in Spectra config (available: %s)", world, strings.Join(names, ", "))
+		}
+		f, err := newFs(ctx, name, rest, worldOpt(world), engine)
+		if f == nil {
+			_ = release()
+			return nil, err
+		}
+		f.worldDir = world
+		f.closeEngine = release
+		return f, err
+	}
+
+	w := &worldsFs{
+		name:        name,
+		names:       names,
+		worlds:      make(map[string]*Fs, len(names)),
+		closeEngine: release,
+	}
+	for _, world := range names {
+		f, err := newFs(ctx, name, "", worldOpt(world), engine)
+		if err != nil {
+			_ = w.Shutdown(ctx)
+			return nil, err
+		}
+		f.worldDir = world
+		w.worlds[world] = f
+	}
+	w.features = (&fs.Features{
+		CanHaveEmptyDirectories: true,
+	}).Fill(ctx, w)
+	return w, nil
+}
+
+// worldsFs is the top level of a world=all remote, showing each world
+// as a directory and passing paths inside them on to the remote of
+// that world
+type worldsFs struct {
+	name     string         // name of this remote
+	names    []string       // names of the worlds, primary first
+	worlds   map[string]*Fs // remotes of the worlds by name
+	features *fs.Features   // optional features
+
+	closeEngine func() error // releases the engine the worlds share
+}
+
+// Name of the remote (as passed into NewFs)
+func (w *worldsFs) Name() string {
+	return w.name
+}
+
+// Root of the remote (as passed into NewFs)
+func (w *worldsFs) Root() string {
+	return ""
+}
+
+// String converts this Fs to a string
+func (w *worldsFs) String() string {
+	return "Spectra root '' all worlds"
+}
+
+// Precision of the ModTimes in this Fs
+func (w *worldsFs) Precision() time.Duration {
+	return w.worlds["primary"].Precision()
+}
+
+// Hashes returns the supported hash sets
+func (w *worldsFs) Hashes() hash.Set {
+	return w.worlds["primary"].Hashes()
+}
+
+// Features returns the optional features of this Fs
+func (w *worldsFs) Features() *fs.Features {
+	return w.features
+}
+
+// route returns the remote of the world remote is in and remote
+// relative to it, or nil if remote isn't in a world
+func (w *worldsFs) route(remote string) (f *Fs, world, rest string) {
+	world, rest, _ = strings.Cut(remote, "/")
+	return w.worlds[world], world, rest
+}
+
+// wrap returns entries listed from the remote of world as entries of
+// this remote
+func (w *worldsFs) wrap(world string, entries fs.DirEntries) fs.DirEntries {
+	out := make(fs.DirEntries, 0, len(entries))
+	for _, entry := range entries {
+		switch x := entry.(type) {
+		case fs.Object:
+			out = append(out, w.newObject(world, x))
+		case fs.Directory:
+			out = append(out, fs.NewDirWrapper(path.Join(world, x.Remote()), x))
+		}
+	}
+	return out
+}
+
+// List the objects and directories in dir into entries
+func (w *worldsFs) List(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
+	if dir == "" {
+		for _, world := range w.names {
+			entries = append(entries, fs.NewDir(world, time.Time{}))
+		}
+		return entries, nil
+	}
+	f, world, rest := w.route(dir)
+	if f == nil {
+		return nil, fs.ErrorDirNotFound
+	}
+	entries, err = f.List(ctx, rest)
+	if err != nil {
+		return nil, err
+	}
+	return w.wrap(world, entries), nil
+}
+
+// NewObject finds the Object at remote
+func (w *worldsFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	f, world, rest := w.route(remote)
+	if f == nil || rest == "" {
+		return nil, fs.ErrorObjectNotFound
+	}
+	o, err := f.NewObject(ctx, rest)
+	if err != nil {
+		return nil, err
+	}
+	return w.newObject(world, o), nil
+}
+
+// Put uploads the object into the world it is in
+func (w *worldsFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	f, world, rest := w.route(src.Remote())
+	if f == nil || rest == "" {
+		return nil, fmt.Errorf("can't upload %q: files must be inside one of the worlds %s", src.Remote(), strings.Join(w.names, ", "))
+	}
+	o, err := f.Put(ctx, in, fs.NewOverrideRemote(src, rest), options...)
+	if err != nil {
+		return nil, err
+	}
+	return w.newObject(world, o), nil
+}
+
+// PutStream uploads an object of unknown size into the world it is in
+func (w *worldsFs) PutStream(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	return w.Put(ctx, in, src, options...)
+}
+
+// Mkdir makes the directory in the world it is in
+func (w *worldsFs) Mkdir(ctx context.Context, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	f, _, rest := w.route(dir)
+	if f == nil {
+		return fmt.Errorf("can't make %q: directories must be inside one of the worlds %s", dir, strings.Join(w.names, ", "))
+	}
+	if rest == "" {
+		return nil
+	}
+	return f.Mkdir(ctx, rest)
+}
+
+// Rmdir removes the directory from the world it is in
+func (w *worldsFs) Rmdir(ctx context.Context, dir string) error {
+	f, _, rest := w.route(dir)
+	if dir == "" || (f != nil && rest == "") {
+		return errors.New("can't remove a world")
+	}
+	if f == nil {
+		return fs.ErrorDirNotFound
+	}
+	return f.Rmdir(ctx, rest)
+}
+
+// Shutdown the remotes of the worlds, then release the engine they
+// share
+func (w *worldsFs) Shutdown(ctx context.Context) (err error) {
+	for _, world := range w.names {
+		f := w.worlds[world]
+		if f == nil {
+			continue
+		}
+		if shutdownErr := f.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	if closeErr := w.closeEngine(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to close engine: %w", closeErr)
+	}
+	return err
+}
+
+// worldObject is an object of a world shown by a world=all remote
+type worldObject struct {
+	fs.Object
+	w      *worldsFs
+	remote string
+}
+
+// newObject returns o of the remote of world as an object of this
+// remote
+func (w *worldsFs) newObject(world string, o fs.Object) *worldObject {
+	return &worldObject{Object: o, w: w, remote: path.Join(world, o.Remote())}
+}
+
+// Fs returns the parent Fs
+func (o *worldObject) Fs() fs.Info {
+	return o.w
+}
+
+// Remote returns the remote path
+func (o *worldObject) Remote() string {
+	return o.remote
+}
+
+// String returns a description of the Object
+func (o *worldObject) String() string {
+	return o.remote
+}
+
+// UnWrap returns the Object of the world's remote
+func (o *worldObject) UnWrap() fs.Object {
+	return o.Object
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Fs              = (*worldsFs)(nil)
+	_ fs.PutStreamer     = (*worldsFs)(nil)
+	_ fs.Shutdowner      = (*worldsFs)(nil)
+	_ fs.Object          = (*worldObject)(nil)
+	_ fs.ObjectUnWrapper = (*worldObject)(nil)
+)
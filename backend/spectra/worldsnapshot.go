@@ -0,0 +1,216 @@
+// World snapshots for the Spectra backend
+package spectra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// initWorldSnapshots creates the tables holding the snapshots of worlds
+// made by the snapshot command.
+//
+// Unlike the nodes table, which the SDK recreates whenever it starts,
+// they are left alone, so a world captured by one rclone run can be
+// restored by a later one.
+func (f *Fs) initWorldSnapshots(ctx context.Context) error {
+	_, err := f.db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS spectra_world_snapshots (
+	name       TEXT PRIMARY KEY,
+	world      TEXT NOT NULL,
+	created_at INTEGER NOT NULL -- Unix milliseconds
+);
+CREATE TABLE IF NOT EXISTS spectra_world_snapshot_nodes (
+	snapshot     TEXT NOT NULL,
+	id           VARCHAR NOT NULL,
+	parent_id    VARCHAR NOT NULL,
+	name         VARCHAR NOT NULL,
+	path         VARCHAR NOT NULL,
+	parent_path  VARCHAR NOT NULL,
+	type         VARCHAR NOT NULL,
+	depth_level  INTEGER NOT NULL,
+	size         BIGINT NOT NULL,
+	last_updated TIMESTAMP NOT NULL,
+	checksum     VARCHAR,
+	sha256       TEXT, -- blob holding the content of an uploaded file
+	attributes   TEXT NOT NULL, -- JSON object of the stored metadata
+	PRIMARY KEY (snapshot, id)
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create world snapshot tables: %w", err)
+	}
+	return nil
+}
+
+// worldSnapshot describes a snapshot made by the snapshot command
+type worldSnapshot struct {
+	Name    string    `json:"name"`
+	World   string    `json:"world"`
+	Created time.Time `json:"created"`
+	Files   int64     `json:"files"`
+	Dirs    int64     `json:"dirs"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// worldSnapshots returns the snapshots in the database, or just the one
+// called name if it is set
+func (f *Fs) worldSnapshots(ctx context.Context, name string) (snapshots []worldSnapshot, err error) {
+	rows, err := f.readDB.QueryContext(ctx, `
+SELECT s.name, s.world, s.created_at,
+	count(CASE WHEN n.type = 'file' THEN 1 END),
+	count(CASE WHEN n.type = 'folder' THEN 1 END),
+	coalesce(sum(CASE WHEN n.type = 'file' THEN n.size END), 0)
+FROM spectra_world_snapshots s LEFT JOIN spectra_world_snapshot_nodes n ON n.snapshot = s.name
+WHERE ? = '' OR s.name = ?
+GROUP BY s.name ORDER BY s.name`, name, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read world snapshots: %w", err)
+	}
+	defer fs.CheckClose(rows, &err)
+	snapshots = []worldSnapshot{}
+	for rows.Next() {
+		var (
+			s       worldSnapshot
+			created int64
+		)
+		if err = rows.Scan(&s.Name, &s.World, &created, &s.Files, &s.Dirs, &s.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to read world snapshots: %w", err)
+		}
+		s.Created = time.UnixMilli(created)
+		snapshots = append(snapshots, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read world snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+// snapshotWorld generates the whole world and stores a copy of its
+// nodes, along with the content of uploaded files and their metadata,
+// as the snapshot called name, replacing any snapshot already called
+// that.
+//
+// The nodes are copied rather than shared with another world, so the
+// snapshot isn't changed by later writes to the world, nor lost when
+// the SDK recreates the nodes table.
+func (f *Fs) snapshotWorld(ctx context.Context, name string) (snapshot worldSnapshot, err error) {
+	if f.opt.Lazy {
+		if err = f.generateBelow(ctx, "/", -1, nil); err != nil {
+			return snapshot, err
+		}
+	}
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to snapshot world: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	_, err = tx.ExecContext(ctx, `
+DELETE FROM spectra_world_snapshot_nodes WHERE snapshot = ?;
+INSERT OR REPLACE INTO spectra_world_snapshots (name, world, created_at) VALUES (?, ?, ?)`,
+		name, name, f.opt.World, time.Now().UnixMilli())
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to snapshot world: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO spectra_world_snapshot_nodes
+SELECT ?, id, parent_id, name, path, parent_path, type, depth_level, size, last_updated, checksum,
+	(SELECT sha256 FROM spectra_file_blobs b WHERE b.node_id = n.id),
+	(SELECT json_group_object(key, value) FROM spectra_attributes a WHERE a.node_id = n.id)
+FROM nodes n WHERE path <> '/' AND json_extract(existence_map, ?) = 1`,
+		name, worldKey(f.opt.World))
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to snapshot world: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return snapshot, fmt.Errorf("failed to snapshot world: %w", err)
+	}
+	snapshots, err := f.worldSnapshots(ctx, name)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot = snapshots[0]
+	fs.Infof(f, "Stored snapshot %q of world %q with %d files in %d directories", name, f.opt.World, snapshot.Files, snapshot.Dirs)
+	return snapshot, nil
+}
+
+// restoreWorld rolls the world back to the snapshot called name,
+// which may be of another world.
+//
+// Nodes which only exist in this world are deleted and the rest are
+// taken out of it, then the nodes of the snapshot are put back with the
+// content and metadata they had. Nodes which still exist in other
+// worlds are shared with them again rather than copied.
+func (f *Fs) restoreWorld(ctx context.Context, name string) (snapshot worldSnapshot, err error) {
+	snapshots, err := f.worldSnapshots(ctx, name)
+	if err != nil {
+		return snapshot, err
+	}
+	if len(snapshots) == 0 {
+		return snapshot, fmt.Errorf("no world snapshot called %q", name)
+	}
+	snapshot = snapshots[0]
+	key := worldKey(f.opt.World)
+	tx, err := f.db.BeginTx(ctx, nil)
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to restore world: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var root string
+	err = tx.QueryRowContext(ctx, `SELECT id FROM nodes WHERE path = '/' ORDER BY id LIMIT 1`).Scan(&root)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errors.New("world has no root")
+	}
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to restore world: %w", err)
+	}
+	for _, query := range []string{`
+DELETE FROM nodes WHERE path <> '/' AND json_extract(existence_map, ?1) = 1
+AND NOT EXISTS (SELECT 1 FROM json_each(existence_map) WHERE value = 1 AND key <> ?4)`, `
+UPDATE nodes SET existence_map = json_set(existence_map, ?1, json('false'))
+WHERE path <> '/' AND json_extract(existence_map, ?1) = 1`, `
+INSERT INTO nodes (` + nodeColumns + `)
+SELECT id, CASE WHEN parent_path = '/' THEN ?3 ELSE parent_id END, name, path, parent_path, type,
+	depth_level, size, last_updated, checksum, json_object(?4, json('true'))
+FROM spectra_world_snapshot_nodes WHERE snapshot = ?2
+ON CONFLICT (id) DO UPDATE SET
+	parent_id = excluded.parent_id, name = excluded.name, path = excluded.path,
+	parent_path = excluded.parent_path, depth_level = excluded.depth_level, size = excluded.size,
+	last_updated = excluded.last_updated, checksum = excluded.checksum,
+	existence_map = json_set(nodes.existence_map, ?1, json('true'))`, `
+DELETE FROM spectra_file_blobs
+WHERE node_id NOT IN (SELECT id FROM nodes) OR node_id IN (SELECT id FROM spectra_world_snapshot_nodes WHERE snapshot = ?2)`, `
+INSERT INTO spectra_file_blobs (node_id, sha256)
+SELECT id, sha256 FROM spectra_world_snapshot_nodes WHERE snapshot = ?2 AND sha256 IS NOT NULL`, `
+DELETE FROM spectra_attributes
+WHERE node_id NOT IN (SELECT id FROM nodes) OR node_id IN (SELECT id FROM spectra_world_snapshot_nodes WHERE snapshot = ?2)`, `
+INSERT INTO spectra_attributes (node_id, key, value)
+SELECT n.id, a.key, a.value FROM spectra_world_snapshot_nodes n, json_each(n.attributes) a WHERE n.snapshot = ?2`,
+	} {
+		if _, err = tx.ExecContext(ctx, query, key, name, root, f.opt.World); err != nil {
+			return snapshot, fmt.Errorf("failed to restore world: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return snapshot, fmt.Errorf("failed to restore world: %w", err)
+	}
+	// What the remote has moved, hidden and added is gone with the nodes
+	f.forgetMovesWithin("/")
+	f.forgetExtraWithin("/")
+	f.rollupMu.Lock()
+	clear(f.rolledUp)
+	f.rollupMu.Unlock()
+	fs.Infof(f, "Restored world %q from snapshot %q of world %q", f.opt.World, name, snapshot.World)
+	return snapshot, nil
+}
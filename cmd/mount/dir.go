@@ -34,6 +34,7 @@ func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) (err error) {
 	a.Valid = time.Duration(d.fsys.opt.AttrTimeout)
 	a.Gid = d.VFS().Opt.GID
 	a.Uid = d.VFS().Opt.UID
+	a.Inode = mountlib.StableInode(d.Dir)
 	a.Mode = d.Mode()
 	modTime := d.ModTime()
 	a.Atime = modTime
@@ -123,9 +124,9 @@ func (d *Dir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error)
 			continue
 		}
 		var dirent = fuse.Dirent{
-			// Inode FIXME ???
-			Type: fuse.DT_File,
-			Name: name,
+			Inode: mountlib.StableInode(node),
+			Type:  fuse.DT_File,
+			Name:  name,
 		}
 		if node.IsDir() {
 			dirent.Type = fuse.DT_Dir
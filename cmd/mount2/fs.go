@@ -75,6 +75,7 @@ func setAttr(node vfs.Node, attr *fuse.Attr) {
 	vfs := node.VFS()
 	attr.Owner.Gid = vfs.Opt.GID
 	attr.Owner.Uid = vfs.Opt.UID
+	attr.Ino = mountlib.StableInode(node)
 	attr.Mode = getMode(node)
 	attr.Size = Size
 	attr.Nlink = 1
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/vfs"
 )
 
 // ClipBlocks clips the blocks pointed to the OS max
@@ -34,6 +35,15 @@ func ClipBlocks(b *uint64) {
 	}
 }
 
+// StableInode returns the inode number of node if its backend supplies
+// stable inode numbers with fs.Inoder, or 0 to let FUSE number it
+func StableInode(node vfs.Node) uint64 {
+	if do, ok := node.DirEntry().(fs.Inoder); ok && do.Inode() != 0 {
+		return node.Inode()
+	}
+	return 0
+}
+
 // CheckOverlap checks that root doesn't overlap with a mountpoint
 func CheckOverlap(f fs.Fs, mountpoint string) error {
 	name := f.Name()
@@ -0,0 +1,37 @@
+package mountlib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/cmd/mountlib"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNode is a VFS node with the given entry and VFS inode number
+type testNode struct {
+	vfs.Node
+	entry fs.DirEntry
+	inode uint64
+}
+
+func (n testNode) DirEntry() fs.DirEntry { return n.entry }
+func (n testNode) Inode() uint64         { return n.inode }
+
+// inodeObject is an object which supplies its own inode number
+type inodeObject struct {
+	fs.Object
+	inode uint64
+}
+
+func (o inodeObject) Inode() uint64 { return o.inode }
+
+func TestStableInode(t *testing.T) {
+	// Only backends supplying inode numbers get them passed on
+	assert.Equal(t, uint64(1234), mountlib.StableInode(testNode{entry: inodeObject{inode: 1234}, inode: 1234}))
+	assert.Equal(t, uint64(0), mountlib.StableInode(testNode{entry: inodeObject{}, inode: 7}))
+	assert.Equal(t, uint64(0), mountlib.StableInode(testNode{entry: fs.NewDir("dir", time.Time{}), inode: 7}))
+	assert.Equal(t, uint64(0), mountlib.StableInode(testNode{inode: 7}))
+}
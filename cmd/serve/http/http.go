@@ -350,6 +350,9 @@ func (s *HTTP) serveFile(w http.ResponseWriter, r *http.Request, remote string)
 		w.Header().Set("Content-Type", mimeType)
 	}
 
+	// Set caching headers
+	serve.SetCacheHeaders(r.Context(), w, obj)
+
 	// Set the Last-Modified header to the timestamp
 	w.Header().Set("Last-Modified", file.ModTime().UTC().Format(http.TimeFormat))
 
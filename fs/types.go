@@ -169,6 +169,12 @@ type IDer interface {
 	ID() string
 }
 
+// Inoder is an optional interface for Object and Directory
+type Inoder interface {
+	// Inode returns a stable inode number for the item, or 0 if not known
+	Inode() uint64
+}
+
 // ParentIDer is an optional interface for Object
 type ParentIDer interface {
 	// ParentID returns the ID of the parent directory if known or nil if not
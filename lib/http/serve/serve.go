@@ -2,6 +2,7 @@
 package serve
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +13,26 @@ import (
 	"github.com/rclone/rclone/fs/accounting"
 )
 
+// SetCacheHeaders sets the Cache-Control and Expires headers from
+// the metadata of o if it has them. The metadata is only read from
+// backends which can read it.
+func SetCacheHeaders(ctx context.Context, w http.ResponseWriter, o fs.Object) {
+	if info := o.Fs(); info == nil || !info.Features().ReadMetadata {
+		return
+	}
+	metadata, err := fs.GetMetadata(ctx, o)
+	if err != nil {
+		fs.Debugf(o, "Failed to read metadata for caching headers: %v", err)
+		return
+	}
+	if cacheControl, ok := metadata["cache-control"]; ok {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if expires, ok := metadata["expires"]; ok {
+		w.Header().Set("Expires", expires)
+	}
+}
+
 // Object serves an fs.Object via HEAD or GET
 func Object(w http.ResponseWriter, r *http.Request, o fs.Object) {
 	if r.Method != "HEAD" && r.Method != "GET" {
@@ -38,6 +38,14 @@ func TestObjectHEAD(t *testing.T) {
 	assert.Equal(t, "", string(body))
 }
 
+func TestSetCacheHeadersNoMetadata(t *testing.T) {
+	w := httptest.NewRecorder()
+	o := mockobject.New("aFile")
+	SetCacheHeaders(context.Background(), w, o)
+	assert.Empty(t, w.Header().Get("Cache-Control"))
+	assert.Empty(t, w.Header().Get("Expires"))
+}
+
 func TestObjectGET(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "http://example.com/aFile", nil)
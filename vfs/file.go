@@ -69,7 +69,7 @@ func newFile(d *Dir, dPath string, o fs.Object, leaf string) *File {
 		dPath: dPath,
 		o:     o,
 		leaf:  leaf,
-		inode: newInode(),
+		inode: newInodeFor(o),
 	}
 	if o != nil {
 		f.size.Store(o.Size())
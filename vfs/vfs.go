@@ -464,6 +464,17 @@ func newInode() (inode uint64) {
 	return inodeCount.Add(1)
 }
 
+// newInodeFor returns the inode number supplied by item if it
+// implements fs.Inoder, otherwise a new unique inode number
+func newInodeFor(item any) (inode uint64) {
+	if do, ok := item.(fs.Inoder); ok {
+		if inode = do.Inode(); inode != 0 {
+			return inode
+		}
+	}
+	return newInode()
+}
+
 // Stat finds the Node by path starting from the root
 //
 // It is the equivalent of os.Stat - Node contains the os.FileInfo
@@ -159,6 +159,25 @@ func TestVFSNew(t *testing.T) {
 	checkActiveCacheEntries(0)
 }
 
+// inodeDir is a directory which supplies its own inode number
+type inodeDir struct {
+	fs.Directory
+	inode uint64
+}
+
+func (d inodeDir) Inode() uint64 { return d.inode }
+
+func TestNewInodeFor(t *testing.T) {
+	a := newInodeFor(nil)
+	b := newInodeFor(fs.NewDir("dir", t1))
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, uint64(1<<62|1234), newInodeFor(inodeDir{inode: 1<<62 | 1234}))
+	// A zero inode from the backend means unknown
+	c := newInodeFor(inodeDir{})
+	assert.NotEqual(t, uint64(0), c)
+	assert.NotEqual(t, b, c)
+}
+
 // TestVFSNewWithOpts sees if the New command works properly
 func TestVFSNewWithOpts(t *testing.T) {
 	var opt = vfscommon.Opt